@@ -13,7 +13,8 @@ package main
 //   - The benchmark does not connect to or mutate the production "fpki" schema.
 //   - Every benchmark sample creates its own fresh schema through createBenchmarkDB.
 //   - createBenchmarkDB executes the embedded create_schema.sh helper by writing exactly
-//     "create_new_db <dbName>" to its stdin, where <dbName> always comes from benchmarkDBName.
+//     "create_new_db <dbName>" to its stdin, where <dbName> always comes from benchmarkDBName,
+//     and then applies the schema migrations of pkg/db/mysql to that database.
 //   - benchmarkDBName always prefixes schemas with "bench_coalesce_", so this command only
 //     creates benchmark-specific databases such as "bench_coalesce_old_small_pair_01_step_1".
 //   - Unless -keep-databases is set, each temporary benchmark schema is dropped after the run.
@@ -524,13 +525,13 @@ func runFullSample(cfg *config, fx *fixture, v variant, runLabel string, record
 	ctx, cancel := context.WithTimeout(context.Background(), fullRunTimeout)
 	defer cancel()
 
-	if err := installProcedure(ctx, conn.DB(), v); err != nil {
+	if err := installProcedure(ctx, conn, v); err != nil {
 		return runResult{}, err
 	}
-	if err := loadFixture(ctx, conn.DB(), fx.Files); err != nil {
+	if err := loadFixture(ctx, conn, fx.Files); err != nil {
 		return runResult{}, err
 	}
-	if err := verifyFixtureCounts(ctx, conn.DB(), fx); err != nil {
+	if err := verifyFixtureCounts(ctx, conn, fx); err != nil {
 		return runResult{}, err
 	}
 
@@ -543,12 +544,12 @@ func runFullSample(cfg *config, fx *fixture, v variant, runLabel string, record
 	defer measuredConn.Close()
 
 	start := time.Now()
-	if err := runCoalescingWithWorkers(ctx, measuredConn.DB(), v, cfg.CoalesceWorkers); err != nil {
+	if err := runCoalescingWithWorkers(ctx, measuredConn, v, cfg.CoalesceWorkers); err != nil {
 		return runResult{}, err
 	}
 	elapsed := time.Since(start)
 
-	result, err := collectAndValidateFullRun(ctx, measuredConn.DB(), fx, v, runLabel, elapsed)
+	result, err := collectAndValidateFullRun(ctx, measuredConn, fx, v, runLabel, elapsed)
 	if err != nil {
 		return runResult{}, err
 	}
@@ -642,6 +643,15 @@ func createBenchmarkDB(dbName string) error {
 	if err := cmd.Wait(); err != nil {
 		return fmt.Errorf("create db %s: %w\n%s", dbName, err, output.String())
 	}
+
+	conn, err := connectBenchmarkDB(dbName)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := mysql.Migrate(context.Background(), conn, 0); err != nil {
+		return fmt.Errorf("migrate db %s: %w", dbName, err)
+	}
 	return nil
 }
 
@@ -655,14 +665,20 @@ func dropBenchmarkDB(dbName string) error {
 	return err
 }
 
-func connectBenchmarkDB(dbName string) (db.Conn, error) {
+// connectBenchmarkDB returns the SQL DB of a MySQL connection, as the benchmarked stored
+// procedures are specific to MySQL.
+func connectBenchmarkDB(dbName string) (*sql.DB, error) {
 	cfg := db.NewConfig(
 		mysql.WithDefaults(),
 		mysql.WithLocalSocket("/var/run/mysqld/mysqld.sock"),
 		mysql.WithEnvironment(),
 		db.WithDB(dbName),
 	)
-	return mysql.Connect(cfg)
+	conn, err := mysql.Connect(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return conn.DB(), nil
 }
 
 func benchmarkAdminDSN() string {
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// decodedRecords implements the decoding part of the inputFormat interface for the formats
+// whose records are already decoded when splitting the file: the certificate payload is in the
+// certField of the line, and those of its chain in its chain field.
+type decodedRecords struct{}
+
+func (decodedRecords) expiration(*line) (int64, bool, error) { return 0, false, nil }
+
+func (decodedRecords) decodeCert(l *line) ([]byte, error) { return l.certField, nil }
+
+func (decodedRecords) decodeChain(l *line) ([][]byte, error) { return l.chain, nil }
+
+// pemFormat is the format of the PEM bundles, with the certificate followed by its chain, e.g.
+// as served by a TLS server. Each file is one record.
+type pemFormat struct{ decodedRecords }
+
+func (pemFormat) name() string { return "pem" }
+
+func (pemFormat) detect(head []byte) bool {
+	return bytes.HasPrefix(trimmedHead(head), []byte("-----BEGIN"))
+}
+
+func (pemFormat) split(
+	r *bufio.Reader,
+	filename string,
+	emit func(line),
+	_ func(line, error) error,
+) error {
+	var payloads [][]byte
+	err := readPEMCertificates(r, filename, func(der []byte) {
+		payloads = append(payloads, der)
+	})
+	if err != nil {
+		return err
+	}
+	if len(payloads) == 0 {
+		return fmt.Errorf("no certificates in %s", filename)
+	}
+	emit(line{
+		certField: payloads[0],
+		chain:     payloads[1:],
+		number:    1,
+	})
+	return nil
+}
+
+// certWriterFormat is the format of the streams written by util.CertWriter: a sequence of
+// independent PEM certificates, each one a record without chain. As it has the same encoding
+// as pemFormat, it is never detected and must be selected explicitly.
+type certWriterFormat struct{ decodedRecords }
+
+func (certWriterFormat) name() string { return "certwriter" }
+
+func (certWriterFormat) detect([]byte) bool { return false }
+
+func (certWriterFormat) split(
+	r *bufio.Reader,
+	filename string,
+	emit func(line),
+	_ func(line, error) error,
+) error {
+	number := 0
+	return readPEMCertificates(r, filename, func(der []byte) {
+		number++
+		emit(line{
+			certField: der,
+			number:    number,
+		})
+	})
+}
+
+// derFormat is the format of the files with one DER encoded certificate each, as those of a
+// directory of certificates. Each file is one record without chain.
+type derFormat struct{ decodedRecords }
+
+func (derFormat) name() string { return "der" }
+
+// detect returns true if the content starts like an ASN.1 SEQUENCE with a long form length,
+// as all certificates do. The length byte is never printable, which rules out text formats.
+func (derFormat) detect(head []byte) bool {
+	return len(head) > 1 && head[0] == 0x30 && head[1]&0x80 != 0
+}
+
+func (derFormat) split(
+	r *bufio.Reader,
+	filename string,
+	emit func(line),
+	_ func(line, error) error,
+) error {
+	payload, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", filename, err)
+	}
+	if len(payload) == 0 {
+		return fmt.Errorf("no certificate in %s", filename)
+	}
+	emit(line{
+		certField: payload,
+		number:    1,
+	})
+	return nil
+}
+
+// jsonLinesFormat is the format of the JSON lines outputs of scans, with one object per line
+// and record, of the form {"cert": "<base64 DER>", "chain": ["<base64 DER>", ...]}.
+type jsonLinesFormat struct{ decodedRecords }
+
+// jsonLinesRecord is one line of the jsonLinesFormat.
+type jsonLinesRecord struct {
+	Cert  []byte   `json:"cert"`
+	Chain [][]byte `json:"chain"`
+}
+
+func (jsonLinesFormat) name() string { return "jsonl" }
+
+func (jsonLinesFormat) detect(head []byte) bool {
+	return bytes.HasPrefix(trimmedHead(head), []byte("{"))
+}
+
+func (jsonLinesFormat) split(
+	r *bufio.Reader,
+	filename string,
+	emit func(line),
+	malformed func(line, error) error,
+) error {
+	for lineNo := 1; ; lineNo++ {
+		rawLine, readErr := r.ReadBytes('\n')
+		if readErr != nil && !errors.Is(readErr, io.EOF) {
+			return fmt.Errorf("reading %s: %w", filename, readErr)
+		}
+		if rawLine = bytes.TrimSpace(rawLine); len(rawLine) > 0 {
+			var record jsonLinesRecord
+			err := json.Unmarshal(rawLine, &record)
+			if err != nil {
+				err = fmt.Errorf("%s at line %d: %w", filename, lineNo, err)
+			} else if len(record.Cert) == 0 {
+				err = fmt.Errorf("%s at line %d: no certificate", filename, lineNo)
+			}
+			if err != nil {
+				if malformed == nil {
+					return err
+				}
+				if err := malformed(line{row: rawLine, number: lineNo}, err); err != nil {
+					return err
+				}
+			} else {
+				emit(line{
+					certField: record.Cert,
+					chain:     record.Chain,
+					number:    lineNo,
+				})
+			}
+		}
+		if errors.Is(readErr, io.EOF) {
+			return nil
+		}
+	}
+}
+
+// readPEMCertificates calls yield with the DER payload of each CERTIFICATE PEM block of the
+// reader, in order. Other PEM blocks and text between blocks are ignored.
+func readPEMCertificates(r *bufio.Reader, filename string, yield func([]byte)) error {
+	var block []byte // The lines of the current block, nil if outside of one.
+	for {
+		rawLine, readErr := r.ReadBytes('\n')
+		if readErr != nil && !errors.Is(readErr, io.EOF) {
+			return fmt.Errorf("reading %s: %w", filename, readErr)
+		}
+		trimmed := bytes.TrimSpace(rawLine)
+		switch {
+		case bytes.HasPrefix(trimmed, []byte("-----BEGIN ")):
+			block = append(block[:0], rawLine...)
+		case block != nil:
+			block = append(block, rawLine...)
+			if bytes.HasPrefix(trimmed, []byte("-----END ")) {
+				p, _ := pem.Decode(block)
+				if p == nil {
+					return fmt.Errorf("malformed PEM block in %s", filename)
+				}
+				if p.Type == "CERTIFICATE" {
+					yield(p.Bytes)
+				}
+				block = nil
+			}
+		}
+		if errors.Is(readErr, io.EOF) {
+			if block != nil {
+				return fmt.Errorf("reading %s: %w", filename, io.ErrUnexpectedEOF)
+			}
+			return nil
+		}
+	}
+}
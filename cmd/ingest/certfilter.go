@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/netsec-ethz/fpki/pkg/cache"
+	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/db"
+	"github.com/netsec-ethz/fpki/pkg/mapserver/updater"
+)
+
+const (
+	// CertFilterFPRate is the false positive rate of the certificate filters created by ingest,
+	// while holding at most their capacity.
+	CertFilterFPRate = 1e-9
+	// certFilterPageSize is the number of rows of the certs table read at once to rebuild the
+	// certificate filter.
+	certFilterPageSize = 100_000
+)
+
+// certFilter drops the certificates already ingested before parsing them. Its persistent Bloom
+// filter holds the IDs of the certificates committed to the DB by previous batches. The IDs of
+// the certificates sent to the DB by the running batch are staged in a file next to the filter,
+// and only added to it once the batch succeeds, so that a failed batch is ingested again in
+// full. A false positive drops a certificate that was never ingested, thus the filter must be
+// sized for the certificates of the DB. The filter is tagged with the identity of its DB, so
+// that it is never used with another one, e.g. after the DB is recreated.
+// A certFilter can be used concurrently by several workers.
+type certFilter struct {
+	filter *cache.BloomFilter
+
+	mu     sync.Mutex
+	staged *os.File // nil if the filter is only read, e.g. in a dry run.
+	w      *bufio.Writer
+}
+
+// openCertFilter opens the certificate filter of the configuration, first rebuilding it from
+// the certs table if requested, or if it was built for another DB. A missing filter is created
+// empty with the configured capacity.
+// It returns nil if there is no filter, or if a dry run, which only reads it, finds none. A dry
+// run opens the filter read-only, and has no DB to check it against.
+// The IDs staged by a previous run, whose batch did not finish, are discarded.
+func openCertFilter(ctx context.Context, cfg RunConfig, conn db.Conn) (*certFilter, error) {
+	if cfg.CertFilter == "" {
+		return nil, nil
+	}
+	if cfg.dryRun() {
+		filter, err := cache.OpenBloomFilterReadOnly(cfg.CertFilter)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &certFilter{
+			filter: filter,
+		}, nil
+	}
+	identity, err := conn.Identity(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.RebuildCertFilter {
+		err := rebuildCertFilter(ctx, conn, cfg.CertFilter, cfg.CertFilterSize, identity)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	filter, err := cache.OpenBloomFilter(cfg.CertFilter, cfg.CertFilterSize, CertFilterFPRate)
+	if err != nil {
+		return nil, err
+	}
+	if filter.Tag() != identity {
+		if filter.Count() == 0 {
+			// A new filter, which drops nothing yet.
+			filter.SetTag(identity)
+		} else {
+			// Its certificates may be missing from the DB, and would never be ingested.
+			filter.Close()
+			fmt.Fprintf(os.Stderr, "certificate filter %s was built for another DB\n",
+				cfg.CertFilter)
+			err := rebuildCertFilter(ctx, conn, cfg.CertFilter, cfg.CertFilterSize, identity)
+			if err != nil {
+				return nil, err
+			}
+			filter, err = cache.OpenBloomFilter(cfg.CertFilter, cfg.CertFilterSize,
+				CertFilterFPRate)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if filter.Count() > filter.Capacity() {
+		fmt.Fprintf(os.Stderr, "certificate filter %s holds %d certificates, more than its "+
+			"capacity %d: rebuild it larger to keep false positives rare\n",
+			cfg.CertFilter, filter.Count(), filter.Capacity())
+	}
+	f := &certFilter{
+		filter: filter,
+	}
+	f.staged, err = os.OpenFile(cfg.CertFilter+".staged", os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+	if err != nil {
+		filter.Close()
+		return nil, fmt.Errorf("opening staged certificate IDs: %w", err)
+	}
+	f.w = bufio.NewWriter(f.staged)
+	return f, nil
+}
+
+// rebuildCertFilter replaces the filter in the file with one sized for capacity certificates,
+// holding the IDs of all the certificates of the certs table and tagged with the identity of
+// the DB. The filter is replaced only once complete.
+func rebuildCertFilter(
+	ctx context.Context,
+	conn db.Conn,
+	filename string,
+	capacity uint64,
+	identity db.Identity,
+) error {
+	tmp := filename + ".rebuild"
+	filter, err := cache.CreateBloomFilter(tmp, capacity, CertFilterFPRate)
+	if err != nil {
+		return err
+	}
+	filter.SetTag(identity)
+	fmt.Printf("rebuilding certificate filter %s from the certs table\n", filename)
+	err = addCertsTableToFilter(ctx, conn, filter)
+	if cerr := filter.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("rebuilding certificate filter: %w", err)
+	}
+	fmt.Printf("certificate filter %s rebuilt with %d certificates\n", filename, filter.Count())
+	return os.Rename(tmp, filename)
+}
+
+// addCertsTableToFilter adds the IDs of all the certificates of the certs table to the filter.
+func addCertsTableToFilter(ctx context.Context, conn db.Conn, filter *cache.BloomFilter) error {
+	var after *common.SHA256Output
+	for {
+		rows, err := conn.RetrieveCertificateParentsPage(ctx, after, certFilterPageSize)
+		if err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			return nil
+		}
+		for i := range rows {
+			filter.AddIDs(&rows[i].ID)
+		}
+		after = &rows[len(rows)-1].ID
+	}
+}
+
+// Contains returns true if the certificate was committed by a previous batch or, rarely, if it
+// is a false positive of the filter.
+func (f *certFilter) Contains(id *common.SHA256Output) bool {
+	return f.filter.Contains(id)
+}
+
+// stage records the IDs of the certificates sent to the DB by the running batch.
+func (f *certFilter) stage(certs []updater.Certificate) error {
+	if f.w == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range certs {
+		if _, err := f.w.Write(certs[i].CertID[:]); err != nil {
+			return fmt.Errorf("staging certificate IDs: %w", err)
+		}
+	}
+	return nil
+}
+
+// finishBatch adds the staged IDs to the filter if the batch succeeded, i.e. err is nil, or
+// discards them otherwise. It returns err, or the error adding the IDs. It is safe to call on a
+// nil filter.
+func (f *certFilter) finishBatch(err error) error {
+	if f == nil || f.w == nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err == nil {
+		err = f.commitStaged()
+	}
+	f.w.Reset(f.staged)
+	if _, serr := f.staged.Seek(0, io.SeekStart); err == nil {
+		err = serr
+	}
+	if terr := f.staged.Truncate(0); err == nil {
+		err = terr
+	}
+	return err
+}
+
+// commitStaged reads back the staged IDs, adds them to the filter and syncs it.
+func (f *certFilter) commitStaged() error {
+	if err := f.w.Flush(); err != nil {
+		return fmt.Errorf("staging certificate IDs: %w", err)
+	}
+	if _, err := f.staged.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("reading staged certificate IDs: %w", err)
+	}
+	r := bufio.NewReader(f.staged)
+	var id common.SHA256Output
+	for {
+		_, err := io.ReadFull(r, id[:])
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading staged certificate IDs: %w", err)
+		}
+		f.filter.AddIDs(&id)
+	}
+	return f.filter.Sync()
+}
+
+// Close discards the IDs still staged and closes the filter. It is safe to call on a nil
+// filter.
+func (f *certFilter) Close() error {
+	if f == nil {
+		return nil
+	}
+	if f.staged != nil {
+		f.staged.Close()
+		os.Remove(f.staged.Name())
+	}
+	return f.filter.Close()
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	ctx509 "github.com/google/certificate-transparency-go/x509"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/db"
+	"github.com/netsec-ethz/fpki/pkg/db/embedded"
+	"github.com/netsec-ethz/fpki/pkg/mapserver/updater"
+	"github.com/netsec-ethz/fpki/pkg/statistics"
+	"github.com/netsec-ethz/fpki/pkg/tests/noopdb"
+	"github.com/netsec-ethz/fpki/pkg/tests/random"
+	"github.com/netsec-ethz/fpki/pkg/util"
+)
+
+// TestCertFilter checks that the certificates of the filter are dropped before ingesting them,
+// that only those of the successful batches are added to it, and that it is rebuilt from the
+// certs table.
+func TestCertFilter(t *testing.T) {
+	ctx, cancelF := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelF()
+
+	conn, err := embedded.Connect(db.NewConfig(embedded.WithDirectory(t.TempDir())))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	a := random.RandomX509Cert(t, "a.com")
+	b := random.RandomX509Cert(t, "b.com")
+	c := random.RandomX509Cert(t, "c.com")
+	issuer := random.RandomX509Cert(t, "issuer.com")
+	id := func(cert ctx509.Certificate) common.SHA256Output {
+		return common.SHA256Hash32Bytes(cert.Raw)
+	}
+	aID, bID, cID, issuerID := id(a), id(b), id(c), id(issuer)
+
+	dir := t.TempDir()
+	ingest := func(f *certFilter, certs ...ctx509.Certificate) error {
+		var rows []string
+		for _, cert := range certs {
+			rows = append(rows, ctCSVRow(base64.StdEncoding.EncodeToString(cert.Raw),
+				base64.StdEncoding.EncodeToString(issuer.Raw), "4000000000.0"))
+		}
+		file := filepath.Join(dir, "bundled", fmt.Sprintf("%d-%d.gz", 0, len(rows)-1))
+		writeCTBundle(t, file, rows...)
+
+		stats := statistics.NewStatistics(time.Hour, nil)
+		defer stats.Stop()
+		proc, err := NewProcessor(ctx, conn, 10, stats, WithStreamCsv(true), WithCertFilter(f))
+		require.NoError(t, err)
+		proc.AddCsvFiles([]util.CsvFile{loadInputFile(file)})
+		proc.Resume()
+		return f.finishBatch(proc.Wait())
+	}
+	inDB := func(ids ...common.SHA256Output) []bool {
+		exist, err := conn.CheckCertsExist(ctx, ids)
+		require.NoError(t, err)
+		return exist
+	}
+
+	cfg := RunConfig{
+		CertFilter:     filepath.Join(t.TempDir(), "certs.filter"),
+		CertFilterSize: 1000,
+	}
+	f, err := openCertFilter(ctx, cfg, conn)
+	require.NoError(t, err)
+	require.NoError(t, ingest(f, a))
+	require.True(t, f.Contains(&aID))
+	require.True(t, f.Contains(&issuerID))
+
+	// The IDs staged by a failed batch are discarded.
+	failure := errors.New("failure")
+	require.NoError(t, f.stage([]updater.Certificate{{CertID: bID}}))
+	require.ErrorIs(t, f.finishBatch(failure), failure)
+	require.False(t, f.Contains(&bID))
+
+	// The certificates of the filter are dropped, even if not in the DB.
+	f.filter.AddIDs(&cID)
+	require.NoError(t, ingest(f, b, c))
+	require.Equal(t, []bool{true, true, false}, inDB(aID, bID, cID))
+	require.True(t, f.Contains(&bID))
+	require.NoError(t, f.Close())
+
+	// The filter persists.
+	f, err = openCertFilter(ctx, cfg, conn)
+	require.NoError(t, err)
+	require.True(t, f.Contains(&aID))
+	require.True(t, f.Contains(&bID))
+	require.NoError(t, f.Close())
+
+	// Rebuilding the filter keeps only the certificates of the DB.
+	cfg.RebuildCertFilter = true
+	f, err = openCertFilter(ctx, cfg, conn)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), f.filter.Count())
+	require.True(t, f.Contains(&aID))
+	require.True(t, f.Contains(&bID))
+	require.True(t, f.Contains(&issuerID))
+	require.False(t, f.Contains(&cID))
+	require.NoError(t, f.Close())
+
+	// The filter of a DB that was recreated empty is rebuilt, or all its certificates would be
+	// dropped as already ingested.
+	cfg.RebuildCertFilter = false
+	require.NoError(t, conn.TruncateAllTables(ctx))
+	f, err = openCertFilter(ctx, cfg, conn)
+	require.NoError(t, err)
+	require.Zero(t, f.filter.Count())
+	require.False(t, f.Contains(&aID))
+	require.NoError(t, ingest(f, a))
+	require.Equal(t, []bool{true}, inDB(aID))
+	require.NoError(t, f.Close())
+
+	// Also if it is used with another DB.
+	other, err := embedded.Connect(db.NewConfig(embedded.WithDirectory(t.TempDir())))
+	require.NoError(t, err)
+	defer other.Close()
+	f, err = openCertFilter(ctx, cfg, other)
+	require.NoError(t, err)
+	require.Zero(t, f.filter.Count())
+	require.False(t, f.Contains(&aID))
+	require.NoError(t, f.Close())
+
+	// A dry run only reads the filter, without staging nor modifying it.
+	f, err = openCertFilter(ctx, cfg, other)
+	require.NoError(t, err)
+	f.filter.AddIDs(&aID)
+	require.NoError(t, f.Close())
+	filename := cfg.CertFilter
+	before, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	cfg = RunConfig{
+		Strategy:       DryRunStrategy,
+		CertFilter:     filename,
+		CertFilterSize: 1000,
+	}
+	f, err = openCertFilter(ctx, cfg, &noopdb.Conn{})
+	require.NoError(t, err)
+	require.True(t, f.Contains(&aID))
+	require.NoError(t, f.stage([]updater.Certificate{{CertID: aID}}))
+	require.NoError(t, f.finishBatch(nil))
+	require.NoError(t, f.Close())
+	after, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+	_, err = os.Stat(filename + ".staged")
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	// A dry run does not create the filter.
+	cfg.CertFilter = filepath.Join(t.TempDir(), "missing.filter")
+	f, err = openCertFilter(ctx, cfg, conn)
+	require.NoError(t, err)
+	require.Nil(t, f)
+	cfg.RebuildCertFilter = true
+	require.Error(t, cfg.validate())
+}
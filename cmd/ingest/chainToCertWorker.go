@@ -24,6 +24,11 @@ func NewChainToCertWorker(numWorker int, p *Processor) *chainToCertWorker {
 			// Obtain the certificates from the chain.
 			certs := updater.CertificatesFromChains((*updater.CertWithChainData)(&in))
 			// TODO: use a []Certificate storage cache here to avoid allocating.
+			if p.CertFilter != nil {
+				if err := p.CertFilter.stage(certs); err != nil {
+					return nil, nil, err
+				}
+			}
 
 			// Recreate channel indices, all to zero.
 			util.ResizeSlice(&w.channelsCache, len(certs), 0)
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"sync"
+	"time"
 )
 
 // Flags for the command line:
@@ -12,6 +13,7 @@ var (
 	CpuProfile      *string
 	MemProfile      *string
 	DBName          *string
+	DBDir           *string
 	MultiInsertSize *int
 	NumFiles        *int
 	NumParsers      *int
@@ -22,8 +24,27 @@ var (
 	JournalFile     *string
 	// IncludePlainCSVs restores the legacy behavior of also ingesting uncompressed
 	// bundle files alongside the default .gz input set.
-	IncludePlainCSVs *bool
-	SkipMissingFiles *bool
+	IncludePlainCSVs   *bool
+	SkipMissingFiles   *bool
+	StreamCsv          *bool
+	InputFormat        *string
+	OnError            *string
+	QuarantineFile     *string
+	Policies           *bool
+	TrustedPolicyRoots *string
+	CTLogURL           *string
+	CTLogStart         *int64
+	CTLogEnd           *int64
+	CTLogBatch         *int64
+	Job                *string
+	Coordinator        *bool
+	Worker             *string
+	Lease              *time.Duration
+	CertFilter         *string
+	CertFilterSize     *uint64
+	RebuildCertFilter  *bool
+	Cache              *string
+	CacheBytes         *int64
 )
 
 // Default values for the command line flags:
@@ -38,21 +59,35 @@ const (
 	DefMultiInsertSize = 10_000 // # of certificates, domains, etc inserted at once.
 
 	DefJournalFile = "fpki-journal.json"
+
+	DefQuarantineFile = "fpki-quarantine.jsonl"
+
+	DefCTLogBatch = 1_000_000 // # of CT log entries ingested before committing progress.
+
+	DefLease = 5 * time.Minute // Lease of the batches of a distributed ingest job.
+
+	DefCertFilterSize = 100_000_000 // # of certificates a new certificate filter is sized for.
+
+	DefCacheBytes = 1 << 30 // Memory budget of the bounded cache of certificate IDs.
 )
 
 var ConfigureFlags func() = sync.OnceFunc(_configureFlags)
 
 func _configureFlags() {
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage:\n%s directory\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage:\n%[1]s directory\n%[1]s -ctlog URL\n"+
+			"%[1]s -job NAME -coordinator directory\n%[1]s -job NAME\n"+
+			"%[1]s journal show|compact|verify|mark|unmark [flags]\n", os.Args[0])
 		flag.PrintDefaults()
 	}
 
 	CpuProfile = flag.String("cpuprofile", "", "write a CPU profile to file")
 	MemProfile = flag.String("memprofile", "", "write a memory profile to file")
 	DBName = flag.String("dbname", DefDBName, "database name to connect to")
+	DBDir = flag.String("dbdir", "", "use the embedded DB backend with its files in this "+
+		"directory, instead of connecting to MySQL")
 	MultiInsertSize = flag.Int("multiinsert", DefMultiInsertSize, "number of certificates and "+
-		"domains inserted at once in the DB")
+		"domains inserted at once in the DB, or of policy documents with -policies")
 	NumFiles = flag.Int("numfiles", DefNumFiles, "Number of parallel files being read at once")
 	NumParsers = flag.Int("numparsers", DefNumParsers, "Number of line parsers concurrently running")
 	NumChainToCerts = flag.Int("numdechainers", DefNumDechainers, "Number of chain unrollers")
@@ -62,7 +97,11 @@ func _configureFlags() {
 		"\"onlyingest\": do not coalesce or update SMT after ingesting files.\n"+
 		"\"skipingest\": only coalesce payloads of domains in the dirty table and update SMT.\n"+
 		"\"onlysmtupdate\": only update the SMT.\n"+
-		"\"recordctsize\": update ctlog_server_last_status from completed journal ranges.\n")
+		"\"recordctsize\": update ctlog_server_last_status from completed journal ranges.\n"+
+		"\"coverage\": print a JSON report of the missing, pending and overlapping ranges of "+
+		"the bundles, the journal and the CT log size recorded in the DB.\n"+
+		"\"dryrun\": read all the files and print a JSON report of what would be ingested, "+
+		"without writing to the DB or the journal.\n")
 	FileBatch = flag.Int("filebatch", 0, "process files in batches of this size. If zero, then "+
 		"all files are processed in one batch")
 	JournalFile = flag.String("journal", DefJournalFile,
@@ -72,5 +111,68 @@ func _configureFlags() {
 			"by default only .gz files are processed")
 	SkipMissingFiles = flag.Bool("skipmissingfiles", false,
 		"report missing input files and continue instead of failing the batch")
+	StreamCsv = flag.Bool("streamcsv", false,
+		"stream the rows to MySQL with LOAD DATA LOCAL (needs local_infile=ON), instead of "+
+			"writing temporary CSV files that MySQL reads from the same host")
+	InputFormat = flag.String("format", "ctcsv", "format of the input files:\n"+
+		"\"ctcsv\": CSV bundles of CT log entries, named after their indices.\n"+
+		"\"pem\": PEM files with a certificate followed by its chain.\n"+
+		"\"der\": DER files with one certificate each.\n"+
+		"\"jsonl\": JSON lines with {\"cert\": base64 DER, \"chain\": [base64 DER, ...]}.\n"+
+		"\"certwriter\": PEM streams of independent certificates, as written by util.CertWriter.\n"+
+		"\"auto\": detect the format of each file, except certwriter.\n"+
+		"Only the ctcsv files are journaled: the files in other formats are ingested at every run.")
+	OnError = flag.String("onerror", "fail", "what to do with the records of the input files "+
+		"that cannot be parsed:\n"+
+		"\"fail\": fail the batch.\n"+
+		"\"skip\": drop them and continue.\n"+
+		"\"quarantine\": write them to the -quarantine file, drop them and continue.\n"+
+		"The dropped rows are counted in the journal.")
+	QuarantineFile = flag.String("quarantine", DefQuarantineFile, "file where the malformed "+
+		"records are appended with -onerror quarantine, one JSON object per line")
+	Policies = flag.Bool("policies", false, "ingest the policy certificates and revocations of "+
+		"the .pc, .pcrev and .json files of the directory, and the .jsonl dumps with one per "+
+		"line, instead of certificates. Their issuer signatures and constraints are validated "+
+		"with the policy certificates of the same directory, or of the DB")
+	TrustedPolicyRoots = flag.String("trustedpolicyroots", "", "policy file, or directory of "+
+		"them, with the root policy certificates trusted by -policies. The other roots are "+
+		"invalid")
+	CTLogURL = flag.String("ctlog", "", "fetch and ingest the entries of this CT log URL, "+
+		"instead of the files of a directory")
+	CTLogStart = flag.Int64("ctstart", 0, "first index of the CT log entries to ingest")
+	CTLogEnd = flag.Int64("ctend", -1, "last index of the CT log entries to ingest. If "+
+		"negative, up to the current size of the CT log")
+	CTLogBatch = flag.Int64("ctbatch", DefCTLogBatch, "ingest the CT log entries in batches of "+
+		"this size, committing the progress to the journal after each one. If zero, all "+
+		"entries are ingested in one batch")
+	Job = flag.String("job", "", "work on the distributed ingest job with this name, whose "+
+		"batches of bundle files are claimed from the DB by any number of workers. Once all "+
+		"of them are done, one worker coalesces and updates the SMT as the strategy of the job "+
+		"requires")
+	Coordinator = flag.Bool("coordinator", false, "enqueue the pending bundles of the "+
+		"directory as the -job, with the -strategy and in batches of -filebatch files, work on "+
+		"it and commit its progress to the journal once it is finalized")
+	Worker = flag.String("worker", "", "name of this worker in the leases of the -job. If "+
+		"empty, the host name and process ID")
+	Lease = flag.Duration("lease", DefLease, "duration of the leases of the -job, renewed "+
+		"while working. The batches of a failed worker are claimed again once their lease "+
+		"expires")
+	CertFilter = flag.String("certfilter", "", "persistent filter file of the certificates "+
+		"already ingested, which are dropped before parsing them. The certificates of each "+
+		"batch are added to it once the batch succeeds. Created empty if missing")
+	CertFilterSize = flag.Uint64("certfiltersize", DefCertFilterSize, "number of certificates "+
+		"the -certfilter is sized for when created or rebuilt. Beyond it, certificates never "+
+		"ingested are more likely to be dropped as false positives")
+	RebuildCertFilter = flag.Bool("rebuildcertfilter", false, "rebuild the -certfilter from the "+
+		"certs table of the DB before ingesting, e.g. after the DB was restored or the filter "+
+		"lost")
+	Cache = flag.String("cache", "lru", "cache of the IDs of the certificates seen, whose "+
+		"chain certificates are not parsed again:\n"+
+		"\"lru\": each parse worker keeps the 10 million most recently used IDs.\n"+
+		"\"bounded\": the workers of a batch share one sharded cache of at most -cachebytes, "+
+		"which keeps the IDs found often, e.g. of intermediates, and counts its hits, misses "+
+		"and evictions in the statistics.")
+	CacheBytes = flag.Int64("cachebytes", DefCacheBytes, "memory budget in bytes of the "+
+		"-cache bounded, allocated for each batch")
 	flag.Parse()
 }
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+
+	"github.com/netsec-ethz/fpki/cmd/ingest/journal"
+)
+
+// CoverageStrategy is the strategy that reports the coverage of the CT log of the directory, or
+// of the CT log URL, by its bundle files, the journal and the CT log size recorded in the DB.
+// Nothing is ingested, and the journal is only read.
+const CoverageStrategy = "coverage"
+
+// coverageReport is the report of the coverage strategy, with the intervals in the inclusive
+// `A-B` form of the journal.
+type coverageReport struct {
+	Key                 string                       `json:"key"`
+	CTLogURL            string                       `json:"ct_log_url,omitempty"`
+	RecordedCTLogSize   int64                        `json:"recorded_ct_log_size"`
+	CompletedSize       int64                        `json:"completed_size"`
+	Bundles             []string                     `json:"bundles"`
+	Completed           []string                     `json:"completed"`
+	Missing             []string                     `json:"missing"`
+	Pending             []string                     `json:"pending"`
+	Holes               []string                     `json:"holes"`
+	Overlaps            []coverageOverlap            `json:"overlaps"`
+	InconsistentBundles []coverageInconsistentBundle `json:"inconsistent_bundles"`
+}
+
+type coverageOverlap struct {
+	Files    [2]string `json:"files"`
+	Interval string    `json:"interval"`
+}
+
+type coverageInconsistentBundle struct {
+	File   string `json:"file"`
+	Reason string `json:"reason"`
+}
+
+func newCoverageReport(ctLogURL string, c journal.Coverage) coverageReport {
+	report := coverageReport{
+		Key:                 c.Key,
+		CTLogURL:            ctLogURL,
+		RecordedCTLogSize:   c.RecordedCTLogSize,
+		CompletedSize:       c.CompletedSize(),
+		Bundles:             intervalStrings(c.Bundles),
+		Completed:           intervalStrings(c.Completed),
+		Missing:             intervalStrings(c.Missing),
+		Pending:             intervalStrings(c.Pending),
+		Holes:               intervalStrings(c.Holes()),
+		Overlaps:            make([]coverageOverlap, len(c.Overlaps)),
+		InconsistentBundles: make([]coverageInconsistentBundle, len(c.Inconsistent)),
+	}
+	for i, overlap := range c.Overlaps {
+		report.Overlaps[i] = coverageOverlap{
+			Files:    overlap.Files,
+			Interval: overlap.Interval.String(),
+		}
+	}
+	for i, bundle := range c.Inconsistent {
+		report.InconsistentBundles[i] = coverageInconsistentBundle{
+			File:   bundle.File,
+			Reason: bundle.Reason,
+		}
+	}
+	return report
+}
+
+// writeCoverageReport writes the report as indented JSON.
+func writeCoverageReport(w io.Writer, report coverageReport) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+func intervalStrings(intervals []journal.Interval) []string {
+	strs := make([]string, len(intervals))
+	for i, interval := range intervals {
+		strs[i] = interval.String()
+	}
+	return strs
+}
+
+// reportCoverage reports the coverage of the CT log of the configuration with
+// deps.ReportCoverage. The journal is read without appending a job to it. The CT log size
+// recorded in the DB is only compared if the URL of the CT log is known, i.e. it is either
+// configured or derived from the name of the directory.
+func reportCoverage(ctx context.Context, cfg RunConfig, deps RunDependencies) error {
+	if deps.ReportCoverage == nil {
+		return fmt.Errorf("missing coverage report dependency")
+	}
+
+	ctLogURL, key := cfg.CTLogURL, cfg.CTLogURL
+	var files []string
+	if ctLogURL == "" {
+		key = filepath.Base(filepath.Clean(cfg.Directory))
+		if url, err := deriveCTLogURLFromIngestDir(cfg.Directory); err == nil {
+			ctLogURL = url
+		}
+		gzFiles, csvFiles, err := journal.ListCsvFiles(cfg.Directory)
+		if err != nil {
+			return err
+		}
+		files = gzFiles
+		if cfg.IncludePlainCSVs {
+			files = append(files, csvFiles...)
+		}
+	}
+
+	j, err := journal.ReadJournal(cfg.JournalFile)
+	if err != nil {
+		return err
+	}
+	var completed []journal.Interval
+	if len(j.Jobs) > 0 {
+		completed = j.Jobs[len(j.Jobs)-1].CompletedIndices[key]
+	}
+
+	var recordedSize int64
+	if ctLogURL != "" && deps.RecordedCTSize != nil {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if recordedSize, err = deps.RecordedCTSize(ctx, ctLogURL); err != nil {
+			return fmt.Errorf("coverage: reading CT log size of %q: %w", ctLogURL, err)
+		}
+	}
+
+	coverage := journal.NewCoverage(key, files, completed, recordedSize)
+	return deps.ReportCoverage(newCoverageReport(ctLogURL, coverage))
+}
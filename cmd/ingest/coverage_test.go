@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/netsec-ethz/fpki/cmd/ingest/journal"
+	"github.com/netsec-ethz/fpki/pkg/db"
+	"github.com/netsec-ethz/fpki/pkg/db/embedded"
+)
+
+// TestRunIngestCoverage checks that the coverage strategy compares the bundles, the journal and
+// the CT log size recorded in the DB without modifying the journal, and that recordctsize is
+// refused while the completed indices have holes.
+func TestRunIngestCoverage(t *testing.T) {
+	ctx, cancelF := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelF()
+
+	conn, err := embedded.Connect(db.NewConfig(embedded.WithDirectory(t.TempDir())))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	dirBase := "https:__ct.example.com_log"
+	dir := filepath.Join(t.TempDir(), dirBase)
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "bundled"), 0o755))
+	for _, name := range []string{"0-9.gz", "10-19.gz", "15-24.gz", "40-49.gz"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "bundled", name), nil, 0o644))
+	}
+	const ctLogURL = "https://ct.example.com/log"
+	require.NoError(t, conn.UpdateLastCTlogServerState(ctx, ctLogURL, 55, nil))
+
+	cfg := newTestRunConfig(dir, filepath.Join(t.TempDir(), "journal.json"), 0, "recordctsize")
+	j := loadJournalForTest(t, cfg)
+	latestJobForTest(t, j).CompletedIndices = journal.CompletedIndices{
+		dirBase: {
+			{Start: 0, End: 9},
+			{Start: 40, End: 49},
+		},
+	}
+	require.NoError(t, j.Close())
+	journalBefore, err := os.ReadFile(cfg.JournalFile)
+	require.NoError(t, err)
+
+	var report bytes.Buffer
+	var recorded bool
+	deps := RunDependencies{
+		NewJournal: func(cfg RunConfig, jobCfg journal.JobConfiguration) (*journal.Journal, error) {
+			return journal.NewJournal(cfg.JournalFile, jobCfg, cfg.Directory)
+		},
+		ReportCoverage: func(r coverageReport) error {
+			return writeCoverageReport(&report, r)
+		},
+		RecordCTSize: func(context.Context, string, int64) error {
+			recorded = true
+			return nil
+		},
+		RecordedCTSize: func(ctx context.Context, url string) (int64, error) {
+			size, _, err := conn.LastCTlogServerState(ctx, url)
+			return size, err
+		},
+	}
+
+	cfg.Strategy = CoverageStrategy
+	require.NoError(t, runIngest(ctx, cfg, deps))
+	var got coverageReport
+	require.NoError(t, json.Unmarshal(report.Bytes(), &got))
+	require.Equal(t, coverageReport{
+		Key:                 dirBase,
+		CTLogURL:            ctLogURL,
+		RecordedCTLogSize:   55,
+		CompletedSize:       10,
+		Bundles:             []string{"0-24", "40-49"},
+		Completed:           []string{"0-9", "40-49"},
+		Missing:             []string{"25-39", "50-54"},
+		Pending:             []string{"10-24"},
+		Holes:               []string{"10-39"},
+		InconsistentBundles: []coverageInconsistentBundle{},
+		Overlaps: []coverageOverlap{{
+			Files: [2]string{
+				filepath.Join(dir, "bundled", "10-19.gz"),
+				filepath.Join(dir, "bundled", "15-24.gz"),
+			},
+			Interval: "15-19",
+		}},
+	}, got)
+	journalAfter, err := os.ReadFile(cfg.JournalFile)
+	require.NoError(t, err)
+	require.Equal(t, journalBefore, journalAfter)
+
+	// The holes prevent recording the CT log size.
+	cfg.Strategy = "recordctsize"
+	err = runIngest(ctx, cfg, deps)
+	require.ErrorContains(t, err, "holes [10-39]")
+	require.False(t, recorded)
+
+	// Coverage is only reported for CT CSV bundles.
+	cfg.Strategy = CoverageStrategy
+	cfg.InputFormat = AutoFormat
+	require.Error(t, cfg.validate())
+}
@@ -7,23 +7,37 @@ import (
 	"io"
 	"os"
 
-	"github.com/netsec-ethz/fpki/cmd/ingest/fastcsv"
 	pip "github.com/netsec-ethz/fpki/pkg/pipeline"
 	"github.com/netsec-ethz/fpki/pkg/util"
 )
 
+// line is one record of an input file, with one certificate and its chain. How its fields are
+// decoded depends on its format.
 type line struct {
+	format          inputFormat // If nil, the CT CSV format.
 	certField       []byte
 	chainField      []byte
 	expirationField []byte
+	chain           [][]byte // The decoded chain, for the formats decoded when split.
+	row             []byte   // The raw record, if it could not be split into fields.
 	number          int
+	filename        string
 }
 
 func (l line) String() string {
 	return fmt.Sprintf("line %06d", l.number)
 }
 
-// csvSplitWorker is a processing stage that takes a CsvFile and outputs all its lines.
+// inputFormat returns the format of the line.
+func (l *line) inputFormat() inputFormat {
+	if l.format == nil {
+		return ctCSVFormat{}
+	}
+	return l.format
+}
+
+// csvSplitWorker is a processing stage that takes a CsvFile and outputs all its lines, i.e. the
+// records of the file according to its input format.
 // The distribution is done in a staggered fan-out way to the next stages, so that each next
 // stage i processes lines i, i+W, i+2W, etc (W being the number or next stages).
 type csvSplitWorker struct {
@@ -31,11 +45,21 @@ type csvSplitWorker struct {
 	lines            chan line  // Created once per file.
 	done             chan error // Created once per file.
 	skipMissingFiles bool
+	format           inputFormat // If nil, detected for each file.
+	// malformed drops a record that cannot be split. If nil, the record fails the batch.
+	malformed func(l *line, err error) error
 }
 
 func NewCsvSplitWorker(p *Processor) *csvSplitWorker {
 	w := &csvSplitWorker{
 		skipMissingFiles: p.SkipMissing,
+		format:           p.Format,
+	}
+	if p.Quarantine != nil {
+		w.malformed = func(l *line, err error) error {
+			p.Manager.Stats.MalformedRows.Add(1)
+			return p.Quarantine.add(l, err)
+		}
 	}
 
 	lastOut := make([]line, 1)
@@ -87,53 +111,26 @@ func (w *csvSplitWorker) startReadingLines(f util.CsvFile) error {
 	}
 
 	r := bufio.NewReader(fileReader)
+	format := w.format
+	if format == nil {
+		format = detectInputFormat(r)
+	}
 	w.lines = make(chan line, cap(w.lines))
 	w.done = make(chan error, 1)
-	go func() {
-		var finalErr error
-		for lineNo := 1; ; lineNo++ {
-			// Read one physical row at a time so we can keep the fast-path parser byte-oriented
-			// and avoid materializing a full []string record for the common case.
-			rawLine, readErr := r.ReadBytes('\n')
-			if readErr != nil && !errors.Is(readErr, io.EOF) {
-				finalErr = fmt.Errorf("reading %s: %w", f.Filename(), readErr)
-				break
-			}
-			if len(rawLine) > 0 {
-				parsed, parseErr := fastcsv.ParseLine(rawLine, f.Filename(), lineNo)
-				if parseErr != nil {
-					// If row parsing fails, continue draining the reader first. This preserves
-					// underlying stream errors such as truncated gzip data instead of masking them
-					// behind a row-shape error from the fast parser.
-					drainErr := drainReader(r)
-					if errors.Is(readErr, io.EOF) {
-						finalErr = errors.Join(
-							fmt.Errorf("reading %s: %w", f.Filename(), io.ErrUnexpectedEOF),
-							parseErr,
-						)
-					} else if drainErr != nil {
-						finalErr = errors.Join(
-							fmt.Errorf("reading %s: %w", f.Filename(), drainErr),
-							parseErr,
-						)
-					} else {
-						finalErr = parseErr
-					}
-					break
-				}
-				// Forward only the compact, ingest-relevant fields to the next stage.
-				w.lines <- line{
-					certField:       parsed.CertField,
-					chainField:      parsed.ChainField,
-					expirationField: parsed.ExpirationField,
-					number:          parsed.Number,
-				}
-			}
-			// EOF after a successfully parsed final row is the normal termination path.
-			if errors.Is(readErr, io.EOF) {
-				break
-			}
+	var malformed func(line, error) error
+	if w.malformed != nil {
+		malformed = func(l line, err error) error {
+			l.format = format
+			l.filename = f.Filename()
+			return w.malformed(&l, err)
 		}
+	}
+	go func() {
+		finalErr := format.split(r, f.Filename(), func(l line) {
+			l.format = format
+			l.filename = f.Filename()
+			w.lines <- l
+		}, malformed)
 		close(w.lines)
 		if err := f.Close(); err != nil {
 			if finalErr != nil {
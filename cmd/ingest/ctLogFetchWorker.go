@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	ctx509 "github.com/google/certificate-transparency-go/x509"
+
+	"github.com/netsec-ethz/fpki/pkg/cache"
+	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/mapserver/logfetcher"
+	pip "github.com/netsec-ethz/fpki/pkg/pipeline"
+)
+
+// ctLogRange is an inclusive range of entry indices of a CT log.
+type ctLogRange struct {
+	start int64
+	end   int64
+}
+
+func (r ctLogRange) String() string {
+	return fmt.Sprintf("entries %d-%d", r.start, r.end)
+}
+
+// ctLogFetchWorker is a processing stage that takes a range of a CT log and outputs the chains
+// of all its entries, fetched by its logfetcher.Fetcher. It plays the role of the csvSplitWorker
+// and lineToChainWorker stages when ingesting directly from a CT log.
+type ctLogFetchWorker struct {
+	*pip.Stage[ctLogRange, certChain]
+
+	fetcher logfetcher.Fetcher
+	now     time.Time
+	cache   cache.Cache // IDs of certificates already seen
+
+	// The batch being sent, and the index of the next entry to send.
+	certs  []ctx509.Certificate
+	chains [][]*ctx509.Certificate
+	next   int
+}
+
+func NewCtLogFetchWorker(p *Processor) *ctLogFetchWorker {
+	w := &ctLogFetchWorker{
+		fetcher: p.Fetcher,
+		now:     time.Now(),
+		cache:   newWorkerCache(p),
+	}
+
+	lastOut := make([]certChain, 1)
+	lastOutIndex := make([]int, 1) // Crisscross linked, always the first channel.
+	w.Stage = pip.NewStage[ctLogRange, certChain](
+		"ctlog_fetch",
+		pip.WithProcessFunction(func(in ctLogRange) ([]certChain, []int, error) {
+			if err := w.fetcher.Initialize(w.now); err != nil {
+				return nil, nil, err
+			}
+			w.fetcher.StartFetching(in.start, in.end)
+			w.certs, w.chains, w.next = nil, nil, 0
+			// Return the cached storage, even if empty.
+			return lastOut[:0], lastOutIndex[:0], pip.StreamOutput
+		}),
+		pip.WithOutputStreamingFunction[ctLogRange](func(outs *[]certChain, outChs *[]int) error {
+			*outs = lastOut[:0]
+			*outChs = lastOutIndex[:0]
+			chain, err := w.nextChain(p)
+			if err != nil || chain == nil {
+				// Error or end of the range.
+				w.fetcher.StopFetching()
+				return err
+			}
+			*outs = append(*outs, *chain)
+			*outChs = append(*outChs, 0)
+			return pip.StreamOutput
+		}),
+	)
+	return w
+}
+
+// nextChain returns the chain of the next entry of the range that has to be ingested,
+// or nil if there are no more entries.
+func (w *ctLogFetchWorker) nextChain(p *Processor) (*certChain, error) {
+	for {
+		for w.next < len(w.certs) {
+			i := w.next
+			w.next++
+			if chain := w.toChain(p, &w.certs[i], w.chains[i]); chain != nil {
+				return chain, nil
+			}
+		}
+
+		// Fetch the next batch.
+		if !w.fetcher.NextBatch(p.Ctx) {
+			return nil, nil
+		}
+		certs, chains, excluded, err := w.fetcher.ReturnNextBatch()
+		if err != nil {
+			return nil, fmt.Errorf("fetching from %s: %w", w.fetcher.URL(), err)
+		}
+		// The excluded entries are counted as read, as they are not ingested, and as expired
+		// unless they were quarantined.
+		quarantined := 0
+		if f, ok := w.fetcher.(logfetcher.QuarantiningFetcher); ok {
+			quarantined = f.Quarantined()
+		}
+		p.Manager.Stats.ReadRows.Add(int64(excluded))
+		p.Manager.Stats.ExpiredCerts.Add(int64(excluded - quarantined))
+		p.Manager.Stats.QuarantinedEntries.Add(int64(quarantined))
+		w.certs, w.chains, w.next = certs, chains, 0
+	}
+}
+
+// toChain returns the chain of the leaf certificate, or nil if the leaf is expired or was
+// already seen by this worker. The payloads of the parents already seen are not kept.
+func (w *ctLogFetchWorker) toChain(
+	p *Processor,
+	cert *ctx509.Certificate,
+	parents []*ctx509.Certificate,
+) *certChain {
+	p.Manager.Stats.ReadRows.Add(1)
+	p.Manager.Stats.ReadCerts.Add(1)
+	p.Manager.Stats.ReadBytes.Add(int64(len(cert.Raw)))
+
+	if w.now.After(cert.NotAfter) {
+		// Don't ingest already expired certificates.
+		p.Manager.Stats.ExpiredCerts.Add(1)
+		return nil
+	}
+
+	certID := common.SHA256Hash32Bytes(cert.Raw)
+	if w.cache.Contains(&certID) {
+		return nil
+	}
+	p.Manager.Stats.UncachedCerts.Add(1)
+
+	chain := make([]*ctx509.Certificate, len(parents))
+	chainIDs := make([]*common.SHA256Output, len(parents))
+	for i, parent := range parents {
+		p.Manager.Stats.ReadBytes.Add(int64(len(parent.Raw)))
+		p.Manager.Stats.ReadCerts.Add(1)
+		id := common.SHA256Hash32Bytes(parent.Raw)
+		if !w.cache.Contains(&id) {
+			chain[i] = parent
+			w.cache.AddIDs(&id)
+			p.Manager.Stats.UncachedCerts.Add(1)
+		}
+		chainIDs[i] = &id
+	}
+
+	return &certChain{
+		Cert:          cert,
+		CertID:        certID,
+		ChainPayloads: chain,
+		ChainIDs:      chainIDs,
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	ctx509 "github.com/google/certificate-transparency-go/x509"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/db"
+	"github.com/netsec-ethz/fpki/pkg/db/embedded"
+	"github.com/netsec-ethz/fpki/pkg/mapserver/logfetcher"
+	"github.com/netsec-ethz/fpki/pkg/statistics"
+	"github.com/netsec-ethz/fpki/pkg/tests/random"
+)
+
+// TestProcessorFetchesCTLogRange checks that a processor with a fetcher ingests the unexpired
+// certificates of the range into the DB.
+func TestProcessorFetchesCTLogRange(t *testing.T) {
+	ctx, cancelF := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelF()
+
+	conn, err := embedded.Connect(db.NewConfig(embedded.WithDirectory(t.TempDir())))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	issuer := random.RandomX509Cert(t, "issuer.com")
+	a := random.RandomX509Cert(t, "a.com")
+	b := random.RandomX509Cert(t, "b.com")
+	expired := random.RandomX509Cert(t, "expired.com")
+	expired.NotAfter = time.Now().Add(-time.Hour)
+	chain := []*ctx509.Certificate{&issuer}
+
+	// Two batches, the last one with an excluded entry.
+	batches := []testCTLogBatch{
+		{
+			certs:  []ctx509.Certificate{a, b},
+			chains: [][]*ctx509.Certificate{chain, chain},
+		},
+		{
+			certs:    []ctx509.Certificate{expired},
+			chains:   [][]*ctx509.Certificate{chain},
+			excluded: 1,
+		},
+	}
+	fetcher := &testCTLogFetcher{batches: batches}
+
+	stats := statistics.NewStatistics(time.Hour, nil)
+	defer stats.Stop()
+	proc, err := NewProcessor(ctx, conn, 10, stats,
+		WithCTLogFetcher(fetcher),
+		WithNumToCerts(2),
+		WithStreamCsv(true),
+	)
+	require.NoError(t, err)
+	proc.AddCTLogRange(0, 3)
+	proc.Resume()
+	require.NoError(t, proc.Wait())
+
+	require.Equal(t, [][2]int64{{0, 3}}, fetcher.started)
+	require.True(t, fetcher.stopped)
+	require.Equal(t, int64(4), stats.ReadRows.Load())
+	require.Equal(t, int64(2), stats.ExpiredCerts.Load())
+
+	ids := []common.SHA256Output{
+		common.SHA256Hash32Bytes(issuer.Raw),
+		common.SHA256Hash32Bytes(a.Raw),
+		common.SHA256Hash32Bytes(b.Raw),
+		common.SHA256Hash32Bytes(expired.Raw),
+	}
+	payloads, err := conn.RetrieveCertificatePayloads(ctx, ids)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{issuer.Raw, a.Raw, b.Raw, nil}, payloads)
+
+	dirty, err := conn.RetrieveDirtyDomains(ctx)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []common.SHA256Output{
+		common.SHA256Hash32Bytes([]byte("a.com")),
+		common.SHA256Hash32Bytes([]byte("b.com")),
+	}, dirty)
+}
+
+type testCTLogBatch struct {
+	certs    []ctx509.Certificate
+	chains   [][]*ctx509.Certificate
+	excluded int
+}
+
+// testCTLogFetcher returns its batches in order, and records the calls to start and stop.
+type testCTLogFetcher struct {
+	batches []testCTLogBatch
+	current int
+	started [][2]int64
+	stopped bool
+}
+
+var _ logfetcher.Fetcher = (*testCTLogFetcher)(nil)
+
+func (f *testCTLogFetcher) Initialize(time.Time) error { return nil }
+
+func (f *testCTLogFetcher) URL() string { return "https://ct.example.com/log" }
+
+func (f *testCTLogFetcher) GetCurrentState(
+	context.Context,
+	logfetcher.State,
+) (logfetcher.State, error) {
+	return logfetcher.State{}, nil
+}
+
+func (f *testCTLogFetcher) StartFetching(start, end int64) {
+	f.started = append(f.started, [2]int64{start, end})
+	f.current = -1
+}
+
+func (f *testCTLogFetcher) StopFetching() {
+	f.stopped = true
+}
+
+func (f *testCTLogFetcher) NextBatch(context.Context) bool {
+	f.current++
+	return f.current < len(f.batches)
+}
+
+func (f *testCTLogFetcher) ReturnNextBatch() (
+	[]ctx509.Certificate,
+	[][]*ctx509.Certificate,
+	int,
+	error,
+) {
+	b := f.batches[f.current]
+	return b.certs, b.chains, b.excluded, nil
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/netsec-ethz/fpki/cmd/ingest/journal"
+	"github.com/netsec-ethz/fpki/pkg/db"
+	"github.com/netsec-ethz/fpki/pkg/statistics"
+)
+
+// defaultWorkerName returns the name of this process in the leases of the distributed jobs.
+func defaultWorkerName() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// runDistributed works on the distributed ingest job of the configuration: it claims its
+// batches from the DB one after the other and ingests them, until all of them are done. Then
+// the job is finalized, i.e. coalesced and the SMT updated as its strategy requires, by the
+// first worker claiming the finalization. Every worker waits for the job to be finalized, so
+// that the batches and the finalization abandoned by a failed worker are claimed again once
+// their lease expires.
+// The coordinator first enqueues the job with the pending bundles of its journal, and, once the
+// job is finalized, commits the completed bundles to the journal.
+func runDistributed(ctx context.Context, cfg RunConfig, deps RunDependencies) error {
+	if deps.IngestQueue == nil {
+		return fmt.Errorf("missing ingest queue dependency")
+	}
+	if deps.NewStatistics == nil {
+		return fmt.Errorf("missing statistics dependency")
+	}
+	if deps.RunBatch == nil {
+		return fmt.Errorf("missing batch runner dependency")
+	}
+	queue := deps.IngestQueue
+
+	var j *journal.Journal
+	if cfg.Coordinator {
+		jobCfg, err := cfg.JobConfiguration()
+		if err != nil {
+			return err
+		}
+		if deps.NewJournal == nil {
+			return fmt.Errorf("missing journal dependency")
+		}
+		if j, err = deps.NewJournal(cfg, jobCfg); err != nil {
+			return err
+		}
+		defer j.Close()
+		if err := enqueueIngestJob(ctx, queue, j, cfg); err != nil {
+			return err
+		}
+	}
+
+	job, batches, err := queue.RetrieveIngestJob(ctx, cfg.Job)
+	if err != nil {
+		return err
+	}
+	if job == nil {
+		return fmt.Errorf("ingest job %q does not exist, enqueue it with -coordinator", cfg.Job)
+	}
+	jobCfg, err := journal.NewJobConfiguration(job.Strategy, cfg.FileBatch, cfg.IncludePlainCSVs)
+	if err != nil {
+		return fmt.Errorf("ingest job %q: %w", cfg.Job, err)
+	}
+	if job.Finalized {
+		// E.g. the coordinator died and the other workers finalized the job meanwhile.
+		fmt.Printf("ingest job %q already finalized\n", cfg.Job)
+		return journalIngestJob(ctx, queue, j, cfg.Job, jobCfg)
+	}
+
+	stats := deps.NewStatistics()
+	if stats != nil {
+		defer stats.Stop()
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		batch, err := queue.ClaimIngestBatch(ctx, cfg.Job, cfg.Worker, cfg.Lease)
+		if err != nil {
+			return err
+		}
+		if batch != nil {
+			if err := ingestClaimedBatch(ctx, queue, stats, cfg, deps, batch, len(batches)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		job, _, err := queue.RetrieveIngestJob(ctx, cfg.Job)
+		if err != nil {
+			return err
+		}
+		if job.Finalized {
+			break
+		}
+		claimed, err := queue.ClaimIngestFinalization(ctx, cfg.Job, cfg.Worker, cfg.Lease)
+		if err != nil {
+			return err
+		}
+		if claimed {
+			err := finalizeIngestJob(ctx, queue, cfg, jobCfg, deps)
+			if err == nil {
+				break
+			}
+			if !errors.Is(err, db.ErrIngestLeaseLost) {
+				return err
+			}
+			// Another worker finalizes the job now.
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+		}
+
+		// Other workers hold the leases of the remaining batches or of the finalization.
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(cfg.Lease / 4):
+		}
+	}
+	fmt.Printf("ingest job %q finalized\n", cfg.Job)
+	return journalIngestJob(ctx, queue, j, cfg.Job, jobCfg)
+}
+
+// journalIngestJob commits the files of all the batches of the finalized job to the journal of
+// the coordinator. It does nothing for the other workers, which have no journal.
+func journalIngestJob(
+	ctx context.Context,
+	queue db.IngestQueue,
+	j *journal.Journal,
+	name string,
+	jobCfg journal.JobConfiguration,
+) error {
+	if j == nil {
+		return nil
+	}
+	_, batches, err := queue.RetrieveIngestJob(ctx, name)
+	if err != nil {
+		return err
+	}
+	var files []string
+	for _, b := range batches {
+		files = append(files, b.Files...)
+	}
+	return j.CommitProgress(files, jobCfg.Coalesce, jobCfg.UpdateSMT)
+}
+
+// enqueueIngestJob enqueues the pending bundles of the journal as the batches of the job of the
+// configuration. If the job already exists, e.g. because the coordinator is run again, it is
+// kept as is.
+func enqueueIngestJob(
+	ctx context.Context,
+	queue db.IngestQueue,
+	j *journal.Journal,
+	cfg RunConfig,
+) error {
+	files, err := j.PendingFiles()
+	if err != nil {
+		return err
+	}
+	key := filepath.Base(filepath.Clean(cfg.Directory))
+	batches, err := ingestBatches(key, files, cfg.FileBatch)
+	if err != nil {
+		return err
+	}
+	err = queue.EnqueueIngestJob(ctx, &db.IngestJob{Name: cfg.Job, Strategy: cfg.Strategy}, batches)
+	if errors.Is(err, db.ErrIngestJobExists) {
+		fmt.Printf("ingest job %q already enqueued, resuming it\n", cfg.Job)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("ingest job %q enqueued with %d batches of %d files\n",
+		cfg.Job, len(batches), len(files))
+	return nil
+}
+
+// ingestBatches groups the bundle files, sorted by their indices, in batches of at most
+// fileBatch files, or all of them if zero. A batch only contains bundles whose indices are
+// contiguous, so that the completed intervals are those of the done batches. The paths are
+// absolute, as the workers may run in other directories.
+func ingestBatches(key string, files []string, fileBatch int) ([]db.IngestBatch, error) {
+	var batches []db.IngestBatch
+	for _, file := range files {
+		interval, err := journal.ParseFileInterval(file)
+		if err != nil {
+			return nil, err
+		}
+		if file, err = filepath.Abs(file); err != nil {
+			return nil, err
+		}
+		start, end := uint64(interval.Start), uint64(interval.End)
+		if n := len(batches); n > 0 {
+			last := &batches[n-1]
+			full := fileBatch > 0 && len(last.Files) >= fileBatch
+			if !full && start <= last.End+1 {
+				last.Files = append(last.Files, file)
+				last.End = max(last.End, end)
+				continue
+			}
+		}
+		batches = append(batches, db.IngestBatch{
+			ID:    uint64(len(batches) + 1),
+			Key:   key,
+			Start: start,
+			End:   end,
+			Files: []string{file},
+		})
+	}
+	return batches, nil
+}
+
+// ingestClaimedBatch ingests the files of the batch while renewing its lease, and completes it.
+// A worker losing the lease of its batch, e.g. after a long pause, stops ingesting it and
+// reports it: the batch is ingested by the worker that claimed it since. Otherwise, the
+// batch could still be written to the DB after it is done, even while the job is finalized.
+func ingestClaimedBatch(
+	ctx context.Context,
+	queue db.IngestQueue,
+	stats *statistics.Stats,
+	cfg RunConfig,
+	deps RunDependencies,
+	batch *db.IngestBatch,
+	batchCount int,
+) error {
+	renew := func(ctx context.Context) error {
+		return queue.RenewIngestBatchLease(ctx, cfg.Job, batch.ID, cfg.Worker, cfg.Lease)
+	}
+	err := whileLeased(ctx, cfg.Lease, renew, func(ctx context.Context) error {
+		return ingestFilesInBatches(
+			ctx,
+			func() ([]string, error) { return batch.Files, nil },
+			stats,
+			0,
+			deps.EstimateCertCount,
+			func(int, int) error {
+				if deps.BeforeBatch == nil {
+					return nil
+				}
+				return deps.BeforeBatch(int(batch.ID), batchCount)
+			},
+			func(files []string) error {
+				return deps.RunBatch(ctx, stats, files)
+			},
+		)
+	})
+	if err == nil {
+		err = queue.CompleteIngestBatch(ctx, cfg.Job, batch.ID, cfg.Worker)
+	}
+	if errors.Is(err, db.ErrIngestLeaseLost) {
+		fmt.Fprintf(os.Stderr, "batch %d of ingest job %q: %s\n", batch.ID, cfg.Job, err)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("batch %d of ingest job %q: %w", batch.ID, cfg.Job, err)
+	}
+	return nil
+}
+
+// finalizeIngestJob coalesces the payloads and updates the SMT as the strategy of the job
+// requires, while renewing the lease of the finalization, and marks the job as finalized.
+// It stops and returns db.ErrIngestLeaseLost if another worker claimed the finalization since,
+// so that the job is never finalized by two workers at once.
+func finalizeIngestJob(
+	ctx context.Context,
+	queue db.IngestQueue,
+	cfg RunConfig,
+	jobCfg journal.JobConfiguration,
+	deps RunDependencies,
+) error {
+	renew := func(ctx context.Context) error {
+		return queue.RenewIngestFinalizationLease(ctx, cfg.Job, cfg.Worker, cfg.Lease)
+	}
+	err := whileLeased(ctx, cfg.Lease, renew, func(ctx context.Context) error {
+		if jobCfg.Coalesce && deps.Coalesce != nil {
+			if err := deps.Coalesce(ctx); err != nil {
+				return err
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if jobCfg.UpdateSMT && deps.UpdateSMT != nil {
+			return deps.UpdateSMT(ctx)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("finalizing ingest job %q: %w", cfg.Job, err)
+	}
+	return queue.CompleteIngestFinalization(ctx, cfg.Job, cfg.Worker)
+}
+
+// whileLeased calls fn while renewing its lease three times per lease duration. Failing to
+// renew the lease is reported, and if the lease is lost, the context of fn is cancelled and
+// whileLeased returns db.ErrIngestLeaseLost.
+func whileLeased(
+	ctx context.Context,
+	lease time.Duration,
+	renew func(context.Context) error,
+	fn func(context.Context) error,
+) error {
+	fnCtx, cancelFn := context.WithCancelCause(ctx)
+	defer cancelFn(nil)
+	renewCtx, cancelRenew := context.WithCancel(fnCtx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(lease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-renewCtx.Done():
+				return
+			case <-ticker.C:
+				err := renew(renewCtx)
+				if errors.Is(err, db.ErrIngestLeaseLost) {
+					cancelFn(err)
+					return
+				}
+				if err != nil && renewCtx.Err() == nil {
+					fmt.Fprintf(os.Stderr, "renewing lease: %s\n", err)
+				}
+			}
+		}
+	}()
+	err := fn(fnCtx)
+	cancelRenew()
+	<-done
+	if cause := context.Cause(fnCtx); errors.Is(cause, db.ErrIngestLeaseLost) {
+		return cause
+	}
+	return err
+}
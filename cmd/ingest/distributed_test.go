@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/netsec-ethz/fpki/cmd/ingest/journal"
+	"github.com/netsec-ethz/fpki/pkg/db"
+	"github.com/netsec-ethz/fpki/pkg/db/embedded"
+	"github.com/netsec-ethz/fpki/pkg/statistics"
+)
+
+func TestIngestBatches(t *testing.T) {
+	files := []string{
+		"/d/bundled/0-9.gz",
+		"/d/bundled/10-19.gz",
+		"/d/bundled/15-24.gz",
+		"/d/bundled/25-29.gz",
+		"/d/bundled/40-49.gz",
+		"/d/bundled/50-59.gz",
+	}
+	batches, err := ingestBatches("d", files, 3)
+	require.NoError(t, err)
+	require.Equal(t, []db.IngestBatch{
+		{ID: 1, Key: "d", Start: 0, End: 24, Files: files[:3]},
+		{ID: 2, Key: "d", Start: 25, End: 29, Files: files[3:4]},
+		{ID: 3, Key: "d", Start: 40, End: 59, Files: files[4:]},
+	}, batches)
+
+	// Without limit, the batches only split at the holes.
+	batches, err = ingestBatches("d", files, 0)
+	require.NoError(t, err)
+	require.Len(t, batches, 2)
+	require.Equal(t, files[:4], batches[0].Files)
+
+	_, err = ingestBatches("d", []string{"/d/bundled/a.gz"}, 0)
+	require.Error(t, err)
+}
+
+// TestRunDistributed checks that the batches of a distributed job are ingested by several
+// workers, that the batch abandoned by a failed worker is claimed again once its lease expires,
+// and that the job is finalized exactly once.
+func TestRunDistributed(t *testing.T) {
+	ctx, cancelF := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancelF()
+
+	conn, err := embedded.Connect(db.NewConfig(embedded.WithDirectory(t.TempDir())))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	dir, files := makeIngestTestFiles(t)
+	journalFile := filepath.Join(t.TempDir(), "journal.json")
+
+	var mu sync.Mutex
+	var ingested []string
+	var coalesced, updated int
+	newDeps := func(runBatch func(files []string) error) RunDependencies {
+		return RunDependencies{
+			NewJournal: func(cfg RunConfig, jobCfg journal.JobConfiguration) (*journal.Journal, error) {
+				return journal.NewJournal(cfg.JournalFile, jobCfg, cfg.Directory)
+			},
+			NewStatistics: func() *statistics.Stats {
+				return statistics.NewStatistics(time.Hour, nil)
+			},
+			EstimateCertCount: func(string) (uint, error) { return 0, nil },
+			RunBatch: func(_ context.Context, _ *statistics.Stats, files []string) error {
+				if runBatch != nil {
+					if err := runBatch(files); err != nil {
+						return err
+					}
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				ingested = append(ingested, files...)
+				return nil
+			},
+			Coalesce: func(context.Context) error {
+				mu.Lock()
+				defer mu.Unlock()
+				coalesced++
+				return nil
+			},
+			UpdateSMT: func(context.Context) error {
+				mu.Lock()
+				defer mu.Unlock()
+				updated++
+				return nil
+			},
+			IngestQueue: conn,
+		}
+	}
+	newCfg := func(worker string, coordinator bool) RunConfig {
+		cfg := newTestRunConfig("", "", 1, "")
+		cfg.Job = "job"
+		cfg.Worker = worker
+		cfg.Lease = 300 * time.Millisecond
+		if coordinator {
+			cfg.Coordinator = true
+			cfg.Directory = dir
+			cfg.JournalFile = journalFile
+		}
+		return cfg
+	}
+
+	// Workers cannot work on a job not enqueued yet.
+	err = runIngest(ctx, newCfg("a", false), newDeps(nil))
+	require.ErrorContains(t, err, "does not exist")
+
+	// The coordinator fails with the first batch, which stays leased to it.
+	crash := errors.New("crash")
+	err = runIngest(ctx, newCfg("coordinator", true), newDeps(func([]string) error {
+		return crash
+	}))
+	require.ErrorIs(t, err, crash)
+	_, batches, err := conn.RetrieveIngestJob(ctx, "job")
+	require.NoError(t, err)
+	require.Len(t, batches, 3)
+	require.Equal(t, "coordinator", batches[0].Worker)
+
+	// Running the coordinator again resumes the job, with two more workers.
+	var wg sync.WaitGroup
+	errs := make([]error, 3)
+	for i, cfg := range []RunConfig{
+		newCfg("coordinator", true),
+		newCfg("a", false),
+		newCfg("b", false),
+	} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = runIngest(ctx, cfg, newDeps(nil))
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+
+	slices.Sort(ingested)
+	expected := slices.Clone(files)
+	slices.Sort(expected)
+	require.Equal(t, expected, ingested)
+	require.Equal(t, 1, coalesced)
+	require.Equal(t, 1, updated)
+
+	job, batches, err := conn.RetrieveIngestJob(ctx, "job")
+	require.NoError(t, err)
+	require.True(t, job.Finalized)
+	for _, b := range batches {
+		require.True(t, b.Done)
+	}
+
+	// The coordinator journals the completed bundles.
+	j, err := journal.ReadJournal(journalFile)
+	require.NoError(t, err)
+	job0 := latestJobForTest(t, j)
+	require.Equal(t, completedIngestTestIntervals(journal.Interval{Start: 0, End: 29}),
+		job0.CompletedIndices)
+	require.True(t, job0.Coalesced)
+	require.True(t, job0.UpdatedSMT)
+
+	// A finalized job has nothing left to do.
+	require.NoError(t, runIngest(ctx, newCfg("a", false), newDeps(nil)))
+	require.Equal(t, 1, coalesced)
+
+	cfg := newCfg("a", false)
+	cfg.Lease = 0
+	require.Error(t, cfg.validate())
+	cfg = newCfg("coordinator", true)
+	cfg.Strategy = "onlysmtupdate"
+	require.Error(t, cfg.validate())
+}
+
+// TestRunDistributedCoordinatorResume checks that a coordinator that died before the job was
+// finalized journals the completed bundles when run again, although the job was finalized by
+// the other workers meanwhile.
+func TestRunDistributedCoordinatorResume(t *testing.T) {
+	ctx, cancelF := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancelF()
+
+	conn, err := embedded.Connect(db.NewConfig(embedded.WithDirectory(t.TempDir())))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	dir, _ := makeIngestTestFiles(t)
+	journalFile := filepath.Join(t.TempDir(), "journal.json")
+
+	var coalesced int
+	newDeps := func(runBatch func() error) RunDependencies {
+		deps := newTestDeps(t, nil, &coalesced, new(int), 0)
+		deps.NewStatistics = func() *statistics.Stats {
+			return statistics.NewStatistics(time.Hour, nil)
+		}
+		deps.RunBatch = func(context.Context, *statistics.Stats, []string) error {
+			if runBatch != nil {
+				return runBatch()
+			}
+			return nil
+		}
+		deps.IngestQueue = conn
+		return deps
+	}
+	newCfg := func(worker string, coordinator bool) RunConfig {
+		cfg := newTestRunConfig("", "", 1, "")
+		cfg.Job = "job"
+		cfg.Worker = worker
+		cfg.Lease = 100 * time.Millisecond
+		if coordinator {
+			cfg.Coordinator = true
+			cfg.Directory = dir
+			cfg.JournalFile = journalFile
+		}
+		return cfg
+	}
+
+	// The coordinator enqueues the job and dies with its first batch.
+	crash := errors.New("crash")
+	err = runIngest(ctx, newCfg("coordinator", true), newDeps(func() error { return crash }))
+	require.ErrorIs(t, err, crash)
+
+	// Another worker ingests all the batches and finalizes the job.
+	require.NoError(t, runIngest(ctx, newCfg("a", false), newDeps(nil)))
+	job, _, err := conn.RetrieveIngestJob(ctx, "job")
+	require.NoError(t, err)
+	require.True(t, job.Finalized)
+	require.Equal(t, 1, coalesced)
+
+	// The coordinator run again only journals the completed bundles.
+	require.NoError(t, runIngest(ctx, newCfg("coordinator", true), newDeps(nil)))
+	require.Equal(t, 1, coalesced)
+	j, err := journal.ReadJournal(journalFile)
+	require.NoError(t, err)
+	job0 := latestJobForTest(t, j)
+	require.Equal(t, completedIngestTestIntervals(journal.Interval{Start: 0, End: 29}),
+		job0.CompletedIndices)
+	require.True(t, job0.Coalesced)
+	require.True(t, job0.UpdatedSMT)
+}
+
+// TestWhileLeased checks that fn is stopped as soon as its lease is lost, but not when the
+// lease cannot be renewed for other reasons.
+func TestWhileLeased(t *testing.T) {
+	ctx, cancelF := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelF()
+
+	lost := func(context.Context) error { return db.ErrIngestLeaseLost }
+	err := whileLeased(ctx, 30*time.Millisecond, lost, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	require.ErrorIs(t, err, db.ErrIngestLeaseLost)
+
+	failing := func(context.Context) error { return errors.New("unavailable") }
+	err = whileLeased(ctx, 30*time.Millisecond, failing, func(ctx context.Context) error {
+		time.Sleep(100 * time.Millisecond)
+		return ctx.Err()
+	})
+	require.NoError(t, err)
+}
+
+// TestFinalizeIngestJobLeaseLost checks that a worker losing the lease of the finalization stops
+// it, leaving the job to be finalized by the worker that claimed it since.
+func TestFinalizeIngestJobLeaseLost(t *testing.T) {
+	ctx, cancelF := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelF()
+
+	conn, err := embedded.Connect(db.NewConfig(embedded.WithDirectory(t.TempDir())))
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.EnqueueIngestJob(ctx, &db.IngestJob{Name: "job"}, nil))
+	claimed, err := conn.ClaimIngestFinalization(ctx, "job", "a", time.Minute)
+	require.NoError(t, err)
+	require.True(t, claimed)
+
+	cfg := newTestRunConfig("", "", 1, "")
+	cfg.Job = "job"
+	cfg.Worker = "a"
+	cfg.Lease = 30 * time.Millisecond
+	jobCfg, err := journal.NewJobConfiguration("", 1, false)
+	require.NoError(t, err)
+	var updated bool
+	deps := RunDependencies{
+		// The coalescing outlives the lease.
+		Coalesce: func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		},
+		UpdateSMT: func(context.Context) error {
+			updated = true
+			return nil
+		},
+	}
+	err = finalizeIngestJob(ctx, &lostFinalizationQueue{conn}, cfg, jobCfg, deps)
+	require.ErrorIs(t, err, db.ErrIngestLeaseLost)
+	require.False(t, updated)
+	job, _, err := conn.RetrieveIngestJob(ctx, "job")
+	require.NoError(t, err)
+	require.False(t, job.Finalized)
+}
+
+// lostFinalizationQueue fails to renew the lease of the finalization, as if another worker
+// claimed it.
+type lostFinalizationQueue struct {
+	db.IngestQueue
+}
+
+func (*lostFinalizationQueue) RenewIngestFinalizationLease(
+	context.Context,
+	string,
+	string,
+	time.Duration,
+) error {
+	return db.ErrIngestLeaseLost
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+	"slices"
+	"sync"
+
+	"github.com/netsec-ethz/fpki/cmd/ingest/journal"
+	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/statistics"
+	"github.com/netsec-ethz/fpki/pkg/tests/noopdb"
+)
+
+// DryRunStrategy is the strategy that runs the ingest pipeline on all the files of the
+// directory without writing to the DB or the journal, and reports what would be ingested.
+const DryRunStrategy = "dryrun"
+
+// dryRunMaxQuarantinedRows is the maximum number of quarantined rows kept in the report of a
+// dry run. The others are only counted as malformed.
+const dryRunMaxQuarantinedRows = 1000
+
+// dryRunConn is a DB connection that writes nothing. Instead, it collects statistics of the CSV
+// rows that the updater.Manager streams into each table. The unique certificates and domains
+// are estimated with sketches, thus its memory does not grow with them.
+type dryRunConn struct {
+	noopdb.Conn
+
+	mu            sync.Mutex
+	leaves        idSketch
+	intermediates idSketch
+	domains       idSketch
+	domainCerts   idSketch
+	domainNames   int64 // Rows streamed into domain_certs, one per leaf and name.
+	quarantined   []quarantinedRow
+}
+
+// dryRunReport is the report of a dry run.
+type dryRunReport struct {
+	Files               int64            `json:"files"`
+	Rows                int64            `json:"rows"`
+	MalformedRows       int64            `json:"malformed_rows"`
+	ExpiredLeaves       int64            `json:"expired_leaves"`
+	UniqueLeaves        int64            `json:"unique_leaves"` // Only the live ones.
+	UniqueIntermediates int64            `json:"unique_intermediates"`
+	DomainNames         int64            `json:"domain_names"` // Extracted from the leaves.
+	UniqueDomains       int64            `json:"unique_domains"`
+	EstimatedDBRows     dryRunTableRows  `json:"estimated_db_rows"`
+	QuarantinedRows     []quarantinedRow `json:"quarantined_rows,omitempty"` // The first ones.
+}
+
+// dryRunTableRows are the rows that a dry run would insert into each table, if it was empty.
+// Like the unique counts of the report, they are estimated.
+type dryRunTableRows struct {
+	Certs       int64 `json:"certs"`
+	Domains     int64 `json:"domains"`
+	DomainCerts int64 `json:"domain_certs"`
+	Dirty       int64 `json:"dirty"`
+}
+
+func newDryRunConn() *dryRunConn {
+	return &dryRunConn{}
+}
+
+func (c *dryRunConn) InsertCsvIntoCerts(context.Context, string) error {
+	return errDryRunFiles
+}
+
+func (c *dryRunConn) InsertCsvIntoDirty(context.Context, string) error {
+	return errDryRunFiles
+}
+
+func (c *dryRunConn) InsertCsvIntoDomains(context.Context, string) error {
+	return errDryRunFiles
+}
+
+func (c *dryRunConn) InsertCsvIntoDomainCerts(context.Context, string) error {
+	return errDryRunFiles
+}
+
+var errDryRunFiles = errors.New("dry runs must stream the CSV rows, not write them to files")
+
+// StreamCsvIntoCerts collects the certificates. The leaves are those with a CT log entry type,
+// the fifth column.
+func (c *dryRunConn) StreamCsvIntoCerts(_ context.Context, r io.Reader) error {
+	return c.collect(r, 7, func(fields [][]byte) error {
+		id, err := decodeDryRunID(fields[0])
+		if err != nil {
+			return err
+		}
+		if len(fields[4]) > 0 {
+			c.leaves.add(idHash(&id))
+		} else {
+			c.intermediates.add(idHash(&id))
+		}
+		return nil
+	})
+}
+
+// StreamCsvIntoDirty collects nothing, as the dirty domains are also streamed into domains.
+func (c *dryRunConn) StreamCsvIntoDirty(context.Context, io.Reader) error {
+	return nil
+}
+
+func (c *dryRunConn) StreamCsvIntoDomains(_ context.Context, r io.Reader) error {
+	return c.collect(r, 2, func(fields [][]byte) error {
+		id, err := decodeDryRunID(fields[0])
+		if err != nil {
+			return err
+		}
+		c.domains.add(idHash(&id))
+		return nil
+	})
+}
+
+func (c *dryRunConn) StreamCsvIntoDomainCerts(_ context.Context, r io.Reader) error {
+	return c.collect(r, 2, func(fields [][]byte) error {
+		domainID, err := decodeDryRunID(fields[0])
+		if err != nil {
+			return err
+		}
+		certID, err := decodeDryRunID(fields[1])
+		if err != nil {
+			return err
+		}
+		// Rotated, so that the pair of two IDs in the opposite order is different.
+		c.domainCerts.add(idHash(&domainID) ^ bits.RotateLeft64(idHash(&certID), 1))
+		c.domainNames++
+		return nil
+	})
+}
+
+// collect calls collectRow with the fields of each CSV row of the reader, which must have
+// numFields columns, while holding the lock of the connection.
+func (c *dryRunConn) collect(
+	r io.Reader,
+	numFields int,
+	collectRow func(fields [][]byte) error,
+) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 64*1024*1024) // The certificate payloads may be large.
+	for scanner.Scan() {
+		fields := bytes.Split(scanner.Bytes(), []byte{','})
+		if len(fields) != numFields {
+			return fmt.Errorf("dry run: CSV row with %d fields instead of %d",
+				len(fields), numFields)
+		}
+		if err := collectRow(fields); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// report returns the report of the statistics collected so far, and those of the run.
+func (c *dryRunConn) report(stats *statistics.Stats) dryRunReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	leaves, intermediates, domains := c.leaves.estimate(), c.intermediates.estimate(),
+		c.domains.estimate()
+	report := dryRunReport{
+		UniqueLeaves:        leaves,
+		UniqueIntermediates: intermediates,
+		DomainNames:         c.domainNames,
+		UniqueDomains:       domains,
+		EstimatedDBRows: dryRunTableRows{
+			Certs:       leaves + intermediates,
+			Domains:     domains,
+			DomainCerts: c.domainCerts.estimate(),
+			Dirty:       domains,
+		},
+		QuarantinedRows: slices.Clone(c.quarantined),
+	}
+	if stats != nil {
+		report.Files = stats.TotalFilesRead.Load()
+		report.Rows = stats.ReadRows.Load()
+		report.MalformedRows = stats.MalformedRows.Load()
+		report.ExpiredLeaves = stats.ExpiredCerts.Load()
+	}
+	return report
+}
+
+// quarantine keeps the row in the report, instead of writing it to the quarantine file.
+func (c *dryRunConn) quarantine(row quarantinedRow) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.quarantined) < dryRunMaxQuarantinedRows {
+		c.quarantined = append(c.quarantined, row)
+	}
+}
+
+// writeDryRunReport writes the report as indented JSON.
+func writeDryRunReport(w io.Writer, report dryRunReport) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+func decodeDryRunID(field []byte) (common.SHA256Output, error) {
+	var id common.SHA256Output
+	n, err := base64.StdEncoding.Decode(id[:], field)
+	if err == nil && n != common.SHA256Size {
+		err = fmt.Errorf("ID of %d bytes", n)
+	}
+	if err != nil {
+		return id, fmt.Errorf("dry run: decoding ID %q: %w", field, err)
+	}
+	return id, nil
+}
+
+// idSketchPrecision is the number of bits of the hashes that select the register of an
+// idSketch: its 2^14 registers estimate the unique IDs with a standard error of 0.8%.
+const idSketchPrecision = 14
+
+// idSketch is a HyperLogLog sketch, which estimates the number of unique hashes added to it
+// in constant memory.
+type idSketch struct {
+	registers [1 << idSketchPrecision]uint8
+}
+
+// idHash returns the hash of the ID for an idSketch. The IDs are SHA256 hashes, thus their
+// bytes are used.
+func idHash(id *common.SHA256Output) uint64 {
+	return binary.LittleEndian.Uint64(id[:8])
+}
+
+func (s *idSketch) add(hash uint64) {
+	register := hash >> (64 - idSketchPrecision)
+	// The position of the first one bit of the other bits, bounded by their number.
+	rank := uint8(bits.LeadingZeros64(hash<<idSketchPrecision|1<<(idSketchPrecision-1))) + 1
+	s.registers[register] = max(s.registers[register], rank)
+}
+
+// estimate returns the estimated number of unique hashes added to the sketch. Linear counting
+// is used for the small numbers, for which it is exact with a high probability.
+func (s *idSketch) estimate() int64 {
+	m := float64(len(s.registers))
+	sum, zeros := 0.0, 0
+	for _, rank := range s.registers {
+		sum += math.Ldexp(1, -int(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+	estimate := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return int64(math.Round(estimate))
+}
+
+// dryRunIngest runs the batches of all the files of the directory, regardless of their progress
+// in the journal, which is not even opened. The DB connection of the batches must be a
+// dryRunConn, whose report is written by deps.ReportDryRun at the end.
+func dryRunIngest(ctx context.Context, cfg RunConfig, deps RunDependencies) error {
+	if deps.NewStatistics == nil {
+		return fmt.Errorf("missing statistics dependency")
+	}
+	if deps.RunBatch == nil {
+		return fmt.Errorf("missing batch runner dependency")
+	}
+	if deps.ReportDryRun == nil {
+		return fmt.Errorf("missing dry run report dependency")
+	}
+
+	stats := deps.NewStatistics()
+	if stats != nil {
+		defer stats.Stop()
+	}
+
+	listFiles := func() ([]string, error) {
+		return journal.ListIngestFiles(cfg.Directory, cfg.IncludePlainCSVs)
+	}
+	estimateCertCount := deps.EstimateCertCount
+	if !cfg.hasCTBundles() {
+		listFiles = func() ([]string, error) {
+			return listInputFiles(cfg.Directory)
+		}
+		estimateCertCount = func(string) (uint, error) { return 0, nil }
+	}
+
+	err := ingestFilesInBatches(
+		ctx,
+		listFiles,
+		stats,
+		cfg.FileBatch,
+		estimateCertCount,
+		deps.BeforeBatch,
+		func(files []string) error {
+			return deps.RunBatch(ctx, stats, files)
+		},
+	)
+	if err != nil {
+		return err
+	}
+	return deps.ReportDryRun(stats)
+}
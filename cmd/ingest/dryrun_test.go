@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/netsec-ethz/fpki/pkg/statistics"
+	"github.com/netsec-ethz/fpki/pkg/tests/random"
+	"github.com/netsec-ethz/fpki/pkg/util"
+)
+
+// TestRunIngestDryRun checks that a dry run runs the whole pipeline on the bundles, reports
+// what would be ingested, and writes neither to the journal, the DB nor the quarantine file.
+func TestRunIngestDryRun(t *testing.T) {
+	ctx, cancelF := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelF()
+
+	a := base64.StdEncoding.EncodeToString(random.RandomX509Cert(t, "a.com").Raw)
+	b := base64.StdEncoding.EncodeToString(random.RandomX509Cert(t, "b.com").Raw)
+	issuer := base64.StdEncoding.EncodeToString(random.RandomX509Cert(t, "issuer.com").Raw)
+	const expiration = "4000000000.0"
+	rows := []string{
+		ctCSVRow(a, issuer, expiration),
+		ctCSVRow(a, issuer, expiration), // Duplicated.
+		ctCSVRow(b, issuer, "1.0"),      // Expired.
+		ctCSVRow("not base64!", issuer, expiration),
+	}
+
+	dir := filepath.Join(t.TempDir(), ingestTestBase)
+	bundle := filepath.Join(dir, "bundled", "0-3.gz")
+	writeCTBundle(t, bundle, rows...)
+
+	cfg := newTestRunConfig(dir, filepath.Join(t.TempDir(), "journal.json"), 0, DryRunStrategy)
+	cfg.OnError = QuarantineOnError
+	cfg.QuarantineFile = filepath.Join(t.TempDir(), "quarantine.jsonl")
+	conn := newDryRunConn()
+	q, err := openRowQuarantine(cfg, conn)
+	require.NoError(t, err)
+	require.NotNil(t, q)
+
+	var report bytes.Buffer
+	var coalesceCount, updateCount int
+	deps := newTestDeps(t, nil, &coalesceCount, &updateCount, 0)
+	deps.NewJournal = nil
+	deps.RunBatch = func(ctx context.Context, stats *statistics.Stats, files []string) error {
+		proc, err := NewProcessor(ctx, conn, 10, stats,
+			WithStreamCsv(true),
+			WithRowQuarantine(q),
+		)
+		require.NoError(t, err)
+		csvFiles := make([]util.CsvFile, 0, len(files))
+		for _, filename := range files {
+			csvFiles = append(csvFiles, loadInputFile(filename))
+		}
+		proc.AddCsvFiles(csvFiles)
+		proc.Resume()
+		return proc.Wait()
+	}
+	deps.ReportDryRun = func(stats *statistics.Stats) error {
+		return writeDryRunReport(&report, conn.report(stats))
+	}
+
+	require.NoError(t, runIngest(ctx, cfg, deps))
+	require.Equal(t, 0, coalesceCount)
+	require.Equal(t, 0, updateCount)
+	_, err = os.Stat(cfg.JournalFile)
+	require.ErrorIs(t, err, os.ErrNotExist)
+	require.NoError(t, q.Close())
+	_, err = os.Stat(cfg.QuarantineFile)
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	var got dryRunReport
+	require.NoError(t, json.Unmarshal(report.Bytes(), &got))
+	// The malformed row is in the report instead.
+	require.Len(t, got.QuarantinedRows, 1)
+	require.Equal(t, bundle, got.QuarantinedRows[0].File)
+	require.Equal(t, 4, got.QuarantinedRows[0].Line)
+	require.Equal(t, "not base64!", got.QuarantinedRows[0].Cert)
+	got.QuarantinedRows = nil
+	require.Equal(t, dryRunReport{
+		Files:               1,
+		Rows:                4,
+		MalformedRows:       1,
+		ExpiredLeaves:       1,
+		UniqueLeaves:        1,
+		UniqueIntermediates: 1,
+		DomainNames:         got.DomainNames,
+		UniqueDomains:       1,
+		EstimatedDBRows: dryRunTableRows{
+			Certs:       2,
+			Domains:     1,
+			DomainCerts: 1,
+			Dirty:       1,
+		},
+	}, got)
+	require.GreaterOrEqual(t, got.DomainNames, int64(1))
+
+	// A dry run cannot write the CSV rows to files.
+	require.ErrorIs(t, conn.InsertCsvIntoCerts(ctx, "certs.csv"), errDryRunFiles)
+
+	cfg.CTLogURL = "https://ct.example.com/log"
+	require.Error(t, cfg.validate())
+}
+
+// TestIDSketch checks that the sketches of the dry runs count the unique IDs exactly when they
+// are few, and closely otherwise.
+func TestIDSketch(t *testing.T) {
+	var s idSketch
+	require.Zero(t, s.estimate())
+	ids := random.RandomIDsForTest(t, 100_000)
+	for i := range 10 {
+		s.add(idHash(&ids[i]))
+		s.add(idHash(&ids[i]))
+	}
+	require.Equal(t, int64(10), s.estimate())
+	for i := range ids {
+		s.add(idHash(&ids[i]))
+	}
+	require.InEpsilon(t, int64(len(ids)), s.estimate(), 0.03)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"strings"
+
+	"github.com/netsec-ethz/fpki/cmd/ingest/fastcsv"
+	"github.com/netsec-ethz/fpki/pkg/util"
+)
+
+const (
+	// CTCSVFormat is the name of the format of the CT log bundles, the default one.
+	CTCSVFormat = "ctcsv"
+	// AutoFormat selects the format of each file by looking at its first bytes.
+	AutoFormat = "auto"
+
+	// detectionSize is the number of bytes looked at to detect the format of a file.
+	detectionSize = 512
+)
+
+// inputFormat is one of the formats of the files that ingest reads certificates from.
+// The csvSplitWorker uses it to split a file into records, each one with a certificate and its
+// chain, and the lineToChainWorker to decode the payloads of each record.
+type inputFormat interface {
+	// name returns the name of the format, as selected by the -format flag.
+	name() string
+	// detect returns true if head, the first bytes of a file, are of this format.
+	detect(head []byte) bool
+	// split calls emit with each record of the file, in order. The records that cannot be split
+	// are passed to malformed, if not nil, instead of failing.
+	split(r *bufio.Reader, filename string, emit func(line), malformed func(line, error) error) error
+	// expiration returns the expiration time of the certificate of the record in seconds, if
+	// the format has it without decoding the certificate.
+	expiration(l *line) (int64, bool, error)
+	// decodeCert returns the DER payload of the certificate of the record.
+	decodeCert(l *line) ([]byte, error)
+	// decodeChain returns the DER payloads of the chain of the record, parent first.
+	decodeChain(l *line) ([][]byte, error)
+}
+
+// inputFormats lists the formats in the order in which they are tried when detecting the format
+// of a file. The CT CSV format detects any content and must be the last one.
+var inputFormats = []inputFormat{
+	pemFormat{},
+	jsonLinesFormat{},
+	derFormat{},
+	certWriterFormat{},
+	ctCSVFormat{},
+}
+
+// inputFormatByName returns the format with the name, or nil if the name is AutoFormat.
+func inputFormatByName(name string) (inputFormat, error) {
+	if name == AutoFormat {
+		return nil, nil
+	}
+	for _, f := range inputFormats {
+		if f.name() == name {
+			return f, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown input format %q", name)
+}
+
+// inputFormatNames returns the names that select a format, including AutoFormat.
+func inputFormatNames() []string {
+	names := make([]string, 0, len(inputFormats)+1)
+	for _, f := range inputFormats {
+		names = append(names, f.name())
+	}
+	return append(names, AutoFormat)
+}
+
+// detectInputFormat returns the first format that detects the first bytes of the reader,
+// without consuming them.
+func detectInputFormat(r *bufio.Reader) inputFormat {
+	// An error reading will be returned again when splitting.
+	head, _ := r.Peek(detectionSize)
+	for _, f := range inputFormats {
+		if f.detect(head) {
+			return f
+		}
+	}
+	return ctCSVFormat{}
+}
+
+// loadInputFile returns the file, decompressing it if its name ends in .gz.
+func loadInputFile(fileName string) util.CsvFile {
+	if strings.ToLower(filepath.Ext(fileName)) == ".gz" {
+		return (&util.GzFile{}).WithFile(fileName)
+	}
+	return (&util.UncompressedFile{}).WithFile(fileName)
+}
+
+// listInputFiles returns all the files under the directory, in lexical order, except the hidden
+// ones. Unlike the CT CSV bundles, their names don't have the indices of their certificates.
+func listInputFiles(dir string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && path != dir {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Type().IsRegular() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// ctCSVFormat is the format of the CSV bundles of CT log entries, with the base64 leaf
+// certificate in one column, the semicolon separated base64 chain in the next one, and the
+// expiration time in the last one.
+type ctCSVFormat struct{}
+
+func (ctCSVFormat) name() string { return CTCSVFormat }
+
+// detect returns true always: the CT CSV format is the fallback.
+func (ctCSVFormat) detect([]byte) bool { return true }
+
+func (ctCSVFormat) split(
+	r *bufio.Reader,
+	filename string,
+	emit func(line),
+	malformed func(line, error) error,
+) error {
+	for lineNo := 1; ; lineNo++ {
+		// Read one physical row at a time so we can keep the fast-path parser byte-oriented
+		// and avoid materializing a full []string record for the common case.
+		rawLine, readErr := r.ReadBytes('\n')
+		if readErr != nil && !errors.Is(readErr, io.EOF) {
+			return fmt.Errorf("reading %s: %w", filename, readErr)
+		}
+		if len(rawLine) > 0 {
+			parsed, parseErr := fastcsv.ParseLine(rawLine, filename, lineNo)
+			if parseErr != nil && malformed != nil && readErr == nil {
+				// Drop the malformed row and go on with the next one. A malformed last row
+				// without line end may be a truncated file, which still fails below.
+				row := bytes.TrimRight(rawLine, "\r\n")
+				if err := malformed(line{row: row, number: lineNo}, parseErr); err != nil {
+					return err
+				}
+				continue
+			}
+			if parseErr != nil {
+				// If row parsing fails, continue draining the reader first. This preserves
+				// underlying stream errors such as truncated gzip data instead of masking them
+				// behind a row-shape error from the fast parser.
+				drainErr := drainReader(r)
+				if errors.Is(readErr, io.EOF) {
+					return errors.Join(
+						fmt.Errorf("reading %s: %w", filename, io.ErrUnexpectedEOF),
+						parseErr,
+					)
+				} else if drainErr != nil {
+					return errors.Join(
+						fmt.Errorf("reading %s: %w", filename, drainErr),
+						parseErr,
+					)
+				}
+				return parseErr
+			}
+			// Forward only the compact, ingest-relevant fields to the next stage.
+			emit(line{
+				certField:       parsed.CertField,
+				chainField:      parsed.ChainField,
+				expirationField: parsed.ExpirationField,
+				number:          parsed.Number,
+			})
+		}
+		// EOF after a successfully parsed final row is the normal termination path.
+		if errors.Is(readErr, io.EOF) {
+			return nil
+		}
+	}
+}
+
+// expiration returns the expiration time, stored already in seconds in the last column.
+func (ctCSVFormat) expiration(l *line) (int64, bool, error) {
+	n, err := getExpiration(l.expirationField)
+	return n, true, err
+}
+
+func (ctCSVFormat) decodeCert(l *line) ([]byte, error) {
+	return decodeBase64Field(l.certField)
+}
+
+func (ctCSVFormat) decodeChain(l *line) ([][]byte, error) {
+	// The certificate chain field is still semicolon-delimited. Split it lazily without
+	// converting the whole field to []string first.
+	fields := splitSemicolonField(l.chainField)
+	for i, s := range fields {
+		raw, err := decodeBase64Field(s)
+		if err != nil {
+			return nil, fmt.Errorf("at line %d: %s\n%s",
+				l.number, err, string(l.chainField))
+		}
+		fields[i] = raw
+	}
+	return fields, nil
+}
+
+// trimmedHead returns the first bytes without leading white space.
+func trimmedHead(head []byte) []byte {
+	return bytes.TrimLeft(head, " \t\r\n")
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	ctx509 "github.com/google/certificate-transparency-go/x509"
+	"github.com/google/certificate-transparency-go/x509/pkix"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/db"
+	"github.com/netsec-ethz/fpki/pkg/db/embedded"
+	"github.com/netsec-ethz/fpki/pkg/statistics"
+	"github.com/netsec-ethz/fpki/pkg/tests/random"
+	"github.com/netsec-ethz/fpki/pkg/util"
+)
+
+func TestDetectInputFormat(t *testing.T) {
+	cert := random.RandomX509Cert(t, "a.com")
+	cases := map[string]struct {
+		content  []byte
+		expected string
+	}{
+		"pem": {
+			content:  pemBundle(t, cert),
+			expected: "pem",
+		},
+		"pem_leading_space": {
+			content:  append([]byte("\n  "), pemBundle(t, cert)...),
+			expected: "pem",
+		},
+		"der": {
+			content:  cert.Raw,
+			expected: "der",
+		},
+		"jsonl": {
+			content:  jsonLines(t, [][]ctx509.Certificate{{cert}}),
+			expected: "jsonl",
+		},
+		"ctcsv": {
+			content:  []byte("0,1,2,3,4,5\n"),
+			expected: CTCSVFormat,
+		},
+		"empty": {
+			expected: CTCSVFormat,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			r := bufio.NewReader(bytes.NewReader(tc.content))
+			require.Equal(t, tc.expected, detectInputFormat(r).name())
+			// Detecting doesn't consume the content.
+			rest, err := r.Peek(len(tc.content))
+			require.NoError(t, err)
+			require.Equal(t, string(tc.content), string(rest))
+		})
+	}
+}
+
+func TestInputFormatByName(t *testing.T) {
+	for _, name := range inputFormatNames() {
+		f, err := inputFormatByName(name)
+		require.NoError(t, err)
+		if name == AutoFormat {
+			require.Nil(t, f)
+		} else {
+			require.Equal(t, name, f.name())
+		}
+	}
+	_, err := inputFormatByName("xml")
+	require.Error(t, err)
+}
+
+func TestInputFormatsSplit(t *testing.T) {
+	issuer := random.RandomX509Cert(t, "issuer.com")
+	a := random.RandomX509Cert(t, "a.com")
+	b := random.RandomX509Cert(t, "b.com")
+
+	var certWriterContent bytes.Buffer
+	_, err := util.NewCertWriter(&certWriterContent).Write([]ctx509.Certificate{a, b})
+	require.NoError(t, err)
+
+	cases := map[string]struct {
+		format   inputFormat
+		content  []byte
+		expected [][][]byte // Per record, the certificate followed by its chain.
+	}{
+		"pem": {
+			format:   pemFormat{},
+			content:  pemBundle(t, a, issuer),
+			expected: [][][]byte{{a.Raw, issuer.Raw}},
+		},
+		"certwriter": {
+			format:   certWriterFormat{},
+			content:  certWriterContent.Bytes(),
+			expected: [][][]byte{{a.Raw}, {b.Raw}},
+		},
+		"der": {
+			format:   derFormat{},
+			content:  a.Raw,
+			expected: [][][]byte{{a.Raw}},
+		},
+		"jsonl": {
+			format:   jsonLinesFormat{},
+			content:  jsonLines(t, [][]ctx509.Certificate{{a, issuer}, {b}}),
+			expected: [][][]byte{{a.Raw, issuer.Raw}, {b.Raw}},
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			var got [][][]byte
+			err := tc.format.split(
+				bufio.NewReader(bytes.NewReader(tc.content)),
+				name,
+				func(l line) {
+					cert, err := tc.format.decodeCert(&l)
+					require.NoError(t, err)
+					chain, err := tc.format.decodeChain(&l)
+					require.NoError(t, err)
+					got = append(got, append([][]byte{cert}, chain...))
+				},
+				nil,
+			)
+			require.NoError(t, err)
+			require.Equal(t, tc.expected, got)
+		})
+	}
+}
+
+func TestInputFormatsSplitMalformed(t *testing.T) {
+	cases := map[string]struct {
+		format  inputFormat
+		content string
+	}{
+		"pem_empty": {
+			format:  pemFormat{},
+			content: "no certificates here\n",
+		},
+		"pem_truncated": {
+			format:  pemFormat{},
+			content: "-----BEGIN CERTIFICATE-----\nMIIB\n",
+		},
+		"der_empty": {
+			format: derFormat{},
+		},
+		"jsonl_not_json": {
+			format:  jsonLinesFormat{},
+			content: "{\"cert\": \"AA==\"}\nnot json\n",
+		},
+		"jsonl_no_cert": {
+			format:  jsonLinesFormat{},
+			content: "{\"chain\": []}\n",
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			err := tc.format.split(
+				bufio.NewReader(bytes.NewReader([]byte(tc.content))),
+				name,
+				func(line) {},
+				nil,
+			)
+			require.ErrorContains(t, err, name)
+		})
+	}
+}
+
+func TestListInputFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"b.pem",
+		"a.der",
+		"sub/c.jsonl",
+		".hidden",
+		".git/config",
+	} {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, nil, 0o644))
+	}
+
+	files, err := listInputFiles(dir)
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		filepath.Join(dir, "a.der"),
+		filepath.Join(dir, "b.pem"),
+		filepath.Join(dir, "sub", "c.jsonl"),
+	}, files)
+}
+
+// TestProcessorIngestsInputFormats checks that a processor detecting the format of each file
+// ingests the certificates of files in different formats into the DB.
+func TestProcessorIngestsInputFormats(t *testing.T) {
+	ctx, cancelF := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelF()
+
+	conn, err := embedded.Connect(db.NewConfig(embedded.WithDirectory(t.TempDir())))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	issuer := random.RandomX509Cert(t, "issuer.com")
+	a := random.RandomX509Cert(t, "a.com")
+	b := random.RandomX509Cert(t, "b.com")
+	c := random.RandomX509Cert(t, "c.com")
+	expired := expiredX509Cert(t, "expired.com")
+
+	dir := t.TempDir()
+	contents := map[string][]byte{
+		"a.pem":   pemBundle(t, a, issuer),
+		"b.der":   b.Raw,
+		"c.jsonl": jsonLines(t, [][]ctx509.Certificate{{c, issuer}, {expired}}),
+	}
+	for name, content := range contents {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), content, 0o644))
+	}
+	filenames, err := listInputFiles(dir)
+	require.NoError(t, err)
+	files := make([]util.CsvFile, 0, len(filenames))
+	for _, filename := range filenames {
+		files = append(files, loadInputFile(filename))
+	}
+
+	stats := statistics.NewStatistics(time.Hour, nil)
+	defer stats.Stop()
+	proc, err := NewProcessor(ctx, conn, 10, stats,
+		WithInputFormat(nil),
+		WithNumToCerts(2),
+		WithStreamCsv(true),
+	)
+	require.NoError(t, err)
+	proc.AddCsvFiles(files)
+	proc.Resume()
+	require.NoError(t, proc.Wait())
+
+	require.Equal(t, int64(4), stats.ReadRows.Load())
+	require.Equal(t, int64(1), stats.ExpiredCerts.Load())
+
+	ids := []common.SHA256Output{
+		common.SHA256Hash32Bytes(issuer.Raw),
+		common.SHA256Hash32Bytes(a.Raw),
+		common.SHA256Hash32Bytes(b.Raw),
+		common.SHA256Hash32Bytes(c.Raw),
+		common.SHA256Hash32Bytes(expired.Raw),
+	}
+	payloads, err := conn.RetrieveCertificatePayloads(ctx, ids)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{issuer.Raw, a.Raw, b.Raw, c.Raw, nil}, payloads)
+
+	dirty, err := conn.RetrieveDirtyDomains(ctx)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []common.SHA256Output{
+		common.SHA256Hash32Bytes([]byte("a.com")),
+		common.SHA256Hash32Bytes([]byte("b.com")),
+		common.SHA256Hash32Bytes([]byte("c.com")),
+	}, dirty)
+}
+
+// expiredX509Cert creates a certificate that expired an hour ago. Unlike modifying the fields
+// of a random one, its DER payload is also expired.
+func expiredX509Cert(t *testing.T, domain string) ctx509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := ctx509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    time.Now().Add(-2 * time.Hour),
+		NotAfter:     time.Now().Add(-time.Hour),
+	}
+	derBytes, err := ctx509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := ctx509.ParseCertificate(derBytes)
+	require.NoError(t, err)
+	return *cert
+}
+
+// pemBundle returns the certificates PEM encoded, in order.
+func pemBundle(t *testing.T, certs ...ctx509.Certificate) []byte {
+	var buff bytes.Buffer
+	_, err := util.NewCertWriter(&buff).Write(certs)
+	require.NoError(t, err)
+	return buff.Bytes()
+}
+
+// jsonLines returns one JSON line per chain, with its first certificate as the leaf.
+func jsonLines(t *testing.T, chains [][]ctx509.Certificate) []byte {
+	var buff bytes.Buffer
+	enc := json.NewEncoder(&buff)
+	for _, chain := range chains {
+		record := jsonLinesRecord{Cert: chain[0].Raw}
+		for _, c := range chain[1:] {
+			record.Chain = append(record.Chain, c.Raw)
+		}
+		require.NoError(t, enc.Encode(record))
+	}
+	return buff.Bytes()
+}
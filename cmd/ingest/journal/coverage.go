@@ -0,0 +1,164 @@
+package journal
+
+import (
+	"slices"
+)
+
+// Coverage compares the index ranges of the bundles of an ingest directory with the completed
+// indices of its key in the journal, and with the size of the CT log recorded in the DB. The
+// ranges are reported up to the last index known by any of them.
+type Coverage struct {
+	Key string
+	// Bundles are the merged ranges of the bundle files with a parsable name.
+	Bundles []Interval
+	// Completed are the completed indices of the key.
+	Completed []Interval
+	// RecordedCTLogSize is the size of the CT log recorded in the DB, or zero if unknown.
+	RecordedCTLogSize int64
+	// Missing are the ranges neither completed nor in any bundle file: they cannot be ingested.
+	Missing []Interval
+	// Pending are the ranges of the bundle files that are not completed yet.
+	Pending []Interval
+	// Overlaps are the ranges of the bundle files that also belong to a previous one.
+	Overlaps []BundleOverlap
+	// Inconsistent are the bundle files that cannot be ingested as they are.
+	Inconsistent []InconsistentBundle
+}
+
+// BundleOverlap is the range shared by two bundle files.
+type BundleOverlap struct {
+	Files    [2]string
+	Interval Interval
+}
+
+// InconsistentBundle is a bundle file with the reason why it is inconsistent.
+type InconsistentBundle struct {
+	File   string
+	Reason string
+}
+
+// NewCoverage returns the coverage of the key by the bundle files, which are those of the
+// ingest directory with that key, or none for a CT log. The completed intervals must be sorted
+// and not overlapping, as stored in the journal.
+func NewCoverage(key string, files []string, completed []Interval, recordedCTLogSize int64) Coverage {
+	c := Coverage{
+		Key:               key,
+		Bundles:           []Interval{},
+		Completed:         slices.Clone(completed),
+		RecordedCTLogSize: recordedCTLogSize,
+		Missing:           []Interval{},
+		Pending:           []Interval{},
+		Overlaps:          []BundleOverlap{},
+		Inconsistent:      []InconsistentBundle{},
+	}
+	if c.Completed == nil {
+		c.Completed = []Interval{}
+	}
+
+	type bundle struct {
+		file     string
+		interval Interval
+	}
+	bundles := make([]bundle, 0, len(files))
+	for _, file := range files {
+		interval, err := parseFileInterval(file)
+		if err != nil {
+			c.Inconsistent = append(c.Inconsistent, InconsistentBundle{
+				File:   file,
+				Reason: err.Error(),
+			})
+			continue
+		}
+		bundles = append(bundles, bundle{file: file, interval: interval})
+	}
+	slices.SortStableFunc(bundles, func(a, b bundle) int {
+		switch {
+		case a.interval.Start < b.interval.Start:
+			return -1
+		case a.interval.Start > b.interval.Start:
+			return 1
+		default:
+			return 0
+		}
+	})
+
+	// The bundle reaching furthest so far is the one that any following bundle overlaps with.
+	var furthest bundle
+	for i, b := range bundles {
+		if i > 0 && b.interval.Start <= furthest.interval.End {
+			c.Overlaps = append(c.Overlaps, BundleOverlap{
+				Files: [2]string{furthest.file, b.file},
+				Interval: Interval{
+					Start: b.interval.Start,
+					End:   min(b.interval.End, furthest.interval.End),
+				},
+			})
+		}
+		if i == 0 || b.interval.End > furthest.interval.End {
+			furthest = b
+		}
+		c.Bundles = appendInterval(c.Bundles, b.interval)
+
+		// A bundle partially completed was cut differently from the ones ingested before.
+		pending := subtractIntervals(b.interval, completed)
+		if len(pending) > 0 && !(len(pending) == 1 && pending[0] == b.interval) {
+			c.Inconsistent = append(c.Inconsistent, InconsistentBundle{
+				File:   b.file,
+				Reason: "partially completed",
+			})
+		}
+	}
+
+	last, ok := c.lastIndex()
+	if !ok {
+		return c
+	}
+	all := Interval{Start: 0, End: last}
+	for _, notCompleted := range subtractIntervals(all, completed) {
+		for _, missing := range subtractIntervals(notCompleted, c.Bundles) {
+			c.Missing = appendInterval(c.Missing, missing)
+		}
+	}
+	for _, b := range c.Bundles {
+		for _, pending := range subtractIntervals(b, completed) {
+			c.Pending = appendInterval(c.Pending, pending)
+		}
+	}
+	return c
+}
+
+// CompletedSize returns the size of the CT log completed without gaps from its first index.
+func (c Coverage) CompletedSize() int64 {
+	if len(c.Completed) == 0 || c.Completed[0].Start != 0 {
+		return 0
+	}
+	return int64(c.Completed[0].End) + 1
+}
+
+// Holes returns the ranges that are not completed below the last completed index. Recording
+// the CT log size is refused while there are holes, since later entries were ingested already.
+func (c Coverage) Holes() []Interval {
+	if len(c.Completed) == 0 {
+		return []Interval{}
+	}
+	last := c.Completed[len(c.Completed)-1].End
+	return subtractIntervals(Interval{Start: 0, End: last}, c.Completed)
+}
+
+// lastIndex returns the last index of the bundles, the completed indices and the recorded CT log
+// size, and false if there is none.
+func (c Coverage) lastIndex() (uint, bool) {
+	var last uint
+	ok := false
+	for _, intervals := range [][]Interval{c.Bundles, c.Completed} {
+		if n := len(intervals); n > 0 {
+			last = max(last, intervals[n-1].End)
+			ok = true
+		}
+	}
+	if c.RecordedCTLogSize > 0 {
+		last = max(last, uint(c.RecordedCTLogSize-1))
+		ok = true
+	}
+	return last, ok
+}
@@ -18,7 +18,7 @@ import (
 
 // Journal persists ingest progress and follow-up phase completion so future
 // runs can skip files whose certificate-index ranges are already fully
-// covered.
+// covered. The manual changes of the journal are kept in Audit, see Mark.
 type Journal struct {
 	mu          sync.Mutex
 	closed      bool
@@ -26,6 +26,7 @@ type Journal struct {
 	JournalFile string `json:"-"` // Exclude from JSON.
 	IngestDir   string `json:"-"` // Only used to refresh file listings.
 	Jobs        []Job
+	Audit       []AuditEntry `json:",omitempty"`
 }
 
 // JobConfiguration captures the ingest-mode settings that affect how one run
@@ -47,7 +48,10 @@ type JobConfiguration struct {
 // has already been brought at least through the coalescing stage. A successful
 // SMT update also implies this flag because SMT runs on coalesced state.
 // UpdatedSMT records the stronger fact that the SMT update phase finished for
-// the same completed-index snapshot.
+// the same completed-index snapshot. QuarantinedRows counts the malformed rows
+// of the completed indices that were skipped or quarantined instead of
+// ingested. CompactedJobs is the number of jobs merged into this one by
+// Compact, if any.
 type Job struct {
 	Cwd               string           `json:"Cwd"`
 	Cmd               []string         `json:"Cmd"`
@@ -57,11 +61,15 @@ type Job struct {
 	Coalesced         bool             `json:"Coalesced"`
 	UpdatedSMT        bool             `json:"UpdatedSMT"`
 	RecordedCTLogSize int64            `json:"RecordedCTLogSize"`
+	QuarantinedRows   int64            `json:"QuarantinedRows"`
+	CompactedJobs     int              `json:"CompactedJobs,omitempty"`
 	CompletedIndices  CompletedIndices `json:"CompletedIndices"`
 }
 
 // CompletedIndices groups completed certificate-index intervals by the
-// normalized ingest-directory key stored in the journal.
+// normalized ingest-directory key stored in the journal, or by the CT log URL
+// for the entries fetched directly from a CT log. The completed documents of a
+// policy file are keyed by PolicyFileKey.
 type CompletedIndices map[string][]Interval
 
 // Interval represents an inclusive range of certificate indices.
@@ -107,6 +115,26 @@ func NewJournal(journalFile string, cfg JobConfiguration, ingestDir string) (*Jo
 	return j, nil
 }
 
+// ReadJournal reads the journal file without appending a job to it nor
+// writing it back, e.g. to inspect its progress. If the file does not exist,
+// the journal has no jobs.
+func ReadJournal(journalFile string) (*Journal, error) {
+	j := &Journal{
+		JournalFile: journalFile,
+	}
+	f, err := os.Open(journalFile)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return j, nil
+	case err != nil:
+		return nil, fmt.Errorf("cannot use journal, file error: %w", err)
+	}
+	if err := j.readAndClose(f); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
 // NewJobConfiguration translates the ingest strategy flags into the journal's
 // execution configuration, including whether plain `.csv` bundles should be
 // considered alongside compressed `.gz` files.
@@ -165,6 +193,118 @@ func (j *Journal) CommitProgress(files []string, coalesced bool, updatedSMT bool
 	return j.writeLocked()
 }
 
+// CommitCTLogProgress is like CommitProgress, but for an interval of entries fetched directly
+// from the CT log at logURL. The completed indices of a CT log are keyed by its URL.
+func (j *Journal) CommitCTLogProgress(
+	logURL string,
+	interval Interval,
+	coalesced bool,
+	updatedSMT bool,
+) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.closed {
+		return fmt.Errorf("cannot commit progress to closed journal")
+	}
+	if logURL == "" {
+		return fmt.Errorf("cannot commit CT log progress without CT log URL")
+	}
+	if interval.Start > interval.End {
+		return fmt.Errorf("invalid interval %s for CT log %q", interval.String(), logURL)
+	}
+
+	job, err := j.currentJob()
+	if err != nil {
+		return err
+	}
+	addCompletedInterval(job.CompletedIndices, logURL, interval)
+	job.Coalesced = coalesced || updatedSMT
+	job.UpdatedSMT = updatedSMT
+	return j.writeLocked()
+}
+
+// CommitPolicyProgress is like CommitProgress, but for the policy documents read from the
+// files of the ingest directory. The completed indices are the indices of the documents in
+// their file, keyed by PolicyFileKey.
+func (j *Journal) CommitPolicyProgress(
+	completed CompletedIndices,
+	coalesced bool,
+	updatedSMT bool,
+) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.closed {
+		return fmt.Errorf("cannot commit progress to closed journal")
+	}
+
+	job, err := j.currentJob()
+	if err != nil {
+		return err
+	}
+	for key, intervals := range completed {
+		if key == "" {
+			return fmt.Errorf("cannot commit policy progress without policy file key")
+		}
+		for _, interval := range intervals {
+			if interval.Start > interval.End {
+				return fmt.Errorf("invalid interval %s for policy file %q", interval.String(), key)
+			}
+			addCompletedInterval(job.CompletedIndices, key, interval)
+		}
+	}
+	job.Coalesced = coalesced || updatedSMT
+	job.UpdatedSMT = updatedSMT
+	return j.writeLocked()
+}
+
+// CompletedIntervals returns a copy of the completed intervals of the key for the current job.
+func (j *Journal) CompletedIntervals(key string) ([]Interval, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.closed {
+		return nil, fmt.Errorf("cannot read completed intervals from closed journal")
+	}
+
+	job, err := j.currentJob()
+	if err != nil {
+		return nil, err
+	}
+	return slices.Clone(job.CompletedIndices[key]), nil
+}
+
+// PolicyFileKey returns the key of the completed indices of the policy file, which is its path
+// relative to the parent of the ingest directory, e.g. "policies/pc_1.pc".
+func PolicyFileKey(file string, ingestDir string) (string, error) {
+	root := filepath.Dir(filepath.Clean(ingestDir))
+	rel, err := filepath.Rel(root, file)
+	if err != nil {
+		return "", fmt.Errorf("policy file %q is not under %q: %w", file, ingestDir, err)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// AddQuarantinedRows adds n malformed rows to those skipped or quarantined by
+// the current job. They are persisted with the next commit, which must be the
+// one of the completed indices that the rows belong to.
+func (j *Journal) AddQuarantinedRows(n int64) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.closed {
+		return fmt.Errorf("cannot add quarantined rows to closed journal")
+	}
+
+	job, err := j.currentJob()
+	if err != nil {
+		return err
+	}
+	job.QuarantinedRows += n
+	return nil
+}
+
 // CommitCTLogSize records the latest CT log size written to the DB for the
 // current completed-index snapshot.
 func (j *Journal) CommitCTLogSize(size int64) error {
@@ -218,6 +358,23 @@ func (j *Journal) PendingFiles() ([]string, error) {
 	return pending, nil
 }
 
+// PendingCTLogIntervals returns the sorted parts of the interval of entries of the CT log at
+// logURL that are not covered by the CompletedIndices of the current job.
+func (j *Journal) PendingCTLogIntervals(logURL string, interval Interval) ([]Interval, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.closed {
+		return nil, fmt.Errorf("cannot read pending intervals from closed journal")
+	}
+
+	job, err := j.currentJob()
+	if err != nil {
+		return nil, err
+	}
+	return subtractIntervals(interval, job.CompletedIndices[logURL]), nil
+}
+
 // reset initializes a new journal instance with the current run configuration
 // and writes its first job entry to disk.
 func (j *Journal) reset(cfg JobConfiguration, ingestDir string) error {
@@ -246,19 +403,26 @@ func (j *Journal) listFiles() ([]string, error) {
 			time.Since(start).Round(time.Millisecond))
 	}()
 
-	gzFiles, csvFiles, err := ListCsvFiles(j.IngestDir)
+	// Default to the compressed bundle set and only opt into plain CSVs when
+	// the current invocation requested them.
+	job, err := j.currentJob()
 	if err != nil {
 		return nil, err
 	}
+	return ListIngestFiles(j.IngestDir, job.JobConfiguration.IncludePlainCSVs)
+}
 
-	files := slices.Clone(gzFiles)
-	// Default to the compressed bundle set and only opt into plain CSVs when
-	// the current invocation requested them.
-	job, err := j.currentJob()
+// ListIngestFiles returns all the bundles of the ingest directory in bundle
+// order, regardless of their progress. Plain `.csv` files are only included if
+// includePlainCSVs is true.
+func ListIngestFiles(ingestDir string, includePlainCSVs bool) ([]string, error) {
+	gzFiles, csvFiles, err := ListCsvFiles(ingestDir)
 	if err != nil {
 		return nil, err
 	}
-	if job.JobConfiguration.IncludePlainCSVs {
+
+	files := slices.Clone(gzFiles)
+	if includePlainCSVs {
 		files = append(files, csvFiles...)
 	}
 	if err := util.SortByBundleName(files); err != nil {
@@ -284,6 +448,7 @@ func (j *Journal) appendJob(cfg JobConfiguration) error {
 		Coalesced:         j.latestCoalesced(),
 		UpdatedSMT:        j.latestUpdatedSMT(),
 		RecordedCTLogSize: j.latestRecordedCTLogSize(),
+		QuarantinedRows:   j.latestQuarantinedRows(),
 		CompletedIndices:  cloneCompletedIndices(j.latestCompletedIndices()),
 	})
 
@@ -404,6 +569,7 @@ func (j *Journal) read(f *os.File) error {
 		return fmt.Errorf("journal file wrong format: %w", err)
 	}
 	j.Jobs = decoded.Jobs
+	j.Audit = decoded.Audit
 	if err := j.normalize(); err != nil {
 		return fmt.Errorf("journal file wrong format: %w", err)
 	}
@@ -446,6 +612,13 @@ func (j *Journal) latestRecordedCTLogSize() int64 {
 	return j.Jobs[len(j.Jobs)-1].RecordedCTLogSize
 }
 
+func (j *Journal) latestQuarantinedRows() int64 {
+	if len(j.Jobs) == 0 {
+		return 0
+	}
+	return j.Jobs[len(j.Jobs)-1].QuarantinedRows
+}
+
 func (j *Journal) currentJob() (*Job, error) {
 	if len(j.Jobs) == 0 {
 		return nil, fmt.Errorf("journal has no jobs")
@@ -649,6 +822,29 @@ func containsCompletedInterval(completed CompletedIndices, ingestDirBase string,
 	return candidate.Start <= interval.Start && candidate.End >= interval.End
 }
 
+// subtractIntervals returns the parts of the interval not covered by the sorted,
+// non-overlapping completed intervals.
+func subtractIntervals(interval Interval, completed []Interval) []Interval {
+	pending := []Interval{}
+	next := interval.Start
+	for _, c := range completed {
+		if c.End < next {
+			continue
+		}
+		if c.Start > interval.End {
+			break
+		}
+		if c.Start > next {
+			pending = append(pending, Interval{Start: next, End: c.Start - 1})
+		}
+		if c.End >= interval.End {
+			return pending
+		}
+		next = c.End + 1
+	}
+	return append(pending, Interval{Start: next, End: interval.End})
+}
+
 // normalizeCompletedFile converts a current-run file path into the canonical
 // ingest-dir and interval pair.
 func normalizeCompletedFile(file string, ingestDir string) (string, Interval, error) {
@@ -676,6 +872,17 @@ func parseFileInterval(file string) (Interval, error) {
 	return interval, nil
 }
 
+// ParseFileInterval returns the inclusive interval of the bundle file, named `A-B.gz` or
+// `A-B.csv`.
+func ParseFileInterval(file string) (Interval, error) {
+	return parseFileInterval(file)
+}
+
+// ParseInterval parses an interval in the inclusive `A-B` form of the journal.
+func ParseInterval(value string) (Interval, error) {
+	return parseIntervalString(value)
+}
+
 // parseIntervalString parses the persisted `A-B` interval encoding.
 func parseIntervalString(value string) (Interval, error) {
 	groups := completedIntervalRe.FindStringSubmatch(value)
@@ -329,6 +329,293 @@ func TestAppendInterval(t *testing.T) {
 	}
 }
 
+// TestSubtractIntervals verifies that only the parts of an interval not covered
+// by the completed intervals are returned.
+func TestSubtractIntervals(t *testing.T) {
+	testCases := map[string]struct {
+		interval  Interval
+		completed []Interval
+		want      []Interval
+	}{
+		"nothing completed": {
+			interval: Interval{Start: 10, End: 19},
+			want:     []Interval{{Start: 10, End: 19}},
+		},
+		"fully covered": {
+			interval:  Interval{Start: 10, End: 19},
+			completed: []Interval{{Start: 0, End: 29}},
+			want:      []Interval{},
+		},
+		"gaps between completed intervals": {
+			interval: Interval{Start: 0, End: 49},
+			completed: []Interval{
+				{Start: 5, End: 9},
+				{Start: 20, End: 29},
+			},
+			want: []Interval{
+				{Start: 0, End: 4},
+				{Start: 10, End: 19},
+				{Start: 30, End: 49},
+			},
+		},
+		"completed intervals outside": {
+			interval: Interval{Start: 10, End: 19},
+			completed: []Interval{
+				{Start: 0, End: 4},
+				{Start: 15, End: 29},
+				{Start: 40, End: 49},
+			},
+			want: []Interval{{Start: 10, End: 14}},
+		},
+	}
+
+	for name, tc := range testCases {
+		name, tc := name, tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			require.Equal(t, tc.want, subtractIntervals(tc.interval, tc.completed))
+		})
+	}
+}
+
+// TestCTLogProgress verifies that the progress of a CT log is keyed by its URL,
+// persisted, and used to compute its pending intervals.
+func TestCTLogProgress(t *testing.T) {
+	const ctLogURL = "https://ct.example.com/logs/test"
+	journalFile := filepath.Join(t.TempDir(), "journal.json")
+	j, err := NewJournal(journalFile, testJobConfig(t, false), "")
+	require.NoError(t, err)
+
+	require.NoError(t, j.CommitCTLogProgress(ctLogURL, Interval{Start: 0, End: 9}, true, false))
+	require.NoError(t, j.CommitCTLogProgress(ctLogURL, Interval{Start: 20, End: 29}, true, false))
+	require.Error(t, j.CommitCTLogProgress("", Interval{Start: 0, End: 9}, false, false))
+	require.NoError(t, j.Close())
+
+	j, err = NewJournal(journalFile, testJobConfig(t, false), "")
+	require.NoError(t, err)
+	defer j.Close()
+	require.Equal(t, CompletedIndices{
+		ctLogURL: {{Start: 0, End: 9}, {Start: 20, End: 29}},
+	}, latestJob(t, j).CompletedIndices)
+	require.True(t, latestJob(t, j).Coalesced)
+
+	pending, err := j.PendingCTLogIntervals(ctLogURL, Interval{Start: 5, End: 39})
+	require.NoError(t, err)
+	require.Equal(t, []Interval{{Start: 10, End: 19}, {Start: 30, End: 39}}, pending)
+	pending, err = j.PendingCTLogIntervals("https://ct.example.com/logs/other",
+		Interval{Start: 5, End: 39})
+	require.NoError(t, err)
+	require.Equal(t, []Interval{{Start: 5, End: 39}}, pending)
+}
+
+// TestPolicyProgress verifies that the progress of policy files is keyed by their path relative
+// to the parent of the ingest directory, persisted, and merged with previous intervals.
+func TestPolicyProgress(t *testing.T) {
+	ingestDir := filepath.Join(t.TempDir(), "policies")
+	key, err := PolicyFileKey(filepath.Join(ingestDir, "sub", "pc_1.pc"), ingestDir+"/")
+	require.NoError(t, err)
+	require.Equal(t, "policies/sub/pc_1.pc", key)
+
+	journalFile := filepath.Join(t.TempDir(), "journal.json")
+	j, err := NewJournal(journalFile, testJobConfig(t, false), "")
+	require.NoError(t, err)
+
+	require.NoError(t, j.CommitPolicyProgress(CompletedIndices{
+		key:                   {{Start: 0, End: 1}},
+		"policies/dump.jsonl": {{Start: 0, End: 4}, {Start: 10, End: 19}},
+	}, false, false))
+	require.NoError(t, j.CommitPolicyProgress(CompletedIndices{
+		"policies/dump.jsonl": {{Start: 5, End: 9}},
+	}, false, false))
+	require.Error(t, j.CommitPolicyProgress(CompletedIndices{"": {{Start: 0, End: 0}}}, false, false))
+	require.Error(t, j.CommitPolicyProgress(CompletedIndices{key: {{Start: 2, End: 1}}}, false, false))
+	require.NoError(t, j.CommitPolicyProgress(nil, false, true))
+	require.NoError(t, j.Close())
+
+	j, err = NewJournal(journalFile, testJobConfig(t, false), "")
+	require.NoError(t, err)
+	defer j.Close()
+	require.Equal(t, CompletedIndices{
+		key:                   {{Start: 0, End: 1}},
+		"policies/dump.jsonl": {{Start: 0, End: 19}},
+	}, latestJob(t, j).CompletedIndices)
+	require.True(t, latestJob(t, j).Coalesced)
+	require.True(t, latestJob(t, j).UpdatedSMT)
+
+	intervals, err := j.CompletedIntervals("policies/dump.jsonl")
+	require.NoError(t, err)
+	require.Equal(t, []Interval{{Start: 0, End: 19}}, intervals)
+	// The returned intervals are a copy.
+	intervals[0].End = 0
+	intervals, err = j.CompletedIntervals("policies/dump.jsonl")
+	require.NoError(t, err)
+	require.Equal(t, []Interval{{Start: 0, End: 19}}, intervals)
+	intervals, err = j.CompletedIntervals("policies/other.pc")
+	require.NoError(t, err)
+	require.Empty(t, intervals)
+}
+
+// TestCoverage verifies that the ranges of the bundles, the completed indices and the recorded
+// CT log size are compared up to the last index known by any of them.
+func TestCoverage(t *testing.T) {
+	files := []string{
+		"log/bundled/20-29.gz",
+		"log/bundled/0-9.gz",
+		"log/bundled/25-34.gz",
+		"log/bundled/40-49.gz",
+		"log/bundled/notabundle.gz",
+	}
+	completed := []Interval{
+		{Start: 0, End: 9},
+		{Start: 20, End: 24},
+	}
+
+	c := NewCoverage("log", files, completed, 60)
+	require.Equal(t, "log", c.Key)
+	require.Equal(t, []Interval{
+		{Start: 0, End: 9},
+		{Start: 20, End: 34},
+		{Start: 40, End: 49},
+	}, c.Bundles)
+	require.Equal(t, completed, c.Completed)
+	require.Equal(t, []Interval{
+		{Start: 10, End: 19},
+		{Start: 35, End: 39},
+		{Start: 50, End: 59},
+	}, c.Missing)
+	require.Equal(t, []Interval{
+		{Start: 25, End: 34},
+		{Start: 40, End: 49},
+	}, c.Pending)
+	require.Equal(t, []BundleOverlap{{
+		Files:    [2]string{"log/bundled/20-29.gz", "log/bundled/25-34.gz"},
+		Interval: Interval{Start: 25, End: 29},
+	}}, c.Overlaps)
+	require.Len(t, c.Inconsistent, 2)
+	require.Equal(t, "log/bundled/notabundle.gz", c.Inconsistent[0].File)
+	require.Equal(t, InconsistentBundle{
+		File:   "log/bundled/20-29.gz",
+		Reason: "partially completed",
+	}, c.Inconsistent[1])
+	require.Equal(t, int64(10), c.CompletedSize())
+	require.Equal(t, []Interval{{Start: 10, End: 19}}, c.Holes())
+
+	// Without bundles, e.g. for a CT log, whatever is not completed is missing.
+	c = NewCoverage("https://ct.example.com/log", nil, []Interval{{Start: 5, End: 9}}, 0)
+	require.Empty(t, c.Bundles)
+	require.Equal(t, []Interval{{Start: 0, End: 4}}, c.Missing)
+	require.Empty(t, c.Pending)
+	require.Equal(t, int64(0), c.CompletedSize())
+	require.Equal(t, []Interval{{Start: 0, End: 4}}, c.Holes())
+
+	c = NewCoverage("log", nil, nil, 0)
+	require.Empty(t, c.Missing)
+	require.Empty(t, c.Holes())
+	require.Equal(t, int64(0), c.CompletedSize())
+}
+
+// TestReadJournal verifies that reading a journal neither appends a job to it nor writes it.
+func TestReadJournal(t *testing.T) {
+	journalFile := filepath.Join(t.TempDir(), "journal.json")
+	j, err := ReadJournal(journalFile)
+	require.NoError(t, err)
+	require.Empty(t, j.Jobs)
+	_, err = os.Stat(journalFile)
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	j, err = NewJournal(journalFile, testJobConfig(t, false), "")
+	require.NoError(t, err)
+	require.NoError(t, j.CommitCTLogProgress("https://ct.example.com/log",
+		Interval{Start: 0, End: 9}, false, false))
+	require.NoError(t, j.Close())
+	before, err := os.ReadFile(journalFile)
+	require.NoError(t, err)
+
+	j, err = ReadJournal(journalFile)
+	require.NoError(t, err)
+	require.Len(t, j.Jobs, 1)
+	require.Equal(t, CompletedIndices{
+		"https://ct.example.com/log": {{Start: 0, End: 9}},
+	}, latestJob(t, j).CompletedIndices)
+	after, err := os.ReadFile(journalFile)
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+}
+
+// TestMarkUnmarkCompact verifies that marking and unmarking intervals is done in new jobs and
+// audited, and that compacting merges the jobs into one snapshot keeping the audit trail.
+func TestMarkUnmarkCompact(t *testing.T) {
+	const key = "https:__ct.example.com_log"
+	journalFile := filepath.Join(t.TempDir(), "journal.json")
+	j, err := NewJournal(journalFile, testJobConfig(t, false), "")
+	require.NoError(t, err)
+	require.NoError(t, j.CommitCTLogProgress(key, Interval{Start: 0, End: 9}, true, true))
+	require.NoError(t, j.Close())
+
+	j, err = ReadJournal(journalFile)
+	require.NoError(t, err)
+	require.NoError(t, j.Mark(key, Interval{Start: 10, End: 29}, "ingested by hand"))
+	require.NoError(t, j.Unmark(key, Interval{Start: 5, End: 14}, "missing from the DB"))
+	require.NoError(t, j.Mark("other", Interval{Start: 0, End: 0}, "test"))
+	require.NoError(t, j.Unmark("other", Interval{Start: 0, End: 0}, "test"))
+	require.Error(t, j.Mark("", Interval{Start: 0, End: 0}, "test"))
+	require.Error(t, j.Mark(key, Interval{Start: 1, End: 0}, "test"))
+	require.Error(t, j.Unmark(key, Interval{Start: 0, End: 0}, ""))
+
+	j, err = ReadJournal(journalFile)
+	require.NoError(t, err)
+	require.Len(t, j.Jobs, 5)
+	job := latestJob(t, j)
+	require.Equal(t, CompletedIndices{
+		key: {{Start: 0, End: 4}, {Start: 15, End: 29}},
+	}, job.CompletedIndices)
+	// The state of the previous jobs is carried forward.
+	require.True(t, job.Coalesced)
+	require.True(t, job.UpdatedSMT)
+	require.Len(t, j.Audit, 4)
+	require.Equal(t, AuditMark, j.Audit[0].Action)
+	require.Equal(t, key, j.Audit[0].Key)
+	require.Equal(t, "10-29", j.Audit[0].Interval)
+	require.Equal(t, "ingested by hand", j.Audit[0].Reason)
+	require.NotEmpty(t, j.Audit[0].Time)
+	require.NotEmpty(t, j.Audit[0].Cmd)
+	require.Equal(t, AuditUnmark, j.Audit[1].Action)
+	require.Equal(t, "5-14", j.Audit[1].Interval)
+	firstStart := j.Jobs[0].StartTime
+
+	require.NoError(t, j.Compact())
+	require.NoError(t, j.Compact())
+	j, err = ReadJournal(journalFile)
+	require.NoError(t, err)
+	require.Len(t, j.Jobs, 1)
+	job = latestJob(t, j)
+	require.Equal(t, 5, job.CompactedJobs)
+	require.Equal(t, firstStart, job.StartTime)
+	require.Equal(t, CompletedIndices{
+		key: {{Start: 0, End: 4}, {Start: 15, End: 29}},
+	}, job.CompletedIndices)
+	require.True(t, job.UpdatedSMT)
+	require.Len(t, j.Audit, 6)
+	require.Equal(t, AuditCompact, j.Audit[4].Action)
+	require.Equal(t, "5 jobs", j.Audit[4].Reason)
+	require.Equal(t, "5 jobs", j.Audit[5].Reason)
+
+	// The next runs carry forward the compacted state.
+	j, err = NewJournal(journalFile, testJobConfig(t, false), "")
+	require.NoError(t, err)
+	require.Len(t, j.Jobs, 2)
+	require.Zero(t, latestJob(t, j).CompactedJobs)
+	pending, err := j.PendingCTLogIntervals(key, Interval{Start: 0, End: 29})
+	require.NoError(t, err)
+	require.Equal(t, []Interval{{Start: 5, End: 14}}, pending)
+	require.NoError(t, j.Close())
+
+	j, err = ReadJournal(filepath.Join(t.TempDir(), "none.json"))
+	require.NoError(t, err)
+	require.Error(t, j.Compact())
+}
+
 // TestContainsCompletedIntervalScenarios verifies that coverage checks succeed
 // only when one stored interval fully contains the queried interval.
 func TestContainsCompletedIntervalScenarios(t *testing.T) {
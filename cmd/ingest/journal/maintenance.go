@@ -0,0 +1,139 @@
+package journal
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"time"
+)
+
+const (
+	// AuditMark is the action of the audit entries of Mark.
+	AuditMark = "mark"
+	// AuditUnmark is the action of the audit entries of Unmark.
+	AuditUnmark = "unmark"
+	// AuditCompact is the action of the audit entries of Compact.
+	AuditCompact = "compact"
+)
+
+// AuditEntry records a manual change of the journal. Unlike the jobs, the audit entries are
+// kept when compacting the journal.
+type AuditEntry struct {
+	Time     string   `json:"Time"`
+	Cmd      []string `json:"Cmd"`
+	Action   string   `json:"Action"`
+	Key      string   `json:"Key,omitempty"`
+	Interval string   `json:"Interval,omitempty"`
+	Reason   string   `json:"Reason,omitempty"`
+}
+
+// Mark records the interval of the key as completed, although it was not ingested by any job,
+// e.g. because its certificates were ingested by other means. The change is done in a new job,
+// audited with the reason, and written to the journal file.
+func (j *Journal) Mark(key string, interval Interval, reason string) error {
+	return j.changeCompleted(AuditMark, key, interval, reason, appendInterval)
+}
+
+// Unmark removes the interval of the key from the completed indices, so that the next runs
+// ingest it again, e.g. because its certificates are missing from the DB. The change is done in
+// a new job, audited with the reason, and written to the journal file.
+func (j *Journal) Unmark(key string, interval Interval, reason string) error {
+	return j.changeCompleted(AuditUnmark, key, interval, reason, removeInterval)
+}
+
+func (j *Journal) changeCompleted(
+	action string,
+	key string,
+	interval Interval,
+	reason string,
+	change func([]Interval, Interval) []Interval,
+) error {
+	if key == "" {
+		return fmt.Errorf("cannot %s an interval without key", action)
+	}
+	if interval.Start > interval.End {
+		return fmt.Errorf("cannot %s invalid interval %s", action, interval)
+	}
+	if reason == "" {
+		return fmt.Errorf("cannot %s an interval without reason", action)
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.closed {
+		return fmt.Errorf("cannot %s an interval in closed journal", action)
+	}
+
+	if err := j.appendJob(JobConfiguration{}); err != nil {
+		return err
+	}
+	job, err := j.currentJob()
+	if err != nil {
+		return err
+	}
+	intervals := change(job.CompletedIndices[key], interval)
+	if len(intervals) == 0 {
+		delete(job.CompletedIndices, key)
+	} else {
+		job.CompletedIndices[key] = intervals
+	}
+	j.audit(action, key, interval.String(), reason)
+	return j.writeLocked()
+}
+
+// Compact merges all the jobs into one snapshot job, with the state and configuration of the
+// latest one, the start time of the first one, and the number of jobs merged, and writes it to
+// the journal file. The audit entries are kept.
+func (j *Journal) Compact() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.closed {
+		return fmt.Errorf("cannot compact closed journal")
+	}
+	if len(j.Jobs) == 0 {
+		return fmt.Errorf("journal has no jobs")
+	}
+
+	compacted := 0
+	for _, job := range j.Jobs {
+		compacted += max(job.CompactedJobs, 1)
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	snapshot := j.Jobs[len(j.Jobs)-1]
+	snapshot.Cwd = cwd
+	snapshot.Cmd = slices.Clone(os.Args)
+	snapshot.StartTime = j.Jobs[0].StartTime
+	snapshot.CompactedJobs = compacted
+	snapshot.CompletedIndices = cloneCompletedIndices(snapshot.CompletedIndices)
+	j.Jobs = []Job{snapshot}
+
+	j.audit(AuditCompact, "", "", fmt.Sprintf("%d jobs", compacted))
+	return j.writeLocked()
+}
+
+// audit appends an audit entry of the current invocation.
+func (j *Journal) audit(action, key, interval, reason string) {
+	j.Audit = append(j.Audit, AuditEntry{
+		Time:     time.Now().UTC().Format(time.RFC3339),
+		Cmd:      slices.Clone(os.Args),
+		Action:   action,
+		Key:      key,
+		Interval: interval,
+		Reason:   reason,
+	})
+}
+
+// removeInterval removes one interval from a sorted interval list, splitting the intervals that
+// contain it.
+func removeInterval(intervals []Interval, interval Interval) []Interval {
+	removed := make([]Interval, 0, len(intervals)+1)
+	for _, i := range intervals {
+		removed = append(removed, subtractIntervals(i, []Interval{interval})...)
+	}
+	return removed
+}
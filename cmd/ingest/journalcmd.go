@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	args "github.com/netsec-ethz/fpki/cmd/ingest/cmdflags"
+	"github.com/netsec-ethz/fpki/cmd/ingest/journal"
+	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/db"
+	"github.com/netsec-ethz/fpki/pkg/db/backends"
+	"github.com/netsec-ethz/fpki/pkg/util"
+)
+
+const (
+	// defVerifySamples is the default number of completed indices sampled by "journal verify".
+	defVerifySamples = 100
+	// maxShownIntervals is the number of completed intervals of each key shown by "journal show".
+	maxShownIntervals = 8
+)
+
+// journalMain runs the "journal" subcommand, which inspects and maintains the journal.
+func journalMain(ctx context.Context, cmdArgs []string) error {
+	usage := func() {
+		fmt.Fprintf(os.Stderr, "Usage:\n"+
+			"%[1]s journal show [-journal file]\n"+
+			"%[1]s journal compact [-journal file]\n"+
+			"%[1]s journal verify [-journal file] [-dbname name | -dbdir dir] [-samples n] directory\n"+
+			"%[1]s journal mark [-journal file] -key key -range A-B -reason text\n"+
+			"%[1]s journal unmark [-journal file] -key key -range A-B -reason text\n",
+			os.Args[0])
+	}
+	if len(cmdArgs) == 0 {
+		usage()
+		return fmt.Errorf("missing journal subcommand")
+	}
+
+	cmd := cmdArgs[0]
+	flags := flag.NewFlagSet("journal "+cmd, flag.ExitOnError)
+	flags.Usage = func() {
+		usage()
+		flags.PrintDefaults()
+	}
+	journalFile := flags.String("journal", args.DefJournalFile, "journal file")
+	switch cmd {
+	case "show":
+		flags.Parse(cmdArgs[1:])
+		j, err := journal.ReadJournal(*journalFile)
+		if err != nil {
+			return err
+		}
+		return showJournal(os.Stdout, j)
+
+	case "compact":
+		flags.Parse(cmdArgs[1:])
+		j, err := readExistingJournal(*journalFile)
+		if err != nil {
+			return err
+		}
+		if err := j.Compact(); err != nil {
+			return err
+		}
+		fmt.Printf("compacted %d jobs into one\n", j.Jobs[0].CompactedJobs)
+		return nil
+
+	case "verify":
+		dbName := flags.String("dbname", args.DefDBName, "database name to connect to")
+		dbDir := flags.String("dbdir", "", "use the embedded DB backend with its files in this "+
+			"directory, instead of connecting to MySQL")
+		samples := flags.Int("samples", defVerifySamples, "number of completed indices to sample")
+		flags.Parse(cmdArgs[1:])
+		if flags.NArg() != 1 || *samples <= 0 {
+			flags.Usage()
+			return fmt.Errorf("verify requires the ingest directory and a positive sample count")
+		}
+		dir := flags.Arg(0)
+
+		j, err := readExistingJournal(*journalFile)
+		if err != nil {
+			return err
+		}
+		conn, err := backends.Connect(dbConfig(*dbName, *dbDir))
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		key := filepath.Base(filepath.Clean(dir))
+		completed, err := j.CompletedIntervals(key)
+		if err != nil {
+			return err
+		}
+		v, err := verifyCompletedIndices(ctx, conn, dir, completed, *samples, rand.New(
+			rand.NewPCG(uint64(time.Now().UnixNano()), 0)))
+		if err != nil {
+			return err
+		}
+		v.write(os.Stdout, key)
+		if len(v.Missing) > 0 {
+			return fmt.Errorf("%d of the sampled certificates of %q are missing from the DB",
+				len(v.Missing), key)
+		}
+		return nil
+
+	case journal.AuditMark, journal.AuditUnmark:
+		key := flags.String("key", "", "key of the completed indices: the base name of the "+
+			"ingest directory, the CT log URL, or the key of a policy file")
+		rangeStr := flags.String("range", "", "inclusive range of indices, as A-B")
+		reason := flags.String("reason", "", "reason of the change, kept in the audit trail")
+		flags.Parse(cmdArgs[1:])
+		interval, err := journal.ParseInterval(*rangeStr)
+		if err != nil {
+			flags.Usage()
+			return err
+		}
+
+		j, err := journal.ReadJournal(*journalFile)
+		if err != nil {
+			return err
+		}
+		change := j.Mark
+		if cmd == journal.AuditUnmark {
+			change = j.Unmark
+		}
+		if err := change(*key, interval, *reason); err != nil {
+			return err
+		}
+		fmt.Printf("%sed %s of %q\n", cmd, interval, *key)
+		return nil
+
+	default:
+		usage()
+		return fmt.Errorf("unknown journal subcommand %q", cmd)
+	}
+}
+
+// readExistingJournal reads the journal file, which must exist.
+func readExistingJournal(journalFile string) (*journal.Journal, error) {
+	j, err := journal.ReadJournal(journalFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(j.Jobs) == 0 {
+		return nil, fmt.Errorf("journal %q has no jobs", journalFile)
+	}
+	return j, nil
+}
+
+// showJournal writes a human summary of the journal: its history, the state of its latest job,
+// the completed indices of each key, and the audit trail.
+func showJournal(w io.Writer, j *journal.Journal) error {
+	if len(j.Jobs) == 0 {
+		_, err := fmt.Fprintf(w, "Journal %s has no jobs\n", j.JournalFile)
+		return err
+	}
+
+	var b strings.Builder
+	first, last := j.Jobs[0], j.Jobs[len(j.Jobs)-1]
+	fmt.Fprintf(&b, "Journal %s: %d jobs", j.JournalFile, len(j.Jobs))
+	if first.CompactedJobs > 0 {
+		fmt.Fprintf(&b, ", the first one compacting %d", first.CompactedJobs)
+	}
+	fmt.Fprintf(&b, ", from %s to %s\n", first.StartTime, last.EndTime)
+	fmt.Fprintf(&b, "Latest job: %s\n", strings.Join(last.Cmd, " "))
+	fmt.Fprintf(&b, "  coalesced: %t, SMT updated: %t, recorded CT log size: %d, "+
+		"quarantined rows: %d\n",
+		last.Coalesced, last.UpdatedSMT, last.RecordedCTLogSize, last.QuarantinedRows)
+
+	keys := make([]string, 0, len(last.CompletedIndices))
+	for key := range last.CompletedIndices {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	fmt.Fprintf(&b, "Completed indices of %d keys:\n", len(keys))
+	for _, key := range keys {
+		c := journal.NewCoverage(key, nil, last.CompletedIndices[key], 0)
+		count := uint64(0)
+		for _, interval := range c.Completed {
+			count += uint64(interval.End-interval.Start) + 1
+		}
+		shown := intervalStrings(c.Completed[:min(len(c.Completed), maxShownIntervals)])
+		if more := len(c.Completed) - len(shown); more > 0 {
+			shown = append(shown, fmt.Sprintf("and %d more", more))
+		}
+		fmt.Fprintf(&b, "  %s: %d indices in %d intervals [%s], completed size %d",
+			key, count, len(c.Completed), strings.Join(shown, " "), c.CompletedSize())
+		if holes := c.Holes(); len(holes) > 0 {
+			fmt.Fprintf(&b, ", %d holes", len(holes))
+		}
+		b.WriteString("\n")
+	}
+
+	if len(j.Audit) > 0 {
+		fmt.Fprintf(&b, "Audit trail:\n")
+		for _, entry := range j.Audit {
+			fmt.Fprintf(&b, "  %s %s", entry.Time, entry.Action)
+			if entry.Key != "" {
+				fmt.Fprintf(&b, " %s %s", entry.Key, entry.Interval)
+			}
+			fmt.Fprintf(&b, ": %s\n", entry.Reason)
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// journalVerification is the result of sampling the completed indices of an ingest directory.
+type journalVerification struct {
+	Completed uint64 // Number of completed indices.
+	Sampled   int
+	InDB      int
+	Expired   int // Not ingested, or already pruned.
+	Malformed int // Skipped or quarantined.
+	NoBundle  int // Neither a bundle file nor a row of it has the index.
+	Missing   []uint
+}
+
+func (v journalVerification) write(w io.Writer, key string) {
+	fmt.Fprintf(w, "%s: sampled %d of %d completed indices: %d in the DB, %d expired, "+
+		"%d malformed, %d without bundle, %d missing\n",
+		key, v.Sampled, v.Completed, v.InDB, v.Expired, v.Malformed, v.NoBundle, len(v.Missing))
+	for _, index := range v.Missing {
+		fmt.Fprintf(w, "  missing index %d\n", index)
+	}
+}
+
+// verifyCompletedIndices samples the completed indices of the ingest directory, reads their
+// certificates from its bundles, and checks that those not expired are in the DB.
+func verifyCompletedIndices(
+	ctx context.Context,
+	conn db.Conn,
+	dir string,
+	completed []journal.Interval,
+	samples int,
+	rng *rand.Rand,
+) (journalVerification, error) {
+	var v journalVerification
+	for _, interval := range completed {
+		v.Completed += uint64(interval.End-interval.Start) + 1
+	}
+	indices := sampleIntervals(completed, v.Completed, min(uint64(samples), v.Completed), rng)
+	v.Sampled = len(indices)
+
+	// Group the sampled indices by the first bundle that has them.
+	gzFiles, csvFiles, err := journal.ListCsvFiles(dir)
+	if err != nil {
+		return v, err
+	}
+	type bundle struct {
+		file    string
+		first   uint
+		indices map[uint]struct{}
+	}
+	var bundles []*bundle
+	for _, file := range append(gzFiles, csvFiles...) {
+		first, err := util.CsvFilenameToFirstIndex(file)
+		if err != nil {
+			continue
+		}
+		count, err := util.EstimateCertCount(file)
+		if err != nil {
+			continue
+		}
+		b := &bundle{file: file, first: first, indices: make(map[uint]struct{})}
+		for _, index := range indices {
+			if first <= index && index < first+count {
+				b.indices[index] = struct{}{}
+			}
+		}
+		bundles = append(bundles, b)
+	}
+	ids := make([]common.SHA256Output, 0, len(indices))
+	idIndices := make([]uint, 0, len(indices))
+	found := make(map[uint]struct{}, len(indices))
+	now := time.Now()
+	for _, b := range bundles {
+		// Skip the indices already found in a previous bundle.
+		for index := range b.indices {
+			if _, ok := found[index]; ok {
+				delete(b.indices, index)
+			}
+		}
+		if len(b.indices) == 0 {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return v, err
+		}
+
+		f := loadInputFile(b.file)
+		r, err := f.Open()
+		if err != nil {
+			return v, err
+		}
+		var format ctCSVFormat
+		err = format.split(bufio.NewReader(r), b.file, func(l line) {
+			index := b.first + uint(l.number) - 1
+			if _, ok := b.indices[index]; !ok {
+				return
+			}
+			found[index] = struct{}{}
+			expiration, _, err := format.expiration(&l)
+			if err != nil {
+				v.Malformed++
+				return
+			}
+			if now.After(time.Unix(expiration, 0)) {
+				v.Expired++
+				return
+			}
+			payload, err := format.decodeCert(&l)
+			if err != nil {
+				v.Malformed++
+				return
+			}
+			ids = append(ids, common.SHA256Hash32Bytes(payload))
+			idIndices = append(idIndices, index)
+		}, nil)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return v, err
+		}
+	}
+	v.NoBundle = len(indices) - len(found)
+
+	if len(ids) == 0 {
+		return v, nil
+	}
+	exist, err := conn.CheckCertsExist(ctx, ids)
+	if err != nil {
+		return v, err
+	}
+	for i, ok := range exist {
+		if ok {
+			v.InDB++
+		} else {
+			v.Missing = append(v.Missing, idIndices[i])
+		}
+	}
+	slices.Sort(v.Missing)
+	return v, nil
+}
+
+// sampleIntervals returns n distinct indices of the sorted intervals, which have total indices,
+// chosen at random and sorted.
+func sampleIntervals(intervals []journal.Interval, total, n uint64, rng *rand.Rand) []uint {
+	offsets := make(map[uint64]struct{}, n)
+	for uint64(len(offsets)) < n {
+		offsets[rng.Uint64N(total)] = struct{}{}
+	}
+	sorted := make([]uint64, 0, n)
+	for offset := range offsets {
+		sorted = append(sorted, offset)
+	}
+	slices.Sort(sorted)
+
+	indices := make([]uint, 0, n)
+	base := uint64(0)
+	i := 0
+	for _, offset := range sorted {
+		for offset >= base+uint64(intervals[i].End-intervals[i].Start)+1 {
+			base += uint64(intervals[i].End-intervals[i].Start) + 1
+			i++
+		}
+		indices = append(indices, intervals[i].Start+uint(offset-base))
+	}
+	return indices
+}
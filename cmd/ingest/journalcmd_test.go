@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"math/rand/v2"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/netsec-ethz/fpki/cmd/ingest/journal"
+	"github.com/netsec-ethz/fpki/pkg/db"
+	"github.com/netsec-ethz/fpki/pkg/db/embedded"
+	"github.com/netsec-ethz/fpki/pkg/statistics"
+	"github.com/netsec-ethz/fpki/pkg/tests/random"
+	"github.com/netsec-ethz/fpki/pkg/util"
+)
+
+func TestShowJournal(t *testing.T) {
+	const key = "https:__ct.example.com_log"
+	journalFile := filepath.Join(t.TempDir(), "journal.json")
+
+	j, err := journal.ReadJournal(journalFile)
+	require.NoError(t, err)
+	var out strings.Builder
+	require.NoError(t, showJournal(&out, j))
+	require.Contains(t, out.String(), "has no jobs")
+
+	require.NoError(t, j.Mark(key, journal.Interval{Start: 0, End: 9}, "ingested by hand"))
+	require.NoError(t, j.Mark(key, journal.Interval{Start: 20, End: 29}, "ingested by hand"))
+	require.NoError(t, j.Compact())
+	j, err = journal.ReadJournal(journalFile)
+	require.NoError(t, err)
+
+	out.Reset()
+	require.NoError(t, showJournal(&out, j))
+	require.Contains(t, out.String(), "1 jobs, the first one compacting 2")
+	require.Contains(t, out.String(),
+		key+": 20 indices in 2 intervals [0-9 20-29], completed size 10, 1 holes\n")
+	require.Contains(t, out.String(), "mark "+key+" 0-9: ingested by hand\n")
+	require.Contains(t, out.String(), "compact: 2 jobs\n")
+}
+
+func TestSampleIntervals(t *testing.T) {
+	intervals := []journal.Interval{
+		{Start: 5, End: 9},
+		{Start: 20, End: 20},
+		{Start: 30, End: 34},
+	}
+	rng := rand.New(rand.NewPCG(1, 2))
+	require.Equal(t, []uint{5, 6, 7, 8, 9, 20, 30, 31, 32, 33, 34},
+		sampleIntervals(intervals, 11, 11, rng))
+
+	indices := sampleIntervals(intervals, 11, 4, rng)
+	require.Len(t, indices, 4)
+	require.IsIncreasing(t, indices)
+	for _, index := range indices {
+		require.True(t, intervalsContain(intervals, index))
+	}
+}
+
+// TestVerifyCompletedIndices checks that the sampled completed indices are looked up in the
+// bundles, and that only the certificates not expired are expected in the DB.
+func TestVerifyCompletedIndices(t *testing.T) {
+	ctx, cancelF := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelF()
+
+	conn, err := embedded.Connect(db.NewConfig(embedded.WithDirectory(t.TempDir())))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	a := base64.StdEncoding.EncodeToString(random.RandomX509Cert(t, "a.com").Raw)
+	b := base64.StdEncoding.EncodeToString(random.RandomX509Cert(t, "b.com").Raw)
+	c := base64.StdEncoding.EncodeToString(random.RandomX509Cert(t, "c.com").Raw)
+	issuer := base64.StdEncoding.EncodeToString(random.RandomX509Cert(t, "issuer.com").Raw)
+	const expiration = "4000000000.0"
+
+	// Only the certificate a is ingested.
+	ingested := filepath.Join(t.TempDir(), "ingested", "bundled", "0-0.gz")
+	writeCTBundle(t, ingested, ctCSVRow(a, issuer, expiration))
+	stats := statistics.NewStatistics(time.Hour, nil)
+	defer stats.Stop()
+	proc, err := NewProcessor(ctx, conn, 10, stats, WithStreamCsv(true))
+	require.NoError(t, err)
+	proc.AddCsvFiles([]util.CsvFile{loadInputFile(ingested)})
+	proc.Resume()
+	require.NoError(t, proc.Wait())
+
+	dir := filepath.Join(t.TempDir(), "log")
+	writeCTBundle(t, filepath.Join(dir, "bundled", "0-3.gz"),
+		ctCSVRow(a, issuer, expiration),
+		ctCSVRow(b, issuer, expiration),
+		ctCSVRow(c, issuer, "1.0"),
+		ctCSVRow("not base64!", issuer, expiration),
+	)
+	completed := []journal.Interval{{Start: 0, End: 4}}
+
+	v, err := verifyCompletedIndices(ctx, conn, dir, completed, 100,
+		rand.New(rand.NewPCG(1, 2)))
+	require.NoError(t, err)
+	require.Equal(t, journalVerification{
+		Completed: 5,
+		Sampled:   5,
+		InDB:      1,
+		Expired:   1,
+		Malformed: 1,
+		NoBundle:  1,
+		Missing:   []uint{1},
+	}, v)
+
+	var out strings.Builder
+	v.write(&out, "log")
+	require.Equal(t, "log: sampled 5 of 5 completed indices: 1 in the DB, 1 expired, "+
+		"1 malformed, 1 without bundle, 1 missing\n  missing index 1\n", out.String())
+}
@@ -18,8 +18,13 @@ import (
 
 	args "github.com/netsec-ethz/fpki/cmd/ingest/cmdflags"
 	"github.com/netsec-ethz/fpki/cmd/ingest/journal"
+	"github.com/netsec-ethz/fpki/pkg/common"
 	"github.com/netsec-ethz/fpki/pkg/db"
+	"github.com/netsec-ethz/fpki/pkg/db/backends"
+	"github.com/netsec-ethz/fpki/pkg/db/embedded"
 	"github.com/netsec-ethz/fpki/pkg/db/mysql"
+	"github.com/netsec-ethz/fpki/pkg/mapserver/logfetcher"
+	"github.com/netsec-ethz/fpki/pkg/mapserver/updater"
 	"github.com/netsec-ethz/fpki/pkg/statistics"
 	tr "github.com/netsec-ethz/fpki/pkg/tracing"
 	"github.com/netsec-ethz/fpki/pkg/util"
@@ -61,6 +66,10 @@ func mainFunction() error {
 	defer cancel()
 	defer util.ShutdownFunction()
 
+	if len(os.Args) > 1 && os.Args[1] == "journal" {
+		return journalMain(ctx, os.Args[2:])
+	}
+
 	tr.SetGlobalTracerName("ingest-cli")
 	ctx, span := tr.MT().Start(ctx, "main")
 	defer span.End()
@@ -72,16 +81,14 @@ func mainFunction() error {
 		return err
 	}
 
-	// Connect to DB via local socket, should be faster.
-	config := db.NewConfig(
-		db.WithDB(cfg.DBName),
-		mysql.WithDefaults(),
-		mysql.WithEnvironment(),
-		mysql.WithLocalSocket("/var/run/mysqld/mysqld.sock"),
-	)
-	conn, err := mysql.Connect(config)
-	if err != nil {
-		return err
+	// A dry run writes nothing, thus needs no DB.
+	dryRun := newDryRunConn()
+	var conn db.Conn = dryRun
+	if !cfg.dryRun() {
+		var err error
+		if conn, err = backends.Connect(dbConfig(cfg.DBName, cfg.DBDir)); err != nil {
+			return err
+		}
 	}
 	defer conn.Close()
 
@@ -149,6 +156,67 @@ func mainFunction() error {
 		exit:              util.Exit,
 	})
 
+	format, err := cfg.Format()
+	if err != nil {
+		return err
+	}
+
+	// When ingesting from a CT log, its fetcher replaces the files as source of certificates.
+	var fetcher logfetcher.Fetcher
+	if cfg.CTLogURL != "" {
+		fetcher, err = logfetcher.NewHttpLogFetcher(cfg.CTLogURL)
+		if err != nil {
+			return err
+		}
+	}
+
+	quarantine, err := openRowQuarantine(cfg, dryRun)
+	if err != nil {
+		return err
+	}
+	defer quarantine.Close()
+
+	certFilter, err := openCertFilter(ctx, cfg, conn)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := certFilter.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "closing certificate filter: %s\n", err)
+		}
+	}()
+
+	// Without budget, each worker keeps its own LRU cache.
+	var cacheBytes int64
+	if cfg.Cache == BoundedCacheKind {
+		cacheBytes = cfg.CacheBytes
+	}
+
+	newProcessor := func(
+		ctx context.Context,
+		stats *statistics.Stats,
+		options ...ingestOptions,
+	) (*Processor, error) {
+		return NewProcessor(
+			ctx,
+			conn,
+			cfg.MultiInsertSize,
+			stats,
+			append([]ingestOptions{
+				WithNumFileReaders(cfg.NumFiles),
+				WithNumToChains(cfg.NumParsers),
+				WithNumToCerts(cfg.NumChainToCerts),
+				WithNumDBWriters(cfg.NumDBWriters),
+				WithSkipMissingFiles(cfg.SkipMissingFiles),
+				WithStreamCsv(cfg.StreamCsv || cfg.dryRun()),
+				WithInputFormat(format),
+				WithRowQuarantine(quarantine),
+				WithCertFilter(certFilter),
+				WithBoundedCache(cacheBytes),
+			}, options...)...,
+		)
+	}
+
 	err = runIngest(ctx, cfg, RunDependencies{
 		NewJournal: func(cfg RunConfig, jobCfg journal.JobConfiguration) (*journal.Journal, error) {
 			return journal.NewJournal(cfg.JournalFile, jobCfg, cfg.Directory)
@@ -157,57 +225,97 @@ func mainFunction() error {
 			return statistics.NewStatistics(2*time.Second, printStats)
 		},
 		BeforeBatch: gcBeforeBatch,
-		RunBatch: func(stats *statistics.Stats, files []string) error {
+		RunBatch: func(ctx context.Context, stats *statistics.Stats, files []string) error {
 			ctx, span := tr.MT().Start(ctx, "file-ingestion")
 			defer span.End()
 
-			proc, err := NewProcessor(
-				ctx,
-				conn,
-				cfg.MultiInsertSize,
-				stats,
-				WithNumFileReaders(cfg.NumFiles),
-				WithNumToChains(cfg.NumParsers),
-				WithNumToCerts(cfg.NumChainToCerts),
-				WithNumDBWriters(cfg.NumDBWriters),
-				WithSkipMissingFiles(cfg.SkipMissingFiles),
-			)
+			proc, err := newProcessor(ctx, stats)
 			if err != nil {
 				return err
 			}
 
 			csvFiles := make([]util.CsvFile, 0, len(files))
 			for _, filename := range files {
-				f, err := util.LoadCsvFile(filename)
-				if err != nil {
-					return err
-				}
-				csvFiles = append(csvFiles, f)
+				csvFiles = append(csvFiles, loadInputFile(filename))
 			}
 			proc.AddCsvFiles(csvFiles)
-			logBatchStart(files)
+			if !cfg.dryRun() {
+				// The standard output is left to the dry run report.
+				logBatchStart(files)
+			}
+			proc.Resume()
+			err = proc.Wait()
+			if err == nil {
+				// E.g. the lease of a distributed batch was lost before all its certificates
+				// were written.
+				err = ctx.Err()
+			}
+			return certFilter.finishBatch(err)
+		},
+		CTLogSize: func(ctx context.Context) (int64, error) {
+			state, err := fetcher.GetCurrentState(ctx, logfetcher.State{})
+			if err != nil {
+				return 0, err
+			}
+			return int64(state.Size), nil
+		},
+		RunCTLogBatch: func(stats *statistics.Stats, interval journal.Interval) error {
+			ctx, span := tr.MT().Start(ctx, "ctlog-ingestion")
+			defer span.End()
+
+			proc, err := newProcessor(ctx, stats, WithCTLogFetcher(fetcher))
+			if err != nil {
+				return err
+			}
+			proc.AddCTLogRange(int64(interval.Start), int64(interval.End))
+			logCTLogBatchStart(cfg.CTLogURL, interval)
 			proc.Resume()
-			return proc.Wait()
+			return certFilter.finishBatch(proc.Wait())
 		},
-		Coalesce: func() error {
+		RunPolicyBatch: func(stats *statistics.Stats, docs []common.PolicyDocument) error {
+			ctx, span := tr.MT().Start(ctx, "policy-ingestion")
+			defer span.End()
+
+			fmt.Printf("[%s] Starting ingesting %d policy documents\n",
+				time.Now().Format(time.StampMilli), len(docs))
+			return updater.UpdatePoliciesWithKeepExisting(ctx, conn, docs)
+		},
+		RetrievePoliciesPage: conn.RetrievePoliciesPage,
+		Coalesce: func(ctx context.Context) error {
 			ctx, span := tr.MT().Start(ctx, "coalesce")
 			defer span.End()
 			return coalescePayloadsForDirtyDomains(ctx, conn)
 		},
-		UpdateSMT: func() error {
+		UpdateSMT: func(ctx context.Context) error {
 			ctx, span := tr.MT().Start(ctx, "smt-update")
 			defer span.End()
 			if err := updateSMT(ctx, conn); err != nil {
 				return err
 			}
+			// The dirty domains are kept if the lease of a distributed job was lost meanwhile,
+			// for the worker finalizing it now.
+			if err := ctx.Err(); err != nil {
+				return err
+			}
 			return cleanupDirty(ctx, conn)
 		},
+		ReportDryRun: func(stats *statistics.Stats) error {
+			return writeDryRunReport(os.Stdout, dryRun.report(stats))
+		},
+		ReportCoverage: func(report coverageReport) error {
+			return writeCoverageReport(os.Stdout, report)
+		},
 		RecordCTSize: func(ctx context.Context, ctLogURL string, size int64) error {
 			if err := conn.UpdateLastCTlogServerState(ctx, ctLogURL, size, nil); err != nil {
 				return fmt.Errorf("updating ctlog_server_last_status with url=%q size=%d: %w", ctLogURL, size, err)
 			}
 			return nil
 		},
+		RecordedCTSize: func(ctx context.Context, ctLogURL string) (int64, error) {
+			size, _, err := conn.LastCTlogServerState(ctx, ctLogURL)
+			return size, err
+		},
+		IngestQueue: conn,
 	})
 	if interrupted.Load() && errors.Is(err, context.Canceled) {
 		return fmt.Errorf("ingest interrupted")
@@ -215,11 +323,27 @@ func mainFunction() error {
 	return err
 }
 
+// dbConfig returns the configuration of the embedded DB in dbDir if set, or otherwise of the
+// MySQL DB with the name.
+func dbConfig(dbName, dbDir string) *db.Configuration {
+	if dbDir != "" {
+		return db.NewConfig(embedded.WithDirectory(dbDir))
+	}
+	// Connect to DB via local socket, should be faster.
+	return db.NewConfig(
+		db.WithDB(dbName),
+		mysql.WithDefaults(),
+		mysql.WithEnvironment(),
+		mysql.WithLocalSocket("/var/run/mysqld/mysqld.sock"),
+	)
+}
+
 func printStats(s *statistics.Stats) {
 	readFiles := s.TotalFilesRead.Load()
 	totalFiles := s.TotalFiles.Load()
 	totalRows := s.TotalRows.Load()
 	readRows := s.ReadRows.Load()
+	malformedRows := s.MalformedRows.Load()
 
 	readCerts := s.ReadCerts.Load()
 	readBytes := s.ReadBytes.Load()
@@ -230,11 +354,12 @@ func printStats(s *statistics.Stats) {
 	expiredCerts := s.ExpiredCerts.Load()
 	secondsSinceStart := float64(time.Since(s.CreateTime).Seconds())
 
-	msg := fmt.Sprintf("%d/%d Files read. %d/%d rows read [%.2f%%], %d cert payloads read, %d written. %.0f certs/s "+
-		"(%.0f%% uncached payloads, %.0f%% expired rows), %.1f | %.1f Mb/s r|w                    ",
+	msg := fmt.Sprintf("%d/%d Files read. %d/%d rows read [%.2f%%], %d malformed, %d cert payloads read, %d written. %.0f certs/s "+
+		"(%.0f%% uncached payloads, %.0f%% expired rows), %.1f | %.1f Mb/s r|w",
 		readFiles, totalFiles,
 		readRows, totalRows,
 		safeDivide(float64(readRows)*100, float64(totalRows)),
+		malformedRows,
 		readCerts,
 		writtenCerts,
 		safeDivide(float64(readCerts), secondsSinceStart),
@@ -244,6 +369,16 @@ func printStats(s *statistics.Stats) {
 		safeDivide(float64(writtenBytes)/1024/1024, secondsSinceStart),
 	)
 
+	if quarantined := s.QuarantinedEntries.Load(); quarantined > 0 {
+		msg += fmt.Sprintf(", %d CT log entries quarantined", quarantined)
+	}
+	if hits, misses := s.CacheLookups(); hits+misses > 0 {
+		msg += fmt.Sprintf(", cache %.0f%% hits, %d evictions",
+			safeDivide(float64(hits)*100, float64(hits+misses)), s.CacheEvictions.Load())
+	}
+	// Pad to overwrite the longer previous messages.
+	msg += "                    "
+
 	fmt.Fprintf(os.Stderr, "%s\r", msg)
 }
 
@@ -255,21 +390,45 @@ func safeDivide(numerator, denominator float64) float64 {
 }
 
 func configFromFlags() RunConfig {
+	worker := *args.Worker
+	if worker == "" {
+		worker = defaultWorkerName()
+	}
 	return RunConfig{
-		Directory:        flag.Arg(0),
-		Strategy:         *args.Strategy,
-		JournalFile:      *args.JournalFile,
-		DBName:           *args.DBName,
-		FileBatch:        *args.FileBatch,
-		MultiInsertSize:  *args.MultiInsertSize,
-		NumFiles:         *args.NumFiles,
-		NumParsers:       *args.NumParsers,
-		NumChainToCerts:  *args.NumChainToCerts,
-		NumDBWriters:     *args.NumDBWriters,
-		IncludePlainCSVs: *args.IncludePlainCSVs,
-		SkipMissingFiles: *args.SkipMissingFiles,
-		CpuProfile:       *args.CpuProfile,
-		MemProfile:       *args.MemProfile,
+		Directory:          flag.Arg(0),
+		Strategy:           *args.Strategy,
+		JournalFile:        *args.JournalFile,
+		DBName:             *args.DBName,
+		DBDir:              *args.DBDir,
+		FileBatch:          *args.FileBatch,
+		MultiInsertSize:    *args.MultiInsertSize,
+		NumFiles:           *args.NumFiles,
+		NumParsers:         *args.NumParsers,
+		NumChainToCerts:    *args.NumChainToCerts,
+		NumDBWriters:       *args.NumDBWriters,
+		IncludePlainCSVs:   *args.IncludePlainCSVs,
+		SkipMissingFiles:   *args.SkipMissingFiles,
+		StreamCsv:          *args.StreamCsv,
+		InputFormat:        *args.InputFormat,
+		OnError:            *args.OnError,
+		QuarantineFile:     *args.QuarantineFile,
+		Policies:           *args.Policies,
+		TrustedPolicyRoots: *args.TrustedPolicyRoots,
+		CTLogURL:           *args.CTLogURL,
+		CTLogStart:         *args.CTLogStart,
+		CTLogEnd:           *args.CTLogEnd,
+		CTLogBatch:         *args.CTLogBatch,
+		Job:                *args.Job,
+		Coordinator:        *args.Coordinator,
+		Worker:             worker,
+		Lease:              *args.Lease,
+		CertFilter:         *args.CertFilter,
+		CertFilterSize:     *args.CertFilterSize,
+		RebuildCertFilter:  *args.RebuildCertFilter,
+		Cache:              *args.Cache,
+		CacheBytes:         *args.CacheBytes,
+		CpuProfile:         *args.CpuProfile,
+		MemProfile:         *args.MemProfile,
 	}
 }
 
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/netsec-ethz/fpki/cmd/ingest/journal"
+	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/common/crypto"
+	"github.com/netsec-ethz/fpki/pkg/db"
+	"github.com/netsec-ethz/fpki/pkg/statistics"
+)
+
+const (
+	// policyLinesExtension is the extension of the dumps with one policy document per line.
+	policyLinesExtension = ".jsonl"
+)
+
+// policyDocumentExtensions are the extensions of the files with one policy document, or a list
+// of them, e.g. the policy certificates and revocations written by the policy generator.
+var policyDocumentExtensions = []string{".pc", ".pcrev", ".json"}
+
+// policyDocument is a policy document read from a policy file.
+type policyDocument struct {
+	common.PolicyDocument
+	key   string // The journal key of its file.
+	index uint   // The index of the document in its file.
+}
+
+// policyFileExtension returns the extension of the policy file, ignoring any .gz suffix.
+func policyFileExtension(filename string) string {
+	return filepath.Ext(strings.TrimSuffix(strings.ToLower(filename), ".gz"))
+}
+
+// listPolicyFiles returns the policy files under the directory, in lexical order, except the
+// hidden ones. Files with other extensions are ignored.
+func listPolicyFiles(dir string) ([]string, error) {
+	files, err := listInputFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	policyFiles := files[:0]
+	for _, file := range files {
+		ext := policyFileExtension(file)
+		if ext == policyLinesExtension || slices.Contains(policyDocumentExtensions, ext) {
+			policyFiles = append(policyFiles, file)
+		}
+	}
+	return policyFiles, nil
+}
+
+// readPolicyFile calls yield with each policy document of the file and its index, in order.
+func readPolicyFile(filename string, yield func(uint, common.PolicyDocument) error) error {
+	f := loadInputFile(filename)
+	r, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if policyFileExtension(filename) != policyLinesExtension {
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", filename, err)
+		}
+		docs, err := parsePolicyDocuments(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", filename, err)
+		}
+		for i, doc := range docs {
+			if err := yield(uint(i), doc); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	br := bufio.NewReader(r)
+	index := uint(0)
+	for lineNo := 1; ; lineNo++ {
+		rawLine, readErr := br.ReadBytes('\n')
+		if readErr != nil && !errors.Is(readErr, io.EOF) {
+			return fmt.Errorf("reading %s: %w", filename, readErr)
+		}
+		if rawLine = bytes.TrimSpace(rawLine); len(rawLine) > 0 {
+			docs, err := parsePolicyDocuments(rawLine)
+			if err != nil {
+				return fmt.Errorf("%s at line %d: %w", filename, lineNo, err)
+			}
+			if len(docs) != 1 {
+				return fmt.Errorf("%s at line %d: %d policy documents instead of one",
+					filename, lineNo, len(docs))
+			}
+			if err := yield(index, docs[0]); err != nil {
+				return err
+			}
+			index++
+		}
+		if errors.Is(readErr, io.EOF) {
+			return nil
+		}
+	}
+}
+
+// parsePolicyDocuments returns the policy certificates and revocations of the JSON data, which
+// is one of them or a list of them. As with util.PolicyCertificateFromFile, the raw JSON is not
+// kept, so that the payloads of the documents don't depend on how they were serialized.
+func parsePolicyDocuments(data []byte) ([]common.PolicyDocument, error) {
+	obj, err := common.FromJSON(data, common.WithSkipCopyJSONIntoPolicyObjects)
+	if err != nil {
+		return nil, err
+	}
+	list, ok := obj.([]any)
+	if !ok {
+		list = []any{obj}
+	}
+	docs := make([]common.PolicyDocument, len(list))
+	for i, obj := range list {
+		switch doc := obj.(type) {
+		case *common.PolicyCertificate:
+			docs[i] = doc
+		case common.PolicyCertificate:
+			docs[i] = &doc
+		case *common.PolicyCertificateRevocation:
+			docs[i] = doc
+		case common.PolicyCertificateRevocation:
+			docs[i] = &doc
+		default:
+			return nil, fmt.Errorf("unsupported policy document of type %T", obj)
+		}
+	}
+	return docs, nil
+}
+
+// policyIssuersPageSize is the number of rows of the policies table read at once to find the
+// issuers ingested before.
+const policyIssuersPageSize = 10_000
+
+// errPolicyIssuerCycle is the validation error of the issuers found again while validating
+// their own chain.
+var errPolicyIssuerCycle = errors.New("cycle of policy certificate issuers")
+
+// policyValidator validates policy documents with the policy certificates that issued them,
+// found by the issuer hash of the documents. The chain of issuers of a valid document ends at a
+// trusted root, or at a policy certificate already in the DB, which was valid when ingested.
+type policyValidator struct {
+	trusted map[string]struct{}                  // The hashes as signer of the trusted roots.
+	issuers map[string]*common.PolicyCertificate // By their hash as signer.
+	checked map[string]error                     // The validation of the issuers.
+
+	// retrievePoliciesPage, if not nil, reads the policies table, whose issuers are loaded into
+	// stored the first time one is not found among the issuers.
+	retrievePoliciesPage func(context.Context, *common.SHA256Output, int) ([]*db.PayloadRecord,
+		error)
+	stored map[string]*common.PolicyCertificate // By their hash as signer. Nil until loaded.
+}
+
+// newPolicyValidator returns a validator that trusts the roots, and looks up the issuers not
+// found among those added in the pages of the policies table, if retrievePoliciesPage is not nil.
+func newPolicyValidator(
+	trustedRoots []*common.PolicyCertificate,
+	retrievePoliciesPage func(context.Context, *common.SHA256Output, int) ([]*db.PayloadRecord,
+		error),
+) (*policyValidator, error) {
+	v := &policyValidator{
+		trusted:              make(map[string]struct{}),
+		issuers:              make(map[string]*common.PolicyCertificate),
+		checked:              make(map[string]error),
+		retrievePoliciesPage: retrievePoliciesPage,
+	}
+	for _, root := range trustedRoots {
+		if root.IssuerHash != nil || root.IssuerSignature != nil {
+			return nil, fmt.Errorf("trusted root policy certificate for %s has an issuer",
+				root.Domain())
+		}
+		hash, err := crypto.ComputeHashAsSigner(root)
+		if err != nil {
+			return nil, err
+		}
+		v.trusted[string(hash)] = struct{}{}
+		if err := v.addIssuer(root); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// addIssuer keeps the document as issuer of others, if it is a policy certificate that can issue.
+func (v *policyValidator) addIssuer(doc common.PolicyDocument) error {
+	pc, ok := doc.(*common.PolicyCertificate)
+	if !ok || !pc.CanIssue {
+		return nil
+	}
+	hash, err := crypto.ComputeHashAsSigner(pc)
+	if err != nil {
+		return err
+	}
+	v.issuers[string(hash)] = pc
+	return nil
+}
+
+// validate checks the issuer signature of the document, and the constraints of its issuer,
+// whose own chain must be valid. The policy certificates without issuer are roots, valid only if
+// trusted.
+func (v *policyValidator) validate(ctx context.Context, doc common.PolicyDocument) error {
+	switch doc := doc.(type) {
+	case *common.PolicyCertificate:
+		if doc.IssuerHash == nil && doc.IssuerSignature == nil {
+			hash, err := crypto.ComputeHashAsSigner(doc)
+			if err != nil {
+				return err
+			}
+			if _, ok := v.trusted[string(hash)]; !ok {
+				return fmt.Errorf("root policy certificate %x is not trusted", hash)
+			}
+			return nil
+		}
+		issuer, err := v.issuer(ctx, doc.IssuerHash)
+		if err != nil {
+			return err
+		}
+		if err := crypto.VerifyIssuerSignature(issuer, doc); err != nil {
+			return err
+		}
+		return crypto.VerifyIssuerConstraints(issuer, doc)
+	case *common.PolicyCertificateRevocation:
+		issuer, err := v.issuer(ctx, doc.IssuerHash)
+		if err != nil {
+			return err
+		}
+		return crypto.VerifyIssuerSignatureInRevocation(issuer, doc)
+	default:
+		return fmt.Errorf("unsupported policy document of type %T", doc)
+	}
+}
+
+// issuer returns the valid issuer with the hash as signer, among those added or else among those
+// of the DB.
+func (v *policyValidator) issuer(ctx context.Context, hash []byte) (*common.PolicyCertificate, error) {
+	issuer, ok := v.issuers[string(hash)]
+	var err error
+	if ok {
+		var checked bool
+		if err, checked = v.checked[string(hash)]; !checked {
+			v.checked[string(hash)] = errPolicyIssuerCycle // Until its chain is validated.
+			err = v.validate(ctx, issuer)
+			v.checked[string(hash)] = err
+		}
+		if err == nil {
+			return issuer, nil
+		}
+		err = fmt.Errorf("invalid issuer %x: %w", hash, err)
+	}
+
+	if err := v.loadStoredIssuers(ctx); err != nil {
+		return nil, err
+	}
+	if issuer, ok := v.stored[string(hash)]; ok {
+		return issuer, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("issuer %x not found among the policy certificates that can issue",
+		hash)
+}
+
+// loadStoredIssuers loads, once, the policy certificates of the DB that can issue.
+func (v *policyValidator) loadStoredIssuers(ctx context.Context) error {
+	if v.retrievePoliciesPage == nil || v.stored != nil {
+		return nil
+	}
+	stored := make(map[string]*common.PolicyCertificate)
+	var after *common.SHA256Output
+	for {
+		rows, err := v.retrievePoliciesPage(ctx, after, policyIssuersPageSize)
+		if err != nil {
+			return fmt.Errorf("retrieving the policies of the DB: %w", err)
+		}
+		if len(rows) == 0 {
+			break
+		}
+		for _, row := range rows {
+			docs, err := parsePolicyDocuments(row.Payload)
+			if err != nil {
+				return fmt.Errorf("policy %x of the DB: %w", row.ID, err)
+			}
+			for _, doc := range docs {
+				pc, ok := doc.(*common.PolicyCertificate)
+				if !ok || !pc.CanIssue {
+					continue
+				}
+				hash, err := crypto.ComputeHashAsSigner(pc)
+				if err != nil {
+					return err
+				}
+				stored[string(hash)] = pc
+			}
+		}
+		after = &rows[len(rows)-1].ID
+	}
+	v.stored = stored
+	return nil
+}
+
+// readTrustedPolicyRoots returns the policy certificates of the file, or of the policy files
+// under the directory, see listPolicyFiles.
+func readTrustedPolicyRoots(path string) ([]*common.PolicyCertificate, error) {
+	if path == "" {
+		return nil, nil
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{path}
+	if info.IsDir() {
+		if files, err = listPolicyFiles(path); err != nil {
+			return nil, err
+		}
+	}
+	var roots []*common.PolicyCertificate
+	for _, file := range files {
+		err := readPolicyFile(file, func(index uint, doc common.PolicyDocument) error {
+			pc, ok := doc.(*common.PolicyCertificate)
+			if !ok {
+				return fmt.Errorf("%s: trusted root %d is not a policy certificate", file, index)
+			}
+			roots = append(roots, pc)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return roots, nil
+}
+
+// ingestPoliciesInBatches calls forEachBatch with the policy documents of the files under the
+// directory that are not yet completed according to the journal, validated by the validator,
+// at most batchSize each, or all at once if it is not positive. The issuers of the documents
+// not found in the validator must be in those files, even if already completed: the files are
+// read once to find all issuers and to count the pending documents, and once more to ingest
+// them.
+func ingestPoliciesInBatches(
+	ctx context.Context,
+	j *journal.Journal,
+	stats *statistics.Stats,
+	validator *policyValidator,
+	dir string,
+	batchSize int,
+	beforeBatch func(batchNum, batchCount int) error,
+	forEachBatch func([]policyDocument) error,
+) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	files, err := listPolicyFiles(dir)
+	if err != nil {
+		return err
+	}
+	keys := make([]string, len(files))
+	completed := make([][]journal.Interval, len(files))
+	for i, file := range files {
+		if keys[i], err = journal.PolicyFileKey(file, dir); err != nil {
+			return err
+		}
+		if completed[i], err = j.CompletedIntervals(keys[i]); err != nil {
+			return err
+		}
+	}
+
+	// First pass: find the issuers and count the pending documents.
+	pendingCount := 0
+	for i, file := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := readPolicyFile(file, func(index uint, doc common.PolicyDocument) error {
+			if !intervalsContain(completed[i], index) {
+				pendingCount++
+			}
+			return validator.addIssuer(doc)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if stats != nil {
+		stats.TotalFiles.Store(int64(len(files)))
+		stats.TotalRows.Store(int64(pendingCount))
+	}
+	if pendingCount == 0 {
+		return nil
+	}
+
+	if batchSize <= 0 {
+		batchSize = pendingCount
+	}
+	batchCount := ((pendingCount - 1) / batchSize) + 1
+	batch := make([]policyDocument, 0, min(batchSize, pendingCount))
+	batchNum := 0
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		batchNum++
+		if beforeBatch != nil {
+			if err := beforeBatch(batchNum, batchCount); err != nil {
+				return err
+			}
+		}
+		if err := forEachBatch(batch); err != nil {
+			return err
+		}
+		batch = batch[:0]
+		return nil
+	}
+
+	// Second pass: validate and ingest the pending documents.
+	for i, file := range files {
+		err := readPolicyFile(file, func(index uint, doc common.PolicyDocument) error {
+			if intervalsContain(completed[i], index) {
+				return nil
+			}
+			if stats != nil {
+				stats.ReadRows.Add(1)
+			}
+			if err := validator.validate(ctx, doc); err != nil {
+				return fmt.Errorf("%s: invalid policy document %d: %w", file, index, err)
+			}
+			batch = append(batch, policyDocument{
+				PolicyDocument: doc,
+				key:            keys[i],
+				index:          index,
+			})
+			if len(batch) == batchSize {
+				return flush()
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if stats != nil {
+			stats.TotalFilesRead.Add(1)
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// policyBatchCompletedIndices returns the completed indices of the documents of the batch.
+func policyBatchCompletedIndices(batch []policyDocument) journal.CompletedIndices {
+	completed := make(journal.CompletedIndices)
+	for _, doc := range batch {
+		intervals := completed[doc.key]
+		if n := len(intervals); n > 0 && intervals[n-1].End+1 == doc.index {
+			intervals[n-1].End = doc.index
+		} else {
+			completed[doc.key] = append(intervals, journal.Interval{
+				Start: doc.index,
+				End:   doc.index,
+			})
+		}
+	}
+	return completed
+}
+
+// intervalsContain returns true if the index is in any of the intervals.
+func intervalsContain(intervals []journal.Interval, index uint) bool {
+	for _, interval := range intervals {
+		if interval.Start <= index && index <= interval.End {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rsa"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/netsec-ethz/fpki/cmd/ingest/journal"
+	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/common/crypto"
+	"github.com/netsec-ethz/fpki/pkg/db"
+	"github.com/netsec-ethz/fpki/pkg/db/embedded"
+	"github.com/netsec-ethz/fpki/pkg/mapserver/updater"
+	"github.com/netsec-ethz/fpki/pkg/statistics"
+	"github.com/netsec-ethz/fpki/pkg/tests/random"
+	"github.com/netsec-ethz/fpki/pkg/util"
+)
+
+func TestParsePolicyDocuments(t *testing.T) {
+	pc := random.RandomPolicyCertificate(t)
+	rev := random.RandomPolicyCertificateRevocation(t)
+	rev.DomainField = "fpki.com"
+
+	cases := map[string]struct {
+		obj      any
+		expected []common.PolicyDocument
+		wantErr  bool
+	}{
+		"pc": {
+			obj:      pc,
+			expected: []common.PolicyDocument{pc},
+		},
+		"pc_value": {
+			obj:      *pc,
+			expected: []common.PolicyDocument{pc},
+		},
+		"revocation": {
+			obj:      rev,
+			expected: []common.PolicyDocument{rev},
+		},
+		"list": {
+			obj:      []any{pc, rev},
+			expected: []common.PolicyDocument{pc, rev},
+		},
+		"unsupported": {
+			obj:     random.RandomSignedPolicyCertificateTimestamp(t),
+			wantErr: true,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			data, err := common.ToJSON(tc.obj)
+			require.NoError(t, err)
+			docs, err := parsePolicyDocuments(data)
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, docs, len(tc.expected))
+			for i, doc := range docs {
+				// The payloads are those of the original documents.
+				expected, err := tc.expected[i].Raw()
+				require.NoError(t, err)
+				got, err := doc.Raw()
+				require.NoError(t, err)
+				require.Equal(t, expected, got)
+			}
+		})
+	}
+}
+
+func TestPolicyValidator(t *testing.T) {
+	ctx, cancelF := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelF()
+
+	root, rootKey := newTestPolicyIssuer(t, "fpki.com")
+	child := newTestPolicyCertificate(t, root, rootKey, "a.fpki.com")
+	rev := newTestPolicyRevocation(t, root, rootKey, "b.fpki.com")
+	other, otherKey := newTestPolicyIssuer(t, "other.com")
+	orphan := newTestPolicyCertificate(t, other, otherKey, "c.other.com")
+
+	v, err := newPolicyValidator([]*common.PolicyCertificate{root}, nil)
+	require.NoError(t, err)
+	for _, doc := range []common.PolicyDocument{root, child, rev} {
+		require.NoError(t, v.addIssuer(doc))
+	}
+	require.Len(t, v.issuers, 1)
+
+	require.NoError(t, v.validate(ctx, root))
+	require.NoError(t, v.validate(ctx, child))
+	require.NoError(t, v.validate(ctx, rev))
+	require.ErrorContains(t, v.validate(ctx, orphan), "not found")
+
+	// An unsigned root is not valid unless trusted, and neither are the documents it issued.
+	require.ErrorContains(t, v.validate(ctx, other), "not trusted")
+	require.NoError(t, v.addIssuer(other))
+	require.ErrorContains(t, v.validate(ctx, orphan), "not trusted")
+
+	// A tampered document is not valid.
+	child.SerialNumberField++
+	require.Error(t, v.validate(ctx, child))
+	child.SerialNumberField--
+
+	// Neither is one valid after its issuer.
+	late := newTestPolicyCertificate(t, root, rootKey, "d.fpki.com")
+	late.IssuerSignature, late.IssuerHash = nil, nil
+	late.NotAfter = root.NotAfter.Add(time.Hour)
+	require.NoError(t, crypto.SignPolicyCertificateAsIssuer(root, rootKey, late))
+	require.ErrorContains(t, v.validate(ctx, late), "valid after its issuer")
+
+	// The issuers ingested before are found in the DB.
+	conn, err := embedded.Connect(db.NewConfig(embedded.WithDirectory(t.TempDir())))
+	require.NoError(t, err)
+	defer conn.Close()
+	err = updater.UpdatePoliciesWithKeepExisting(ctx, conn, []common.PolicyDocument{other})
+	require.NoError(t, err)
+	v, err = newPolicyValidator(nil, conn.RetrievePoliciesPage)
+	require.NoError(t, err)
+	require.NoError(t, v.validate(ctx, orphan))
+	require.ErrorContains(t, v.validate(ctx, child), "not found")
+}
+
+// TestRunIngestPolicies checks that the policy documents of a directory are validated, ingested
+// into the DB in batches and journaled, and that the coalescing and SMT update run once.
+func TestRunIngestPolicies(t *testing.T) {
+	ctx, cancelF := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelF()
+
+	conn, err := embedded.Connect(db.NewConfig(embedded.WithDirectory(t.TempDir())))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	root, rootKey := newTestPolicyIssuer(t, "fpki.com")
+	pcA := newTestPolicyCertificate(t, root, rootKey, "a.fpki.com")
+	pcB := newTestPolicyCertificate(t, root, rootKey, "b.fpki.com")
+	pcC := newTestPolicyCertificate(t, root, rootKey, "c.fpki.com")
+	rev := newTestPolicyRevocation(t, root, rootKey, "a.fpki.com")
+
+	dir := filepath.Join(t.TempDir(), "policies")
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "keys"), 0o755))
+	writePolicyFile(t, filepath.Join(dir, "pca.pc"), root)
+	writePolicyFile(t, filepath.Join(dir, "pc_a.pc"), pcA)
+	writePolicyFile(t, filepath.Join(dir, "dump.jsonl"), pcB, pcC, rev)
+	// Files with other extensions are ignored.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "keys", "pca.pem"),
+		util.RSAKeyToPEM(rootKey), 0o644))
+
+	cfg := newTestRunConfig(dir, filepath.Join(t.TempDir(), "journal.json"), 0, "")
+	cfg.Policies = true
+	cfg.TrustedPolicyRoots = filepath.Join(dir, "pca.pc")
+	cfg.MultiInsertSize = 2
+
+	var batches [][]common.PolicyDocument
+	var coalesceCount, updateCount int
+	deps := newTestDeps(t, nil, &coalesceCount, &updateCount, 0)
+	deps.RunBatch = nil
+	deps.RunPolicyBatch = func(_ *statistics.Stats, docs []common.PolicyDocument) error {
+		batches = append(batches, docs)
+		return updater.UpdatePoliciesWithKeepExisting(ctx, conn, docs)
+	}
+	deps.RetrievePoliciesPage = conn.RetrievePoliciesPage
+
+	require.NoError(t, runIngest(ctx, cfg, deps))
+	// In lexical order: dump.jsonl, pc_a.pc, pca.pc .
+	require.Len(t, batches, 3)
+	require.Equal(t, []int{2, 2, 1}, []int{len(batches[0]), len(batches[1]), len(batches[2])})
+	require.Equal(t, 1, coalesceCount)
+	require.Equal(t, 1, updateCount)
+
+	ids := make([]common.SHA256Output, 0, 5)
+	for _, doc := range []common.PolicyDocument{root, pcA, pcB, pcC, rev} {
+		payload, err := doc.Raw()
+		require.NoError(t, err)
+		ids = append(ids, common.SHA256Hash32Bytes(payload))
+	}
+	exist, err := conn.CheckPoliciesExist(ctx, ids)
+	require.NoError(t, err)
+	require.Equal(t, []bool{true, true, true, true, true}, exist)
+
+	j := loadJournalForTest(t, cfg)
+	job := previousJobForTest(t, j)
+	require.Equal(t, journal.CompletedIndices{
+		"policies/dump.jsonl": {{Start: 0, End: 2}},
+		"policies/pc_a.pc":    {{Start: 0, End: 0}},
+		"policies/pca.pc":     {{Start: 0, End: 0}},
+	}, job.CompletedIndices)
+	require.True(t, job.Coalesced)
+	require.True(t, job.UpdatedSMT)
+	require.NoError(t, j.Close())
+
+	// Nothing is pending anymore, nor is coalescing or updating the SMT.
+	batches = nil
+	require.NoError(t, runIngest(ctx, cfg, deps))
+	require.Empty(t, batches)
+	require.Equal(t, 1, coalesceCount)
+	require.Equal(t, 1, updateCount)
+
+	// A new document is ingested, but the issuer is still found in its completed file.
+	pcD := newTestPolicyCertificate(t, root, rootKey, "d.fpki.com")
+	writePolicyFile(t, filepath.Join(dir, "pc_d.pc.gz"), pcD)
+	require.NoError(t, runIngest(ctx, cfg, deps))
+	require.Len(t, batches, 1)
+	require.Len(t, batches[0], 1)
+	require.Equal(t, 2, coalesceCount)
+	require.Equal(t, 2, updateCount)
+
+	// An invalid document stops the ingestion.
+	other, otherKey := newTestPolicyIssuer(t, "other.com")
+	writePolicyFile(t, filepath.Join(dir, "pc_e.pc"),
+		newTestPolicyCertificate(t, other, otherKey, "e.other.com"))
+	err = runIngest(ctx, cfg, deps)
+	require.ErrorContains(t, err, "pc_e.pc: invalid policy document 0")
+
+	cfg.CTLogURL = "https://ct.example.com/log"
+	require.Error(t, cfg.validate())
+	cfg.CTLogURL = ""
+	cfg.Policies = false
+	require.Error(t, cfg.validate())
+}
+
+// newTestPolicyIssuer returns a root policy certificate that can issue for the domain, and its key.
+func newTestPolicyIssuer(t *testing.T, domain string) (*common.PolicyCertificate, *rsa.PrivateKey) {
+	key := random.RandomRSAPrivateKey(t)
+	derPubKey, err := util.RSAPublicToDERBytes(&key.PublicKey)
+	require.NoError(t, err)
+
+	pc := random.RandomPolicyCertificate(t)
+	pc.DomainField = domain
+	pc.PublicKey = derPubKey
+	pc.CanIssue = true
+	pc.NotBefore = time.Unix(1_000_000, 0).UTC()
+	pc.NotAfter = time.Unix(2_000_000_000, 0).UTC()
+	pc.OwnerSignature, pc.OwnerHash = nil, nil
+	pc.IssuerSignature, pc.IssuerHash = nil, nil
+	return pc, key
+}
+
+// newTestPolicyCertificate returns a policy certificate for the domain signed by the issuer.
+func newTestPolicyCertificate(
+	t *testing.T,
+	issuer *common.PolicyCertificate,
+	issuerKey *rsa.PrivateKey,
+	domain string,
+) *common.PolicyCertificate {
+	pc := random.RandomPolicyCertificate(t)
+	pc.DomainField = domain
+	pc.CanIssue = false
+	pc.NotBefore = issuer.NotBefore.Add(time.Hour)
+	pc.NotAfter = issuer.NotAfter.Add(-time.Hour)
+	pc.IssuerSignature, pc.IssuerHash = nil, nil
+	require.NoError(t, crypto.SignPolicyCertificateAsIssuer(issuer, issuerKey, pc))
+	return pc
+}
+
+// newTestPolicyRevocation returns a revocation for the domain signed by the issuer.
+func newTestPolicyRevocation(
+	t *testing.T,
+	issuer *common.PolicyCertificate,
+	issuerKey *rsa.PrivateKey,
+	domain string,
+) *common.PolicyCertificateRevocation {
+	rev := random.RandomPolicyCertificateRevocation(t)
+	rev.DomainField = domain
+	rev.IssuerSignature, rev.IssuerHash = nil, nil
+	require.NoError(t, crypto.SignPolicyCertificateRevocationAsIssuer(issuer, issuerKey, rev))
+	return rev
+}
+
+// writePolicyFile writes the documents to the file, one per line, gzipped if its name ends in .gz.
+func writePolicyFile(t *testing.T, filename string, docs ...common.PolicyDocument) {
+	var buff bytes.Buffer
+	var w io.WriteCloser = nopWriteCloser{&buff}
+	if filepath.Ext(filename) == ".gz" {
+		w = gzip.NewWriter(&buff)
+	}
+	for _, doc := range docs {
+		data, err := common.ToJSON(doc)
+		require.NoError(t, err)
+		_, err = w.Write(append(data, '\n'))
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+	require.NoError(t, os.WriteFile(filename, buff.Bytes(), 0o644))
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
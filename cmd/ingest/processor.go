@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"sync"
 
+	"github.com/netsec-ethz/fpki/pkg/cache"
 	"github.com/netsec-ethz/fpki/pkg/db"
+	"github.com/netsec-ethz/fpki/pkg/mapserver/logfetcher"
 	"github.com/netsec-ethz/fpki/pkg/mapserver/updater"
 	pip "github.com/netsec-ethz/fpki/pkg/pipeline"
 	"github.com/netsec-ethz/fpki/pkg/statistics"
@@ -24,14 +26,22 @@ import (
 			|                  ...
 		   ...
 */
+// If the processor has a Fetcher, the certificates are fetched from ranges of its CT log instead.
 type Processor struct {
 	Ctx            context.Context
 	CsvFiles       []util.CsvFile
+	Format         inputFormat // The format of the files. If nil, detected for each file.
+	Fetcher        logfetcher.Fetcher
+	CTLogRanges    []ctLogRange
 	NumFileReaders int
 	NumToChain     int
 	NumToCerts     int
 	NumDBWriters   int
 	SkipMissing    bool
+	Quarantine     *rowQuarantine // If nil, a malformed record fails the batch.
+	CertFilter     *certFilter    // If not nil, drops the certificates already ingested.
+	CacheBytes     int64          // The budget of Cache. If zero, each worker has an LRU cache.
+	Cache          cache.Cache    // Shared by the workers, see newWorkerCache.
 	Pipeline       *pip.Pipeline
 	Manager        *updater.Manager
 }
@@ -50,6 +60,7 @@ func NewProcessor(
 		NumToChain:     1, // Default to just 1 lineToChain.
 		NumToCerts:     1, // Default to just 1 chainToCerts.
 		NumDBWriters:   1, // Default to 1 db writer.
+		Format:         ctCSVFormat{},
 	}
 
 	// Apply options to processor only.
@@ -78,6 +89,11 @@ func NewProcessor(
 		}
 	}
 
+	// The workers share one bounded cache, counting its hits in the statistics of the manager.
+	if p.CacheBytes > 0 {
+		p.Cache = cache.NewBoundedCache(p.CacheBytes, p.Manager.Stats)
+	}
+
 	// Create the pipFiles from files to Certificates.
 	pipFiles, err := p.createFilesToCertsPipeline()
 	if err != nil {
@@ -135,6 +151,61 @@ func WithSkipMissingFiles(skipMissing bool) ingestOptions {
 		})
 }
 
+// WithInputFormat sets the format of the files. If nil, the format is detected for each file.
+// See inputFormatByName.
+func WithInputFormat(format inputFormat) ingestOptions {
+	return processorOptions(
+		func(p *Processor) {
+			p.Format = format
+		})
+}
+
+// WithRowQuarantine makes the processor drop the records that cannot be parsed, adding them to
+// the quarantine, instead of failing. See openRowQuarantine.
+func WithRowQuarantine(q *rowQuarantine) ingestOptions {
+	return processorOptions(
+		func(p *Processor) {
+			p.Quarantine = q
+		})
+}
+
+// WithCertFilter makes the processor drop the certificates of the filter before parsing them,
+// and stage the IDs of those sent to the DB. See openCertFilter.
+func WithCertFilter(f *certFilter) ingestOptions {
+	return processorOptions(
+		func(p *Processor) {
+			p.CertFilter = f
+		})
+}
+
+// WithBoundedCache makes the workers of the processor share one cache.BoundedCache of the IDs
+// of the certificates seen, which uses at most budget bytes. If zero, each worker keeps its own
+// LRU cache instead.
+func WithBoundedCache(budget int64) ingestOptions {
+	return processorOptions(
+		func(p *Processor) {
+			p.CacheBytes = budget
+		})
+}
+
+// WithCTLogFetcher makes the processor fetch the certificates from the CT log of the fetcher,
+// for the ranges added with AddCTLogRange, instead of reading them from CSV files.
+func WithCTLogFetcher(fetcher logfetcher.Fetcher) ingestOptions {
+	return processorOptions(
+		func(p *Processor) {
+			p.Fetcher = fetcher
+		})
+}
+
+// WithStreamCsv makes the manager send the CSV rows thru the DB connection, instead of writing
+// temporary files that the DB reads. See updater.Manager.StreamCsv.
+func WithStreamCsv(stream bool) ingestOptions {
+	return managerOptions(
+		func(m *updater.Manager) {
+			m.StreamCsv = stream
+		})
+}
+
 func (p *Processor) Resume() {
 	p.Pipeline.Resume(p.Ctx)
 }
@@ -148,6 +219,12 @@ func (p *Processor) AddCsvFiles(files []util.CsvFile) {
 	p.CsvFiles = append(p.CsvFiles, files...)
 }
 
+// AddCTLogRange adds the inclusive range of entries of the CT log of the fetcher, to be fetched
+// when Resume is called.
+func (p *Processor) AddCTLogRange(start, end int64) {
+	p.CTLogRanges = append(p.CTLogRanges, ctLogRange{start: start, end: end})
+}
+
 // createFilesToCertsPipeline creates a pipeline that processes CSV and GZ files into Certificates.
 // It can be joined together with a Manager to push the Certificates into the DB.
 // The created pipeline looks like this:
@@ -170,6 +247,10 @@ func (p *Processor) AddCsvFiles(files []util.CsvFile) {
 //	 ...     ...             ...
 //	  └-> bS -┴-> cW ---> dC -┘
 func (p *Processor) createFilesToCertsPipeline() (*pip.Pipeline, error) {
+	if p.Fetcher != nil {
+		return p.createCTLogToCertsPipeline()
+	}
+
 	// Prepare source. It opens CSV files based on the filenames stored in the processor.
 	source := pip.NewSource[util.CsvFile](
 		"open-csv-files",
@@ -270,6 +351,70 @@ func (p *Processor) createFilesToCertsPipeline() (*pip.Pipeline, error) {
 	return pipeline, err
 }
 
+// createCTLogToCertsPipeline creates a pipeline that fetches ranges of a CT log into
+// Certificates. It replaces the files to certs pipeline when the processor has a Fetcher.
+// The created pipeline looks like this:
+//
+//	a: source, generates ctLogRange.
+//	b: transforms into Chain. ctLogFetchWorker.
+//	c1..C: transforms into []Certificate, crisscross I/O. chainToCertWorker.
+//	d: sink, multiple inputs, crisscross input. []Certificate.
+//
+// The indices are below:
+// a: 0
+// b: 1
+// c: 2..2+C
+// d: 2+C
+//
+//	a --> b -┌-> c1 -┬-> d
+//	         |-> c2 -|
+//	        ...     ...
+//	         └-> cC -┘
+func (p *Processor) createCTLogToCertsPipeline() (*pip.Pipeline, error) {
+	source := pip.NewSource[ctLogRange](
+		"ctlog-ranges",
+		pip.WithSourceSlice(&p.CTLogRanges, func(in ctLogRange) (int, error) {
+			return 0, nil
+		}),
+	)
+
+	fetcher := NewCtLogFetchWorker(p)
+
+	chainToCertWorkers := make([]*chainToCertWorker, p.NumToCerts)
+	for i := range chainToCertWorkers {
+		chainToCertWorkers[i] = NewChainToCertWorker(i, p)
+	}
+
+	sink := p.createCertificateSink()
+
+	stages := []pip.StageLike{
+		source,
+		fetcher.Stage,
+	}
+	for _, w := range chainToCertWorkers {
+		stages = append(stages, w.Stage)
+	}
+	stages = append(stages, sink)
+
+	return pip.NewPipeline(
+		func(pipeline *pip.Pipeline) {
+			C := p.NumToCerts
+			a := pip.SourceStage[ctLogRange](pipeline)
+			b := pip.StageAtIndex[ctLogRange, certChain](pipeline, 1)
+			c := make([]*pip.Stage[certChain, updater.Certificate], C)
+			for i := range c {
+				c[i] = pip.StageAtIndex[certChain, updater.Certificate](pipeline, 2+i)
+			}
+			d := pip.StagesAsSlice(pip.SinkStage[updater.Certificate](pipeline))
+
+			pip.LinkStagesDistribute(a, b)    // A -> B
+			pip.LinkStagesDistribute(b, c...) // B -> Ci
+			pip.LinkStagesCrissCross(c, d)    // Ci-> D
+		},
+		pip.WithStages(stages...),
+	)
+}
+
 func (p *Processor) createCertificateSink() *pip.Sink[updater.Certificate] {
 	return pip.NewSink[updater.Certificate](
 		"certSink",
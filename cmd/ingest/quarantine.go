@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/netsec-ethz/fpki/pkg/util"
+)
+
+const (
+	// FailOnError makes a malformed record fail its batch, the default.
+	FailOnError = "fail"
+	// SkipOnError drops the malformed records.
+	SkipOnError = "skip"
+	// QuarantineOnError writes the malformed records to the quarantine file and drops them.
+	QuarantineOnError = "quarantine"
+)
+
+// rowQuarantine keeps the records of the input files that cannot be parsed, instead of failing
+// the batch they belong to. The records are written one JSON object per line, with their file,
+// line number and error. Their certificate and chain are kept base64 encoded as in the jsonl
+// input format, so that a quarantine file can be ingested again once its records are fixed.
+// The rows that cannot even be split into fields are kept as they are instead.
+// A rowQuarantine can be used concurrently by several workers.
+type rowQuarantine struct {
+	w      *util.JSONLinesWriter // If nil, the records are sent to report instead.
+	report func(quarantinedRow)
+}
+
+// quarantinedRow is a record of an input file that could not be parsed.
+type quarantinedRow struct {
+	File  string    `json:"file"`
+	Line  int       `json:"line"`
+	Error string    `json:"error"`
+	Cert  string    `json:"cert"`
+	Chain []string  `json:"chain"`
+	Row   string    `json:"row,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// newRowQuarantine creates a quarantine that writes its records to w.
+func newRowQuarantine(w io.Writer) *rowQuarantine {
+	return &rowQuarantine{
+		w: util.NewJSONLinesWriter(w),
+	}
+}
+
+// openRowQuarantine returns the quarantine for the error policy of the configuration, which
+// appends the records to its quarantine file, or discards them when skipping. It returns nil
+// if the malformed records fail their batch. Dry runs skip them instead, to count them, and
+// send those to quarantine to the report of dryRun instead of the file, which is not written.
+func openRowQuarantine(cfg RunConfig, dryRun *dryRunConn) (*rowQuarantine, error) {
+	if cfg.dryRun() {
+		if cfg.OnError == QuarantineOnError {
+			return &rowQuarantine{
+				report: dryRun.quarantine,
+			}, nil
+		}
+		return newRowQuarantine(io.Discard), nil
+	}
+	switch cfg.OnError {
+	case QuarantineOnError:
+		w, err := util.OpenJSONLinesFile(cfg.QuarantineFile)
+		if err != nil {
+			return nil, fmt.Errorf("opening quarantine file: %w", err)
+		}
+		return &rowQuarantine{
+			w: w,
+		}, nil
+	case SkipOnError:
+		return newRowQuarantine(io.Discard), nil
+	default:
+		return nil, nil
+	}
+}
+
+// add writes the record of the line, which failed with err, to the quarantine.
+func (q *rowQuarantine) add(l *line, err error) error {
+	cert, chain := l.rawRecord()
+	row := quarantinedRow{
+		File:  l.filename,
+		Line:  l.number,
+		Error: err.Error(),
+		Cert:  cert,
+		Chain: chain,
+		Row:   string(l.row),
+		Time:  time.Now().UTC(),
+	}
+	if q.w == nil {
+		q.report(row)
+		return nil
+	}
+	if err := q.w.Write(row); err != nil {
+		return fmt.Errorf("quarantining line %d of %s: %w", l.number, l.filename, err)
+	}
+	return nil
+}
+
+// Close closes the quarantine file, if any. It is safe to call on a nil quarantine.
+func (q *rowQuarantine) Close() error {
+	if q == nil || q.w == nil {
+		return nil
+	}
+	return q.w.Close()
+}
+
+// readRowQuarantine reads the records written to a quarantine.
+func readRowQuarantine(r io.Reader) ([]quarantinedRow, error) {
+	return util.ReadJSONLines[quarantinedRow](r)
+}
+
+// rawRecord returns the certificate and chain of the line base64 encoded, without decoding
+// them: the CT CSV fields are already base64 encoded, and kept as they are in the file.
+func (l *line) rawRecord() (string, []string) {
+	if l.row != nil {
+		// Not split into fields.
+		return "", nil
+	}
+	if _, ok := l.inputFormat().(ctCSVFormat); ok {
+		var chain []string
+		if len(l.chainField) > 0 {
+			for _, field := range splitSemicolonField(l.chainField) {
+				chain = append(chain, string(field))
+			}
+		}
+		return string(l.certField), chain
+	}
+	chain := make([]string, len(l.chain))
+	for i, payload := range l.chain {
+		chain[i] = base64.StdEncoding.EncodeToString(payload)
+	}
+	return base64.StdEncoding.EncodeToString(l.certField), chain
+}
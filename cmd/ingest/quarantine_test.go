@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/netsec-ethz/fpki/cmd/ingest/journal"
+	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/db"
+	"github.com/netsec-ethz/fpki/pkg/db/embedded"
+	"github.com/netsec-ethz/fpki/pkg/statistics"
+	"github.com/netsec-ethz/fpki/pkg/tests/random"
+	"github.com/netsec-ethz/fpki/pkg/util"
+)
+
+func TestRowQuarantine(t *testing.T) {
+	cert := random.RandomX509Cert(t, "a.com")
+	issuer := random.RandomX509Cert(t, "issuer.com")
+
+	var buff bytes.Buffer
+	q := newRowQuarantine(&buff)
+	require.NoError(t, q.add(&line{
+		certField:  []byte("not base64"),
+		chainField: []byte("QUJD;REVG"),
+		number:     2,
+		filename:   "0-9.gz",
+	}, errors.New("bad base64")))
+	require.NoError(t, q.add(&line{
+		format:    pemFormat{},
+		certField: cert.Raw,
+		chain:     [][]byte{issuer.Raw},
+		number:    1,
+		filename:  "a.pem",
+	}, errors.New("bad certificate")))
+	require.NoError(t, q.Close())
+
+	rows, err := readRowQuarantine(&buff)
+	require.NoError(t, err)
+	require.Len(t, rows, 2)
+
+	require.Equal(t, "0-9.gz", rows[0].File)
+	require.Equal(t, 2, rows[0].Line)
+	require.Equal(t, "bad base64", rows[0].Error)
+	require.Equal(t, "not base64", rows[0].Cert)
+	require.Equal(t, []string{"QUJD", "REVG"}, rows[0].Chain)
+
+	require.Equal(t, "a.pem", rows[1].File)
+	require.Equal(t, "bad certificate", rows[1].Error)
+	require.Equal(t, base64.StdEncoding.EncodeToString(cert.Raw), rows[1].Cert)
+	require.Equal(t, []string{base64.StdEncoding.EncodeToString(issuer.Raw)}, rows[1].Chain)
+}
+
+// TestRunIngestQuarantine checks that the malformed rows of a bundle fail its batch by default,
+// also those that cannot be split into fields, and that otherwise they are dropped, quarantined and counted in the journal, while the rest
+// of the bundle is ingested and journaled as complete.
+func TestRunIngestQuarantine(t *testing.T) {
+	ctx, cancelF := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelF()
+
+	conn, err := embedded.Connect(db.NewConfig(embedded.WithDirectory(t.TempDir())))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	a := random.RandomX509Cert(t, "a.com")
+	b := random.RandomX509Cert(t, "b.com")
+	c := random.RandomX509Cert(t, "c.com")
+	d := random.RandomX509Cert(t, "d.com")
+	issuer := base64.StdEncoding.EncodeToString(random.RandomX509Cert(t, "issuer.com").Raw)
+	const expiration = "4000000000.0"
+	rows := []string{
+		ctCSVRow(base64.StdEncoding.EncodeToString(a.Raw), issuer, expiration),
+		ctCSVRow("not base64!", issuer, expiration),
+		ctCSVRow(base64.StdEncoding.EncodeToString(b.Raw), "QUJD", expiration),
+		ctCSVRow(base64.StdEncoding.EncodeToString(c.Raw), issuer, "no expiration"),
+		"a,b,c", // Too short.
+		ctCSVRow(base64.StdEncoding.EncodeToString(d.Raw), issuer, expiration),
+	}
+
+	dir := filepath.Join(t.TempDir(), ingestTestBase)
+	bundle := filepath.Join(dir, "bundled", "0-5.gz")
+	writeCTBundle(t, bundle, rows...)
+
+	cfg := newTestRunConfig(dir, filepath.Join(t.TempDir(), "journal.json"), 0, "onlyingest")
+	cfg.QuarantineFile = filepath.Join(t.TempDir(), "quarantine.jsonl")
+
+	var coalesceCount, updateCount int
+	var q *rowQuarantine
+	deps := newTestDeps(t, nil, &coalesceCount, &updateCount, 0)
+	deps.RunBatch = func(ctx context.Context, stats *statistics.Stats, files []string) error {
+		proc, err := NewProcessor(ctx, conn, 10, stats,
+			WithStreamCsv(true),
+			WithRowQuarantine(q),
+		)
+		require.NoError(t, err)
+		csvFiles := make([]util.CsvFile, 0, len(files))
+		for _, filename := range files {
+			csvFiles = append(csvFiles, loadInputFile(filename))
+		}
+		proc.AddCsvFiles(csvFiles)
+		proc.Resume()
+		return proc.Wait()
+	}
+
+	// By default, the first malformed row fails the batch.
+	require.Error(t, runIngest(ctx, cfg, deps))
+	j := loadJournalForTest(t, cfg)
+	require.Empty(t, previousJobForTest(t, j).CompletedIndices)
+	require.NoError(t, j.Close())
+
+	cfg.OnError = QuarantineOnError
+	q, err = openRowQuarantine(cfg, nil)
+	require.NoError(t, err)
+	require.NoError(t, runIngest(ctx, cfg, deps))
+	require.NoError(t, q.Close())
+
+	payloads, err := conn.RetrieveCertificatePayloads(ctx, []common.SHA256Output{
+		common.SHA256Hash32Bytes(a.Raw),
+		common.SHA256Hash32Bytes(b.Raw),
+		common.SHA256Hash32Bytes(c.Raw),
+		common.SHA256Hash32Bytes(d.Raw),
+	})
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{a.Raw, nil, nil, d.Raw}, payloads)
+
+	f, err := os.Open(cfg.QuarantineFile)
+	require.NoError(t, err)
+	defer f.Close()
+	quarantined, err := readRowQuarantine(f)
+	require.NoError(t, err)
+	require.Len(t, quarantined, 4)
+	// The rows that cannot be split are quarantined by an earlier stage.
+	slices.SortFunc(quarantined, func(a, b quarantinedRow) int {
+		return a.Line - b.Line
+	})
+	for i, row := range quarantined {
+		require.Equal(t, bundle, row.File)
+		require.Equal(t, i+2, row.Line)
+		require.NotEmpty(t, row.Error)
+	}
+	require.Equal(t, "not base64!", quarantined[0].Cert)
+	require.Equal(t, []string{"QUJD"}, quarantined[1].Chain)
+	require.Equal(t, "a,b,c", quarantined[3].Row)
+	require.Empty(t, quarantined[3].Cert)
+
+	j = loadJournalForTest(t, cfg)
+	job := previousJobForTest(t, j)
+	require.Equal(t, completedIngestTestIntervals(journal.Interval{Start: 0, End: 5}),
+		job.CompletedIndices)
+	require.Equal(t, int64(4), job.QuarantinedRows)
+	// The count is carried forward with the completed indices.
+	require.Equal(t, int64(4), latestJobForTest(t, j).QuarantinedRows)
+	require.NoError(t, j.Close())
+}
+
+func TestRunConfigValidateOnError(t *testing.T) {
+	cfg := newTestRunConfig(t.TempDir(), "journal.json", 0, "")
+	for _, onError := range []string{"", FailOnError, SkipOnError, QuarantineOnError} {
+		cfg.OnError = onError
+		cfg.QuarantineFile = "quarantine.jsonl"
+		require.NoError(t, cfg.validate())
+	}
+	cfg.QuarantineFile = ""
+	require.Error(t, cfg.validate())
+	cfg.OnError = "ignore"
+	require.Error(t, cfg.validate())
+}
+
+// writeCTBundle writes the rows to the gzipped CT CSV bundle, creating its directory.
+func writeCTBundle(t *testing.T, filename string, rows ...string) {
+	require.NoError(t, os.MkdirAll(filepath.Dir(filename), 0o755))
+	var buff bytes.Buffer
+	gzw := gzip.NewWriter(&buff)
+	for _, row := range rows {
+		_, err := gzw.Write([]byte(row + "\n"))
+		require.NoError(t, err)
+	}
+	require.NoError(t, gzw.Close())
+	require.NoError(t, os.WriteFile(filename, buff.Bytes(), 0o644))
+}
+
+// ctCSVRow returns a row of a CT CSV bundle with the certificate, chain and expiration columns.
+func ctCSVRow(cert, chain, expiration string) string {
+	return fmt.Sprintf("a,b,c,%s,%s,x,y,%s", cert, chain, expiration)
+}
@@ -10,6 +10,8 @@ import (
 	"time"
 
 	"github.com/netsec-ethz/fpki/cmd/ingest/journal"
+	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/db"
 	"github.com/netsec-ethz/fpki/pkg/statistics"
 	"github.com/netsec-ethz/fpki/pkg/util"
 )
@@ -19,6 +21,7 @@ type RunConfig struct {
 	Strategy        string
 	JournalFile     string
 	DBName          string
+	DBDir           string // if set, the directory of the embedded DB instead of MySQL
 	FileBatch       int
 	MultiInsertSize int
 	NumFiles        int
@@ -29,8 +32,49 @@ type RunConfig struct {
 	// `.csv` bundles or restricts processing to compressed `.gz` bundles only.
 	IncludePlainCSVs bool
 	SkipMissingFiles bool
-	CpuProfile       string
-	MemProfile       string
+	StreamCsv        bool // stream the rows to the DB instead of writing temporary CSV files
+	// InputFormat is the name of the format of the files of Directory, see inputFormatByName.
+	// If empty, CTCSVFormat. Only the CT CSV bundles are listed and journaled by their indices:
+	// the files of other formats are all ingested at every run.
+	InputFormat string
+	// OnError is the policy for the records of the input files that cannot be parsed: fail the
+	// batch, or skip or quarantine them into QuarantineFile. If empty, FailOnError.
+	OnError        string
+	QuarantineFile string
+	// Policies selects ingesting the policy documents of the files of Directory instead of
+	// certificates, in batches of MultiInsertSize documents. See ingestPoliciesInBatches.
+	// The root policy certificates are valid only if in TrustedPolicyRoots, a policy file or a
+	// directory of them.
+	Policies           bool
+	TrustedPolicyRoots string
+	// CTLogURL, if set, is the CT log whose entries [CTLogStart,CTLogEnd] are fetched and
+	// ingested, instead of the files of Directory. If CTLogEnd is negative, the entries are
+	// ingested up to the current size of the log. They are ingested in batches of CTLogBatch
+	// entries, or all at once if it is zero.
+	CTLogURL   string
+	CTLogStart int64
+	CTLogEnd   int64
+	CTLogBatch int64
+	// Job, if set, is the name of the distributed ingest job in the DB whose batches are
+	// claimed and ingested, see runDistributed. The Coordinator first enqueues the pending
+	// bundles of Directory as the job. The leases of Worker on the batches of the job expire
+	// after Lease unless renewed.
+	Job         string
+	Coordinator bool
+	Worker      string
+	Lease       time.Duration
+	// CertFilter, if set, is the file of the persistent filter of the certificates already
+	// ingested, which are dropped before parsing them, see openCertFilter. It is created for
+	// CertFilterSize certificates, and rebuilt from the certs table first if RebuildCertFilter.
+	CertFilter        string
+	CertFilterSize    uint64
+	RebuildCertFilter bool
+	// Cache is the kind of cache of the certificate IDs seen by the parse workers, LruCacheKind
+	// if empty. BoundedCacheKind uses at most CacheBytes bytes.
+	Cache      string
+	CacheBytes int64
+	CpuProfile string
+	MemProfile string
 }
 
 // RunDependencies collects all necessary functions to effectively run ingest.
@@ -39,14 +83,54 @@ type RunDependencies struct {
 	NewStatistics     func() *statistics.Stats
 	EstimateCertCount func(string) (uint, error)
 	BeforeBatch       func(batchNum, batchCount int) error
-	RunBatch          func(*statistics.Stats, []string) error
-	Coalesce          func() error
-	UpdateSMT         func() error
-	RecordCTSize      func(context.Context, string, int64) error
+	RunBatch          func(context.Context, *statistics.Stats, []string) error
+	CTLogSize         func(context.Context) (int64, error)
+	RunCTLogBatch     func(*statistics.Stats, journal.Interval) error
+	RunPolicyBatch    func(*statistics.Stats, []common.PolicyDocument) error
+	// RetrievePoliciesPage, if not nil, reads the policies table to find the issuers of the
+	// policy documents ingested before.
+	RetrievePoliciesPage func(context.Context, *common.SHA256Output, int) ([]*db.PayloadRecord,
+		error)
+	ReportDryRun   func(*statistics.Stats) error
+	ReportCoverage func(coverageReport) error
+	Coalesce       func(context.Context) error
+	UpdateSMT      func(context.Context) error
+	RecordCTSize   func(context.Context, string, int64) error
+	RecordedCTSize func(context.Context, string) (int64, error)
+	IngestQueue    db.IngestQueue
 }
 
 func (cfg RunConfig) JobConfiguration() (journal.JobConfiguration, error) {
-	return journal.NewJobConfiguration(cfg.Strategy, cfg.FileBatch, cfg.IncludePlainCSVs)
+	strategy := cfg.Strategy
+	if cfg.dryRun() || cfg.coverage() {
+		// A dry run only ingests and a coverage report only reads the journal, although
+		// nothing is journaled in either case.
+		strategy = "onlyingest"
+	}
+	return journal.NewJobConfiguration(strategy, cfg.FileBatch, cfg.IncludePlainCSVs)
+}
+
+// dryRun returns true if the strategy is DryRunStrategy.
+func (cfg RunConfig) dryRun() bool {
+	return cfg.Strategy == DryRunStrategy
+}
+
+// coverage returns true if the strategy is CoverageStrategy.
+func (cfg RunConfig) coverage() bool {
+	return cfg.Strategy == CoverageStrategy
+}
+
+// Format returns the format of the input files, nil meaning detected for each file.
+func (cfg RunConfig) Format() (inputFormat, error) {
+	if cfg.InputFormat == "" {
+		return ctCSVFormat{}, nil
+	}
+	return inputFormatByName(cfg.InputFormat)
+}
+
+// hasCTBundles returns true if the input files are CT CSV bundles, named after their indices.
+func (cfg RunConfig) hasCTBundles() bool {
+	return cfg.InputFormat == "" || cfg.InputFormat == CTCSVFormat
 }
 
 func (cfg RunConfig) validate() error {
@@ -54,11 +138,92 @@ func (cfg RunConfig) validate() error {
 	if err != nil {
 		return err
 	}
+	if _, err := cfg.Format(); err != nil {
+		return err
+	}
+	switch cfg.OnError {
+	case "", FailOnError, SkipOnError:
+	case QuarantineOnError:
+		if cfg.QuarantineFile == "" {
+			return fmt.Errorf("quarantining malformed rows requires a quarantine file")
+		}
+	default:
+		return fmt.Errorf("unknown error policy %q", cfg.OnError)
+	}
+	if cfg.dryRun() && (cfg.Policies || cfg.CTLogURL != "") {
+		return fmt.Errorf("only the certificates of a directory can be dry run")
+	}
+	if cfg.coverage() && (cfg.Policies || !cfg.hasCTBundles()) {
+		return fmt.Errorf("only the coverage of CT CSV bundles can be reported")
+	}
+	switch cfg.Cache {
+	case "", LruCacheKind:
+	case BoundedCacheKind:
+		if cfg.CacheBytes <= 0 {
+			return fmt.Errorf("invalid cache budget of %d bytes", cfg.CacheBytes)
+		}
+	default:
+		return fmt.Errorf("unknown cache kind %q", cfg.Cache)
+	}
+	if cfg.CertFilter != "" && cfg.CertFilterSize == 0 {
+		return fmt.Errorf("invalid certificate filter size 0")
+	}
+	if cfg.RebuildCertFilter && (cfg.CertFilter == "" || cfg.dryRun()) {
+		return fmt.Errorf("rebuilding the certificate filter requires a filter file and " +
+			"writes it, thus cannot be dry run")
+	}
+	if cfg.Coordinator && cfg.Job == "" {
+		return fmt.Errorf("a coordinator requires a distributed ingest job")
+	}
+	if cfg.Job != "" {
+		if cfg.dryRun() || cfg.coverage() || cfg.Policies || cfg.CTLogURL != "" ||
+			!cfg.hasCTBundles() {
+			return fmt.Errorf("only the CT CSV bundles of a directory can be ingested by a " +
+				"distributed ingest job")
+		}
+		if cfg.Worker == "" {
+			return fmt.Errorf("a distributed ingest job requires a worker name")
+		}
+		if cfg.Lease <= 0 {
+			return fmt.Errorf("invalid lease duration %s", cfg.Lease)
+		}
+		if cfg.Coordinator && (!jobCfg.IngestFiles || cfg.Directory == "") {
+			return fmt.Errorf("the coordinator of a distributed ingest job ingests the files " +
+				"of a directory")
+		}
+		return nil
+	}
+	if cfg.TrustedPolicyRoots != "" && !cfg.Policies {
+		return fmt.Errorf("trusted policy roots are only used to ingest policies")
+	}
+	if cfg.Policies {
+		if cfg.CTLogURL != "" {
+			return fmt.Errorf("policies are ingested from a directory, not from a CT log")
+		}
+		if !cfg.hasCTBundles() {
+			return fmt.Errorf("policies are ingested regardless of the input format")
+		}
+	}
+	if cfg.CTLogURL != "" {
+		if cfg.Directory != "" {
+			return fmt.Errorf("use either a directory or a CT log URL, not both")
+		}
+		if cfg.CTLogStart < 0 {
+			return fmt.Errorf("invalid CT log start index %d", cfg.CTLogStart)
+		}
+		if cfg.CTLogEnd >= 0 && cfg.CTLogEnd < cfg.CTLogStart {
+			return fmt.Errorf("invalid CT log range %d-%d", cfg.CTLogStart, cfg.CTLogEnd)
+		}
+		if cfg.CTLogBatch < 0 {
+			return fmt.Errorf("invalid CT log batch size %d", cfg.CTLogBatch)
+		}
+		return nil
+	}
 	if jobCfg.IngestFiles && cfg.Directory == "" {
-		return fmt.Errorf("ingest requires a directory")
+		return fmt.Errorf("ingest requires a directory or a CT log URL")
 	}
 	if jobCfg.RecordCTSize && cfg.Directory == "" {
-		return fmt.Errorf("recordctsize requires a directory")
+		return fmt.Errorf("recordctsize requires a directory or a CT log URL")
 	}
 	return nil
 }
@@ -68,6 +233,16 @@ func runIngest(ctx context.Context, cfg RunConfig, deps RunDependencies) error {
 		return err
 	}
 
+	if cfg.dryRun() {
+		return dryRunIngest(ctx, cfg, deps)
+	}
+	if cfg.coverage() {
+		return reportCoverage(ctx, cfg, deps)
+	}
+	if cfg.Job != "" {
+		return runDistributed(ctx, cfg, deps)
+	}
+
 	jobCfg, err := cfg.JobConfiguration()
 	if err != nil {
 		return err
@@ -82,15 +257,13 @@ func runIngest(ctx context.Context, cfg RunConfig, deps RunDependencies) error {
 	// Ensure the journal is always flushed.
 	defer j.Close()
 
-	// TODO: use context in all processing functions, e.g. coalesce,updateSMT.
-
 	coalesce := deps.Coalesce
 	if coalesce == nil {
-		coalesce = func() error { return nil }
+		coalesce = func(context.Context) error { return nil }
 	}
 	updateSMT := deps.UpdateSMT
 	if updateSMT == nil {
-		updateSMT = func() error { return nil }
+		updateSMT = func(context.Context) error { return nil }
 	}
 
 	if jobCfg.RecordCTSize {
@@ -100,13 +273,22 @@ func runIngest(ctx context.Context, cfg RunConfig, deps RunDependencies) error {
 		if deps.RecordCTSize == nil {
 			panic("missing CT log size recorder dependency")
 		}
-		ctLogURL, err := deriveCTLogURLFromIngestDir(cfg.Directory)
-		if err != nil {
-			return fmt.Errorf("recordctsize: deriving CT log URL from %q: %w", cfg.Directory, err)
+		// Entries fetched from a CT log are journaled with its URL, and files with the base
+		// name of their directory, which encodes the URL.
+		ctLogURL, key := cfg.CTLogURL, cfg.CTLogURL
+		if ctLogURL == "" {
+			ctLogURL, err = deriveCTLogURLFromIngestDir(cfg.Directory)
+			if err != nil {
+				return fmt.Errorf("recordctsize: deriving CT log URL from %q: %w", cfg.Directory, err)
+			}
+			key = filepath.Base(filepath.Clean(cfg.Directory))
+		}
+		if err := checkNoHoles(j, key); err != nil {
+			return fmt.Errorf("recordctsize: %w", err)
 		}
-		size, err := completedCTLogSize(j, cfg.Directory)
+		size, err := completedCTLogSize(j, key)
 		if err != nil {
-			return fmt.Errorf("recordctsize: computing CT log size from journal for %q: %w", cfg.Directory, err)
+			return fmt.Errorf("recordctsize: computing CT log size from journal for %q: %w", key, err)
 		}
 		if err := deps.RecordCTSize(ctx, ctLogURL, size); err != nil {
 			return fmt.Errorf("recordctsize: recording CT log size %d for URL %q: %w", size, ctLogURL, err)
@@ -123,7 +305,7 @@ func runIngest(ctx context.Context, cfg RunConfig, deps RunDependencies) error {
 			return err
 		}
 		if jobCfg.Coalesce {
-			if err := coalesce(); err != nil {
+			if err := coalesce(ctx); err != nil {
 				return err
 			}
 			if err := j.CommitProgress(nil, true, false); err != nil {
@@ -134,7 +316,7 @@ func runIngest(ctx context.Context, cfg RunConfig, deps RunDependencies) error {
 			return err
 		}
 		if jobCfg.UpdateSMT {
-			if err := updateSMT(); err != nil {
+			if err := updateSMT(ctx); err != nil {
 				return err
 			}
 			if err := j.CommitProgress(nil, jobCfg.Coalesce, true); err != nil {
@@ -147,7 +329,13 @@ func runIngest(ctx context.Context, cfg RunConfig, deps RunDependencies) error {
 	if deps.NewStatistics == nil {
 		return fmt.Errorf("missing statistics dependency")
 	}
-	if deps.RunBatch == nil {
+	if cfg.Policies && deps.RunPolicyBatch == nil {
+		return fmt.Errorf("missing policy batch runner dependency")
+	}
+	if cfg.CTLogURL != "" && deps.RunCTLogBatch == nil {
+		return fmt.Errorf("missing CT log batch runner dependency")
+	}
+	if cfg.CTLogURL == "" && !cfg.Policies && deps.RunBatch == nil {
 		return fmt.Errorf("missing batch runner dependency")
 	}
 
@@ -156,36 +344,158 @@ func runIngest(ctx context.Context, cfg RunConfig, deps RunDependencies) error {
 		defer stats.Stop()
 	}
 
+	if cfg.Policies {
+		return ingestPolicies(ctx, j, stats, cfg, jobCfg, deps, coalesce, updateSMT)
+	}
+
+	if cfg.CTLogURL != "" {
+		return ingestCTLogInBatches(
+			ctx,
+			j,
+			stats,
+			cfg,
+			deps.CTLogSize,
+			deps.BeforeBatch,
+			func(interval journal.Interval) error {
+				if err := deps.RunCTLogBatch(stats, interval); err != nil {
+					return err
+				}
+				if jobCfg.Coalesce {
+					if err := coalesce(ctx); err != nil {
+						return err
+					}
+				}
+				if jobCfg.UpdateSMT {
+					if err := updateSMT(ctx); err != nil {
+						return err
+					}
+				}
+				return j.CommitCTLogProgress(cfg.CTLogURL, interval,
+					jobCfg.Coalesce, jobCfg.UpdateSMT)
+			},
+		)
+	}
+
+	pendingFiles := j.PendingFiles
+	estimateCertCount := deps.EstimateCertCount
+	journaled := func(files []string) []string { return files }
+	if !cfg.hasCTBundles() {
+		// The names of the files of other formats have no indices to journal or estimate from.
+		pendingFiles = func() ([]string, error) {
+			return listInputFiles(cfg.Directory)
+		}
+		estimateCertCount = func(string) (uint, error) { return 0, nil }
+		journaled = func([]string) []string { return nil }
+	}
+
 	return ingestFilesInBatches(
 		ctx,
-		j,
+		pendingFiles,
 		stats,
 		cfg.FileBatch,
-		deps.EstimateCertCount,
+		estimateCertCount,
 		deps.BeforeBatch,
 		func(files []string) error {
-			if err := deps.RunBatch(stats, files); err != nil {
+			malformedBefore := malformedRows(stats)
+			if err := deps.RunBatch(ctx, stats, files); err != nil {
 				return err
 			}
 			if jobCfg.Coalesce {
-				if err := coalesce(); err != nil {
+				if err := coalesce(ctx); err != nil {
 					return err
 				}
 			}
 			if jobCfg.UpdateSMT {
-				if err := updateSMT(); err != nil {
+				if err := updateSMT(ctx); err != nil {
+					return err
+				}
+			}
+			if cfg.hasCTBundles() {
+				// The malformed rows are journaled with the indices of their files.
+				err := j.AddQuarantinedRows(malformedRows(stats) - malformedBefore)
+				if err != nil {
 					return err
 				}
 			}
-			return j.CommitProgress(files, jobCfg.Coalesce, jobCfg.UpdateSMT)
+			return j.CommitProgress(journaled(files), jobCfg.Coalesce, jobCfg.UpdateSMT)
 		},
 	)
 }
 
-func ingestFilesInBatches(
+// ingestPolicies ingests the pending policy documents of the directory of the configuration in
+// batches, journaling each one. Unlike certificates, the coalescing and SMT update run once after
+// all batches, if anything was ingested or a previous run did not complete them.
+func ingestPolicies(
 	ctx context.Context,
 	j *journal.Journal,
 	stats *statistics.Stats,
+	cfg RunConfig,
+	jobCfg journal.JobConfiguration,
+	deps RunDependencies,
+	coalesce func(context.Context) error,
+	updateSMT func(context.Context) error,
+) error {
+	roots, err := readTrustedPolicyRoots(cfg.TrustedPolicyRoots)
+	if err != nil {
+		return fmt.Errorf("reading trusted policy roots: %w", err)
+	}
+	validator, err := newPolicyValidator(roots, deps.RetrievePoliciesPage)
+	if err != nil {
+		return err
+	}
+	err = ingestPoliciesInBatches(
+		ctx,
+		j,
+		stats,
+		validator,
+		cfg.Directory,
+		cfg.MultiInsertSize,
+		deps.BeforeBatch,
+		func(batch []policyDocument) error {
+			docs := make([]common.PolicyDocument, len(batch))
+			for i, doc := range batch {
+				docs[i] = doc.PolicyDocument
+			}
+			if err := deps.RunPolicyBatch(stats, docs); err != nil {
+				return err
+			}
+			return j.CommitPolicyProgress(policyBatchCompletedIndices(batch), false, false)
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	job := j.Jobs[len(j.Jobs)-1]
+	if jobCfg.Coalesce && !job.Coalesced {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := coalesce(ctx); err != nil {
+			return err
+		}
+		if err := j.CommitProgress(nil, true, false); err != nil {
+			return err
+		}
+	}
+	if jobCfg.UpdateSMT && !job.UpdatedSMT {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := updateSMT(ctx); err != nil {
+			return err
+		}
+		if err := j.CommitProgress(nil, true, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func ingestFilesInBatches(
+	ctx context.Context,
+	pendingFiles func() ([]string, error),
+	stats *statistics.Stats,
 	fileBatchSize int,
 	estimateCertCount func(string) (uint, error),
 	beforeBatch func(batchNum, batchCount int) error,
@@ -199,7 +509,7 @@ func ingestFilesInBatches(
 		estimateCertCount = util.EstimateCertCount
 	}
 
-	allFilenames, err := j.PendingFiles()
+	allFilenames, err := pendingFiles()
 	if err != nil {
 		return err
 	}
@@ -249,6 +559,93 @@ func ingestFilesInBatches(
 	return nil
 }
 
+// ingestCTLogInBatches calls forEachBatch for the intervals of entries of the CT log of the
+// configuration that are not yet completed according to the journal, at most cfg.CTLogBatch
+// entries each.
+func ingestCTLogInBatches(
+	ctx context.Context,
+	j *journal.Journal,
+	stats *statistics.Stats,
+	cfg RunConfig,
+	ctLogSize func(context.Context) (int64, error),
+	beforeBatch func(batchNum, batchCount int) error,
+	forEachBatch func(journal.Interval) error,
+) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	end := cfg.CTLogEnd
+	if end < 0 {
+		if ctLogSize == nil {
+			return fmt.Errorf("missing CT log size dependency")
+		}
+		size, err := ctLogSize(ctx)
+		if err != nil {
+			return fmt.Errorf("obtaining size of CT log %q: %w", cfg.CTLogURL, err)
+		}
+		end = size - 1
+	}
+	if end < cfg.CTLogStart {
+		// Nothing to ingest.
+		return nil
+	}
+
+	pending, err := j.PendingCTLogIntervals(cfg.CTLogURL, journal.Interval{
+		Start: uint(cfg.CTLogStart),
+		End:   uint(end),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Split the pending intervals in batches.
+	batches := make([]journal.Interval, 0, len(pending))
+	for _, interval := range pending {
+		if cfg.CTLogBatch <= 0 {
+			batches = append(batches, interval)
+			continue
+		}
+		for start := interval.Start; start <= interval.End; start += uint(cfg.CTLogBatch) {
+			batches = append(batches, journal.Interval{
+				Start: start,
+				End:   min(start+uint(cfg.CTLogBatch)-1, interval.End),
+			})
+		}
+	}
+
+	if stats != nil {
+		stats.TotalRows.Store(0)
+		for _, batch := range batches {
+			stats.TotalRows.Add(int64(batch.End - batch.Start + 1))
+		}
+	}
+
+	for i, batch := range batches {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if beforeBatch != nil {
+			if err := beforeBatch(i+1, len(batches)); err != nil {
+				return err
+			}
+		}
+		if err := forEachBatch(batch); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// malformedRows returns the number of malformed rows skipped or quarantined so far.
+func malformedRows(stats *statistics.Stats) int64 {
+	if stats == nil {
+		return 0
+	}
+	return stats.MalformedRows.Load()
+}
+
 func logBatchStart(files []string) {
 	names := make([]string, len(files))
 	for i, f := range files {
@@ -261,6 +658,14 @@ func logBatchStart(files []string) {
 	)
 }
 
+func logCTLogBatchStart(ctLogURL string, interval journal.Interval) {
+	fmt.Printf("[%s] Starting ingesting entries %s of %s\n",
+		time.Now().Format(time.StampMilli),
+		interval.String(),
+		ctLogURL,
+	)
+}
+
 func gcBeforeBatch(batchNum, batchCount int) error {
 	var memBefore, memAfter runtime.MemStats
 	runtime.ReadMemStats(&memBefore)
@@ -286,17 +691,33 @@ func deriveCTLogURLFromIngestDir(ingestDir string) (string, error) {
 	return parsed.String(), nil
 }
 
-func completedCTLogSize(j *journal.Journal, ingestDir string) (int64, error) {
+// checkNoHoles returns an error if the completed indices of the journal with the key have holes,
+// i.e. indices not completed below the last completed one.
+func checkNoHoles(j *journal.Journal, key string) error {
+	completed, err := j.CompletedIntervals(key)
+	if err != nil {
+		return err
+	}
+	holes := journal.NewCoverage(key, nil, completed, 0).Holes()
+	if len(holes) > 0 {
+		return fmt.Errorf("refusing to record the size of %q, its completed indices have holes %v",
+			key, holes)
+	}
+	return nil
+}
+
+// completedCTLogSize returns the size of the CT log ingested without gaps according to the
+// completed indices of the journal with the key.
+func completedCTLogSize(j *journal.Journal, key string) (int64, error) {
 	if j == nil {
 		return 0, fmt.Errorf("cannot compute CT log size without journal")
 	}
 	if len(j.Jobs) == 0 {
 		return 0, fmt.Errorf("journal has no jobs")
 	}
-	ingestDirBase := filepath.Base(filepath.Clean(ingestDir))
-	intervals := j.Jobs[len(j.Jobs)-1].CompletedIndices[ingestDirBase]
+	intervals := j.Jobs[len(j.Jobs)-1].CompletedIndices[key]
 	if len(intervals) == 0 {
-		return 0, fmt.Errorf("no completed indices recorded for ingest directory %q", ingestDirBase)
+		return 0, fmt.Errorf("no completed indices recorded for %q", key)
 	}
 	// Set the size of the ingested set from this CT log server to be END+1 of the interval [0,END].
 	return int64(intervals[0].End) + 1, nil
@@ -343,7 +343,7 @@ func TestCompletedCTLogSize(t *testing.T) {
 			},
 		}
 
-		size, err := completedCTLogSize(j, dir)
+		size, err := completedCTLogSize(j, filepath.Base(dir))
 		require.NoError(t, err)
 		require.Equal(t, int64(10), size)
 	})
@@ -359,7 +359,7 @@ func TestCompletedCTLogSize(t *testing.T) {
 			},
 		}
 
-		_, err := completedCTLogSize(j, dir)
+		_, err := completedCTLogSize(j, filepath.Base(dir))
 		require.Error(t, err)
 		require.Contains(t, err.Error(), filepath.Base(dir))
 	})
@@ -480,6 +480,170 @@ func TestRunIngestRecordCTSizeUpdatesDB(t *testing.T) {
 	require.NoError(t, finalJournal.Close())
 }
 
+// TestRunIngestCTLog checks that the entries of a CT log are ingested in batches, skipping the
+// ones already completed according to the journal, which keys them by the CT log URL.
+func TestRunIngestCTLog(t *testing.T) {
+	const ctLogURL = "https://ct.example.com/logs/test"
+	cfg := newTestRunConfig("", filepath.Join(t.TempDir(), "journal.json"), 0, "")
+	cfg.CTLogURL = ctLogURL
+	cfg.CTLogStart = 5
+	cfg.CTLogEnd = -1 // Up to the size of the log.
+	cfg.CTLogBatch = 10
+
+	// Entries [10,14] were already ingested.
+	j := loadJournalForTest(t, cfg)
+	require.NoError(t, j.CommitCTLogProgress(ctLogURL, journal.Interval{Start: 10, End: 14},
+		false, false))
+	require.NoError(t, j.Close())
+
+	var runOrder []journal.Interval
+	var coalesceCount, updateCount int
+	deps := newTestDeps(t, nil, &coalesceCount, &updateCount, 0)
+	deps.RunBatch = nil
+	deps.CTLogSize = func(context.Context) (int64, error) {
+		return 30, nil
+	}
+	deps.RunCTLogBatch = func(_ *statistics.Stats, interval journal.Interval) error {
+		runOrder = append(runOrder, interval)
+		return nil
+	}
+
+	require.NoError(t, runIngest(context.Background(), cfg, deps))
+	require.Equal(t, []journal.Interval{
+		{Start: 5, End: 9},
+		{Start: 15, End: 24},
+		{Start: 25, End: 29},
+	}, runOrder)
+	require.Equal(t, 3, coalesceCount)
+	require.Equal(t, 3, updateCount)
+
+	j = loadJournalForTest(t, cfg)
+	job := latestJobForTest(t, j)
+	require.Equal(t, journal.CompletedIndices{
+		ctLogURL: {{Start: 5, End: 29}},
+	}, job.CompletedIndices)
+	require.True(t, job.Coalesced)
+	require.True(t, job.UpdatedSMT)
+	require.NoError(t, j.Close())
+
+	// Nothing is pending anymore.
+	runOrder = nil
+	require.NoError(t, runIngest(context.Background(), cfg, deps))
+	require.Empty(t, runOrder)
+
+	// The recorded size uses the CT log URL as key and as URL.
+	cfg.Strategy = "recordctsize"
+	var recordedURL string
+	var recordedSize int64
+	deps.RecordCTSize = func(_ context.Context, url string, size int64) error {
+		recordedURL, recordedSize = url, size
+		return nil
+	}
+	// Starting at 5, the log is not completed without gaps from its first entry.
+	j = loadJournalForTest(t, cfg)
+	require.NoError(t, j.CommitCTLogProgress(ctLogURL, journal.Interval{Start: 0, End: 4},
+		true, true))
+	require.NoError(t, j.Close())
+	require.NoError(t, runIngest(context.Background(), cfg, deps))
+	require.Equal(t, ctLogURL, recordedURL)
+	require.Equal(t, int64(30), recordedSize)
+}
+
+// TestRunIngestInputFormat checks that the files in formats other than the CT CSV bundles are
+// all listed and ingested at every run, without journaling their indices.
+func TestRunIngestInputFormat(t *testing.T) {
+	dir := t.TempDir()
+	files := []string{
+		filepath.Join(dir, "a.pem"),
+		filepath.Join(dir, "sub", "b.der"),
+	}
+	for _, name := range files {
+		require.NoError(t, os.MkdirAll(filepath.Dir(name), 0o755))
+		require.NoError(t, os.WriteFile(name, nil, 0o644))
+	}
+	cfg := newTestRunConfig(dir, filepath.Join(t.TempDir(), "journal.json"), 1, "")
+	cfg.InputFormat = AutoFormat
+
+	var runOrder [][]string
+	var coalesceCount, updateCount int
+	deps := newTestDeps(t, &runOrder, &coalesceCount, &updateCount, 0)
+	deps.EstimateCertCount = func(string) (uint, error) {
+		require.FailNow(t, "the certificates of these files cannot be estimated")
+		return 0, nil
+	}
+
+	for run := 1; run <= 2; run++ {
+		runOrder = nil
+		require.NoError(t, runIngest(context.Background(), cfg, deps))
+		require.Equal(t, [][]string{{files[0]}, {files[1]}}, runOrder)
+		require.Equal(t, 2*run, coalesceCount)
+		require.Equal(t, 2*run, updateCount)
+
+		j := loadJournalForTest(t, cfg)
+		job := previousJobForTest(t, j)
+		require.Empty(t, job.CompletedIndices)
+		require.True(t, job.UpdatedSMT)
+		require.NoError(t, j.Close())
+	}
+
+	cfg.InputFormat = "xml"
+	require.Error(t, cfg.validate())
+}
+
+// TestRunConfigValidateCTLog checks the validation of the CT log source settings.
+func TestRunConfigValidateCTLog(t *testing.T) {
+	testCases := map[string]struct {
+		modify  func(*RunConfig)
+		wantErr bool
+	}{
+		"valid_range": {
+			modify: func(cfg *RunConfig) {
+				cfg.CTLogStart, cfg.CTLogEnd = 10, 20
+			},
+		},
+		"valid_open_range": {
+			modify: func(cfg *RunConfig) {
+				cfg.CTLogStart, cfg.CTLogEnd = 10, -1
+			},
+		},
+		"fails_with_directory": {
+			modify: func(cfg *RunConfig) {
+				cfg.Directory = t.TempDir()
+			},
+			wantErr: true,
+		},
+		"fails_with_negative_start": {
+			modify: func(cfg *RunConfig) {
+				cfg.CTLogStart = -1
+			},
+			wantErr: true,
+		},
+		"fails_with_end_before_start": {
+			modify: func(cfg *RunConfig) {
+				cfg.CTLogStart, cfg.CTLogEnd = 10, 9
+			},
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		name, tc := name, tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			cfg := newTestRunConfig("", "journal.json", 0, "onlyingest")
+			cfg.CTLogURL = "https://ct.example.com/logs/test"
+			tc.modify(&cfg)
+			err := cfg.validate()
+			if tc.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
 // makeIngestTestFiles creates a minimal bundled ingest tree with three
 // sequential gzip files and returns the ingest root plus file paths in order.
 func makeIngestTestFiles(t *testing.T) (string, []string) {
@@ -533,18 +697,18 @@ func newTestDeps(
 		NewStatistics: func() *statistics.Stats {
 			return statistics.NewStatistics(time.Hour, nil)
 		},
-		RunBatch: func(_ *statistics.Stats, files []string) error {
+		RunBatch: func(_ context.Context, _ *statistics.Stats, files []string) error {
 			*runOrder = append(*runOrder, slices.Clone(files))
 			if failBatch > 0 && len(*runOrder) == failBatch {
 				return assertErr{}
 			}
 			return nil
 		},
-		Coalesce: func() error {
+		Coalesce: func(context.Context) error {
 			*coalesceCount = *coalesceCount + 1
 			return nil
 		},
-		UpdateSMT: func() error {
+		UpdateSMT: func(context.Context) error {
 			*updateCount = *updateCount + 1
 			return nil
 		},
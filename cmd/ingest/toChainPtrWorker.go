@@ -22,7 +22,7 @@ type lineToChainPtrWorker struct {
 func NewLineToChainPtrWorker(p *Processor, numWorker int) *lineToChainPtrWorker {
 	w := &lineToChainPtrWorker{
 		now:   time.Now(),
-		cache: cache.NewLruCache(LruCacheSize),
+		cache: newWorkerCache(p),
 	}
 
 	// Prepare stage.
@@ -43,22 +43,23 @@ func NewLineToChainPtrWorker(p *Processor, numWorker int) *lineToChainPtrWorker
 	return w
 }
 
-// parseLine decodes one compact CSV row into a pointer-based certificate chain representation.
+// parseLine decodes one record into a pointer-based certificate chain representation.
 func (w *lineToChainPtrWorker) parseLine(p *Processor, line *line) (*certChain, error) {
+	format := line.inputFormat()
 	// First avoid even parsing already expired certs. As in the value-based worker, we only
-	// inspect the compact expiration field extracted by the CSV stage.
-	n, err := getExpiration(line.expirationField)
+	// inspect the compact expiration field extracted by the CSV stage, if the format has it.
+	n, ok, err := format.expiration(line)
 	if err != nil {
 		return nil, err
 	}
 	p.Manager.Stats.ReadRows.Add(1)
-	if w.now.After(time.Unix(n, 0)) {
+	if ok && w.now.After(time.Unix(n, 0)) {
 		// Skip this certificate.
 		return nil, nil
 	}
 
-	// Decode the leaf certificate payload directly from the byte-oriented CSV representation.
-	rawBytes, err := decodeBase64Field(line.certField)
+	// Decode the leaf certificate payload directly from the byte-oriented representation.
+	rawBytes, err := format.decodeCert(line)
 	if err != nil {
 		return nil, err
 	}
@@ -79,22 +80,19 @@ func (w *lineToChainPtrWorker) parseLine(p *Processor, line *line) (*certChain,
 		return nil, err
 	}
 
-	// Although we checked right at the beginning with getExpiration, now use the payload.
+	// Although we may have checked right at the beginning, now use the payload.
 	if w.now.After(cert.NotAfter) {
 		// Don't ingest already expired certificates.
 		return nil, nil
 	}
 
-	// The chain is still represented as semicolon-delimited base64 payloads.
-	chainFields := splitSemicolonField(line.chainField)
-	chain := make([]*ctx509.Certificate, len(chainFields))
-	chainIDs := make([]*common.SHA256Output, len(chainFields))
-	for i, s := range chainFields {
-		rawBytes, err = decodeBase64Field(s)
-		if err != nil {
-			return nil, fmt.Errorf("at line %d: %s\n%s",
-				line.number, err, string(line.chainField))
-		}
+	chainPayloads, err := format.decodeChain(line)
+	if err != nil {
+		return nil, err
+	}
+	chain := make([]*ctx509.Certificate, len(chainPayloads))
+	chainIDs := make([]*common.SHA256Output, len(chainPayloads))
+	for i, rawBytes := range chainPayloads {
 		// Update statistics.
 		p.Manager.Stats.ReadBytes.Add(int64(len(rawBytes)))
 		p.Manager.Stats.ReadCerts.Add(1)
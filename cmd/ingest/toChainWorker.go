@@ -38,7 +38,7 @@ type lineToChainWorker struct {
 func NewLineToChainWorker(p *Processor, numWorker int) *lineToChainWorker {
 	w := &lineToChainWorker{
 		now:   time.Now(),
-		cache: cache.NewLruCache(LruCacheSize),
+		cache: newWorkerCache(p),
 	}
 
 	// Prepare stage.
@@ -51,6 +51,11 @@ func NewLineToChainWorker(p *Processor, numWorker int) *lineToChainWorker {
 		pip.WithProcessFunction(
 			func(in line) ([]certChain, []int, error) {
 				chain, err := w.parseLine(p, &in)
+				if err != nil && p.Quarantine != nil {
+					// Drop the malformed record instead of failing the batch.
+					p.Manager.Stats.MalformedRows.Add(1)
+					return nil, nil, p.Quarantine.add(&in, err)
+				}
 				if chain == nil {
 					// Skipped line, return nothing.
 					return nil, nil, err
@@ -63,11 +68,13 @@ func NewLineToChainWorker(p *Processor, numWorker int) *lineToChainWorker {
 	return w
 }
 
-// parseLine decodes one compact CSV row into a leaf certificate plus its parent chain metadata.
+// parseLine decodes one record into a leaf certificate plus its parent chain metadata.
 func (w *lineToChainWorker) parseLine(p *Processor, line *line) (*certChain, error) {
-	// First avoid even parsing already expired certs. The splitter already isolated the last
-	// column for us, so we can parse the timestamp without materializing the whole row.
-	n, err := getExpiration(line.expirationField)
+	format := line.inputFormat()
+	// First avoid even parsing already expired certs. For CT CSV rows, the splitter already
+	// isolated the last column for us, so we can parse the timestamp without materializing the
+	// whole row.
+	n, ok, err := format.expiration(line)
 	if err != nil {
 		return nil, err
 	}
@@ -76,15 +83,15 @@ func (w *lineToChainWorker) parseLine(p *Processor, line *line) (*certChain, err
 	p.Manager.Stats.ReadRows.Add(1)
 	p.Manager.Stats.ReadCerts.Add(1)
 
-	if w.now.After(time.Unix(n, 0)) {
+	if ok && w.now.After(time.Unix(n, 0)) {
 		// Skip this certificate.
 		p.Manager.Stats.ExpiredCerts.Add(1)
 		return nil, nil
 	}
 
 	// From this point on, we need the actual leaf payload. Decode directly from the compact
-	// byte field produced by the fast/slow CSV parser.
-	rawBytes, err := decodeBase64Field(line.certField)
+	// byte field produced by the splitter.
+	rawBytes, err := format.decodeCert(line)
 	if err != nil {
 		return nil, err
 	}
@@ -106,23 +113,22 @@ func (w *lineToChainWorker) parseLine(p *Processor, line *line) (*certChain, err
 		return nil, err
 	}
 
-	// Although we checked right at the beginning with getExpiration, now use the payload.
+	// Although we may have checked right at the beginning, now use the payload.
 	if w.now.After(cert.NotAfter) {
 		// Don't ingest already expired certificates.
+		if !ok {
+			p.Manager.Stats.ExpiredCerts.Add(1)
+		}
 		return nil, nil
 	}
 
-	// The certificate chain field is still semicolon-delimited. Split it lazily without
-	// converting the whole field to []string first.
-	chainFields := splitSemicolonField(line.chainField)
-	chain := make([]*ctx509.Certificate, len(chainFields))
-	chainIDs := make([]*common.SHA256Output, len(chainFields))
-	for i, s := range chainFields {
-		rawBytes, err = decodeBase64Field(s)
-		if err != nil {
-			return nil, fmt.Errorf("at line %d: %s\n%s",
-				line.number, err, string(line.chainField))
-		}
+	chainPayloads, err := format.decodeChain(line)
+	if err != nil {
+		return nil, err
+	}
+	chain := make([]*ctx509.Certificate, len(chainPayloads))
+	chainIDs := make([]*common.SHA256Output, len(chainPayloads))
+	for i, rawBytes := range chainPayloads {
 		// Update statistics.
 		p.Manager.Stats.ReadBytes.Add(int64(len(rawBytes)))
 		p.Manager.Stats.ReadCerts.Add(1)
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"github.com/netsec-ethz/fpki/pkg/cache"
+	"github.com/netsec-ethz/fpki/pkg/common"
+)
+
+const (
+	// LruCacheKind gives each parse worker its own LRU cache of LruCacheSize certificate IDs.
+	LruCacheKind = "lru"
+	// BoundedCacheKind makes the parse workers of a batch share one cache.BoundedCache, within a
+	// memory budget.
+	BoundedCacheKind = "bounded"
+)
+
+// filteredCache is the cache of the workers of a processor with a certificate filter: it also
+// contains the certificates of the filter, while the IDs added are only kept by the worker.
+type filteredCache struct {
+	cache.Cache
+	filter *certFilter
+}
+
+func (c filteredCache) Contains(id *common.SHA256Output) bool {
+	return c.Cache.Contains(id) || c.filter.Contains(id)
+}
+
+// newWorkerCache returns the cache of the IDs of the certificates seen by a worker of the
+// processor: the cache shared by its workers, or otherwise a new LRU cache. It also contains
+// the certificates of the certificate filter of the processor, if any.
+func newWorkerCache(p *Processor) cache.Cache {
+	seen := p.Cache
+	if seen == nil {
+		seen = cache.NewLruCache(LruCacheSize)
+	}
+	if p.CertFilter == nil {
+		return seen
+	}
+	return filteredCache{
+		Cache:  seen,
+		filter: p.CertFilter,
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/db"
+	"github.com/netsec-ethz/fpki/pkg/db/embedded"
+	"github.com/netsec-ethz/fpki/pkg/statistics"
+	"github.com/netsec-ethz/fpki/pkg/tests/random"
+	"github.com/netsec-ethz/fpki/pkg/util"
+)
+
+// TestProcessorBoundedCache checks that the workers of a processor with a bounded cache share
+// it, so that the issuer of the certificates is parsed once, and that its hits and misses are
+// counted in the statistics.
+func TestProcessorBoundedCache(t *testing.T) {
+	ctx, cancelF := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelF()
+
+	conn, err := embedded.Connect(db.NewConfig(embedded.WithDirectory(t.TempDir())))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	issuer := random.RandomX509Cert(t, "issuer.com")
+	ids := []common.SHA256Output{common.SHA256Hash32Bytes(issuer.Raw)}
+	var rows []string
+	for _, domain := range []string{"a.com", "b.com", "c.com", "d.com"} {
+		cert := random.RandomX509Cert(t, domain)
+		ids = append(ids, common.SHA256Hash32Bytes(cert.Raw))
+		rows = append(rows, ctCSVRow(base64.StdEncoding.EncodeToString(cert.Raw),
+			base64.StdEncoding.EncodeToString(issuer.Raw), "4000000000.0"))
+	}
+	file := filepath.Join(t.TempDir(), "bundled", "0-3.gz")
+	writeCTBundle(t, file, rows...)
+
+	stats := statistics.NewStatistics(time.Hour, nil)
+	defer stats.Stop()
+	proc, err := NewProcessor(ctx, conn, 10, stats, WithStreamCsv(true), WithBoundedCache(1<<20))
+	require.NoError(t, err)
+	require.NotNil(t, proc.Cache)
+	require.Same(t, proc.Cache, newWorkerCache(proc))
+	proc.AddCsvFiles([]util.CsvFile{loadInputFile(file)})
+	proc.Resume()
+	require.NoError(t, proc.Wait())
+
+	exist, err := conn.CheckCertsExist(ctx, ids)
+	require.NoError(t, err)
+	require.Equal(t, []bool{true, true, true, true, true}, exist)
+	// Each leaf and the first issuer miss, the other issuers hit.
+	hits, misses := stats.CacheLookups()
+	require.Equal(t, int64(3), hits)
+	require.Equal(t, int64(5), misses)
+	require.Zero(t, stats.CacheEvictions.Load())
+
+	cfg := newTestRunConfig(t.TempDir(), "", 0, "")
+	cfg.Cache = BoundedCacheKind
+	require.Error(t, cfg.validate())
+	cfg.CacheBytes = 1 << 20
+	require.NoError(t, cfg.validate())
+	cfg.Cache = "arc"
+	require.Error(t, cfg.validate())
+}
@@ -12,9 +12,12 @@ import (
 
 	"github.com/netsec-ethz/fpki/pkg/common"
 	"github.com/netsec-ethz/fpki/pkg/db"
+	"github.com/netsec-ethz/fpki/pkg/db/backends"
 	"github.com/netsec-ethz/fpki/pkg/db/mysql"
 	"github.com/netsec-ethz/fpki/pkg/mapserver"
+	"github.com/netsec-ethz/fpki/pkg/mapserver/archive"
 	"github.com/netsec-ethz/fpki/pkg/mapserver/config"
+	"github.com/netsec-ethz/fpki/pkg/mapserver/fsck"
 	"github.com/netsec-ethz/fpki/pkg/mapserver/updater"
 	"github.com/netsec-ethz/fpki/pkg/util"
 )
@@ -23,6 +26,9 @@ const VERSION = "0.2.1"
 
 const waitForExitBeforePanicTime = 10 * time.Second
 
+// deriveEntriesPageSize is the number of rows of the certs table read at once by -deriveCertEntries.
+const deriveEntriesPageSize = 10_000
+
 func main() {
 	os.Exit(mainFunc())
 }
@@ -32,9 +38,14 @@ func mainFunc() int {
 	// the flags before touching them.
 	flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
 
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		return manageError(migrateMain(os.Args[2:]))
+	}
+
 	// Prepare our flags.
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage:\n%s configuration_file\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Usage:\n%s configuration_file\n%s migrate [flags] "+
+			"[configuration_file]\n", os.Args[0], os.Args[0])
 		flag.PrintDefaults()
 	}
 	flag.CommandLine.Usage = flag.Usage
@@ -46,6 +57,25 @@ func mainFunc() int {
 	createSampleConfig := flag.Bool("createSampleConfig", false,
 		"Create configuration file specified by positional argument")
 	insertPolicyVar := flag.String("policyFile", "", "policy certificate file to be ingested into the mapserver")
+	subdomainsOf := flag.String("subdomainsOf", "", "list the known subdomains of this domain")
+	domainPattern := flag.String("domainPattern", "",
+		"list the known domains matching this pattern, with '*' and '?' wildcards")
+	searchAfter := flag.String("searchAfter", "", "when listing domains, start after this one")
+	searchLimit := flag.Int("searchLimit", mapserver.DefaultSearchLimit,
+		"maximum number of domains to list, 0 for all")
+	exportDir := flag.String("export", "", "export the map into this archive directory")
+	exportChunkSize := flag.Int("exportChunkSize", archive.DefaultChunkSize,
+		"maximum number of rows per chunk of the exported archive")
+	importDir := flag.String("import", "", "import the map from this archive directory into "+
+		"an empty DB")
+	archiveCert := flag.String("archiveCert", "", "certificate of the map server that exported "+
+		"the archive being imported (default: the certificate in the configuration)")
+	fsckVar := flag.Bool("fsck", false, "check the consistency of the DB and exit")
+	fsckGC := flag.Bool("fsckGC", false, "with -fsck, delete the orphaned SMT nodes")
+	fsckKeepEpochs := flag.Uint64("fsckKeepEpochs", 0, "with -fsck, the SMT nodes of the roots "+
+		"of this many epochs before the latest are not orphaned")
+	deriveCertEntries := flag.Bool("deriveCertEntries", false, "store the CT log entry of the "+
+		"leaves ingested without it, and mark the domains of their precertificates dirty")
 	flag.Parse()
 
 	if showVersion {
@@ -65,6 +95,25 @@ func mainFunc() int {
 		err = writeSampleConfig()
 	case *insertPolicyVar != "":
 		err = insertPolicyFromFile(*insertPolicyVar)
+	case *fsckVar:
+		var ok bool
+		ok, err = fsckMap(*fsckGC, *fsckKeepEpochs)
+		if err == nil && !ok {
+			return 1
+		}
+	case *deriveCertEntries:
+		err = deriveEntries()
+	case *exportDir != "":
+		err = exportMap(*exportDir, *exportChunkSize)
+	case *importDir != "":
+		err = importMap(*importDir, *archiveCert)
+	case *subdomainsOf != "" || *domainPattern != "":
+		err = searchDomains(db.DomainSearch{
+			Suffix:  *subdomainsOf,
+			Pattern: *domainPattern,
+			After:   *searchAfter,
+			Limit:   *searchLimit,
+		})
 	default:
 		err = run(*updateVar)
 	}
@@ -131,6 +180,176 @@ func insertPolicyFromFile(policyFile string) error {
 	return nil
 }
 
+// fsckMap checks the consistency of the DB of the configuration, and returns false if any
+// problem was found. The nodes reachable from the roots of the last keepEpochs epochs are
+// retained.
+func fsckMap(collectGarbage bool, keepEpochs uint64) (bool, error) {
+	ctx := context.Background()
+	conf, err := config.ReadConfigFromFile(flag.Arg(0))
+	if err != nil {
+		return false, err
+	}
+	conn, err := backends.Connect(conf.DBConfig)
+	if err != nil {
+		return false, fmt.Errorf("error connecting to the DB: %w", err)
+	}
+	defer conn.Close()
+
+	opts := fsck.Options{
+		CollectGarbage: collectGarbage,
+	}
+	last, err := conn.LastEpoch(ctx)
+	if err != nil {
+		return false, err
+	}
+	for i := uint64(1); last != nil && i <= keepEpochs && i < last.Number; i++ {
+		epoch, err := conn.RetrieveEpoch(ctx, last.Number-i)
+		if err != nil {
+			return false, err
+		}
+		if epoch != nil {
+			opts.RetainedRoots = append(opts.RetainedRoots, epoch.Root)
+		}
+	}
+
+	r, err := fsck.Check(ctx, conn, opts)
+	if err != nil {
+		return false, err
+	}
+	for _, p := range r.Problems {
+		fmt.Println(p)
+	}
+	fmt.Printf("checked %d certificates, %d policies, %d domains, %d SMT leaves and "+
+		"%d SMT nodes\n", r.Certificates, r.Policies, r.Domains, r.Leaves, r.TreeNodes)
+	for kind, count := range r.Counts {
+		fmt.Printf("%s: %d\n", kind, count)
+	}
+	if r.DeletedNodes > 0 {
+		fmt.Printf("deleted %d orphaned SMT nodes\n", r.DeletedNodes)
+	}
+	return r.OK(), nil
+}
+
+// deriveEntries stores the entries of the leaves that have none. The payloads of the domains of
+// their precertificates are coalesced again by the next update.
+func deriveEntries() error {
+	ctx := context.Background()
+	conf, err := config.ReadConfigFromFile(flag.Arg(0))
+	if err != nil {
+		return err
+	}
+	conn, err := backends.Connect(conf.DBConfig)
+	if err != nil {
+		return fmt.Errorf("error connecting to the DB: %w", err)
+	}
+	defer conn.Close()
+
+	n, err := updater.DeriveCertificateEntries(ctx, conn, deriveEntriesPageSize)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("derived the entries of %d certificates\n", n)
+	return nil
+}
+
+// exportMap writes the map into an archive, signing its root with the map server key.
+func exportMap(dir string, chunkSize int) error {
+	ctx := context.Background()
+	conf, err := config.ReadConfigFromFile(flag.Arg(0))
+	if err != nil {
+		return err
+	}
+	pemKey, err := os.ReadFile(conf.PrivateKeyPemFile)
+	if err != nil {
+		return fmt.Errorf("error loading private key: %w", err)
+	}
+	key, err := util.RSAKeyFromPEM(pemKey)
+	if err != nil {
+		return fmt.Errorf("error loading private key: %w", err)
+	}
+	conn, err := backends.Connect(conf.DBConfig)
+	if err != nil {
+		return fmt.Errorf("error connecting to the DB: %w", err)
+	}
+	defer conn.Close()
+
+	m, err := archive.Export(ctx, conn, dir, key, chunkSize)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("exported map with root %x into %d chunks in %s\n", m.Root, len(m.Chunks), dir)
+	return nil
+}
+
+// importMap loads an archive into the empty DB of the configuration. The signed root of the
+// archive is verified with certFile, or the map server certificate if empty.
+func importMap(dir string, certFile string) error {
+	ctx := context.Background()
+	conf, err := config.ReadConfigFromFile(flag.Arg(0))
+	if err != nil {
+		return err
+	}
+	if certFile == "" {
+		certFile = conf.CertificatePemFile
+	}
+	pemCert, err := os.ReadFile(certFile)
+	if err != nil {
+		return fmt.Errorf("error loading certificate: %w", err)
+	}
+	cert, err := util.CertificateFromPEMBytes(pemCert)
+	if err != nil {
+		return fmt.Errorf("error loading certificate: %w", err)
+	}
+	publicKey, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("certificate %s does not contain an RSA key", certFile)
+	}
+	conn, err := backends.Connect(conf.DBConfig)
+	if err != nil {
+		return fmt.Errorf("error connecting to the DB: %w", err)
+	}
+	defer conn.Close()
+
+	m, err := archive.Import(ctx, conn, dir, publicKey)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("imported map with root %x from %s\n", m.Root, dir)
+	return nil
+}
+
+// searchDomains prints the domains selected by the search, one per line, followed by the
+// total count.
+func searchDomains(search db.DomainSearch) error {
+	ctx := context.Background()
+	conf, err := config.ReadConfigFromFile(flag.Arg(0))
+	if err != nil {
+		return err
+	}
+	conn, err := backends.Connect(conf.DBConfig)
+	if err != nil {
+		return fmt.Errorf("error connecting to the DB: %w", err)
+	}
+	defer conn.Close()
+
+	domains, err := conn.SearchDomains(ctx, search)
+	if err != nil {
+		return err
+	}
+	total, err := conn.CountDomains(ctx, search)
+	if err != nil {
+		return err
+	}
+	for _, d := range domains {
+		fmt.Printf("%x %s\n", d.DomainID, d.DomainName)
+	}
+	fmt.Printf("listed %d of %d domains\n", len(domains), total)
+	if search.Limit > 0 && len(domains) == search.Limit {
+		fmt.Printf("continue with -searchAfter %s\n", domains[len(domains)-1].DomainName)
+	}
+	return nil
+}
+
 func writeSampleConfig() error {
 	dbConfig := db.NewConfig(
 		mysql.WithDefaults(),
@@ -177,6 +396,10 @@ func runWithConfig(
 	updateNow bool,
 ) error {
 
+	if conf.PrimaryURL != "" {
+		return runReplicaWithConfig(ctx, conf)
+	}
+
 	server, err := mapserver.NewMapServer(ctx, conf)
 	if err != nil {
 		return err
@@ -225,6 +448,35 @@ func runWithConfig(
 	return err
 }
 
+// runReplicaWithConfig runs a read-only map server that syncs with its primary every
+// SyncInterval, starting now.
+func runReplicaWithConfig(ctx context.Context, conf *config.Config) error {
+	server, err := mapserver.NewReplicaMapServer(ctx, conf)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Running replica map server (%s) of primary %s\n", VERSION, conf.PrimaryURL)
+
+	interval := conf.SyncInterval.Duration
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	util.RunWhen(ctx, time.Now(), interval, func(ctx context.Context) {
+		if err := server.SyncWithPrimary(ctx); err != nil {
+			fmt.Printf("ERROR: sync with primary returned %s\n", err)
+		}
+	})
+
+	// Listen in responder.
+	err = server.ListenWithoutTLS(ctx)
+
+	// Regardless of the error, clean everything up.
+	cleanUp()
+
+	// Return the error from the responder.
+	return err
+}
+
 func cleanUp() {
 	fmt.Println("cleaning up")
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/netsec-ethz/fpki/pkg/db"
+	"github.com/netsec-ethz/fpki/pkg/db/mysql"
+	"github.com/netsec-ethz/fpki/pkg/mapserver/config"
+)
+
+// migrateMain runs the "migrate" subcommand, which applies the schema migrations to the DB.
+func migrateMain(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage:\n%s migrate [flags] [configuration_file]\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	to := flags.Int("to", 0, "migrate up to this schema version (default: the latest)")
+	status := flags.Bool("status", false,
+		"print the schema version and the pending migrations, without applying them")
+	dbName := flags.String("dbname", "", "migrate this MySQL DB, with the connection "+
+		"parameters of the environment, instead of the DB of the configuration file")
+	flags.Parse(args)
+
+	var dbConfig *db.Configuration
+	switch {
+	case *dbName != "" && flags.NArg() == 0:
+		dbConfig = db.NewConfig(
+			mysql.WithDefaults(),
+			mysql.WithEnvironment(),
+			mysql.WithLocalSocket("/var/run/mysqld/mysqld.sock"),
+			db.WithDB(*dbName),
+		)
+	case *dbName == "" && flags.NArg() == 1:
+		conf, err := config.ReadConfigFromFile(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		dbConfig = conf.DBConfig
+	default:
+		flags.Usage()
+		return fmt.Errorf("either a configuration file or -dbname is needed")
+	}
+	if dbConfig.Backend == db.BackendEmbedded {
+		fmt.Println("the embedded backend has no schema to migrate")
+		return nil
+	}
+
+	ctx := context.Background()
+	conn, err := mysql.Connect(dbConfig)
+	if err != nil {
+		return fmt.Errorf("error connecting to the DB: %w", err)
+	}
+	defer conn.Close()
+
+	current, err := mysql.SchemaVersion(ctx, conn.DB())
+	if err != nil {
+		return err
+	}
+	if *status {
+		migrations, err := mysql.Migrations()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("schema version %d, latest %d\n", current, len(migrations))
+		for _, m := range migrations[min(current, len(migrations)):] {
+			fmt.Printf("pending migration %d_%s\n", m.Version, m.Name)
+		}
+		return nil
+	}
+
+	applied, err := mysql.Migrate(ctx, conn.DB(), *to)
+	for _, m := range applied {
+		fmt.Printf("applied migration %d_%s\n", m.Version, m.Name)
+	}
+	if err != nil {
+		return err
+	}
+	if len(applied) > 0 {
+		current = applied[len(applied)-1].Version
+	}
+	fmt.Printf("schema version %d\n", current)
+	return nil
+}
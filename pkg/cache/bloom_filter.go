@@ -0,0 +1,253 @@
+package cache
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+)
+
+// bloomFilterMagic identifies the files of a BloomFilter, and the version of their layout.
+const bloomFilterMagic = "FPKIBLM1"
+
+// bloomFilterHeaderSize is the size of the header of the file, before the bits of the filter.
+// The header holds the magic, the capacity, the number of bits and hash functions, the count
+// of IDs added and the tag, and is padded so that the bits are aligned to 64 bit words.
+const bloomFilterHeaderSize = 64
+
+// BloomFilter is a persistent Bloom filter of IDs, memory mapped from its file.
+// Contains may return true for IDs never added, with the false positive rate the filter was
+// created with, as long as it holds at most its capacity. It never returns false for an added
+// ID. The IDs are SHA256 hashes, thus their bytes are used as the hashes of the filter.
+// A BloomFilter can be used concurrently, and only one process can open its file at a time.
+type BloomFilter struct {
+	file     *os.File
+	data     []byte   // The header and bits, mapped from the file.
+	words    []uint64 // The bits of the filter, within data.
+	capacity uint64
+	bits     uint64
+	hashes   uint64
+	count    atomic.Uint64 // IDs added that were not contained yet.
+	readOnly bool
+	unmap    func() error
+	sync     func() error
+}
+
+var _ Cache = (*BloomFilter)(nil)
+
+// OpenBloomFilter opens the filter stored in the file, or creates it sized for capacity IDs
+// with the false positive rate fpRate if the file does not exist. An existing filter keeps the
+// size it was created with.
+func OpenBloomFilter(filename string, capacity uint64, fpRate float64) (*BloomFilter, error) {
+	f, err := os.OpenFile(filename, os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return CreateBloomFilter(filename, capacity, fpRate)
+	}
+	if err != nil {
+		return nil, err
+	}
+	filter, err := mapBloomFilter(f, true)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("opening bloom filter %s: %w", filename, err)
+	}
+	return filter, nil
+}
+
+// OpenBloomFilterReadOnly opens the filter stored in the file without modifying it. IDs cannot
+// be added to it, nor its tag set. Several processes can open the same file read-only, but not
+// while it is opened to be modified.
+func OpenBloomFilterReadOnly(filename string) (*BloomFilter, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := mapBloomFilter(f, false)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("opening bloom filter %s: %w", filename, err)
+	}
+	return filter, nil
+}
+
+// CreateBloomFilter creates an empty filter in the file, replacing it if it exists, sized for
+// capacity IDs with the false positive rate fpRate.
+func CreateBloomFilter(filename string, capacity uint64, fpRate float64) (*BloomFilter, error) {
+	if capacity == 0 || fpRate <= 0 || fpRate >= 1 {
+		return nil, fmt.Errorf("invalid bloom filter capacity %d or false positive rate %g",
+			capacity, fpRate)
+	}
+	bits, hashes := bloomFilterSize(capacity, fpRate)
+
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, bloomFilterHeaderSize)
+	copy(header, bloomFilterMagic)
+	binary.LittleEndian.PutUint64(header[8:], capacity)
+	binary.LittleEndian.PutUint64(header[16:], bits)
+	binary.LittleEndian.PutUint64(header[24:], hashes)
+	if _, err := f.Write(header); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("creating bloom filter %s: %w", filename, err)
+	}
+	// The bits are all zero: extend the file without writing them.
+	if err := f.Truncate(int64(bloomFilterHeaderSize + bits/8)); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("creating bloom filter %s: %w", filename, err)
+	}
+	filter, err := mapBloomFilter(f, true)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("creating bloom filter %s: %w", filename, err)
+	}
+	return filter, nil
+}
+
+// bloomFilterSize returns the number of bits, a multiple of 64, and of hash functions of the
+// optimal filter for capacity IDs and the false positive rate.
+func bloomFilterSize(capacity uint64, fpRate float64) (uint64, uint64) {
+	n := float64(capacity)
+	bits := uint64(math.Ceil(-n * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	bits = (bits + 63) / 64 * 64
+	hashes := uint64(math.Round(float64(bits) / n * math.Ln2))
+	return bits, max(hashes, 1)
+}
+
+// mapBloomFilter maps the filter stored in the file, and checks its header.
+func mapBloomFilter(f *os.File, writable bool) (*BloomFilter, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < bloomFilterHeaderSize {
+		return nil, fmt.Errorf("file too short (%d bytes)", info.Size())
+	}
+	data, unmap, sync, err := mapFile(f, int(info.Size()), writable)
+	if err != nil {
+		return nil, err
+	}
+	filter := &BloomFilter{
+		file:     f,
+		data:     data,
+		capacity: binary.LittleEndian.Uint64(data[8:]),
+		bits:     binary.LittleEndian.Uint64(data[16:]),
+		hashes:   binary.LittleEndian.Uint64(data[24:]),
+		readOnly: !writable,
+		unmap:    unmap,
+		sync:     sync,
+	}
+	filter.count.Store(binary.LittleEndian.Uint64(data[32:]))
+	switch {
+	case string(data[:8]) != bloomFilterMagic:
+		err = fmt.Errorf("not a bloom filter file")
+	case filter.bits == 0 || filter.bits%64 != 0 || filter.hashes == 0:
+		err = fmt.Errorf("corrupt header with %d bits and %d hashes", filter.bits, filter.hashes)
+	case uint64(len(data)) != bloomFilterHeaderSize+filter.bits/8:
+		err = fmt.Errorf("file of %d bytes for %d bits", len(data), filter.bits)
+	}
+	if err != nil {
+		unmap()
+		return nil, err
+	}
+	filter.words = unsafe.Slice(
+		(*uint64)(unsafe.Pointer(&data[bloomFilterHeaderSize])), filter.bits/64)
+	return filter, nil
+}
+
+// Contains returns true if the ID was added to the filter, or, with its false positive rate,
+// if it was not.
+func (f *BloomFilter) Contains(id *common.SHA256Output) bool {
+	h1, h2 := bloomFilterHashes(id)
+	for i := uint64(0); i < f.hashes; i++ {
+		bit := (h1 + i*h2) % f.bits
+		if atomic.LoadUint64(&f.words[bit/64])&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// AddIDs adds the IDs to the filter. They are persisted once the filter is synced or closed.
+func (f *BloomFilter) AddIDs(ids ...*common.SHA256Output) {
+	if f.readOnly {
+		panic("adding IDs to a read-only bloom filter")
+	}
+	for _, id := range ids {
+		h1, h2 := bloomFilterHashes(id)
+		added := false
+		for i := uint64(0); i < f.hashes; i++ {
+			bit := (h1 + i*h2) % f.bits
+			mask := uint64(1) << (bit % 64)
+			if atomic.OrUint64(&f.words[bit/64], mask)&mask == 0 {
+				added = true
+			}
+		}
+		if added {
+			f.count.Add(1)
+		}
+	}
+}
+
+// bloomFilterHashes returns the two hashes from which the filter derives those of the ID, by
+// double hashing. The second one is odd, so that the bits of an ID are all different when the
+// number of bits of the filter is a power of two.
+func bloomFilterHashes(id *common.SHA256Output) (uint64, uint64) {
+	return binary.LittleEndian.Uint64(id[:8]), binary.LittleEndian.Uint64(id[8:16]) | 1
+}
+
+// Count returns the number of IDs added to the filter. IDs found in the filter when added, i.e.
+// added twice or false positives, are not counted.
+func (f *BloomFilter) Count() uint64 {
+	return f.count.Load()
+}
+
+// Tag returns the tag of the filter, zero until set.
+func (f *BloomFilter) Tag() [16]byte {
+	return [16]byte(f.data[40:56])
+}
+
+// SetTag sets the tag of the filter: an opaque value stored with it, e.g. to identify the set
+// its IDs were taken from. It is persisted once the filter is synced or closed.
+func (f *BloomFilter) SetTag(tag [16]byte) {
+	if f.readOnly {
+		panic("setting the tag of a read-only bloom filter")
+	}
+	copy(f.data[40:56], tag[:])
+}
+
+// Capacity returns the number of IDs the filter was sized for. Beyond it, the false positive
+// rate increases above the one the filter was created with.
+func (f *BloomFilter) Capacity() uint64 {
+	return f.capacity
+}
+
+// Sync writes the IDs added to the filter to its file. It does nothing if read-only.
+func (f *BloomFilter) Sync() error {
+	if f.readOnly {
+		return nil
+	}
+	binary.LittleEndian.PutUint64(f.data[32:], f.count.Load())
+	if err := f.sync(); err != nil {
+		return fmt.Errorf("syncing bloom filter %s: %w", f.file.Name(), err)
+	}
+	return nil
+}
+
+// Close syncs and closes the filter, which cannot be used anymore.
+func (f *BloomFilter) Close() error {
+	err := f.Sync()
+	if uerr := f.unmap(); err == nil {
+		err = uerr
+	}
+	if cerr := f.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
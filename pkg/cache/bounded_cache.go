@@ -0,0 +1,219 @@
+package cache
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"sync"
+	"sync/atomic"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/statistics"
+)
+
+const (
+	// boundedCacheShards is the maximum number of shards of a BoundedCache.
+	boundedCacheShards = 64
+	// boundedCacheEntryBytes bounds the memory used per entry: its ID and count, and at most
+	// 8/3 slots of 4 bytes in the hash table, which is at least 3/4 empty when full.
+	boundedCacheEntryBytes = common.SHA256Size + 4 + 11
+	// boundedCacheMaxCount is the maximum count of an entry, i.e. the number of sweeps of the
+	// clock hand that an entry hit often survives without being hit again.
+	boundedCacheMaxCount = 3
+)
+
+// BoundedCache is a cache of IDs that uses at most a memory budget in bytes, allocated when
+// created. It is split in shards by ID, each one with its own lock, that readers share.
+// When full, a shard evicts with a generalized clock: each entry has a count, incremented when
+// it is hit, up to boundedCacheMaxCount, and decremented when the clock hand sweeps over it,
+// which evicts the first entry with a zero count. The IDs added but never found again, e.g.
+// those of leaves, are thus evicted before those hit often, e.g. those of intermediates.
+// The hits and misses are counted per shard, and summed when read from the statistics; the
+// evictions are counted in the statistics.
+// A BoundedCache can be used concurrently.
+type BoundedCache struct {
+	shards []boundedShard
+	shift  uint // Of the hash of the ID, to obtain its shard.
+	stats  *statistics.Stats
+}
+
+var _ Cache = (*BoundedCache)(nil)
+
+// boundedShard holds up to cap(ids) entries, the IDs and their counts, indexed by a hash table
+// with linear probing.
+type boundedShard struct {
+	mu     sync.RWMutex
+	ids    []common.SHA256Output
+	counts []uint32 // Accessed atomically, as readers increment them.
+	slots  []uint32 // The index of the entry plus one, or zero if empty.
+	hand   int      // The next entry swept by the clock hand.
+
+	// Counted atomically by the readers, but only for this shard, not to contend with the
+	// readers of the others.
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+// NewBoundedCache creates a cache that uses at most budget bytes, counting its hits, misses and
+// evictions in the statistics, which may be nil.
+func NewBoundedCache(budget int64, stats *statistics.Stats) *BoundedCache {
+	if stats == nil {
+		stats = &statistics.Stats{}
+	}
+	entries := max(budget/boundedCacheEntryBytes, 1)
+	shards := min(uint64(boundedCacheShards), 1<<(bits.Len64(uint64(entries))-1))
+	c := &BoundedCache{
+		shards: make([]boundedShard, shards),
+		shift:  uint(64 - bits.TrailingZeros64(shards)),
+		stats:  stats,
+	}
+	perShard := int(uint64(entries) / shards)
+	for i := range c.shards {
+		c.shards[i].ids = make([]common.SHA256Output, 0, perShard)
+		c.shards[i].counts = make([]uint32, perShard)
+		// At most 3/4 of the slots are used.
+		c.shards[i].slots = make([]uint32, 1<<bits.Len(uint(perShard*4/3)))
+	}
+	stats.AddCacheLookups(c.Lookups)
+	return c
+}
+
+// Contains returns true if the ID is in the cache, and counts the hit.
+func (c *BoundedCache) Contains(id *common.SHA256Output) bool {
+	s := c.shard(id)
+	s.mu.RLock()
+	slot, ok := s.find(id)
+	if ok {
+		count := &s.counts[s.slots[slot]-1]
+		// Concurrent hits may be lost, which is harmless.
+		if n := atomic.LoadUint32(count); n < boundedCacheMaxCount {
+			atomic.StoreUint32(count, n+1)
+		}
+	}
+	s.mu.RUnlock()
+
+	if ok {
+		s.hits.Add(1)
+	} else {
+		s.misses.Add(1)
+	}
+	return ok
+}
+
+// Lookups returns the hits and misses of Contains, summed over the shards.
+func (c *BoundedCache) Lookups() (hits, misses int64) {
+	for i := range c.shards {
+		hits += c.shards[i].hits.Load()
+		misses += c.shards[i].misses.Load()
+	}
+	return hits, misses
+}
+
+// AddIDs adds the IDs to the cache, evicting others if their shard is full.
+func (c *BoundedCache) AddIDs(ids ...*common.SHA256Output) {
+	for _, id := range ids {
+		s := c.shard(id)
+		s.mu.Lock()
+		evicted := s.add(id)
+		s.mu.Unlock()
+		if evicted {
+			c.stats.CacheEvictions.Add(1)
+		}
+	}
+}
+
+// Len returns the number of IDs in the cache.
+func (c *BoundedCache) Len() int {
+	n := 0
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.mu.RLock()
+		n += len(s.ids)
+		s.mu.RUnlock()
+	}
+	return n
+}
+
+// Bytes returns the memory allocated by the cache for its entries, at most its budget.
+func (c *BoundedCache) Bytes() int64 {
+	var n int64
+	for i := range c.shards {
+		s := &c.shards[i]
+		n += int64(cap(s.ids))*common.SHA256Size + int64(len(s.counts)+len(s.slots))*4
+	}
+	return n
+}
+
+func (c *BoundedCache) shard(id *common.SHA256Output) *boundedShard {
+	// The IDs are SHA256 hashes: use other bytes than those of the slots of the shard.
+	return &c.shards[binary.LittleEndian.Uint64(id[8:16])>>c.shift&(uint64(len(c.shards))-1)]
+}
+
+// home returns the slot where the ID is first looked up.
+func (s *boundedShard) home(id *common.SHA256Output) uint64 {
+	return binary.LittleEndian.Uint64(id[:8]) & uint64(len(s.slots)-1)
+}
+
+// find returns the slot of the ID and true, or the empty slot where it would be inserted and
+// false.
+func (s *boundedShard) find(id *common.SHA256Output) (uint64, bool) {
+	mask := uint64(len(s.slots) - 1)
+	for slot := s.home(id); ; slot = (slot + 1) & mask {
+		i := s.slots[slot]
+		if i == 0 {
+			return slot, false
+		}
+		if s.ids[i-1] == *id {
+			return slot, true
+		}
+	}
+}
+
+// add adds the ID if not present, evicting the entry at the clock hand if the shard is full.
+// It returns true if an entry was evicted.
+func (s *boundedShard) add(id *common.SHA256Output) bool {
+	if cap(s.ids) == 0 {
+		return false
+	}
+	slot, ok := s.find(id)
+	if ok {
+		return false
+	}
+	if len(s.ids) < cap(s.ids) {
+		s.ids = append(s.ids, *id)
+		s.slots[slot] = uint32(len(s.ids))
+		return false
+	}
+
+	// Sweep until an entry not hit since the last sweep is found.
+	for {
+		count := atomic.LoadUint32(&s.counts[s.hand])
+		if count == 0 {
+			break
+		}
+		atomic.StoreUint32(&s.counts[s.hand], count-1)
+		s.hand = (s.hand + 1) % len(s.ids)
+	}
+	victim := s.hand
+	s.hand = (s.hand + 1) % len(s.ids)
+	old, _ := s.find(&s.ids[victim])
+	s.remove(old)
+	s.ids[victim] = *id
+	slot, _ = s.find(id)
+	s.slots[slot] = uint32(victim + 1)
+	return true
+}
+
+// remove empties the slot, shifting back the following ones of its probing sequence, so that
+// no lookup stops at the emptied slot before finding its ID.
+func (s *boundedShard) remove(slot uint64) {
+	mask := uint64(len(s.slots) - 1)
+	for next := (slot + 1) & mask; s.slots[next] != 0; next = (next + 1) & mask {
+		home := s.home(&s.ids[s.slots[next]-1])
+		// The entry at next can move back to slot if its home is not within (slot, next].
+		if (next-home)&mask >= (next-slot)&mask {
+			s.slots[slot] = s.slots[next]
+			slot = next
+		}
+	}
+	s.slots[slot] = 0
+}
@@ -1,9 +1,13 @@
 package cache
 
 import (
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 
 	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/netsec-ethz/fpki/pkg/statistics"
 	"github.com/netsec-ethz/fpki/pkg/tests/random"
 	"github.com/stretchr/testify/require"
 )
@@ -51,3 +55,146 @@ func TestLruCache(t *testing.T) {
 		require.Falsef(t, cache.Contains(id), "id at %d should not be contained in cache", i)
 	}
 }
+
+func TestBloomFilter(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "filter")
+	N := 1000
+	filter, err := OpenBloomFilter(filename, uint64(N), 1e-6)
+	require.NoError(t, err)
+	require.Equal(t, uint64(N), filter.Capacity())
+
+	ids := random.RandomIDPtrsForTest(t, N)
+	filter.AddIDs(ids...)
+	filter.AddIDs(ids[0]) // Already added.
+	for i, id := range ids {
+		require.Truef(t, filter.Contains(id), "id at %d should be contained in filter", i)
+	}
+	require.Equal(t, uint64(N), filter.Count())
+
+	// At full capacity, false positives are still rare.
+	falsePositives := 0
+	for _, id := range random.RandomIDPtrsForTest(t, 100*N) {
+		if filter.Contains(id) {
+			falsePositives++
+		}
+	}
+	require.LessOrEqual(t, falsePositives, 2)
+	require.Zero(t, filter.Tag())
+	tag := [16]byte{1, 2, 3}
+	filter.SetTag(tag)
+	require.NoError(t, filter.Close())
+
+	// The filter is persisted, with its own size regardless of the requested one.
+	filter, err = OpenBloomFilter(filename, 10, 0.1)
+	require.NoError(t, err)
+	require.Equal(t, uint64(N), filter.Capacity())
+	require.Equal(t, uint64(N), filter.Count())
+	require.Equal(t, tag, filter.Tag())
+	for i, id := range ids {
+		require.Truef(t, filter.Contains(id), "id at %d should be contained in filter", i)
+	}
+
+	// It cannot be opened read-only while opened to be modified.
+	_, err = OpenBloomFilterReadOnly(filename)
+	require.ErrorContains(t, err, "in use")
+	require.NoError(t, filter.Close())
+
+	// Opened read-only, several times, the file is not modified.
+	before, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	readOnly, err := OpenBloomFilterReadOnly(filename)
+	require.NoError(t, err)
+	readOnly2, err := OpenBloomFilterReadOnly(filename)
+	require.NoError(t, err)
+	require.Equal(t, uint64(N), readOnly.Count())
+	require.Equal(t, tag, readOnly.Tag())
+	for i, id := range ids {
+		require.Truef(t, readOnly.Contains(id), "id at %d should be contained in filter", i)
+	}
+	require.Panics(t, func() { readOnly.AddIDs(ids[0]) })
+	require.NoError(t, readOnly.Close())
+	require.NoError(t, readOnly2.Close())
+	after, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+	_, err = OpenBloomFilterReadOnly(filepath.Join(t.TempDir(), "missing"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	// Creating the filter again empties it.
+	filter, err = CreateBloomFilter(filename, uint64(N), 1e-6)
+	require.NoError(t, err)
+	require.Zero(t, filter.Count())
+	require.False(t, filter.Contains(ids[0]))
+	require.NoError(t, filter.Close())
+
+	_, err = CreateBloomFilter(filename, 0, 1e-6)
+	require.Error(t, err)
+
+	other := filepath.Join(t.TempDir(), "other")
+	require.NoError(t, os.WriteFile(other, make([]byte, 100), 0644))
+	_, err = OpenBloomFilter(other, uint64(N), 1e-6)
+	require.ErrorContains(t, err, "not a bloom filter")
+}
+
+func TestBoundedCache(t *testing.T) {
+	budget := int64(100_000)
+	stats := &statistics.Stats{}
+	cache := NewBoundedCache(budget, stats)
+	require.LessOrEqual(t, cache.Bytes(), budget)
+	capacity := int(budget / boundedCacheEntryBytes)
+
+	// The hot IDs are hit after each batch of cold ones, which are never hit.
+	hot := random.RandomIDPtrsForTest(t, capacity/10)
+	cache.AddIDs(hot...)
+	for range 10 {
+		for i, id := range hot {
+			require.Truef(t, cache.Contains(id), "hot id at %d should be contained in cache", i)
+		}
+		cold := random.RandomIDPtrsForTest(t, capacity/2)
+		cache.AddIDs(cold...)
+		cache.AddIDs(cold[0]) // Already added.
+	}
+	require.LessOrEqual(t, cache.Len(), capacity)
+	require.Greater(t, cache.Len(), capacity*9/10)
+	for i, id := range hot {
+		require.Truef(t, cache.Contains(id), "hot id at %d should be contained in cache", i)
+	}
+	for _, id := range random.RandomIDPtrsForTest(t, 10) {
+		require.False(t, cache.Contains(id))
+	}
+
+	hits, misses := stats.CacheLookups()
+	require.Equal(t, int64(11*len(hot)), hits)
+	require.Equal(t, int64(10), misses)
+	cacheHits, cacheMisses := cache.Lookups()
+	require.Equal(t, hits, cacheHits)
+	require.Equal(t, misses, cacheMisses)
+	added := len(hot) + 10*(capacity/2)
+	require.Equal(t, int64(added-cache.Len()), stats.CacheEvictions.Load())
+}
+
+func TestBoundedCacheConcurrent(t *testing.T) {
+	cache := NewBoundedCache(10_000, nil)
+	ids := random.RandomIDPtrsForTest(t, 1000)
+	wg := sync.WaitGroup{}
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j, id := range ids {
+				if j%8 == i {
+					cache.AddIDs(id)
+				}
+				cache.Contains(ids[(j*7)%len(ids)])
+			}
+		}()
+	}
+	wg.Wait()
+	require.LessOrEqual(t, cache.Len(), 10_000/boundedCacheEntryBytes)
+
+	// A tiny budget still holds one ID.
+	cache = NewBoundedCache(1, nil)
+	cache.AddIDs(ids[:2]...)
+	require.False(t, cache.Contains(ids[0]))
+	require.True(t, cache.Contains(ids[1]))
+}
@@ -0,0 +1,34 @@
+//go:build !unix
+
+package cache
+
+import (
+	"io"
+	"os"
+	"unsafe"
+)
+
+// mapFile reads the size bytes of the file in memory, as it cannot be mapped. The returned
+// function that writes the modified bytes to the file writes all of them, unless not writable.
+// Other processes opening the same file are not detected.
+func mapFile(f *os.File, size int, writable bool) ([]byte, func() error, func() error, error) {
+	// Allocate words, so that the bytes are aligned as when mapped.
+	words := make([]uint64, (size+7)/8)
+	data := unsafe.Slice((*byte)(unsafe.Pointer(&words[0])), size)
+	if _, err := io.ReadFull(io.NewSectionReader(f, 0, int64(size)), data); err != nil {
+		return nil, nil, nil, err
+	}
+	unmap := func() error {
+		return nil
+	}
+	sync := func() error {
+		if !writable {
+			return nil
+		}
+		if _, err := f.WriteAt(data, 0); err != nil {
+			return err
+		}
+		return f.Sync()
+	}
+	return data, unmap, sync, nil
+}
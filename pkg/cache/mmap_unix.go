@@ -0,0 +1,38 @@
+//go:build unix
+
+package cache
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// mapFile maps the size bytes of the file in memory, shared with the file, after taking an
+// exclusive lock on it so that no other process maps it. If not writable, the bytes are mapped
+// read-only after taking a shared lock, so that only other readers map it. It returns the
+// functions that unmap the file and that write the modified bytes to it.
+func mapFile(f *os.File, size int, writable bool) ([]byte, func() error, func() error, error) {
+	lock, prot := unix.LOCK_EX, unix.PROT_READ|unix.PROT_WRITE
+	if !writable {
+		lock, prot = unix.LOCK_SH, unix.PROT_READ
+	}
+	if err := unix.Flock(int(f.Fd()), lock|unix.LOCK_NB); err != nil {
+		return nil, nil, nil, fmt.Errorf("already in use by another process: %w", err)
+	}
+	data, err := unix.Mmap(int(f.Fd()), 0, size, prot, unix.MAP_SHARED)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	unmap := func() error {
+		return unix.Munmap(data)
+	}
+	sync := func() error {
+		if !writable {
+			return nil
+		}
+		return unix.Msync(data, unix.MS_SYNC)
+	}
+	return data, unmap, sync, nil
+}
@@ -304,6 +304,75 @@ func VerifyIssuerSignature(
 
 }
 
+// SignPolicyCertificateRevocationAsIssuer is like SignPolicyCertificateAsIssuer, but for a
+// revocation of a policy certificate. The revocation is passed with empty IssuerSignature and
+// IssuerHash, and is modified in place iif no error is found.
+func SignPolicyCertificateRevocationAsIssuer(
+	issuerPolCert *common.PolicyCertificate,
+	privKey *rsa.PrivateKey,
+	rev *common.PolicyCertificateRevocation,
+) error {
+
+	if rev.IssuerSignature != nil || rev.IssuerHash != nil {
+		return fmt.Errorf("remove any issuer signature or issuer hash before signing (set to nil)")
+	}
+	issuerHash, err := ComputeHashAsSigner(issuerPolCert)
+	if err != nil {
+		return err
+	}
+	rev.IssuerHash = issuerHash
+
+	signature, err := signStructRSASHA256(rev, privKey)
+	if err != nil {
+		rev.IssuerHash = nil
+		return err
+	}
+	rev.IssuerSignature = signature
+
+	return nil
+}
+
+// VerifyIssuerSignatureInRevocation is like VerifyIssuerSignature, but for a revocation of a
+// policy certificate.
+func VerifyIssuerSignatureInRevocation(
+	issuerPolCert *common.PolicyCertificate,
+	rev *common.PolicyCertificateRevocation,
+) error {
+
+	issuerHash, err := ComputeHashAsSigner(issuerPolCert)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(rev.IssuerHash, issuerHash) != 1 {
+		// Not equal.
+		return fmt.Errorf("revocation's issuer is identified by %s, but "+
+			"policy certificate is %s",
+			hex.EncodeToString(rev.IssuerHash), hex.EncodeToString(issuerHash))
+	}
+
+	pubKey, err := util.DERBytesToRSAPublic(issuerPolCert.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	// Serialize the revocation without signature.
+	sig := rev.IssuerSignature
+	rev.IssuerSignature = nil
+	serializedStruct, err := common.ToJSON(rev)
+	rev.IssuerSignature = sig // restore previous signature
+	if err != nil {
+		return err
+	}
+
+	hashOutput := common.SHA256Hash(serializedStruct)
+	err = rsa.VerifyPKCS1v15(pubKey, crypto.SHA256, hashOutput, rev.IssuerSignature)
+	if err != nil {
+		return fmt.Errorf("bad issuer signature: %w", err)
+	}
+
+	return nil
+}
+
 // signStructRSASHA256: generate a signature using SHA256 and RSA
 func signStructRSASHA256(s any, key *rsa.PrivateKey) ([]byte, error) {
 	data, err := common.ToJSON(s)
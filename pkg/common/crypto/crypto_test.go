@@ -265,6 +265,41 @@ func TestSignRequestAsIssuer(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestSignPolicyCertificateRevocationAsIssuer(t *testing.T) {
+	random.Seed(14)
+
+	// Load issuer policy cert and key.
+	issuerCert, err := util.PolicyCertificateFromFile("../../../tests/testdata/issuer_cert.json")
+	require.NoError(t, err)
+	issuerKey, err := util.RSAKeyFromPEMFile("../../../tests/testdata/issuer_key.pem")
+	require.NoError(t, err)
+
+	rev := random.RandomPolicyCertificateRevocation(t)
+	err = crypto.SignPolicyCertificateRevocationAsIssuer(issuerCert, issuerKey, rev)
+	require.Error(t, err) // issuer signature and hash not nil
+	rev.IssuerSignature = nil
+	rev.IssuerHash = nil
+	err = crypto.SignPolicyCertificateRevocationAsIssuer(issuerCert, issuerKey, rev)
+	require.NoError(t, err)
+
+	issuerHash, err := crypto.ComputeHashAsSigner(issuerCert)
+	require.NoError(t, err)
+	require.Equal(t, issuerHash, rev.IssuerHash)
+	err = crypto.VerifyIssuerSignatureInRevocation(issuerCert, rev)
+	require.NoError(t, err)
+
+	// A modified revocation doesn't verify.
+	rev.SerialNumberField++
+	err = crypto.VerifyIssuerSignatureInRevocation(issuerCert, rev)
+	require.Error(t, err)
+	rev.SerialNumberField--
+
+	// Nor does one verified with another issuer.
+	otherCert, _ := randomPolCertAndKey(t)
+	err = crypto.VerifyIssuerSignatureInRevocation(otherCert, rev)
+	require.Error(t, err)
+}
+
 func randomPolCertAndKey(t tests.T) (*common.PolicyCertificate, *rsa.PrivateKey) {
 	cert := random.RandomPolicyCertificate(t)
 	key := random.RandomRSAPrivateKey(t)
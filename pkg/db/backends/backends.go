@@ -0,0 +1,33 @@
+// Package backends opens a db.Conn with the storage backend selected by the configuration.
+package backends
+
+import (
+	"fmt"
+
+	"github.com/netsec-ethz/fpki/pkg/db"
+	"github.com/netsec-ethz/fpki/pkg/db/embedded"
+	"github.com/netsec-ethz/fpki/pkg/db/mysql"
+)
+
+// Connect opens a connection to the backend of config.Backend, MySQL if empty.
+func Connect(config *db.Configuration) (db.Conn, error) {
+	if config == nil {
+		return nil, fmt.Errorf("nil config not allowed")
+	}
+	switch config.Backend {
+	case "", db.BackendMySQL:
+		conn, err := mysql.Connect(config)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	case db.BackendEmbedded:
+		conn, err := embedded.Connect(config)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	default:
+		return nil, fmt.Errorf("unknown DB backend %q", config.Backend)
+	}
+}
@@ -2,12 +2,20 @@ package db
 
 const KeyDBName = "DBNAME"
 
+// Storage backends that implement Conn.
+const (
+	BackendMySQL    = "mysql"
+	BackendEmbedded = "embedded"
+)
+
 // Configuration for the db connection
 type Configuration struct {
+	Backend     string // one of the Backend* values; empty means BackendMySQL
 	Dsn         string
 	DBName      string
 	Values      map[string]string
-	CheckSchema bool // indicates if opening the connection checks the health of the schema
+	CheckSchema bool   // indicates if opening the connection checks the health of the schema
+	Dir         string // directory holding the files of the embedded backend
 }
 
 type ConfigurationModFunction func(*Configuration) *Configuration
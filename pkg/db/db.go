@@ -2,9 +2,12 @@ package db
 
 import (
 	"context"
-	"database/sql"
+	"errors"
+	"io"
 	"time"
 
+	ct "github.com/google/certificate-transparency-go"
+
 	"github.com/netsec-ethz/fpki/pkg/common"
 )
 
@@ -23,6 +26,123 @@ type DomainEntryRecord struct {
 	Payload  []byte
 }
 
+// PayloadRecord stores one row of the certs or policies table.
+// ParentID is nil for root certificates and policies without parent. Entry is only set for the
+// leaf certificates whose CT log entry is known.
+type PayloadRecord struct {
+	ID         common.SHA256Output
+	ParentID   *common.SHA256Output
+	Expiration time.Time
+	Payload    []byte
+	Entry      *CertificateEntry
+}
+
+// DomainRecord stores one row of the domains table.
+type DomainRecord struct {
+	DomainID   common.SHA256Output
+	DomainName string
+}
+
+// DomainAssociation stores one row of the domain_certs or domain_policies table: ID is the
+// certificate or policy ID associated with the domain.
+type DomainAssociation struct {
+	DomainID common.SHA256Output
+	ID       common.SHA256Output
+}
+
+// ParentRecord links a certificate or policy to its parent. ParentID is nil if it has none.
+type ParentRecord struct {
+	ID       common.SHA256Output
+	ParentID *common.SHA256Output
+}
+
+// CertificateEntry describes the CT log entry of a leaf certificate, and is stored with it in
+// the certs table. TBSID is the ID that a precertificate shares with its final certificate,
+// see util.CertificateTBSID. IssuerKeyHash is only set for precertificates whose issuer was
+// known when they were ingested, see util.PrecertIssuerKeyHash.
+type CertificateEntry struct {
+	Type          ct.LogEntryType
+	TBSID         common.SHA256Output
+	IssuerKeyHash *common.SHA256Output
+}
+
+// Epoch describes one update of the map: its sequence number, the root after the update, and
+// the largest row ID of the tree table when the epoch was recorded.
+type Epoch struct {
+	Number uint64
+	Root   common.SHA256Output
+	TreeID uint64
+}
+
+// Identity is a random value created with a DB, which tells it apart from other DBs, and from
+// itself before its tables were truncated. The files that describe the contents of a DB, e.g.
+// the certificate filter of cmd/ingest, store it to detect that they belong to another DB.
+type Identity [16]byte
+
+// TableCounts holds the number of rows of the main tables of the DB.
+type TableCounts struct {
+	Certs          uint64
+	Policies       uint64
+	Domains        uint64
+	DomainCerts    uint64
+	DomainPolicies uint64
+	Dirty          uint64
+	TreeNodes      uint64
+	Epochs         uint64
+}
+
+// IngestJob is a distributed ingestion: a work queue of batches of bundle files, ingested by
+// any number of workers, and finalized once by one of them after all batches are done.
+type IngestJob struct {
+	Name string
+	// Strategy is the ingest strategy of the job, which decides what its finalization does.
+	Strategy string
+	// Finalizer is the worker holding, or that last held, the lease of the finalization.
+	Finalizer   string
+	LeaseExpiry time.Time
+	Finalized   bool
+}
+
+// IngestBatch is one batch of the work queue of an ingest job: bundle files ingested together,
+// covering the indices [Start,End] of the CT log identified by Key.
+type IngestBatch struct {
+	Job   string
+	ID    uint64 // position of the batch in the queue, starting at 1
+	Key   string
+	Start uint64
+	End   uint64
+	Files []string
+	// Worker is the worker holding, or that last held, the lease of the batch.
+	Worker      string
+	LeaseExpiry time.Time
+	Done        bool
+}
+
+// ErrIngestJobExists is returned when enqueuing an ingest job with the name of an existing one.
+var ErrIngestJobExists = errors.New("ingest job already exists")
+
+// ErrIngestLeaseLost is returned when renewing or completing a lease not held by the worker
+// anymore, e.g. because it expired and another worker claimed it.
+var ErrIngestLeaseLost = errors.New("ingest lease lost")
+
+// DomainSearch selects domains from the domains table. All non-empty criteria must match.
+// Results are sorted by the reversed domain name, which keeps subdomains of the same parent
+// domain next to each other.
+type DomainSearch struct {
+	// Suffix selects the subdomains of this domain, excluding the domain itself. E.g.
+	// "example.com" selects "www.example.com" and "a.b.example.com".
+	Suffix string
+	// Pattern selects the domains whose name matches it. The wildcard '*' matches any
+	// sequence of characters, including dots, and '?' matches exactly one character.
+	Pattern string
+	// After is the name of the last domain of the previous page. Only domains sorted after it
+	// are returned. Ignored when counting.
+	After string
+	// Limit is the maximum number of domains returned, zero meaning no limit.
+	// Ignored when counting.
+	Limit int
+}
+
 // DirtyDomainEntriesCursor tracks per-partition progress while retrieving dirty-domain
 // entries in bounded bundles.
 type DirtyDomainEntriesCursor struct {
@@ -52,6 +172,9 @@ type dirty interface {
 	// present in the `updates` table.
 	RetrieveDirtyDomains(ctx context.Context) ([]common.SHA256Output, error)
 
+	// CheckDomainsDirty returns, for each of the domain IDs, whether it is in the dirty table.
+	CheckDomainsDirty(ctx context.Context, ids []common.SHA256Output) ([]bool, error)
+
 	// InsertDomainsIntoDirty adds the domain IDs into the dirty table, to signal that these
 	// domains have not been fully processed yet.
 	InsertDomainsIntoDirty(ctx context.Context, ids []common.SHA256Output) error
@@ -59,6 +182,9 @@ type dirty interface {
 	// InsertCsvIntoDirty inserts all the domain IDs in the CSV file into the dirty table.
 	InsertCsvIntoDirty(ctx context.Context, filename string) error
 
+	// StreamCsvIntoDirty is like InsertCsvIntoDirty, with the CSV rows read from r.
+	StreamCsvIntoDirty(ctx context.Context, r io.Reader) error
+
 	// RecomputeDirtyDomainsCertAndPolicyIDs recomputes the aggregated certificate and policy
 	// payload identifiers for all dirty domains and stores them in the DB. The aggregated payload
 	// takes into account all policies and certificates needed for that domain, including e.g. the
@@ -74,22 +200,37 @@ type certs interface {
 	// InsertCsvIntoCerts inserts all the certificate fields into the certs table.
 	InsertCsvIntoCerts(ctx context.Context, filename string) error
 
+	// StreamCsvIntoCerts is like InsertCsvIntoCerts, with the CSV rows read from r.
+	StreamCsvIntoCerts(ctx context.Context, r io.Reader) error
+
 	// InsertCsvIntoDomainCerts inserts all the certificate-domain records into the domain_certs
 	// table.
 	InsertCsvIntoDomainCerts(ctx context.Context, filename string) error
 
+	// StreamCsvIntoDomainCerts is like InsertCsvIntoDomainCerts, with the CSV rows read from r.
+	StreamCsvIntoDomainCerts(ctx context.Context, r io.Reader) error
+
 	// CheckCertsExist returns a slice of true/false values. Each value indicates if
 	// the corresponding certificate identified by its ID is already present in the DB.
 	CheckCertsExist(ctx context.Context, ids []common.SHA256Output) ([]bool, error)
 
+	// UpdateCerts inserts the certificates, keeping the existing ones. The entries of the
+	// leaves are stored with them: entries is nil, or holds nil for the certificates that are
+	// not leaves or whose entry is not known.
 	UpdateCerts(
 		ctx context.Context,
 		ids []common.SHA256Output,
 		parents []*common.SHA256Output,
 		expirations []time.Time,
 		payloads [][]byte,
+		entries []*CertificateEntry,
 	) error
 
+	// UpdateCertificateEntries sets the entries of existing certificates. Missing certificates
+	// are skipped.
+	UpdateCertificateEntries(ctx context.Context, ids []common.SHA256Output,
+		entries []CertificateEntry) error
+
 	// UpdateDomainCerts updates the domain_certs table with new entries.
 	UpdateDomainCerts(ctx context.Context, domainIDs, certIDs []common.SHA256Output) error
 
@@ -102,6 +243,21 @@ type certs interface {
 	// by the passed ID.
 	RetrieveCertificatePayloads(ctx context.Context, IDs []common.SHA256Output) ([][]byte, error)
 
+	// RetrieveCertificateRecords returns the full certs table row for each of the certificates
+	// identified by the passed ID, in the same order. Missing certificates yield a nil record.
+	RetrieveCertificateRecords(ctx context.Context, IDs []common.SHA256Output,
+	) ([]*PayloadRecord, error)
+
+	// RetrieveCertificateParents returns the parent of each of the certificates identified by
+	// the passed ID. Missing certificates are skipped.
+	RetrieveCertificateParents(ctx context.Context, IDs []common.SHA256Output,
+	) ([]ParentRecord, error)
+
+	// RetrieveCertificateDomains returns the domains that reference the certificate in the
+	// domain_certs table. Domains without an entry in the domains table have an empty name.
+	RetrieveCertificateDomains(ctx context.Context, certID common.SHA256Output,
+	) ([]DomainRecord, error)
+
 	// LastCTlogServerState returns the last state of the CT log server written into the DB.
 	// The url specifies the CT log server from which this data comes from.
 	LastCTlogServerState(ctx context.Context, url string) (size int64, sth []byte, err error)
@@ -137,11 +293,151 @@ type policies interface {
 	// RetrievePolicyPayloads returns the payload for each of the policies identified
 	// by the passed ID.
 	RetrievePolicyPayloads(ctx context.Context, IDs []common.SHA256Output) ([][]byte, error)
+
+	// RetrievePolicyRecords returns the full policies table row for each of the policies
+	// identified by the passed ID, in the same order. Missing policies yield a nil record.
+	RetrievePolicyRecords(ctx context.Context, IDs []common.SHA256Output,
+	) ([]*PayloadRecord, error)
+
+	// RetrievePolicyParents returns the parent of each of the policies identified by the
+	// passed ID. Missing policies are skipped.
+	RetrievePolicyParents(ctx context.Context, IDs []common.SHA256Output,
+	) ([]ParentRecord, error)
+
+	// RetrievePolicyDomains returns the domains that reference the policy in the
+	// domain_policies table. Domains without an entry in the domains table have an empty name.
+	RetrievePolicyDomains(ctx context.Context, policyID common.SHA256Output,
+	) ([]DomainRecord, error)
 }
 
 type certsAndPolicies interface {
 	// RetrieveCertificateOrPolicyPayloads returns the payloads for each identifier regardless whether it is a certificate or a policy
 	RetrieveCertificateOrPolicyPayloads(ctx context.Context, IDs []common.SHA256Output) ([][]byte, error)
+
+	// RetrieveDomainAssociations returns the rows of the domain_certs and domain_policies
+	// tables for the domains.
+	RetrieveDomainAssociations(ctx context.Context, domainIDs []common.SHA256Output,
+	) (certs []DomainAssociation, policies []DomainAssociation, err error)
+
+	// ReplaceDomainAssociations removes all rows of the domain_certs and domain_policies tables
+	// for the domains, and inserts the passed ones instead.
+	ReplaceDomainAssociations(
+		ctx context.Context,
+		domainIDs []common.SHA256Output,
+		certs []DomainAssociation,
+		policies []DomainAssociation,
+	) error
+}
+
+// epochs keeps track of the updates of the map, so that they can be replicated.
+type epochs interface {
+	// RecordEpoch stores a new epoch with the current root, and associates all the domains in
+	// the dirty table with it. It must be called after saving the new root and before
+	// cleaning up the dirty table.
+	RecordEpoch(ctx context.Context) (*Epoch, error)
+
+	// SaveEpoch stores an epoch obtained elsewhere, e.g. from a primary map server, and saves
+	// its root as the current one, in one transaction.
+	SaveEpoch(ctx context.Context, epoch *Epoch) error
+
+	// LastEpoch returns the latest epoch, or nil if there is none.
+	LastEpoch(ctx context.Context) (*Epoch, error)
+
+	// RetrieveEpoch returns the epoch with the given number, or nil if it does not exist.
+	RetrieveEpoch(ctx context.Context, number uint64) (*Epoch, error)
+
+	// RetrieveEpochDomainsPage returns at most limit sorted and distinct IDs of the domains
+	// modified by the epochs after `from` up to and including `to`, starting after the passed
+	// domain ID, or from the first one if nil.
+	RetrieveEpochDomainsPage(
+		ctx context.Context,
+		from, to uint64,
+		after *common.SHA256Output,
+		limit int,
+	) ([]common.SHA256Output, error)
+
+	// RetrieveTreeNodesPage returns at most limit SMT nodes of the tree table with a row ID
+	// after `after` up to and including `upTo`, sorted by row ID, and the row ID of the last
+	// node returned.
+	RetrieveTreeNodesPage(ctx context.Context, after, upTo uint64, limit int,
+	) ([]*TreeNodeRecord, uint64, error)
+}
+
+// IngestQueue is the work queue of the distributed ingestion. The leases expire after the
+// passed duration unless renewed, measured with the clock of the DB, so that the clocks of the
+// workers do not matter.
+type IngestQueue interface {
+	// EnqueueIngestJob creates the job with its batches, all pending. It returns
+	// ErrIngestJobExists if a job with the same name exists.
+	EnqueueIngestJob(ctx context.Context, job *IngestJob, batches []IngestBatch) error
+
+	// RetrieveIngestJob returns the job with its batches sorted by ID, or nil if it does not
+	// exist.
+	RetrieveIngestJob(ctx context.Context, name string) (*IngestJob, []IngestBatch, error)
+
+	// ClaimIngestBatch leases to the worker the first batch of the job that is not done and
+	// whose lease, if any, expired. It returns nil if there is none.
+	ClaimIngestBatch(ctx context.Context, job, worker string, lease time.Duration,
+	) (*IngestBatch, error)
+
+	// RenewIngestBatchLease extends the lease of the batch held by the worker. It returns
+	// ErrIngestLeaseLost if the batch is done or another worker claimed it since.
+	RenewIngestBatchLease(ctx context.Context, job string, id uint64, worker string,
+		lease time.Duration) error
+
+	// CompleteIngestBatch marks the batch held by the worker as done. It returns
+	// ErrIngestLeaseLost if the batch is already done or another worker claimed it since.
+	CompleteIngestBatch(ctx context.Context, job string, id uint64, worker string) error
+
+	// ClaimIngestFinalization leases the finalization of the job to the worker, if all its
+	// batches are done, it is not finalized and no other worker holds the lease. It returns
+	// false otherwise.
+	ClaimIngestFinalization(ctx context.Context, job, worker string, lease time.Duration,
+	) (bool, error)
+
+	// RenewIngestFinalizationLease extends the lease of the finalization held by the worker.
+	// It returns ErrIngestLeaseLost if the job is finalized or another worker claimed the
+	// finalization since.
+	RenewIngestFinalizationLease(ctx context.Context, job, worker string,
+		lease time.Duration) error
+
+	// CompleteIngestFinalization marks the job as finalized by the worker holding the lease of
+	// its finalization. It returns ErrIngestLeaseLost if the job is already finalized or
+	// another worker claimed the finalization since.
+	CompleteIngestFinalization(ctx context.Context, job, worker string) error
+}
+
+// tables allows iterating over the full contents of the tables, sorted by their primary key.
+// Each method returns at most limit rows sorted after the row passed as after, or from the
+// start of the table if after is nil. An empty result signals the end of the table.
+type tables interface {
+	// RetrieveDomainsPage returns rows of the domains table.
+	RetrieveDomainsPage(ctx context.Context, after *common.SHA256Output, limit int,
+	) ([]DomainRecord, error)
+
+	// RetrieveCertificatesPage returns rows of the certs table.
+	RetrieveCertificatesPage(ctx context.Context, after *common.SHA256Output, limit int,
+	) ([]*PayloadRecord, error)
+
+	// RetrievePoliciesPage returns rows of the policies table.
+	RetrievePoliciesPage(ctx context.Context, after *common.SHA256Output, limit int,
+	) ([]*PayloadRecord, error)
+
+	// RetrieveCertificateParentsPage returns the ID and parent ID of rows of the certs table.
+	RetrieveCertificateParentsPage(ctx context.Context, after *common.SHA256Output, limit int,
+	) ([]ParentRecord, error)
+
+	// RetrievePolicyParentsPage returns the ID and parent ID of rows of the policies table.
+	RetrievePolicyParentsPage(ctx context.Context, after *common.SHA256Output, limit int,
+	) ([]ParentRecord, error)
+
+	// RetrieveDomainCertsPage returns rows of the domain_certs table.
+	RetrieveDomainCertsPage(ctx context.Context, after *DomainAssociation, limit int,
+	) ([]DomainAssociation, error)
+
+	// RetrieveDomainPoliciesPage returns rows of the domain_policies table.
+	RetrieveDomainPoliciesPage(ctx context.Context, after *DomainAssociation, limit int,
+	) ([]DomainAssociation, error)
 }
 
 // Conn is a connection to operate with the DB.
@@ -151,18 +447,35 @@ type Conn interface {
 	certs
 	policies
 	certsAndPolicies
+	tables
+	epochs
+	IngestQueue
 
-	// TODO(juagargi) remove the temporary access to the sql.DB object
-	DB() *sql.DB
 	// Close closes the connection.
 	Close() error
 
-	// TruncateAllTables resets the DB to an initial state.
+	// CheckSchema returns an error if any of the tables used by the map server is missing.
+	CheckSchema(ctx context.Context) error
+
+	// CountRows returns the number of rows of the main tables.
+	CountRows(ctx context.Context) (*TableCounts, error)
+
+	// DisableRedoLog speeds up bulk ingestion by not journaling the writes, at the cost of
+	// losing the DB if the server crashes meanwhile. Backends without such a log ignore it.
+	DisableRedoLog(ctx context.Context) error
+
+	// TruncateAllTables resets the DB to an initial state, with a new identity.
 	TruncateAllTables(ctx context.Context) error
 
+	// Identity returns the identity of the DB.
+	Identity(ctx context.Context) (Identity, error)
+
 	// InsertCsvIntoDomains inserts all the domains in the CSV into the domains table.
 	InsertCsvIntoDomains(ctx context.Context, filename string) error
 
+	// StreamCsvIntoDomains is like InsertCsvIntoDomains, with the CSV rows read from r.
+	StreamCsvIntoDomains(ctx context.Context, r io.Reader) error
+
 	// UpdateDomains updates the domains table.
 	UpdateDomains(
 		ctx context.Context,
@@ -170,6 +483,16 @@ type Conn interface {
 		domainNames []string,
 	) error
 
+	// RetrieveDomains returns the rows of the domains table for the IDs, skipping missing ones.
+	RetrieveDomains(ctx context.Context, ids []common.SHA256Output) ([]DomainRecord, error)
+
+	// SearchDomains returns the domains from the domains table selected by the search.
+	SearchDomains(ctx context.Context, search DomainSearch) ([]DomainRecord, error)
+
+	// CountDomains returns the total number of domains selected by the search, regardless of
+	// its pagination.
+	CountDomains(ctx context.Context, search DomainSearch) (uint64, error)
+
 	// RetrieveDomainEntries retrieves domain-entry payloads for the specified domain IDs.
 	RetrieveDomainEntries(
 		ctx context.Context,
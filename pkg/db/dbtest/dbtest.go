@@ -0,0 +1,195 @@
+// Package dbtest contains a conformance test suite for the implementations of db.Conn.
+// Each backend runs it from its own tests:
+//
+//	func TestConformance(t *testing.T) {
+//		dbtest.Run(t, dbtest.Backend{New: newEmptyConn})
+//	}
+//
+// The suite only checks the behavior described by db.Conn, and that shared by all backends
+// where the interface leaves it open, e.g. how existing rows are treated on insertion.
+package dbtest
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/csv"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/db"
+)
+
+// Backend describes the backend under test.
+type Backend struct {
+	// New returns a connection to a new and empty DB. The suite closes it.
+	New func(t *testing.T) db.Conn
+	// CSVDir is the directory where the CSV files are written, which must be readable by the
+	// backend. If empty, a temporary directory of the test is used.
+	CSVDir string
+}
+
+// Run runs all the conformance tests as subtests of t, each one with a new DB.
+func Run(t *testing.T, b Backend) {
+	for _, test := range []struct {
+		name string
+		fn   func(*testing.T, *env)
+	}{
+		{"CSV", testCSV},
+		{"StreamCSV", testStreamCSV},
+		{"Certs", testCerts},
+		{"Policies", testPolicies},
+		{"Domains", testDomains},
+		{"Associations", testAssociations},
+		{"Coalesce", testCoalesce},
+		{"CoalescePrecerts", testCoalescePrecerts},
+		{"Prune", testPrune},
+		{"Dirty", testDirty},
+		{"DirtyBundle", testDirtyBundle},
+		{"CTLogState", testCTLogState},
+		{"SMT", testSMT},
+		{"Epochs", testEpochs},
+		{"IngestQueue", testIngestQueue},
+		{"Pages", testPages},
+		{"CountRows", testCountRows},
+		{"Truncate", testTruncate},
+		{"Identity", testIdentity},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancelF := context.WithTimeout(context.Background(), time.Minute)
+			defer cancelF()
+
+			conn := b.New(t)
+			defer func() {
+				require.NoError(t, conn.Close())
+			}()
+			csvDir := b.CSVDir
+			if csvDir == "" {
+				csvDir = t.TempDir()
+			}
+			test.fn(t, &env{ctx: ctx, conn: conn, csvDir: csvDir})
+		})
+	}
+}
+
+// env is what each conformance test gets.
+type env struct {
+	ctx    context.Context
+	conn   db.Conn
+	csvDir string
+}
+
+// writeCSV writes the rows into a new CSV file, as the ingestion does for the InsertCsvInto*
+// methods, and returns its name. The file is removed at the end of the test.
+func (e *env) writeCSV(t *testing.T, rows [][]string) string {
+	t.Helper()
+	f, err := os.CreateTemp(e.csvDir, "fpki-dbtest-*.csv")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.Remove(f.Name()) })
+
+	w := csv.NewWriter(f)
+	require.NoError(t, w.WriteAll(rows))
+	require.NoError(t, f.Close())
+	require.NoError(t, os.Chmod(f.Name(), 0644))
+	return filepath.Clean(f.Name())
+}
+
+// csvReader returns the rows in CSV format, as the ingestion streams them.
+func csvReader(t *testing.T, rows [][]string) io.Reader {
+	t.Helper()
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	require.NoError(t, w.WriteAll(rows))
+	return &buf
+}
+
+// updateCerts inserts the certificates with a payload equal to their ID.
+func (e *env) updateCerts(
+	t *testing.T,
+	expiration time.Time,
+	ids []common.SHA256Output,
+	parents []*common.SHA256Output,
+) {
+	t.Helper()
+	expirations := make([]time.Time, len(ids))
+	payloads := make([][]byte, len(ids))
+	for i := range ids {
+		expirations[i] = expiration
+		payloads[i] = ids[i][:]
+	}
+	require.NoError(t, e.conn.UpdateCerts(e.ctx, ids, parents, expirations, payloads, nil))
+}
+
+// updatePolicies inserts the policies with a payload equal to their ID.
+func (e *env) updatePolicies(
+	t *testing.T,
+	expiration time.Time,
+	ids []common.SHA256Output,
+	parents []*common.SHA256Output,
+) {
+	t.Helper()
+	expirations := make([]time.Time, len(ids))
+	payloads := make([][]byte, len(ids))
+	for i := range ids {
+		expirations[i] = expiration
+		payloads[i] = ids[i][:]
+	}
+	require.NoError(t, e.conn.UpdatePolicies(e.ctx, ids, parents, expirations, payloads))
+}
+
+// retrieveDirtyBundles retrieves all the dirty entries with bundles of the size.
+func (e *env) retrieveDirtyBundles(t *testing.T, size uint64) []db.DomainEntryRecord {
+	t.Helper()
+	var all []db.DomainEntryRecord
+	var cursor *db.DirtyDomainEntriesCursor
+	for i := 0; ; i++ {
+		require.Less(t, i, 10_000, "bundle retrieval does not finish")
+		entries, next, done, err := e.conn.RetrieveDomainEntriesDirtyBundle(e.ctx, cursor, size)
+		require.NoError(t, err)
+		require.LessOrEqual(t, uint64(len(entries)), size)
+		all = append(all, entries...)
+		if done {
+			return all
+		}
+		require.NotEmpty(t, entries, "no entries but not done")
+		cursor = next
+	}
+}
+
+// id returns an ID that starts with the bytes.
+func id(prefix ...byte) common.SHA256Output {
+	var id common.SHA256Output
+	copy(id[:], prefix)
+	return id
+}
+
+// ids returns the IDs starting with each one of the bytes.
+func ids(bytes ...byte) []common.SHA256Output {
+	ids := make([]common.SHA256Output, len(bytes))
+	for i, b := range bytes {
+		ids[i] = id(b)
+	}
+	return ids
+}
+
+func ptr(id common.SHA256Output) *common.SHA256Output {
+	return &id
+}
+
+func base64ID(id common.SHA256Output) string {
+	return base64.StdEncoding.EncodeToString(id[:])
+}
+
+// glue returns the IDs sorted and glued together, as in the domain payloads.
+func glue(ids ...common.SHA256Output) []byte {
+	return common.SortIDsAndGlue(ids)
+}
+
+// future is an expiration time not reached by any test, with the precision of the DB.
+var future = time.Date(2100, 1, 2, 3, 4, 5, 0, time.UTC)
@@ -0,0 +1,301 @@
+package dbtest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	ctx509 "github.com/google/certificate-transparency-go/x509"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/db"
+	"github.com/netsec-ethz/fpki/pkg/tests/random"
+	"github.com/netsec-ethz/fpki/pkg/util"
+)
+
+// testCoalesce checks the payloads of the dirty domains: the sorted IDs of their certificates
+// and policies, including the trust chains, and the hash of those IDs.
+func testCoalesce(t *testing.T, e *env) {
+	// The IDs are inserted in an order different from their sorted one.
+	c0, c1, leafA, leafB, missing := id(9), id(5), id(7), id(1), id(99)
+	p0, p1 := id(8), id(2)
+	a, b, c, gone := id(10), id(11), id(12), id(13)
+	e.updateCerts(t, future, []common.SHA256Output{c0, c1, leafA, leafB},
+		[]*common.SHA256Output{nil, &c0, &c1, &missing})
+	e.updatePolicies(t, future, []common.SHA256Output{p0, p1}, []*common.SHA256Output{nil, &p0})
+	err := e.conn.UpdateDomains(e.ctx, []common.SHA256Output{a, b, c, gone},
+		[]string{"a.com", "b.com", "c.com", "gone.com"})
+	require.NoError(t, err)
+	// a.com has leafA and leafB. b.com has leafB and the policy p1. c.com only the policy p1,
+	// and gone.com only a missing certificate.
+	err = e.conn.UpdateDomainCerts(e.ctx, []common.SHA256Output{a, a, b, gone},
+		[]common.SHA256Output{leafA, leafB, leafB, missing})
+	require.NoError(t, err)
+	err = e.conn.UpdateDomainPolicies(e.ctx, []common.SHA256Output{b, c},
+		[]common.SHA256Output{p1, p1})
+	require.NoError(t, err)
+	require.NoError(t, e.conn.InsertDomainsIntoDirty(e.ctx,
+		[]common.SHA256Output{a, b, c, gone}))
+	require.NoError(t, e.conn.RecomputeDirtyDomainsCertAndPolicyIDs(e.ctx))
+
+	certIDsA := glue(c0, c1, leafA, leafB)
+	require.True(t, bytes.Equal(certIDsA, glue(leafB, c1, leafA, c0)))
+	policyIDs := glue(p0, p1)
+	expected := map[common.SHA256Output]struct {
+		certIDs   []byte
+		policyIDs []byte
+	}{
+		a: {certIDs: certIDsA},
+		b: {certIDs: glue(leafB), policyIDs: policyIDs},
+		c: {policyIDs: policyIDs},
+	}
+	for domainID, exp := range expected {
+		certIDsID, certIDs, err := e.conn.RetrieveDomainCertificatesIDs(e.ctx, domainID)
+		require.NoError(t, err)
+		require.Equal(t, exp.certIDs, certIDs)
+		policyIDsID, policyIDs, err := e.conn.RetrieveDomainPoliciesIDs(e.ctx, domainID)
+		require.NoError(t, err)
+		require.Equal(t, exp.policyIDs, policyIDs)
+		if exp.certIDs == nil {
+			require.Equal(t, common.SHA256Output{}, certIDsID)
+		} else {
+			require.Equal(t, common.SHA256Hash32Bytes(exp.certIDs), certIDsID)
+		}
+		if exp.policyIDs == nil {
+			require.Equal(t, common.SHA256Output{}, policyIDsID)
+		} else {
+			require.Equal(t, common.SHA256Hash32Bytes(exp.policyIDs), policyIDsID)
+		}
+	}
+
+	// The entries of the domains glue the certificate and policy IDs, all sorted.
+	entries, err := e.conn.RetrieveDomainEntries(e.ctx, []common.SHA256Output{a, b, c, gone})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []db.DomainEntryRecord{
+		{DomainID: a, Payload: certIDsA},
+		{DomainID: b, Payload: glue(leafB, p0, p1)},
+		{DomainID: c, Payload: policyIDs},
+	}, entries)
+
+	// The domain without any existing certificate or policy is removed.
+	domains, err := e.conn.RetrieveDomains(e.ctx, []common.SHA256Output{a, b, c, gone})
+	require.NoError(t, err)
+	require.Len(t, domains, 3)
+	for _, d := range domains {
+		require.NotEqual(t, gone, d.DomainID)
+	}
+
+	// Coalescing again does not change anything until the domains are dirty again.
+	err = e.conn.UpdateDomainCerts(e.ctx, []common.SHA256Output{c}, []common.SHA256Output{c1})
+	require.NoError(t, err)
+	require.NoError(t, e.conn.RecomputeDirtyDomainsCertAndPolicyIDs(e.ctx))
+	_, certIDs, err := e.conn.RetrieveDomainCertificatesIDs(e.ctx, c)
+	require.NoError(t, err)
+	require.Nil(t, certIDs)
+	require.NoError(t, e.conn.InsertDomainsIntoDirty(e.ctx, []common.SHA256Output{c}))
+	require.NoError(t, e.conn.RecomputeDirtyDomainsCertAndPolicyIDs(e.ctx))
+	_, certIDs, err = e.conn.RetrieveDomainCertificatesIDs(e.ctx, c)
+	require.NoError(t, err)
+	require.Equal(t, glue(c0, c1), certIDs)
+}
+
+// testCoalescePrecerts checks that the payload of a domain does not have a precertificate if
+// it also has its final certificate.
+func testCoalescePrecerts(t *testing.T, e *env) {
+	issuer := random.RandomX509Cert(t, "issuer.com")
+	precert, final := random.RandomX509Precert(t, "a.com")
+	other := random.RandomX509Cert(t, "a.com")
+	issuerID := common.SHA256Hash32Bytes(issuer.Raw)
+	precertID := common.SHA256Hash32Bytes(precert.Raw)
+	finalID := common.SHA256Hash32Bytes(final.Raw)
+	otherID := common.SHA256Hash32Bytes(other.Raw)
+	a, b := id(10), id(11)
+	coalesce := func(domainIDs ...common.SHA256Output) {
+		require.NoError(t, e.conn.InsertDomainsIntoDirty(e.ctx, domainIDs))
+		require.NoError(t, e.conn.RecomputeDirtyDomainsCertAndPolicyIDs(e.ctx))
+	}
+
+	entry := func(cert *ctx509.Certificate) *db.CertificateEntry {
+		tbsID, err := util.CertificateTBSID(cert)
+		require.NoError(t, err)
+		return &db.CertificateEntry{Type: util.CertificateEntryType(cert), TBSID: tbsID}
+	}
+
+	// a.com has the precertificate and another certificate. b.com only the precertificate.
+	err := e.conn.UpdateCerts(e.ctx,
+		[]common.SHA256Output{issuerID, precertID, otherID},
+		[]*common.SHA256Output{nil, &issuerID, &issuerID},
+		[]time.Time{future, future, future},
+		[][]byte{issuer.Raw, precert.Raw, other.Raw},
+		[]*db.CertificateEntry{nil, entry(&precert), entry(&other)})
+	require.NoError(t, err)
+	err = e.conn.UpdateDomainCerts(e.ctx, []common.SHA256Output{a, a, b},
+		[]common.SHA256Output{precertID, otherID, precertID})
+	require.NoError(t, err)
+	coalesce(a, b)
+	_, certIDs, err := e.conn.RetrieveDomainCertificatesIDs(e.ctx, a)
+	require.NoError(t, err)
+	require.Equal(t, glue(issuerID, precertID, otherID), certIDs)
+
+	// The final certificate of a.com arrives, as the ingestion inserts it.
+	err = e.conn.StreamCsvIntoCerts(e.ctx, csvReader(t, [][]string{{
+		base64ID(finalID),
+		base64ID(issuerID),
+		future.Format(time.DateTime),
+		base64.StdEncoding.EncodeToString(final.Raw),
+		"0",
+		base64ID(entry(&final).TBSID),
+		"",
+	}}))
+	require.NoError(t, err)
+	err = e.conn.UpdateDomainCerts(e.ctx, []common.SHA256Output{a},
+		[]common.SHA256Output{finalID})
+	require.NoError(t, err)
+	coalesce(a, b)
+	_, certIDs, err = e.conn.RetrieveDomainCertificatesIDs(e.ctx, a)
+	require.NoError(t, err)
+	require.Equal(t, glue(issuerID, finalID, otherID), certIDs)
+	_, certIDs, err = e.conn.RetrieveDomainCertificatesIDs(e.ctx, b)
+	require.NoError(t, err)
+	require.Equal(t, glue(issuerID, precertID), certIDs)
+}
+
+// testPrune checks that pruning removes the expired certificates and their descendants, and
+// that the domains referencing them become dirty.
+func testPrune(t *testing.T, e *env) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	expired := now.Add(-time.Hour)
+	// a.com: a0 <- a1 <- aLeaf, nothing expires.
+	// b.com: b0 <- bLeaf, only the leaf expires.
+	// c.com: c0 <- c1 <- cLeaf, the root expires.
+	a0, a1, aLeaf := id(1), id(2), id(3)
+	b0, bLeaf := id(4), id(5)
+	c0, c1, cLeaf := id(6), id(7), id(8)
+	a, b, c, c1Domain := id(10), id(11), id(12), id(13)
+	e.updateCerts(t, future,
+		[]common.SHA256Output{a0, a1, aLeaf, b0, c1, cLeaf},
+		[]*common.SHA256Output{nil, &a0, &a1, nil, &c0, &c1})
+	e.updateCerts(t, expired, []common.SHA256Output{bLeaf, c0},
+		[]*common.SHA256Output{&b0, nil})
+	err := e.conn.UpdateDomainCerts(e.ctx,
+		[]common.SHA256Output{a, b, c, c1Domain},
+		[]common.SHA256Output{aLeaf, bLeaf, cLeaf, c1})
+	require.NoError(t, err)
+	require.NoError(t, e.conn.CleanupDirty(e.ctx))
+
+	// A certificate expiring at the same second as now is still valid.
+	e.updateCerts(t, now, []common.SHA256Output{id(20)}, []*common.SHA256Output{nil})
+	require.NoError(t, e.conn.PruneCerts(e.ctx, now))
+
+	exist, err := e.conn.CheckCertsExist(e.ctx,
+		[]common.SHA256Output{a0, a1, aLeaf, b0, bLeaf, c0, c1, cLeaf, id(20)})
+	require.NoError(t, err)
+	require.Equal(t, []bool{true, true, true, true, false, false, false, false, true}, exist)
+
+	dirty, err := e.conn.RetrieveDirtyDomains(e.ctx)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []common.SHA256Output{b, c, c1Domain}, dirty)
+}
+
+// testDirty checks the dirty table and the entries of the dirty domains.
+func testDirty(t *testing.T, e *env) {
+	count, err := e.conn.DirtyCount(e.ctx)
+	require.NoError(t, err)
+	require.Zero(t, count)
+
+	cert := id(1)
+	e.updateCerts(t, future, []common.SHA256Output{cert}, []*common.SHA256Output{nil})
+	err = e.conn.UpdateDomainCerts(e.ctx, []common.SHA256Output{id(10)}, []common.SHA256Output{cert})
+	require.NoError(t, err)
+	domainIDs := ids(30, 10, 20, 10)
+	require.NoError(t, e.conn.InsertDomainsIntoDirty(e.ctx, domainIDs))
+	require.NoError(t, e.conn.RecomputeDirtyDomainsCertAndPolicyIDs(e.ctx))
+
+	count, err = e.conn.DirtyCount(e.ctx)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), count)
+	dirty, err := e.conn.RetrieveDirtyDomains(e.ctx)
+	require.NoError(t, err)
+	require.ElementsMatch(t, ids(10, 20, 30), dirty)
+	present, err := e.conn.CheckDomainsDirty(e.ctx, ids(20, 40, 10))
+	require.NoError(t, err)
+	require.Equal(t, []bool{true, false, true}, present)
+
+	// Sorted by domain ID, with empty payloads for the domains without any.
+	entries, err := e.conn.RetrieveDomainEntriesDirtyOnes(e.ctx, 0, 2)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []db.DomainEntryRecord{
+		{DomainID: id(10), Payload: glue(cert)},
+		{DomainID: id(20), Payload: []byte{}},
+	}, entries)
+	entries, err = e.conn.RetrieveDomainEntriesDirtyOnes(e.ctx, 2, 10)
+	require.NoError(t, err)
+	require.Equal(t, []db.DomainEntryRecord{{DomainID: id(30), Payload: []byte{}}}, entries)
+
+	require.NoError(t, e.conn.CleanupDirty(e.ctx))
+	count, err = e.conn.DirtyCount(e.ctx)
+	require.NoError(t, err)
+	require.Zero(t, count)
+}
+
+// testDirtyBundle checks that bundles of dirty entries, spread over several partitions, return
+// each dirty domain exactly once.
+func testDirtyBundle(t *testing.T, e *env) {
+	_, _, _, err := e.conn.RetrieveDomainEntriesDirtyBundle(e.ctx, nil, 0)
+	require.Error(t, err)
+
+	// Empty dirty table.
+	require.Empty(t, e.retrieveDirtyBundles(t, 3))
+
+	// The partition of a domain is given by the 5 most significant bits of its ID.
+	cert := id(1)
+	e.updateCerts(t, future, []common.SHA256Output{cert}, []*common.SHA256Output{nil})
+	var domainIDs []common.SHA256Output
+	for _, p := range []struct {
+		partition byte
+		count     byte
+	}{
+		{0, 5},
+		{3, 1},
+		{17, 4},
+		{31, 2},
+	} {
+		for i := range p.count {
+			domainIDs = append(domainIDs, id(p.partition<<3, i+1))
+		}
+	}
+	// Only some domains have a payload.
+	var withPayload, certs []common.SHA256Output
+	for i := 0; i < len(domainIDs); i += 2 {
+		withPayload = append(withPayload, domainIDs[i])
+		certs = append(certs, cert)
+	}
+	require.NoError(t, e.conn.UpdateDomainCerts(e.ctx, withPayload, certs))
+	require.NoError(t, e.conn.InsertDomainsIntoDirty(e.ctx, withPayload))
+	require.NoError(t, e.conn.RecomputeDirtyDomainsCertAndPolicyIDs(e.ctx))
+	require.NoError(t, e.conn.InsertDomainsIntoDirty(e.ctx, domainIDs))
+
+	expected := make([]db.DomainEntryRecord, len(domainIDs))
+	for i, domainID := range domainIDs {
+		expected[i].DomainID = domainID
+		if i%2 == 0 {
+			expected[i].Payload = glue(cert)
+		}
+	}
+	for _, size := range []uint64{1, 2, 3, 5, 100} {
+		entries := e.retrieveDirtyBundles(t, size)
+		require.ElementsMatch(t, expected, entries, "bundle size %d", size)
+
+		// Within each partition, the domains are sorted.
+		last := make(map[byte]common.SHA256Output)
+		for _, entry := range entries {
+			partition := entry.DomainID[0] >> 3
+			if prev, ok := last[partition]; ok {
+				require.Less(t, bytes.Compare(prev[:], entry.DomainID[:]), 0)
+			}
+			last[partition] = entry.DomainID
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package dbtest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/netsec-ethz/fpki/pkg/db"
+)
+
+func testIngestQueue(t *testing.T, e *env) {
+	const name = "job"
+	job, _, err := e.conn.RetrieveIngestJob(e.ctx, name)
+	require.NoError(t, err)
+	require.Nil(t, job)
+	batch, err := e.conn.ClaimIngestBatch(e.ctx, name, "a", time.Minute)
+	require.NoError(t, err)
+	require.Nil(t, batch)
+
+	batches := []db.IngestBatch{
+		{ID: 1, Key: "log", Start: 0, End: 9, Files: []string{"/d/0-4.gz", "/d/5-9.gz"}},
+		{ID: 2, Key: "log", Start: 20, End: 29, Files: []string{"/d/20-29.gz"}},
+	}
+	require.NoError(t, e.conn.EnqueueIngestJob(e.ctx, &db.IngestJob{Name: name, Strategy: "s"},
+		batches))
+	err = e.conn.EnqueueIngestJob(e.ctx, &db.IngestJob{Name: name}, nil)
+	require.ErrorIs(t, err, db.ErrIngestJobExists)
+
+	job, stored, err := e.conn.RetrieveIngestJob(e.ctx, name)
+	require.NoError(t, err)
+	require.Equal(t, &db.IngestJob{Name: name, Strategy: "s"}, job)
+	require.Len(t, stored, 2)
+	for i, b := range stored {
+		require.Equal(t, name, b.Job)
+		require.Equal(t, batches[i].Files, b.Files)
+		require.Equal(t, batches[i].Start, b.Start)
+		require.Equal(t, batches[i].End, b.End)
+		require.Empty(t, b.Worker)
+		require.False(t, b.Done)
+	}
+
+	// The batches are claimed in order, each one by one worker.
+	first, err := e.conn.ClaimIngestBatch(e.ctx, name, "a", time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), first.ID)
+	require.Equal(t, "a", first.Worker)
+	require.Equal(t, batches[0].Files, first.Files)
+	second, err := e.conn.ClaimIngestBatch(e.ctx, name, "b", time.Millisecond)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), second.ID)
+	batch, err = e.conn.ClaimIngestBatch(e.ctx, name, "c", time.Minute)
+	require.NoError(t, err)
+	require.Nil(t, batch)
+	require.NoError(t, e.conn.RenewIngestBatchLease(e.ctx, name, 1, "a", time.Minute))
+	err = e.conn.RenewIngestBatchLease(e.ctx, name, 1, "b", time.Minute)
+	require.ErrorIs(t, err, db.ErrIngestLeaseLost)
+
+	// Nothing is finalized until all batches are done.
+	require.NoError(t, e.conn.CompleteIngestBatch(e.ctx, name, 1, "a"))
+	err = e.conn.CompleteIngestBatch(e.ctx, name, 1, "a")
+	require.ErrorIs(t, err, db.ErrIngestLeaseLost)
+	err = e.conn.RenewIngestBatchLease(e.ctx, name, 1, "a", time.Minute)
+	require.ErrorIs(t, err, db.ErrIngestLeaseLost)
+	claimed, err := e.conn.ClaimIngestFinalization(e.ctx, name, "a", time.Minute)
+	require.NoError(t, err)
+	require.False(t, claimed)
+
+	// The abandoned batch is claimed by another worker once its lease expires.
+	time.Sleep(10 * time.Millisecond)
+	batch, err = e.conn.ClaimIngestBatch(e.ctx, name, "c", time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), batch.ID)
+	require.Equal(t, "c", batch.Worker)
+	err = e.conn.RenewIngestBatchLease(e.ctx, name, 2, "b", time.Minute)
+	require.ErrorIs(t, err, db.ErrIngestLeaseLost)
+	err = e.conn.CompleteIngestBatch(e.ctx, name, 2, "b")
+	require.ErrorIs(t, err, db.ErrIngestLeaseLost)
+	require.NoError(t, e.conn.CompleteIngestBatch(e.ctx, name, 2, "c"))
+
+	_, stored, err = e.conn.RetrieveIngestJob(e.ctx, name)
+	require.NoError(t, err)
+	require.True(t, stored[0].Done)
+	require.True(t, stored[1].Done)
+	require.Equal(t, "c", stored[1].Worker)
+
+	// The finalization is leased like the batches.
+	claimed, err = e.conn.ClaimIngestFinalization(e.ctx, name, "a", time.Millisecond)
+	require.NoError(t, err)
+	require.True(t, claimed)
+	claimed, err = e.conn.ClaimIngestFinalization(e.ctx, name, "b", time.Minute)
+	require.NoError(t, err)
+	require.False(t, claimed)
+	time.Sleep(10 * time.Millisecond)
+	claimed, err = e.conn.ClaimIngestFinalization(e.ctx, name, "b", time.Minute)
+	require.NoError(t, err)
+	require.True(t, claimed)
+	err = e.conn.RenewIngestFinalizationLease(e.ctx, name, "a", time.Minute)
+	require.ErrorIs(t, err, db.ErrIngestLeaseLost)
+	require.NoError(t, e.conn.RenewIngestFinalizationLease(e.ctx, name, "b", time.Minute))
+	err = e.conn.CompleteIngestFinalization(e.ctx, name, "a")
+	require.ErrorIs(t, err, db.ErrIngestLeaseLost)
+	require.NoError(t, e.conn.CompleteIngestFinalization(e.ctx, name, "b"))
+
+	job, _, err = e.conn.RetrieveIngestJob(e.ctx, name)
+	require.NoError(t, err)
+	require.True(t, job.Finalized)
+	require.Equal(t, "b", job.Finalizer)
+	claimed, err = e.conn.ClaimIngestFinalization(e.ctx, name, "c", time.Minute)
+	require.NoError(t, err)
+	require.False(t, claimed)
+}
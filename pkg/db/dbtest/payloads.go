@@ -0,0 +1,369 @@
+package dbtest
+
+import (
+	"testing"
+	"time"
+
+	ct "github.com/google/certificate-transparency-go"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/db"
+)
+
+// testCSV checks the InsertCsvInto* methods with files written as the ingestion does.
+func testCSV(t *testing.T, e *env) {
+	root, leaf, domain, missing := id(1), id(2), id(10), id(99)
+	expiration := time.Date(2030, 5, 6, 7, 8, 9, 0, time.UTC)
+	certs := e.writeCSV(t, [][]string{
+		{base64ID(root), base64ID(missing), expiration.Format(time.DateTime), "cm9vdA==", "", "", ""},
+		{base64ID(leaf), base64ID(root), expiration.Format(time.DateTime), "bGVhZg==", "", "", ""},
+	})
+	require.NoError(t, e.conn.InsertCsvIntoCerts(e.ctx, certs))
+	// Existing certificates are kept.
+	again := e.writeCSV(t, [][]string{
+		{base64ID(leaf), base64ID(root), future.Format(time.DateTime), "b3RoZXI=", "", "", ""},
+	})
+	require.NoError(t, e.conn.InsertCsvIntoCerts(e.ctx, again))
+
+	records, err := e.conn.RetrieveCertificateRecords(e.ctx, []common.SHA256Output{leaf, root})
+	require.NoError(t, err)
+	require.Equal(t, []*db.PayloadRecord{
+		{ID: leaf, ParentID: &root, Expiration: expiration, Payload: []byte("leaf")},
+		{ID: root, ParentID: &missing, Expiration: expiration, Payload: []byte("root")},
+	}, records)
+
+	domains := e.writeCSV(t, [][]string{{base64ID(domain), "a.example.com"}})
+	require.NoError(t, e.conn.InsertCsvIntoDomains(e.ctx, domains))
+	gotDomains, err := e.conn.RetrieveDomains(e.ctx, []common.SHA256Output{domain})
+	require.NoError(t, err)
+	require.Equal(t, []db.DomainRecord{{DomainID: domain, DomainName: "a.example.com"}},
+		gotDomains)
+
+	domainCerts := e.writeCSV(t, [][]string{{base64ID(domain), base64ID(leaf)}})
+	require.NoError(t, e.conn.InsertCsvIntoDomainCerts(e.ctx, domainCerts))
+	assocs, err := e.conn.RetrieveDomainCertsPage(e.ctx, nil, 10)
+	require.NoError(t, err)
+	require.Equal(t, []db.DomainAssociation{{DomainID: domain, ID: leaf}}, assocs)
+
+	dirty := e.writeCSV(t, [][]string{{base64ID(domain)}, {base64ID(id(11))}})
+	require.NoError(t, e.conn.InsertCsvIntoDirty(e.ctx, dirty))
+	dirtyIDs, err := e.conn.RetrieveDirtyDomains(e.ctx)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []common.SHA256Output{domain, id(11)}, dirtyIDs)
+}
+
+// testStreamCSV checks the StreamCsvInto* methods with the same rows as the CSV files.
+func testStreamCSV(t *testing.T, e *env) {
+	root, leaf, domain, missing := id(1), id(2), id(10), id(99)
+	expiration := time.Date(2030, 5, 6, 7, 8, 9, 0, time.UTC)
+	certs := csvReader(t, [][]string{
+		{base64ID(root), base64ID(missing), expiration.Format(time.DateTime), "cm9vdA==", "", "", ""},
+		{base64ID(leaf), base64ID(root), expiration.Format(time.DateTime), "bGVhZg==",
+			"1", base64ID(id(20)), base64ID(id(21))},
+	})
+	require.NoError(t, e.conn.StreamCsvIntoCerts(e.ctx, certs))
+	// Existing certificates are kept.
+	again := csvReader(t, [][]string{
+		{base64ID(leaf), base64ID(root), future.Format(time.DateTime), "b3RoZXI=", "", "", ""},
+	})
+	require.NoError(t, e.conn.StreamCsvIntoCerts(e.ctx, again))
+
+	records, err := e.conn.RetrieveCertificateRecords(e.ctx, []common.SHA256Output{leaf, root})
+	require.NoError(t, err)
+	require.Equal(t, []*db.PayloadRecord{
+		{ID: leaf, ParentID: &root, Expiration: expiration, Payload: []byte("leaf"),
+			Entry: &db.CertificateEntry{
+				Type:          ct.PrecertLogEntryType,
+				TBSID:         id(20),
+				IssuerKeyHash: ptr(id(21)),
+			}},
+		{ID: root, ParentID: &missing, Expiration: expiration, Payload: []byte("root")},
+	}, records)
+
+	domains := csvReader(t, [][]string{{base64ID(domain), "a.example.com"}})
+	require.NoError(t, e.conn.StreamCsvIntoDomains(e.ctx, domains))
+	gotDomains, err := e.conn.RetrieveDomains(e.ctx, []common.SHA256Output{domain})
+	require.NoError(t, err)
+	require.Equal(t, []db.DomainRecord{{DomainID: domain, DomainName: "a.example.com"}},
+		gotDomains)
+
+	domainCerts := csvReader(t, [][]string{{base64ID(domain), base64ID(leaf)}})
+	require.NoError(t, e.conn.StreamCsvIntoDomainCerts(e.ctx, domainCerts))
+	assocs, err := e.conn.RetrieveDomainCertsPage(e.ctx, nil, 10)
+	require.NoError(t, err)
+	require.Equal(t, []db.DomainAssociation{{DomainID: domain, ID: leaf}}, assocs)
+
+	dirty := csvReader(t, [][]string{{base64ID(domain)}, {base64ID(id(11))}})
+	require.NoError(t, e.conn.StreamCsvIntoDirty(e.ctx, dirty))
+	dirtyIDs, err := e.conn.RetrieveDirtyDomains(e.ctx)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []common.SHA256Output{domain, id(11)}, dirtyIDs)
+
+	// Nothing to stream is not an error.
+	require.NoError(t, e.conn.StreamCsvIntoCerts(e.ctx, csvReader(t, nil)))
+}
+
+// testCerts checks that certificates are inserted only once, and retrieved by ID.
+func testCerts(t *testing.T, e *env) {
+	root, leaf, missing := id(1), id(2), id(99)
+	e.updateCerts(t, future, []common.SHA256Output{root, leaf},
+		[]*common.SHA256Output{nil, &root})
+	// Inserting an existing certificate does not modify it.
+	err := e.conn.UpdateCerts(e.ctx, []common.SHA256Output{leaf}, []*common.SHA256Output{nil},
+		[]time.Time{future.Add(time.Hour)}, [][]byte{[]byte("other")}, nil)
+	require.NoError(t, err)
+
+	exist, err := e.conn.CheckCertsExist(e.ctx, []common.SHA256Output{missing, leaf, root})
+	require.NoError(t, err)
+	require.Equal(t, []bool{false, true, true}, exist)
+	exist, err = e.conn.CheckCertsExist(e.ctx, nil)
+	require.NoError(t, err)
+	require.Empty(t, exist)
+
+	payloads, err := e.conn.RetrieveCertificatePayloads(e.ctx,
+		[]common.SHA256Output{leaf, missing, root})
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{leaf[:], nil, root[:]}, payloads)
+
+	records, err := e.conn.RetrieveCertificateRecords(e.ctx,
+		[]common.SHA256Output{missing, leaf, root})
+	require.NoError(t, err)
+	require.Equal(t, []*db.PayloadRecord{
+		nil,
+		{ID: leaf, ParentID: &root, Expiration: future, Payload: leaf[:]},
+		{ID: root, Expiration: future, Payload: root[:]},
+	}, records)
+
+	parents, err := e.conn.RetrieveCertificateParents(e.ctx,
+		[]common.SHA256Output{leaf, missing, root})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []db.ParentRecord{
+		{ID: leaf, ParentID: &root},
+		{ID: root},
+	}, parents)
+
+	// The entries of the leaves are stored with them, or set later.
+	precert, final := id(3), id(4)
+	precertEntry := &db.CertificateEntry{
+		Type:          ct.PrecertLogEntryType,
+		TBSID:         id(5),
+		IssuerKeyHash: ptr(id(6)),
+	}
+	err = e.conn.UpdateCerts(e.ctx, []common.SHA256Output{precert, final},
+		[]*common.SHA256Output{&root, &root}, []time.Time{future, future},
+		[][]byte{precert[:], final[:]}, []*db.CertificateEntry{precertEntry, nil})
+	require.NoError(t, err)
+	finalEntry := db.CertificateEntry{Type: ct.X509LogEntryType, TBSID: id(5)}
+	err = e.conn.UpdateCertificateEntries(e.ctx, []common.SHA256Output{final, missing},
+		[]db.CertificateEntry{finalEntry, finalEntry})
+	require.NoError(t, err)
+	records, err = e.conn.RetrieveCertificateRecords(e.ctx,
+		[]common.SHA256Output{precert, final, leaf, missing})
+	require.NoError(t, err)
+	require.Len(t, records, 4)
+	require.Equal(t, precertEntry, records[0].Entry)
+	require.Equal(t, &finalEntry, records[1].Entry)
+	require.Nil(t, records[2].Entry)
+	require.Nil(t, records[3])
+}
+
+// testPolicies checks that policies are replaced when inserted again, and retrieved by ID,
+// also together with certificates.
+func testPolicies(t *testing.T, e *env) {
+	root, leaf, cert, missing := id(1), id(2), id(3), id(99)
+	e.updatePolicies(t, future, []common.SHA256Output{root, leaf},
+		[]*common.SHA256Output{nil, &root})
+	// Inserting an existing policy replaces it.
+	later := future.Add(time.Hour)
+	err := e.conn.UpdatePolicies(e.ctx, []common.SHA256Output{leaf}, []*common.SHA256Output{nil},
+		[]time.Time{later}, [][]byte{[]byte("other")})
+	require.NoError(t, err)
+	e.updateCerts(t, future, []common.SHA256Output{cert}, []*common.SHA256Output{nil})
+
+	exist, err := e.conn.CheckPoliciesExist(e.ctx, []common.SHA256Output{root, cert, leaf})
+	require.NoError(t, err)
+	require.Equal(t, []bool{true, false, true}, exist)
+
+	payloads, err := e.conn.RetrievePolicyPayloads(e.ctx,
+		[]common.SHA256Output{missing, root, leaf})
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{nil, root[:], []byte("other")}, payloads)
+
+	records, err := e.conn.RetrievePolicyRecords(e.ctx, []common.SHA256Output{leaf, missing})
+	require.NoError(t, err)
+	require.Equal(t, []*db.PayloadRecord{
+		{ID: leaf, Expiration: later, Payload: []byte("other")},
+		nil,
+	}, records)
+
+	parents, err := e.conn.RetrievePolicyParents(e.ctx, []common.SHA256Output{missing, root})
+	require.NoError(t, err)
+	require.Equal(t, []db.ParentRecord{{ID: root}}, parents)
+
+	payloads, err = e.conn.RetrieveCertificateOrPolicyPayloads(e.ctx,
+		[]common.SHA256Output{cert, missing, root})
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{cert[:], nil, root[:]}, payloads)
+}
+
+// testDomains checks the insertion and search of domains, and the domains referencing
+// certificates and policies.
+func testDomains(t *testing.T, e *env) {
+	names := []string{
+		"example.com",
+		"www.example.com",
+		"a.b.example.com",
+		"mail1.example.com",
+		"mail22.example.com",
+		"example.org",
+		"notexample.com",
+	}
+	domainIDs := make([]common.SHA256Output, len(names))
+	for i, name := range names {
+		domainIDs[i] = common.SHA256Hash32Bytes([]byte(name))
+	}
+	require.NoError(t, e.conn.UpdateDomains(e.ctx, domainIDs, names))
+	// Existing domains are kept.
+	require.NoError(t, e.conn.UpdateDomains(e.ctx, domainIDs[:1], []string{"other.com"}))
+
+	domains, err := e.conn.RetrieveDomains(e.ctx,
+		[]common.SHA256Output{domainIDs[0], id(99), domainIDs[5]})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []db.DomainRecord{
+		{DomainID: domainIDs[0], DomainName: "example.com"},
+		{DomainID: domainIDs[5], DomainName: "example.org"},
+	}, domains)
+
+	search := func(search db.DomainSearch) []string {
+		t.Helper()
+		domains, err := e.conn.SearchDomains(e.ctx, search)
+		require.NoError(t, err)
+		names := make([]string, len(domains))
+		for i, d := range domains {
+			names[i] = d.DomainName
+			require.Equal(t, common.SHA256Hash32Bytes([]byte(d.DomainName)), d.DomainID)
+		}
+		return names
+	}
+	count := func(search db.DomainSearch) uint64 {
+		t.Helper()
+		n, err := e.conn.CountDomains(e.ctx, search)
+		require.NoError(t, err)
+		return n
+	}
+
+	// Sorted by reversed name.
+	subdomains := []string{
+		"mail1.example.com",
+		"mail22.example.com",
+		"a.b.example.com",
+		"www.example.com",
+	}
+	require.Equal(t, subdomains, search(db.DomainSearch{Suffix: "example.com"}))
+	require.Equal(t, subdomains, search(db.DomainSearch{Suffix: ".example.com."}))
+	require.Equal(t, uint64(4), count(db.DomainSearch{Suffix: "example.com", Limit: 1}))
+	require.Equal(t, subdomains[1:3], search(db.DomainSearch{
+		Suffix: "example.com",
+		After:  "mail1.example.com",
+		Limit:  2,
+	}))
+	require.Equal(t, []string{"mail1.example.com", "mail22.example.com"},
+		search(db.DomainSearch{Pattern: "mail*.example.com"}))
+	require.Equal(t, []string{"mail1.example.com"},
+		search(db.DomainSearch{Pattern: "mail?.example.com"}))
+	require.Equal(t, []string{"example.org"}, search(db.DomainSearch{Pattern: "*.org"}))
+	require.Equal(t, uint64(2), count(db.DomainSearch{Pattern: "mail*", Suffix: "example.com"}))
+	require.Equal(t, uint64(len(names)), count(db.DomainSearch{}))
+	require.Empty(t, search(db.DomainSearch{Suffix: "example.net"}))
+
+	// Domains referencing certificates and policies, sorted by name. Domains missing from
+	// the domains table have an empty name.
+	cert, policy := id(1), id(2)
+	err = e.conn.UpdateDomainCerts(e.ctx,
+		[]common.SHA256Output{domainIDs[1], domainIDs[0], id(98)},
+		[]common.SHA256Output{cert, cert, cert})
+	require.NoError(t, err)
+	err = e.conn.UpdateDomainPolicies(e.ctx,
+		[]common.SHA256Output{domainIDs[5]}, []common.SHA256Output{policy})
+	require.NoError(t, err)
+	certDomains, err := e.conn.RetrieveCertificateDomains(e.ctx, cert)
+	require.NoError(t, err)
+	require.Equal(t, []db.DomainRecord{
+		{DomainID: id(98)},
+		{DomainID: domainIDs[0], DomainName: "example.com"},
+		{DomainID: domainIDs[1], DomainName: "www.example.com"},
+	}, certDomains)
+	policyDomains, err := e.conn.RetrievePolicyDomains(e.ctx, policy)
+	require.NoError(t, err)
+	require.Equal(t, []db.DomainRecord{{DomainID: domainIDs[5], DomainName: "example.org"}},
+		policyDomains)
+	policyDomains, err = e.conn.RetrievePolicyDomains(e.ctx, id(99))
+	require.NoError(t, err)
+	require.Empty(t, policyDomains)
+}
+
+// testAssociations checks the retrieval and replacement of the domain_certs and
+// domain_policies rows of domains.
+func testAssociations(t *testing.T, e *env) {
+	a, b, c := id(10), id(11), id(12)
+	err := e.conn.UpdateDomainCerts(e.ctx,
+		[]common.SHA256Output{a, a, b, c, a},
+		[]common.SHA256Output{id(1), id(2), id(1), id(3), id(1)})
+	require.NoError(t, err)
+	err = e.conn.UpdateDomainPolicies(e.ctx,
+		[]common.SHA256Output{a, c}, []common.SHA256Output{id(5), id(6)})
+	require.NoError(t, err)
+
+	certs, policies, err := e.conn.RetrieveDomainAssociations(e.ctx,
+		[]common.SHA256Output{a, b})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []db.DomainAssociation{
+		{DomainID: a, ID: id(1)},
+		{DomainID: a, ID: id(2)},
+		{DomainID: b, ID: id(1)},
+	}, certs)
+	require.Equal(t, []db.DomainAssociation{{DomainID: a, ID: id(5)}}, policies)
+
+	err = e.conn.ReplaceDomainAssociations(e.ctx, []common.SHA256Output{a, b},
+		[]db.DomainAssociation{{DomainID: a, ID: id(4)}},
+		[]db.DomainAssociation{{DomainID: b, ID: id(7)}})
+	require.NoError(t, err)
+
+	certs, err = e.conn.RetrieveDomainCertsPage(e.ctx, nil, 10)
+	require.NoError(t, err)
+	require.Equal(t, []db.DomainAssociation{
+		{DomainID: a, ID: id(4)},
+		{DomainID: c, ID: id(3)},
+	}, certs)
+	policies, err = e.conn.RetrieveDomainPoliciesPage(e.ctx, nil, 10)
+	require.NoError(t, err)
+	require.Equal(t, []db.DomainAssociation{
+		{DomainID: b, ID: id(7)},
+		{DomainID: c, ID: id(6)},
+	}, policies)
+}
+
+// testCTLogState checks that the state of each CT log server round trips.
+func testCTLogState(t *testing.T, e *env) {
+	const url1 = "https://ct1.example.com/log/"
+	const url2 = "https://ct2.example.com/log/"
+
+	size, sth, err := e.conn.LastCTlogServerState(e.ctx, url1)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), size)
+	require.Empty(t, sth)
+
+	require.NoError(t, e.conn.UpdateLastCTlogServerState(e.ctx, url1, 100, []byte("sth1")))
+	require.NoError(t, e.conn.UpdateLastCTlogServerState(e.ctx, url2, 5, []byte("sth2")))
+	require.NoError(t, e.conn.UpdateLastCTlogServerState(e.ctx, url1, 200, []byte("sth3")))
+
+	size, sth, err = e.conn.LastCTlogServerState(e.ctx, url1)
+	require.NoError(t, err)
+	require.Equal(t, int64(200), size)
+	require.Equal(t, []byte("sth3"), sth)
+	size, sth, err = e.conn.LastCTlogServerState(e.ctx, url2)
+	require.NoError(t, err)
+	require.Equal(t, int64(5), size)
+	require.Equal(t, []byte("sth2"), sth)
+}
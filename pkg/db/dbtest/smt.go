@@ -0,0 +1,160 @@
+package dbtest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/db"
+)
+
+// testSMT checks the root and the nodes of the tree.
+func testSMT(t *testing.T, e *env) {
+	root, err := e.conn.LoadRoot(e.ctx)
+	require.NoError(t, err)
+	require.Nil(t, root)
+	require.NoError(t, e.conn.SaveRoot(e.ctx, ptr(id(1))))
+	require.NoError(t, e.conn.SaveRoot(e.ctx, ptr(id(2))))
+	root, err = e.conn.LoadRoot(e.ctx)
+	require.NoError(t, err)
+	require.Equal(t, ptr(id(2)), root)
+
+	// Inserted nodes count once, replaced ones twice.
+	n, err := e.conn.UpdateTreeNodes(e.ctx, []*db.TreeNodeRecord{
+		{Key: id(1), Value: []byte{1}},
+		{Key: id(2), Value: []byte{2}},
+		{Key: id(3), Value: []byte{3}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+	n, err = e.conn.UpdateTreeNodes(e.ctx, []*db.TreeNodeRecord{{Key: id(2), Value: []byte{4}}})
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	n, err = e.conn.UpdateTreeNodes(e.ctx, nil)
+	require.NoError(t, err)
+	require.Zero(t, n)
+
+	value, err := e.conn.RetrieveTreeNode(e.ctx, id(2))
+	require.NoError(t, err)
+	require.Equal(t, []byte{4}, value)
+	value, err = e.conn.RetrieveTreeNode(e.ctx, id(9))
+	require.NoError(t, err)
+	require.Nil(t, value)
+
+	// Only the existing nodes count as deleted.
+	n, err = e.conn.DeleteTreeNodes(e.ctx, ids(1, 9))
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	value, err = e.conn.RetrieveTreeNode(e.ctx, id(1))
+	require.NoError(t, err)
+	require.Nil(t, value)
+}
+
+// testEpochs checks recording and saving epochs, and the retrieval of what each one modified.
+func testEpochs(t *testing.T, e *env) {
+	// There is no epoch without a root.
+	_, err := e.conn.RecordEpoch(e.ctx)
+	require.Error(t, err)
+	epoch, err := e.conn.LastEpoch(e.ctx)
+	require.NoError(t, err)
+	require.Nil(t, epoch)
+
+	_, err = e.conn.UpdateTreeNodes(e.ctx, []*db.TreeNodeRecord{
+		{Key: id(1), Value: []byte{1}},
+		{Key: id(2), Value: []byte{2}},
+	})
+	require.NoError(t, err)
+	require.NoError(t, e.conn.SaveRoot(e.ctx, ptr(id(1))))
+	require.NoError(t, e.conn.InsertDomainsIntoDirty(e.ctx, ids(3, 1, 2)))
+	first, err := e.conn.RecordEpoch(e.ctx)
+	require.NoError(t, err)
+	_, lastRowID, err := e.conn.RetrieveTreeNodesPage(e.ctx, 0, ^uint64(0), 100)
+	require.NoError(t, err)
+	require.Equal(t, &db.Epoch{Number: 1, Root: id(1), TreeID: lastRowID}, first)
+	require.NoError(t, e.conn.CleanupDirty(e.ctx))
+
+	// The replaced node gets a new row ID.
+	_, err = e.conn.UpdateTreeNodes(e.ctx, []*db.TreeNodeRecord{
+		{Key: id(1), Value: []byte{3}},
+		{Key: id(4), Value: []byte{4}},
+	})
+	require.NoError(t, err)
+	require.NoError(t, e.conn.SaveRoot(e.ctx, ptr(id(4))))
+	require.NoError(t, e.conn.InsertDomainsIntoDirty(e.ctx, ids(4, 2)))
+	second, err := e.conn.RecordEpoch(e.ctx)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), second.Number)
+	require.Equal(t, id(4), second.Root)
+	require.Greater(t, second.TreeID, first.TreeID)
+
+	// Saved epochs cannot reuse a number, and then leave the root unchanged.
+	require.Error(t, e.conn.SaveEpoch(e.ctx, &db.Epoch{Number: 2, Root: id(5)}))
+	root, err := e.conn.LoadRoot(e.ctx)
+	require.NoError(t, err)
+	require.Equal(t, ptr(id(4)), root)
+	third := &db.Epoch{Number: 3, Root: id(5), TreeID: second.TreeID}
+	require.NoError(t, e.conn.SaveEpoch(e.ctx, third))
+	root, err = e.conn.LoadRoot(e.ctx)
+	require.NoError(t, err)
+	require.Equal(t, ptr(id(5)), root)
+
+	epoch, err = e.conn.LastEpoch(e.ctx)
+	require.NoError(t, err)
+	require.Equal(t, third, epoch)
+	epoch, err = e.conn.RetrieveEpoch(e.ctx, 1)
+	require.NoError(t, err)
+	require.Equal(t, first, epoch)
+	epoch, err = e.conn.RetrieveEpoch(e.ctx, 9)
+	require.NoError(t, err)
+	require.Nil(t, epoch)
+
+	// The domains of the epochs in (from,to], sorted and distinct.
+	for _, tc := range []struct {
+		from, to uint64
+		after    *common.SHA256Output
+		limit    int
+		expected []common.SHA256Output
+	}{
+		{0, 1, nil, 10, ids(1, 2, 3)},
+		{1, 2, nil, 10, ids(2, 4)},
+		{0, 3, nil, 10, ids(1, 2, 3, 4)},
+		{0, 3, nil, 2, ids(1, 2)},
+		{0, 3, ptr(id(2)), 1, ids(3)},
+		{2, 3, nil, 10, nil},
+	} {
+		domainIDs, err := e.conn.RetrieveEpochDomainsPage(e.ctx, tc.from, tc.to, tc.after, tc.limit)
+		require.NoError(t, err)
+		require.ElementsMatch(t, tc.expected, domainIDs, "epochs (%d,%d]", tc.from, tc.to)
+		if len(tc.expected) > 0 {
+			require.Equal(t, tc.expected, domainIDs)
+		}
+	}
+
+	// Only the nodes written after the first epoch are retrieved, in the order of the writes.
+	nodes, last, err := e.conn.RetrieveTreeNodesPage(e.ctx, first.TreeID, second.TreeID, 10)
+	require.NoError(t, err)
+	require.Equal(t, []*db.TreeNodeRecord{
+		{Key: id(1), Value: []byte{3}},
+		{Key: id(4), Value: []byte{4}},
+	}, nodes)
+	require.Equal(t, second.TreeID, last)
+	nodes, last, err = e.conn.RetrieveTreeNodesPage(e.ctx, first.TreeID, second.TreeID, 1)
+	require.NoError(t, err)
+	require.Equal(t, []*db.TreeNodeRecord{{Key: id(1), Value: []byte{3}}}, nodes)
+	nodes, last, err = e.conn.RetrieveTreeNodesPage(e.ctx, last, second.TreeID, 1)
+	require.NoError(t, err)
+	require.Equal(t, []*db.TreeNodeRecord{{Key: id(4), Value: []byte{4}}}, nodes)
+	require.Equal(t, second.TreeID, last)
+
+	// The node replaced later is not part of the first epoch anymore.
+	nodes, _, err = e.conn.RetrieveTreeNodesPage(e.ctx, 0, first.TreeID, 10)
+	require.NoError(t, err)
+	require.Equal(t, []*db.TreeNodeRecord{{Key: id(2), Value: []byte{2}}}, nodes)
+
+	// An empty page keeps the passed row ID.
+	nodes, last, err = e.conn.RetrieveTreeNodesPage(e.ctx, second.TreeID, second.TreeID, 10)
+	require.NoError(t, err)
+	require.Empty(t, nodes)
+	require.Equal(t, second.TreeID, last)
+}
@@ -0,0 +1,247 @@
+package dbtest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/db"
+)
+
+// testPages checks iterating over the full contents of the tables.
+func testPages(t *testing.T, e *env) {
+	err := e.conn.UpdateDomains(e.ctx, ids(3, 1, 2), []string{"c.com", "a.com", "b.com"})
+	require.NoError(t, err)
+	domains, err := e.conn.RetrieveDomainsPage(e.ctx, nil, 2)
+	require.NoError(t, err)
+	require.Equal(t, []db.DomainRecord{
+		{DomainID: id(1), DomainName: "a.com"},
+		{DomainID: id(2), DomainName: "b.com"},
+	}, domains)
+	domains, err = e.conn.RetrieveDomainsPage(e.ctx, ptr(id(2)), 2)
+	require.NoError(t, err)
+	require.Equal(t, []db.DomainRecord{{DomainID: id(3), DomainName: "c.com"}}, domains)
+	domains, err = e.conn.RetrieveDomainsPage(e.ctx, ptr(id(3)), 2)
+	require.NoError(t, err)
+	require.Empty(t, domains)
+
+	// Certificates and policies are paged in the same way.
+	e.updateCerts(t, future, ids(3, 1, 2), []*common.SHA256Output{nil, ptr(id(3)), nil})
+	e.updatePolicies(t, future, ids(6, 4, 5), []*common.SHA256Output{ptr(id(4)), nil, nil})
+	for _, tc := range []struct {
+		name    string
+		records func(*common.SHA256Output, int) ([]*db.PayloadRecord, error)
+		parents func(*common.SHA256Output, int) ([]db.ParentRecord, error)
+		ids     []common.SHA256Output
+		parent  map[common.SHA256Output]*common.SHA256Output
+	}{
+		{
+			name: "certificates",
+			records: func(after *common.SHA256Output, limit int) ([]*db.PayloadRecord, error) {
+				return e.conn.RetrieveCertificatesPage(e.ctx, after, limit)
+			},
+			parents: func(after *common.SHA256Output, limit int) ([]db.ParentRecord, error) {
+				return e.conn.RetrieveCertificateParentsPage(e.ctx, after, limit)
+			},
+			ids:    ids(1, 2, 3),
+			parent: map[common.SHA256Output]*common.SHA256Output{id(1): ptr(id(3))},
+		},
+		{
+			name: "policies",
+			records: func(after *common.SHA256Output, limit int) ([]*db.PayloadRecord, error) {
+				return e.conn.RetrievePoliciesPage(e.ctx, after, limit)
+			},
+			parents: func(after *common.SHA256Output, limit int) ([]db.ParentRecord, error) {
+				return e.conn.RetrievePolicyParentsPage(e.ctx, after, limit)
+			},
+			ids:    ids(4, 5, 6),
+			parent: map[common.SHA256Output]*common.SHA256Output{id(6): ptr(id(4))},
+		},
+	} {
+		var expectedRecords []*db.PayloadRecord
+		var expectedParents []db.ParentRecord
+		for _, id := range tc.ids {
+			expectedRecords = append(expectedRecords, &db.PayloadRecord{
+				ID:         id,
+				ParentID:   tc.parent[id],
+				Expiration: future,
+				Payload:    id[:],
+			})
+			expectedParents = append(expectedParents, db.ParentRecord{
+				ID:       id,
+				ParentID: tc.parent[id],
+			})
+		}
+
+		records, err := tc.records(nil, 10)
+		require.NoError(t, err)
+		require.Equal(t, expectedRecords, records, tc.name)
+		records, err = tc.records(&tc.ids[0], 1)
+		require.NoError(t, err)
+		require.Equal(t, expectedRecords[1:2], records, tc.name)
+		records, err = tc.records(&tc.ids[2], 10)
+		require.NoError(t, err)
+		require.Empty(t, records, tc.name)
+
+		parents, err := tc.parents(nil, 2)
+		require.NoError(t, err)
+		require.Equal(t, expectedParents[:2], parents, tc.name)
+		parents, err = tc.parents(&tc.ids[1], 2)
+		require.NoError(t, err)
+		require.Equal(t, expectedParents[2:], parents, tc.name)
+	}
+
+	// The associations are sorted by domain and then by certificate or policy.
+	a, b := id(10), id(11)
+	err = e.conn.UpdateDomainCerts(e.ctx,
+		[]common.SHA256Output{b, a, a}, []common.SHA256Output{id(1), id(2), id(1)})
+	require.NoError(t, err)
+	err = e.conn.UpdateDomainPolicies(e.ctx,
+		[]common.SHA256Output{b, a, b}, []common.SHA256Output{id(5), id(4), id(4)})
+	require.NoError(t, err)
+	for _, tc := range []struct {
+		name     string
+		page     func(*db.DomainAssociation, int) ([]db.DomainAssociation, error)
+		expected []db.DomainAssociation
+	}{
+		{
+			name: "domain_certs",
+			page: func(after *db.DomainAssociation, limit int) ([]db.DomainAssociation, error) {
+				return e.conn.RetrieveDomainCertsPage(e.ctx, after, limit)
+			},
+			expected: []db.DomainAssociation{
+				{DomainID: a, ID: id(1)},
+				{DomainID: a, ID: id(2)},
+				{DomainID: b, ID: id(1)},
+			},
+		},
+		{
+			name: "domain_policies",
+			page: func(after *db.DomainAssociation, limit int) ([]db.DomainAssociation, error) {
+				return e.conn.RetrieveDomainPoliciesPage(e.ctx, after, limit)
+			},
+			expected: []db.DomainAssociation{
+				{DomainID: a, ID: id(4)},
+				{DomainID: b, ID: id(4)},
+				{DomainID: b, ID: id(5)},
+			},
+		},
+	} {
+		rows, err := tc.page(nil, 10)
+		require.NoError(t, err)
+		require.Equal(t, tc.expected, rows, tc.name)
+		rows, err = tc.page(&tc.expected[0], 1)
+		require.NoError(t, err)
+		require.Equal(t, tc.expected[1:2], rows, tc.name)
+		rows, err = tc.page(&tc.expected[1], 10)
+		require.NoError(t, err)
+		require.Equal(t, tc.expected[2:], rows, tc.name)
+		rows, err = tc.page(&tc.expected[2], 10)
+		require.NoError(t, err)
+		require.Empty(t, rows, tc.name)
+	}
+}
+
+// testCountRows checks the schema of a new DB, and the number of rows of its tables.
+func testCountRows(t *testing.T, e *env) {
+	require.NoError(t, e.conn.CheckSchema(e.ctx))
+	counts, err := e.conn.CountRows(e.ctx)
+	require.NoError(t, err)
+	require.Equal(t, &db.TableCounts{}, counts)
+
+	e.updateCerts(t, future, ids(1, 2), []*common.SHA256Output{nil, ptr(id(1))})
+	e.updatePolicies(t, future, ids(3), []*common.SHA256Output{nil})
+	require.NoError(t, e.conn.UpdateDomains(e.ctx, ids(10, 11), []string{"a.com", "b.com"}))
+	err = e.conn.UpdateDomainCerts(e.ctx, ids(10, 11, 11), ids(2, 2, 1))
+	require.NoError(t, err)
+	require.NoError(t, e.conn.UpdateDomainPolicies(e.ctx, ids(10), ids(3)))
+	require.NoError(t, e.conn.InsertDomainsIntoDirty(e.ctx, ids(10, 11, 10)))
+	_, err = e.conn.UpdateTreeNodes(e.ctx, []*db.TreeNodeRecord{
+		{Key: id(20), Value: []byte{1}},
+		{Key: id(21), Value: []byte{2}},
+	})
+	require.NoError(t, err)
+	require.NoError(t, e.conn.SaveRoot(e.ctx, ptr(id(20))))
+	_, err = e.conn.RecordEpoch(e.ctx)
+	require.NoError(t, err)
+
+	counts, err = e.conn.CountRows(e.ctx)
+	require.NoError(t, err)
+	require.Equal(t, &db.TableCounts{
+		Certs:          2,
+		Policies:       1,
+		Domains:        2,
+		DomainCerts:    3,
+		DomainPolicies: 1,
+		Dirty:          2,
+		TreeNodes:      2,
+		Epochs:         1,
+	}, counts)
+}
+
+// testTruncate checks that truncating removes the certificates, domains and the tree.
+// The policies and the state of the CT log servers are not checked, as backends differ.
+func testTruncate(t *testing.T, e *env) {
+	cert := id(1)
+	e.updateCerts(t, future, []common.SHA256Output{cert}, []*common.SHA256Output{nil})
+	require.NoError(t, e.conn.UpdateDomains(e.ctx, ids(10), []string{"a.com"}))
+	err := e.conn.UpdateDomainCerts(e.ctx, ids(10), []common.SHA256Output{cert})
+	require.NoError(t, err)
+	require.NoError(t, e.conn.InsertDomainsIntoDirty(e.ctx, ids(10)))
+	require.NoError(t, e.conn.RecomputeDirtyDomainsCertAndPolicyIDs(e.ctx))
+	_, err = e.conn.UpdateTreeNodes(e.ctx, []*db.TreeNodeRecord{{Key: id(2), Value: []byte{2}}})
+	require.NoError(t, err)
+	require.NoError(t, e.conn.SaveRoot(e.ctx, ptr(id(2))))
+	_, err = e.conn.RecordEpoch(e.ctx)
+	require.NoError(t, err)
+
+	require.NoError(t, e.conn.TruncateAllTables(e.ctx))
+
+	exist, err := e.conn.CheckCertsExist(e.ctx, []common.SHA256Output{cert})
+	require.NoError(t, err)
+	require.Equal(t, []bool{false}, exist)
+	domains, err := e.conn.RetrieveDomainsPage(e.ctx, nil, 10)
+	require.NoError(t, err)
+	require.Empty(t, domains)
+	associations, err := e.conn.RetrieveDomainCertsPage(e.ctx, nil, 10)
+	require.NoError(t, err)
+	require.Empty(t, associations)
+	entries, err := e.conn.RetrieveDomainEntries(e.ctx, ids(10))
+	require.NoError(t, err)
+	require.Empty(t, entries)
+	count, err := e.conn.DirtyCount(e.ctx)
+	require.NoError(t, err)
+	require.Zero(t, count)
+	root, err := e.conn.LoadRoot(e.ctx)
+	require.NoError(t, err)
+	require.Nil(t, root)
+	value, err := e.conn.RetrieveTreeNode(e.ctx, id(2))
+	require.NoError(t, err)
+	require.Nil(t, value)
+	epoch, err := e.conn.LastEpoch(e.ctx)
+	require.NoError(t, err)
+	require.Nil(t, epoch)
+
+	// The epochs start again from the first one.
+	require.NoError(t, e.conn.SaveRoot(e.ctx, ptr(id(3))))
+	epoch, err = e.conn.RecordEpoch(e.ctx)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), epoch.Number)
+}
+
+func testIdentity(t *testing.T, e *env) {
+	identity, err := e.conn.Identity(e.ctx)
+	require.NoError(t, err)
+	require.NotEqual(t, db.Identity{}, identity)
+	again, err := e.conn.Identity(e.ctx)
+	require.NoError(t, err)
+	require.Equal(t, identity, again)
+
+	// Truncating the tables makes it another DB.
+	require.NoError(t, e.conn.TruncateAllTables(e.ctx))
+	again, err = e.conn.Identity(e.ctx)
+	require.NoError(t, err)
+	require.NotEqual(t, db.Identity{}, again)
+	require.NotEqual(t, identity, again)
+}
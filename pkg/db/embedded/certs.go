@@ -0,0 +1,254 @@
+package embedded
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"time"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/db"
+)
+
+// CheckCertsExist returns a slice of true/false values. Each value indicates if
+// the corresponding certificate identified by its ID is already present in the DB.
+func (c *embeddedDB) CheckCertsExist(ctx context.Context, ids []common.SHA256Output,
+) ([]bool, error) {
+
+	return c.checkExist(certsOf, ids)
+}
+
+// UpdateCerts inserts the certificates with their entries, keeping the existing ones.
+func (c *embeddedDB) UpdateCerts(
+	ctx context.Context,
+	ids []common.SHA256Output,
+	parents []*common.SHA256Output,
+	expirations []time.Time,
+	payloads [][]byte,
+	entries []*db.CertificateEntry,
+) error {
+
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+
+	recs := make([]record, 0, len(ids))
+	seen := make(map[common.SHA256Output]struct{}, len(ids))
+	for i, id := range ids {
+		if _, ok := c.s.t.certs[id]; ok {
+			continue
+		}
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		recs = append(recs, putPayloadRecord(opPutCert, &db.PayloadRecord{
+			ID:         id,
+			ParentID:   parents[i],
+			Expiration: toDateTime(expirations[i]),
+			Payload:    bytes.Clone(payloads[i]),
+		}))
+		if entries != nil && entries[i] != nil {
+			recs = append(recs, putCertEntryRecord(id, *entries[i]))
+		}
+	}
+	return c.s.commit(recs...)
+}
+
+// UpdateCertificateEntries sets the entries of the existing certificates.
+func (c *embeddedDB) UpdateCertificateEntries(
+	ctx context.Context,
+	ids []common.SHA256Output,
+	entries []db.CertificateEntry,
+) error {
+
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+
+	recs := make([]record, 0, len(ids))
+	for i, id := range ids {
+		if _, ok := c.s.t.certs[id]; ok {
+			recs = append(recs, putCertEntryRecord(id, entries[i]))
+		}
+	}
+	return c.s.commit(recs...)
+}
+
+func (c *embeddedDB) InsertCsvIntoCerts(ctx context.Context, filename string) error {
+	return insertCsv(filename, 7, c.insertCertsRows(ctx))
+}
+
+func (c *embeddedDB) StreamCsvIntoCerts(ctx context.Context, r io.Reader) error {
+	return streamCsv(r, 7, c.insertCertsRows(ctx))
+}
+
+// insertCertsRows inserts rows with the columns of the certs table: ID, parent ID, expiration,
+// payload, and the entry type, TBS ID and issuer key hash, which are empty if unknown.
+func (c *embeddedDB) insertCertsRows(ctx context.Context) func(rows [][]string) error {
+	return func(rows [][]string) error {
+		ids := make([]common.SHA256Output, len(rows))
+		parents := make([]*common.SHA256Output, len(rows))
+		expirations := make([]time.Time, len(rows))
+		payloads := make([][]byte, len(rows))
+		entries := make([]*db.CertificateEntry, len(rows))
+		for i, row := range rows {
+			var err error
+			if ids[i], err = parseBase64ID(row[0]); err != nil {
+				return err
+			}
+			if parents[i], err = parseBase64OptionalID(row[1]); err != nil {
+				return err
+			}
+			if expirations[i], err = time.Parse(time.DateTime, row[2]); err != nil {
+				return err
+			}
+			if payloads[i], err = decodeBase64(row[3]); err != nil {
+				return err
+			}
+			if entries[i], err = parseCertEntry(row[4], row[5], row[6]); err != nil {
+				return err
+			}
+		}
+		return c.UpdateCerts(ctx, ids, parents, expirations, payloads, entries)
+	}
+}
+
+// UpdateDomainCerts inserts the rows into the domain_certs table.
+func (c *embeddedDB) UpdateDomainCerts(
+	ctx context.Context,
+	domainIDs []common.SHA256Output,
+	certIDs []common.SHA256Output,
+) error {
+
+	return c.updateAssociations(opPutDomainCert, domainCertsOf, domainIDs, certIDs)
+}
+
+func (c *embeddedDB) InsertCsvIntoDomainCerts(ctx context.Context, filename string) error {
+	return insertCsv(filename, 2, c.insertDomainCertsRows(ctx))
+}
+
+func (c *embeddedDB) StreamCsvIntoDomainCerts(ctx context.Context, r io.Reader) error {
+	return streamCsv(r, 2, c.insertDomainCertsRows(ctx))
+}
+
+func (c *embeddedDB) insertDomainCertsRows(ctx context.Context) func(rows [][]string) error {
+	return func(rows [][]string) error {
+		domainIDs := make([]common.SHA256Output, len(rows))
+		certIDs := make([]common.SHA256Output, len(rows))
+		for i, row := range rows {
+			var err error
+			if domainIDs[i], err = parseBase64ID(row[0]); err != nil {
+				return err
+			}
+			if certIDs[i], err = parseBase64ID(row[1]); err != nil {
+				return err
+			}
+		}
+		return c.UpdateDomainCerts(ctx, domainIDs, certIDs)
+	}
+}
+
+// RetrieveDomainCertificatesIDs retrieves the domain's certificate payload ID and the payload
+// itself, given the domain ID.
+func (c *embeddedDB) RetrieveDomainCertificatesIDs(ctx context.Context, domainID common.SHA256Output,
+) (common.SHA256Output, []byte, error) {
+
+	c.s.mu.RLock()
+	defer c.s.mu.RUnlock()
+	return idsAndTheirID(c.s.t.payloads[domainID].certIDs)
+}
+
+// RetrieveCertificatePayloads returns the payload for each certificate identified by the IDs
+// parameter, in the same order (element i corresponds to IDs[i]).
+func (c *embeddedDB) RetrieveCertificatePayloads(ctx context.Context, IDs []common.SHA256Output,
+) ([][]byte, error) {
+
+	return c.retrievePayloads(IDs, certsOf)
+}
+
+// RetrieveCertificateRecords returns the certs table row for each certificate identified by
+// the IDs parameter, in the same order. Missing certificates yield a nil record.
+func (c *embeddedDB) RetrieveCertificateRecords(ctx context.Context, IDs []common.SHA256Output,
+) ([]*db.PayloadRecord, error) {
+
+	return c.retrievePayloadRecords(IDs, certsOf)
+}
+
+// RetrieveCertificateParents returns the parent of the existing certificates with the IDs.
+func (c *embeddedDB) RetrieveCertificateParents(ctx context.Context, IDs []common.SHA256Output,
+) ([]db.ParentRecord, error) {
+
+	return c.retrieveParents(IDs, certsOf)
+}
+
+// RetrieveCertificateDomains returns the domains that reference the certificate in domain_certs.
+func (c *embeddedDB) RetrieveCertificateDomains(ctx context.Context, certID common.SHA256Output,
+) ([]db.DomainRecord, error) {
+
+	return c.retrieveReferringDomains(certID, domainCertsOf)
+}
+
+// LastCTlogServerState returns the last state of the server written into the DB.
+// The url specifies the CT log server from which this data comes from.
+func (c *embeddedDB) LastCTlogServerState(ctx context.Context, url string,
+) (int64, []byte, error) {
+
+	c.s.mu.RLock()
+	defer c.s.mu.RUnlock()
+
+	state := c.s.t.ctLogs[(common.SHA256Output)(common.SHA256Hash([]byte(url)))]
+	return state.size, bytes.Clone(state.sth), nil
+}
+
+// UpdateLastCTlogServerState updates the index of the last certificate written into the DB.
+// The url specifies the CT log server from which this index comes from.
+func (c *embeddedDB) UpdateLastCTlogServerState(ctx context.Context, url string,
+	size int64, sth []byte) error {
+
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	return c.s.commit(newRecord(opPutCTLogState, common.SHA256Hash([]byte(url)),
+		uint64Field(uint64(size)), bytes.Clone(sth)))
+}
+
+// PruneCerts removes the certificates that expire before now, and their descendants, and
+// marks as dirty the domains that referenced them.
+func (c *embeddedDB) PruneCerts(ctx context.Context, now time.Time) error {
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+
+	cut := toDateTime(now)
+	children := make(map[common.SHA256Output][]common.SHA256Output)
+	var pruned []common.SHA256Output
+	for id, rec := range c.s.t.certs {
+		if rec.ParentID != nil {
+			children[*rec.ParentID] = append(children[*rec.ParentID], id)
+		}
+		if rec.Expiration.Before(cut) {
+			pruned = append(pruned, id)
+		}
+	}
+
+	removed := make(map[common.SHA256Output]struct{})
+	var recs []record
+	for len(pruned) > 0 {
+		id := pruned[len(pruned)-1]
+		pruned = pruned[:len(pruned)-1]
+		if _, ok := removed[id]; ok {
+			continue
+		}
+		removed[id] = struct{}{}
+		recs = append(recs, newRecord(opDelCert, clone(id)))
+		pruned = append(pruned, children[id]...)
+	}
+
+	dirty := make(map[common.SHA256Output]struct{})
+	for id := range removed {
+		for domainID := range c.s.t.domainCerts.byID[id] {
+			if _, ok := dirty[domainID]; !ok {
+				dirty[domainID] = struct{}{}
+				recs = append(recs, newRecord(opPutDirty, clone(domainID), boolField(false)))
+			}
+		}
+	}
+	return c.s.commit(recs...)
+}
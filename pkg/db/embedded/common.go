@@ -0,0 +1,278 @@
+package embedded
+
+import (
+	"bytes"
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/db"
+)
+
+// Selectors of the tables shared by certificates and policies. The tables are accessed through
+// them, as TruncateAllTables replaces their maps.
+func certsOf(t *tables) map[common.SHA256Output]*db.PayloadRecord    { return t.certs }
+func policiesOf(t *tables) map[common.SHA256Output]*db.PayloadRecord { return t.policies }
+func domainCertsOf(t *tables) *associations                          { return t.domainCerts }
+func domainPoliciesOf(t *tables) *associations                       { return t.domainPolicies }
+
+// RetrieveCertificateOrPolicyPayloads returns the payload for each certificate OR policy
+// identified by the IDs parameter, in the same order (element i corresponds to IDs[i]).
+func (c *embeddedDB) RetrieveCertificateOrPolicyPayloads(
+	ctx context.Context,
+	IDs []common.SHA256Output,
+) ([][]byte, error) {
+
+	c.s.mu.RLock()
+	defer c.s.mu.RUnlock()
+
+	payloads := make([][]byte, len(IDs))
+	for i, id := range IDs {
+		if rec, ok := c.s.t.policies[id]; ok {
+			payloads[i] = bytes.Clone(rec.Payload)
+		} else if rec, ok := c.s.t.certs[id]; ok {
+			payloads[i] = bytes.Clone(rec.Payload)
+		}
+	}
+	return payloads, nil
+}
+
+// RetrieveDomainAssociations returns the domain_certs and domain_policies rows of the domains.
+func (c *embeddedDB) RetrieveDomainAssociations(
+	ctx context.Context,
+	domainIDs []common.SHA256Output,
+) ([]db.DomainAssociation, []db.DomainAssociation, error) {
+
+	if len(domainIDs) == 0 {
+		return nil, nil, nil
+	}
+	c.s.mu.RLock()
+	defer c.s.mu.RUnlock()
+
+	domains := make(map[common.SHA256Output]struct{}, len(domainIDs))
+	var certs, policies []db.DomainAssociation
+	for _, domainID := range domainIDs {
+		if _, ok := domains[domainID]; ok {
+			continue
+		}
+		domains[domainID] = struct{}{}
+		for id := range c.s.t.domainCerts.byDomain[domainID] {
+			certs = append(certs, db.DomainAssociation{DomainID: domainID, ID: id})
+		}
+		for id := range c.s.t.domainPolicies.byDomain[domainID] {
+			policies = append(policies, db.DomainAssociation{DomainID: domainID, ID: id})
+		}
+	}
+	slices.SortFunc(certs, compareAssociations)
+	slices.SortFunc(policies, compareAssociations)
+	return certs, policies, nil
+}
+
+// ReplaceDomainAssociations replaces, at once, the domain_certs and domain_policies rows of
+// the domains with the passed ones.
+func (c *embeddedDB) ReplaceDomainAssociations(
+	ctx context.Context,
+	domainIDs []common.SHA256Output,
+	certs []db.DomainAssociation,
+	policies []db.DomainAssociation,
+) error {
+
+	if len(domainIDs) == 0 {
+		return nil
+	}
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+
+	var recs []record
+	for _, t := range []struct {
+		delOp  opCode
+		putOp  opCode
+		table  *associations
+		assocs []db.DomainAssociation
+	}{
+		{opDelDomainCert, opPutDomainCert, c.s.t.domainCerts, certs},
+		{opDelDomainPolicy, opPutDomainPolicy, c.s.t.domainPolicies, policies},
+	} {
+		for _, domainID := range domainIDs {
+			for id := range t.table.byDomain[domainID] {
+				recs = append(recs, newRecord(t.delOp, clone(domainID), clone(id)))
+			}
+		}
+		for _, a := range t.assocs {
+			recs = append(recs, newRecord(t.putOp, clone(a.DomainID), clone(a.ID)))
+		}
+	}
+	return c.s.commit(recs...)
+}
+
+// checkExist returns whether each ID is present in the selected table.
+func (c *embeddedDB) checkExist(
+	table func(*tables) map[common.SHA256Output]*db.PayloadRecord,
+	ids []common.SHA256Output,
+) ([]bool, error) {
+
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	c.s.mu.RLock()
+	defer c.s.mu.RUnlock()
+
+	m := table(c.s.t)
+	present := make([]bool, len(ids))
+	for i, id := range ids {
+		_, present[i] = m[id]
+	}
+	return present, nil
+}
+
+// updateAssociations inserts the rows into the selected domain_certs or domain_policies table,
+// ignoring the existing ones.
+func (c *embeddedDB) updateAssociations(
+	op opCode,
+	table func(*tables) *associations,
+	domainIDs []common.SHA256Output,
+	ids []common.SHA256Output,
+) error {
+
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+
+	assocs := table(c.s.t)
+	recs := make([]record, 0, len(domainIDs))
+	for i, domainID := range domainIDs {
+		if _, ok := assocs.byDomain[domainID][ids[i]]; ok {
+			continue
+		}
+		recs = append(recs, newRecord(op, clone(domainID), clone(ids[i])))
+	}
+	return c.s.commit(recs...)
+}
+
+// retrievePayloads returns the payloads of the IDs in the selected table, nil for the
+// missing ones.
+func (c *embeddedDB) retrievePayloads(
+	IDs []common.SHA256Output,
+	table func(*tables) map[common.SHA256Output]*db.PayloadRecord,
+) ([][]byte, error) {
+
+	c.s.mu.RLock()
+	defer c.s.mu.RUnlock()
+
+	m := table(c.s.t)
+	payloads := make([][]byte, len(IDs))
+	for i, id := range IDs {
+		if rec, ok := m[id]; ok {
+			payloads[i] = bytes.Clone(rec.Payload)
+		}
+	}
+	return payloads, nil
+}
+
+// retrievePayloadRecords returns the rows of the IDs in the selected table, in the same order.
+// Missing rows are nil.
+func (c *embeddedDB) retrievePayloadRecords(
+	IDs []common.SHA256Output,
+	table func(*tables) map[common.SHA256Output]*db.PayloadRecord,
+) ([]*db.PayloadRecord, error) {
+
+	if len(IDs) == 0 {
+		return nil, nil
+	}
+	c.s.mu.RLock()
+	defer c.s.mu.RUnlock()
+
+	m := table(c.s.t)
+	records := make([]*db.PayloadRecord, len(IDs))
+	for i, id := range IDs {
+		if rec, ok := m[id]; ok {
+			records[i] = clonePayloadRecord(rec)
+		}
+	}
+	return records, nil
+}
+
+// retrieveParents returns the parents of the IDs present in the selected table.
+func (c *embeddedDB) retrieveParents(
+	IDs []common.SHA256Output,
+	table func(*tables) map[common.SHA256Output]*db.PayloadRecord,
+) ([]db.ParentRecord, error) {
+
+	c.s.mu.RLock()
+	defer c.s.mu.RUnlock()
+
+	m := table(c.s.t)
+	var parents []db.ParentRecord
+	for _, id := range IDs {
+		if rec, ok := m[id]; ok {
+			parents = append(parents, parentRecord(rec))
+		}
+	}
+	return parents, nil
+}
+
+// retrieveReferringDomains returns the domains that reference the ID in the selected
+// domain_certs or domain_policies table, ordered by domain name.
+func (c *embeddedDB) retrieveReferringDomains(
+	id common.SHA256Output,
+	table func(*tables) *associations,
+) ([]db.DomainRecord, error) {
+
+	c.s.mu.RLock()
+	defer c.s.mu.RUnlock()
+
+	var domains []db.DomainRecord
+	for domainID := range table(c.s.t).byID[id] {
+		domains = append(domains, db.DomainRecord{
+			DomainID:   domainID,
+			DomainName: c.s.t.domains[domainID],
+		})
+	}
+	slices.SortFunc(domains, func(a, b db.DomainRecord) int {
+		if c := strings.Compare(a.DomainName, b.DomainName); c != 0 {
+			return c
+		}
+		return compareIDs(a.DomainID, b.DomainID)
+	})
+	return domains, nil
+}
+
+// idsAndTheirID returns the hash of the glued IDs and a copy of them, or zero values if there
+// are none, like the domain_payloads table of MySQL.
+func idsAndTheirID(ids []byte) (common.SHA256Output, []byte, error) {
+	if len(ids) == 0 {
+		return common.SHA256Output{}, nil, nil
+	}
+	return common.SHA256Hash32Bytes(ids), bytes.Clone(ids), nil
+}
+
+func clonePayloadRecord(rec *db.PayloadRecord) *db.PayloadRecord {
+	clone := *rec
+	if rec.ParentID != nil {
+		parent := *rec.ParentID
+		clone.ParentID = &parent
+	}
+	clone.Payload = bytes.Clone(rec.Payload)
+	if rec.Entry != nil {
+		entry := cloneCertEntry(*rec.Entry)
+		clone.Entry = &entry
+	}
+	return &clone
+}
+
+func cloneCertEntry(e db.CertificateEntry) db.CertificateEntry {
+	if e.IssuerKeyHash != nil {
+		hash := *e.IssuerKeyHash
+		e.IssuerKeyHash = &hash
+	}
+	return e
+}
+
+func parentRecord(rec *db.PayloadRecord) db.ParentRecord {
+	r := db.ParentRecord{ID: rec.ID}
+	if rec.ParentID != nil {
+		parent := *rec.ParentID
+		r.ParentID = &parent
+	}
+	return r
+}
@@ -0,0 +1,16 @@
+package embedded_test
+
+import (
+	"testing"
+
+	"github.com/netsec-ethz/fpki/pkg/db"
+	"github.com/netsec-ethz/fpki/pkg/db/dbtest"
+)
+
+func TestConformance(t *testing.T) {
+	dbtest.Run(t, dbtest.Backend{
+		New: func(t *testing.T) db.Conn {
+			return connect(t, t.TempDir())
+		},
+	})
+}
@@ -0,0 +1,122 @@
+package embedded
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	ct "github.com/google/certificate-transparency-go"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/db"
+)
+
+// csvChunkSize is the number of CSV rows inserted at once.
+const csvChunkSize = 10_000
+
+// insertCsv reads the CSV file written for the LOAD DATA statements of the MySQL backend,
+// and calls insert with chunks of its rows, each one with the given number of columns.
+func insertCsv(filename string, columns int, insert func(rows [][]string) error) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("opening CSV file: %w", err)
+	}
+	defer f.Close()
+
+	if err := streamCsv(f, columns, insert); err != nil {
+		return fmt.Errorf("CSV file %s: %w", filename, err)
+	}
+	return nil
+}
+
+// streamCsv is like insertCsv, with the CSV rows read from r.
+func streamCsv(r io.Reader, columns int, insert func(rows [][]string) error) error {
+	cr := csv.NewReader(bufio.NewReaderSize(r, 1024*1024))
+	cr.FieldsPerRecord = columns
+	cr.LazyQuotes = true
+	cr.ReuseRecord = false
+
+	rows := make([][]string, 0, csvChunkSize)
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading CSV: %w", err)
+		}
+		rows = append(rows, row)
+		if len(rows) == csvChunkSize {
+			if err := insert(rows); err != nil {
+				return fmt.Errorf("inserting CSV rows: %w", err)
+			}
+			rows = rows[:0]
+		}
+	}
+	if len(rows) > 0 {
+		if err := insert(rows); err != nil {
+			return fmt.Errorf("inserting CSV rows: %w", err)
+		}
+	}
+	return nil
+}
+
+func parseBase64ID(s string) (common.SHA256Output, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(b) != common.SHA256Size {
+		return common.SHA256Output{}, fmt.Errorf("invalid ID %q", s)
+	}
+	return (common.SHA256Output)(b), nil
+}
+
+func decodeBase64(s string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64 field: %w", err)
+	}
+	return b, nil
+}
+
+// parseBase64OptionalID returns nil for an empty string.
+func parseBase64OptionalID(s string) (*common.SHA256Output, error) {
+	if s == "" {
+		return nil, nil
+	}
+	id, err := parseBase64ID(s)
+	return &id, err
+}
+
+// parseCertEntry returns the entry of the entry type, TBS ID and issuer key hash columns, or
+// nil if they are empty.
+func parseCertEntry(entryType, tbsID, issuerKeyHash string) (*db.CertificateEntry, error) {
+	if entryType == "" {
+		return nil, nil
+	}
+	t, err := strconv.ParseUint(entryType, 10, 8)
+	if err != nil {
+		return nil, fmt.Errorf("invalid entry type %q", entryType)
+	}
+	e := &db.CertificateEntry{Type: ct.LogEntryType(t)}
+	if e.TBSID, err = parseBase64ID(tbsID); err != nil {
+		return nil, err
+	}
+	if e.IssuerKeyHash, err = parseBase64OptionalID(issuerKeyHash); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// toDateTime returns the time as stored in a DATETIME column of MySQL: its wall clock
+// without fractional seconds, in UTC.
+func toDateTime(t time.Time) time.Time {
+	parsed, err := time.Parse(time.DateTime, t.Format(time.DateTime))
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}
@@ -0,0 +1,190 @@
+package embedded
+
+import (
+	"context"
+	"io"
+	"maps"
+
+	ct "github.com/google/certificate-transparency-go"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/db"
+)
+
+func (c *embeddedDB) DirtyCount(ctx context.Context) (uint64, error) {
+	c.s.mu.RLock()
+	defer c.s.mu.RUnlock()
+	return uint64(len(c.s.t.dirty)), nil
+}
+
+// RetrieveDirtyDomains returns the IDs of the dirty domains, sorted.
+func (c *embeddedDB) RetrieveDirtyDomains(ctx context.Context) ([]common.SHA256Output, error) {
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+
+	ids := sortedKeys(c.s.t.dirty, &c.s.t.sortedDirty)
+	return append(make([]common.SHA256Output, 0, len(ids)), ids...), nil
+}
+
+// CheckDomainsDirty returns whether each domain is dirty.
+func (c *embeddedDB) CheckDomainsDirty(ctx context.Context, ids []common.SHA256Output,
+) ([]bool, error) {
+
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	c.s.mu.RLock()
+	defer c.s.mu.RUnlock()
+
+	dirty := make([]bool, len(ids))
+	for i, id := range ids {
+		_, dirty[i] = c.s.t.dirty[id]
+	}
+	return dirty, nil
+}
+
+// InsertDomainsIntoDirty marks the domains as dirty and not coalesced.
+func (c *embeddedDB) InsertDomainsIntoDirty(ctx context.Context, domainIDs []common.SHA256Output,
+) error {
+
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+
+	recs := make([]record, 0, len(domainIDs))
+	seen := make(map[common.SHA256Output]struct{}, len(domainIDs))
+	for _, id := range domainIDs {
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		recs = append(recs, newRecord(opPutDirty, clone(id), boolField(false)))
+	}
+	return c.s.commit(recs...)
+}
+
+func (c *embeddedDB) InsertCsvIntoDirty(ctx context.Context, filename string) error {
+	return insertCsv(filename, 1, c.insertDirtyRows(ctx))
+}
+
+func (c *embeddedDB) StreamCsvIntoDirty(ctx context.Context, r io.Reader) error {
+	return streamCsv(r, 1, c.insertDirtyRows(ctx))
+}
+
+func (c *embeddedDB) insertDirtyRows(ctx context.Context) func(rows [][]string) error {
+	return func(rows [][]string) error {
+		ids := make([]common.SHA256Output, len(rows))
+		for i, row := range rows {
+			var err error
+			if ids[i], err = parseBase64ID(row[0]); err != nil {
+				return err
+			}
+		}
+		return c.InsertDomainsIntoDirty(ctx, ids)
+	}
+}
+
+// RecomputeDirtyDomainsCertAndPolicyIDs computes the payload of the dirty domains that are not
+// coalesced yet, as the calc_dirty_domains procedure of MySQL does: the IDs of the existing
+// certificates and policies of the domain and of their ancestors, without the precertificates
+// whose final certificate is also a certificate of the domain. Domains without any are
+// removed from the domains and domain_payloads tables.
+func (c *embeddedDB) RecomputeDirtyDomainsCertAndPolicyIDs(ctx context.Context) error {
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+
+	var recs []record
+	for domainID, coalesced := range c.s.t.dirty {
+		if coalesced {
+			continue
+		}
+		certIDs := closure(c.s.t.certs,
+			c.s.t.withoutFinalizedPrecerts(c.s.t.domainCerts.byDomain[domainID]))
+		policyIDs := closure(c.s.t.policies, c.s.t.domainPolicies.byDomain[domainID])
+		if len(certIDs) == 0 && len(policyIDs) == 0 {
+			recs = append(recs,
+				newRecord(opDelPayload, clone(domainID)),
+				newRecord(opDelDomain, clone(domainID)))
+		} else {
+			recs = append(recs, newRecord(opPutPayload, clone(domainID), certIDs, policyIDs))
+		}
+		recs = append(recs, newRecord(opPutDirty, clone(domainID), boolField(true)))
+	}
+	return c.s.commit(recs...)
+}
+
+// CleanupDirty removes all entries from the dirty table.
+func (c *embeddedDB) CleanupDirty(ctx context.Context) error {
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	return c.s.commit(newRecord(opClearDirty))
+}
+
+// closure returns the sorted and glued IDs of the existing payloads in ids and their
+// ancestors, or nil if there are none.
+func closure(
+	payloads map[common.SHA256Output]*db.PayloadRecord,
+	ids map[common.SHA256Output]struct{},
+) []byte {
+
+	var found []common.SHA256Output
+	seen := make(map[common.SHA256Output]struct{}, len(ids))
+	for id := range ids {
+		for {
+			if _, ok := seen[id]; ok {
+				break
+			}
+			rec, ok := payloads[id]
+			if !ok {
+				break
+			}
+			seen[id] = struct{}{}
+			found = append(found, id)
+			if rec.ParentID == nil {
+				break
+			}
+			id = *rec.ParentID
+		}
+	}
+	if len(found) == 0 {
+		return nil
+	}
+	return common.SortIDsAndGlue(found)
+}
+
+// withoutFinalizedPrecerts returns the IDs of the certificates of a domain without the
+// precertificates whose final certificate is also one of them, according to their entries.
+func (t *tables) withoutFinalizedPrecerts(ids map[common.SHA256Output]struct{},
+) map[common.SHA256Output]struct{} {
+
+	if len(ids) < 2 {
+		return ids
+	}
+	finals := make(map[common.SHA256Output]struct{})
+	var precerts []*db.PayloadRecord
+	for id := range ids {
+		rec, ok := t.certs[id]
+		if !ok || rec.Entry == nil {
+			continue
+		}
+		switch rec.Entry.Type {
+		case ct.PrecertLogEntryType:
+			precerts = append(precerts, rec)
+		case ct.X509LogEntryType:
+			finals[rec.Entry.TBSID] = struct{}{}
+		}
+	}
+	var finalized []common.SHA256Output
+	for _, rec := range precerts {
+		if _, ok := finals[rec.Entry.TBSID]; ok {
+			finalized = append(finalized, rec.ID)
+		}
+	}
+	if len(finalized) == 0 {
+		return ids
+	}
+	ids = maps.Clone(ids)
+	for _, id := range finalized {
+		delete(ids, id)
+	}
+	return ids
+}
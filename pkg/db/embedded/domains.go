@@ -0,0 +1,133 @@
+package embedded
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/db"
+)
+
+// SearchDomains returns the domains selected by the search, sorted by their reversed name.
+func (c *embeddedDB) SearchDomains(ctx context.Context, search db.DomainSearch,
+) ([]db.DomainRecord, error) {
+
+	c.s.mu.RLock()
+	defer c.s.mu.RUnlock()
+
+	after := reverseString(search.After)
+	var domains []db.DomainRecord
+	var reversed []string
+	for id, name := range c.s.t.domains {
+		if !matchesSearch(name, search) {
+			continue
+		}
+		r := reverseString(name)
+		if search.After != "" && r <= after {
+			continue
+		}
+		domains = append(domains, db.DomainRecord{DomainID: id, DomainName: name})
+		reversed = append(reversed, r)
+	}
+
+	order := make([]int, len(domains))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortFunc(order, func(a, b int) int {
+		if c := strings.Compare(reversed[a], reversed[b]); c != 0 {
+			return c
+		}
+		return compareIDs(domains[a].DomainID, domains[b].DomainID)
+	})
+	if search.Limit > 0 && len(order) > search.Limit {
+		order = order[:search.Limit]
+	}
+	sorted := make([]db.DomainRecord, len(order))
+	for i, j := range order {
+		sorted[i] = domains[j]
+	}
+	return sorted, nil
+}
+
+// CountDomains returns the number of domains selected by the search, ignoring its pagination.
+func (c *embeddedDB) CountDomains(ctx context.Context, search db.DomainSearch) (uint64, error) {
+	c.s.mu.RLock()
+	defer c.s.mu.RUnlock()
+
+	var count uint64
+	for _, name := range c.s.t.domains {
+		if matchesSearch(name, search) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+// RetrieveDomains returns the rows of the domains table for the IDs. Missing domains are skipped.
+func (c *embeddedDB) RetrieveDomains(ctx context.Context, ids []common.SHA256Output,
+) ([]db.DomainRecord, error) {
+
+	c.s.mu.RLock()
+	defer c.s.mu.RUnlock()
+
+	var domains []db.DomainRecord
+	seen := make(map[common.SHA256Output]struct{}, len(ids))
+	for _, id := range ids {
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		if name, ok := c.s.t.domains[id]; ok {
+			domains = append(domains, db.DomainRecord{DomainID: id, DomainName: name})
+		}
+	}
+	return domains, nil
+}
+
+// matchesSearch returns whether the domain name matches the suffix and pattern of the search.
+func matchesSearch(name string, search db.DomainSearch) bool {
+	if suffix := strings.Trim(search.Suffix, "."); suffix != "" &&
+		!strings.HasSuffix(name, "."+suffix) {
+
+		return false
+	}
+	return search.Pattern == "" || matchGlob(search.Pattern, name)
+}
+
+// matchGlob returns whether s matches the pattern, where '*' matches any sequence of
+// characters and '?' exactly one.
+func matchGlob(pattern, s string) bool {
+	// Backtrack to the last '*' on a mismatch.
+	p, i := 0, 0
+	star, next := -1, 0
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+			p++
+			i++
+		case p < len(pattern) && pattern[p] == '*':
+			star, next = p, i
+			p++
+		case star >= 0:
+			next++
+			p, i = star+1, next
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// reverseString reverses the bytes of s, as the reversed_name column of MySQL does.
+func reverseString(s string) string {
+	b := []byte(s)
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return string(b)
+}
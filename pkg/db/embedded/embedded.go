@@ -0,0 +1,301 @@
+// Package embedded implements db.Conn without MySQL, storing the tables in files of a local
+// directory.
+//
+// All tables are kept in memory. Every modification is appended to a log file before being
+// applied, and the log is compacted into a snapshot file when it grows larger than the
+// snapshot, and when the last connection is closed. Opening a directory replays the snapshot
+// and the log, ignoring an incomplete last record. This makes the backend suitable for small
+// deployments, development and CI, where the tables fit in memory.
+//
+// Connections to the same directory within a process share the same tables. A directory can
+// only be opened by one process at a time.
+package embedded
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/db"
+)
+
+// numPartitions is the number of partitions of the dirty table, as in the MySQL schema, which
+// determines the order in which RetrieveDomainEntriesDirtyBundle returns the domains.
+const numPartitions = 32
+
+// partitionOf returns the partition of the ID: the 5 most significant bits.
+func partitionOf(id common.SHA256Output) int {
+	return int(id[0] >> 3)
+}
+
+type embeddedDB struct {
+	s         *store
+	closeOnce sync.Once
+}
+
+var _ db.Conn = (*embeddedDB)(nil)
+
+// WithDirectory modifies the configuration to use the embedded backend, with its files in dir.
+func WithDirectory(dir string) db.ConfigurationModFunction {
+	return func(c *db.Configuration) *db.Configuration {
+		c.Backend = db.BackendEmbedded
+		c.Dir = dir
+		return c
+	}
+}
+
+// Connect opens the embedded DB in config.Dir, creating it if necessary.
+func Connect(config *db.Configuration) (*embeddedDB, error) {
+	if config == nil {
+		return nil, fmt.Errorf("nil config not allowed")
+	}
+	if config.Dir == "" {
+		return nil, fmt.Errorf("no directory for the embedded DB")
+	}
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("creating directory of the embedded DB: %w", err)
+	}
+	s, err := openStore(config.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("opening embedded DB in %s: %w", config.Dir, err)
+	}
+	return &embeddedDB{s: s}, nil
+}
+
+func (c *embeddedDB) Close() error {
+	err := fmt.Errorf("embedded DB %s already closed", c.s.dir)
+	c.closeOnce.Do(func() {
+		err = c.s.release()
+	})
+	return err
+}
+
+// CheckSchema never fails, as the tables are created when the directory is opened.
+func (c *embeddedDB) CheckSchema(ctx context.Context) error {
+	return nil
+}
+
+func (c *embeddedDB) CountRows(ctx context.Context) (*db.TableCounts, error) {
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+
+	return &db.TableCounts{
+		Certs:          uint64(len(c.s.t.certs)),
+		Policies:       uint64(len(c.s.t.policies)),
+		Domains:        uint64(len(c.s.t.domains)),
+		DomainCerts:    c.s.t.domainCerts.count(),
+		DomainPolicies: c.s.t.domainPolicies.count(),
+		Dirty:          uint64(len(c.s.t.dirty)),
+		TreeNodes:      uint64(len(c.s.t.tree)),
+		Epochs:         uint64(len(c.s.t.epochs)),
+	}, nil
+}
+
+// DisableRedoLog does nothing: the log of this backend is what persists the tables.
+func (c *embeddedDB) DisableRedoLog(ctx context.Context) error {
+	return nil
+}
+
+func (c *embeddedDB) TruncateAllTables(ctx context.Context) error {
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	return c.s.commit(newRecord(opTruncate), newIdentityRecord())
+}
+
+// Identity returns the identity of the DB, created when its directory was first opened.
+func (c *embeddedDB) Identity(ctx context.Context) (db.Identity, error) {
+	c.s.mu.RLock()
+	defer c.s.mu.RUnlock()
+	return c.s.t.identity, nil
+}
+
+// newIdentityRecord returns the record of a new random identity.
+func newIdentityRecord() record {
+	id := make([]byte, len(db.Identity{}))
+	rand.Read(id)
+	return newRecord(opPutIdentity, id)
+}
+
+// UpdateDomains inserts the domains, keeping the existing names.
+func (c *embeddedDB) UpdateDomains(
+	ctx context.Context,
+	domainIDs []common.SHA256Output,
+	domainNames []string,
+) error {
+
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+
+	recs := make([]record, 0, len(domainIDs))
+	seen := make(map[common.SHA256Output]struct{}, len(domainIDs))
+	for i, id := range domainIDs {
+		if _, ok := c.s.t.domains[id]; ok {
+			continue
+		}
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		recs = append(recs, newRecord(opPutDomain, clone(id), []byte(domainNames[i])))
+	}
+	return c.s.commit(recs...)
+}
+
+func (c *embeddedDB) InsertCsvIntoDomains(ctx context.Context, filename string) error {
+	return insertCsv(filename, 2, c.insertDomainsRows(ctx))
+}
+
+func (c *embeddedDB) StreamCsvIntoDomains(ctx context.Context, r io.Reader) error {
+	return streamCsv(r, 2, c.insertDomainsRows(ctx))
+}
+
+func (c *embeddedDB) insertDomainsRows(ctx context.Context) func(rows [][]string) error {
+	return func(rows [][]string) error {
+		ids := make([]common.SHA256Output, len(rows))
+		names := make([]string, len(rows))
+		for i, row := range rows {
+			var err error
+			if ids[i], err = parseBase64ID(row[0]); err != nil {
+				return err
+			}
+			names[i] = row[1]
+		}
+		return c.UpdateDomains(ctx, ids, names)
+	}
+}
+
+// RetrieveDomainEntries retrieves domain-entry payloads for the specified domain IDs.
+// Missing payload rows are omitted from the result; callers should check the result length.
+func (c *embeddedDB) RetrieveDomainEntries(ctx context.Context, domainIDs []common.SHA256Output,
+) ([]db.DomainEntryRecord, error) {
+
+	c.s.mu.RLock()
+	defer c.s.mu.RUnlock()
+
+	entries := make([]db.DomainEntryRecord, 0, len(domainIDs))
+	for _, id := range domainIDs {
+		if p, ok := c.s.t.payloads[id]; ok {
+			entries = append(entries, db.DomainEntryRecord{
+				DomainID: id,
+				Payload:  p.entry(),
+			})
+		}
+	}
+	return entries, nil
+}
+
+// RetrieveDomainEntriesDirtyOnes returns the entries of the dirty domains sorted by ID in
+// [start,end), with an empty payload for the ones without payload.
+func (c *embeddedDB) RetrieveDomainEntriesDirtyOnes(
+	ctx context.Context,
+	start uint64,
+	end uint64,
+) ([]db.DomainEntryRecord, error) {
+
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+
+	ids := sortedKeys(c.s.t.dirty, &c.s.t.sortedDirty)
+	start = min(start, uint64(len(ids)))
+	end = min(max(start, end), uint64(len(ids)))
+	entries := make([]db.DomainEntryRecord, 0, end-start)
+	for _, id := range ids[start:end] {
+		entries = append(entries, db.DomainEntryRecord{
+			DomainID: id,
+			Payload:  c.s.t.payloads[id].entry(),
+		})
+	}
+	return entries, nil
+}
+
+// RetrieveDomainEntriesDirtyBundle returns the dirty domains partition by partition, like the
+// MySQL backend does. Domains without payload have a nil payload.
+func (c *embeddedDB) RetrieveDomainEntriesDirtyBundle(
+	ctx context.Context,
+	cursor *db.DirtyDomainEntriesCursor,
+	maxBundleSize uint64,
+) ([]db.DomainEntryRecord, *db.DirtyDomainEntriesCursor, bool, error) {
+
+	if maxBundleSize == 0 {
+		return nil, cursor, true, fmt.Errorf("max bundle size must be > 0")
+	}
+
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+
+	// Split the sorted dirty domains into their partitions.
+	partitions := make([][]common.SHA256Output, numPartitions)
+	for _, id := range sortedKeys(c.s.t.dirty, &c.s.t.sortedDirty) {
+		p := partitionOf(id)
+		partitions[p] = append(partitions[p], id)
+	}
+
+	state := normalizeCursor(cursor)
+	bundle := make([]db.DomainEntryRecord, 0, maxBundleSize)
+	for uint64(len(bundle)) < maxBundleSize {
+		active := make([]int, 0, numPartitions)
+		for i := range numPartitions {
+			p := (state.NextPartition + i) % numPartitions
+			if !state.PartitionExhausted[p] {
+				active = append(active, p)
+			}
+		}
+		if len(active) == 0 {
+			break
+		}
+
+		// Spread the remaining size of the bundle among the active partitions.
+		remaining := maxBundleSize - uint64(len(bundle))
+		base := remaining / uint64(len(active))
+		extra := remaining % uint64(len(active))
+		for i, p := range active {
+			limit := base
+			if uint64(i) < extra {
+				limit++
+			}
+			offset := min(state.PartitionOffsets[p], uint64(len(partitions[p])))
+			ids := partitions[p][offset:min(offset+limit, uint64(len(partitions[p])))]
+			for _, id := range ids {
+				var payload []byte
+				if p, ok := c.s.t.payloads[id]; ok {
+					payload = p.entry()
+				}
+				bundle = append(bundle, db.DomainEntryRecord{DomainID: id, Payload: payload})
+			}
+			state.PartitionOffsets[p] += uint64(len(ids))
+			if uint64(len(ids)) < limit {
+				state.PartitionExhausted[p] = true
+			}
+		}
+		state.NextPartition = (active[0] + 1) % numPartitions
+	}
+
+	done := true
+	for _, exhausted := range state.PartitionExhausted {
+		done = done && exhausted
+	}
+	return bundle, state, done, nil
+}
+
+func normalizeCursor(cursor *db.DirtyDomainEntriesCursor) *db.DirtyDomainEntriesCursor {
+	state := &db.DirtyDomainEntriesCursor{
+		PartitionOffsets:   make([]uint64, numPartitions),
+		PartitionExhausted: make([]bool, numPartitions),
+	}
+	if cursor != nil {
+		copy(state.PartitionOffsets, cursor.PartitionOffsets)
+		copy(state.PartitionExhausted, cursor.PartitionExhausted)
+		state.NextPartition = cursor.NextPartition % numPartitions
+	}
+	return state
+}
+
+// entry returns the payload of the domain as consumed by the SMT updater.
+func (p domainPayload) entry() []byte {
+	ids := append(common.BytesToIDs(p.certIDs), common.BytesToIDs(p.policyIDs)...)
+	return common.SortIDsAndGlue(ids)
+}
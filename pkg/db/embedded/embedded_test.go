@@ -0,0 +1,299 @@
+package embedded_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/db"
+	"github.com/netsec-ethz/fpki/pkg/db/embedded"
+)
+
+// TestReopen checks that the tables survive closing and opening the directory again.
+func TestReopen(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	conn := connect(t, dir)
+
+	// Two connections to the same directory share the tables.
+	other := connect(t, dir)
+	require.NoError(t, other.Close())
+
+	root, leaf := id(1), id(2)
+	expiration := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	err := conn.UpdateCerts(ctx,
+		[]common.SHA256Output{root, leaf},
+		[]*common.SHA256Output{nil, &root},
+		[]time.Time{expiration, expiration},
+		[][]byte{[]byte("root"), []byte("leaf")},
+		nil)
+	require.NoError(t, err)
+	require.NoError(t, conn.UpdateDomains(ctx, []common.SHA256Output{id(10)}, []string{"a.com"}))
+	require.NoError(t, conn.UpdateDomainCerts(ctx,
+		[]common.SHA256Output{id(10)}, []common.SHA256Output{leaf}))
+	require.NoError(t, conn.InsertDomainsIntoDirty(ctx, []common.SHA256Output{id(10)}))
+	require.NoError(t, conn.RecomputeDirtyDomainsCertAndPolicyIDs(ctx))
+	require.NoError(t, conn.UpdateLastCTlogServerState(ctx, "https://ct.example", 42, []byte("sth")))
+	_, err = conn.UpdateTreeNodes(ctx, []*db.TreeNodeRecord{{Key: id(20), Value: []byte("node")}})
+	require.NoError(t, err)
+	require.NoError(t, conn.SaveRoot(ctx, ptr(id(20))))
+	epoch, err := conn.RecordEpoch(ctx)
+	require.NoError(t, err)
+	require.NoError(t, conn.EnqueueIngestJob(ctx, &db.IngestJob{Name: "job"}, []db.IngestBatch{
+		{ID: 1, Key: "log", Start: 0, End: 9, Files: []string{"0-9.gz"}},
+	}))
+	batch, err := conn.ClaimIngestBatch(ctx, "job", "worker", time.Hour)
+	require.NoError(t, err)
+	identity, err := conn.Identity(ctx)
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+
+	conn = connect(t, dir)
+	defer conn.Close()
+
+	records, err := conn.RetrieveCertificateRecords(ctx, []common.SHA256Output{leaf, id(3)})
+	require.NoError(t, err)
+	require.Equal(t, []*db.PayloadRecord{{
+		ID:         leaf,
+		ParentID:   &root,
+		Expiration: expiration,
+		Payload:    []byte("leaf"),
+	}, nil}, records)
+
+	entries, err := conn.RetrieveDomainEntries(ctx, []common.SHA256Output{id(10)})
+	require.NoError(t, err)
+	require.Equal(t, []db.DomainEntryRecord{{
+		DomainID: id(10),
+		Payload:  common.SortIDsAndGlue([]common.SHA256Output{root, leaf}),
+	}}, entries)
+
+	size, sth, err := conn.LastCTlogServerState(ctx, "https://ct.example")
+	require.NoError(t, err)
+	require.Equal(t, int64(42), size)
+	require.Equal(t, []byte("sth"), sth)
+
+	value, err := conn.RetrieveTreeNode(ctx, id(20))
+	require.NoError(t, err)
+	require.Equal(t, []byte("node"), value)
+	gotRoot, err := conn.LoadRoot(ctx)
+	require.NoError(t, err)
+	require.Equal(t, ptr(id(20)), gotRoot)
+	lastEpoch, err := conn.LastEpoch(ctx)
+	require.NoError(t, err)
+	require.Equal(t, epoch, lastEpoch)
+
+	job, batches, err := conn.RetrieveIngestJob(ctx, "job")
+	require.NoError(t, err)
+	require.Equal(t, &db.IngestJob{Name: "job"}, job)
+	require.Len(t, batches, 1)
+	require.True(t, batch.LeaseExpiry.Equal(batches[0].LeaseExpiry))
+	batches[0].LeaseExpiry = batch.LeaseExpiry
+	require.Equal(t, *batch, batches[0])
+
+	gotIdentity, err := conn.Identity(ctx)
+	require.NoError(t, err)
+	require.Equal(t, identity, gotIdentity)
+}
+
+// TestTornSnapshot checks that an incomplete last record is ignored, and that a corrupt record
+// followed by others is an error.
+func TestTornSnapshot(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	conn := connect(t, dir)
+	require.NoError(t, conn.UpdateDomains(ctx, []common.SHA256Output{id(1)}, []string{"a.com"}))
+	require.NoError(t, conn.UpdateDomains(ctx, []common.SHA256Output{id(2)}, []string{"b.com"}))
+	require.NoError(t, conn.Close()) // Writes the snapshot.
+
+	snapshot := filepath.Join(dir, "snapshot")
+	valid, err := os.ReadFile(snapshot)
+	require.NoError(t, err)
+	tails := map[string][]byte{
+		"huge size":    binary.AppendUvarint(nil, 1<<40),
+		"beyond end":   append(binary.AppendUvarint(nil, 100), 1, 2, 3, 4, 5),
+		"bad checksum": append(binary.AppendUvarint(nil, 3), 0, 0, 0, 0, 1, 2, 3),
+	}
+	for name, tail := range tails {
+		t.Run(name, func(t *testing.T) {
+			require.NoError(t, os.WriteFile(snapshot, append(slices.Clip(valid), tail...), 0644))
+			conn := connect(t, dir)
+			defer conn.Close()
+			domains, err := conn.RetrieveDomainsPage(ctx, nil, 10)
+			require.NoError(t, err)
+			require.Len(t, domains, 2)
+		})
+	}
+
+	// Corrupt the record of a.com, which is followed by the one of b.com.
+	corrupt := bytes.Replace(valid, []byte("a.com"), []byte("x.com"), 1)
+	require.NotEqual(t, valid, corrupt)
+	require.NoError(t, os.WriteFile(snapshot, corrupt, 0644))
+	_, err = embedded.Connect(db.NewConfig(embedded.WithDirectory(dir)))
+	require.ErrorContains(t, err, "corrupt record")
+}
+
+// TestCoalesceAndPrune checks the payloads of the domains computed when coalescing, and that
+// pruning removes the expired certificates with their descendants.
+func TestCoalesceAndPrune(t *testing.T) {
+	ctx := context.Background()
+	conn := connect(t, t.TempDir())
+	defer conn.Close()
+
+	// a.com has the chain leafA->c1->c0, b.com has leafB->c1->c0, and c.com has a policy.
+	c0, c1, leafA, leafB, pol := id(1), id(2), id(3), id(4), id(5)
+	a, b, c := id(10), id(11), id(12)
+	expired := time.Unix(100, 0).UTC()
+	now := expired.Add(time.Hour)
+	valid := now.Add(time.Hour)
+	err := conn.UpdateCerts(ctx,
+		[]common.SHA256Output{c0, c1, leafA, leafB},
+		[]*common.SHA256Output{nil, &c0, &c1, &c1},
+		[]time.Time{valid, valid, valid, expired},
+		[][]byte{{0}, {1}, {2}, {3}},
+		nil)
+	require.NoError(t, err)
+	err = conn.UpdatePolicies(ctx, []common.SHA256Output{pol}, []*common.SHA256Output{nil},
+		[]time.Time{valid}, [][]byte{{5}})
+	require.NoError(t, err)
+	err = conn.UpdateDomains(ctx, []common.SHA256Output{a, b, c},
+		[]string{"a.com", "b.com", "c.com"})
+	require.NoError(t, err)
+	err = conn.UpdateDomainCerts(ctx, []common.SHA256Output{a, b}, []common.SHA256Output{leafA, leafB})
+	require.NoError(t, err)
+	err = conn.UpdateDomainPolicies(ctx, []common.SHA256Output{c}, []common.SHA256Output{pol})
+	require.NoError(t, err)
+	require.NoError(t, conn.InsertDomainsIntoDirty(ctx, []common.SHA256Output{a, b, c}))
+	require.NoError(t, conn.RecomputeDirtyDomainsCertAndPolicyIDs(ctx))
+
+	certIDsID, certIDs, err := conn.RetrieveDomainCertificatesIDs(ctx, a)
+	require.NoError(t, err)
+	require.Equal(t, common.SortIDsAndGlue([]common.SHA256Output{c0, c1, leafA}), certIDs)
+	require.Equal(t, common.SHA256Hash32Bytes(certIDs), certIDsID)
+	policyIDsID, policyIDs, err := conn.RetrieveDomainPoliciesIDs(ctx, a)
+	require.NoError(t, err)
+	require.Equal(t, common.SHA256Output{}, policyIDsID)
+	require.Nil(t, policyIDs)
+	_, policyIDs, err = conn.RetrieveDomainPoliciesIDs(ctx, c)
+	require.NoError(t, err)
+	require.Equal(t, pol[:], policyIDs)
+	require.NoError(t, conn.CleanupDirty(ctx))
+
+	// Inserting an existing certificate does not modify it: only leafB is pruned, which marks
+	// b.com as dirty.
+	err = conn.UpdateCerts(ctx, []common.SHA256Output{c1}, []*common.SHA256Output{&c0},
+		[]time.Time{expired}, [][]byte{{1}}, nil)
+	require.NoError(t, err)
+	records, err := conn.RetrieveCertificateRecords(ctx, []common.SHA256Output{c1})
+	require.NoError(t, err)
+	require.Equal(t, valid, records[0].Expiration)
+	require.NoError(t, conn.PruneCerts(ctx, now))
+	exist, err := conn.CheckCertsExist(ctx, []common.SHA256Output{c0, c1, leafA, leafB})
+	require.NoError(t, err)
+	require.Equal(t, []bool{true, true, true, false}, exist)
+	dirty, err := conn.RetrieveDirtyDomains(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []common.SHA256Output{b}, dirty)
+
+	// b.com has no certificates left, and is removed when coalescing.
+	require.NoError(t, conn.RecomputeDirtyDomainsCertAndPolicyIDs(ctx))
+	domains, err := conn.RetrieveDomains(ctx, []common.SHA256Output{a, b, c})
+	require.NoError(t, err)
+	require.Equal(t, []db.DomainRecord{
+		{DomainID: a, DomainName: "a.com"},
+		{DomainID: c, DomainName: "c.com"},
+	}, domains)
+	entries, err := conn.RetrieveDomainEntriesDirtyOnes(ctx, 0, 10)
+	require.NoError(t, err)
+	require.Equal(t, []db.DomainEntryRecord{{DomainID: b, Payload: []byte{}}}, entries)
+
+	// Pruning the root removes its descendants.
+	require.NoError(t, conn.PruneCerts(ctx, valid.Add(time.Second)))
+	exist, err = conn.CheckCertsExist(ctx, []common.SHA256Output{c0, c1, leafA})
+	require.NoError(t, err)
+	require.Equal(t, []bool{false, false, false}, exist)
+}
+
+// TestDirtyBundle checks that the dirty domains are returned exactly once in bundles.
+func TestDirtyBundle(t *testing.T) {
+	ctx := context.Background()
+	conn := connect(t, t.TempDir())
+	defer conn.Close()
+
+	var ids []common.SHA256Output
+	for i := range 100 {
+		ids = append(ids, common.SHA256Hash32Bytes([]byte{byte(i)}))
+	}
+	require.NoError(t, conn.InsertDomainsIntoDirty(ctx, ids))
+
+	seen := make(map[common.SHA256Output]struct{})
+	var cursor *db.DirtyDomainEntriesCursor
+	for done := false; !done; {
+		var bundle []db.DomainEntryRecord
+		var err error
+		bundle, cursor, done, err = conn.RetrieveDomainEntriesDirtyBundle(ctx, cursor, 7)
+		require.NoError(t, err)
+		require.LessOrEqual(t, len(bundle), 7)
+		for _, e := range bundle {
+			require.NotContains(t, seen, e.DomainID)
+			require.Nil(t, e.Payload)
+			seen[e.DomainID] = struct{}{}
+		}
+	}
+	require.Len(t, seen, len(ids))
+}
+
+// TestTreeNodesPage checks that replaced nodes get a new row ID, as with MySQL.
+func TestTreeNodesPage(t *testing.T) {
+	ctx := context.Background()
+	conn := connect(t, t.TempDir())
+	defer conn.Close()
+
+	n, err := conn.UpdateTreeNodes(ctx, []*db.TreeNodeRecord{
+		{Key: id(1), Value: []byte{1}},
+		{Key: id(2), Value: []byte{2}},
+		{Key: id(3), Value: []byte{3}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+	n, err = conn.UpdateTreeNodes(ctx, []*db.TreeNodeRecord{{Key: id(1), Value: []byte{4}}})
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	n, err = conn.DeleteTreeNodes(ctx, []common.SHA256Output{id(2), id(9)})
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	nodes, last, err := conn.RetrieveTreeNodesPage(ctx, 0, 100, 100)
+	require.NoError(t, err)
+	require.Equal(t, []*db.TreeNodeRecord{
+		{Key: id(3), Value: []byte{3}},
+		{Key: id(1), Value: []byte{4}},
+	}, nodes)
+	require.Equal(t, uint64(4), last)
+
+	nodes, last, err = conn.RetrieveTreeNodesPage(ctx, 3, 100, 100)
+	require.NoError(t, err)
+	require.Len(t, nodes, 1)
+	require.Equal(t, uint64(4), last)
+}
+
+func connect(t *testing.T, dir string) db.Conn {
+	conn, err := embedded.Connect(db.NewConfig(embedded.WithDirectory(dir)))
+	require.NoError(t, err)
+	return conn
+}
+
+func id(b byte) common.SHA256Output {
+	return common.SHA256Output{b}
+}
+
+func ptr(id common.SHA256Output) *common.SHA256Output {
+	return &id
+}
@@ -0,0 +1,157 @@
+package embedded
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/db"
+)
+
+// RecordEpoch stores a new epoch with the current root and the largest row ID of the tree
+// table, and associates all the domains in the dirty table with it.
+func (c *embeddedDB) RecordEpoch(ctx context.Context) (*db.Epoch, error) {
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+
+	if c.s.t.root == nil {
+		return nil, fmt.Errorf("recording epoch: no root")
+	}
+	epoch := &db.Epoch{
+		Number: 1,
+		Root:   *c.s.t.root,
+		TreeID: c.s.t.largestTreeRowID(),
+	}
+	for number := range c.s.t.epochs {
+		epoch.Number = max(epoch.Number, number+1)
+	}
+
+	recs := make([]record, 0, len(c.s.t.dirty)+1)
+	recs = append(recs, epochRecord(epoch))
+	for id := range c.s.t.dirty {
+		recs = append(recs, newRecord(opPutEpochDomain, uint64Field(epoch.Number), clone(id)))
+	}
+	if err := c.s.commit(recs...); err != nil {
+		return nil, fmt.Errorf("recording epoch %d: %w", epoch.Number, err)
+	}
+	return epoch, nil
+}
+
+// SaveEpoch stores the epoch as is, and its root as the current one. Its domains are not
+// recorded.
+func (c *embeddedDB) SaveEpoch(ctx context.Context, epoch *db.Epoch) error {
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+
+	if _, ok := c.s.t.epochs[epoch.Number]; ok {
+		return fmt.Errorf("saving epoch %d: duplicate epoch", epoch.Number)
+	}
+	return c.s.commit(newRecord(opPutRoot, clone(epoch.Root)), epochRecord(epoch))
+}
+
+func (c *embeddedDB) LastEpoch(ctx context.Context) (*db.Epoch, error) {
+	c.s.mu.RLock()
+	defer c.s.mu.RUnlock()
+
+	var last *db.Epoch
+	for _, e := range c.s.t.epochs {
+		if last == nil || e.Number > last.Number {
+			e := e
+			last = &e
+		}
+	}
+	return last, nil
+}
+
+func (c *embeddedDB) RetrieveEpoch(ctx context.Context, number uint64) (*db.Epoch, error) {
+	c.s.mu.RLock()
+	defer c.s.mu.RUnlock()
+
+	if e, ok := c.s.t.epochs[number]; ok {
+		return &e, nil
+	}
+	return nil, nil
+}
+
+// RetrieveEpochDomainsPage returns the IDs of the domains modified in the epochs in (from,to].
+func (c *embeddedDB) RetrieveEpochDomainsPage(
+	ctx context.Context,
+	from, to uint64,
+	after *common.SHA256Output,
+	limit int,
+) ([]common.SHA256Output, error) {
+
+	c.s.mu.RLock()
+	defer c.s.mu.RUnlock()
+
+	distinct := make(map[common.SHA256Output]struct{})
+	for number, ids := range c.s.t.epochDomains {
+		if number <= from || number > to {
+			continue
+		}
+		for id := range ids {
+			if after == nil || compareIDs(id, *after) > 0 {
+				distinct[id] = struct{}{}
+			}
+		}
+	}
+	ids := make([]common.SHA256Output, 0, len(distinct))
+	for id := range distinct {
+		ids = append(ids, id)
+	}
+	slices.SortFunc(ids, compareIDs)
+	return ids[:min(max(limit, 0), len(ids))], nil
+}
+
+// RetrieveTreeNodesPage returns the nodes of the tree table with a row ID in (after,upTo].
+// As with MySQL, a modified node always gets a new row ID.
+func (c *embeddedDB) RetrieveTreeNodesPage(
+	ctx context.Context,
+	after, upTo uint64,
+	limit int,
+) ([]*db.TreeNodeRecord, uint64, error) {
+
+	c.s.mu.RLock()
+	defer c.s.mu.RUnlock()
+
+	rows := c.s.t.treeRows
+	start, _ := slices.BinarySearchFunc(rows, after+1, func(r treeRow, id uint64) int {
+		return cmp.Compare(r.rowID, id)
+	})
+	last := after
+	var nodes []*db.TreeNodeRecord
+	for _, row := range rows[start:] {
+		if row.rowID > upTo || len(nodes) >= limit {
+			break
+		}
+		node, ok := c.s.t.tree[row.key]
+		if !ok || node.rowID != row.rowID {
+			// Stale row of a replaced or deleted node.
+			continue
+		}
+		nodes = append(nodes, &db.TreeNodeRecord{
+			Key:   row.key,
+			Value: bytes.Clone(node.value),
+		})
+		last = row.rowID
+	}
+	return nodes, last, nil
+}
+
+// largestTreeRowID returns the largest row ID of the existing tree nodes, or zero.
+func (t *tables) largestTreeRowID() uint64 {
+	for i := len(t.treeRows) - 1; i >= 0; i-- {
+		row := t.treeRows[i]
+		if node, ok := t.tree[row.key]; ok && node.rowID == row.rowID {
+			return row.rowID
+		}
+	}
+	return 0
+}
+
+func epochRecord(e *db.Epoch) record {
+	return newRecord(opPutEpoch, uint64Field(e.Number), clone(e.Root), uint64Field(e.TreeID))
+}
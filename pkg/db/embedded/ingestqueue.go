@@ -0,0 +1,236 @@
+package embedded
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/netsec-ethz/fpki/pkg/db"
+)
+
+// EnqueueIngestJob stores the job and its batches, all pending.
+func (c *embeddedDB) EnqueueIngestJob(
+	ctx context.Context,
+	job *db.IngestJob,
+	batches []db.IngestBatch,
+) error {
+
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+
+	if _, ok := c.s.t.ingestJobs[job.Name]; ok {
+		return fmt.Errorf("enqueuing ingest job %q: %w", job.Name, db.ErrIngestJobExists)
+	}
+	recs := make([]record, 0, len(batches)+1)
+	recs = append(recs, ingestJobRecord(db.IngestJob{
+		Name:     job.Name,
+		Strategy: job.Strategy,
+	}))
+	for _, b := range batches {
+		recs = append(recs, ingestBatchRecord(db.IngestBatch{
+			Job:   job.Name,
+			ID:    b.ID,
+			Key:   b.Key,
+			Start: b.Start,
+			End:   b.End,
+			Files: b.Files,
+		}))
+	}
+	if err := c.s.commit(recs...); err != nil {
+		return fmt.Errorf("enqueuing ingest job %q: %w", job.Name, err)
+	}
+	return nil
+}
+
+func (c *embeddedDB) RetrieveIngestJob(
+	ctx context.Context,
+	name string,
+) (*db.IngestJob, []db.IngestBatch, error) {
+
+	c.s.mu.RLock()
+	defer c.s.mu.RUnlock()
+
+	j, ok := c.s.t.ingestJobs[name]
+	if !ok {
+		return nil, nil, nil
+	}
+	job := j.job
+	batches := make([]db.IngestBatch, 0, len(j.batches))
+	for _, b := range j.sortedBatches() {
+		b.Files = slices.Clone(b.Files)
+		batches = append(batches, b)
+	}
+	return &job, batches, nil
+}
+
+func (c *embeddedDB) ClaimIngestBatch(
+	ctx context.Context,
+	job, worker string,
+	lease time.Duration,
+) (*db.IngestBatch, error) {
+
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+
+	j, ok := c.s.t.ingestJobs[job]
+	if !ok {
+		return nil, nil
+	}
+	now := time.Now()
+	for _, b := range j.sortedBatches() {
+		if b.Done || b.LeaseExpiry.After(now) {
+			continue
+		}
+		b.Worker = worker
+		b.LeaseExpiry = now.Add(lease)
+		if err := c.s.commit(ingestBatchRecord(b)); err != nil {
+			return nil, fmt.Errorf("claiming batch %d of ingest job %q: %w", b.ID, job, err)
+		}
+		b.Files = slices.Clone(b.Files)
+		return &b, nil
+	}
+	return nil, nil
+}
+
+func (c *embeddedDB) RenewIngestBatchLease(
+	ctx context.Context,
+	job string,
+	id uint64,
+	worker string,
+	lease time.Duration,
+) error {
+
+	return c.updateIngestBatch(job, id, worker, func(b *db.IngestBatch) {
+		b.LeaseExpiry = time.Now().Add(lease)
+	})
+}
+
+func (c *embeddedDB) CompleteIngestBatch(
+	ctx context.Context,
+	job string,
+	id uint64,
+	worker string,
+) error {
+
+	return c.updateIngestBatch(job, id, worker, func(b *db.IngestBatch) {
+		b.Done = true
+		b.LeaseExpiry = time.Time{}
+	})
+}
+
+func (c *embeddedDB) ClaimIngestFinalization(
+	ctx context.Context,
+	job, worker string,
+	lease time.Duration,
+) (bool, error) {
+
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+
+	j, ok := c.s.t.ingestJobs[job]
+	now := time.Now()
+	if !ok || j.job.Finalized || j.job.LeaseExpiry.After(now) {
+		return false, nil
+	}
+	for _, b := range j.batches {
+		if !b.Done {
+			return false, nil
+		}
+	}
+	claimed := j.job
+	claimed.Finalizer = worker
+	claimed.LeaseExpiry = now.Add(lease)
+	if err := c.s.commit(ingestJobRecord(claimed)); err != nil {
+		return false, fmt.Errorf("claiming finalization of ingest job %q: %w", job, err)
+	}
+	return true, nil
+}
+
+func (c *embeddedDB) RenewIngestFinalizationLease(
+	ctx context.Context,
+	job, worker string,
+	lease time.Duration,
+) error {
+
+	return c.updateIngestJob(job, worker, func(j *db.IngestJob) {
+		j.LeaseExpiry = time.Now().Add(lease)
+	})
+}
+
+func (c *embeddedDB) CompleteIngestFinalization(ctx context.Context, job, worker string) error {
+	return c.updateIngestJob(job, worker, func(j *db.IngestJob) {
+		j.Finalized = true
+		j.LeaseExpiry = time.Time{}
+	})
+}
+
+// updateIngestBatch modifies the batch if it is not done and the worker holds its lease.
+func (c *embeddedDB) updateIngestBatch(
+	job string,
+	id uint64,
+	worker string,
+	update func(*db.IngestBatch),
+) error {
+
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+
+	what := fmt.Sprintf("batch %d of ingest job %q", id, job)
+	j, ok := c.s.t.ingestJobs[job]
+	if !ok {
+		return fmt.Errorf("%s: %w", what, db.ErrIngestLeaseLost)
+	}
+	b, ok := j.batches[id]
+	if !ok || b.Done || b.Worker != worker {
+		return fmt.Errorf("%s: %w", what, db.ErrIngestLeaseLost)
+	}
+	update(&b)
+	if err := c.s.commit(ingestBatchRecord(b)); err != nil {
+		return fmt.Errorf("%s: %w", what, err)
+	}
+	return nil
+}
+
+// updateIngestJob modifies the job if it is not finalized and the worker holds the lease of
+// its finalization.
+func (c *embeddedDB) updateIngestJob(job, worker string, update func(*db.IngestJob)) error {
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+
+	what := fmt.Sprintf("finalization of ingest job %q", job)
+	j, ok := c.s.t.ingestJobs[job]
+	if !ok || j.job.Finalized || j.job.Finalizer != worker {
+		return fmt.Errorf("%s: %w", what, db.ErrIngestLeaseLost)
+	}
+	updated := j.job
+	update(&updated)
+	if err := c.s.commit(ingestJobRecord(updated)); err != nil {
+		return fmt.Errorf("%s: %w", what, err)
+	}
+	return nil
+}
+
+// sortedBatches returns the batches of the job sorted by ID.
+func (j *ingestJob) sortedBatches() []db.IngestBatch {
+	return slices.SortedFunc(maps.Values(j.batches), func(a, b db.IngestBatch) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+}
+
+func ingestJobRecord(j db.IngestJob) record {
+	expiry, _ := j.LeaseExpiry.MarshalBinary()
+	return newRecord(opPutIngestJob, []byte(j.Name), []byte(j.Strategy), []byte(j.Finalizer),
+		expiry, boolField(j.Finalized))
+}
+
+func ingestBatchRecord(b db.IngestBatch) record {
+	expiry, _ := b.LeaseExpiry.MarshalBinary()
+	files, _ := json.Marshal(b.Files)
+	return newRecord(opPutIngestBatch, []byte(b.Job), uint64Field(b.ID), []byte(b.Key),
+		uint64Field(b.Start), uint64Field(b.End), files, []byte(b.Worker), expiry,
+		boolField(b.Done))
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package embedded
+
+import "os"
+
+// lockDir only creates the file: other processes opening the same directory are not detected.
+func lockDir(filename string) (func() error, error) {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return f.Close, nil
+}
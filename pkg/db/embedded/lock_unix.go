@@ -0,0 +1,23 @@
+//go:build unix
+
+package embedded
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// lockDir takes an exclusive lock on the file, so that no other process opens the same
+// directory. It returns the function that releases the lock.
+func lockDir(filename string) (func() error, error) {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("already in use by another process: %w", err)
+	}
+	return f.Close, nil
+}
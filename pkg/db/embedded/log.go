@@ -0,0 +1,310 @@
+package embedded
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	snapshotFile = "snapshot"
+	logFile      = "log"
+	lockFile     = "LOCK"
+
+	// compactMinSize is the minimum size of the log before it is compacted into the snapshot.
+	compactMinSize = 64 * 1024 * 1024
+
+	// maxRecordSize bounds the size of the body of a record when reading it, so that a size
+	// damaged by a crash does not allocate it.
+	maxRecordSize = 1024 * 1024 * 1024
+)
+
+type opCode byte
+
+// Operations stored in the snapshot and log files. Each one unconditionally sets or removes
+// rows, so that replaying a log twice yields the same tables.
+const (
+	opGeneration      opCode = iota + 1 // generation
+	opTruncate                          //
+	opPutCert                           // id, parent, expiration, payload
+	opDelCert                           // id
+	opPutPolicy                         // id, parent, expiration, payload
+	opPutDomain                         // id, name
+	opDelDomain                         // id
+	opPutDomainCert                     // domain id, cert id
+	opDelDomainCert                     // domain id, cert id
+	opPutDomainPolicy                   // domain id, policy id
+	opDelDomainPolicy                   // domain id, policy id
+	opPutPayload                        // domain id, cert ids, policy ids
+	opDelPayload                        // domain id
+	opPutDirty                          // domain id, coalesced
+	opClearDirty                        //
+	opPutTreeNode                       // key, value, row id
+	opDelTreeNode                       // key
+	opPutRoot                           // root
+	opPutCTLogState                     // url hash, size, sth
+	opPutEpoch                          // number, root, tree id
+	opPutEpochDomain                    // number, domain id
+	opPutLastTreeID                     // row id
+	opPutIngestJob                      // name, strategy, finalizer, lease expiry, finalized
+	opPutIngestBatch                    // job, id, key, start, end, files, worker, lease expiry, done
+	opPutIdentity                       // identity
+	opPutCertEntry                      // id, entry type, tbs id, issuer key hash
+)
+
+// record is one operation with its fields.
+type record struct {
+	op     opCode
+	fields [][]byte
+}
+
+func newRecord(op opCode, fields ...[]byte) record {
+	return record{op: op, fields: fields}
+}
+
+func uint64Field(n uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, n)
+}
+
+func fieldUint64(b []byte) uint64 {
+	if len(b) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func boolField(v bool) []byte {
+	if v {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// appendRecord appends the framed record to buf: the length of the body, its CRC32 and the
+// body, which is the operation followed by the length prefixed fields.
+func appendRecord(buf []byte, r record) []byte {
+	body := []byte{byte(r.op)}
+	body = binary.AppendUvarint(body, uint64(len(r.fields)))
+	for _, f := range r.fields {
+		body = binary.AppendUvarint(body, uint64(len(f)))
+		body = append(body, f...)
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(body)))
+	buf = binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(body))
+	return append(buf, body...)
+}
+
+var (
+	errCorrupt = errors.New("corrupt record")
+	errTorn    = errors.New("torn record")
+)
+
+// readRecords calls apply with each record of the file. It returns the offset after the last
+// complete record; a truncated or corrupt last record, e.g. from a crash while writing, is
+// ignored. A corrupt record followed by others is an error.
+func readRecords(filename string, apply func(record) error) (int64, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	r := bufio.NewReaderSize(f, 1024*1024)
+	var offset int64
+	for {
+		rec, n, err := readRecord(r, info.Size()-offset)
+		if err == io.EOF || err == io.ErrUnexpectedEOF || err == errTorn {
+			return offset, nil
+		}
+		if err == errCorrupt && offset+n == info.Size() {
+			return offset, nil
+		}
+		if err != nil {
+			return offset, fmt.Errorf("reading %s at offset %d: %w", filename, offset, err)
+		}
+		if err := apply(rec); err != nil {
+			return offset, fmt.Errorf("applying record of %s at offset %d: %w",
+				filename, offset, err)
+		}
+		offset += n
+	}
+}
+
+// readRecord reads the next record out of the remaining bytes of the file, and returns its
+// size in the file. It returns errTorn if the record does not fit in them, and errCorrupt with
+// its size if it does but is not valid.
+func readRecord(r *bufio.Reader, remaining int64) (record, int64, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return record{}, 0, err
+	}
+	n := int64(len(binary.AppendUvarint(nil, size))) + 4
+	if size > maxRecordSize || int64(size) > remaining-n {
+		return record{}, 0, errTorn
+	}
+	n += int64(size)
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return record{}, 0, err
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return record{}, 0, err
+	}
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[:]) || len(body) == 0 {
+		return record{}, n, errCorrupt
+	}
+
+	rec := record{op: opCode(body[0])}
+	body = body[1:]
+	count, k := binary.Uvarint(body)
+	if k <= 0 || count > uint64(len(body)) {
+		return record{}, n, errCorrupt
+	}
+	body = body[k:]
+	rec.fields = make([][]byte, count)
+	for i := range rec.fields {
+		l, k := binary.Uvarint(body)
+		if k <= 0 || uint64(len(body)-k) < l {
+			return record{}, n, errCorrupt
+		}
+		rec.fields[i] = body[k : k+int(l)]
+		body = body[k+int(l):]
+	}
+	return rec, n, nil
+}
+
+// logWriter appends records to the log file.
+type logWriter struct {
+	f    *os.File
+	w    *bufio.Writer
+	size int64
+	buf  []byte
+}
+
+func openLog(dir string, offset int64) (*logWriter, error) {
+	f, err := os.OpenFile(filepath.Join(dir, logFile), os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	// Drop any incomplete record at the end.
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &logWriter{
+		f:    f,
+		w:    bufio.NewWriterSize(f, 1024*1024),
+		size: offset,
+	}, nil
+}
+
+// write appends the records and flushes them to the file.
+func (l *logWriter) write(recs ...record) error {
+	for _, r := range recs {
+		l.buf = appendRecord(l.buf[:0], r)
+		n, err := l.w.Write(l.buf)
+		l.size += int64(n)
+		if err != nil {
+			return fmt.Errorf("writing log: %w", err)
+		}
+	}
+	if err := l.w.Flush(); err != nil {
+		return fmt.Errorf("writing log: %w", err)
+	}
+	return nil
+}
+
+// reset empties the log, and starts it with the generation.
+func (l *logWriter) reset(generation uint64) error {
+	if err := l.f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := l.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	l.w.Reset(l.f)
+	l.size = 0
+	if err := l.write(newRecord(opGeneration, uint64Field(generation))); err != nil {
+		return err
+	}
+	return l.f.Sync()
+}
+
+func (l *logWriter) close() error {
+	err := l.w.Flush()
+	if err == nil {
+		err = l.f.Sync()
+	}
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writeSnapshot atomically replaces the snapshot file with the records.
+func writeSnapshot(dir string, records func(emit func(record) error) error) (int64, error) {
+	tmp, err := os.CreateTemp(dir, snapshotFile+"-*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriterSize(tmp, 1024*1024)
+	var size int64
+	var buf []byte
+	err = records(func(r record) error {
+		buf = appendRecord(buf[:0], r)
+		n, err := w.Write(buf)
+		size += int64(n)
+		return err
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, fmt.Errorf("writing snapshot: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, snapshotFile)); err != nil {
+		return 0, fmt.Errorf("replacing snapshot: %w", err)
+	}
+	// The rename is only durable once the directory is synced.
+	if err := syncDir(dir); err != nil {
+		return 0, fmt.Errorf("replacing snapshot: %w", err)
+	}
+	return size, nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,90 @@
+package embedded
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/db"
+)
+
+// CheckPoliciesExist returns a slice of true/false values. Each value indicates if
+// the corresponding policy identified by its ID is already present in the DB.
+func (c *embeddedDB) CheckPoliciesExist(ctx context.Context, ids []common.SHA256Output,
+) ([]bool, error) {
+
+	return c.checkExist(policiesOf, ids)
+}
+
+// UpdatePolicies inserts the policies, replacing the existing ones.
+func (c *embeddedDB) UpdatePolicies(
+	ctx context.Context,
+	ids []common.SHA256Output,
+	parents []*common.SHA256Output,
+	expirations []time.Time,
+	payloads [][]byte,
+) error {
+
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+
+	recs := make([]record, len(ids))
+	for i, id := range ids {
+		recs[i] = putPayloadRecord(opPutPolicy, &db.PayloadRecord{
+			ID:         id,
+			ParentID:   parents[i],
+			Expiration: expirations[i].UTC().Truncate(time.Second),
+			Payload:    bytes.Clone(payloads[i]),
+		})
+	}
+	return c.s.commit(recs...)
+}
+
+// UpdateDomainPolicies updates the domain_policies table.
+func (c *embeddedDB) UpdateDomainPolicies(
+	ctx context.Context,
+	domainIDs []common.SHA256Output,
+	policyIDs []common.SHA256Output,
+) error {
+
+	return c.updateAssociations(opPutDomainPolicy, domainPoliciesOf, domainIDs, policyIDs)
+}
+
+func (c *embeddedDB) RetrieveDomainPoliciesIDs(ctx context.Context, domainID common.SHA256Output,
+) (common.SHA256Output, []byte, error) {
+
+	c.s.mu.RLock()
+	defer c.s.mu.RUnlock()
+	return idsAndTheirID(c.s.t.payloads[domainID].policyIDs)
+}
+
+// RetrievePolicyPayloads returns the payload for each policy identified by the IDs
+// parameter, in the same order (element i corresponds to IDs[i]).
+func (c *embeddedDB) RetrievePolicyPayloads(ctx context.Context, IDs []common.SHA256Output,
+) ([][]byte, error) {
+
+	return c.retrievePayloads(IDs, policiesOf)
+}
+
+// RetrievePolicyRecords returns the policies table row for each policy identified by the
+// IDs parameter, in the same order. Missing policies yield a nil record.
+func (c *embeddedDB) RetrievePolicyRecords(ctx context.Context, IDs []common.SHA256Output,
+) ([]*db.PayloadRecord, error) {
+
+	return c.retrievePayloadRecords(IDs, policiesOf)
+}
+
+// RetrievePolicyParents returns the parent of the existing policies with the IDs.
+func (c *embeddedDB) RetrievePolicyParents(ctx context.Context, IDs []common.SHA256Output,
+) ([]db.ParentRecord, error) {
+
+	return c.retrieveParents(IDs, policiesOf)
+}
+
+// RetrievePolicyDomains returns the domains that reference the policy in domain_policies.
+func (c *embeddedDB) RetrievePolicyDomains(ctx context.Context, policyID common.SHA256Output,
+) ([]db.DomainRecord, error) {
+
+	return c.retrieveReferringDomains(policyID, domainPoliciesOf)
+}
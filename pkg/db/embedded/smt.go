@@ -0,0 +1,84 @@
+package embedded
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/db"
+)
+
+func (c *embeddedDB) LoadRoot(ctx context.Context) (*common.SHA256Output, error) {
+	c.s.mu.RLock()
+	defer c.s.mu.RUnlock()
+
+	if c.s.t.root == nil {
+		return nil, nil
+	}
+	root := *c.s.t.root
+	return &root, nil
+}
+
+func (c *embeddedDB) SaveRoot(ctx context.Context, root *common.SHA256Output) error {
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	return c.s.commit(newRecord(opPutRoot, clone(*root)))
+}
+
+func (c *embeddedDB) RetrieveTreeNode(ctx context.Context, key common.SHA256Output) ([]byte, error) {
+	c.s.mu.RLock()
+	defer c.s.mu.RUnlock()
+
+	if node, ok := c.s.t.tree[key]; ok {
+		return bytes.Clone(node.value), nil
+	}
+	return nil, nil
+}
+
+func (c *embeddedDB) DeleteTreeNodes(ctx context.Context, keys []common.SHA256Output) (int, error) {
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+
+	recs := make([]record, 0, len(keys))
+	deleted := make(map[common.SHA256Output]struct{}, len(keys))
+	for _, k := range keys {
+		if _, ok := c.s.t.tree[k]; !ok {
+			continue
+		}
+		if _, ok := deleted[k]; ok {
+			continue
+		}
+		deleted[k] = struct{}{}
+		recs = append(recs, newRecord(opDelTreeNode, clone(k)))
+	}
+	return len(recs), c.s.commit(recs...)
+}
+
+// UpdateTreeNodes inserts or replaces the SMT nodes. Like a REPLACE statement in MySQL, each
+// node gets a new row ID, and the number of affected rows counts the replaced nodes twice.
+func (c *embeddedDB) UpdateTreeNodes(ctx context.Context, keyValuePairs []*db.TreeNodeRecord,
+) (int, error) {
+
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+
+	recs := make([]record, len(keyValuePairs))
+	written := make(map[common.SHA256Output]struct{}, len(keyValuePairs))
+	affected := 0
+	for i, pair := range keyValuePairs {
+		_, existing := c.s.t.tree[pair.Key]
+		_, rewritten := written[pair.Key]
+		if existing || rewritten {
+			affected += 2
+		} else {
+			affected++
+		}
+		written[pair.Key] = struct{}{}
+		recs[i] = newRecord(opPutTreeNode, clone(pair.Key), bytes.Clone(pair.Value),
+			uint64Field(c.s.t.lastTreeID+uint64(i)+1))
+	}
+	if err := c.s.commit(recs...); err != nil {
+		return 0, err
+	}
+	return affected, nil
+}
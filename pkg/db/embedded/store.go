@@ -0,0 +1,710 @@
+package embedded
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	ct "github.com/google/certificate-transparency-go"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/db"
+)
+
+type domainPayload struct {
+	certIDs   []byte // sorted and glued IDs, empty if none
+	policyIDs []byte
+}
+
+type treeNode struct {
+	value []byte
+	rowID uint64
+}
+
+type treeRow struct {
+	rowID uint64
+	key   common.SHA256Output
+}
+
+type ctLogState struct {
+	size int64
+	sth  []byte
+}
+
+// ingestJob is one row of the ingest_jobs table with its rows of the ingest_batches table.
+type ingestJob struct {
+	job     db.IngestJob
+	batches map[uint64]db.IngestBatch
+}
+
+// associations is the domain_certs or domain_policies table, indexed both ways.
+type associations struct {
+	byDomain map[common.SHA256Output]map[common.SHA256Output]struct{}
+	byID     map[common.SHA256Output]map[common.SHA256Output]struct{}
+	sorted   []db.DomainAssociation // nil if it must be rebuilt
+}
+
+func newAssociations() *associations {
+	return &associations{
+		byDomain: make(map[common.SHA256Output]map[common.SHA256Output]struct{}),
+		byID:     make(map[common.SHA256Output]map[common.SHA256Output]struct{}),
+	}
+}
+
+func (a *associations) put(domainID, id common.SHA256Output) {
+	addToSet(a.byDomain, domainID, id)
+	addToSet(a.byID, id, domainID)
+	a.sorted = nil
+}
+
+func (a *associations) del(domainID, id common.SHA256Output) {
+	removeFromSet(a.byDomain, domainID, id)
+	removeFromSet(a.byID, id, domainID)
+	a.sorted = nil
+}
+
+// count returns the number of rows.
+func (a *associations) count() uint64 {
+	var n uint64
+	for _, ids := range a.byDomain {
+		n += uint64(len(ids))
+	}
+	return n
+}
+
+// rows returns all rows sorted by domain ID and ID.
+func (a *associations) rows() []db.DomainAssociation {
+	if a.sorted == nil {
+		a.sorted = make([]db.DomainAssociation, 0, len(a.byDomain))
+		for domainID, ids := range a.byDomain {
+			for id := range ids {
+				a.sorted = append(a.sorted, db.DomainAssociation{DomainID: domainID, ID: id})
+			}
+		}
+		slices.SortFunc(a.sorted, compareAssociations)
+	}
+	return a.sorted
+}
+
+func addToSet(m map[common.SHA256Output]map[common.SHA256Output]struct{}, k, v common.SHA256Output) {
+	set, ok := m[k]
+	if !ok {
+		set = make(map[common.SHA256Output]struct{})
+		m[k] = set
+	}
+	set[v] = struct{}{}
+}
+
+func removeFromSet(m map[common.SHA256Output]map[common.SHA256Output]struct{},
+	k, v common.SHA256Output) {
+
+	if set, ok := m[k]; ok {
+		delete(set, v)
+		if len(set) == 0 {
+			delete(m, k)
+		}
+	}
+}
+
+// tables holds the contents of all tables. The sorted slices are caches of the keys of their
+// maps, rebuilt when nil.
+type tables struct {
+	certs          map[common.SHA256Output]*db.PayloadRecord
+	policies       map[common.SHA256Output]*db.PayloadRecord
+	domains        map[common.SHA256Output]string
+	domainCerts    *associations
+	domainPolicies *associations
+	payloads       map[common.SHA256Output]domainPayload
+	dirty          map[common.SHA256Output]bool // domain ID -> coalesced
+	tree           map[common.SHA256Output]treeNode
+	treeRows       []treeRow // sorted by row ID, with stale rows of replaced or deleted nodes
+	lastTreeID     uint64
+	root           *common.SHA256Output
+	ctLogs         map[common.SHA256Output]ctLogState
+	epochs         map[uint64]db.Epoch
+	epochDomains   map[uint64]map[common.SHA256Output]struct{}
+	ingestJobs     map[string]*ingestJob
+	identity       db.Identity // Zero until created.
+
+	sortedCerts    []common.SHA256Output
+	sortedPolicies []common.SHA256Output
+	sortedDomains  []common.SHA256Output
+	sortedDirty    []common.SHA256Output
+}
+
+func newTables() *tables {
+	return &tables{
+		certs:          make(map[common.SHA256Output]*db.PayloadRecord),
+		policies:       make(map[common.SHA256Output]*db.PayloadRecord),
+		domains:        make(map[common.SHA256Output]string),
+		domainCerts:    newAssociations(),
+		domainPolicies: newAssociations(),
+		payloads:       make(map[common.SHA256Output]domainPayload),
+		dirty:          make(map[common.SHA256Output]bool),
+		tree:           make(map[common.SHA256Output]treeNode),
+		ctLogs:         make(map[common.SHA256Output]ctLogState),
+		epochs:         make(map[uint64]db.Epoch),
+		epochDomains:   make(map[uint64]map[common.SHA256Output]struct{}),
+		ingestJobs:     make(map[string]*ingestJob),
+	}
+}
+
+// layouts describes the fields of each operation: 'i' is an ID, 'p' an optional ID, 'n' an
+// uint64 and 'b' any bytes.
+var layouts = map[opCode]string{
+	opGeneration:      "n",
+	opTruncate:        "",
+	opPutCert:         "ipbb",
+	opDelCert:         "i",
+	opPutPolicy:       "ipbb",
+	opPutDomain:       "ib",
+	opDelDomain:       "i",
+	opPutDomainCert:   "ii",
+	opDelDomainCert:   "ii",
+	opPutDomainPolicy: "ii",
+	opDelDomainPolicy: "ii",
+	opPutPayload:      "ibb",
+	opDelPayload:      "i",
+	opPutDirty:        "ib",
+	opClearDirty:      "",
+	opPutTreeNode:     "ibn",
+	opDelTreeNode:     "i",
+	opPutRoot:         "i",
+	opPutCTLogState:   "inb",
+	opPutEpoch:        "nin",
+	opPutEpochDomain:  "ni",
+	opPutLastTreeID:   "n",
+	opPutIngestJob:    "bbbbb",
+	opPutIngestBatch:  "bnbnnbbbb",
+	opPutIdentity:     "b",
+	opPutCertEntry:    "inip",
+}
+
+// apply modifies the tables with the record.
+func (t *tables) apply(r record) error {
+	layout, ok := layouts[r.op]
+	if !ok {
+		return fmt.Errorf("unknown operation %d", r.op)
+	}
+	if len(r.fields) != len(layout) {
+		return fmt.Errorf("operation %d with %d fields, expected %d",
+			r.op, len(r.fields), len(layout))
+	}
+	for i, kind := range layout {
+		l := len(r.fields[i])
+		if kind == 'i' && l != common.SHA256Size ||
+			kind == 'p' && l != 0 && l != common.SHA256Size ||
+			kind == 'n' && l != 8 {
+			return fmt.Errorf("operation %d with invalid field %d", r.op, i)
+		}
+	}
+	f := r.fields
+	id := func(i int) common.SHA256Output { return (common.SHA256Output)(f[i]) }
+
+	switch r.op {
+	case opGeneration:
+	case opTruncate:
+		*t = *newTables()
+	case opPutCert, opPutPolicy:
+		rec := &db.PayloadRecord{
+			ID:      id(0),
+			Payload: f[3],
+		}
+		if len(f[1]) != 0 {
+			rec.ParentID = (*common.SHA256Output)(f[1])
+		}
+		if err := rec.Expiration.UnmarshalBinary(f[2]); err != nil {
+			return err
+		}
+		if r.op == opPutCert {
+			if _, ok := t.certs[rec.ID]; !ok {
+				t.sortedCerts = nil
+			}
+			t.certs[rec.ID] = rec
+		} else {
+			if _, ok := t.policies[rec.ID]; !ok {
+				t.sortedPolicies = nil
+			}
+			t.policies[rec.ID] = rec
+		}
+	case opDelCert:
+		delete(t.certs, id(0))
+		t.sortedCerts = nil
+	case opPutDomain:
+		if _, ok := t.domains[id(0)]; !ok {
+			t.sortedDomains = nil
+		}
+		t.domains[id(0)] = string(f[1])
+	case opDelDomain:
+		delete(t.domains, id(0))
+		t.sortedDomains = nil
+	case opPutDomainCert:
+		t.domainCerts.put(id(0), id(1))
+	case opDelDomainCert:
+		t.domainCerts.del(id(0), id(1))
+	case opPutDomainPolicy:
+		t.domainPolicies.put(id(0), id(1))
+	case opDelDomainPolicy:
+		t.domainPolicies.del(id(0), id(1))
+	case opPutPayload:
+		t.payloads[id(0)] = domainPayload{certIDs: f[1], policyIDs: f[2]}
+	case opDelPayload:
+		delete(t.payloads, id(0))
+	case opPutDirty:
+		if _, ok := t.dirty[id(0)]; !ok {
+			t.sortedDirty = nil
+		}
+		t.dirty[id(0)] = len(f[1]) == 1 && f[1][0] == 1
+	case opClearDirty:
+		t.dirty = make(map[common.SHA256Output]bool)
+		t.sortedDirty = nil
+	case opPutTreeNode:
+		rowID := fieldUint64(f[2])
+		t.tree[id(0)] = treeNode{value: f[1], rowID: rowID}
+		t.treeRows = append(t.treeRows, treeRow{rowID: rowID, key: id(0)})
+		t.lastTreeID = max(t.lastTreeID, rowID)
+	case opDelTreeNode:
+		delete(t.tree, id(0))
+	case opPutRoot:
+		root := id(0)
+		t.root = &root
+	case opPutCTLogState:
+		t.ctLogs[id(0)] = ctLogState{size: int64(fieldUint64(f[1])), sth: f[2]}
+	case opPutEpoch:
+		e := db.Epoch{
+			Number: fieldUint64(f[0]),
+			Root:   id(1),
+			TreeID: fieldUint64(f[2]),
+		}
+		t.epochs[e.Number] = e
+	case opPutEpochDomain:
+		number := fieldUint64(f[0])
+		set, ok := t.epochDomains[number]
+		if !ok {
+			set = make(map[common.SHA256Output]struct{})
+			t.epochDomains[number] = set
+		}
+		set[id(1)] = struct{}{}
+	case opPutLastTreeID:
+		// Row IDs are never reused, even if the rows with the largest ones were deleted.
+		t.lastTreeID = max(t.lastTreeID, fieldUint64(f[0]))
+	case opPutIngestJob:
+		job := db.IngestJob{
+			Name:      string(f[0]),
+			Strategy:  string(f[1]),
+			Finalizer: string(f[2]),
+			Finalized: len(f[4]) == 1 && f[4][0] == 1,
+		}
+		if err := job.LeaseExpiry.UnmarshalBinary(f[3]); err != nil {
+			return err
+		}
+		if j, ok := t.ingestJobs[job.Name]; ok {
+			j.job = job
+		} else {
+			t.ingestJobs[job.Name] = &ingestJob{
+				job:     job,
+				batches: make(map[uint64]db.IngestBatch),
+			}
+		}
+	case opPutIngestBatch:
+		b := db.IngestBatch{
+			Job:    string(f[0]),
+			ID:     fieldUint64(f[1]),
+			Key:    string(f[2]),
+			Start:  fieldUint64(f[3]),
+			End:    fieldUint64(f[4]),
+			Worker: string(f[6]),
+			Done:   len(f[8]) == 1 && f[8][0] == 1,
+		}
+		if err := json.Unmarshal(f[5], &b.Files); err != nil {
+			return err
+		}
+		if err := b.LeaseExpiry.UnmarshalBinary(f[7]); err != nil {
+			return err
+		}
+		j, ok := t.ingestJobs[b.Job]
+		if !ok {
+			return fmt.Errorf("batch %d of unknown ingest job %q", b.ID, b.Job)
+		}
+		j.batches[b.ID] = b
+	case opPutIdentity:
+		if len(f[0]) != len(t.identity) {
+			return fmt.Errorf("invalid identity %x", f[0])
+		}
+		t.identity = (db.Identity)(f[0])
+	case opPutCertEntry:
+		// The record is replaced, as it may be shared with a reader.
+		if rec, ok := t.certs[id(0)]; ok {
+			entry := &db.CertificateEntry{
+				Type:  ct.LogEntryType(fieldUint64(f[1])),
+				TBSID: id(2),
+			}
+			if len(f[3]) != 0 {
+				entry.IssuerKeyHash = (*common.SHA256Output)(f[3])
+			}
+			updated := *rec
+			updated.Entry = entry
+			t.certs[id(0)] = &updated
+		}
+	}
+	return nil
+}
+
+// records emits the records that recreate the tables.
+func (t *tables) records(emit func(record) error) error {
+	for _, rec := range t.certs {
+		if err := emit(putPayloadRecord(opPutCert, rec)); err != nil {
+			return err
+		}
+		if rec.Entry != nil {
+			if err := emit(putCertEntryRecord(rec.ID, *rec.Entry)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, rec := range t.policies {
+		if err := emit(putPayloadRecord(opPutPolicy, rec)); err != nil {
+			return err
+		}
+	}
+	for id, name := range t.domains {
+		if err := emit(newRecord(opPutDomain, clone(id), []byte(name))); err != nil {
+			return err
+		}
+	}
+	for _, a := range []struct {
+		op     opCode
+		assocs *associations
+	}{
+		{opPutDomainCert, t.domainCerts},
+		{opPutDomainPolicy, t.domainPolicies},
+	} {
+		for domainID, ids := range a.assocs.byDomain {
+			for id := range ids {
+				if err := emit(newRecord(a.op, clone(domainID), clone(id))); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for id, p := range t.payloads {
+		if err := emit(newRecord(opPutPayload, clone(id), p.certIDs, p.policyIDs)); err != nil {
+			return err
+		}
+	}
+	for id, coalesced := range t.dirty {
+		if err := emit(newRecord(opPutDirty, clone(id), boolField(coalesced))); err != nil {
+			return err
+		}
+	}
+	// Keep the order of the row IDs.
+	for _, row := range t.treeRows {
+		if node, ok := t.tree[row.key]; ok && node.rowID == row.rowID {
+			err := emit(newRecord(opPutTreeNode, clone(row.key), node.value,
+				uint64Field(row.rowID)))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if err := emit(newRecord(opPutLastTreeID, uint64Field(t.lastTreeID))); err != nil {
+		return err
+	}
+	if t.root != nil {
+		if err := emit(newRecord(opPutRoot, clone(*t.root))); err != nil {
+			return err
+		}
+	}
+	for hash, s := range t.ctLogs {
+		err := emit(newRecord(opPutCTLogState, clone(hash), uint64Field(uint64(s.size)), s.sth))
+		if err != nil {
+			return err
+		}
+	}
+	for _, e := range t.epochs {
+		err := emit(newRecord(opPutEpoch, uint64Field(e.Number), clone(e.Root),
+			uint64Field(e.TreeID)))
+		if err != nil {
+			return err
+		}
+	}
+	for number, ids := range t.epochDomains {
+		for id := range ids {
+			if err := emit(newRecord(opPutEpochDomain, uint64Field(number), clone(id))); err != nil {
+				return err
+			}
+		}
+	}
+	if t.identity != (db.Identity{}) {
+		if err := emit(newRecord(opPutIdentity, bytes.Clone(t.identity[:]))); err != nil {
+			return err
+		}
+	}
+	// The jobs before their batches.
+	for _, j := range t.ingestJobs {
+		if err := emit(ingestJobRecord(j.job)); err != nil {
+			return err
+		}
+		for _, b := range j.batches {
+			if err := emit(ingestBatchRecord(b)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// compactTreeRows removes the stale rows of treeRows if they are the majority.
+func (t *tables) compactTreeRows() {
+	if len(t.treeRows) < 2*len(t.tree)+1024 {
+		return
+	}
+	rows := make([]treeRow, 0, len(t.tree))
+	for _, row := range t.treeRows {
+		if node, ok := t.tree[row.key]; ok && node.rowID == row.rowID {
+			rows = append(rows, row)
+		}
+	}
+	t.treeRows = rows
+}
+
+func putCertEntryRecord(id common.SHA256Output, e db.CertificateEntry) record {
+	var issuerKeyHash []byte
+	if e.IssuerKeyHash != nil {
+		issuerKeyHash = clone(*e.IssuerKeyHash)
+	}
+	return newRecord(opPutCertEntry, clone(id), uint64Field(uint64(e.Type)), clone(e.TBSID),
+		issuerKeyHash)
+}
+
+func putPayloadRecord(op opCode, rec *db.PayloadRecord) record {
+	var parent []byte
+	if rec.ParentID != nil {
+		parent = clone(*rec.ParentID)
+	}
+	exp, _ := rec.Expiration.MarshalBinary()
+	return newRecord(op, clone(rec.ID), parent, exp, rec.Payload)
+}
+
+func clone(id common.SHA256Output) []byte {
+	return bytes.Clone(id[:])
+}
+
+// sortedKeys returns the keys of m sorted, reusing *cache if not nil.
+func sortedKeys[V any](m map[common.SHA256Output]V, cache *[]common.SHA256Output,
+) []common.SHA256Output {
+
+	if *cache == nil {
+		keys := make([]common.SHA256Output, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		slices.SortFunc(keys, compareIDs)
+		*cache = keys
+	}
+	return *cache
+}
+
+func compareIDs(a, b common.SHA256Output) int {
+	return bytes.Compare(a[:], b[:])
+}
+
+func compareAssociations(a, b db.DomainAssociation) int {
+	if c := compareIDs(a.DomainID, b.DomainID); c != 0 {
+		return c
+	}
+	return compareIDs(a.ID, b.ID)
+}
+
+// page returns at most limit elements of sorted that are after `after`, or from the start
+// if after is nil.
+func page[T any](sorted []T, after *T, limit int, compare func(a, b T) int) []T {
+	start := 0
+	if after != nil {
+		start, _ = slices.BinarySearchFunc(sorted, *after, compare)
+		if start < len(sorted) && compare(sorted[start], *after) == 0 {
+			start++
+		}
+	}
+	end := min(start+max(limit, 0), len(sorted))
+	return slices.Clone(sorted[start:end])
+}
+
+// store is one open directory, shared by all the connections to it.
+type store struct {
+	dir        string
+	mu         sync.RWMutex
+	t          *tables
+	log        *logWriter
+	generation uint64
+	snapSize   int64
+	refs       int
+	unlock     func() error
+}
+
+var (
+	storesMu sync.Mutex
+	stores   = make(map[string]*store)
+)
+
+// openStore returns the store of the directory, loading it if it is not open yet.
+func openStore(dir string) (*store, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	storesMu.Lock()
+	defer storesMu.Unlock()
+
+	if s, ok := stores[dir]; ok {
+		s.refs++
+		return s, nil
+	}
+	s, err := loadStore(dir)
+	if err != nil {
+		return nil, err
+	}
+	s.refs = 1
+	stores[dir] = s
+	return s, nil
+}
+
+func loadStore(dir string) (*store, error) {
+	unlock, err := lockDir(filepath.Join(dir, lockFile))
+	if err != nil {
+		return nil, fmt.Errorf("locking %s: %w", dir, err)
+	}
+	s := &store{
+		dir:    dir,
+		t:      newTables(),
+		unlock: unlock,
+	}
+	if err := s.load(); err != nil {
+		unlock()
+		return nil, err
+	}
+	return s, nil
+}
+
+// load replays the snapshot and the log, if the log belongs to the snapshot.
+func (s *store) load() error {
+	start := time.Now()
+	var err error
+	s.snapSize, err = readRecords(filepath.Join(s.dir, snapshotFile), func(r record) error {
+		if r.op == opGeneration {
+			s.generation = fieldUint64(r.fields[0])
+		}
+		return s.t.apply(r)
+	})
+	if err != nil {
+		return err
+	}
+
+	// The log starts with the generation of its snapshot. A different one means that the
+	// process stopped after writing a new snapshot but before resetting the log.
+	first := true
+	stale := false
+	offset, err := readRecords(filepath.Join(s.dir, logFile), func(r record) error {
+		if first {
+			first = false
+			stale = r.op != opGeneration || fieldUint64(r.fields[0]) != s.generation
+		}
+		if stale {
+			return nil
+		}
+		return s.t.apply(r)
+	})
+	if err != nil {
+		return err
+	}
+	if s.log, err = openLog(s.dir, offset); err != nil {
+		return err
+	}
+	if first || stale {
+		if err := s.log.reset(s.generation); err != nil {
+			return err
+		}
+	}
+	if s.t.identity == (db.Identity{}) {
+		// A new DB, or one created before identities.
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if err := s.commit(newIdentityRecord()); err != nil {
+			return err
+		}
+	}
+	s.t.compactTreeRows()
+	if time.Since(start) > 10*time.Second {
+		fmt.Printf("embedded DB %s loaded in %s\n", s.dir, time.Since(start))
+	}
+	return nil
+}
+
+// commit writes the records to the log and applies them to the tables. The caller must hold
+// the write lock.
+func (s *store) commit(recs ...record) error {
+	if len(recs) == 0 {
+		return nil
+	}
+	if s.log == nil {
+		return fmt.Errorf("embedded DB %s is closed", s.dir)
+	}
+	if err := s.log.write(recs...); err != nil {
+		return err
+	}
+	for _, r := range recs {
+		if err := s.t.apply(r); err != nil {
+			return err
+		}
+	}
+	if s.log.size > compactMinSize && s.log.size > s.snapSize {
+		return s.compact()
+	}
+	return nil
+}
+
+// compact writes all the tables into a new snapshot and empties the log.
+func (s *store) compact() error {
+	s.t.compactTreeRows()
+	generation := s.generation + 1
+	size, err := writeSnapshot(s.dir, func(emit func(record) error) error {
+		if err := emit(newRecord(opGeneration, uint64Field(generation))); err != nil {
+			return err
+		}
+		return s.t.records(emit)
+	})
+	if err != nil {
+		return err
+	}
+	s.generation = generation
+	s.snapSize = size
+	return s.log.reset(generation)
+}
+
+// release closes the store when the last connection is closed.
+func (s *store) release() error {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+
+	s.refs--
+	if s.refs > 0 {
+		return nil
+	}
+	delete(stores, s.dir)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.compact()
+	if cerr := s.log.close(); err == nil {
+		err = cerr
+	}
+	s.log = nil
+	if uerr := s.unlock(); err == nil {
+		err = uerr
+	}
+	return err
+}
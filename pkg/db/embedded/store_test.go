@@ -0,0 +1,57 @@
+package embedded
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+)
+
+// TestLoadAfterCrash checks that a log with an incomplete last record, or belonging to an
+// older snapshot, is replayed correctly.
+func TestLoadAfterCrash(t *testing.T) {
+	dir := t.TempDir()
+	name := func(b byte) record {
+		return newRecord(opPutDomain, clone(common.SHA256Output{b}), []byte{'a' + b})
+	}
+
+	s, err := loadStore(dir)
+	require.NoError(t, err)
+	require.NoError(t, s.commit(name(1)))
+	require.NoError(t, s.compact())
+	require.NoError(t, s.commit(name(2)))
+	// Keep a copy of the log before the next snapshot.
+	oldLog, err := os.ReadFile(filepath.Join(dir, logFile))
+	require.NoError(t, err)
+	require.NoError(t, s.commit(name(3)))
+	crash(t, s)
+
+	// Cut the last record in half.
+	log := filepath.Join(dir, logFile)
+	info, err := os.Stat(log)
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(log, info.Size()-2))
+
+	s, err = loadStore(dir)
+	require.NoError(t, err)
+	require.Equal(t, map[common.SHA256Output]string{{1}: "b", {2}: "c"}, s.t.domains)
+	require.NoError(t, s.commit(name(4)))
+	require.NoError(t, s.compact())
+	crash(t, s)
+
+	// A stale log from before the snapshot is ignored.
+	require.NoError(t, os.WriteFile(log, oldLog, 0644))
+	s, err = loadStore(dir)
+	require.NoError(t, err)
+	require.Equal(t, map[common.SHA256Output]string{{1}: "b", {2}: "c", {4}: "e"}, s.t.domains)
+	crash(t, s)
+}
+
+// crash closes the files of the store without compacting it.
+func crash(t *testing.T, s *store) {
+	require.NoError(t, s.log.close())
+	require.NoError(t, s.unlock())
+}
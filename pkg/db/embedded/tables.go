@@ -0,0 +1,122 @@
+package embedded
+
+import (
+	"context"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/db"
+)
+
+// RetrieveDomainsPage returns rows of the domains table sorted by domain ID.
+func (c *embeddedDB) RetrieveDomainsPage(
+	ctx context.Context,
+	after *common.SHA256Output,
+	limit int,
+) ([]db.DomainRecord, error) {
+
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+
+	ids := page(sortedKeys(c.s.t.domains, &c.s.t.sortedDomains), after, limit, compareIDs)
+	domains := make([]db.DomainRecord, len(ids))
+	for i, id := range ids {
+		domains[i] = db.DomainRecord{DomainID: id, DomainName: c.s.t.domains[id]}
+	}
+	return domains, nil
+}
+
+// RetrieveCertificatesPage returns rows of the certs table sorted by certificate ID.
+func (c *embeddedDB) RetrieveCertificatesPage(
+	ctx context.Context,
+	after *common.SHA256Output,
+	limit int,
+) ([]*db.PayloadRecord, error) {
+
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+
+	ids := page(sortedKeys(c.s.t.certs, &c.s.t.sortedCerts), after, limit, compareIDs)
+	return mapRecords(ids, c.s.t.certs, clonePayloadRecord), nil
+}
+
+// RetrievePoliciesPage returns rows of the policies table sorted by policy ID.
+func (c *embeddedDB) RetrievePoliciesPage(
+	ctx context.Context,
+	after *common.SHA256Output,
+	limit int,
+) ([]*db.PayloadRecord, error) {
+
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+
+	ids := page(sortedKeys(c.s.t.policies, &c.s.t.sortedPolicies), after, limit, compareIDs)
+	return mapRecords(ids, c.s.t.policies, clonePayloadRecord), nil
+}
+
+// RetrieveCertificateParentsPage returns the ID and parent ID of rows of the certs table.
+func (c *embeddedDB) RetrieveCertificateParentsPage(
+	ctx context.Context,
+	after *common.SHA256Output,
+	limit int,
+) ([]db.ParentRecord, error) {
+
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+
+	ids := page(sortedKeys(c.s.t.certs, &c.s.t.sortedCerts), after, limit, compareIDs)
+	return mapRecords(ids, c.s.t.certs, parentRecord), nil
+}
+
+// RetrievePolicyParentsPage returns the ID and parent ID of rows of the policies table.
+func (c *embeddedDB) RetrievePolicyParentsPage(
+	ctx context.Context,
+	after *common.SHA256Output,
+	limit int,
+) ([]db.ParentRecord, error) {
+
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+
+	ids := page(sortedKeys(c.s.t.policies, &c.s.t.sortedPolicies), after, limit, compareIDs)
+	return mapRecords(ids, c.s.t.policies, parentRecord), nil
+}
+
+// RetrieveDomainCertsPage returns rows of the domain_certs table sorted by domain and
+// certificate ID.
+func (c *embeddedDB) RetrieveDomainCertsPage(
+	ctx context.Context,
+	after *db.DomainAssociation,
+	limit int,
+) ([]db.DomainAssociation, error) {
+
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	return page(c.s.t.domainCerts.rows(), after, limit, compareAssociations), nil
+}
+
+// RetrieveDomainPoliciesPage returns rows of the domain_policies table sorted by domain and
+// policy ID.
+func (c *embeddedDB) RetrieveDomainPoliciesPage(
+	ctx context.Context,
+	after *db.DomainAssociation,
+	limit int,
+) ([]db.DomainAssociation, error) {
+
+	c.s.mu.Lock()
+	defer c.s.mu.Unlock()
+	return page(c.s.t.domainPolicies.rows(), after, limit, compareAssociations), nil
+}
+
+// mapRecords converts the rows of the IDs in m.
+func mapRecords[T any](
+	ids []common.SHA256Output,
+	m map[common.SHA256Output]*db.PayloadRecord,
+	convert func(*db.PayloadRecord) T,
+) []T {
+
+	records := make([]T, len(ids))
+	for i, id := range ids {
+		records[i] = convert(m[id])
+	}
+	return records
+}
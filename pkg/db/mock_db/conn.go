@@ -11,7 +11,6 @@ package mock_db
 
 import (
 	context "context"
-	sql "database/sql"
 	reflect "reflect"
 	time "time"
 
@@ -101,20 +100,6 @@ func (mr *MockConnMockRecorder) Close() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Close", reflect.TypeOf((*MockConn)(nil).Close))
 }
 
-// DB mocks base method.
-func (m *MockConn) DB() *sql.DB {
-	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "DB")
-	ret0, _ := ret[0].(*sql.DB)
-	return ret0
-}
-
-// DB indicates an expected call of DB.
-func (mr *MockConnMockRecorder) DB() *gomock.Call {
-	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DB", reflect.TypeOf((*MockConn)(nil).DB))
-}
-
 // DeleteTreeNodes mocks base method.
 func (m *MockConn) DeleteTreeNodes(arg0 context.Context, arg1 []common.SHA256Output) (int, error) {
 	m.ctrl.T.Helper()
@@ -401,17 +386,17 @@ func (mr *MockConnMockRecorder) TruncateAllTables(arg0 any) *gomock.Call {
 }
 
 // UpdateCerts mocks base method.
-func (m *MockConn) UpdateCerts(arg0 context.Context, arg1 []common.SHA256Output, arg2 []*common.SHA256Output, arg3 []time.Time, arg4 [][]byte) error {
+func (m *MockConn) UpdateCerts(arg0 context.Context, arg1 []common.SHA256Output, arg2 []*common.SHA256Output, arg3 []time.Time, arg4 [][]byte, arg5 []*db.CertificateEntry) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "UpdateCerts", arg0, arg1, arg2, arg3, arg4)
+	ret := m.ctrl.Call(m, "UpdateCerts", arg0, arg1, arg2, arg3, arg4, arg5)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // UpdateCerts indicates an expected call of UpdateCerts.
-func (mr *MockConnMockRecorder) UpdateCerts(arg0, arg1, arg2, arg3, arg4 any) *gomock.Call {
+func (mr *MockConnMockRecorder) UpdateCerts(arg0, arg1, arg2, arg3, arg4, arg5 any) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateCerts", reflect.TypeOf((*MockConn)(nil).UpdateCerts), arg0, arg1, arg2, arg3, arg4)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "UpdateCerts", reflect.TypeOf((*MockConn)(nil).UpdateCerts), arg0, arg1, arg2, arg3, arg4, arg5)
 }
 
 // UpdateDomainCerts mocks base method.
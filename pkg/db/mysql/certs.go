@@ -5,11 +5,14 @@ import (
 	"database/sql"
 	"encoding/base64"
 	"fmt"
+	"io"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/db"
 	tr "github.com/netsec-ethz/fpki/pkg/tracing"
 )
 
@@ -49,8 +52,47 @@ func (c *mysqlDB) UpdateCerts(
 	parents []*common.SHA256Output,
 	expirations []time.Time,
 	payloads [][]byte,
+	entries []*db.CertificateEntry,
 ) error {
-	return c.updateCertsCSV(ctx, ids, parents, expirations, payloads)
+	return c.updateCertsCSV(ctx, ids, parents, expirations, payloads, entries)
+}
+
+// UpdateCertificateEntries sets the entries of the existing certificates.
+func (c *mysqlDB) UpdateCertificateEntries(
+	ctx context.Context,
+	ids []common.SHA256Output,
+	entries []db.CertificateEntry,
+) error {
+
+	if len(ids) == 0 {
+		return nil
+	}
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("updating certificate entries: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, "UPDATE certs "+
+		"SET entry_type = ?, tbs_id = ?, issuer_key_hash = ? WHERE cert_id = ?")
+	if err != nil {
+		return fmt.Errorf("updating certificate entries: %w", err)
+	}
+	defer stmt.Close()
+	for i, e := range entries {
+		var issuerKeyHash []byte
+		if e.IssuerKeyHash != nil {
+			issuerKeyHash = e.IssuerKeyHash[:]
+		}
+		_, err := stmt.ExecContext(ctx, uint8(e.Type), e.TBSID[:], issuerKeyHash, ids[i][:])
+		if err != nil {
+			return fmt.Errorf("updating certificate entries: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("updating certificate entries: %w", err)
+	}
+	return nil
 }
 
 func (c *mysqlDB) InsertCsvIntoCerts(ctx context.Context, filename string) error {
@@ -58,12 +100,17 @@ func (c *mysqlDB) InsertCsvIntoCerts(ctx context.Context, filename string) error
 	return err
 }
 
+func (c *mysqlDB) StreamCsvIntoCerts(ctx context.Context, r io.Reader) error {
+	return streamCsv(ctx, c.db, r, loadCertsCsv)
+}
+
 func (c *mysqlDB) updateCertsCSV(
 	ctx context.Context,
 	ids []common.SHA256Output,
 	parents []*common.SHA256Output,
 	expirations []time.Time,
 	payloads [][]byte,
+	entries []*db.CertificateEntry,
 ) error {
 	// Remove duplicates for the dirty table insertion.
 	tracer := tr.GetTracer("db")
@@ -75,13 +122,21 @@ func (c *mysqlDB) updateCertsCSV(
 
 		records = make([][]string, len(ids))
 		for i := 0; i < len(ids); i++ {
-			records[i] = make([]string, 4)
+			records[i] = make([]string, 7)
 			records[i][0] = base64.StdEncoding.EncodeToString(ids[i][:])
 			if parents[i] != nil {
 				records[i][1] = base64.StdEncoding.EncodeToString(parents[i][:])
 			}
 			records[i][2] = expirations[i].Format(time.DateTime)
 			records[i][3] = base64.StdEncoding.EncodeToString(payloads[i])
+			if entries != nil && entries[i] != nil {
+				e := entries[i]
+				records[i][4] = strconv.Itoa(int(e.Type))
+				records[i][5] = base64.StdEncoding.EncodeToString(e.TBSID[:])
+				if e.IssuerKeyHash != nil {
+					records[i][6] = base64.StdEncoding.EncodeToString(e.IssuerKeyHash[:])
+				}
+			}
 		}
 
 		span.End()
@@ -172,6 +227,10 @@ func (c *mysqlDB) InsertCsvIntoDomainCerts(ctx context.Context, filename string)
 	return err
 }
 
+func (c *mysqlDB) StreamCsvIntoDomainCerts(ctx context.Context, r io.Reader) error {
+	return streamCsv(ctx, c.db, r, loadDomainCertsCsv)
+}
+
 func (c *mysqlDB) updateDomainCertsCSV(
 	ctx context.Context,
 	domainIDs []common.SHA256Output,
@@ -283,6 +342,23 @@ func (c *mysqlDB) RetrieveCertificatePayloads(
 	return payloads, nil
 }
 
+// RetrieveCertificateRecords returns the certs table row for each certificate identified by
+// the IDs parameter, in the same order. Missing certificates yield a nil record.
+func (c *mysqlDB) RetrieveCertificateRecords(
+	ctx context.Context,
+	IDs []common.SHA256Output,
+) ([]*db.PayloadRecord, error) {
+	return c.retrievePayloadRecords(ctx, "certs", "cert_id", IDs)
+}
+
+// RetrieveCertificateDomains returns the domains that reference the certificate in domain_certs.
+func (c *mysqlDB) RetrieveCertificateDomains(
+	ctx context.Context,
+	certID common.SHA256Output,
+) ([]db.DomainRecord, error) {
+	return c.retrieveReferringDomains(ctx, "domain_certs", "cert_id", certID)
+}
+
 // LastCTlogServerState returns the last state of the server written into the DB.
 // The url specifies the CT log server from which this data comes from.
 func (c *mysqlDB) LastCTlogServerState(ctx context.Context, url string,
@@ -385,12 +461,7 @@ func loadCertsTableWithCSV(
 		return nil, fmt.Errorf("setting permissions to file \"%s\": %w", filepath, err)
 	}
 
-	str := `LOAD DATA CONCURRENT INFILE ? IGNORE INTO TABLE certs ` +
-		`FIELDS TERMINATED BY ',' ENCLOSED BY '"' LINES TERMINATED BY '\n' ` +
-		`(@cert_id,@parent_id,expiration,@payload) SET ` +
-		`cert_id = FROM_BASE64(@cert_id),` +
-		`parent_id = FROM_BASE64(@parent_id),` +
-		`payload = FROM_BASE64(@payload);`
+	str := `LOAD DATA CONCURRENT INFILE ? ` + loadCertsCsv
 	return db.ExecContext(ctx, str, filepath)
 }
 
@@ -405,10 +476,6 @@ func loadDomainCertsTableWithCSV(
 		return nil, fmt.Errorf("setting permissions to file \"%s\": %w", filepath, err)
 	}
 
-	str := `LOAD DATA CONCURRENT INFILE ? IGNORE INTO TABLE domain_certs ` +
-		`FIELDS TERMINATED BY ',' ENCLOSED BY '"' LINES TERMINATED BY '\n' ` +
-		`(@domain_id,@cert_id) SET ` +
-		`domain_id = FROM_BASE64(@domain_id),` +
-		`cert_id = FROM_BASE64(@cert_id);`
+	str := `LOAD DATA CONCURRENT INFILE ? ` + loadDomainCertsCsv
 	return db.ExecContext(ctx, str, filepath)
 }
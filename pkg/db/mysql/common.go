@@ -2,8 +2,14 @@ package mysql
 
 import (
 	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	ct "github.com/google/certificate-transparency-go"
 
 	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/db"
 )
 
 // RetrievePolicyPayloads returns the payload for each certificate OR policy identified by the IDs
@@ -46,3 +52,290 @@ func (c *mysqlDB) RetrieveCertificateOrPolicyPayloads(
 
 	return payloads, nil
 }
+
+// retrievePayloadRecords returns the rows of the table (certs or policies) identified by the IDs
+// parameter, in the same order (element i corresponds to IDs[i]). Missing rows are nil.
+func (c *mysqlDB) retrievePayloadRecords(
+	ctx context.Context,
+	table string,
+	idColumn string,
+	IDs []common.SHA256Output,
+) ([]*db.PayloadRecord, error) {
+	if len(IDs) == 0 {
+		return nil, nil
+	}
+
+	str := fmt.Sprintf("SELECT %s FROM %s WHERE %s IN ",
+		payloadColumns(table, idColumn), table, idColumn) + repeatStmt(1, len(IDs))
+	params := make([]any, len(IDs))
+	for i, id := range IDs {
+		params[i] = id[:]
+	}
+	rows, err := c.db.QueryContext(ctx, str, params...)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving records from %s: %w", table, err)
+	}
+
+	records, err := collectRows(rows, payloadScanner(table))
+	if err != nil {
+		return nil, fmt.Errorf("scanning records from %s: %w", table, err)
+	}
+
+	m := make(map[common.SHA256Output]*db.PayloadRecord, len(records))
+	for _, rec := range records {
+		m[rec.ID] = rec
+	}
+
+	// Sort them in the same order as the IDs.
+	result := make([]*db.PayloadRecord, len(IDs))
+	for i, id := range IDs {
+		result[i] = m[id]
+	}
+	return result, nil
+}
+
+// retrieveReferringDomains returns the domains that reference the ID via the join table
+// (domain_certs or domain_policies), ordered by domain name.
+func (c *mysqlDB) retrieveReferringDomains(
+	ctx context.Context,
+	joinTable string,
+	idColumn string,
+	id common.SHA256Output,
+) ([]db.DomainRecord, error) {
+	str := fmt.Sprintf("SELECT j.domain_id,d.domain_name FROM %s AS j "+
+		"LEFT JOIN domains AS d ON d.domain_id = j.domain_id "+
+		"WHERE j.%s = ? ORDER BY d.domain_name", joinTable, idColumn)
+	rows, err := c.db.QueryContext(ctx, str, id[:])
+	if err != nil {
+		return nil, fmt.Errorf("retrieving domains from %s: %w", joinTable, err)
+	}
+	domains, err := collectRows(rows, scanDomainRecord)
+	if err != nil {
+		return nil, fmt.Errorf("scanning domains from %s: %w", joinTable, err)
+	}
+	return domains, nil
+}
+
+// payloadColumns returns the columns of the certs or policies table that are scanned into a
+// db.PayloadRecord by the function returned by payloadScanner.
+func payloadColumns(table, idColumn string) string {
+	columns := idColumn + ",parent_id,expiration,payload"
+	if table == "certs" {
+		columns += ",entry_type,tbs_id,issuer_key_hash"
+	}
+	return columns
+}
+
+func payloadScanner(table string) func(*sql.Rows) (*db.PayloadRecord, error) {
+	if table == "certs" {
+		return scanCertificateRecord
+	}
+	return scanPayloadRecord
+}
+
+// scanCertificateRecord scans a row with the columns of scanPayloadRecord, followed by the
+// entry_type, tbs_id and issuer_key_hash columns.
+func scanCertificateRecord(rows *sql.Rows) (*db.PayloadRecord, error) {
+	var id, parentID, payload, tbsID, issuerKeyHash []byte
+	var expiration time.Time
+	var entryType sql.NullByte
+	err := rows.Scan(&id, &parentID, &expiration, &payload, &entryType, &tbsID, &issuerKeyHash)
+	if err != nil {
+		return nil, err
+	}
+	rec := &db.PayloadRecord{
+		ID:         *(*common.SHA256Output)(id),
+		Expiration: expiration,
+		Payload:    payload,
+	}
+	if parentID != nil {
+		rec.ParentID = (*common.SHA256Output)(parentID)
+	}
+	if entryType.Valid && len(tbsID) == common.SHA256Size {
+		rec.Entry = &db.CertificateEntry{
+			Type:  ct.LogEntryType(entryType.Byte),
+			TBSID: (common.SHA256Output)(tbsID),
+		}
+		if len(issuerKeyHash) == common.SHA256Size {
+			rec.Entry.IssuerKeyHash = (*common.SHA256Output)(issuerKeyHash)
+		}
+	}
+	return rec, nil
+}
+
+// scanPayloadRecord scans a row with the ID, parent_id, expiration and payload columns.
+func scanPayloadRecord(rows *sql.Rows) (*db.PayloadRecord, error) {
+	var id, parentID, payload []byte
+	var expiration time.Time
+	if err := rows.Scan(&id, &parentID, &expiration, &payload); err != nil {
+		return nil, err
+	}
+	rec := &db.PayloadRecord{
+		ID:         *(*common.SHA256Output)(id),
+		Expiration: expiration,
+		Payload:    payload,
+	}
+	if parentID != nil {
+		rec.ParentID = (*common.SHA256Output)(parentID)
+	}
+	return rec, nil
+}
+
+// scanDomainRecord scans a row with the domain_id and domain_name columns.
+func scanDomainRecord(rows *sql.Rows) (db.DomainRecord, error) {
+	var domainID []byte
+	var name sql.NullString
+	if err := rows.Scan(&domainID, &name); err != nil {
+		return db.DomainRecord{}, err
+	}
+	return db.DomainRecord{
+		DomainID:   *(*common.SHA256Output)(domainID),
+		DomainName: name.String,
+	}, nil
+}
+
+// RetrieveDomainAssociations returns the domain_certs and domain_policies rows of the domains.
+func (c *mysqlDB) RetrieveDomainAssociations(
+	ctx context.Context,
+	domainIDs []common.SHA256Output,
+) ([]db.DomainAssociation, []db.DomainAssociation, error) {
+
+	if len(domainIDs) == 0 {
+		return nil, nil, nil
+	}
+	certs, err := c.retrieveDomainAssociations(ctx, "domain_certs", "cert_id", domainIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+	policies, err := c.retrieveDomainAssociations(ctx, "domain_policies", "policy_id", domainIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certs, policies, nil
+}
+
+// ReplaceDomainAssociations replaces, in one transaction, the domain_certs and domain_policies
+// rows of the domains with the passed ones.
+func (c *mysqlDB) ReplaceDomainAssociations(
+	ctx context.Context,
+	domainIDs []common.SHA256Output,
+	certs []db.DomainAssociation,
+	policies []db.DomainAssociation,
+) error {
+
+	if len(domainIDs) == 0 {
+		return nil
+	}
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("replacing domain associations: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, t := range []struct {
+		table    string
+		idColumn string
+		assocs   []db.DomainAssociation
+	}{
+		{"domain_certs", "cert_id", certs},
+		{"domain_policies", "policy_id", policies},
+	} {
+		str := fmt.Sprintf("DELETE FROM %s WHERE domain_id IN ", t.table) +
+			repeatStmt(1, len(domainIDs))
+		if _, err := tx.ExecContext(ctx, str, idsToParams(domainIDs)...); err != nil {
+			return fmt.Errorf("deleting from %s: %w", t.table, err)
+		}
+		if len(t.assocs) == 0 {
+			continue
+		}
+		str = fmt.Sprintf("INSERT IGNORE INTO %s (domain_id,%s) VALUES ", t.table, t.idColumn) +
+			repeatStmt(len(t.assocs), 2)
+		params := make([]any, 0, 2*len(t.assocs))
+		for _, a := range t.assocs {
+			params = append(params, a.DomainID[:], a.ID[:])
+		}
+		if _, err := tx.ExecContext(ctx, str, params...); err != nil {
+			return fmt.Errorf("inserting into %s: %w", t.table, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("replacing domain associations: %w", err)
+	}
+	return nil
+}
+
+func (c *mysqlDB) retrieveDomainAssociations(
+	ctx context.Context,
+	table string,
+	idColumn string,
+	domainIDs []common.SHA256Output,
+) ([]db.DomainAssociation, error) {
+
+	str := fmt.Sprintf("SELECT domain_id,%s FROM %s WHERE domain_id IN ", idColumn, table) +
+		repeatStmt(1, len(domainIDs))
+	rows, err := c.db.QueryContext(ctx, str, idsToParams(domainIDs)...)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving rows of %s: %w", table, err)
+	}
+	assocs, err := collectRows(rows, scanDomainAssociation)
+	if err != nil {
+		return nil, fmt.Errorf("scanning rows of %s: %w", table, err)
+	}
+	return assocs, nil
+}
+
+// idsToParams returns the IDs as query parameters.
+func idsToParams(ids []common.SHA256Output) []any {
+	params := make([]any, len(ids))
+	for i := range ids {
+		params[i] = ids[i][:]
+	}
+	return params
+}
+
+// RetrieveCertificateParents returns the parent of the existing certificates with the IDs.
+func (c *mysqlDB) RetrieveCertificateParents(ctx context.Context, IDs []common.SHA256Output,
+) ([]db.ParentRecord, error) {
+
+	if len(IDs) == 0 {
+		return nil, nil
+	}
+	str := "SELECT cert_id,parent_id FROM certs WHERE cert_id IN " + repeatStmt(1, len(IDs))
+	return c.retrieveParents(ctx, "certs", str, idsToParams(IDs))
+}
+
+// RetrievePolicyParents returns the parent of the existing policies with the IDs.
+func (c *mysqlDB) RetrievePolicyParents(ctx context.Context, IDs []common.SHA256Output,
+) ([]db.ParentRecord, error) {
+
+	if len(IDs) == 0 {
+		return nil, nil
+	}
+	str := "SELECT policy_id,parent_id FROM policies WHERE policy_id IN " +
+		repeatStmt(1, len(IDs))
+	return c.retrieveParents(ctx, "policies", str, idsToParams(IDs))
+}
+
+// retrieveParents runs the query, which must select an ID and a parent ID.
+func (c *mysqlDB) retrieveParents(ctx context.Context, table, str string, args []any,
+) ([]db.ParentRecord, error) {
+
+	rows, err := c.db.QueryContext(ctx, str, args...)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving parents from %s: %w", table, err)
+	}
+	parents, err := collectRows(rows, func(rows *sql.Rows) (db.ParentRecord, error) {
+		var id, parentID []byte
+		if err := rows.Scan(&id, &parentID); err != nil {
+			return db.ParentRecord{}, err
+		}
+		return db.ParentRecord{
+			ID:       *(*common.SHA256Output)(id),
+			ParentID: (*common.SHA256Output)(parentID),
+		}, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("scanning parents from %s: %w", table, err)
+	}
+	return parents, nil
+}
@@ -0,0 +1,22 @@
+package mysql_test
+
+import (
+	"testing"
+
+	"github.com/netsec-ethz/fpki/pkg/db"
+	"github.com/netsec-ethz/fpki/pkg/db/dbtest"
+	"github.com/netsec-ethz/fpki/pkg/db/mysql"
+	"github.com/netsec-ethz/fpki/pkg/tests/testdb"
+)
+
+func TestConformance(t *testing.T) {
+	dbtest.Run(t, dbtest.Backend{
+		New: func(t *testing.T) db.Conn {
+			config, removeF := testdb.ConfigureTestDB(t)
+			t.Cleanup(removeF)
+			return testdb.Connect(t, config)
+		},
+		// The MySQL server reads the CSV files from its own temporary directory.
+		CSVDir: mysql.TemporaryDir,
+	})
+}
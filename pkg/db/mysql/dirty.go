@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"encoding/base64"
 	"fmt"
+	"io"
 	"os"
 	"sync"
 	"sync/atomic"
@@ -110,6 +111,37 @@ func (c *mysqlDB) RetrieveDirtyDomains(ctx context.Context) ([]common.SHA256Outp
 	return domainIDs, nil
 }
 
+// CheckDomainsDirty returns whether each domain is in the dirty table.
+func (c *mysqlDB) CheckDomainsDirty(ctx context.Context, ids []common.SHA256Output,
+) ([]bool, error) {
+
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	str := "SELECT domain_id FROM dirty WHERE domain_id IN " + repeatStmt(1, len(ids))
+	rows, err := c.db.QueryContext(ctx, str, idsToParams(ids)...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying dirty domains: %w", err)
+	}
+	found, err := collectRows(rows, func(rows *sql.Rows) (common.SHA256Output, error) {
+		var id []byte
+		err := rows.Scan(&id)
+		return common.SHA256Output(id), err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error scanning domain ID: %w", err)
+	}
+	present := make(map[common.SHA256Output]struct{}, len(found))
+	for _, id := range found {
+		present[id] = struct{}{}
+	}
+	dirty := make([]bool, len(ids))
+	for i, id := range ids {
+		_, dirty[i] = present[id]
+	}
+	return dirty, nil
+}
+
 func (c *mysqlDB) InsertDomainsIntoDirty(
 	ctx context.Context,
 	domainIDs []common.SHA256Output,
@@ -122,6 +154,10 @@ func (c *mysqlDB) InsertCsvIntoDirty(ctx context.Context, filename string) error
 	return err
 }
 
+func (c *mysqlDB) StreamCsvIntoDirty(ctx context.Context, r io.Reader) error {
+	return streamCsv(ctx, c.db, r, loadDirtyCsv)
+}
+
 func (c *mysqlDB) insertDomainsIntoDirtyCSV(
 	ctx context.Context,
 	domainIDs []common.SHA256Output,
@@ -315,10 +351,6 @@ func loadDirtyTableWithCSV(
 		return nil, fmt.Errorf("setting permissions to file \"%s\": %w", filepath, err)
 	}
 
-	str := `LOAD DATA CONCURRENT INFILE ? REPLACE INTO TABLE dirty ` +
-		`FIELDS TERMINATED BY ',' ENCLOSED BY '"' LINES TERMINATED BY '\n' ` +
-		`(@domain_id) SET ` +
-		`domain_id = FROM_BASE64(@domain_id), ` +
-		`coalesced = FALSE;`
+	str := `LOAD DATA CONCURRENT INFILE ? ` + loadDirtyCsv
 	return db.ExecContext(ctx, str, filepath)
 }
@@ -0,0 +1,136 @@
+package mysql
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/db"
+)
+
+// SearchDomains returns the domains selected by the search, sorted by their reversed name.
+// Suffix and pattern searches use the index on the reversed_name column.
+func (c *mysqlDB) SearchDomains(ctx context.Context, search db.DomainSearch,
+) ([]db.DomainRecord, error) {
+
+	where, args := domainSearchConditions(search)
+	if search.After != "" {
+		where = append(where, "reversed_name > ?")
+		args = append(args, reverseString(search.After))
+	}
+	str := "SELECT domain_id,domain_name FROM domains" + whereClause(where) +
+		" ORDER BY reversed_name"
+	if search.Limit > 0 {
+		str += " LIMIT ?"
+		args = append(args, search.Limit)
+	}
+
+	rows, err := c.db.QueryContext(ctx, str, args...)
+	if err != nil {
+		return nil, fmt.Errorf("searching domains: %w", err)
+	}
+	domains, err := collectRows(rows, scanDomainRecord)
+	if err != nil {
+		return nil, fmt.Errorf("scanning domains: %w", err)
+	}
+	return domains, nil
+}
+
+// CountDomains returns the number of domains selected by the search, ignoring its pagination.
+func (c *mysqlDB) CountDomains(ctx context.Context, search db.DomainSearch) (uint64, error) {
+	where, args := domainSearchConditions(search)
+	str := "SELECT COUNT(*) FROM domains" + whereClause(where)
+
+	var count uint64
+	if err := c.db.QueryRowContext(ctx, str, args...).Scan(&count); err != nil {
+		return 0, fmt.Errorf("counting domains: %w", err)
+	}
+	return count, nil
+}
+
+// domainSearchConditions returns the SQL conditions and their arguments for the suffix and
+// pattern criteria of the search.
+func domainSearchConditions(search db.DomainSearch) ([]string, []any) {
+	var where []string
+	var args []any
+
+	if suffix := strings.Trim(search.Suffix, "."); suffix != "" {
+		// Subdomains of example.com have a reversed name starting with "moc.elpmaxe.".
+		where = append(where, "reversed_name LIKE ?")
+		args = append(args, escapeLike(reverseString("."+suffix))+"%")
+	}
+	if search.Pattern != "" {
+		where = append(where, "domain_name LIKE ?")
+		args = append(args, globToLike(search.Pattern))
+
+		// The literal tail after the last wildcard lets MySQL do a range scan on reversed_name.
+		if tail := search.Pattern[strings.LastIndexAny(search.Pattern, "*?")+1:]; tail != "" &&
+			tail != search.Pattern {
+
+			where = append(where, "reversed_name LIKE ?")
+			args = append(args, escapeLike(reverseString(tail))+"%")
+		}
+	}
+	return where, args
+}
+
+func whereClause(conditions []string) string {
+	if len(conditions) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(conditions, " AND ")
+}
+
+// globToLike converts a pattern with '*' and '?' wildcards into a LIKE expression.
+func globToLike(pattern string) string {
+	var b strings.Builder
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			b.WriteByte('%')
+		case '?':
+			b.WriteByte('_')
+		case '%', '_', '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// escapeLike escapes the LIKE special characters of s.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// reverseString reverses the bytes of s, which is what REVERSE does for ascii domain names.
+func reverseString(s string) string {
+	b := []byte(s)
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return string(b)
+}
+
+// RetrieveDomains returns the rows of the domains table for the IDs. Missing domains are skipped.
+func (c *mysqlDB) RetrieveDomains(ctx context.Context, ids []common.SHA256Output,
+) ([]db.DomainRecord, error) {
+
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	str := "SELECT domain_id,domain_name FROM domains WHERE domain_id IN " +
+		repeatStmt(1, len(ids))
+	rows, err := c.db.QueryContext(ctx, str, idsToParams(ids)...)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving domains: %w", err)
+	}
+	domains, err := collectRows(rows, scanDomainRecord)
+	if err != nil {
+		return nil, fmt.Errorf("scanning domains: %w", err)
+	}
+	return domains, nil
+}
@@ -0,0 +1,151 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/db"
+)
+
+// RecordEpoch stores a new epoch with the current root and the largest row ID of the tree
+// table, and associates all the domains in the dirty table with it.
+func (c *mysqlDB) RecordEpoch(ctx context.Context) (*db.Epoch, error) {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("recording epoch: %w", err)
+	}
+	defer tx.Rollback()
+
+	var root []byte
+	if err := tx.QueryRowContext(ctx, "SELECT key32 FROM root").Scan(&root); err != nil {
+		return nil, fmt.Errorf("recording epoch, obtaining the root: %w", err)
+	}
+	epoch := &db.Epoch{
+		Root: *(*common.SHA256Output)(root),
+	}
+	str := "SELECT COALESCE(MAX(epoch),0)+1, (SELECT COALESCE(MAX(id),0) FROM tree) FROM epochs"
+	if err := tx.QueryRowContext(ctx, str).Scan(&epoch.Number, &epoch.TreeID); err != nil {
+		return nil, fmt.Errorf("recording epoch, obtaining its number: %w", err)
+	}
+	str = "INSERT INTO epochs (epoch,root,tree_id) VALUES (?,?,?)"
+	if _, err := tx.ExecContext(ctx, str, epoch.Number, epoch.Root[:], epoch.TreeID); err != nil {
+		return nil, fmt.Errorf("recording epoch %d: %w", epoch.Number, err)
+	}
+	str = "INSERT INTO epoch_domains (epoch,domain_id) SELECT ?,domain_id FROM dirty"
+	if _, err := tx.ExecContext(ctx, str, epoch.Number); err != nil {
+		return nil, fmt.Errorf("recording domains of epoch %d: %w", epoch.Number, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("recording epoch %d: %w", epoch.Number, err)
+	}
+	return epoch, nil
+}
+
+// SaveEpoch stores the epoch as is, and its root as the current one. Its domains are not
+// recorded.
+func (c *mysqlDB) SaveEpoch(ctx context.Context, epoch *db.Epoch) error {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("saving epoch %d: %w", epoch.Number, err)
+	}
+	defer tx.Rollback()
+
+	str := "REPLACE INTO root (key32) VALUES (?)"
+	if _, err := tx.ExecContext(ctx, str, epoch.Root[:]); err != nil {
+		return fmt.Errorf("saving root of epoch %d: %w", epoch.Number, err)
+	}
+	str = "INSERT INTO epochs (epoch,root,tree_id) VALUES (?,?,?)"
+	if _, err := tx.ExecContext(ctx, str, epoch.Number, epoch.Root[:], epoch.TreeID); err != nil {
+		return fmt.Errorf("saving epoch %d: %w", epoch.Number, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("saving epoch %d: %w", epoch.Number, err)
+	}
+	return nil
+}
+
+func (c *mysqlDB) LastEpoch(ctx context.Context) (*db.Epoch, error) {
+	return c.retrieveEpoch(ctx,
+		"SELECT epoch,root,tree_id FROM epochs ORDER BY epoch DESC LIMIT 1")
+}
+
+func (c *mysqlDB) RetrieveEpoch(ctx context.Context, number uint64) (*db.Epoch, error) {
+	return c.retrieveEpoch(ctx, "SELECT epoch,root,tree_id FROM epochs WHERE epoch = ?", number)
+}
+
+func (c *mysqlDB) retrieveEpoch(ctx context.Context, str string, args ...any) (*db.Epoch, error) {
+	var root []byte
+	epoch := &db.Epoch{}
+	err := c.db.QueryRowContext(ctx, str, args...).Scan(&epoch.Number, &root, &epoch.TreeID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("retrieving epoch: %w", err)
+	}
+	epoch.Root = *(*common.SHA256Output)(root)
+	return epoch, nil
+}
+
+// RetrieveEpochDomainsPage returns the IDs of the domains modified in the epochs in (from,to].
+func (c *mysqlDB) RetrieveEpochDomainsPage(
+	ctx context.Context,
+	from, to uint64,
+	after *common.SHA256Output,
+	limit int,
+) ([]common.SHA256Output, error) {
+
+	str := "SELECT DISTINCT domain_id FROM epoch_domains WHERE epoch > ? AND epoch <= ?"
+	args := []any{from, to}
+	if after != nil {
+		str += " AND domain_id > ?"
+		args = append(args, after[:])
+	}
+	str += " ORDER BY domain_id LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := c.db.QueryContext(ctx, str, args...)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving domains of epochs (%d,%d]: %w", from, to, err)
+	}
+	ids, err := collectRows(rows, func(rows *sql.Rows) (common.SHA256Output, error) {
+		var id []byte
+		err := rows.Scan(&id)
+		return *(*common.SHA256Output)(id), err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("scanning domains of epochs (%d,%d]: %w", from, to, err)
+	}
+	return ids, nil
+}
+
+// RetrieveTreeNodesPage returns the nodes of the tree table with a row ID in (after,upTo].
+// Because nodes are written with REPLACE, a modified node always gets a new row ID.
+func (c *mysqlDB) RetrieveTreeNodesPage(
+	ctx context.Context,
+	after, upTo uint64,
+	limit int,
+) ([]*db.TreeNodeRecord, uint64, error) {
+
+	str := "SELECT id,key32,value FROM tree WHERE id > ? AND id <= ? ORDER BY id LIMIT ?"
+	rows, err := c.db.QueryContext(ctx, str, after, upTo, limit)
+	if err != nil {
+		return nil, 0, fmt.Errorf("retrieving tree nodes: %w", err)
+	}
+	last := after
+	nodes, err := collectRows(rows, func(rows *sql.Rows) (*db.TreeNodeRecord, error) {
+		var key []byte
+		node := &db.TreeNodeRecord{}
+		if err := rows.Scan(&last, &key, &node.Value); err != nil {
+			return nil, err
+		}
+		node.Key = *(*common.SHA256Output)(key)
+		return node, nil
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("scanning tree nodes: %w", err)
+	}
+	return nodes, last, nil
+}
@@ -51,7 +51,7 @@ func CallCalcDirtyDomainsForTests(
 	partition int,
 	chunkSize int,
 ) (int64, error) {
-	sqlConn, err := conn.DB().Conn(ctx)
+	sqlConn, err := conn.(*mysqlDB).db.Conn(ctx)
 	if err != nil {
 		return 0, fmt.Errorf("creating SQL connection for test: %w", err)
 	}
@@ -0,0 +1,231 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/netsec-ethz/fpki/pkg/db"
+)
+
+// EnqueueIngestJob inserts the job and its batches in one transaction.
+func (c *mysqlDB) EnqueueIngestJob(
+	ctx context.Context,
+	job *db.IngestJob,
+	batches []db.IngestBatch,
+) error {
+
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("enqueuing ingest job %q: %w", job.Name, err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, "INSERT IGNORE INTO ingest_jobs (job,strategy) VALUES (?,?)",
+		job.Name, job.Strategy)
+	if err != nil {
+		return fmt.Errorf("enqueuing ingest job %q: %w", job.Name, err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("enqueuing ingest job %q: %w", job.Name, err)
+	} else if n == 0 {
+		return fmt.Errorf("enqueuing ingest job %q: %w", job.Name, db.ErrIngestJobExists)
+	}
+
+	str := "INSERT INTO ingest_batches (job,id,log_key,first_index,last_index,files) " +
+		"VALUES (?,?,?,?,?,?)"
+	for _, b := range batches {
+		files, err := json.Marshal(b.Files)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, str, job.Name, b.ID, b.Key, b.Start, b.End, files)
+		if err != nil {
+			return fmt.Errorf("enqueuing batch %d of ingest job %q: %w", b.ID, job.Name, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("enqueuing ingest job %q: %w", job.Name, err)
+	}
+	return nil
+}
+
+func (c *mysqlDB) RetrieveIngestJob(
+	ctx context.Context,
+	name string,
+) (*db.IngestJob, []db.IngestBatch, error) {
+
+	job := &db.IngestJob{Name: name}
+	var expiry sql.NullTime
+	str := "SELECT strategy,finalizer,lease_expiry,finalized FROM ingest_jobs WHERE job = ?"
+	err := c.db.QueryRowContext(ctx, str, name).Scan(
+		&job.Strategy, &job.Finalizer, &expiry, &job.Finalized)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil, nil
+		}
+		return nil, nil, fmt.Errorf("retrieving ingest job %q: %w", name, err)
+	}
+	job.LeaseExpiry = expiry.Time
+
+	str = "SELECT job,id,log_key,first_index,last_index,files,worker,lease_expiry,done " +
+		"FROM ingest_batches WHERE job = ? ORDER BY id"
+	rows, err := c.db.QueryContext(ctx, str, name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("retrieving batches of ingest job %q: %w", name, err)
+	}
+	batches, err := collectRows(rows, scanIngestBatch)
+	if err != nil {
+		return nil, nil, fmt.Errorf("scanning batches of ingest job %q: %w", name, err)
+	}
+	return job, batches, nil
+}
+
+// ClaimIngestBatch locks the first claimable batch, skipping those locked by other workers
+// claiming concurrently, and leases it to the worker.
+func (c *mysqlDB) ClaimIngestBatch(
+	ctx context.Context,
+	job, worker string,
+	lease time.Duration,
+) (*db.IngestBatch, error) {
+
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("claiming batch of ingest job %q: %w", job, err)
+	}
+	defer tx.Rollback()
+
+	str := "SELECT job,id,log_key,first_index,last_index,files,worker," +
+		"NOW(6) + INTERVAL ? MICROSECOND,done FROM ingest_batches " +
+		"WHERE job = ? AND NOT done AND (lease_expiry IS NULL OR lease_expiry < NOW(6)) " +
+		"ORDER BY id LIMIT 1 FOR UPDATE SKIP LOCKED"
+	rows, err := tx.QueryContext(ctx, str, lease.Microseconds(), job)
+	if err != nil {
+		return nil, fmt.Errorf("claiming batch of ingest job %q: %w", job, err)
+	}
+	batches, err := collectRows(rows, scanIngestBatch)
+	if err != nil {
+		return nil, fmt.Errorf("claiming batch of ingest job %q: %w", job, err)
+	}
+	if len(batches) == 0 {
+		return nil, nil
+	}
+	b := &batches[0]
+	b.Worker = worker
+
+	str = "UPDATE ingest_batches SET worker = ?, lease_expiry = ? WHERE job = ? AND id = ?"
+	if _, err := tx.ExecContext(ctx, str, worker, b.LeaseExpiry, job, b.ID); err != nil {
+		return nil, fmt.Errorf("claiming batch %d of ingest job %q: %w", b.ID, job, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("claiming batch %d of ingest job %q: %w", b.ID, job, err)
+	}
+	return b, nil
+}
+
+func (c *mysqlDB) RenewIngestBatchLease(
+	ctx context.Context,
+	job string,
+	id uint64,
+	worker string,
+	lease time.Duration,
+) error {
+
+	str := "UPDATE ingest_batches SET lease_expiry = NOW(6) + INTERVAL ? MICROSECOND " +
+		"WHERE job = ? AND id = ? AND worker = ? AND NOT done"
+	res, err := c.db.ExecContext(ctx, str, lease.Microseconds(), job, id, worker)
+	if err != nil {
+		return fmt.Errorf("renewing lease of batch %d of ingest job %q: %w", id, job, err)
+	}
+	return leaseResult(res, fmt.Sprintf("batch %d of ingest job %q", id, job))
+}
+
+func (c *mysqlDB) CompleteIngestBatch(
+	ctx context.Context,
+	job string,
+	id uint64,
+	worker string,
+) error {
+
+	str := "UPDATE ingest_batches SET done = TRUE, lease_expiry = NULL " +
+		"WHERE job = ? AND id = ? AND worker = ? AND NOT done"
+	res, err := c.db.ExecContext(ctx, str, job, id, worker)
+	if err != nil {
+		return fmt.Errorf("completing batch %d of ingest job %q: %w", id, job, err)
+	}
+	return leaseResult(res, fmt.Sprintf("batch %d of ingest job %q", id, job))
+}
+
+func (c *mysqlDB) ClaimIngestFinalization(
+	ctx context.Context,
+	job, worker string,
+	lease time.Duration,
+) (bool, error) {
+
+	str := "UPDATE ingest_jobs SET finalizer = ?, " +
+		"lease_expiry = NOW(6) + INTERVAL ? MICROSECOND " +
+		"WHERE job = ? AND NOT finalized " +
+		"AND (lease_expiry IS NULL OR lease_expiry < NOW(6)) " +
+		"AND NOT EXISTS (SELECT 1 FROM ingest_batches WHERE job = ? AND NOT done)"
+	res, err := c.db.ExecContext(ctx, str, worker, lease.Microseconds(), job, job)
+	if err != nil {
+		return false, fmt.Errorf("claiming finalization of ingest job %q: %w", job, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("claiming finalization of ingest job %q: %w", job, err)
+	}
+	return n == 1, nil
+}
+
+func (c *mysqlDB) RenewIngestFinalizationLease(
+	ctx context.Context,
+	job, worker string,
+	lease time.Duration,
+) error {
+
+	str := "UPDATE ingest_jobs SET lease_expiry = NOW(6) + INTERVAL ? MICROSECOND " +
+		"WHERE job = ? AND finalizer = ? AND NOT finalized"
+	res, err := c.db.ExecContext(ctx, str, lease.Microseconds(), job, worker)
+	if err != nil {
+		return fmt.Errorf("renewing lease of finalization of ingest job %q: %w", job, err)
+	}
+	return leaseResult(res, fmt.Sprintf("finalization of ingest job %q", job))
+}
+
+func (c *mysqlDB) CompleteIngestFinalization(ctx context.Context, job, worker string) error {
+	str := "UPDATE ingest_jobs SET finalized = TRUE, lease_expiry = NULL " +
+		"WHERE job = ? AND finalizer = ? AND NOT finalized"
+	res, err := c.db.ExecContext(ctx, str, job, worker)
+	if err != nil {
+		return fmt.Errorf("completing finalization of ingest job %q: %w", job, err)
+	}
+	return leaseResult(res, fmt.Sprintf("finalization of ingest job %q", job))
+}
+
+func scanIngestBatch(rows *sql.Rows) (db.IngestBatch, error) {
+	var b db.IngestBatch
+	var files []byte
+	var expiry sql.NullTime
+	err := rows.Scan(&b.Job, &b.ID, &b.Key, &b.Start, &b.End, &files, &b.Worker, &expiry, &b.Done)
+	if err != nil {
+		return b, err
+	}
+	b.LeaseExpiry = expiry.Time
+	return b, json.Unmarshal(files, &b.Files)
+}
+
+// leaseResult returns db.ErrIngestLeaseLost if the statement did not change any row. The
+// statements always change the row they match, as they set the lease expiry or the done flag.
+func leaseResult(res sql.Result, what string) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("%s: %w", what, err)
+	}
+	if n == 0 {
+		return fmt.Errorf("%s: %w", what, db.ErrIngestLeaseLost)
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package mysql
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"net/url"
@@ -43,7 +44,9 @@ func Connect(config *db.Configuration) (*mysqlDB, error) {
 
 	// check schema
 	if config.CheckSchema {
-		if err := checkSchema(db); err != nil {
+		ctx, cancelF := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancelF()
+		if err := checkSchema(ctx, db); err != nil {
 			return nil, fmt.Errorf("checking schema on connection: %w", err)
 		}
 	}
@@ -93,21 +96,26 @@ func connect(config *db.Configuration) (*sql.DB, error) {
 	return sql.Open("mysql", dsn.String())
 }
 
-func checkSchema(c *sql.DB) error {
-	_, err := c.Query("SELECT COUNT(*) FROM nodes")
+// checkSchema checks that all the migrations have been applied to the DB, and raises the
+// maximum number of connections of the server.
+func checkSchema(ctx context.Context, c *sql.DB) error {
+	version, err := schemaVersion(ctx, c)
 	if err != nil {
-		return fmt.Errorf("table nodes: %w", err)
+		return err
+	}
+	if latest := LatestSchemaVersion(); version != latest {
+		return fmt.Errorf("schema version is %d but %d is expected, migrate the DB with "+
+			"\"mapserver migrate\"", version, latest)
 	}
-	row := c.QueryRow("SHOW STATUS LIKE 'max_used_connections'")
+	row := c.QueryRowContext(ctx, "SHOW STATUS LIKE 'max_used_connections'")
 	var varName string
 	var varValue string
 	if err = row.Scan(&varName, &varValue); err != nil {
 		return err
 	}
 	fmt.Printf("***************** Init %s : %s\n", varName, varValue)
-	if _, err = c.Exec("SET GLOBAL max_connections = 1024"); err != nil {
+	if _, err = c.ExecContext(ctx, "SET GLOBAL max_connections = 1024"); err != nil {
 		return err
 	}
-	fmt.Printf("***************** Init %s : %s\n", varName, varValue)
 	return nil
 }
@@ -0,0 +1,225 @@
+package mysql
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The migrations are the SQL files in the migrations directory, named
+// <version>_<name>.sql, e.g. 0002_calc_dirty_domains.sql. Each one is applied once, in the
+// order of its version, and recorded in the schema_version table. A released migration is
+// never modified: changes to the schema, including to the stored procedures, are new
+// migrations. The files follow the syntax of the mysql client, including DELIMITER, so that
+// they can also be applied by hand.
+// The initial migrations create the tables and procedures only if they don't exist, so that
+// DBs created before the migrations existed can be migrated as well.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockTimeout is how long Migrate waits for other migrations of the same DB.
+const migrationLockTimeout = time.Minute
+
+// Migration is a forward change of the schema.
+type Migration struct {
+	Version    int
+	Name       string
+	Statements []string
+}
+
+// Migrations returns all the migrations sorted by version.
+func Migrations() ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	migrations := make([]Migration, 0, len(entries))
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".sql")
+		if !ok {
+			continue
+		}
+		version, name, ok := strings.Cut(name, "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %s: no version", e.Name())
+		}
+		v, err := strconv.Atoi(version)
+		if err != nil || v <= 0 {
+			return nil, fmt.Errorf("migration %s: bad version %q", e.Name(), version)
+		}
+		contents, err := migrationFiles.ReadFile(path.Join("migrations", e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		statements, err := splitStatements(string(contents))
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: %w", e.Name(), err)
+		}
+		migrations = append(migrations, Migration{
+			Version:    v,
+			Name:       name,
+			Statements: statements,
+		})
+	}
+	slices.SortFunc(migrations, func(a, b Migration) int { return a.Version - b.Version })
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration %d_%s: expected version %d", m.Version, m.Name, i+1)
+		}
+	}
+	return migrations, nil
+}
+
+// LatestSchemaVersion returns the version of the schema after applying all migrations.
+func LatestSchemaVersion() int {
+	migrations, err := Migrations()
+	if err != nil {
+		panic(fmt.Errorf("embedded migrations: %w", err))
+	}
+	return len(migrations)
+}
+
+// SchemaVersion returns the version of the schema of the DB, or 0 if no migration was applied.
+func SchemaVersion(ctx context.Context, c *sql.DB) (int, error) {
+	return schemaVersion(ctx, c)
+}
+
+// Migrate applies, in order, the migrations after the schema version of the DB up to and
+// including the version `to`, or up to the latest one if `to` is 0. It returns the applied
+// migrations. Concurrent calls for the same DB wait for each other.
+// MySQL commits each change of the schema implicitly, so a failed migration can leave part of
+// its statements applied. The migration is not recorded, and it must be fixed by hand.
+func Migrate(ctx context.Context, c *sql.DB, to int) ([]Migration, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+	if to == 0 {
+		to = len(migrations)
+	}
+	if to < 0 || to > len(migrations) {
+		return nil, fmt.Errorf("unknown schema version %d, the latest is %d", to, len(migrations))
+	}
+
+	// All statements of the migration run on the same connection, which holds the lock.
+	conn, err := c.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var locked sql.NullInt64
+	err = conn.QueryRowContext(ctx, "SELECT GET_LOCK(CONCAT(DATABASE(),'.migrate'),?)",
+		int(migrationLockTimeout.Seconds())).Scan(&locked)
+	if err != nil {
+		return nil, fmt.Errorf("locking the schema: %w", err)
+	}
+	if locked.Int64 != 1 {
+		return nil, fmt.Errorf("locking the schema: timeout waiting for another migration")
+	}
+	defer conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK(CONCAT(DATABASE(),'.migrate'))")
+
+	str := "CREATE TABLE IF NOT EXISTS schema_version (" +
+		"version INT UNSIGNED NOT NULL," +
+		"name VARCHAR(255) NOT NULL," +
+		"applied DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"PRIMARY KEY (version)" +
+		") ENGINE=InnoDB CHARSET=binary COLLATE=binary"
+	if _, err := conn.ExecContext(ctx, str); err != nil {
+		return nil, fmt.Errorf("creating schema_version: %w", err)
+	}
+	current, err := schemaVersion(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	if current > len(migrations) {
+		return nil, fmt.Errorf("schema version %d is newer than the latest known %d",
+			current, len(migrations))
+	}
+	if current > to {
+		return nil, fmt.Errorf("schema version %d is newer than %d, and only forward "+
+			"migrations exist", current, to)
+	}
+
+	var applied []Migration
+	for _, m := range migrations[current:to] {
+		for i, s := range m.Statements {
+			if _, err := conn.ExecContext(ctx, s); err != nil {
+				return applied, fmt.Errorf("migration %d_%s, statement %d: %w",
+					m.Version, m.Name, i+1, err)
+			}
+		}
+		str := "INSERT INTO schema_version (version,name) VALUES (?,?)"
+		if _, err := conn.ExecContext(ctx, str, m.Version, m.Name); err != nil {
+			return applied, fmt.Errorf("recording migration %d_%s: %w", m.Version, m.Name, err)
+		}
+		applied = append(applied, m)
+	}
+	return applied, nil
+}
+
+// queryRower is either a *sql.DB or a *sql.Conn.
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func schemaVersion(ctx context.Context, c queryRower) (int, error) {
+	var exists int
+	str := "SELECT COUNT(*) FROM information_schema.tables " +
+		"WHERE table_schema = DATABASE() AND table_name = 'schema_version'"
+	if err := c.QueryRowContext(ctx, str).Scan(&exists); err != nil {
+		return 0, fmt.Errorf("looking for schema_version: %w", err)
+	}
+	if exists == 0 {
+		return 0, nil
+	}
+	var version int
+	str = "SELECT COALESCE(MAX(version),0) FROM schema_version"
+	if err := c.QueryRowContext(ctx, str).Scan(&version); err != nil {
+		return 0, fmt.Errorf("obtaining the schema version: %w", err)
+	}
+	return version, nil
+}
+
+// splitStatements splits the SQL script into statements as the mysql client does: each one
+// ends with the delimiter, which is ";" unless changed with DELIMITER. Lines with only
+// comments between statements are dropped.
+func splitStatements(script string) ([]string, error) {
+	var statements []string
+	var current []string
+	delimiter := ";"
+	scanner := bufio.NewScanner(strings.NewReader(script))
+	for scanner.Scan() {
+		line := scanner.Text()
+		trimmed := strings.TrimSpace(line)
+		if len(current) == 0 && (trimmed == "" || strings.HasPrefix(trimmed, "--")) {
+			continue
+		}
+		if d, ok := strings.CutPrefix(trimmed, "DELIMITER "); ok && len(current) == 0 {
+			delimiter = strings.TrimSpace(d)
+			continue
+		}
+		if s, ok := strings.CutSuffix(strings.TrimRight(line, " \t"), delimiter); ok {
+			current = append(current, s)
+			statements = append(statements, strings.TrimSpace(strings.Join(current, "\n")))
+			current = nil
+			continue
+		}
+		current = append(current, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(current) > 0 {
+		return nil, fmt.Errorf("statement without delimiter %q: %s", delimiter, current[0])
+	}
+	return statements, nil
+}
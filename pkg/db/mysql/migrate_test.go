@@ -0,0 +1,103 @@
+package mysql_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/db/mysql"
+	"github.com/netsec-ethz/fpki/pkg/tests/testdb"
+)
+
+// TestMigrations checks that the embedded migrations are parsed into their statements.
+func TestMigrations(t *testing.T) {
+	migrations, err := mysql.Migrations()
+	require.NoError(t, err)
+	require.Equal(t, mysql.LatestSchemaVersion(), len(migrations))
+	for i, m := range migrations {
+		require.Equal(t, i+1, m.Version)
+		require.NotEmpty(t, m.Statements, m.Name)
+		for _, s := range m.Statements {
+			require.False(t, strings.HasSuffix(s, ";"), "statement with delimiter: %s", s)
+			require.NotContains(t, s, "DELIMITER")
+		}
+	}
+
+	// The stored procedures are one statement each, despite the delimiters in their body.
+	require.Equal(t, "calc_dirty_domains", migrations[1].Name)
+	require.Equal(t, "DROP PROCEDURE IF EXISTS calc_dirty_domains", migrations[1].Statements[0])
+	require.Len(t, migrations[1].Statements, 2)
+	require.True(t, strings.HasPrefix(migrations[1].Statements[1], "CREATE PROCEDURE"))
+	require.True(t, strings.HasSuffix(migrations[1].Statements[1], "END"))
+}
+
+// TestMigrate checks that migrating twice does nothing, and that the schema is then valid, also
+// when migrating a DB created before the migrations existed.
+func TestMigrate(t *testing.T) {
+	ctx, cancelF := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancelF()
+
+	// The test DB is already migrated.
+	config, removeF := testdb.ConfigureTestDB(t)
+	defer removeF()
+	conn := testdb.Connect(t, config)
+	defer conn.Close()
+
+	version, err := mysql.SchemaVersion(ctx, conn.DB())
+	require.NoError(t, err)
+	require.Equal(t, mysql.LatestSchemaVersion(), version)
+	require.NoError(t, conn.CheckSchema(ctx))
+
+	applied, err := mysql.Migrate(ctx, conn.DB(), 0)
+	require.NoError(t, err)
+	require.Empty(t, applied)
+	_, err = mysql.Migrate(ctx, conn.DB(), 1)
+	require.Error(t, err)
+
+	// A DB created before the migrations existed has the tables and procedures of the first
+	// migrations, and no schema version.
+	tables, err := conn.DB().QueryContext(ctx, "SELECT table_name FROM "+
+		"information_schema.tables WHERE table_schema = DATABASE()")
+	require.NoError(t, err)
+	var names []string
+	for tables.Next() {
+		var name string
+		require.NoError(t, tables.Scan(&name))
+		names = append(names, name)
+	}
+	require.NoError(t, tables.Err())
+	for _, name := range names {
+		_, err = conn.DB().ExecContext(ctx, "DROP TABLE "+name)
+		require.NoError(t, err)
+	}
+	applied, err = mysql.Migrate(ctx, conn.DB(), baselineSchemaVersion)
+	require.NoError(t, err)
+	require.Len(t, applied, baselineSchemaVersion)
+	_, err = conn.DB().ExecContext(ctx, "DROP TABLE schema_version")
+	require.NoError(t, err)
+	domainID := common.SHA256Hash32Bytes([]byte("a.example.com"))
+	_, err = conn.DB().ExecContext(ctx, "INSERT INTO domains (domain_id,domain_name) "+
+		"VALUES (?,?)", domainID[:], "a.example.com")
+	require.NoError(t, err)
+	require.Error(t, conn.CheckSchema(ctx))
+
+	applied, err = mysql.Migrate(ctx, conn.DB(), 0)
+	require.NoError(t, err)
+	require.Len(t, applied, mysql.LatestSchemaVersion())
+	require.NoError(t, conn.CheckSchema(ctx))
+
+	// The domains of the DB can be searched by suffix.
+	var reversed string
+	err = conn.DB().QueryRowContext(ctx, "SELECT reversed_name FROM domains "+
+		"WHERE domain_id = ?", domainID[:]).Scan(&reversed)
+	require.NoError(t, err)
+	require.Equal(t, "moc.elpmaxe.a", reversed)
+}
+
+// baselineSchemaVersion is the version of the schema created by tools/create_schema.sh before
+// the migrations existed: its tables and the calc_dirty_domains and prune procedures.
+const baselineSchemaVersion = 3
@@ -0,0 +1,110 @@
+-- The initial tables of the map server. The tables with a shard column are partitioned by the 5
+-- most significant bits of their ID.
+
+CREATE TABLE IF NOT EXISTS domains (
+  domain_id VARBINARY(32) NOT NULL,
+  shard TINYINT UNSIGNED AS
+    (ORD(LEFT(domain_id, 1)) >> 3 ) STORED,
+  domain_name VARCHAR(300) COLLATE ascii_bin DEFAULT NULL,
+
+  PRIMARY KEY (domain_id,shard),
+  INDEX domain_name (domain_name)
+) ENGINE=InnoDB CHARSET=binary COLLATE=binary
+PARTITION BY HASH (shard) PARTITIONS 32;
+
+CREATE TABLE IF NOT EXISTS certs (
+  cert_id VARBINARY(32) NOT NULL,
+  shard TINYINT UNSIGNED AS
+    (ORD(LEFT(cert_id, 1)) >> 3 ) STORED,
+  parent_id VARBINARY(32) DEFAULT NULL,
+  expiration DATETIME NOT NULL,
+  payload LONGBLOB,
+
+  PRIMARY KEY(cert_id,shard)
+) ENGINE=InnoDB CHARSET=binary COLLATE=binary
+PARTITION BY HASH (shard) PARTITIONS 32;
+
+CREATE TABLE IF NOT EXISTS domain_certs (
+  domain_id VARBINARY(32) NOT NULL,
+  shard TINYINT UNSIGNED AS
+    (ORD(LEFT(domain_id, 1)) >> 3 ) STORED,
+  cert_id VARBINARY(32) NOT NULL,
+
+  PRIMARY KEY domain_cert (domain_id,shard,cert_id),
+  INDEX cert_id (cert_id)
+) ENGINE=InnoDB CHARSET=binary COLLATE=binary
+PARTITION BY HASH (shard) PARTITIONS 32;
+
+CREATE TABLE IF NOT EXISTS policies (
+  policy_id VARBINARY(32) NOT NULL,
+  shard TINYINT UNSIGNED AS
+    (ORD(LEFT(policy_id, 1)) >> 3 ) STORED,
+  parent_id VARBINARY(32) DEFAULT NULL,
+  expiration DATETIME NOT NULL,
+  payload LONGBLOB,
+
+  PRIMARY KEY(policy_id,shard)
+) ENGINE=InnoDB CHARSET=binary COLLATE=binary
+PARTITION BY HASH (shard) PARTITIONS 32;
+
+CREATE TABLE IF NOT EXISTS domain_policies (
+  domain_id VARBINARY(32) NOT NULL,
+  shard TINYINT UNSIGNED AS
+    (ORD(LEFT(domain_id, 1)) >> 3 ) STORED,
+  policy_id VARBINARY(32) NOT NULL,
+
+  PRIMARY KEY domain_pol (domain_id,shard,policy_id),
+  INDEX policy_id (policy_id)
+) ENGINE=InnoDB CHARSET=binary COLLATE=binary
+PARTITION BY HASH (shard) PARTITIONS 32;
+
+CREATE TABLE IF NOT EXISTS domain_payloads (
+  domain_id VARBINARY(32) NOT NULL,
+  shard TINYINT UNSIGNED AS
+    (ORD(LEFT(domain_id, 1)) >> 3 ) STORED,
+  cert_ids LONGBLOB,                            -- IDs of each certificate for this domain,
+                                                -- alphabetically sorted, one after another.
+  cert_ids_id VARBINARY(32) DEFAULT NULL,       -- ID of cert_ids (above).
+  policy_ids LONGBLOB,                          -- IDs of each policy object for this domain,
+                                                -- alphabetically sorted, glued together.
+  policy_ids_id VARBINARY(32) DEFAULT NULL,     -- ID of cert_ids (above).
+
+  PRIMARY KEY (domain_id,shard)
+) ENGINE=InnoDB CHARSET=binary COLLATE=binary
+PARTITION BY HASH (shard) PARTITIONS 32;
+
+CREATE TABLE IF NOT EXISTS dirty (
+  domain_id VARBINARY(32) NOT NULL,
+  shard TINYINT UNSIGNED AS
+    (ORD(LEFT(domain_id, 1)) >> 3 ) STORED,
+  coalesced BOOLEAN NOT NULL DEFAULT FALSE,
+
+  PRIMARY KEY(domain_id,shard),
+  INDEX dirty_coalesced (coalesced)
+) ENGINE=InnoDB CHARSET=binary COLLATE=binary
+PARTITION BY HASH (shard) PARTITIONS 32;
+
+CREATE TABLE IF NOT EXISTS root (
+    key32 VARBINARY(32) NOT NULL,
+
+    -- constraints to ensure that only a single root value exists at any time by having a single possible value for the primary key
+    single_row_pk char(25) NOT NULL PRIMARY KEY DEFAULT 'PK_RestrictToOneRootValue' CHECK (single_row_pk='PK_RestrictToOneRootValue')
+) ENGINE=InnoDB CHARSET=binary COLLATE=binary;
+
+-- Stores the last valid status that was ingested, per CT log server URL
+CREATE TABLE IF NOT EXISTS ctlog_server_last_status (
+  url_hash VARBINARY(32) NOT NULL,
+  size BIGINT,
+  sth BLOB,
+
+  PRIMARY KEY (url_hash)
+) ENGINE=InnoDB CHARSET=binary COLLATE=binary;
+
+CREATE TABLE IF NOT EXISTS tree (
+  key32 VARBINARY(32) NOT NULL,
+  value longblob NOT NULL,
+  id BIGINT NOT NULL AUTO_INCREMENT,
+
+  PRIMARY KEY (id),
+  UNIQUE KEY key_UNIQUE (key32)
+) ENGINE=InnoDB CHARSET=binary COLLATE=binary;
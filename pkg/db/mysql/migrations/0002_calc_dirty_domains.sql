@@ -0,0 +1,184 @@
+DROP PROCEDURE IF EXISTS calc_dirty_domains;
+DELIMITER $$
+-- The procedure has one argument: the partition number to operate on. Usually 0..31.
+-- Because MySQL doesn't support FULL OUTER JOIN, we have to emulate it.
+-- We want:
+-- SELECT * FROM t1
+-- FULL OUTER JOIN
+-- SELECT * FROM t2
+-- ------------------------------------
+-- We emulate is with:
+-- SELECT * FROM t1
+-- LEFT JOIN t2 ON t1.id = t2.id
+-- UNION
+-- SELECT * FROM t1
+-- RIGHT JOIN t2 ON t1.id = t2.id
+-- https://stackoverflow.com/questions/4796872/how-can-i-do-a-full-outer-join-in-mysql
+--
+-- The table t1 is a CTE that retrieves the certificates.
+-- The table t2 is a CTE that retrieves the policies.
+-- ------------------------------------
+-- This SP needs ~ 5 seconds per 20K dirty domains.
+CREATE PROCEDURE calc_dirty_domains(
+    IN partition_number INT,
+	IN chunk_size INT,
+	OUT processed_rows BIGINT
+)
+proc: BEGIN
+
+    SET group_concat_max_len = 1073741824; -- so that GROUP_CONCAT doesn't truncate results
+
+    SET processed_rows = 0;
+
+    SET @count_sql = CONCAT("
+		SELECT COUNT(*) INTO @chunk_rows
+		FROM (
+			SELECT domain_id
+			FROM dirty PARTITION(p", partition_number, ") FORCE INDEX (dirty_coalesced)
+			WHERE coalesced = FALSE
+			ORDER BY shard,coalesced,domain_id
+			LIMIT ", chunk_size, "
+		) AS chunk_domains
+	");
+	PREPARE stmt FROM @count_sql;
+	EXECUTE stmt;
+	DEALLOCATE PREPARE stmt;
+
+	SET processed_rows = COALESCE(@chunk_rows, 0);
+	IF processed_rows = 0 THEN
+		LEAVE proc;
+	END IF;
+
+    SET TRANSACTION ISOLATION LEVEL READ COMMITTED;
+
+    SET @replace_sql = CONCAT("
+    REPLACE INTO domain_payloads PARTITION(p", partition_number, ") (
+			domain_id,
+			cert_ids,
+			cert_ids_id,
+			policy_ids,
+			policy_ids_id
+		)
+		WITH RECURSIVE
+
+		chunk_domains AS (
+			SELECT domain_id
+			FROM dirty PARTITION(p", partition_number, ")
+			FORCE INDEX (dirty_coalesced)
+			WHERE coalesced = FALSE
+			ORDER BY coalesced,domain_id
+			LIMIT ", chunk_size, "
+		),
+		cert_closure AS (
+			SELECT d.domain_id, c.cert_id, c.parent_id
+			FROM chunk_domains AS d
+			INNER JOIN domain_certs AS dc ON dc.domain_id = d.domain_id
+			INNER JOIN certs AS c ON c.cert_id = dc.cert_id
+
+			UNION
+
+			SELECT cc.domain_id, c.cert_id, c.parent_id
+			FROM cert_closure AS cc
+			INNER JOIN certs AS c ON c.cert_id = cc.parent_id
+		),
+        cert_agg AS (
+			SELECT domain_id, GROUP_CONCAT(cert_id ORDER BY cert_id SEPARATOR '') AS cert_ids
+			FROM cert_closure
+			GROUP BY domain_id
+		),
+		policy_closure AS (
+			SELECT d.domain_id, p.policy_id, p.parent_id
+			FROM chunk_domains AS d
+			INNER JOIN domain_policies AS dp ON dp.domain_id = d.domain_id
+			INNER JOIN policies AS p ON p.policy_id = dp.policy_id
+
+			UNION
+
+			SELECT pc.domain_id, p.policy_id, p.parent_id
+			FROM policy_closure AS pc
+			INNER JOIN policies AS p ON p.policy_id = pc.parent_id
+		),
+		policy_agg AS (
+			SELECT domain_id, GROUP_CONCAT(policy_id ORDER BY policy_id SEPARATOR '') AS policy_ids
+			FROM policy_closure
+			GROUP BY domain_id
+		)
+        SELECT
+			d.domain_id,
+			ca.cert_ids,
+			CASE
+				WHEN ca.cert_ids IS NULL THEN NULL
+				ELSE UNHEX(SHA2(ca.cert_ids, 256))
+			END AS cert_ids_id,
+			pa.policy_ids,
+			CASE
+				WHEN pa.policy_ids IS NULL THEN NULL
+				ELSE UNHEX(SHA2(pa.policy_ids, 256))
+			END AS policy_ids_id
+		FROM chunk_domains AS d
+		LEFT JOIN cert_agg AS ca ON ca.domain_id = d.domain_id
+		LEFT JOIN policy_agg AS pa ON pa.domain_id = d.domain_id
+    ");
+	PREPARE stmt FROM @replace_sql;
+	EXECUTE stmt;
+	DEALLOCATE PREPARE stmt;
+
+    SET @delete_payloads_sql = CONCAT("
+        DELETE dp
+        FROM domain_payloads PARTITION(p", partition_number, ") AS dp
+        INNER JOIN (
+            SELECT shard, domain_id
+            FROM dirty PARTITION(p", partition_number, ")
+			FORCE INDEX (dirty_coalesced)
+			WHERE coalesced = FALSE
+			ORDER BY coalesced,domain_id
+            LIMIT ", chunk_size, "
+        ) AS d
+        ON dp.shard = d.shard AND dp.domain_id = d.domain_id
+        WHERE dp.cert_ids IS NULL
+        AND dp.policy_ids IS NULL
+    ");
+    PREPARE stmt FROM @delete_payloads_sql;
+    EXECUTE stmt;
+    DEALLOCATE PREPARE stmt;
+
+    SET @delete_domains_sql = CONCAT("
+        DELETE dom
+        FROM domains PARTITION(p", partition_number, ") AS dom
+        INNER JOIN (
+            SELECT shard,domain_id
+            FROM dirty PARTITION(p", partition_number, ")
+			FORCE INDEX (dirty_coalesced)
+			WHERE coalesced = FALSE
+			ORDER BY coalesced,domain_id
+            LIMIT ", chunk_size, "
+        ) AS d
+        ON dom.shard = d.shard AND dom.domain_id = d.domain_id
+        LEFT JOIN domain_payloads PARTITION(p", partition_number, ") AS dp
+            ON dp.shard = dom.shard AND dp.domain_id = dom.domain_id
+        WHERE dp.domain_id IS NULL;
+    ");
+    PREPARE stmt FROM @delete_domains_sql;
+    EXECUTE stmt;
+    DEALLOCATE PREPARE stmt;
+
+    SET @mark_coalesced_sql = CONCAT("
+		UPDATE dirty PARTITION(p", partition_number, ") AS d
+		INNER JOIN (
+			SELECT shard, domain_id
+            FROM dirty PARTITION(p", partition_number, ")
+			FORCE INDEX (dirty_coalesced)
+			WHERE coalesced = FALSE
+			ORDER BY coalesced,domain_id
+            LIMIT ", chunk_size, "
+		) AS t
+        ON d.shard = t.shard AND d.domain_id = t.domain_id
+		SET d.coalesced = TRUE
+	");
+	PREPARE stmt FROM @mark_coalesced_sql;
+	EXECUTE stmt;
+	DEALLOCATE PREPARE stmt;
+
+
+END$$
+DELIMITER ;
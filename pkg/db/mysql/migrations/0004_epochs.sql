@@ -0,0 +1,18 @@
+-- One row per update of the map. Replicas use it to follow this map server.
+CREATE TABLE IF NOT EXISTS epochs (
+  epoch BIGINT UNSIGNED NOT NULL,
+  root VARBINARY(32) NOT NULL,
+  tree_id BIGINT NOT NULL,                      -- Largest tree.id when the epoch was recorded.
+  created DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+
+  PRIMARY KEY (epoch)
+) ENGINE=InnoDB CHARSET=binary COLLATE=binary;
+
+-- The domains modified by each epoch.
+CREATE TABLE IF NOT EXISTS epoch_domains (
+  epoch BIGINT UNSIGNED NOT NULL,
+  domain_id VARBINARY(32) NOT NULL,
+
+  PRIMARY KEY (epoch,domain_id),
+  INDEX domain_id (domain_id)
+) ENGINE=InnoDB CHARSET=binary COLLATE=binary;
@@ -0,0 +1,28 @@
+-- The jobs of the distributed ingestion of cmd/ingest. Each one is finalized, i.e. the payloads
+-- of the dirty domains coalesced and the SMT updated, once all its batches are done, by the
+-- worker holding the lease of its finalization.
+CREATE TABLE IF NOT EXISTS ingest_jobs (
+  job VARBINARY(255) NOT NULL,
+  strategy VARBINARY(64) NOT NULL,
+  finalizer VARBINARY(255) NOT NULL DEFAULT '',
+  lease_expiry DATETIME(6) DEFAULT NULL,
+  finalized BOOLEAN NOT NULL DEFAULT FALSE,
+
+  PRIMARY KEY (job)
+) ENGINE=InnoDB CHARSET=binary COLLATE=binary;
+
+-- The work queue of each job: batches of bundle files, leased to one worker at a time. A batch
+-- whose lease expired can be claimed by any other worker.
+CREATE TABLE IF NOT EXISTS ingest_batches (
+  job VARBINARY(255) NOT NULL,
+  id BIGINT UNSIGNED NOT NULL,
+  log_key VARBINARY(255) NOT NULL,              -- The CT log of the bundles, as in the journal.
+  first_index BIGINT UNSIGNED NOT NULL,
+  last_index BIGINT UNSIGNED NOT NULL,
+  files MEDIUMBLOB NOT NULL,                    -- JSON array with the paths of the bundles.
+  worker VARBINARY(255) NOT NULL DEFAULT '',
+  lease_expiry DATETIME(6) DEFAULT NULL,
+  done BOOLEAN NOT NULL DEFAULT FALSE,
+
+  PRIMARY KEY (job,id)
+) ENGINE=InnoDB CHARSET=binary COLLATE=binary;
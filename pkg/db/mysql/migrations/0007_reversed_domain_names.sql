@@ -0,0 +1,7 @@
+-- The domain names reversed, so that the searches by suffix, e.g. of the subdomains of a domain,
+-- are range scans of their index. Being a stored generated column, adding it computes its
+-- values for the existing domains.
+ALTER TABLE domains
+  ADD COLUMN reversed_name VARCHAR(300) COLLATE ascii_bin AS
+    (REVERSE(domain_name)) STORED,
+  ADD INDEX reversed_name (reversed_name);
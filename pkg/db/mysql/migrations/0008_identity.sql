@@ -0,0 +1,11 @@
+-- The identity of the DB: one random value, created with the DB and replaced when its tables
+-- are truncated, which tells apart the DBs described by files such as the certificate filter
+-- of cmd/ingest.
+CREATE TABLE IF NOT EXISTS identity (
+  id VARBINARY(16) NOT NULL,
+
+  PRIMARY KEY (id)
+) ENGINE=InnoDB CHARSET=binary COLLATE=binary;
+
+INSERT INTO identity (id) SELECT RANDOM_BYTES(16) FROM DUAL
+  WHERE NOT EXISTS (SELECT * FROM identity);
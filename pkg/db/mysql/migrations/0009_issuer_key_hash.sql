@@ -0,0 +1,7 @@
+-- The issuer key hash of the precertificate entries, as in RFC 6962 section 3.2, computed when
+-- they are ingested with their chain. It is NULL for the other certificates.
+-- The entries of the leaves inserted before 0005, and the issuer key hash of the
+-- precertificates inserted before this migration, are set by the -deriveCertEntries command of
+-- the map server.
+ALTER TABLE certs
+  ADD COLUMN issuer_key_hash VARBINARY(32) DEFAULT NULL;
@@ -7,6 +7,7 @@ import (
 	"encoding/base64"
 	"encoding/csv"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 	"sync"
@@ -71,6 +72,8 @@ func NewMysqlDB(db *sql.DB) (*mysqlDB, error) {
 	}, nil
 }
 
+// DB returns the SQL DB behind the connection. It is not part of db.Conn: only code specific
+// to MySQL, such as its tests and the benchmarks of the stored procedures, should need it.
 func (c *mysqlDB) DB() *sql.DB {
 	return c.db
 }
@@ -79,6 +82,47 @@ func (c *mysqlDB) Close() error {
 	return c.db.Close()
 }
 
+// CheckSchema checks that the DB has been migrated to the latest schema version.
+func (c *mysqlDB) CheckSchema(ctx context.Context) error {
+	return checkSchema(ctx, c.db)
+}
+
+// CountRows counts the rows of the main tables in one query.
+func (c *mysqlDB) CountRows(ctx context.Context) (*db.TableCounts, error) {
+	str := "SELECT " +
+		"(SELECT COUNT(*) FROM certs)," +
+		"(SELECT COUNT(*) FROM policies)," +
+		"(SELECT COUNT(*) FROM domains)," +
+		"(SELECT COUNT(*) FROM domain_certs)," +
+		"(SELECT COUNT(*) FROM domain_policies)," +
+		"(SELECT COUNT(*) FROM dirty)," +
+		"(SELECT COUNT(*) FROM tree)," +
+		"(SELECT COUNT(*) FROM epochs)"
+	counts := &db.TableCounts{}
+	err := c.db.QueryRowContext(ctx, str).Scan(
+		&counts.Certs,
+		&counts.Policies,
+		&counts.Domains,
+		&counts.DomainCerts,
+		&counts.DomainPolicies,
+		&counts.Dirty,
+		&counts.TreeNodes,
+		&counts.Epochs,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("counting rows: %w", err)
+	}
+	return counts, nil
+}
+
+// DisableRedoLog disables the InnoDB redo log for the whole MySQL instance.
+func (c *mysqlDB) DisableRedoLog(ctx context.Context) error {
+	if _, err := c.db.ExecContext(ctx, "ALTER INSTANCE DISABLE INNODB REDO_LOG"); err != nil {
+		return fmt.Errorf("disabling the redo log: %w", err)
+	}
+	return nil
+}
+
 func (c *mysqlDB) TruncateAllTables(ctx context.Context) error {
 	tables := []string{
 		"tree",
@@ -88,13 +132,29 @@ func (c *mysqlDB) TruncateAllTables(ctx context.Context) error {
 		"domain_certs",
 		"domain_payloads",
 		"dirty",
+		"epochs",
+		"epoch_domains",
+		"identity",
 	}
 	for _, t := range tables {
 		if _, err := c.db.ExecContext(ctx, fmt.Sprintf("TRUNCATE %s", t)); err != nil {
 			return err
 		}
 	}
-	return nil
+	_, err := c.db.ExecContext(ctx, "INSERT INTO identity (id) VALUES (RANDOM_BYTES(16))")
+	return err
+}
+
+// Identity returns the identity of the DB, created by its migrations.
+func (c *mysqlDB) Identity(ctx context.Context) (db.Identity, error) {
+	var id []byte
+	if err := c.db.QueryRowContext(ctx, "SELECT id FROM identity").Scan(&id); err != nil {
+		return db.Identity{}, fmt.Errorf("retrieving the identity of the DB: %w", err)
+	}
+	if len(id) != len(db.Identity{}) {
+		return db.Identity{}, fmt.Errorf("invalid identity of the DB %x", id)
+	}
+	return (db.Identity)(id), nil
 }
 
 // UpdateDomains updates the domains table.
@@ -112,6 +172,10 @@ func (c *mysqlDB) InsertCsvIntoDomains(ctx context.Context, filename string) err
 	return err
 }
 
+func (c *mysqlDB) StreamCsvIntoDomains(ctx context.Context, r io.Reader) error {
+	return streamCsv(ctx, c.db, r, loadDomainsCsv)
+}
+
 func (c *mysqlDB) updateDomainsCSV(
 	ctx context.Context,
 	ids []common.SHA256Output,
@@ -546,10 +610,7 @@ func loadDomainsTableWithCSV(
 		return nil, fmt.Errorf("setting permissions to file \"%s\": %w", filepath, err)
 	}
 
-	str := `LOAD DATA CONCURRENT INFILE ? IGNORE INTO TABLE domains ` +
-		`FIELDS TERMINATED BY ',' ENCLOSED BY '"' LINES TERMINATED BY '\n' ` +
-		`(@domain_id,domain_name) SET ` +
-		`domain_id = FROM_BASE64(@domain_id);`
+	str := `LOAD DATA CONCURRENT INFILE ? ` + loadDomainsCsv
 	return db.ExecContext(ctx, str, filepath)
 }
 
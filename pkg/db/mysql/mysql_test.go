@@ -91,6 +91,7 @@ func TestUpdateCerts(t *testing.T) {
 		parentIds,
 		util.ExtractExpirations(certs),
 		util.ExtractPayloads(certs),
+		nil,
 	)
 	require.NoError(t, err)
 
@@ -131,6 +132,7 @@ func TestUpdateCertsNonUnique(t *testing.T) {
 		parentIds,
 		expirations,
 		payloads,
+		nil,
 	)
 	require.NoError(t, err)
 
@@ -984,6 +986,89 @@ func TestUpdateDomains(t *testing.T) {
 	require.ElementsMatch(t, expected, got)
 }
 
+func TestSearchDomains(t *testing.T) {
+	ctx, cancelF := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelF()
+
+	// Configure a test DB.
+	config, removeF := testdb.ConfigureTestDB(t)
+	defer removeF()
+
+	// Connect to the DB.
+	conn := testdb.Connect(t, config)
+	defer conn.Close()
+
+	names := []string{
+		"example.com",
+		"www.example.com",
+		"mail.example.com",
+		"mail2.example.com",
+		"a.b.example.com",
+		"_dmarc.example.com",
+		"notexample.com",
+		"example.org",
+		"www.example.org",
+	}
+	ids := make([]common.SHA256Output, len(names))
+	for i, name := range names {
+		ids[i] = common.SHA256Hash32Bytes([]byte(name))
+	}
+	err := conn.UpdateDomains(ctx, ids, names)
+	require.NoError(t, err)
+
+	searchNames := func(search db.DomainSearch) []string {
+		t.Helper()
+		domains, err := conn.SearchDomains(ctx, search)
+		require.NoError(t, err)
+		names := make([]string, len(domains))
+		for i, d := range domains {
+			require.Equal(t, common.SHA256Hash32Bytes([]byte(d.DomainName)), d.DomainID)
+			names[i] = d.DomainName
+		}
+		return names
+	}
+	count := func(search db.DomainSearch) uint64 {
+		t.Helper()
+		n, err := conn.CountDomains(ctx, search)
+		require.NoError(t, err)
+		return n
+	}
+
+	// Subdomains of example.com, sorted by reversed name ("moc.elpmaxe.2liam" first).
+	search := db.DomainSearch{Suffix: "example.com"}
+	require.Equal(t, []string{
+		"mail2.example.com",
+		"a.b.example.com",
+		"_dmarc.example.com",
+		"mail.example.com",
+		"www.example.com",
+	}, searchNames(search))
+	require.Equal(t, uint64(5), count(search))
+
+	// Pagination.
+	search.Limit = 2
+	require.Equal(t, []string{"mail2.example.com", "a.b.example.com"}, searchNames(search))
+	search.After = "a.b.example.com"
+	require.Equal(t, []string{"_dmarc.example.com", "mail.example.com"}, searchNames(search))
+	search.After = "mail.example.com"
+	require.Equal(t, []string{"www.example.com"}, searchNames(search))
+	require.Equal(t, uint64(5), count(search))
+
+	// Patterns.
+	require.ElementsMatch(t, []string{"mail.example.com", "mail2.example.com"},
+		searchNames(db.DomainSearch{Pattern: "mail*.example.com"}))
+	require.ElementsMatch(t, []string{"www.example.com", "www.example.org"},
+		searchNames(db.DomainSearch{Pattern: "www.example.???"}))
+	require.ElementsMatch(t, []string{"_dmarc.example.com"},
+		searchNames(db.DomainSearch{Pattern: "_dmarc.*"}))
+	require.ElementsMatch(t, []string{"example.com"},
+		searchNames(db.DomainSearch{Pattern: "example.com"}))
+	require.Equal(t, uint64(2), count(db.DomainSearch{Suffix: "example.com", Pattern: "mail*"}))
+
+	// Everything.
+	require.Equal(t, uint64(len(names)), count(db.DomainSearch{}))
+}
+
 func BenchmarkRetrieveDomainEntries(b *testing.B) {
 	ctx, cancelF := context.WithTimeout(context.Background(), 10*time.Minute)
 	defer cancelF()
@@ -1124,7 +1209,7 @@ func getAllCertIds(ctx context.Context, t tests.T, conn testdb.Conn) []common.SH
 	return IDs
 }
 
-func getAllCertsTable(ctx context.Context, t tests.T, conn db.Conn) (
+func getAllCertsTable(ctx context.Context, t tests.T, conn testdb.Conn) (
 	ids []common.SHA256Output,
 	parentIds []*common.SHA256Output,
 	expirations []time.Time,
@@ -1252,7 +1337,7 @@ func dirtyDomainIDForPartition(partition, suffix byte) common.SHA256Output {
 func requireDirtyCoalescedCounts(
 	ctx context.Context,
 	t *testing.T,
-	conn db.Conn,
+	conn testdb.Conn,
 	partition int,
 	wantCoalesced int,
 	wantPending int,
@@ -1283,7 +1368,7 @@ func requireDirtyCoalescedCounts(
 func insertIntoDomainPayloads(
 	ctx context.Context,
 	t tests.T,
-	conn db.Conn,
+	conn testdb.Conn,
 	domainIDs []common.SHA256Output,
 	certIDs []common.SHA256Output,
 	polIDs []common.SHA256Output,
@@ -23,7 +23,6 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/netsec-ethz/fpki/pkg/common"
-	"github.com/netsec-ethz/fpki/pkg/db"
 	"github.com/netsec-ethz/fpki/pkg/db/mysql"
 	"github.com/netsec-ethz/fpki/pkg/tests"
 	"github.com/netsec-ethz/fpki/pkg/tests/random"
@@ -1207,7 +1206,7 @@ func BenchmarkCreateTable(b *testing.B) {
 	})
 }
 
-func exec(ctx context.Context, t tests.T, conn db.Conn, query string, args ...any) {
+func exec(ctx context.Context, t tests.T, conn testdb.Conn, query string, args ...any) {
 	_, err := conn.DB().ExecContext(ctx, query, args...)
 	require.NoError(t, err)
 }
@@ -1254,7 +1253,7 @@ func callFuncPerIDBatch(
 func insertCerts(
 	ctx context.Context,
 	t tests.T,
-	conn db.Conn,
+	conn testdb.Conn,
 	tableName string,
 	certIDs []common.SHA256Output,
 	mockExp time.Time,
@@ -1281,7 +1280,7 @@ func insertCerts(
 func retrieveCertificatePayloads(
 	ctx context.Context,
 	t tests.T,
-	conn db.Conn,
+	conn testdb.Conn,
 	IDs []common.SHA256Output,
 ) {
 	if len(IDs) == 0 {
@@ -1314,7 +1313,7 @@ func retrieveCertificatePayloads(
 
 func insertIntoDirty(
 	ctx context.Context,
-	conn db.Conn,
+	conn testdb.Conn,
 	tableName string,
 	domainIDs []common.SHA256Output) error {
 
@@ -1340,7 +1339,7 @@ func insertIntoDirty(
 	return err
 }
 
-func loadDataWithCSV(ctx context.Context, t tests.T, conn db.Conn, filepath string) {
+func loadDataWithCSV(ctx context.Context, t tests.T, conn testdb.Conn, filepath string) {
 	ctx, span := tr.T("db").Start(ctx, "from-csv")
 	defer span.End()
 
@@ -1598,7 +1597,7 @@ func createMockDataInCsvFiles(
 func runWithCsvFile(
 	ctx context.Context,
 	t tests.T,
-	conn db.Conn,
+	conn testdb.Conn,
 	N int, // number of chunks/partitions
 	createTableFunc func(tests.T, int), // function to create the table
 	fName func(int) string, // function returning chunked csv filename
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/db"
 )
 
 // CheckPoliciesExist returns a slice of true/false values. Each value indicates if
@@ -171,3 +172,20 @@ func (c *mysqlDB) RetrievePolicyPayloads(ctx context.Context, IDs []common.SHA25
 
 	return payloads, nil
 }
+
+// RetrievePolicyRecords returns the policies table row for each policy identified by
+// the IDs parameter, in the same order. Missing policies yield a nil record.
+func (c *mysqlDB) RetrievePolicyRecords(
+	ctx context.Context,
+	IDs []common.SHA256Output,
+) ([]*db.PayloadRecord, error) {
+	return c.retrievePayloadRecords(ctx, "policies", "policy_id", IDs)
+}
+
+// RetrievePolicyDomains returns the domains that reference the policy in domain_policies.
+func (c *mysqlDB) RetrievePolicyDomains(
+	ctx context.Context,
+	policyID common.SHA256Output,
+) ([]db.DomainRecord, error) {
+	return c.retrieveReferringDomains(ctx, "domain_policies", "policy_id", policyID)
+}
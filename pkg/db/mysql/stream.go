@@ -0,0 +1,57 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"sync/atomic"
+
+	gomysql "github.com/go-sql-driver/mysql"
+)
+
+// The LOAD DATA statements for the CSV files of the ingestion, after the INFILE clause.
+// They are the same whether the server reads the file or the client streams it.
+const (
+	loadCertsCsv = `IGNORE INTO TABLE certs ` +
+		`FIELDS TERMINATED BY ',' ENCLOSED BY '"' LINES TERMINATED BY '\n' ` +
+		`(@cert_id,@parent_id,expiration,@payload,@entry_type,@tbs_id,@issuer_key_hash) SET ` +
+		`cert_id = FROM_BASE64(@cert_id),` +
+		`parent_id = FROM_BASE64(@parent_id),` +
+		`payload = FROM_BASE64(@payload),` +
+		`entry_type = NULLIF(@entry_type,''),` +
+		`tbs_id = NULLIF(FROM_BASE64(@tbs_id),''),` +
+		`issuer_key_hash = NULLIF(FROM_BASE64(@issuer_key_hash),'');`
+	loadDomainCertsCsv = `IGNORE INTO TABLE domain_certs ` +
+		`FIELDS TERMINATED BY ',' ENCLOSED BY '"' LINES TERMINATED BY '\n' ` +
+		`(@domain_id,@cert_id) SET ` +
+		`domain_id = FROM_BASE64(@domain_id),` +
+		`cert_id = FROM_BASE64(@cert_id);`
+	loadDirtyCsv = `REPLACE INTO TABLE dirty ` +
+		`FIELDS TERMINATED BY ',' ENCLOSED BY '"' LINES TERMINATED BY '\n' ` +
+		`(@domain_id) SET ` +
+		`domain_id = FROM_BASE64(@domain_id), ` +
+		`coalesced = FALSE;`
+	loadDomainsCsv = `IGNORE INTO TABLE domains ` +
+		`FIELDS TERMINATED BY ',' ENCLOSED BY '"' LINES TERMINATED BY '\n' ` +
+		`(@domain_id,domain_name) SET ` +
+		`domain_id = FROM_BASE64(@domain_id);`
+)
+
+// readerHandlerCount makes the names of the registered reader handlers unique.
+var readerHandlerCount atomic.Uint64
+
+// streamCsv runs the LOAD DATA statement with the CSV rows read from r, which the driver sends
+// through the connection as the contents of a LOCAL file. Thus the DB server needs neither a
+// filesystem shared with this process nor secure_file_priv, but it needs local_infile=ON.
+func streamCsv(ctx context.Context, db *sql.DB, r io.Reader, load string) error {
+	name := fmt.Sprintf("fpki-csv-%d", readerHandlerCount.Add(1))
+	gomysql.RegisterReaderHandler(name, func() io.Reader { return r })
+	defer gomysql.DeregisterReaderHandler(name)
+
+	str := `LOAD DATA CONCURRENT LOCAL INFILE ? ` + load
+	if _, err := db.ExecContext(ctx, str, "Reader::"+name); err != nil {
+		return fmt.Errorf("streaming CSV rows: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/db"
+)
+
+// RetrieveDomainsPage returns at most limit rows of the domains table, sorted by domain ID.
+func (c *mysqlDB) RetrieveDomainsPage(
+	ctx context.Context,
+	after *common.SHA256Output,
+	limit int,
+) ([]db.DomainRecord, error) {
+
+	str, args := pageQuery("SELECT domain_id,domain_name FROM domains", "domain_id", after, limit)
+	rows, err := c.db.QueryContext(ctx, str, args...)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving page of domains: %w", err)
+	}
+	domains, err := collectRows(rows, scanDomainRecord)
+	if err != nil {
+		return nil, fmt.Errorf("scanning page of domains: %w", err)
+	}
+	return domains, nil
+}
+
+// RetrieveCertificatesPage returns at most limit rows of the certs table, sorted by cert ID.
+func (c *mysqlDB) RetrieveCertificatesPage(
+	ctx context.Context,
+	after *common.SHA256Output,
+	limit int,
+) ([]*db.PayloadRecord, error) {
+
+	return c.retrievePayloadRecordsPage(ctx, "certs", "cert_id", after, limit)
+}
+
+// RetrievePoliciesPage returns at most limit rows of the policies table, sorted by policy ID.
+func (c *mysqlDB) RetrievePoliciesPage(
+	ctx context.Context,
+	after *common.SHA256Output,
+	limit int,
+) ([]*db.PayloadRecord, error) {
+
+	return c.retrievePayloadRecordsPage(ctx, "policies", "policy_id", after, limit)
+}
+
+// RetrieveCertificateParentsPage returns at most limit IDs and parent IDs of the certs table,
+// sorted by cert ID.
+func (c *mysqlDB) RetrieveCertificateParentsPage(
+	ctx context.Context,
+	after *common.SHA256Output,
+	limit int,
+) ([]db.ParentRecord, error) {
+
+	str, args := pageQuery("SELECT cert_id,parent_id FROM certs", "cert_id", after, limit)
+	return c.retrieveParents(ctx, "certs", str, args)
+}
+
+// RetrievePolicyParentsPage returns at most limit IDs and parent IDs of the policies table,
+// sorted by policy ID.
+func (c *mysqlDB) RetrievePolicyParentsPage(
+	ctx context.Context,
+	after *common.SHA256Output,
+	limit int,
+) ([]db.ParentRecord, error) {
+
+	str, args := pageQuery("SELECT policy_id,parent_id FROM policies", "policy_id", after, limit)
+	return c.retrieveParents(ctx, "policies", str, args)
+}
+
+// RetrieveDomainCertsPage returns at most limit rows of the domain_certs table, sorted by
+// domain ID and cert ID.
+func (c *mysqlDB) RetrieveDomainCertsPage(
+	ctx context.Context,
+	after *db.DomainAssociation,
+	limit int,
+) ([]db.DomainAssociation, error) {
+
+	return c.retrieveDomainAssociationsPage(ctx, "domain_certs", "cert_id", after, limit)
+}
+
+// RetrieveDomainPoliciesPage returns at most limit rows of the domain_policies table, sorted
+// by domain ID and policy ID.
+func (c *mysqlDB) RetrieveDomainPoliciesPage(
+	ctx context.Context,
+	after *db.DomainAssociation,
+	limit int,
+) ([]db.DomainAssociation, error) {
+
+	return c.retrieveDomainAssociationsPage(ctx, "domain_policies", "policy_id", after, limit)
+}
+
+func (c *mysqlDB) retrievePayloadRecordsPage(
+	ctx context.Context,
+	table string,
+	idColumn string,
+	after *common.SHA256Output,
+	limit int,
+) ([]*db.PayloadRecord, error) {
+
+	str, args := pageQuery(
+		fmt.Sprintf("SELECT %s FROM %s", payloadColumns(table, idColumn), table),
+		idColumn, after, limit)
+	rows, err := c.db.QueryContext(ctx, str, args...)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving page of %s: %w", table, err)
+	}
+	records, err := collectRows(rows, payloadScanner(table))
+	if err != nil {
+		return nil, fmt.Errorf("scanning page of %s: %w", table, err)
+	}
+	return records, nil
+}
+
+func (c *mysqlDB) retrieveDomainAssociationsPage(
+	ctx context.Context,
+	table string,
+	idColumn string,
+	after *db.DomainAssociation,
+	limit int,
+) ([]db.DomainAssociation, error) {
+
+	str := fmt.Sprintf("SELECT domain_id,%s FROM %s", idColumn, table)
+	var args []any
+	if after != nil {
+		str += fmt.Sprintf(" WHERE (domain_id,%s) > (?,?)", idColumn)
+		args = append(args, after.DomainID[:], after.ID[:])
+	}
+	str += fmt.Sprintf(" ORDER BY domain_id,%s LIMIT ?", idColumn)
+	args = append(args, limit)
+
+	rows, err := c.db.QueryContext(ctx, str, args...)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving page of %s: %w", table, err)
+	}
+	assocs, err := collectRows(rows, scanDomainAssociation)
+	if err != nil {
+		return nil, fmt.Errorf("scanning page of %s: %w", table, err)
+	}
+	return assocs, nil
+}
+
+func scanDomainAssociation(rows *sql.Rows) (db.DomainAssociation, error) {
+	var domainID, id []byte
+	if err := rows.Scan(&domainID, &id); err != nil {
+		return db.DomainAssociation{}, err
+	}
+	return db.DomainAssociation{
+		DomainID: *(*common.SHA256Output)(domainID),
+		ID:       *(*common.SHA256Output)(id),
+	}, nil
+}
+
+// pageQuery appends to the select statement the conditions to return at most limit rows
+// sorted by idColumn and after the passed ID, if not nil.
+func pageQuery(selectStmt, idColumn string, after *common.SHA256Output, limit int,
+) (string, []any) {
+
+	str := selectStmt
+	var args []any
+	if after != nil {
+		str += fmt.Sprintf(" WHERE %s > ?", idColumn)
+		args = append(args, after[:])
+	}
+	str += fmt.Sprintf(" ORDER BY %s LIMIT ?", idColumn)
+	args = append(args, limit)
+	return str, args
+}
@@ -0,0 +1,260 @@
+// Package archive exports the contents of a map server DB into a directory of chunk files,
+// and imports them back into an empty DB.
+//
+// The archive directory contains a manifest.json file and a list of chunk files. Each chunk
+// is a gzip compressed JSON-lines file with rows of one kind (domains, certs, policies,
+// domain_certs or domain_policies). The manifest lists all chunks in import order, with their
+// row count and SHA256 checksum, and the signed root of the exported map.
+// The manifest is written last, thus an archive without manifest is incomplete.
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	ct "github.com/google/certificate-transparency-go"
+)
+
+const (
+	// FormatVersion is the version of the archive format written by Export.
+	FormatVersion = 1
+
+	// ManifestFile is the name of the manifest inside the archive directory.
+	ManifestFile = "manifest.json"
+
+	// DefaultChunkSize is the default maximum number of rows per chunk.
+	DefaultChunkSize = 100_000
+)
+
+// Kind identifies the table the rows of a chunk belong to.
+type Kind string
+
+const (
+	Domains        Kind = "domains"
+	Certs          Kind = "certs"
+	Policies       Kind = "policies"
+	DomainCerts    Kind = "domain_certs"
+	DomainPolicies Kind = "domain_policies"
+)
+
+// kinds is the order in which the chunks are exported and imported.
+var kinds = []Kind{Domains, Certs, Policies, DomainCerts, DomainPolicies}
+
+// Manifest describes an archive.
+type Manifest struct {
+	Version   int
+	CreatedAt time.Time
+	// Root is the root of the SMT of the exported map.
+	Root []byte
+	// SignedTreeHead is the signature of Root by the map server key.
+	SignedTreeHead []byte
+	Chunks         []Chunk
+}
+
+// Chunk describes one chunk file of the archive.
+type Chunk struct {
+	Kind   Kind
+	File   string
+	Rows   int
+	SHA256 string // hex encoded SHA256 of the file
+}
+
+// domainRow is a row of a Domains chunk.
+type domainRow struct {
+	ID   []byte
+	Name string
+}
+
+// payloadRow is a row of a Certs or Policies chunk. Entry is only set for the leaf
+// certificates whose CT log entry is known.
+type payloadRow struct {
+	ID         []byte
+	ParentID   []byte `json:",omitempty"`
+	Expiration time.Time
+	Payload    []byte
+	Entry      *entryRow `json:",omitempty"`
+}
+
+// entryRow is the db.CertificateEntry of a leaf certificate.
+type entryRow struct {
+	Type          ct.LogEntryType
+	TBSID         []byte
+	IssuerKeyHash []byte `json:",omitempty"`
+}
+
+// associationRow is a row of a DomainCerts or DomainPolicies chunk.
+type associationRow struct {
+	DomainID []byte
+	ID       []byte
+}
+
+// ReadManifest reads the manifest of the archive in dir.
+func ReadManifest(dir string) (*Manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ManifestFile))
+	if err != nil {
+		return nil, fmt.Errorf("reading manifest: %w", err)
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("parsing manifest: %w", err)
+	}
+	if m.Version != FormatVersion {
+		return nil, fmt.Errorf("unsupported archive version %d", m.Version)
+	}
+	return m, nil
+}
+
+func writeManifest(dir string, m *Manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding manifest: %w", err)
+	}
+	// Write to a temporary file and rename, so that the manifest is never partially written.
+	tmp := filepath.Join(dir, ManifestFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("writing manifest: %w", err)
+	}
+	return os.Rename(tmp, filepath.Join(dir, ManifestFile))
+}
+
+// Verify checks that all chunks listed in the manifest exist and match their checksum.
+func Verify(dir string, m *Manifest) error {
+	for _, c := range m.Chunks {
+		if _, err := readChunkFile(dir, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunkWriter writes rows of one kind into chunk files of at most chunkSize rows.
+type chunkWriter struct {
+	dir       string
+	kind      Kind
+	chunkSize int
+	chunks    []Chunk
+
+	file    *os.File
+	hash    hash.Hash
+	gz      *gzip.Writer
+	enc     *json.Encoder
+	rows    int
+	current string
+}
+
+func newChunkWriter(dir string, kind Kind, chunkSize int) *chunkWriter {
+	return &chunkWriter{
+		dir:       dir,
+		kind:      kind,
+		chunkSize: chunkSize,
+	}
+}
+
+// Write appends one row to the current chunk, starting a new one if necessary.
+func (w *chunkWriter) Write(row any) error {
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			return err
+		}
+	}
+	if err := w.enc.Encode(row); err != nil {
+		return fmt.Errorf("writing row to %s: %w", w.current, err)
+	}
+	w.rows++
+	if w.rows == w.chunkSize {
+		return w.closeChunk()
+	}
+	return nil
+}
+
+// Close finishes the last chunk and returns all chunks written.
+func (w *chunkWriter) Close() ([]Chunk, error) {
+	if w.file != nil {
+		if err := w.closeChunk(); err != nil {
+			return nil, err
+		}
+	}
+	return w.chunks, nil
+}
+
+func (w *chunkWriter) open() error {
+	w.current = fmt.Sprintf("%s-%06d.jsonl.gz", w.kind, len(w.chunks))
+	f, err := os.Create(filepath.Join(w.dir, w.current))
+	if err != nil {
+		return fmt.Errorf("creating chunk: %w", err)
+	}
+	w.file = f
+	w.hash = sha256.New()
+	w.gz = gzip.NewWriter(io.MultiWriter(f, w.hash))
+	w.enc = json.NewEncoder(w.gz)
+	w.rows = 0
+	return nil
+}
+
+func (w *chunkWriter) closeChunk() error {
+	if err := w.gz.Close(); err != nil {
+		return fmt.Errorf("compressing %s: %w", w.current, err)
+	}
+	if err := w.file.Close(); err != nil {
+		return fmt.Errorf("closing %s: %w", w.current, err)
+	}
+	w.chunks = append(w.chunks, Chunk{
+		Kind:   w.kind,
+		File:   w.current,
+		Rows:   w.rows,
+		SHA256: hex.EncodeToString(w.hash.Sum(nil)),
+	})
+	w.file = nil
+	return nil
+}
+
+// readChunkFile reads the chunk into memory and verifies its checksum.
+func readChunkFile(dir string, c Chunk) ([]byte, error) {
+	if filepath.Base(c.File) != c.File {
+		return nil, fmt.Errorf("invalid chunk file name %q", c.File)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, c.File))
+	if err != nil {
+		return nil, fmt.Errorf("reading chunk: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != c.SHA256 {
+		return nil, fmt.Errorf("chunk %s is corrupted: checksum mismatch", c.File)
+	}
+	return data, nil
+}
+
+// readChunk verifies the chunk and decodes all its rows with the decode function.
+func readChunk(dir string, c Chunk, decode func(*json.Decoder) error) error {
+	data, err := readChunkFile(dir, c)
+	if err != nil {
+		return err
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("decompressing %s: %w", c.File, err)
+	}
+	defer gz.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(gz))
+	rows := 0
+	for ; dec.More(); rows++ {
+		if err := decode(dec); err != nil {
+			return fmt.Errorf("decoding row %d of %s: %w", rows, c.File, err)
+		}
+	}
+	if rows != c.Rows {
+		return fmt.Errorf("chunk %s has %d rows, expected %d", c.File, rows, c.Rows)
+	}
+	return nil
+}
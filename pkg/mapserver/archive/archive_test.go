@@ -0,0 +1,132 @@
+package archive
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/netsec-ethz/fpki/pkg/tests/random"
+	"github.com/netsec-ethz/fpki/pkg/tests/testdb"
+	tup "github.com/netsec-ethz/fpki/pkg/tests/updater"
+)
+
+func TestChunks(t *testing.T) {
+	dir := t.TempDir()
+
+	// Write 7 rows in chunks of 3.
+	w := newChunkWriter(dir, Domains, 3)
+	for i := 0; i < 7; i++ {
+		err := w.Write(domainRow{ID: []byte{byte(i)}, Name: "a.com"})
+		require.NoError(t, err)
+	}
+	chunks, err := w.Close()
+	require.NoError(t, err)
+	require.Len(t, chunks, 3)
+	require.Equal(t, []int{3, 3, 1}, []int{chunks[0].Rows, chunks[1].Rows, chunks[2].Rows})
+	require.Equal(t, "domains-000002.jsonl.gz", chunks[2].File)
+
+	m := &Manifest{Version: FormatVersion, Chunks: chunks}
+	require.NoError(t, writeManifest(dir, m))
+	got, err := ReadManifest(dir)
+	require.NoError(t, err)
+	require.Equal(t, m.Chunks, got.Chunks)
+	require.NoError(t, Verify(dir, got))
+
+	// Read the rows back.
+	var ids []byte
+	for _, c := range chunks {
+		err := readChunk(dir, c, func(dec *json.Decoder) error {
+			var row domainRow
+			err := dec.Decode(&row)
+			ids = append(ids, row.ID...)
+			return err
+		})
+		require.NoError(t, err)
+	}
+	require.Equal(t, []byte{0, 1, 2, 3, 4, 5, 6}, ids)
+
+	// Corrupt one chunk.
+	filename := filepath.Join(dir, chunks[1].File)
+	data, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	data[len(data)/2] ^= 0xFF
+	require.NoError(t, os.WriteFile(filename, data, 0644))
+	require.ErrorContains(t, Verify(dir, got), "checksum mismatch")
+
+	// Wrong row count.
+	chunks[0].Rows = 2
+	err = readChunk(dir, chunks[0], func(dec *json.Decoder) error {
+		var row domainRow
+		return dec.Decode(&row)
+	})
+	require.ErrorContains(t, err, "expected 2")
+}
+
+func TestExportImport(t *testing.T) {
+	random.Seed(1)
+
+	ctx, cancelF := context.WithTimeout(context.Background(), time.Minute)
+	defer cancelF()
+
+	// Configure a test DB.
+	config, removeF := testdb.ConfigureTestDB(t)
+	defer removeF()
+
+	// Connect to the DB.
+	conn := testdb.Connect(t, config)
+	defer conn.Close()
+
+	tup.UpdateDBwithRandomCerts(ctx, t, conn,
+		[]string{"a.com", "b.com", "c.com"},
+		[]tup.CertsPoliciesOrBoth{tup.CertsOnly, tup.PoliciesOnly, tup.BothCertsAndPolicies})
+	root, err := conn.LoadRoot(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, root)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	// Export with small chunks.
+	dir := t.TempDir()
+	m, err := Export(ctx, conn, dir, key, 4)
+	require.NoError(t, err)
+	require.Equal(t, root[:], m.Root)
+	require.Greater(t, len(m.Chunks), len(kinds))
+
+	// Exporting again into the same directory fails.
+	_, err = Export(ctx, conn, dir, key, 4)
+	require.Error(t, err)
+
+	// Importing into a non empty DB fails.
+	_, err = Import(ctx, conn, dir, &key.PublicKey)
+	require.ErrorContains(t, err, "not empty")
+
+	t.Run("import", func(t *testing.T) {
+		config, removeF := testdb.ConfigureTestDB(t)
+		defer removeF()
+		conn := testdb.Connect(t, config)
+		defer conn.Close()
+
+		// Wrong key.
+		otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+		_, err = Import(ctx, conn, dir, &otherKey.PublicKey)
+		require.Error(t, err)
+
+		_, err = Import(ctx, conn, dir, &key.PublicKey)
+		require.NoError(t, err)
+		got, err := conn.LoadRoot(ctx)
+		require.NoError(t, err)
+		require.Equal(t, root, got)
+		dirty, err := conn.DirtyCount(ctx)
+		require.NoError(t, err)
+		require.Zero(t, dirty)
+	})
+}
@@ -0,0 +1,211 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/common/crypto"
+	"github.com/netsec-ethz/fpki/pkg/db"
+)
+
+// Export writes the contents of the map into the directory dir, which is created if needed and
+// must not already contain an archive. The root is signed with key, as the responder does.
+// Export refuses to run while an update is pending (the dirty table is not empty), and fails
+// if the map was updated during the export, as the archive would not be a consistent epoch.
+// A chunkSize of zero means DefaultChunkSize.
+func Export(
+	ctx context.Context,
+	conn db.Conn,
+	dir string,
+	key *rsa.PrivateKey,
+	chunkSize int,
+) (*Manifest, error) {
+
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("creating archive directory: %w", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ManifestFile)); err == nil {
+		return nil, fmt.Errorf("directory %s already contains an archive", dir)
+	}
+
+	root, err := quiescentRoot(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	if root == nil {
+		return nil, fmt.Errorf("the map is empty, nothing to export")
+	}
+	sth, err := crypto.SignBytes(root[:], key)
+	if err != nil {
+		return nil, fmt.Errorf("signing root: %w", err)
+	}
+
+	m := &Manifest{
+		Version:        FormatVersion,
+		CreatedAt:      time.Now().UTC(),
+		Root:           root[:],
+		SignedTreeHead: sth,
+	}
+	for _, kind := range kinds {
+		chunks, err := exportKind(ctx, conn, dir, kind, chunkSize)
+		if err != nil {
+			return nil, fmt.Errorf("exporting %s: %w", kind, err)
+		}
+		m.Chunks = append(m.Chunks, chunks...)
+	}
+
+	// Check that no update happened while exporting.
+	after, err := quiescentRoot(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	if after == nil || !bytes.Equal(after[:], root[:]) {
+		return nil, fmt.Errorf("the map was updated during the export, root is no longer %x",
+			root[:])
+	}
+
+	if err := writeManifest(dir, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// quiescentRoot returns the root of the map, or an error if an update is in progress.
+func quiescentRoot(ctx context.Context, conn db.Conn) (*common.SHA256Output, error) {
+	dirty, err := conn.DirtyCount(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("checking pending updates: %w", err)
+	}
+	if dirty != 0 {
+		return nil, fmt.Errorf("an update is in progress (%d dirty domains)", dirty)
+	}
+	root, err := conn.LoadRoot(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("loading root: %w", err)
+	}
+	return root, nil
+}
+
+func exportKind(
+	ctx context.Context,
+	conn db.Conn,
+	dir string,
+	kind Kind,
+	chunkSize int,
+) ([]Chunk, error) {
+
+	w := newChunkWriter(dir, kind, chunkSize)
+	var err error
+	switch kind {
+	case Domains:
+		err = exportDomains(ctx, conn, w, chunkSize)
+	case Certs:
+		err = exportPayloads(ctx, conn.RetrieveCertificatesPage, w, chunkSize)
+	case Policies:
+		err = exportPayloads(ctx, conn.RetrievePoliciesPage, w, chunkSize)
+	case DomainCerts:
+		err = exportAssociations(ctx, conn.RetrieveDomainCertsPage, w, chunkSize)
+	case DomainPolicies:
+		err = exportAssociations(ctx, conn.RetrieveDomainPoliciesPage, w, chunkSize)
+	}
+	chunks, closeErr := w.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return chunks, err
+}
+
+func exportDomains(ctx context.Context, conn db.Conn, w *chunkWriter, pageSize int) error {
+	var after *common.SHA256Output
+	for {
+		domains, err := conn.RetrieveDomainsPage(ctx, after, pageSize)
+		if err != nil {
+			return err
+		}
+		if len(domains) == 0 {
+			return nil
+		}
+		for _, d := range domains {
+			if err := w.Write(domainRow{ID: d.DomainID[:], Name: d.DomainName}); err != nil {
+				return err
+			}
+		}
+		after = &domains[len(domains)-1].DomainID
+	}
+}
+
+func exportPayloads(
+	ctx context.Context,
+	retrievePage func(context.Context, *common.SHA256Output, int) ([]*db.PayloadRecord, error),
+	w *chunkWriter,
+	pageSize int,
+) error {
+
+	var after *common.SHA256Output
+	for {
+		records, err := retrievePage(ctx, after, pageSize)
+		if err != nil {
+			return err
+		}
+		if len(records) == 0 {
+			return nil
+		}
+		for _, rec := range records {
+			row := payloadRow{
+				ID:         rec.ID[:],
+				Expiration: rec.Expiration,
+				Payload:    rec.Payload,
+			}
+			if rec.ParentID != nil {
+				row.ParentID = rec.ParentID[:]
+			}
+			if rec.Entry != nil {
+				row.Entry = &entryRow{
+					Type:  rec.Entry.Type,
+					TBSID: rec.Entry.TBSID[:],
+				}
+				if rec.Entry.IssuerKeyHash != nil {
+					row.Entry.IssuerKeyHash = rec.Entry.IssuerKeyHash[:]
+				}
+			}
+			if err := w.Write(row); err != nil {
+				return err
+			}
+		}
+		after = &records[len(records)-1].ID
+	}
+}
+
+func exportAssociations(
+	ctx context.Context,
+	retrievePage func(context.Context, *db.DomainAssociation, int) ([]db.DomainAssociation, error),
+	w *chunkWriter,
+	pageSize int,
+) error {
+
+	var after *db.DomainAssociation
+	for {
+		assocs, err := retrievePage(ctx, after, pageSize)
+		if err != nil {
+			return err
+		}
+		if len(assocs) == 0 {
+			return nil
+		}
+		for _, a := range assocs {
+			if err := w.Write(associationRow{DomainID: a.DomainID[:], ID: a.ID[:]}); err != nil {
+				return err
+			}
+		}
+		after = &assocs[len(assocs)-1]
+	}
+}
@@ -0,0 +1,256 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/common/crypto"
+	"github.com/netsec-ethz/fpki/pkg/db"
+	"github.com/netsec-ethz/fpki/pkg/mapserver/updater"
+)
+
+// importBatchSize is the maximum number of rows sent to the DB at once.
+const importBatchSize = 10_000
+
+// Import loads the archive in dir into the empty DB behind conn, recomputes the coalesced
+// payloads and the SMT, and checks that the recomputed root equals the exported one.
+// If publicKey is not nil, the signed tree head of the archive is verified with it before
+// touching the DB. All chunks are verified against their checksum before loading any of them.
+// If the recomputed root differs, an error is returned and the DB must be discarded.
+func Import(
+	ctx context.Context,
+	conn db.Conn,
+	dir string,
+	publicKey *rsa.PublicKey,
+) (*Manifest, error) {
+
+	m, err := ReadManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Root) != common.SHA256Size {
+		return nil, fmt.Errorf("archive has an invalid root %x", m.Root)
+	}
+	if publicKey != nil {
+		if err := crypto.VerifySignedBytes(m.Root, m.SignedTreeHead, publicKey); err != nil {
+			return nil, fmt.Errorf("verifying signed tree head of archive: %w", err)
+		}
+	}
+	if err := Verify(dir, m); err != nil {
+		return nil, err
+	}
+	if err := checkEmpty(ctx, conn); err != nil {
+		return nil, err
+	}
+
+	for _, c := range m.Chunks {
+		if err := importChunk(ctx, conn, dir, c); err != nil {
+			return nil, fmt.Errorf("importing %s: %w", c.File, err)
+		}
+	}
+
+	// All the domains are now dirty: recompute everything.
+	if err := updater.CoalescePayloadsForDirtyDomains(ctx, conn); err != nil {
+		return nil, fmt.Errorf("coalescing payloads: %w", err)
+	}
+	if err := updater.UpdateSMT(ctx, conn); err != nil {
+		return nil, fmt.Errorf("updating SMT: %w", err)
+	}
+	root, err := conn.LoadRoot(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("loading recomputed root: %w", err)
+	}
+	if root == nil {
+		return nil, fmt.Errorf("recomputed map is empty, the imported DB is not usable")
+	}
+	if !bytes.Equal(root[:], m.Root) {
+		return nil, fmt.Errorf("recomputed root %x differs from exported root %x, "+
+			"the imported DB is not usable", root[:], m.Root)
+	}
+	if err := conn.CleanupDirty(ctx); err != nil {
+		return nil, fmt.Errorf("cleaning up dirty domains: %w", err)
+	}
+	return m, nil
+}
+
+// checkEmpty returns an error if the DB contains a map or any domain or certificate.
+func checkEmpty(ctx context.Context, conn db.Conn) error {
+	root, err := conn.LoadRoot(ctx)
+	if err != nil {
+		return fmt.Errorf("loading root: %w", err)
+	}
+	domains, err := conn.RetrieveDomainsPage(ctx, nil, 1)
+	if err != nil {
+		return err
+	}
+	certs, err := conn.RetrieveCertificatesPage(ctx, nil, 1)
+	if err != nil {
+		return err
+	}
+	policies, err := conn.RetrievePoliciesPage(ctx, nil, 1)
+	if err != nil {
+		return err
+	}
+	dirty, err := conn.DirtyCount(ctx)
+	if err != nil {
+		return err
+	}
+	if root != nil || len(domains) != 0 || len(certs) != 0 || len(policies) != 0 || dirty != 0 {
+		return fmt.Errorf("the DB is not empty, refusing to import")
+	}
+	return nil
+}
+
+func importChunk(ctx context.Context, conn db.Conn, dir string, c Chunk) error {
+	switch c.Kind {
+	case Domains:
+		var ids []common.SHA256Output
+		var names []string
+		flush := func() error {
+			// Every domain becomes dirty, as it was at some point in the exported map.
+			if err := conn.InsertDomainsIntoDirty(ctx, ids); err != nil {
+				return err
+			}
+			err := conn.UpdateDomains(ctx, ids, names)
+			ids, names = ids[:0], names[:0]
+			return err
+		}
+		return readRows(dir, c, flush, func(row *domainRow) error {
+			id, err := toID(row.ID)
+			if err != nil {
+				return err
+			}
+			ids = append(ids, id)
+			names = append(names, row.Name)
+			return nil
+		}, func() int { return len(ids) })
+
+	case Certs, Policies:
+		update := conn.UpdateCerts
+		if c.Kind == Policies {
+			update = func(ctx context.Context, ids []common.SHA256Output,
+				parents []*common.SHA256Output, expirations []time.Time, payloads [][]byte,
+				_ []*db.CertificateEntry) error {
+
+				return conn.UpdatePolicies(ctx, ids, parents, expirations, payloads)
+			}
+		}
+		var ids []common.SHA256Output
+		var parents []*common.SHA256Output
+		var expirations []time.Time
+		var payloads [][]byte
+		var entries []*db.CertificateEntry
+		flush := func() error {
+			err := update(ctx, ids, parents, expirations, payloads, entries)
+			ids, parents, expirations, payloads = ids[:0], parents[:0], expirations[:0], payloads[:0]
+			entries = entries[:0]
+			return err
+		}
+		return readRows(dir, c, flush, func(row *payloadRow) error {
+			id, err := toID(row.ID)
+			if err != nil {
+				return err
+			}
+			var parent *common.SHA256Output
+			if row.ParentID != nil {
+				p, err := toID(row.ParentID)
+				if err != nil {
+					return err
+				}
+				parent = &p
+			}
+			var entry *db.CertificateEntry
+			if row.Entry != nil {
+				entry = &db.CertificateEntry{Type: row.Entry.Type}
+				if entry.TBSID, err = toID(row.Entry.TBSID); err != nil {
+					return err
+				}
+				if row.Entry.IssuerKeyHash != nil {
+					hash, err := toID(row.Entry.IssuerKeyHash)
+					if err != nil {
+						return err
+					}
+					entry.IssuerKeyHash = &hash
+				}
+			}
+			ids = append(ids, id)
+			parents = append(parents, parent)
+			expirations = append(expirations, row.Expiration)
+			payloads = append(payloads, row.Payload)
+			entries = append(entries, entry)
+			return nil
+		}, func() int { return len(ids) })
+
+	case DomainCerts, DomainPolicies:
+		update := conn.UpdateDomainCerts
+		if c.Kind == DomainPolicies {
+			update = conn.UpdateDomainPolicies
+		}
+		var domainIDs, ids []common.SHA256Output
+		flush := func() error {
+			err := update(ctx, domainIDs, ids)
+			domainIDs, ids = domainIDs[:0], ids[:0]
+			return err
+		}
+		return readRows(dir, c, flush, func(row *associationRow) error {
+			domainID, err := toID(row.DomainID)
+			if err != nil {
+				return err
+			}
+			id, err := toID(row.ID)
+			if err != nil {
+				return err
+			}
+			domainIDs = append(domainIDs, domainID)
+			ids = append(ids, id)
+			return nil
+		}, func() int { return len(ids) })
+
+	default:
+		return fmt.Errorf("unknown chunk kind %q", c.Kind)
+	}
+}
+
+// readRows decodes all rows of type T in the chunk, passing them to add, and calls flush
+// every importBatchSize rows (as reported by pending) and at the end.
+func readRows[T any](
+	dir string,
+	c Chunk,
+	flush func() error,
+	add func(*T) error,
+	pending func() int,
+) error {
+
+	err := readChunk(dir, c, func(dec *json.Decoder) error {
+		var row T
+		if err := dec.Decode(&row); err != nil {
+			return err
+		}
+		if err := add(&row); err != nil {
+			return err
+		}
+		if pending() >= importBatchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if pending() > 0 {
+		return flush()
+	}
+	return nil
+}
+
+func toID(b []byte) (common.SHA256Output, error) {
+	if len(b) != common.SHA256Size {
+		return common.SHA256Output{}, fmt.Errorf("invalid ID length %d", len(b))
+	}
+	return (common.SHA256Output)(b), nil
+}
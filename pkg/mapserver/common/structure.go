@@ -1,5 +1,11 @@
 package common
 
+import (
+	"time"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+)
+
 // Proof type enum
 // PoA: Proof of Absence; non-inclusion proof
 // PoP: Proof of Presence; inclusion proof
@@ -26,3 +32,69 @@ type PoI struct {
 	ProofKey   []byte
 	ProofValue []byte
 }
+
+// CertificateSummary: parsed view of one row of the certs table.
+type CertificateSummary struct {
+	ID           common.SHA256Output
+	ParentID     *common.SHA256Output `json:",omitempty"`
+	Expiration   time.Time
+	Subject      string
+	Issuer       string
+	SerialNumber string
+	NotBefore    time.Time
+	NotAfter     time.Time
+	DNSNames     []string `json:",omitempty"`
+	IsCA         bool
+	// Only for the certificate of a CertificateDetail: "x509" or "precert", the type of its
+	// CT log entry, and for precertificates the hash of the key of their issuer, as in the entry.
+	EntryType     string `json:",omitempty"`
+	IssuerKeyHash []byte `json:",omitempty"`
+}
+
+// CertificateDetail: response from map server to a certificate lookup.
+// Chain contains the ancestors of the certificate, starting with its parent and ending with the
+// root (or the last ancestor present in the DB).
+type CertificateDetail struct {
+	Certificate CertificateSummary
+	Chain       []CertificateSummary
+	Domains     []DomainReference
+}
+
+// PolicySummary: parsed view of one row of the policies table.
+type PolicySummary struct {
+	ID           common.SHA256Output
+	ParentID     *common.SHA256Output `json:",omitempty"`
+	Expiration   time.Time
+	Type         string // "pc" for policy certificates, "pcrev" for revocations.
+	Domain       string
+	SerialNumber int
+	NotBefore    time.Time `json:",omitempty"`
+	NotAfter     time.Time `json:",omitempty"`
+	CanIssue     bool      `json:",omitempty"`
+	CanOwn       bool      `json:",omitempty"`
+	IssuerHash   []byte    `json:",omitempty"`
+}
+
+// PolicyDetail: response from map server to a policy lookup. Chain is ordered as in
+// CertificateDetail.
+type PolicyDetail struct {
+	Policy  PolicySummary
+	Chain   []PolicySummary
+	Domains []DomainReference
+}
+
+// DomainReference: a domain that references a certificate or policy.
+// DomainName is empty if the domain is not present in the domains table.
+type DomainReference struct {
+	DomainID   common.SHA256Output
+	DomainName string
+}
+
+// DomainSearchResponse: response from map server to a domain search.
+// Total is the number of domains matching the search across all pages. Next is the value to
+// pass as "after" to obtain the next page, empty if this is the last page.
+type DomainSearchResponse struct {
+	Domains []DomainReference
+	Total   uint64
+	Next    string `json:",omitempty"`
+}
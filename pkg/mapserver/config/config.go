@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 
 	"github.com/netsec-ethz/fpki/pkg/db"
+	"github.com/netsec-ethz/fpki/pkg/mapserver/logfetcher"
 	"github.com/netsec-ethz/fpki/pkg/util"
 )
 
@@ -17,8 +18,35 @@ type Config struct {
 	HttpAPIPort         int
 	CsvIngestionMaxRows uint64
 
+	// StaticCTLogs configures, by their URL, the logs of CTLogServerURLs that implement the
+	// static-ct-api. They are read from their tiles instead of with the RFC 6962 API.
+	StaticCTLogs map[string]logfetcher.StaticLogConfig
+	// CTLogListFile is a CT log list in the v3 schema, to select the CT logs and learn their
+	// public keys. See SelectCTLogs.
+	CTLogListFile string
+
 	UpdateAt    util.TimeOfDayWrap
 	UpdateTimer util.DurationWrap
+
+	// CTRetries is the number of retries of a failed request to a CT log server. If zero, the
+	// retries of logfetcher.DefaultRetryPolicy are used. A negative value disables retrying.
+	CTRetries int
+	// CTRetryMaxDelay bounds the delay between retries, also when requested by the server.
+	CTRetryMaxDelay util.DurationWrap
+	// CTQuarantineFile is the file where the entries of the CT logs that cannot be parsed are
+	// appended. If empty, only their URL, index and error are written to the standard error.
+	CTQuarantineFile string
+
+	// SyncToken authenticates the calls to the sync API used by replicas. A primary serves
+	// the API only if it is set, and a replica sends it to its primary.
+	SyncToken string
+
+	// PrimaryURL, if set, makes this map server a read-only replica of the primary at the URL.
+	PrimaryURL string
+	// PrimaryCertificatePemFile is the X509 pem certificate of the primary.
+	PrimaryCertificatePemFile string
+	// SyncInterval is the time between two syncs of a replica with its primary.
+	SyncInterval util.DurationWrap
 }
 
 func ReadConfigFromFile(filePath string) (*Config, error) {
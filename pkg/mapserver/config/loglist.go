@@ -0,0 +1,255 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/certificate-transparency-go/loglist3"
+
+	"github.com/netsec-ethz/fpki/pkg/mapserver/logfetcher"
+)
+
+// CTLogSelection are the CT logs that the map server updates from.
+type CTLogSelection struct {
+	URLs       []string                              // All the selected logs.
+	PublicKeys map[string][]byte                     // DER public keys of the logs, by URL.
+	StaticLogs map[string]logfetcher.StaticLogConfig // Logs implementing the static-ct-api.
+	Warnings   []string                              // Configured logs that were not selected.
+
+	skipped map[string]string // Why the logs of the list were not selected, by URL.
+	warned  map[string]bool   // URLs of the configured logs with a warning.
+}
+
+// SelectCTLogs returns the CT logs to update from at the time now.
+// Without CTLogListFile, they are the CTLogServerURLs, with the StaticCTLogs among them.
+// With it, the log list is read, and the selected logs are those of the list that are
+// qualified, usable or read-only, skipping the temporal shards whose interval has ended.
+// If CTLogServerURLs is not empty, only those logs are selected, together with the current
+// shards of the same temporal series. The configured logs that are not in the list, or are
+// skipped, are reported as warnings. The logs in CertificateFolders are always selected.
+func (c *Config) SelectCTLogs(now time.Time) (*CTLogSelection, error) {
+	selection := &CTLogSelection{
+		PublicKeys: make(map[string][]byte),
+		StaticLogs: make(map[string]logfetcher.StaticLogConfig),
+		skipped:    make(map[string]string),
+		warned:     make(map[string]bool),
+	}
+	if c.CTLogListFile == "" {
+		selection.URLs = c.CTLogServerURLs
+		for url, static := range c.StaticCTLogs {
+			selection.StaticLogs[url] = static
+		}
+		return selection, nil
+	}
+
+	data, err := os.ReadFile(c.CTLogListFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading CT log list: %w", err)
+	}
+	list := &ctLogList{}
+	if err := json.Unmarshal(data, list); err != nil {
+		return nil, fmt.Errorf("parsing CT log list %s: %w", c.CTLogListFile, err)
+	}
+	logs := list.logs()
+
+	selected := make(map[*ctLogListEntry]struct{})
+	// The URL identifies the log, and is the configured one if the log is configured.
+	selectLog := func(log *ctLogListEntry, url string, configured bool) {
+		if _, ok := selected[log]; ok {
+			return
+		}
+		skip := func(reason string) {
+			selection.skipped[url] = reason
+			if configured {
+				selection.warned[url] = true
+				selection.Warnings = append(selection.Warnings, fmt.Sprintf(
+					"configured log %s %s, skipped", url, reason))
+			}
+		}
+		if status := log.State.LogStatus(); status != loglist3.QualifiedLogStatus &&
+			status != loglist3.UsableLogStatus &&
+			status != loglist3.ReadOnlyLogStatus {
+
+			status := strings.ToLower(strings.TrimSuffix(status.String(), "LogStatus"))
+			skip(fmt.Sprintf("is %s in the CT log list", status))
+			return
+		}
+		if log.TemporalInterval != nil && !now.Before(log.TemporalInterval.EndExclusive) {
+			skip(fmt.Sprintf("is a temporal shard that ended at %s",
+				log.TemporalInterval.EndExclusive.Format(time.RFC3339)))
+			return
+		}
+		selected[log] = struct{}{}
+		selection.URLs = append(selection.URLs, url)
+		selection.PublicKeys[url] = log.Key
+		if log.static {
+			// The origin of the checkpoints is the submission URL without scheme.
+			_, origin, ok := strings.Cut(log.url, "://")
+			if !ok {
+				origin = log.url
+			}
+			selection.StaticLogs[url] = logfetcher.StaticLogConfig{
+				MonitoringURL: log.MonitoringURL,
+				Origin:        strings.TrimSuffix(origin, "/"),
+				PublicKey:     log.Key,
+			}
+		}
+	}
+
+	if len(c.CTLogServerURLs) == 0 {
+		for _, log := range logs {
+			selectLog(log, log.url, false)
+		}
+	}
+	for _, url := range c.CTLogServerURLs {
+		if _, ok := c.CertificateFolders[url]; ok {
+			selection.URLs = append(selection.URLs, url)
+			continue
+		}
+		log := findCTLog(logs, url)
+		if log == nil {
+			selection.warned[url] = true
+			selection.Warnings = append(selection.Warnings, fmt.Sprintf(
+				"configured log %s is not in the CT log list, skipped", url))
+			continue
+		}
+		selectLog(log, url, true)
+		// Follow the other shards of the series.
+		if series := log.series(); series != "" {
+			for _, other := range logs {
+				if other.operator == log.operator && other.series() == series {
+					selectLog(other, other.url, false)
+				}
+			}
+		}
+	}
+
+	// The explicit configuration of the static logs takes precedence.
+	for url, static := range c.StaticCTLogs {
+		if _, ok := selection.StaticLogs[url]; ok {
+			selection.StaticLogs[url] = static
+		}
+	}
+	return selection, nil
+}
+
+// Changes returns the warnings of the selection that the previous one, which may be nil, did
+// not have, and a warning for each log of the previous selection that is not selected anymore,
+// unless it is configured and already has a warning.
+func (s *CTLogSelection) Changes(previous *CTLogSelection) []string {
+	if previous == nil {
+		return s.Warnings
+	}
+	var changes []string
+	for _, w := range s.Warnings {
+		if !slices.Contains(previous.Warnings, w) {
+			changes = append(changes, w)
+		}
+	}
+	for _, url := range previous.URLs {
+		if slices.Contains(s.URLs, url) || s.warned[url] {
+			continue
+		}
+		reason, ok := s.skipped[url]
+		if !ok {
+			reason = "is not in the CT log list"
+		}
+		changes = append(changes, fmt.Sprintf("log %s %s, not updated from anymore", url, reason))
+	}
+	return changes
+}
+
+// ctLogList is a CT log list in the v3 schema. The tiled logs of the operators, which are not
+// supported by loglist3 yet, are also parsed.
+type ctLogList struct {
+	Operators []struct {
+		Name      string          `json:"name"`
+		Logs      []*loglist3.Log `json:"logs"`
+		TiledLogs []*struct {
+			loglist3.Log
+			SubmissionURL string `json:"submission_url"`
+			MonitoringURL string `json:"monitoring_url"`
+		} `json:"tiled_logs"`
+	} `json:"operators"`
+}
+
+// ctLogListEntry is a log of the list, either RFC 6962 or static.
+type ctLogListEntry struct {
+	loglist3.Log
+	MonitoringURL string // Only for static logs.
+
+	operator string
+	url      string // The URL of RFC 6962 logs, the submission URL of static ones.
+	static   bool
+}
+
+// logs returns all the logs of the list, in order.
+func (l *ctLogList) logs() []*ctLogListEntry {
+	var logs []*ctLogListEntry
+	for _, op := range l.Operators {
+		for _, log := range op.Logs {
+			logs = append(logs, &ctLogListEntry{
+				Log:      *log,
+				operator: op.Name,
+				url:      log.URL,
+			})
+		}
+		for _, log := range op.TiledLogs {
+			logs = append(logs, &ctLogListEntry{
+				Log:           log.Log,
+				MonitoringURL: log.MonitoringURL,
+				operator:      op.Name,
+				url:           log.SubmissionURL,
+				static:        true,
+			})
+		}
+	}
+	return logs
+}
+
+// findCTLog returns the log with the URL, or nil. Static logs are also found by their
+// monitoring URL.
+func findCTLog(logs []*ctLogListEntry, url string) *ctLogListEntry {
+	normalize := func(url string) string {
+		return strings.TrimSuffix(url, "/")
+	}
+	for _, log := range logs {
+		if normalize(log.url) == normalize(url) ||
+			log.static && normalize(log.MonitoringURL) == normalize(url) {
+			return log
+		}
+	}
+	return nil
+}
+
+// series returns the description of the temporal shard without its period, which is the same
+// for all the shards of the series. The period is found in the description by the year of its
+// temporal interval, and includes the letters and digits that follow, e.g. "2025h1" in
+// "Google 'Argon2025h1' log", "2026" in "Cloudflare 'Nimbus2026' Log", or "2026a" in
+// "TrustAsia Log2026a". It returns empty if the log is not a temporal shard, or if its period
+// is not in the description.
+func (l *ctLogListEntry) series() string {
+	if l.TemporalInterval == nil {
+		return ""
+	}
+	// The interval may start before the year of the shard, but not end after it.
+	year := l.TemporalInterval.EndExclusive.Add(-time.Nanosecond).UTC().Year()
+	start := strings.Index(l.Description, strconv.Itoa(year))
+	if start < 0 {
+		return ""
+	}
+	end := start + len(strconv.Itoa(year))
+	for end < len(l.Description) && isAlphanumeric(l.Description[end]) {
+		end++
+	}
+	return l.Description[:start] + l.Description[end:]
+}
+
+func isAlphanumeric(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
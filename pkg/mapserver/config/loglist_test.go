@@ -0,0 +1,330 @@
+package config_test
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/netsec-ethz/fpki/pkg/mapserver/config"
+	"github.com/netsec-ethz/fpki/pkg/mapserver/logfetcher"
+)
+
+// testLogList has, for operator A: the argon shards of 2025h2 (ended), 2026h1, 2026h2 and
+// 2027h1 (rejected), a retired log, a pending log, and a usable log. For operator B: a usable
+// log, the elm shards of 2026a and 2026b, and a usable tiled log.
+const testLogList = `{
+  "version": "3.0",
+  "log_list_timestamp": "2026-01-01T00:00:00Z",
+  "operators": [
+    {
+      "name": "A",
+      "email": ["a@example.com"],
+      "logs": [
+        {
+          "description": "A 'Argon2025h2' log",
+          "log_id": "AAAA", "key": "KEY_ARGON2025H2", "mmd": 86400,
+          "url": "https://a.example.com/logs/argon2025h2/",
+          "state": {"usable": {"timestamp": "2024-01-01T00:00:00Z"}},
+          "temporal_interval": {
+            "start_inclusive": "2025-07-01T00:00:00Z",
+            "end_exclusive": "2026-01-01T00:00:00Z"
+          }
+        },
+        {
+          "description": "A 'Argon2026h1' log",
+          "log_id": "AAAB", "key": "KEY_ARGON2026H1", "mmd": 86400,
+          "url": "https://a.example.com/logs/argon2026h1/",
+          "state": {"usable": {"timestamp": "2024-01-01T00:00:00Z"}},
+          "temporal_interval": {
+            "start_inclusive": "2026-01-01T00:00:00Z",
+            "end_exclusive": "2026-07-01T00:00:00Z"
+          }
+        },
+        {
+          "description": "A 'Argon2026h2' log",
+          "log_id": "AAAC", "key": "KEY_ARGON2026H2", "mmd": 86400,
+          "url": "https://a.example.com/logs/argon2026h2/",
+          "state": {"qualified": {"timestamp": "2024-01-01T00:00:00Z"}},
+          "temporal_interval": {
+            "start_inclusive": "2026-07-01T00:00:00Z",
+            "end_exclusive": "2027-01-01T00:00:00Z"
+          }
+        },
+        {
+          "description": "A 'Argon2027h1' log",
+          "log_id": "AAAD", "key": "KEY_ARGON2027H1", "mmd": 86400,
+          "url": "https://a.example.com/logs/argon2027h1/",
+          "state": {"rejected": {"timestamp": "2024-01-01T00:00:00Z"}},
+          "temporal_interval": {
+            "start_inclusive": "2027-01-01T00:00:00Z",
+            "end_exclusive": "2027-07-01T00:00:00Z"
+          }
+        },
+        {
+          "description": "A 'Old' log",
+          "log_id": "AAAE", "key": "KEY_OLD", "mmd": 86400,
+          "url": "https://a.example.com/logs/old/",
+          "state": {"retired": {"timestamp": "2024-01-01T00:00:00Z"}}
+        },
+        {
+          "description": "A 'New' log",
+          "log_id": "AAAF", "key": "KEY_NEW", "mmd": 86400,
+          "url": "https://a.example.com/logs/new/",
+          "state": {"pending": {"timestamp": "2024-01-01T00:00:00Z"}}
+        },
+        {
+          "description": "A 'Xenon' log",
+          "log_id": "AAAG", "key": "KEY_XENON", "mmd": 86400,
+          "url": "https://a.example.com/logs/xenon/",
+          "state": {"usable": {"timestamp": "2024-01-01T00:00:00Z"}}
+        }
+      ]
+    },
+    {
+      "name": "B",
+      "email": ["b@example.com"],
+      "logs": [
+        {
+          "description": "B 'Oak' log",
+          "log_id": "AAAH", "key": "KEY_OAK", "mmd": 86400,
+          "url": "https://b.example.com/oak/",
+          "state": {"usable": {"timestamp": "2024-01-01T00:00:00Z"}}
+        },
+        {
+          "description": "B Elm2026a",
+          "log_id": "AAAJ", "key": "KEY_ELM2026A", "mmd": 86400,
+          "url": "https://b.example.com/elm2026a/",
+          "state": {"usable": {"timestamp": "2024-01-01T00:00:00Z"}},
+          "temporal_interval": {
+            "start_inclusive": "2025-12-15T00:00:00Z",
+            "end_exclusive": "2026-07-01T00:00:00Z"
+          }
+        },
+        {
+          "description": "B Elm2026b",
+          "log_id": "AAAK", "key": "KEY_ELM2026B", "mmd": 86400,
+          "url": "https://b.example.com/elm2026b/",
+          "state": {"usable": {"timestamp": "2024-01-01T00:00:00Z"}},
+          "temporal_interval": {
+            "start_inclusive": "2026-07-01T00:00:00Z",
+            "end_exclusive": "2027-01-01T00:00:00Z"
+          }
+        }
+      ],
+      "tiled_logs": [
+        {
+          "description": "B 'Sycamore' log",
+          "log_id": "AAAI", "key": "KEY_SYCAMORE", "mmd": 60,
+          "submission_url": "https://b.example.com/sycamore/",
+          "monitoring_url": "https://mon.b.example.com/sycamore/",
+          "state": {"usable": {"timestamp": "2024-01-01T00:00:00Z"}}
+        }
+      ]
+    }
+  ]
+}`
+
+// testLogKey returns the key of the log in testLogList, as written there and as decoded.
+func testLogKey(name string) (string, []byte) {
+	key := []byte("public key of " + name)
+	return base64.StdEncoding.EncodeToString(key), key
+}
+
+// writeTestLogList writes testLogList, with the keys of testLogKey, and returns its file.
+func writeTestLogList(t *testing.T) string {
+	list := testLogList
+	for _, name := range []string{"ARGON2025H2", "ARGON2026H1", "ARGON2026H2", "ARGON2027H1",
+		"OLD", "NEW", "XENON", "OAK", "ELM2026A", "ELM2026B", "SYCAMORE"} {
+
+		encoded, _ := testLogKey(name)
+		list = strings.ReplaceAll(list, `"KEY_`+name+`"`, `"`+encoded+`"`)
+	}
+	listFile := filepath.Join(t.TempDir(), "log_list.json")
+	require.NoError(t, os.WriteFile(listFile, []byte(list), 0644))
+	return listFile
+}
+
+func TestSelectCTLogs(t *testing.T) {
+	listFile := writeTestLogList(t)
+	now := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	cases := map[string]struct {
+		conf             config.Config
+		expectedURLs     []string
+		expectedStatic   map[string]logfetcher.StaticLogConfig
+		expectedKeys     []string // Names of the keys of the expected URLs, in order.
+		expectedWarnings []string // Substrings of the expected warnings, in order.
+	}{
+		"no_list": {
+			conf: config.Config{
+				CTLogServerURLs: []string{"https://a.example.com/logs/xenon/", "https://b"},
+				StaticCTLogs: map[string]logfetcher.StaticLogConfig{
+					"https://b": {Origin: "b"},
+				},
+			},
+			expectedURLs: []string{"https://a.example.com/logs/xenon/", "https://b"},
+			expectedStatic: map[string]logfetcher.StaticLogConfig{
+				"https://b": {Origin: "b"},
+			},
+		},
+		"all": {
+			conf: config.Config{
+				CTLogListFile: listFile,
+			},
+			expectedURLs: []string{
+				"https://a.example.com/logs/argon2026h1/",
+				"https://a.example.com/logs/argon2026h2/",
+				"https://a.example.com/logs/xenon/",
+				"https://b.example.com/oak/",
+				"https://b.example.com/elm2026a/",
+				"https://b.example.com/elm2026b/",
+				"https://b.example.com/sycamore/",
+			},
+			expectedStatic: map[string]logfetcher.StaticLogConfig{
+				"https://b.example.com/sycamore/": {
+					MonitoringURL: "https://mon.b.example.com/sycamore/",
+					Origin:        "b.example.com/sycamore",
+				},
+			},
+			expectedKeys: []string{"ARGON2026H1", "ARGON2026H2", "XENON", "OAK", "ELM2026A",
+				"ELM2026B", "SYCAMORE"},
+		},
+		"configured": {
+			conf: config.Config{
+				CTLogListFile: listFile,
+				CTLogServerURLs: []string{
+					"https://a.example.com/logs/argon2025h2", // Shard ended, follows series.
+					"https://a.example.com/logs/old/",
+					"https://a.example.com/logs/gone/",
+					"https://b.example.com/elm2026a/", // Follows the 2026b shard.
+					"https://mon.b.example.com/sycamore/",
+					"https://local",
+				},
+				CertificateFolders: map[string]string{
+					"https://local": "/tmp/certs",
+				},
+			},
+			expectedURLs: []string{
+				"https://a.example.com/logs/argon2026h1/",
+				"https://a.example.com/logs/argon2026h2/",
+				"https://b.example.com/elm2026a/",
+				"https://b.example.com/elm2026b/",
+				"https://mon.b.example.com/sycamore/",
+				"https://local",
+			},
+			expectedStatic: map[string]logfetcher.StaticLogConfig{
+				"https://mon.b.example.com/sycamore/": {
+					MonitoringURL: "https://mon.b.example.com/sycamore/",
+					Origin:        "b.example.com/sycamore",
+				},
+			},
+			expectedKeys: []string{"ARGON2026H1", "ARGON2026H2", "ELM2026A", "ELM2026B",
+				"SYCAMORE"},
+			expectedWarnings: []string{
+				"argon2025h2 is a temporal shard that ended",
+				"old/ is retired",
+				"gone/ is not in the CT log list",
+			},
+		},
+	}
+	for name, tc := range cases {
+		name, tc := name, tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			logs, err := tc.conf.SelectCTLogs(now)
+			require.NoError(t, err)
+			require.Equal(t, tc.expectedURLs, logs.URLs)
+
+			// The static logs have the key of the list.
+			for url, static := range logs.StaticLogs {
+				if tc.conf.CTLogListFile != "" {
+					require.Equal(t, logs.PublicKeys[url], static.PublicKey)
+					static.PublicKey = nil
+				}
+				require.Equal(t, tc.expectedStatic[url], static, url)
+			}
+			require.Len(t, logs.StaticLogs, len(tc.expectedStatic))
+
+			require.Len(t, logs.PublicKeys, len(tc.expectedKeys))
+			for i, name := range tc.expectedKeys {
+				_, key := testLogKey(name)
+				require.Equal(t, key, logs.PublicKeys[tc.expectedURLs[i]])
+			}
+
+			require.Len(t, logs.Warnings, len(tc.expectedWarnings))
+			for i, w := range tc.expectedWarnings {
+				require.Contains(t, logs.Warnings[i], w)
+			}
+		})
+	}
+}
+
+// TestCTLogSelectionChanges checks that only the new warnings are reported, together with the
+// logs that are not selected anymore, whether configured or not.
+func TestCTLogSelectionChanges(t *testing.T) {
+	listFile := writeTestLogList(t)
+	before := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	after := time.Date(2026, 8, 1, 0, 0, 0, 0, time.UTC) // The 2026h1 and 2026a shards ended.
+
+	cases := map[string]struct {
+		conf     config.Config
+		expected []string // Substrings of the expected changes after the first ones, in order.
+	}{
+		"all": {
+			conf: config.Config{
+				CTLogListFile: listFile,
+			},
+			expected: []string{
+				"argon2026h1/ is a temporal shard that ended",
+				"elm2026a/ is a temporal shard that ended",
+			},
+		},
+		"configured": {
+			conf: config.Config{
+				CTLogListFile: listFile,
+				CTLogServerURLs: []string{
+					"https://a.example.com/logs/argon2025h2/",
+					"https://b.example.com/elm2026a/",
+				},
+			},
+			expected: []string{
+				"configured log https://b.example.com/elm2026a/ is a temporal shard that ended",
+				"argon2026h1/ is a temporal shard that ended",
+			},
+		},
+	}
+	for name, tc := range cases {
+		name, tc := name, tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			first, err := tc.conf.SelectCTLogs(before)
+			require.NoError(t, err)
+			require.Equal(t, first.Warnings, first.Changes(nil))
+			again, err := tc.conf.SelectCTLogs(before)
+			require.NoError(t, err)
+			require.Empty(t, again.Changes(first))
+
+			second, err := tc.conf.SelectCTLogs(after)
+			require.NoError(t, err)
+			changes := second.Changes(again)
+			require.Len(t, changes, len(tc.expected))
+			for i, c := range tc.expected {
+				require.Contains(t, changes[i], c)
+			}
+			require.Empty(t, second.Changes(second))
+		})
+	}
+}
+
+func TestSelectCTLogsMissingList(t *testing.T) {
+	conf := config.Config{
+		CTLogListFile: filepath.Join(t.TempDir(), "missing.json"),
+	}
+	_, err := conf.SelectCTLogs(time.Now())
+	require.Error(t, err)
+}
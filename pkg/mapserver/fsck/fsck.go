@@ -0,0 +1,609 @@
+// Package fsck checks that the tables of a map server DB are mutually consistent.
+//
+// Check verifies that:
+//   - the parent of every certificate and policy exists,
+//   - the coalesced payload of every domain matches a recomputation from the domain_certs and
+//     domain_policies tables, following the parents of certificates and policies,
+//   - every leaf of the SMT reachable from the stored root matches the coalesced payload of its
+//     domain, and every domain with a payload is in the SMT,
+//   - every node of the tree table is reachable from a retained root. The unreachable ones are
+//     reported, and optionally deleted.
+//
+// Inconsistencies of domains in the dirty table are reported as pending, as they are expected
+// to be fixed by finishing (or rerunning) the interrupted update.
+package fsck
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"slices"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/db"
+	"github.com/netsec-ethz/fpki/pkg/mapserver/trie"
+)
+
+const (
+	// DefaultPageSize is the default number of rows read from the DB at once.
+	DefaultPageSize = 1000
+	// DefaultMaxProblems is the default maximum number of problems kept in the report.
+	DefaultMaxProblems = 1000
+	// DefaultMaxReachableNodes is the default maximum number of SMT nodes kept in memory.
+	DefaultMaxReachableNodes = 10_000_000
+)
+
+// Kind classifies the problems found by Check.
+type Kind string
+
+const (
+	MissingCertParent   Kind = "missing certificate parent"
+	MissingPolicyParent Kind = "missing policy parent"
+	StalePayload        Kind = "stale coalesced payload"
+	LeafMismatch        Kind = "SMT leaf does not match payload"
+	LeafWithoutPayload  Kind = "SMT leaf without payload"
+	PayloadNotInSMT     Kind = "payload not in SMT"
+	MissingTreeNode     Kind = "missing SMT node"
+	Pending             Kind = "pending update of dirty domain"
+	OrphanedTreeNode    Kind = "orphaned SMT node"
+)
+
+// Problem is one inconsistency found by Check.
+type Problem struct {
+	Kind Kind
+	// ID identifies the certificate, policy, domain or SMT node with the problem.
+	ID     common.SHA256Output
+	Detail string
+}
+
+func (p Problem) String() string {
+	if p.Detail == "" {
+		return fmt.Sprintf("%s: %x", p.Kind, p.ID)
+	}
+	return fmt.Sprintf("%s: %x (%s)", p.Kind, p.ID, p.Detail)
+}
+
+// Options configure Check.
+type Options struct {
+	// RetainedRoots are roots, besides the stored one, whose SMT nodes are not orphaned.
+	// Their missing nodes are not reported.
+	RetainedRoots []common.SHA256Output
+	// CollectGarbage deletes the orphaned SMT nodes. It is refused if the dirty table is
+	// not empty, as an update could be running.
+	CollectGarbage bool
+	// MaxProblems is the maximum number of problems kept in the report. All are counted.
+	MaxProblems int
+	// PageSize is the number of rows read from the DB at once.
+	PageSize int
+	// MaxReachableNodes is the maximum number of keys of reachable SMT nodes kept in memory to
+	// find the orphaned ones. A larger tree table is checked in several passes, each walking
+	// the retained roots again.
+	MaxReachableNodes int
+}
+
+// Report is the result of Check.
+type Report struct {
+	Root         *common.SHA256Output
+	DirtyDomains uint64
+
+	Certificates uint64
+	Policies     uint64
+	Domains      uint64
+	Leaves       uint64
+	TreeNodes    uint64
+	DeletedNodes uint64
+	Counts       map[Kind]uint64
+	Problems     []Problem
+	maxProblems  int
+}
+
+// OK returns true if no inconsistency was found, besides pending updates and orphaned nodes.
+func (r *Report) OK() bool {
+	for kind, count := range r.Counts {
+		if kind != Pending && kind != OrphanedTreeNode && count > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Report) add(kind Kind, id common.SHA256Output, detail string) {
+	r.Counts[kind]++
+	if len(r.Problems) < r.maxProblems {
+		r.Problems = append(r.Problems, Problem{Kind: kind, ID: id, Detail: detail})
+	}
+}
+
+// Check verifies the consistency of the DB behind conn. The map server must not update the
+// DB while Check runs.
+func Check(ctx context.Context, conn db.Conn, opts Options) (*Report, error) {
+	if opts.PageSize <= 0 {
+		opts.PageSize = DefaultPageSize
+	}
+	if opts.MaxProblems <= 0 {
+		opts.MaxProblems = DefaultMaxProblems
+	}
+	if opts.MaxReachableNodes <= 0 {
+		opts.MaxReachableNodes = DefaultMaxReachableNodes
+	}
+	r := &Report{
+		Counts:      make(map[Kind]uint64),
+		maxProblems: opts.MaxProblems,
+	}
+
+	var err error
+	if r.Root, err = conn.LoadRoot(ctx); err != nil {
+		return nil, fmt.Errorf("loading root: %w", err)
+	}
+	if r.DirtyDomains, err = conn.DirtyCount(ctx); err != nil {
+		return nil, fmt.Errorf("counting dirty domains: %w", err)
+	}
+	if opts.CollectGarbage && r.DirtyDomains != 0 {
+		return nil, fmt.Errorf("refusing to collect garbage with %d dirty domains",
+			r.DirtyDomains)
+	}
+
+	c := &checker{
+		conn:   conn,
+		opts:   opts,
+		report: r,
+	}
+	steps := []struct {
+		name string
+		f    func(context.Context) error
+	}{
+		{"checking parents", c.checkParents},
+		{"checking coalesced payloads", c.checkPayloads},
+		{"checking SMT", c.checkSMT},
+	}
+	for _, step := range steps {
+		err := step.f(ctx)
+		if err == nil {
+			err = c.flush(ctx)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", step.name, err)
+		}
+	}
+	return r, nil
+}
+
+type checker struct {
+	conn    db.Conn
+	opts    Options
+	report  *Report
+	pending []Problem // Problems of domains, not yet checked against the dirty table.
+}
+
+// checkParents verifies that the parent of every certificate and policy exists.
+func (c *checker) checkParents(ctx context.Context) error {
+	tables := []struct {
+		retrievePage func(context.Context, *common.SHA256Output, int) ([]db.ParentRecord, error)
+		exist        func(context.Context, []common.SHA256Output) ([]bool, error)
+		count        *uint64
+		kind         Kind
+	}{
+		{c.conn.RetrieveCertificateParentsPage, c.conn.CheckCertsExist,
+			&c.report.Certificates, MissingCertParent},
+		{c.conn.RetrievePolicyParentsPage, c.conn.CheckPoliciesExist,
+			&c.report.Policies, MissingPolicyParent},
+	}
+	for _, t := range tables {
+		var after *common.SHA256Output
+		for {
+			records, err := t.retrievePage(ctx, after, c.opts.PageSize)
+			if err != nil {
+				return err
+			}
+			if len(records) == 0 {
+				break
+			}
+			*t.count += uint64(len(records))
+			after = &records[len(records)-1].ID
+
+			var children, parents []common.SHA256Output
+			for _, rec := range records {
+				if rec.ParentID != nil {
+					children = append(children, rec.ID)
+					parents = append(parents, *rec.ParentID)
+				}
+			}
+			if len(parents) == 0 {
+				continue
+			}
+			exist, err := t.exist(ctx, parents)
+			if err != nil {
+				return err
+			}
+			for i, ok := range exist {
+				if !ok {
+					c.report.add(t.kind, children[i], fmt.Sprintf("parent %x", parents[i]))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// checkPayloads recomputes the coalesced payload of every domain and compares it with the
+// stored one.
+func (c *checker) checkPayloads(ctx context.Context) error {
+	var after *common.SHA256Output
+	for {
+		domains, err := c.conn.RetrieveDomainsPage(ctx, after, c.opts.PageSize)
+		if err != nil {
+			return err
+		}
+		if len(domains) == 0 {
+			return nil
+		}
+		c.report.Domains += uint64(len(domains))
+		after = &domains[len(domains)-1].DomainID
+
+		ids := make([]common.SHA256Output, len(domains))
+		for i, d := range domains {
+			ids[i] = d.DomainID
+		}
+		certs, policies, err := c.conn.RetrieveDomainAssociations(ctx, ids)
+		if err != nil {
+			return err
+		}
+		expected := make(map[common.SHA256Output][]common.SHA256Output, len(ids))
+		if err := closure(ctx, c.conn.RetrieveCertificateParents, certs, expected); err != nil {
+			return err
+		}
+		if err := closure(ctx, c.conn.RetrievePolicyParents, policies, expected); err != nil {
+			return err
+		}
+
+		entries, err := c.conn.RetrieveDomainEntries(ctx, ids)
+		if err != nil {
+			return err
+		}
+		stored := make(map[common.SHA256Output][]byte, len(entries))
+		for _, e := range entries {
+			stored[e.DomainID] = e.Payload
+		}
+		for _, id := range ids {
+			var payload []byte
+			if ids := expected[id]; len(ids) > 0 {
+				payload = common.SortIDsAndGlue(ids)
+			}
+			if !bytes.Equal(payload, stored[id]) {
+				err := c.add(ctx, StalePayload, id, fmt.Sprintf("expected %d IDs, stored %d",
+					len(payload)/common.SHA256Size, len(stored[id])/common.SHA256Size))
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// closure adds to payloads, per domain, the IDs of the existing certificates (or policies)
+// associated to it and of all their ancestors, as the coalescing of payloads does.
+func closure(
+	ctx context.Context,
+	retrieveParents func(context.Context, []common.SHA256Output) ([]db.ParentRecord, error),
+	assocs []db.DomainAssociation,
+	payloads map[common.SHA256Output][]common.SHA256Output,
+) error {
+
+	seen := make(map[db.DomainAssociation]struct{})
+	for len(assocs) > 0 {
+		ids := make([]common.SHA256Output, 0, len(assocs))
+		for _, a := range assocs {
+			ids = append(ids, a.ID)
+		}
+		records, err := retrieveParents(ctx, ids)
+		if err != nil {
+			return err
+		}
+		parents := make(map[common.SHA256Output]*common.SHA256Output, len(records))
+		for _, rec := range records {
+			parents[rec.ID] = rec.ParentID
+		}
+
+		var next []db.DomainAssociation
+		for _, a := range assocs {
+			parent, exists := parents[a.ID]
+			if _, ok := seen[a]; ok || !exists {
+				continue
+			}
+			seen[a] = struct{}{}
+			payloads[a.DomainID] = append(payloads[a.DomainID], a.ID)
+			if parent != nil {
+				next = append(next, db.DomainAssociation{DomainID: a.DomainID, ID: *parent})
+			}
+		}
+		assocs = next
+	}
+	return nil
+}
+
+// checkSMT walks the SMT from the stored root, comparing its leaves with the coalesced
+// payloads, and finds the orphaned nodes of the tree table. The keys of the nodes are split in
+// partitions of about MaxReachableNodes nodes, each checked for orphans after walking the
+// retained roots again.
+func (c *checker) checkSMT(ctx context.Context) error {
+	smt, err := trie.NewTrie(nil, common.SHA256Hash, c.conn)
+	if err != nil {
+		return err
+	}
+	counts, err := c.conn.CountRows(ctx)
+	if err != nil {
+		return err
+	}
+	maxNodes := uint64(c.opts.MaxReachableNodes)
+	partitions := max(1, (counts.TreeNodes+maxNodes-1)/maxNodes)
+
+	for partition := uint64(0); partition < partitions; partition++ {
+		inPartition := func(key []byte) bool {
+			return binary.BigEndian.Uint64(key)%partitions == partition
+		}
+		reachable := make(map[common.SHA256Output]struct{})
+		visitNode := func(key []byte, missing bool) error {
+			if inPartition(key) {
+				reachable[(common.SHA256Output)(key)] = struct{}{}
+			}
+			return nil
+		}
+		visitLeaf := func(key, value []byte) error { return nil }
+
+		// The stored root is checked with the first partition.
+		roots := c.opts.RetainedRoots
+		if partition == 0 {
+			if err := c.checkLeaves(ctx, smt, visitNode); err != nil {
+				return err
+			}
+		} else if root := c.report.Root; root != nil {
+			roots = append([]common.SHA256Output{*root}, roots...)
+		}
+		for _, root := range roots {
+			if err := smt.Walk(ctx, root[:], visitNode, visitLeaf); err != nil {
+				return err
+			}
+		}
+
+		if err := c.checkOrphans(ctx, reachable, inPartition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkLeaves walks the SMT from the stored root, reporting its missing nodes, and compares
+// its leaves, sorted by key, with the domains with a coalesced payload.
+func (c *checker) checkLeaves(
+	ctx context.Context,
+	smt *trie.Trie,
+	visitNode func(key []byte, missing bool) error,
+) error {
+
+	payloads := &payloadCursor{c: c}
+	var keys []common.SHA256Output
+	var values [][]byte
+	if root := c.report.Root; root != nil {
+		err := smt.Walk(ctx, root[:],
+			func(key []byte, missing bool) error {
+				if missing {
+					c.report.add(MissingTreeNode, (common.SHA256Output)(key), "")
+				}
+				return visitNode(key, missing)
+			},
+			func(key, value []byte) error {
+				c.report.Leaves++
+				id := (common.SHA256Output)(key)
+				if err := payloads.skipTo(ctx, &id); err != nil {
+					return err
+				}
+				keys = append(keys, id)
+				values = append(values, value)
+				if len(keys) < c.opts.PageSize {
+					return nil
+				}
+				err := c.compareLeaves(ctx, keys, values)
+				keys, values = keys[:0], values[:0]
+				return err
+			})
+		if err != nil {
+			return err
+		}
+	}
+	if err := c.compareLeaves(ctx, keys, values); err != nil {
+		return err
+	}
+	// The domains with a payload after the last leaf.
+	return payloads.skipTo(ctx, nil)
+}
+
+func (c *checker) compareLeaves(ctx context.Context, keys []common.SHA256Output, values [][]byte,
+) error {
+
+	if len(keys) == 0 {
+		return nil
+	}
+	entries, err := c.conn.RetrieveDomainEntries(ctx, keys)
+	if err != nil {
+		return err
+	}
+	payloads := make(map[common.SHA256Output][]byte, len(entries))
+	for _, e := range entries {
+		payloads[e.DomainID] = e.Payload
+	}
+	for i, key := range keys {
+		payload := payloads[key]
+		var err error
+		switch {
+		case len(payload) == 0:
+			err = c.add(ctx, LeafWithoutPayload, key, "")
+		case !bytes.Equal(common.SHA256Hash(payload), values[i]):
+			err = c.add(ctx, LeafMismatch, key, "")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// payloadCursor iterates over the domains with a coalesced payload, sorted by ID, as the
+// leaves of the SMT are.
+type payloadCursor struct {
+	c     *checker
+	after *common.SHA256Output
+	ids   []common.SHA256Output // The rest of the current page.
+	done  bool
+}
+
+// skipTo reports the domains with a payload before the leaf as not in the SMT, and skips the
+// domain of the leaf. A nil leaf reports all the remaining domains.
+func (p *payloadCursor) skipTo(ctx context.Context, leaf *common.SHA256Output) error {
+	for {
+		if len(p.ids) == 0 {
+			if p.done {
+				return nil
+			}
+			if err := p.next(ctx); err != nil {
+				return err
+			}
+			continue
+		}
+		cmp := -1
+		if leaf != nil {
+			cmp = bytes.Compare(p.ids[0][:], leaf[:])
+		}
+		if cmp > 0 {
+			return nil
+		}
+		if cmp < 0 {
+			if err := p.c.add(ctx, PayloadNotInSMT, p.ids[0], ""); err != nil {
+				return err
+			}
+		}
+		p.ids = p.ids[1:]
+		if cmp == 0 {
+			return nil
+		}
+	}
+}
+
+// next reads the next page of domains.
+func (p *payloadCursor) next(ctx context.Context) error {
+	domains, err := p.c.conn.RetrieveDomainsPage(ctx, p.after, p.c.opts.PageSize)
+	if err != nil {
+		return err
+	}
+	if len(domains) == 0 {
+		p.done = true
+		return nil
+	}
+	p.after = &domains[len(domains)-1].DomainID
+	ids := make([]common.SHA256Output, len(domains))
+	for i, d := range domains {
+		ids[i] = d.DomainID
+	}
+	entries, err := p.c.conn.RetrieveDomainEntries(ctx, ids)
+	if err != nil {
+		return err
+	}
+	p.ids = p.ids[:0]
+	for _, e := range entries {
+		if len(e.Payload) > 0 {
+			p.ids = append(p.ids, e.DomainID)
+		}
+	}
+	slices.SortFunc(p.ids, func(a, b common.SHA256Output) int {
+		return bytes.Compare(a[:], b[:])
+	})
+	return nil
+}
+
+// checkOrphans reports, and deletes if requested, the nodes of the tree table in the partition
+// not reachable from any retained root.
+func (c *checker) checkOrphans(
+	ctx context.Context,
+	reachable map[common.SHA256Output]struct{},
+	inPartition func(key []byte) bool,
+) error {
+
+	var orphans []common.SHA256Output
+	deleteOrphans := func() error {
+		if !c.opts.CollectGarbage || len(orphans) == 0 {
+			return nil
+		}
+		n, err := c.conn.DeleteTreeNodes(ctx, orphans)
+		c.report.DeletedNodes += uint64(n)
+		orphans = orphans[:0]
+		return err
+	}
+
+	var after uint64
+	for {
+		nodes, last, err := c.conn.RetrieveTreeNodesPage(ctx, after, math.MaxInt64,
+			c.opts.PageSize)
+		if err != nil {
+			return err
+		}
+		if len(nodes) == 0 {
+			break
+		}
+		after = last
+		for _, node := range nodes {
+			if !inPartition(node.Key[:]) {
+				continue
+			}
+			c.report.TreeNodes++
+			if _, ok := reachable[node.Key]; !ok {
+				c.report.add(OrphanedTreeNode, node.Key, "")
+				orphans = append(orphans, node.Key)
+			}
+		}
+		if err := deleteOrphans(); err != nil {
+			return err
+		}
+		orphans = orphans[:0]
+	}
+	return nil
+}
+
+// add reports a problem of the domain, or a pending update if the domain is dirty. The
+// problems are reported in batches, see flush.
+func (c *checker) add(ctx context.Context, kind Kind, domainID common.SHA256Output,
+	detail string) error {
+
+	c.pending = append(c.pending, Problem{Kind: kind, ID: domainID, Detail: detail})
+	if len(c.pending) < c.opts.PageSize {
+		return nil
+	}
+	return c.flush(ctx)
+}
+
+// flush reports the pending problems, checking which domains are dirty.
+func (c *checker) flush(ctx context.Context) error {
+	if len(c.pending) == 0 {
+		return nil
+	}
+	dirty := make([]bool, len(c.pending))
+	if c.report.DirtyDomains > 0 {
+		ids := make([]common.SHA256Output, len(c.pending))
+		for i, p := range c.pending {
+			ids[i] = p.ID
+		}
+		var err error
+		if dirty, err = c.conn.CheckDomainsDirty(ctx, ids); err != nil {
+			return err
+		}
+	}
+	for i, p := range c.pending {
+		if dirty[i] {
+			c.report.add(Pending, p.ID, string(p.Kind))
+		} else {
+			c.report.add(p.Kind, p.ID, p.Detail)
+		}
+	}
+	c.pending = c.pending[:0]
+	return nil
+}
@@ -0,0 +1,242 @@
+package fsck
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/db"
+	"github.com/netsec-ethz/fpki/pkg/db/embedded"
+	"github.com/netsec-ethz/fpki/pkg/mapserver/updater"
+	"github.com/netsec-ethz/fpki/pkg/tests/noopdb"
+)
+
+// TestCheckPayloads checks that the parents and payloads are verified against a DB with
+// one root certificate, one leaf certificate and one orphan certificate.
+func TestCheckPayloads(t *testing.T) {
+	ctx := context.Background()
+	id := func(b byte) common.SHA256Output { return common.SHA256Output{b} }
+	ptr := func(id common.SHA256Output) *common.SHA256Output { return &id }
+
+	root, leaf, orphan, missing := id(1), id(2), id(3), id(4)
+	good, stale, dirty := id(10), id(11), id(12)
+	conn := &fakeConn{
+		parents: map[common.SHA256Output]*common.SHA256Output{
+			root:   nil,
+			leaf:   ptr(root),
+			orphan: ptr(missing),
+		},
+		domains: []common.SHA256Output{good, stale, dirty},
+		certs: []db.DomainAssociation{
+			{DomainID: good, ID: leaf},
+			{DomainID: stale, ID: leaf},
+			{DomainID: stale, ID: orphan},
+			{DomainID: dirty, ID: root},
+		},
+		payloads: map[common.SHA256Output][]byte{
+			// The parent of leaf is included, the missing parent of orphan is not.
+			good:  common.SortIDsAndGlue([]common.SHA256Output{leaf, root}),
+			stale: common.SortIDsAndGlue([]common.SHA256Output{leaf, root}),
+		},
+		dirty: []common.SHA256Output{dirty},
+	}
+
+	r, err := Check(ctx, conn, Options{PageSize: 2})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), r.Certificates)
+	require.Equal(t, uint64(3), r.Domains)
+	require.Equal(t, uint64(1), r.Counts[MissingCertParent])
+	require.Equal(t, uint64(1), r.Counts[StalePayload])
+	require.Equal(t, uint64(1), r.Counts[Pending])
+	// Without root, no domain with a payload is in the SMT.
+	require.Equal(t, uint64(2), r.Counts[PayloadNotInSMT])
+	require.Contains(t, r.Problems, Problem{Kind: PayloadNotInSMT, ID: good})
+	require.Contains(t, r.Problems, Problem{Kind: PayloadNotInSMT, ID: stale})
+	require.False(t, r.OK())
+	require.Contains(t, r.Problems, Problem{
+		Kind:   MissingCertParent,
+		ID:     orphan,
+		Detail: "parent 0400000000000000000000000000000000000000000000000000000000000000",
+	})
+
+	// Garbage collection is refused while the dirty table is not empty.
+	_, err = Check(ctx, conn, Options{CollectGarbage: true})
+	require.Error(t, err)
+}
+
+// TestCheckSMT checks the leaves and orphaned nodes of an SMT, with the reachable nodes
+// split in several partitions or not.
+func TestCheckSMT(t *testing.T) {
+	ctx := context.Background()
+	conn, err := embedded.Connect(db.NewConfig(embedded.WithDirectory(t.TempDir())))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Add domains with one certificate each.
+	addDomains := func(names ...string) {
+		ids := make([]common.SHA256Output, len(names))
+		for i, name := range names {
+			ids[i] = common.SHA256Hash32Bytes([]byte(name))
+		}
+		certIDs := make([]common.SHA256Output, len(names))
+		payloads := make([][]byte, len(names))
+		for i, name := range names {
+			payloads[i] = []byte("cert of " + name)
+			certIDs[i] = common.SHA256Hash32Bytes(payloads[i])
+		}
+		expirations := slices.Repeat([]time.Time{time.Now().Add(time.Hour)}, len(names))
+		parents := make([]*common.SHA256Output, len(names))
+		require.NoError(t, conn.UpdateCerts(ctx, certIDs, parents, expirations, payloads, nil))
+		require.NoError(t, conn.UpdateDomains(ctx, ids, names))
+		require.NoError(t, conn.UpdateDomainCerts(ctx, ids, certIDs))
+		require.NoError(t, conn.InsertDomainsIntoDirty(ctx, ids))
+		require.NoError(t, updater.CoalescePayloadsForDirtyDomains(ctx, conn))
+	}
+	var names []string
+	for i := range 20 {
+		names = append(names, fmt.Sprintf("%d.com", i))
+	}
+	addDomains(names...)
+	require.NoError(t, updater.UpdateSMT(ctx, conn))
+	require.NoError(t, conn.CleanupDirty(ctx))
+	// A domain coalesced but not in the SMT, and an orphaned node.
+	addDomains("new.com")
+	require.NoError(t, conn.CleanupDirty(ctx))
+	orphan := common.SHA256Hash32Bytes([]byte("orphan"))
+	_, err = conn.UpdateTreeNodes(ctx, []*db.TreeNodeRecord{{Key: orphan, Value: []byte{1}}})
+	require.NoError(t, err)
+
+	whole, err := Check(ctx, conn, Options{PageSize: 3})
+	require.NoError(t, err)
+	require.Equal(t, uint64(20), whole.Leaves)
+	require.Equal(t, map[Kind]uint64{PayloadNotInSMT: 1, OrphanedTreeNode: 1}, whole.Counts)
+	require.ElementsMatch(t, []Problem{
+		{Kind: PayloadNotInSMT, ID: common.SHA256Hash32Bytes([]byte("new.com"))},
+		{Kind: OrphanedTreeNode, ID: orphan},
+	}, whole.Problems)
+
+	// Collect the garbage with partitions of about two nodes.
+	partitioned, err := Check(ctx, conn, Options{
+		PageSize:          3,
+		MaxReachableNodes: 2,
+		CollectGarbage:    true,
+	})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), partitioned.DeletedNodes)
+	partitioned.DeletedNodes = 0
+	require.Equal(t, whole, partitioned)
+
+	r, err := Check(ctx, conn, Options{MaxReachableNodes: 2})
+	require.NoError(t, err)
+	require.Equal(t, whole.TreeNodes-1, r.TreeNodes)
+	require.Equal(t, map[Kind]uint64{PayloadNotInSMT: 1}, r.Counts)
+}
+
+// fakeConn is an in-memory DB with only certificates and domains.
+type fakeConn struct {
+	noopdb.Conn
+	parents  map[common.SHA256Output]*common.SHA256Output
+	domains  []common.SHA256Output
+	certs    []db.DomainAssociation
+	payloads map[common.SHA256Output][]byte
+	dirty    []common.SHA256Output
+}
+
+func (c *fakeConn) DirtyCount(context.Context) (uint64, error) {
+	return uint64(len(c.dirty)), nil
+}
+
+func (c *fakeConn) CheckDomainsDirty(_ context.Context, ids []common.SHA256Output,
+) ([]bool, error) {
+
+	dirty := make([]bool, len(ids))
+	for i, id := range ids {
+		dirty[i] = slices.Contains(c.dirty, id)
+	}
+	return dirty, nil
+}
+
+func (c *fakeConn) RetrieveCertificateParentsPage(
+	_ context.Context,
+	after *common.SHA256Output,
+	limit int,
+) ([]db.ParentRecord, error) {
+
+	var records []db.ParentRecord
+	for i := byte(0); i < 255 && len(records) < limit; i++ {
+		id := common.SHA256Output{i}
+		parent, ok := c.parents[id]
+		if ok && (after == nil || after[0] < i) {
+			records = append(records, db.ParentRecord{ID: id, ParentID: parent})
+		}
+	}
+	return records, nil
+}
+
+func (c *fakeConn) RetrieveCertificateParents(_ context.Context, ids []common.SHA256Output,
+) ([]db.ParentRecord, error) {
+
+	var records []db.ParentRecord
+	for _, id := range ids {
+		if parent, ok := c.parents[id]; ok {
+			records = append(records, db.ParentRecord{ID: id, ParentID: parent})
+		}
+	}
+	return records, nil
+}
+
+func (c *fakeConn) CheckCertsExist(_ context.Context, ids []common.SHA256Output,
+) ([]bool, error) {
+
+	exist := make([]bool, len(ids))
+	for i, id := range ids {
+		_, exist[i] = c.parents[id]
+	}
+	return exist, nil
+}
+
+func (c *fakeConn) RetrieveDomainsPage(
+	_ context.Context,
+	after *common.SHA256Output,
+	limit int,
+) ([]db.DomainRecord, error) {
+
+	var domains []db.DomainRecord
+	for _, id := range c.domains {
+		if len(domains) < limit && (after == nil || after[0] < id[0]) {
+			domains = append(domains, db.DomainRecord{DomainID: id})
+		}
+	}
+	return domains, nil
+}
+
+func (c *fakeConn) RetrieveDomainAssociations(_ context.Context, ids []common.SHA256Output,
+) ([]db.DomainAssociation, []db.DomainAssociation, error) {
+
+	var certs []db.DomainAssociation
+	for _, id := range ids {
+		for _, a := range c.certs {
+			if a.DomainID == id {
+				certs = append(certs, a)
+			}
+		}
+	}
+	return certs, nil, nil
+}
+
+func (c *fakeConn) RetrieveDomainEntries(_ context.Context, ids []common.SHA256Output,
+) ([]db.DomainEntryRecord, error) {
+
+	var entries []db.DomainEntryRecord
+	for _, id := range ids {
+		if payload, ok := c.payloads[id]; ok {
+			entries = append(entries, db.DomainEntryRecord{DomainID: id, Payload: payload})
+		}
+	}
+	return entries, nil
+}
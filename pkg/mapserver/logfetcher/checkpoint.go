@@ -0,0 +1,130 @@
+package logfetcher
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+
+	ct "github.com/google/certificate-transparency-go"
+	cttls "github.com/google/certificate-transparency-go/tls"
+)
+
+// rfc6962NoteSignatureType is the type of the signatures of the checkpoints of the logs that
+// implement the static-ct-api: an RFC 6962 TreeHeadSignature.
+const rfc6962NoteSignatureType = 0x05
+
+// checkpoint is the signed tree head of a tiled log, as specified in C2SP tlog-checkpoint.
+type checkpoint struct {
+	Origin    string
+	Size      uint64
+	RootHash  [sha256.Size]byte
+	Timestamp uint64 // Milliseconds since the epoch, from the signature.
+}
+
+// noteKeyID returns the ID of the key of the log, as used in the signature lines of its notes.
+func noteKeyID(origin string, publicKeyDER []byte) [4]byte {
+	h := sha256.New()
+	h.Write([]byte(origin))
+	h.Write([]byte{'\n', rfc6962NoteSignatureType})
+	h.Write(publicKeyDER)
+	return [4]byte(h.Sum(nil))
+}
+
+// parseCheckpoint parses the signed note of a checkpoint, and verifies that it is signed by the
+// log with the origin and public key.
+func parseCheckpoint(
+	note []byte,
+	origin string,
+	publicKey crypto.PublicKey,
+	publicKeyDER []byte,
+) (*checkpoint, error) {
+
+	// The text of the note is separated from the signatures by an empty line.
+	i := bytes.Index(note, []byte("\n\n"))
+	if i < 0 {
+		return nil, fmt.Errorf("malformed checkpoint: no signatures")
+	}
+	text, signatures := string(note[:i+1]), string(note[i+2:])
+
+	// Text: origin, size and root hash lines, and optional extension lines.
+	lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	if len(lines) < 3 {
+		return nil, fmt.Errorf("malformed checkpoint: %d lines", len(lines))
+	}
+	if lines[0] != origin {
+		return nil, fmt.Errorf("checkpoint has origin %q instead of %q", lines[0], origin)
+	}
+	size, err := strconv.ParseUint(lines[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("malformed checkpoint size: %w", err)
+	}
+	rootHash, err := base64.StdEncoding.DecodeString(lines[2])
+	if err != nil || len(rootHash) != sha256.Size {
+		return nil, fmt.Errorf("malformed checkpoint root hash %q", lines[2])
+	}
+	cp := &checkpoint{
+		Origin:   origin,
+		Size:     size,
+		RootHash: [sha256.Size]byte(rootHash),
+	}
+
+	// Find the signature of the log.
+	keyID := noteKeyID(origin, publicKeyDER)
+	for _, line := range strings.Split(strings.TrimSuffix(signatures, "\n"), "\n") {
+		fields := strings.Fields(strings.TrimPrefix(line, "— "))
+		if !strings.HasPrefix(line, "— ") || len(fields) != 2 {
+			return nil, fmt.Errorf("malformed checkpoint signature line %q", line)
+		}
+		if fields[0] != origin {
+			continue
+		}
+		sig, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(sig) < 4+8 || [4]byte(sig[:4]) != keyID {
+			continue
+		}
+		cp.Timestamp = binary.BigEndian.Uint64(sig[4:12])
+		if err := verifyCheckpointSignature(cp, sig[12:], publicKey); err != nil {
+			return nil, err
+		}
+		return cp, nil
+	}
+	return nil, fmt.Errorf("checkpoint not signed by the key of %s", origin)
+}
+
+// verifyCheckpointSignature verifies the TLS encoded digitally-signed struct of a checkpoint
+// as the signature of an RFC 6962 tree head.
+func verifyCheckpointSignature(
+	cp *checkpoint,
+	digitallySigned []byte,
+	publicKey crypto.PublicKey,
+) error {
+
+	var sig cttls.DigitallySigned
+	rest, err := cttls.Unmarshal(digitallySigned, &sig)
+	if err != nil {
+		return fmt.Errorf("malformed checkpoint signature: %w", err)
+	}
+	if len(rest) > 0 {
+		return fmt.Errorf("malformed checkpoint signature: %d trailing bytes", len(rest))
+	}
+	verifier, err := ct.NewSignatureVerifier(publicKey)
+	if err != nil {
+		return err
+	}
+	err = verifier.VerifySTHSignature(ct.SignedTreeHead{
+		Version:           ct.V1,
+		TreeSize:          cp.Size,
+		Timestamp:         cp.Timestamp,
+		SHA256RootHash:    ct.SHA256Hash(cp.RootHash),
+		TreeHeadSignature: ct.DigitallySigned(sig),
+	})
+	if err != nil {
+		return fmt.Errorf("invalid checkpoint signature: %w", err)
+	}
+	return nil
+}
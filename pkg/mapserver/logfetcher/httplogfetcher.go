@@ -17,43 +17,36 @@ import (
 
 	"github.com/netsec-ethz/fpki/pkg/common"
 	"github.com/netsec-ethz/fpki/pkg/domain"
+	"github.com/netsec-ethz/fpki/pkg/util"
 )
 
 const defaultServerBatchSize = 128
 const defaultProcessBatchSize = defaultServerBatchSize * 128
 
-const preloadCount = 2 // Number of batches the LogFetcher tries to preload.
-
 // HttpLogFetcher is used to download CT TBS certificates. It has state and keeps some routines
-// downloading certificates in the background, trying to prefetch preloadCount batches.
+// downloading certificates in the background, see rangesFetcher.
 // HttpLogFetcher uses the certificate-transparency-go/client from google to do the heavy lifting.
 // The default size of the server side batch is 128, i.e. the server expects queries in blocks
 // of 128 entries.
+// Failed requests are retried following the RetryPolicy, and the entries that cannot be
+// parsed are sent to the Quarantine and excluded from the batch.
+// The signature of the STH is verified if the public key of the log is set with WithPublicKey.
 // TODO(juagargi) Use lists of CT log servers: check certificate-transparency-go/ctutil/sctcheck
 // or ct/client/ctclient for a full and standard list that may already implement this.
 type HttpLogFetcher struct {
-	url   string
-	start int64 // TODO(juagargi) start & end should go into fetch() and not as part as the type.
-	end   int64
-
-	serverBatchSize  int64 // The server requires queries in blocks of this size.
-	processBatchSize int64 // We unblock NextBatch in batches of this size.
-	ctClient         *client.LogClient
-	chanResults      chan *result
-	stopping         bool // Set to request the LogFetcher to stop fetching.
-
-	// The chanResults channel is used to obtain results from this fetcher. Each call to NextBatch
-	// pulls one full result from the channel into the currentResult variable. And each call
-	// to ReturnNextBatch returns it.
-	currentResult *result // The last result from the batch.
+	rangesFetcher
+	url string
+
+	serverBatchSize int64 // The server requires queries in blocks of this size.
+	ctClient        *client.LogClient
 }
 
-var _ Fetcher = (*HttpLogFetcher)(nil)
+var _ QuarantiningFetcher = (*HttpLogFetcher)(nil)
 
-func NewHttpLogFetcher(url string) (*HttpLogFetcher, error) {
+func NewHttpLogFetcher(url string, options ...FetcherOption) (*HttpLogFetcher, error) {
 	httpClient := &http.Client{
 		Timeout: 10 * time.Second,
-		Transport: &http.Transport{
+		Transport: retryAfterTransport{next: &http.Transport{
 			TLSHandshakeTimeout:   30 * time.Second,
 			ResponseHeaderTimeout: 30 * time.Second,
 			MaxIdleConnsPerHost:   10,
@@ -64,21 +57,25 @@ func NewHttpLogFetcher(url string) (*HttpLogFetcher, error) {
 			TLSClientConfig: &tls.Config{
 				InsecureSkipVerify: true,
 			},
-		},
+		}},
+	}
+	f := &HttpLogFetcher{
+		url: url,
+
+		serverBatchSize: defaultServerBatchSize,
+	}
+	f.init(options, f.newHttpFetchRange)
+
+	opts := jsonclient.Options{
+		UserAgent:    "ct-go-ctclient/1.0",
+		PublicKeyDER: f.publicKeyDER, // The client verifies the STHs if set.
 	}
-	opts := jsonclient.Options{UserAgent: "ct-go-ctclient/1.0"}
-	ctClient, err := client.New(url, httpClient, opts)
+	var err error
+	f.ctClient, err = client.New(url, httpClient, opts)
 	if err != nil {
 		return nil, err
 	}
-	return &HttpLogFetcher{
-		url: url,
-
-		serverBatchSize:  defaultServerBatchSize,
-		processBatchSize: defaultProcessBatchSize,
-		ctClient:         ctClient,
-		chanResults:      nil,
-	}, nil
+	return f, nil
 }
 
 func (f *HttpLogFetcher) Initialize(updateStartTime time.Time) error {
@@ -90,7 +87,12 @@ func (f *HttpLogFetcher) URL() string {
 }
 
 func (f *HttpLogFetcher) GetCurrentState(ctx context.Context, lastState State) (State, error) {
-	sth, err := f.ctClient.GetSTH(ctx)
+	var sth *ct.SignedTreeHead
+	err := f.retryPolicy.do(ctx, "get-sth from "+f.url, func(ctx context.Context) error {
+		var err error
+		sth, err = f.ctClient.GetSTH(ctx)
+		return err
+	})
 	if err != nil {
 		return State{}, err
 	}
@@ -102,152 +104,102 @@ func (f *HttpLogFetcher) GetCurrentState(ctx context.Context, lastState State) (
 	}, nil
 }
 
-// StartFetching will start fetching certificates in the background, so that there is
-// at most two batches ready to be immediately read by NextBatch.
-func (f *HttpLogFetcher) StartFetching(start, end int64) {
-	f.chanResults = make(chan *result, preloadCount)
-	f.stopping = false
-	f.start = start
-	f.end = end
-	go f.fetch()
-}
-
-func (f *HttpLogFetcher) StopFetching() {
-	f.stopping = true
+// newHttpFetchRange returns a function that downloads the entries [start,end] and parses them
+// into certificates and chains. The entries that cannot be parsed are quarantined, and counted
+// as quarantined.
+func (f *HttpLogFetcher) newHttpFetchRange() fetchRangeFunc {
+	leafEntries := make([]ct.LeafEntry, f.processBatchSize) // Created once, reused.
+	return func(start, end int64) *result {
+		return f.fetchRange(leafEntries, start, end)
+	}
 }
 
-// NextBatch returns true if there is a next batch to be retrieved, or error, I.e. if the call to
-// ReturnNextBatch will return something other than nil, nil, nil.
-func (f *HttpLogFetcher) NextBatch(ctx context.Context) bool {
-	f.currentResult = &result{}
-	var ok bool
-	select {
-	case <-ctx.Done():
-		f.currentResult.err = ctx.Err()
-	case f.currentResult, ok = <-f.chanResults:
-		// Only in case that there is no error AND no data should we return false:
-		if !ok ||
-			f.currentResult.err == nil &&
-				len(f.currentResult.certs) == 0 &&
-				len(f.currentResult.chains) == 0 &&
-				f.currentResult.expired == 0 {
-			// If no  error and no data, return false
-			return false // do not attempt to get result
+func (f *HttpLogFetcher) fetchRange(leafEntries []ct.LeafEntry, start, end int64) *result {
+	n, err := f.getRawEntriesInBatches(leafEntries, start, end)
+	if err != nil {
+		return &result{err: err}
+	}
+	if f.stopping.Load() {
+		// The entries may be incomplete, and are not sent anyway.
+		return &result{}
+	}
+	res := &result{
+		certs:  make([]ctx509.Certificate, 0, n),
+		chains: make([][]*ctx509.Certificate, 0, n),
+	}
+	// Parse each entry to certificates and chains.
+	for i := range leafEntries[:n] {
+		index := start + int64(i)
+		cert, chain, err := parseLeafEntry(index, &leafEntries[i])
+		if err != nil {
+			err = f.quarantineEntry(f.url, index, err,
+				leafEntries[i].LeafInput, leafEntries[i].ExtraData)
+			if err != nil {
+				return &result{err: err}
+			}
+			res.quarantined++
+			continue
 		}
+		res.certs = append(res.certs, *cert)
+		res.chains = append(res.chains, chain)
 	}
-	return true
+	return res
 }
 
-// ReturnNextBatch returns the next batch of certificates as if it were a channel.
-// The call blocks until a whole batch is available. The last batch may have less elements.
-// Returns nil when there is no more batches, i.e. all certificates have been fetched.
-func (f *HttpLogFetcher) ReturnNextBatch() (
-	certs []ctx509.Certificate,
-	chains [][]*ctx509.Certificate,
-	excluded int,
-	err error) {
-
-	return f.currentResult.certs, f.currentResult.chains, f.currentResult.expired, f.currentResult.err
-}
+// parseLeafEntry parses the certificate and chain of the entry of the log at index.
+func parseLeafEntry(index int64, leaf *ct.LeafEntry) (
+	*ctx509.Certificate, []*ctx509.Certificate, error) {
 
-// FetchAllCertificates will block until all certificates and chains [start,end] have been fetched.
-func (f *HttpLogFetcher) FetchAllCertificates(
-	ctx context.Context,
-	start,
-	end int64,
-) (
-	certs []ctx509.Certificate,
-	chains [][]*ctx509.Certificate,
-	excluded uint64,
-	err error,
-) {
-
-	f.StartFetching(start, end)
-	certs = make([]ctx509.Certificate, 0, end-start+1)
-	chains = make([][]*ctx509.Certificate, 0, end-start+1)
-	for f.NextBatch(ctx) {
-		bCerts, bChains, bExcluded, bErr := f.ReturnNextBatch()
-		if bErr != nil {
-			err = bErr
-			return
-		}
-		if len(bCerts) == 0 {
-			break
+	raw, err := ct.RawLogEntryFromLeaf(index, leaf)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Certificate.
+	cert, err := ctx509.ParseCertificate(raw.Cert.Data)
+	// Accept the same certificates as CT logs, i.e., don't be too restrictive in terms of
+	// which certificates to reject (i.e., allow for non-fatal parsing/validation errors)
+	if ctx509.IsFatal(err) {
+		return nil, nil, fmt.Errorf("parsing certificate: %w", err)
+	}
+	// Chain.
+	chain := make([]*ctx509.Certificate, len(raw.Chain))
+	for j, c := range raw.Chain {
+		chain[j], err = ctx509.ParseCertificate(c.Data)
+		if ctx509.IsFatal(err) {
+			return nil, nil, fmt.Errorf("parsing chain certificate %d: %w", j, err)
 		}
-		certs = append(certs, bCerts...)
-		chains = append(chains, bChains...)
-		excluded += uint64(bExcluded)
 	}
-	f.StopFetching()
-	return
+	if err := checkEntryType(raw.Leaf.TimestampedEntry, cert, chain); err != nil {
+		return nil, nil, err
+	}
+	return cert, chain, nil
 }
 
-func (f *HttpLogFetcher) fetch() {
-	defer close(f.chanResults)
-
-	if f.start > f.end {
-		return
+// checkEntryType checks that the certificate of a precertificate entry is a precertificate
+// issued by the key of the entry, and that the one of an X.509 entry is not.
+// The certificate of a precertificate entry is the precertificate, which is stored as such,
+// and not the final certificate, which is not in the entry.
+func checkEntryType(
+	entry *ct.TimestampedEntry,
+	cert *ctx509.Certificate,
+	chain []*ctx509.Certificate,
+) error {
+
+	if util.CertificateEntryType(cert) != entry.EntryType {
+		return fmt.Errorf("certificate of type %s in %s entry",
+			util.CertificateEntryType(cert), entry.EntryType)
 	}
-	// Taking into account the batchSize, compute the # of calls to getEntriesInBatches.
-	// It calls count-1 times with the batchSize, and 1 time with the remainder.
-	count := 1 + (f.end-f.start)/f.processBatchSize
-
-	leafEntries := make([]ct.LeafEntry, f.processBatchSize)
-	for i := int64(0); i < count; i++ {
-		start := f.start + i*f.processBatchSize
-		end := min(f.end, start+f.processBatchSize-1)
-		n, err := f.getRawEntriesInBatches(leafEntries, start, end)
-		if err != nil {
-			f.chanResults <- &result{
-				err: err,
-			}
-			return // Don't continue processing when errors.
-		}
-		if f.stopping {
-			f.stopping = false // We are handling the stop now.
-			return
-		}
-		certEntries := make([]ctx509.Certificate, n)
-		chainEntries := make([][]*ctx509.Certificate, n)
-		// Parse each entry to certificates and chains.
-		for i, leaf := range leafEntries[:n] {
-			index := start + int64(i)
-			raw, err := ct.RawLogEntryFromLeaf(index, &leaf)
-			if err != nil {
-				f.chanResults <- &result{
-					err: err,
-				}
-				return
-			}
-			// Certificate.
-			cert, err := ctx509.ParseCertificate(raw.Cert.Data)
-			// Accept the same certificates as CT logs, i.e., don't be too restrictive in terms of
-			// which certificates to reject (i.e., allow for non-fatal parsing/validation errors)
-			if ctx509.IsFatal(err) {
-				f.chanResults <- &result{
-					err: err,
-				}
-				return
-			}
-			certEntries[i] = *cert
-			// Chain.
-			chainEntries[i] = make([]*ctx509.Certificate, len(raw.Chain))
-			for j, c := range raw.Chain {
-				chainEntries[i][j], err = ctx509.ParseCertificate(c.Data)
-				if err != nil {
-					f.chanResults <- &result{
-						err: err,
-					}
-					return
-				}
-			}
-		}
-		// Send the result.
-		f.chanResults <- &result{
-			certs:  certEntries,
-			chains: chainEntries,
-		}
+	if entry.EntryType != ct.PrecertLogEntryType {
+		return nil
 	}
+	issuerKeyHash, err := util.PrecertIssuerKeyHash(chain)
+	if err != nil {
+		return err
+	}
+	if issuerKeyHash != entry.PrecertEntry.IssuerKeyHash {
+		return fmt.Errorf("precertificate chain does not match the issuer key hash")
+	}
+	return nil
 }
 
 // streamRawEntries fetches certificates from CT log using getCerts.
@@ -255,6 +207,8 @@ func (f *HttpLogFetcher) fetch() {
 // serverBatchSize.
 // streamRawEntries will download end - start + 1 certificates,
 // starting at start, and finishing with end.
+// It returns the number of entries retrieved, counted from start, which is less than all of
+// them if stopping.
 func (f *HttpLogFetcher) getRawEntriesInBatches(leafEntries []ct.LeafEntry, start, end int64) (
 	int64, error) {
 
@@ -264,7 +218,7 @@ func (f *HttpLogFetcher) getRawEntriesInBatches(leafEntries []ct.LeafEntry, star
 	// TODO(juagargi) should we align the calls to serverBatchSize
 	batchCount := (end - start + 1) / f.serverBatchSize
 
-	if f.stopping {
+	if f.stopping.Load() {
 		return 0, nil
 	}
 	// Do batches.
@@ -277,7 +231,7 @@ func (f *HttpLogFetcher) getRawEntriesInBatches(leafEntries []ct.LeafEntry, star
 		if err != nil {
 			return i * f.serverBatchSize, err
 		}
-		if f.stopping {
+		if f.stopping.Load() {
 			return i*f.serverBatchSize + n, nil
 		}
 		assert(n == f.serverBatchSize, "bad size in getRawEntriesInBatches")
@@ -293,8 +247,8 @@ func (f *HttpLogFetcher) getRawEntriesInBatches(leafEntries []ct.LeafEntry, star
 		if err != nil {
 			return batchCount * f.serverBatchSize, err
 		}
-		if f.stopping {
-			return remStart + n, nil
+		if f.stopping.Load() {
+			return batchCount*f.serverBatchSize + n, nil
 		}
 		assert(n == remEnd-remStart+1, "bad remainder size in getRawEntriesInBatches")
 	}
@@ -316,12 +270,29 @@ func (f *HttpLogFetcher) getRawEntries(
 	_ = leafEntries[end-start] // Fail early if the slice is too small.
 
 	for offset := int64(0); offset < end-start+1; {
-		if f.stopping {
+		if f.stopping.Load() {
 			// Requested to stop
 			return 0, nil
 		}
-		rsp, err := f.ctClient.GetRawEntries(context.Background(), start+offset, end)
+		var rsp *ct.GetEntriesResponse
+		err := f.retryPolicy.do(f.fetchCtx, "get-entries from "+f.url,
+			func(ctx context.Context) error {
+				var err error
+				rsp, err = f.ctClient.GetRawEntries(ctx, start+offset, end)
+				if err == nil && len(rsp.Entries) == 0 {
+					// Malformed response: retry it instead of looping forever.
+					err = jsonclient.RspError{
+						Err:        fmt.Errorf("no entries in response"),
+						StatusCode: http.StatusOK,
+					}
+				}
+				return err
+			})
 		if err != nil {
+			if f.stopping.Load() {
+				// The request was canceled by the stop.
+				return 0, nil
+			}
 			return offset, err
 		}
 		for i := int64(0); i < int64(len(rsp.Entries)); i++ {
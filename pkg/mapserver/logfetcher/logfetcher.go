@@ -20,6 +20,15 @@ type Fetcher interface {
 	ReturnNextBatch() ([]ctx509.Certificate, [][]*ctx509.Certificate, int, error)
 }
 
+// QuarantiningFetcher is a Fetcher that quarantines the entries it cannot parse. These entries
+// are excluded from the batches, and counted as excluded by ReturnNextBatch.
+type QuarantiningFetcher interface {
+	Fetcher
+	// Quarantined returns how many of the entries excluded from the last batch returned by
+	// ReturnNextBatch were quarantined.
+	Quarantined() int
+}
+
 // State represents the state of a log (in a server) at a given point in time.
 // The time point is represented by the Size (logs are append-only).
 type State struct {
@@ -28,8 +37,9 @@ type State struct {
 }
 
 type result struct {
-	certs   []ctx509.Certificate
-	chains  [][]*ctx509.Certificate
-	expired int
-	err     error
+	certs       []ctx509.Certificate
+	chains      [][]*ctx509.Certificate
+	expired     int // Excluded entries: expired.
+	quarantined int // Excluded entries: quarantined, as they could not be parsed.
+	err         error
 }
@@ -3,8 +3,16 @@ package logfetcher
 import (
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
+	"math/rand"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -13,8 +21,11 @@ import (
 	ct "github.com/google/certificate-transparency-go"
 	"github.com/google/certificate-transparency-go/client"
 	"github.com/google/certificate-transparency-go/jsonclient"
+	cttls "github.com/google/certificate-transparency-go/tls"
 	ctx509 "github.com/google/certificate-transparency-go/x509"
+	"github.com/netsec-ethz/fpki/pkg/common"
 	"github.com/netsec-ethz/fpki/pkg/tests"
+	"github.com/netsec-ethz/fpki/pkg/tests/random"
 	"github.com/netsec-ethz/fpki/pkg/util"
 )
 
@@ -261,6 +272,246 @@ func TestLogFetcher(t *testing.T) {
 	}
 }
 
+// TestParallelLogFetcher checks that the batches downloaded concurrently from a local CT log
+// server, which answers with random delays, are returned in order.
+func TestParallelLogFetcher(t *testing.T) {
+	leaves, entries := buildTestLogEntries(t, 300)
+	var requests atomic.Int64
+	server := newTestCTServer(t, entries, 5, &requests, nil)
+	t.Cleanup(server.Close)
+
+	cases := map[string]struct {
+		start         int64
+		end           int64
+		rangeFetchers int
+	}{
+		"empty": {
+			start:         10,
+			end:           10 - 1,
+			rangeFetchers: 4,
+		},
+		"1": {
+			start:         10,
+			end:           10,
+			rangeFetchers: 4,
+		},
+		"all_1": {
+			start:         0,
+			end:           299,
+			rangeFetchers: 1,
+		},
+		"all_4": {
+			start:         0,
+			end:           299,
+			rangeFetchers: 4,
+		},
+		"middle_16": {
+			start:         17,
+			end:           250,
+			rangeFetchers: 16,
+		},
+	}
+	for name, tc := range cases {
+		name, tc := name, tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx, cancelF := context.WithTimeout(context.Background(), 20*time.Second)
+			defer cancelF()
+			f, err := NewHttpLogFetcher(server.URL, WithRangeFetchers(tc.rangeFetchers))
+			require.NoError(t, err)
+			f.serverBatchSize = 8
+			f.processBatchSize = 32
+
+			certs, chains, _, err := f.FetchAllCertificates(ctx, tc.start, tc.end)
+			require.NoError(t, err)
+			require.Len(t, certs, int(tc.end-tc.start+1))
+			require.Len(t, chains, int(tc.end-tc.start+1))
+			for i := range certs {
+				require.Equal(t, leaves[tc.start+int64(i)].Raw, certs[i].Raw, "at %d", i)
+				require.Len(t, chains[i], 1)
+			}
+		})
+	}
+}
+
+// TestStopParallelLogFetcher checks that stopping the fetcher ends its pipeline, while the
+// range fetchers are blocked by batches not consumed.
+func TestStopParallelLogFetcher(t *testing.T) {
+	ctx, cancelF := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancelF()
+
+	_, entries := buildTestLogEntries(t, 300)
+	var requests atomic.Int64
+	server := newTestCTServer(t, entries, 8, &requests, nil)
+	defer server.Close()
+
+	f, err := NewHttpLogFetcher(server.URL, WithRangeFetchers(2))
+	require.NoError(t, err)
+	f.serverBatchSize = 8
+	f.processBatchSize = 8
+	f.StartFetching(0, 299)
+
+	require.True(t, f.NextBatch(ctx))
+	_, _, _, err = f.ReturnNextBatch()
+	require.NoError(t, err)
+
+	// Without consuming, the fetcher downloads at most the window of 2*rangeFetchers batches
+	// and preloadCount ready ones, besides the one returned.
+	time.Sleep(200 * time.Millisecond)
+	require.LessOrEqual(t, requests.Load(), int64(1+preloadCount+2*2))
+
+	f.StopFetching()
+	for f.NextBatch(ctx) {
+		_, _, _, err = f.ReturnNextBatch()
+		require.NoError(t, err)
+	}
+	require.NoError(t, ctx.Err())
+}
+
+// TestStopDuringFetch checks that stopping the fetcher while a request is in flight returns an
+// empty result, without quarantining the entries of the interrupted batch, whether the batch
+// is a remainder of the server batch size or was partially downloaded.
+func TestStopDuringFetch(t *testing.T) {
+	_, entries := buildTestLogEntries(t, 300)
+	cases := map[string]struct {
+		start, end int64
+		served     int64 // Requests served before blocking.
+	}{
+		"remainder": {
+			start: 100_000,
+			end:   100_010,
+		},
+		"partial_batch": {
+			start:  0,
+			end:    39,
+			served: 1,
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			ctx, cancelF := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancelF()
+
+			blocked := make(chan struct{}, 1)
+			var requests atomic.Int64
+			server := newTestCTServer(t, entries, 8, &requests,
+				func(w http.ResponseWriter, request int64) bool {
+					if request <= tc.served {
+						return false
+					}
+					select {
+					case blocked <- struct{}{}:
+					default:
+					}
+					<-ctx.Done() // Until the test ends.
+					return true
+				})
+			defer server.Close()
+			defer cancelF() // Unblock the server before closing it.
+
+			filename := filepath.Join(t.TempDir(), "quarantine.jsonl")
+			q, err := OpenQuarantineFile(filename)
+			require.NoError(t, err)
+
+			f, err := NewHttpLogFetcher(server.URL, WithQuarantine(q))
+			require.NoError(t, err)
+			f.serverBatchSize = 8
+			f.processBatchSize = 64
+
+			// Fetch the range as a range fetcher of the pipeline does.
+			f.fetchCtx, f.cancelFetch = context.WithCancel(ctx)
+			fetchRange := f.newHttpFetchRange()
+			results := make(chan *result)
+			go func() {
+				results <- fetchRange(tc.start, tc.end)
+			}()
+			<-blocked
+			f.StopFetching()
+			require.Equal(t, &result{}, <-results)
+			require.NoError(t, q.Close())
+
+			file, err := os.Open(filename)
+			require.NoError(t, err)
+			defer file.Close()
+			quarantined, err := ReadQuarantine(file)
+			require.NoError(t, err)
+			require.Empty(t, quarantined)
+		})
+	}
+}
+
+// buildTestLogEntries creates n entries with a random leaf certificate and a chain of one
+// random certificate, as returned by get-entries.
+func buildTestLogEntries(t tests.T, n int) ([]ctx509.Certificate, []ct.LeafEntry) {
+	leaves := make([]ctx509.Certificate, n)
+	entries := make([]ct.LeafEntry, n)
+	issuer := random.RandomX509Cert(t, "issuer.com")
+	extraData, err := cttls.Marshal(ct.CertificateChain{
+		Entries: []ct.ASN1Cert{{Data: issuer.Raw}},
+	})
+	require.NoError(t, err)
+	for i := range leaves {
+		leaves[i] = random.RandomX509Cert(t, fmt.Sprintf("leaf-%d.com", i))
+		leafInput, err := cttls.Marshal(ct.MerkleTreeLeaf{
+			Version:  ct.V1,
+			LeafType: ct.TimestampedEntryLeafType,
+			TimestampedEntry: &ct.TimestampedEntry{
+				Timestamp: uint64(i),
+				EntryType: ct.X509LogEntryType,
+				X509Entry: &ct.ASN1Cert{Data: leaves[i].Raw},
+			},
+		})
+		require.NoError(t, err)
+		entries[i] = ct.LeafEntry{
+			LeafInput: leafInput,
+			ExtraData: extraData,
+		}
+	}
+	return leaves, entries
+}
+
+// newTestCTServer serves the entries with get-entries, at most maxEntries per response and
+// after a random delay. It counts the requests. If fault is not nil, it is called with the
+// number of the request, and if it returns true, it has written the response instead.
+func newTestCTServer(
+	t tests.T,
+	entries []ct.LeafEntry,
+	maxEntries int64,
+	requests *atomic.Int64,
+	fault func(w http.ResponseWriter, request int64) bool,
+) *httptest.Server {
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := requests.Add(1)
+		if fault != nil && fault(w, request) {
+			return
+		}
+		if !strings.HasSuffix(r.URL.Path, ct.GetEntriesPath) {
+			http.NotFound(w, r)
+			return
+		}
+		start, err := strconv.ParseInt(r.URL.Query().Get("start"), 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		end, err := strconv.ParseInt(r.URL.Query().Get("end"), 10, 64)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		end = min(end, start+maxEntries-1, int64(len(entries))-1)
+
+		time.Sleep(time.Duration(rand.Intn(5)) * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(ct.GetEntriesResponse{
+			Entries: entries[start : end+1],
+		})
+		require.NoError(t, err)
+	}))
+}
+
 func TestTimeoutLogFetcher(t *testing.T) {
 	ctx, cancelF := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancelF()
@@ -347,3 +598,100 @@ func TestGetSize(t *testing.T) {
 	_, err = ctClient.GetRawEntries(ctx, int64(s.Size), int64(s.Size))
 	require.Error(t, err)
 }
+
+// TestVerifySTH checks that the signature of the STH is verified with the key of the log.
+func TestVerifySTH(t *testing.T) {
+	ctx, cancelF := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelF()
+
+	key := newTestLogKey(t)
+	sth := ct.SignedTreeHead{
+		Version:   ct.V1,
+		TreeSize:  42,
+		Timestamp: uint64(time.Now().UnixMilli()),
+	}
+	input, err := ct.SerializeSTHSignatureInput(sth)
+	require.NoError(t, err)
+	digitallySigned, err := cttls.CreateSignature(*key, cttls.SHA256, input)
+	require.NoError(t, err)
+	signature, err := cttls.Marshal(digitallySigned)
+	require.NoError(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, ct.GetSTHPath) {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(ct.GetSTHResponse{
+			TreeSize:          sth.TreeSize,
+			Timestamp:         sth.Timestamp,
+			SHA256RootHash:    sth.SHA256RootHash[:],
+			TreeHeadSignature: signature,
+		})
+		require.NoError(t, err)
+	}))
+	defer server.Close()
+
+	// Correct key.
+	f, err := NewHttpLogFetcher(server.URL, WithPublicKey(marshalTestPublicKey(t, key)))
+	require.NoError(t, err)
+	state, err := f.GetCurrentState(ctx, State{})
+	require.NoError(t, err)
+	require.Equal(t, sth.TreeSize, state.Size)
+
+	// Another key.
+	f, err = NewHttpLogFetcher(server.URL,
+		WithPublicKey(marshalTestPublicKey(t, newTestLogKey(t))),
+		WithRetryPolicy(RetryPolicy{}),
+	)
+	require.NoError(t, err)
+	_, err = f.GetCurrentState(ctx, State{})
+	require.Error(t, err)
+}
+
+// TestParseLeafEntry checks that precertificate entries are parsed to their precertificate,
+// and that entries whose certificate does not match their type are rejected.
+func TestParseLeafEntry(t *testing.T) {
+	issuer := random.RandomX509Cert(t, "issuer.com")
+	parsedIssuer, err := ctx509.ParseCertificate(issuer.Raw)
+	require.NoError(t, err)
+	precert, final := random.RandomX509Precert(t, "leaf.com")
+
+	newPrecertEntry := func(cert ctx509.Certificate, issuerKeyHash [32]byte) *ct.LeafEntry {
+		leafInput, err := cttls.Marshal(ct.MerkleTreeLeaf{
+			Version:  ct.V1,
+			LeafType: ct.TimestampedEntryLeafType,
+			TimestampedEntry: &ct.TimestampedEntry{
+				EntryType: ct.PrecertLogEntryType,
+				PrecertEntry: &ct.PreCert{
+					IssuerKeyHash:  issuerKeyHash,
+					TBSCertificate: cert.RawTBSCertificate,
+				},
+			},
+		})
+		require.NoError(t, err)
+		extraData, err := cttls.Marshal(ct.PrecertChainEntry{
+			PreCertificate:   ct.ASN1Cert{Data: cert.Raw},
+			CertificateChain: []ct.ASN1Cert{{Data: issuer.Raw}},
+		})
+		require.NoError(t, err)
+		return &ct.LeafEntry{LeafInput: leafInput, ExtraData: extraData}
+	}
+	issuerKeyHash := common.SHA256Hash32Bytes(parsedIssuer.RawSubjectPublicKeyInfo)
+
+	cert, chain, err := parseLeafEntry(0, newPrecertEntry(precert, issuerKeyHash))
+	require.NoError(t, err)
+	require.Equal(t, precert.Raw, cert.Raw)
+	require.True(t, cert.IsPrecertificate())
+	require.Len(t, chain, 1)
+	require.Equal(t, issuer.Raw, chain[0].Raw)
+
+	// Another issuer key hash.
+	_, _, err = parseLeafEntry(0, newPrecertEntry(precert, [32]byte{}))
+	require.Error(t, err)
+
+	// Not a precertificate.
+	_, _, err = parseLeafEntry(0, newPrecertEntry(final, issuerKeyHash))
+	require.Error(t, err)
+}
@@ -0,0 +1,85 @@
+package logfetcher
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/netsec-ethz/fpki/pkg/util"
+)
+
+// Quarantine keeps the entries of CT logs that cannot be parsed, instead of failing the batch
+// they belong to. The entries are written one JSON object per line, with their index in the
+// log, so that they can be inspected and reprocessed later.
+// A Quarantine can be used concurrently by several fetchers.
+type Quarantine struct {
+	w *util.JSONLinesWriter // If nil, only a summary of the entries is written to summary.
+
+	summaryMu sync.Mutex
+	summary   io.Writer
+}
+
+// QuarantinedEntry is an entry of a CT log that could not be parsed.
+type QuarantinedEntry struct {
+	URL       string    `json:"url"`
+	Index     int64     `json:"index"`
+	Error     string    `json:"error"`
+	LeafInput []byte    `json:"leaf_input"`
+	ExtraData []byte    `json:"extra_data"`
+	Time      time.Time `json:"time"`
+}
+
+// NewQuarantine creates a quarantine that writes its entries to w.
+func NewQuarantine(w io.Writer) *Quarantine {
+	return &Quarantine{
+		w: util.NewJSONLinesWriter(w),
+	}
+}
+
+// NewQuarantineSummary creates a quarantine that only writes a line with the URL, index and
+// error of each entry to w. The entries themselves are not kept.
+func NewQuarantineSummary(w io.Writer) *Quarantine {
+	return &Quarantine{
+		summary: w,
+	}
+}
+
+// OpenQuarantineFile creates a quarantine that appends its entries to the file.
+func OpenQuarantineFile(filename string) (*Quarantine, error) {
+	w, err := util.OpenJSONLinesFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("opening quarantine file: %w", err)
+	}
+	return &Quarantine{
+		w: w,
+	}, nil
+}
+
+// Add writes the entry to the quarantine.
+func (q *Quarantine) Add(entry QuarantinedEntry) error {
+	if q.w == nil {
+		q.summaryMu.Lock()
+		defer q.summaryMu.Unlock()
+		_, err := fmt.Fprintf(q.summary, "quarantined entry %d of %s: %s\n",
+			entry.Index, entry.URL, entry.Error)
+		return err
+	}
+	if err := q.w.Write(entry); err != nil {
+		return fmt.Errorf("quarantining entry %d of %s: %w", entry.Index, entry.URL, err)
+	}
+	return nil
+}
+
+// Close closes the file of the quarantine, if it was opened with OpenQuarantineFile.
+func (q *Quarantine) Close() error {
+	if q.w == nil {
+		return nil
+	}
+	return q.w.Close()
+}
+
+// ReadQuarantine reads the entries written to a quarantine.
+func ReadQuarantine(r io.Reader) ([]QuarantinedEntry, error) {
+	return util.ReadJSONLines[QuarantinedEntry](r)
+}
@@ -0,0 +1,94 @@
+package logfetcher
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ct "github.com/google/certificate-transparency-go"
+	cttls "github.com/google/certificate-transparency-go/tls"
+	"github.com/stretchr/testify/require"
+)
+
+// TestQuarantineLogFetcher checks that the entries that cannot be parsed are quarantined with
+// their index, and excluded from the batch instead of failing it.
+func TestQuarantineLogFetcher(t *testing.T) {
+	ctx, cancelF := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelF()
+
+	leaves, entries := buildTestLogEntries(t, 100)
+	// Entry 5 has a bad leaf, entry 17 a bad certificate in its chain.
+	entries[5].LeafInput = []byte{1, 2, 3}
+	badChain, err := cttls.Marshal(ct.CertificateChain{
+		Entries: []ct.ASN1Cert{{Data: []byte("not a certificate")}},
+	})
+	require.NoError(t, err)
+	entries[17].ExtraData = badChain
+
+	var requests atomic.Int64
+	server := newTestCTServer(t, entries, 10, &requests, nil)
+	defer server.Close()
+
+	filename := filepath.Join(t.TempDir(), "quarantine.jsonl")
+	q, err := OpenQuarantineFile(filename)
+	require.NoError(t, err)
+
+	f, err := NewHttpLogFetcher(server.URL, WithQuarantine(q))
+	require.NoError(t, err)
+	f.serverBatchSize = 10
+	f.processBatchSize = 20
+
+	certs, chains, excluded, err := f.FetchAllCertificates(ctx, 0, 99)
+	require.NoError(t, err)
+	require.NoError(t, q.Close())
+	require.Equal(t, uint64(2), excluded)
+	require.Len(t, certs, 98)
+	require.Len(t, chains, 98)
+	// The remaining certificates keep their order.
+	expected := append(append(leaves[:5:5], leaves[6:17]...), leaves[18:]...)
+	for i := range certs {
+		require.Equal(t, expected[i].Raw, certs[i].Raw)
+	}
+
+	// Check the quarantine file.
+	file, err := os.Open(filename)
+	require.NoError(t, err)
+	defer file.Close()
+	quarantined, err := ReadQuarantine(file)
+	require.NoError(t, err)
+	require.Len(t, quarantined, 2)
+	require.Equal(t, int64(5), quarantined[0].Index)
+	require.Equal(t, int64(17), quarantined[1].Index)
+	for i, index := range []int{5, 17} {
+		require.Equal(t, server.URL, quarantined[i].URL)
+		require.NotEmpty(t, quarantined[i].Error)
+		require.Equal(t, entries[index].LeafInput, quarantined[i].LeafInput)
+		require.Equal(t, entries[index].ExtraData, quarantined[i].ExtraData)
+	}
+
+	// The excluded entries of each batch are counted as quarantined, not expired.
+	// A summary quarantine only writes a line per entry.
+	var summary strings.Builder
+	f, err = NewHttpLogFetcher(server.URL, WithQuarantine(NewQuarantineSummary(&summary)))
+	require.NoError(t, err)
+	f.serverBatchSize = 10
+	f.processBatchSize = 20
+	f.StartFetching(0, 99)
+	defer f.StopFetching()
+	quarantinedCount := 0
+	for f.NextBatch(ctx) {
+		_, _, excluded, err := f.ReturnNextBatch()
+		require.NoError(t, err)
+		require.Equal(t, excluded, f.Quarantined())
+		quarantinedCount += f.Quarantined()
+	}
+	require.Equal(t, 2, quarantinedCount)
+	lines := strings.Split(strings.TrimSuffix(summary.String(), "\n"), "\n")
+	require.Len(t, lines, 2)
+	require.Contains(t, lines[0], "entry 5 of "+server.URL+": ")
+	require.Contains(t, lines[1], "entry 17 of "+server.URL+": ")
+}
@@ -0,0 +1,371 @@
+package logfetcher
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	ctx509 "github.com/google/certificate-transparency-go/x509"
+
+	pip "github.com/netsec-ethz/fpki/pkg/pipeline"
+)
+
+const preloadCount = 2 // Number of batches the LogFetcher tries to preload.
+
+const defaultRangeFetchers = 4 // Number of batches downloaded concurrently.
+
+// fetcherSettings are the settings of the fetchers of remote logs.
+type fetcherSettings struct {
+	processBatchSize int64 // We unblock NextBatch in batches of this size.
+	rangeFetchers    int   // Number of batches downloaded concurrently.
+	retryPolicy      RetryPolicy
+	quarantine       *Quarantine
+	publicKeyDER     []byte // If not nil, the signature of the tree heads is verified.
+}
+
+func defaultFetcherSettings() fetcherSettings {
+	return fetcherSettings{
+		processBatchSize: defaultProcessBatchSize,
+		rangeFetchers:    defaultRangeFetchers,
+		retryPolicy:      DefaultRetryPolicy,
+		quarantine:       NewQuarantineSummary(os.Stderr),
+	}
+}
+
+// FetcherOption configures the fetchers of remote logs.
+type FetcherOption func(*fetcherSettings)
+
+// WithRangeFetchers sets the number of batches that are downloaded concurrently.
+func WithRangeFetchers(n int) FetcherOption {
+	return func(f *fetcherSettings) {
+		f.rangeFetchers = max(1, n)
+	}
+}
+
+// WithRetryPolicy sets how the failed requests are retried. DefaultRetryPolicy is used if not
+// specified.
+func WithRetryPolicy(policy RetryPolicy) FetcherOption {
+	return func(f *fetcherSettings) {
+		f.retryPolicy = policy
+	}
+}
+
+// WithQuarantine sets where the entries that cannot be parsed are kept. By default they are
+// not kept, and only their URL, index and error are written to the standard error.
+func WithQuarantine(q *Quarantine) FetcherOption {
+	return func(f *fetcherSettings) {
+		f.quarantine = q
+	}
+}
+
+// WithPublicKey sets the DER encoded public key of the log, to verify the signature of its tree
+// heads. Without it, they are not verified.
+func WithPublicKey(der []byte) FetcherOption {
+	return func(f *fetcherSettings) {
+		f.publicKeyDER = der
+	}
+}
+
+// fetchRangeFunc downloads the entries [start,end] of a log and parses them into certificates
+// and chains.
+type fetchRangeFunc func(start, end int64) *result
+
+// rangesFetcher implements the fetching part of the Fetcher interface for remote logs. It keeps
+// some routines downloading certificates in the background, trying to prefetch preloadCount
+// batches.
+// The batches are downloaded by rangeFetchers concurrent stages of a pipeline, and returned
+// in order of their indices. At most 2*rangeFetchers batches are being downloaded or waiting
+// for their predecessors, plus preloadCount batches ready: when NextBatch is not called, the
+// pipeline blocks.
+type rangesFetcher struct {
+	fetcherSettings
+	newFetchRange func() fetchRangeFunc // Creates the function of each range fetcher.
+
+	start       int64 // TODO(juagargi) start & end should go into fetch() and not as part as the type.
+	end         int64
+	chanResults chan *result
+	stopping    atomic.Bool        // Set to request the LogFetcher to stop fetching.
+	fetchCtx    context.Context    // Canceled when stopping.
+	cancelFetch context.CancelFunc // Cancels fetchCtx.
+
+	// The chanResults channel is used to obtain results from this fetcher. Each call to NextBatch
+	// pulls one full result from the channel into the currentResult variable. And each call
+	// to ReturnNextBatch returns it.
+	currentResult *result // The last result from the batch.
+}
+
+// init sets the default settings modified by the options, and the creator of the functions of
+// the range fetchers.
+func (f *rangesFetcher) init(options []FetcherOption, newFetchRange func() fetchRangeFunc) {
+	f.fetcherSettings = defaultFetcherSettings()
+	for _, opt := range options {
+		opt(&f.fetcherSettings)
+	}
+	f.newFetchRange = newFetchRange
+	f.fetchCtx = context.Background()
+}
+
+// quarantineEntry adds the entry of the log at index, which could not be parsed, to the
+// quarantine.
+func (f *rangesFetcher) quarantineEntry(
+	url string,
+	index int64,
+	err error,
+	leafInput []byte,
+	extraData []byte,
+) error {
+
+	return f.quarantine.Add(QuarantinedEntry{
+		URL:       url,
+		Index:     index,
+		Error:     err.Error(),
+		LeafInput: leafInput,
+		ExtraData: extraData,
+		Time:      time.Now(),
+	})
+}
+
+// entryRange is the batch of log entries [start,end] that a range fetcher downloads.
+type entryRange struct {
+	index int // Order of the batch in the fetch.
+	start int64
+	end   int64
+}
+
+// rangeResult is the result of downloading the entryRange with the same index.
+type rangeResult struct {
+	index int
+	res   *result
+}
+
+// StartFetching will start fetching certificates in the background, so that there is
+// at most two batches ready to be immediately read by NextBatch.
+func (f *rangesFetcher) StartFetching(start, end int64) {
+	f.chanResults = make(chan *result, preloadCount)
+	f.stopping.Store(false)
+	f.fetchCtx, f.cancelFetch = context.WithCancel(context.Background())
+	f.start = start
+	f.end = end
+	go f.fetch(f.fetchCtx, f.chanResults)
+}
+
+func (f *rangesFetcher) StopFetching() {
+	f.stopping.Store(true)
+	if f.cancelFetch != nil {
+		f.cancelFetch()
+	}
+}
+
+// NextBatch returns true if there is a next batch to be retrieved, or error, I.e. if the call to
+// ReturnNextBatch will return something other than nil, nil, nil.
+func (f *rangesFetcher) NextBatch(ctx context.Context) bool {
+	f.currentResult = &result{}
+	var ok bool
+	select {
+	case <-ctx.Done():
+		f.currentResult.err = ctx.Err()
+	case f.currentResult, ok = <-f.chanResults:
+		// Only in case that there is no error AND no data should we return false:
+		if !ok ||
+			f.currentResult.err == nil &&
+				len(f.currentResult.certs) == 0 &&
+				len(f.currentResult.chains) == 0 &&
+				f.currentResult.expired == 0 &&
+				f.currentResult.quarantined == 0 {
+			// If no  error and no data, return false
+			return false // do not attempt to get result
+		}
+	}
+	return true
+}
+
+// ReturnNextBatch returns the next batch of certificates as if it were a channel.
+// The call blocks until a whole batch is available. The last batch may have less elements.
+// Returns nil when there is no more batches, i.e. all certificates have been fetched.
+// The excluded entries are the expired and the quarantined ones; see Quarantined.
+func (f *rangesFetcher) ReturnNextBatch() (
+	certs []ctx509.Certificate,
+	chains [][]*ctx509.Certificate,
+	excluded int,
+	err error) {
+
+	res := f.currentResult
+	return res.certs, res.chains, res.expired + res.quarantined, res.err
+}
+
+// Quarantined returns how many of the entries excluded from the last batch were quarantined.
+func (f *rangesFetcher) Quarantined() int {
+	if f.currentResult == nil {
+		return 0
+	}
+	return f.currentResult.quarantined
+}
+
+// FetchAllCertificates will block until all certificates and chains [start,end] have been fetched.
+func (f *rangesFetcher) FetchAllCertificates(
+	ctx context.Context,
+	start,
+	end int64,
+) (
+	certs []ctx509.Certificate,
+	chains [][]*ctx509.Certificate,
+	excluded uint64,
+	err error,
+) {
+
+	f.StartFetching(start, end)
+	defer f.StopFetching()
+	certs = make([]ctx509.Certificate, 0, end-start+1)
+	chains = make([][]*ctx509.Certificate, 0, end-start+1)
+	for f.NextBatch(ctx) {
+		bCerts, bChains, bExcluded, bErr := f.ReturnNextBatch()
+		if bErr != nil {
+			err = bErr
+			return
+		}
+		if len(bCerts) == 0 && bExcluded == 0 {
+			break
+		}
+		certs = append(certs, bCerts...)
+		chains = append(chains, bChains...)
+		excluded += uint64(bExcluded)
+	}
+	return
+}
+
+// fetch downloads the entries [f.start,f.end] in batches of processBatchSize, and sends them
+// in order to chanResults, which is closed at the end. An error is sent as the last result.
+// The pipeline is:
+//
+//	a: source, generates the entryRange of each batch.
+//	b1..N: range fetchers, download and parse one batch each.
+//	c: sink, reassembles the results in order.
+//
+//	a ┌-> b1 -┬-> c
+//	  |-> b2 -|
+//	 ...     ...
+//	  └-> bN -┘
+func (f *rangesFetcher) fetch(ctx context.Context, chanResults chan *result) {
+	defer close(chanResults)
+	ctx, cancelF := context.WithCancel(ctx) // Stops the ranges generator at the end.
+	defer cancelF()
+
+	// The window limits the batches that are being downloaded or reassembled.
+	// A batch takes a slot when generated, and releases it when sent to chanResults.
+	window := make(chan struct{}, 2*f.rangeFetchers)
+	incomingRanges := make(chan entryRange)
+	go f.generateRanges(ctx, window, incomingRanges)
+
+	source := pip.NewSource[entryRange](
+		"ct_ranges",
+		pip.WithSourceChannel(&incomingRanges, func(entryRange) ([]int, error) {
+			return []int{0}, nil
+		}),
+	)
+	fetchers := make([]*pip.Stage[entryRange, rangeResult], f.rangeFetchers)
+	stages := []pip.StageLike{source}
+	for i := range fetchers {
+		fetchers[i] = f.newRangeFetcher(i)
+		stages = append(stages, fetchers[i])
+	}
+	sink := f.newResultsReassembler(ctx, window, chanResults)
+	stages = append(stages, sink)
+
+	pipeline, err := pip.NewPipeline(
+		func(p *pip.Pipeline) {
+			pip.LinkStagesDistribute(pip.SourceAsStage(source), fetchers...)
+			pip.LinkStagesCrissCross(fetchers, []*pip.Stage[rangeResult, pip.None]{sink.Stage})
+		},
+		pip.WithStages(stages...),
+	)
+	if err != nil {
+		chanResults <- &result{err: err}
+		return
+	}
+	pipeline.Resume(ctx)
+	// The errors have been sent to chanResults by the reassembler already.
+	_ = pipeline.Wait(ctx)
+}
+
+// generateRanges sends to out the entryRange of each batch of [f.start,f.end], after taking
+// a slot of the window for it. It closes out at the end, or when ctx is done.
+func (f *rangesFetcher) generateRanges(
+	ctx context.Context,
+	window chan struct{},
+	out chan entryRange,
+) {
+	defer close(out)
+	for i, start := 0, f.start; start <= f.end; i, start = i+1, start+f.processBatchSize {
+		r := entryRange{
+			index: i,
+			start: start,
+			end:   min(f.end, start+f.processBatchSize-1),
+		}
+		select {
+		case window <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		select {
+		case out <- r:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// newRangeFetcher creates a stage that downloads and parses the entries of each entryRange.
+// Errors are sent to the next stage as part of the result, to keep the order.
+func (f *rangesFetcher) newRangeFetcher(id int) *pip.Stage[entryRange, rangeResult] {
+	fetchRange := f.newFetchRange() // Each range fetcher has its own.
+	outs := make([]rangeResult, 1)
+	outChs := make([]int, 1)
+	return pip.NewStage[entryRange, rangeResult](
+		fmt.Sprintf("ct_range_fetcher_%02d", id),
+		pip.WithProcessFunction(func(in entryRange) ([]rangeResult, []int, error) {
+			outs[0] = rangeResult{
+				index: in.index,
+				res:   fetchRange(in.start, in.end),
+			}
+			return outs, outChs, nil
+		}),
+	)
+}
+
+// newResultsReassembler creates a sink that sends the results to chanResults in the order
+// of their indices, releasing their slot of the window. It keeps the results that arrive
+// before their predecessors. It stops after sending an error, or if stopping.
+func (f *rangesFetcher) newResultsReassembler(
+	ctx context.Context,
+	window chan struct{},
+	chanResults chan *result,
+) *pip.Sink[rangeResult] {
+
+	pending := make(map[int]*result, cap(window))
+	next := 0
+	return pip.NewSink[rangeResult](
+		"ct_results_reassembler",
+		pip.WithSinkFunction(func(in rangeResult) error {
+			pending[in.index] = in.res
+			for res, ok := pending[next]; ok; res, ok = pending[next] {
+				delete(pending, next)
+				next++
+				if f.stopping.Load() {
+					return pip.NoMoreData
+				}
+				select {
+				case chanResults <- res:
+				case <-ctx.Done():
+					return pip.NoMoreData
+				}
+				<-window
+				if res.err != nil {
+					return pip.NoMoreData // Don't continue processing when errors.
+				}
+			}
+			return nil
+		}),
+	)
+}
@@ -0,0 +1,155 @@
+package logfetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/google/certificate-transparency-go/jsonclient"
+)
+
+// RetryPolicy configures how the failed requests to a CT log server are retried.
+// Requests are retried if the server is overloaded or unavailable (429 and 5xx statuses), or
+// if there was a network error. The delay before each retry grows exponentially, unless the
+// server specifies it with a Retry-After header.
+type RetryPolicy struct {
+	MaxRetries int           // Retries after the first attempt. Zero disables them.
+	BaseDelay  time.Duration // Delay before the first retry, doubled after each retry.
+	MaxDelay   time.Duration // Maximum delay, also for the ones specified by the server.
+	Jitter     float64       // Fraction of the delay randomly added or subtracted, in [0,1].
+}
+
+// DefaultRetryPolicy retries for about five minutes before failing.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxRetries: 10,
+	BaseDelay:  500 * time.Millisecond,
+	MaxDelay:   time.Minute,
+	Jitter:     0.2,
+}
+
+// do calls the function until it succeeds, it fails with an error that cannot be retried,
+// the retries are exhausted, or ctx is done. It returns the error of the last call.
+func (p RetryPolicy) do(
+	ctx context.Context,
+	name string,
+	f func(ctx context.Context) error,
+) error {
+
+	for attempt := 0; ; attempt++ {
+		hint := &retryAfterHint{}
+		err := f(context.WithValue(ctx, retryAfterKey{}, hint))
+		if err == nil || attempt >= p.MaxRetries || ctx.Err() != nil || !isRetryable(err) {
+			return err
+		}
+		delay := p.delay(attempt, hint.delay)
+		fmt.Printf("%s failed (attempt %d/%d), retrying in %s: %s\n",
+			name, attempt+1, p.MaxRetries+1, delay.Round(time.Millisecond), err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// delay returns the delay before the retry after the attempt, using the one requested by the
+// server if not zero.
+func (p RetryPolicy) delay(attempt int, requested time.Duration) time.Duration {
+	if requested > 0 {
+		return min(requested, p.MaxDelay)
+	}
+	delay := p.MaxDelay
+	if attempt < 32 {
+		delay = min(p.BaseDelay<<attempt, p.MaxDelay)
+	}
+	if p.Jitter > 0 {
+		delay += time.Duration(p.Jitter * (2*rand.Float64() - 1) * float64(delay))
+	}
+	return max(delay, 0)
+}
+
+// isRetryable returns true if the error is a network error other than an unknown host, a 429
+// or a 5xx status, or a malformed response.
+func isRetryable(err error) bool {
+	var rspErr jsonclient.RspError
+	if errors.As(err, &rspErr) {
+		return rspErr.StatusCode == http.StatusOK || // Truncated or malformed body.
+			rspErr.StatusCode == http.StatusTooManyRequests ||
+			rspErr.StatusCode >= 500
+	}
+	var statusErr *statusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode == http.StatusTooManyRequests ||
+			statusErr.StatusCode >= 500
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return false
+	}
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
+}
+
+// statusError is the error of a response with an unexpected HTTP status.
+type statusError struct {
+	URL        string
+	StatusCode int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("GET %s: got HTTP status %d %s",
+		e.URL, e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+type retryAfterKey struct{}
+
+// retryAfterHint holds the delay requested by the server with a Retry-After header, as the CT
+// client does not return the headers of the failed responses.
+type retryAfterHint struct {
+	delay time.Duration
+}
+
+// retryAfterTransport records the Retry-After header of the 429 and 503 responses in the
+// retryAfterHint of the context of the request, if any.
+type retryAfterTransport struct {
+	next http.RoundTripper
+}
+
+func (t retryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rsp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return rsp, err
+	}
+	if rsp.StatusCode != http.StatusTooManyRequests &&
+		rsp.StatusCode != http.StatusServiceUnavailable {
+		return rsp, nil
+	}
+	if hint, ok := req.Context().Value(retryAfterKey{}).(*retryAfterHint); ok {
+		hint.delay = parseRetryAfter(rsp.Header.Get("Retry-After"), time.Now())
+	}
+	return rsp, nil
+}
+
+// parseRetryAfter returns the delay of a Retry-After header, in seconds or as an HTTP date.
+// It returns zero if the header is empty or invalid.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		return max(time.Duration(secs)*time.Second, 0)
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return max(t.Sub(now), 0)
+	}
+	return 0
+}
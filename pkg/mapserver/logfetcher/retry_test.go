@@ -0,0 +1,224 @@
+package logfetcher
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/certificate-transparency-go/jsonclient"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	cases := map[string]struct {
+		value    string
+		expected time.Duration
+	}{
+		"empty": {
+			value:    "",
+			expected: 0,
+		},
+		"seconds": {
+			value:    "120",
+			expected: 2 * time.Minute,
+		},
+		"negative": {
+			value:    "-3",
+			expected: 0,
+		},
+		"date": {
+			value:    now.Add(90 * time.Second).Format(http.TimeFormat),
+			expected: 90 * time.Second,
+		},
+		"past_date": {
+			value:    now.Add(-time.Hour).Format(http.TimeFormat),
+			expected: 0,
+		},
+		"invalid": {
+			value:    "soon",
+			expected: 0,
+		},
+	}
+	for name, tc := range cases {
+		name, tc := name, tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			require.Equal(t, tc.expected, parseRetryAfter(tc.value, now))
+		})
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{
+		BaseDelay: time.Second,
+		MaxDelay:  10 * time.Second,
+	}
+	require.Equal(t, time.Second, p.delay(0, 0))
+	require.Equal(t, 2*time.Second, p.delay(1, 0))
+	require.Equal(t, 8*time.Second, p.delay(3, 0))
+	require.Equal(t, 10*time.Second, p.delay(4, 0))
+	require.Equal(t, 10*time.Second, p.delay(100, 0))
+	// Requested by the server, and bounded.
+	require.Equal(t, 3*time.Second, p.delay(0, 3*time.Second))
+	require.Equal(t, 10*time.Second, p.delay(0, time.Hour))
+
+	// With jitter.
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		d := p.delay(2, 0)
+		require.GreaterOrEqual(t, d, 2*time.Second)
+		require.LessOrEqual(t, d, 6*time.Second)
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	require.True(t, isRetryable(jsonclient.RspError{StatusCode: http.StatusTooManyRequests}))
+	require.True(t, isRetryable(jsonclient.RspError{StatusCode: http.StatusServiceUnavailable}))
+	require.True(t, isRetryable(jsonclient.RspError{StatusCode: http.StatusInternalServerError}))
+	require.True(t, isRetryable(jsonclient.RspError{StatusCode: http.StatusOK}))
+	require.True(t, isRetryable(fmt.Errorf("wrapped: %w",
+		jsonclient.RspError{StatusCode: http.StatusBadGateway})))
+	require.False(t, isRetryable(jsonclient.RspError{StatusCode: http.StatusBadRequest}))
+	require.False(t, isRetryable(jsonclient.RspError{StatusCode: http.StatusNotFound}))
+	require.False(t, isRetryable(fmt.Errorf("some error")))
+	require.True(t, isRetryable(&url.Error{Op: "Get", Err: &net.OpError{Op: "dial"}}))
+	require.False(t, isRetryable(&url.Error{Op: "Get", Err: &net.DNSError{IsNotFound: true}}))
+}
+
+// TestRetryLogFetcher checks the retries of the fetcher against a local CT log server that
+// fails some of the requests.
+func TestRetryLogFetcher(t *testing.T) {
+	leaves, entries := buildTestLogEntries(t, 100)
+	policy := RetryPolicy{
+		MaxRetries: 3,
+		BaseDelay:  time.Millisecond,
+		MaxDelay:   5 * time.Second,
+		Jitter:     0.2,
+	}
+
+	cases := map[string]struct {
+		fault            func(w http.ResponseWriter, request int64) bool
+		expectedErr      bool
+		expectedRequests int64
+		minElapsed       time.Duration
+	}{
+		"no_faults": {
+			fault:            nil,
+			expectedRequests: 10,
+		},
+		"every_other_429": {
+			fault: func(w http.ResponseWriter, request int64) bool {
+				if request%2 == 1 {
+					http.Error(w, "slow down", http.StatusTooManyRequests)
+					return true
+				}
+				return false
+			},
+			expectedRequests: 20,
+		},
+		"retry_after": {
+			fault: func(w http.ResponseWriter, request int64) bool {
+				if request == 1 {
+					w.Header().Set("Retry-After", "1")
+					http.Error(w, "unavailable", http.StatusServiceUnavailable)
+					return true
+				}
+				return false
+			},
+			expectedRequests: 11,
+			minElapsed:       time.Second,
+		},
+		"truncated_body": {
+			fault: func(w http.ResponseWriter, request int64) bool {
+				if request <= 2 {
+					w.Write([]byte(`{"entries": [`))
+					return true
+				}
+				return false
+			},
+			expectedRequests: 12,
+		},
+		"always_500": {
+			fault: func(w http.ResponseWriter, request int64) bool {
+				http.Error(w, "broken", http.StatusInternalServerError)
+				return true
+			},
+			expectedErr:      true,
+			expectedRequests: 1 + 3,
+		},
+		"not_found": {
+			fault: func(w http.ResponseWriter, request int64) bool {
+				http.NotFound(w, nil)
+				return true
+			},
+			expectedErr:      true,
+			expectedRequests: 1,
+		},
+	}
+	for name, tc := range cases {
+		name, tc := name, tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx, cancelF := context.WithTimeout(context.Background(), 20*time.Second)
+			defer cancelF()
+
+			var requests atomic.Int64
+			server := newTestCTServer(t, entries, 10, &requests, tc.fault)
+			defer server.Close()
+
+			f, err := NewHttpLogFetcher(server.URL,
+				WithRangeFetchers(1),
+				WithRetryPolicy(policy),
+			)
+			require.NoError(t, err)
+			f.serverBatchSize = 10
+			f.processBatchSize = 100
+
+			t0 := time.Now()
+			certs, _, _, err := f.FetchAllCertificates(ctx, 0, 99)
+			elapsed := time.Since(t0)
+			if tc.expectedErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+				require.Len(t, certs, 100)
+				for i := range certs {
+					require.Equal(t, leaves[i].Raw, certs[i].Raw)
+				}
+			}
+			require.Equal(t, tc.expectedRequests, requests.Load())
+			require.GreaterOrEqual(t, elapsed, tc.minElapsed)
+		})
+	}
+}
+
+// TestRetryGetCurrentState checks that get-sth is also retried.
+func TestRetryGetCurrentState(t *testing.T) {
+	ctx, cancelF := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelF()
+
+	var requests atomic.Int64
+	server := newTestCTServer(t, nil, 10, &requests,
+		func(w http.ResponseWriter, request int64) bool {
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+			return true
+		})
+	defer server.Close()
+
+	f, err := NewHttpLogFetcher(server.URL, WithRetryPolicy(RetryPolicy{
+		MaxRetries: 2,
+		BaseDelay:  time.Millisecond,
+		MaxDelay:   time.Millisecond,
+	}))
+	require.NoError(t, err)
+	_, err = f.GetCurrentState(ctx, State{})
+	require.Error(t, err)
+	require.Equal(t, int64(3), requests.Load())
+}
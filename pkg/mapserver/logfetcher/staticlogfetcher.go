@@ -0,0 +1,357 @@
+package logfetcher
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	ct "github.com/google/certificate-transparency-go"
+	cttls "github.com/google/certificate-transparency-go/tls"
+	ctx509 "github.com/google/certificate-transparency-go/x509"
+)
+
+const tileWidth = 256 // Number of entries of a full data tile.
+
+// StaticLogConfig configures a CT log that implements the static-ct-api, i.e. that serves its
+// checkpoints, entries and issuers as static files, in tiles.
+type StaticLogConfig struct {
+	MonitoringURL string // Prefix of the resources of the log. The URL of the log if empty.
+	Origin        string // Origin of the checkpoints. The URL without scheme if empty.
+	PublicKey     []byte // DER encoded public key of the log.
+}
+
+// StaticLogFetcher downloads certificates from a CT log that implements the static-ct-api.
+// It verifies the signature of the checkpoint of the log, and reads its data tiles and issuers
+// in the background, see rangesFetcher, with the same output as the HttpLogFetcher.
+// Failed requests are retried following the RetryPolicy, and the entries that cannot be
+// parsed are sent to the Quarantine and excluded from the batch.
+type StaticLogFetcher struct {
+	rangesFetcher
+	url string
+
+	monitoringURL string
+	origin        string
+	publicKey     crypto.PublicKey
+	publicKeyDER  []byte
+	httpClient    *http.Client
+	treeSize      atomic.Int64 // Size of the last checkpoint, sets the width of partial tiles.
+
+	issuersMu sync.Mutex
+	issuers   map[[sha256.Size]byte]*ctx509.Certificate // Already downloaded issuers.
+}
+
+var _ QuarantiningFetcher = (*StaticLogFetcher)(nil)
+
+func NewStaticLogFetcher(
+	url string,
+	config StaticLogConfig,
+	options ...FetcherOption,
+) (*StaticLogFetcher, error) {
+
+	publicKey, err := x509.ParsePKIXPublicKey(config.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("parsing public key of static log %s: %w", url, err)
+	}
+	if config.MonitoringURL == "" {
+		config.MonitoringURL = url
+	}
+	if config.Origin == "" {
+		config.Origin = url
+		if i := strings.Index(url, "://"); i >= 0 {
+			config.Origin = url[i+len("://"):]
+		}
+		config.Origin = strings.TrimSuffix(config.Origin, "/")
+	}
+	f := &StaticLogFetcher{
+		url: url,
+
+		monitoringURL: strings.TrimSuffix(config.MonitoringURL, "/"),
+		origin:        config.Origin,
+		publicKey:     publicKey,
+		publicKeyDER:  config.PublicKey,
+		httpClient: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: retryAfterTransport{next: &http.Transport{
+				TLSHandshakeTimeout:   30 * time.Second,
+				ResponseHeaderTimeout: 30 * time.Second,
+				MaxIdleConnsPerHost:   10,
+				MaxIdleConns:          100,
+				IdleConnTimeout:       90 * time.Second,
+			}},
+		},
+		issuers: make(map[[sha256.Size]byte]*ctx509.Certificate),
+	}
+	f.init(options, f.newStaticFetchRange)
+	return f, nil
+}
+
+func (f *StaticLogFetcher) Initialize(updateStartTime time.Time) error {
+	return nil
+}
+
+func (f *StaticLogFetcher) URL() string {
+	return f.url
+}
+
+// GetCurrentState downloads the checkpoint of the log and verifies its signature.
+// The STH of the state is the signed note of the checkpoint.
+func (f *StaticLogFetcher) GetCurrentState(ctx context.Context, lastState State) (State, error) {
+	note, err := f.get(ctx, "checkpoint")
+	if err != nil {
+		return State{}, err
+	}
+	cp, err := parseCheckpoint(note, f.origin, f.publicKey, f.publicKeyDER)
+	if err != nil {
+		return State{}, fmt.Errorf("checkpoint of %s: %w", f.url, err)
+	}
+	if cp.Size < lastState.Size {
+		return State{}, fmt.Errorf("checkpoint of %s has size %d, smaller than the previous %d",
+			f.url, cp.Size, lastState.Size)
+	}
+	f.treeSize.Store(int64(cp.Size))
+	return State{
+		Size: cp.Size,
+		STH:  note,
+	}, nil
+}
+
+// get downloads the resource at path under the monitoring prefix of the log, retrying it
+// following the RetryPolicy.
+func (f *StaticLogFetcher) get(ctx context.Context, path string) ([]byte, error) {
+	resource := f.monitoringURL + "/" + path
+	var body []byte
+	err := f.retryPolicy.do(ctx, "get "+resource, func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, resource, nil)
+		if err != nil {
+			return err
+		}
+		rsp, err := f.httpClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer rsp.Body.Close()
+		if rsp.StatusCode != http.StatusOK {
+			return &statusError{URL: resource, StatusCode: rsp.StatusCode}
+		}
+		body, err = io.ReadAll(rsp.Body)
+		if err != nil {
+			// Truncated body: retry it as any other network error.
+			return &statusError{URL: resource, StatusCode: http.StatusServiceUnavailable}
+		}
+		return nil
+	})
+	return body, err
+}
+
+// newStaticFetchRange returns a function that downloads the tiles with the entries [start,end]
+// and parses them into certificates and chains. The entries that cannot be parsed are
+// quarantined, and counted as quarantined.
+func (f *StaticLogFetcher) newStaticFetchRange() fetchRangeFunc {
+	return f.fetchRange
+}
+
+func (f *StaticLogFetcher) fetchRange(start, end int64) *result {
+	// The tree has at least end+1 entries, even if the checkpoint was not downloaded.
+	treeSize := max(f.treeSize.Load(), end+1)
+	res := &result{
+		certs:  make([]ctx509.Certificate, 0, end-start+1),
+		chains: make([][]*ctx509.Certificate, 0, end-start+1),
+	}
+	for tile := start / tileWidth; tile <= end/tileWidth; tile++ {
+		width := min(tileWidth, treeSize-tile*tileWidth)
+		leaves, err := f.getDataTile(tile, width)
+		if err != nil {
+			if f.stopping.Load() {
+				// The request was canceled by the stop.
+				return &result{}
+			}
+			return &result{err: err}
+		}
+		first := max(start, tile*tileWidth)
+		last := min(end, tile*tileWidth+width-1)
+		for index := first; index <= last; index++ {
+			leaf := &leaves[index-tile*tileWidth]
+			cert, chain, err := f.parseTileLeaf(leaf)
+			if err != nil {
+				if f.stopping.Load() {
+					return &result{}
+				}
+				if isDownloadError(err) {
+					// The entry may be correct, but its issuers are unavailable.
+					return &result{err: err}
+				}
+				err = f.quarantineEntry(f.url, index, err, leaf.raw, nil)
+				if err != nil {
+					return &result{err: err}
+				}
+				res.quarantined++
+				continue
+			}
+			res.certs = append(res.certs, *cert)
+			res.chains = append(res.chains, chain)
+		}
+	}
+	return res
+}
+
+// isDownloadError returns true if the error is of a request to the log, instead of a malformed
+// entry.
+func isDownloadError(err error) bool {
+	var statusErr *statusError
+	var urlErr *url.Error
+	return errors.As(err, &statusErr) || errors.As(err, &urlErr)
+}
+
+// tileLeaf is an entry of a data tile of the static-ct-api.
+type tileLeaf struct {
+	entry          ct.TimestampedEntry
+	preCertificate []byte              // Only for precertificate entries.
+	fingerprints   [][sha256.Size]byte // Of the certificates of the chain.
+	raw            []byte              // The bytes of the whole entry.
+}
+
+// getDataTile downloads the data tile with the given index and width, and splits it into its
+// entries. If the partial tile is not found, the log has grown since the checkpoint, and the
+// full tile is downloaded instead.
+func (f *StaticLogFetcher) getDataTile(tile, width int64) ([]tileLeaf, error) {
+	path := "tile/data/" + tilePath(tile)
+	if width < tileWidth {
+		data, err := f.get(f.fetchCtx, fmt.Sprintf("%s.p/%d", path, width))
+		var statusErr *statusError
+		if err == nil {
+			return parseDataTile(data, width)
+		} else if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusNotFound {
+			return nil, err
+		}
+	}
+	data, err := f.get(f.fetchCtx, path)
+	if err != nil {
+		return nil, err
+	}
+	return parseDataTile(data, width)
+}
+
+// tilePath returns the path of the tile with the given index, encoded in groups of three
+// digits, all but the last one prefixed with "x", e.g. x001/x234/067 for 1234067.
+func tilePath(index int64) string {
+	path := fmt.Sprintf("%03d", index%1000)
+	for index /= 1000; index > 0; index /= 1000 {
+		path = fmt.Sprintf("x%03d/%s", index%1000, path)
+	}
+	return path
+}
+
+// parseDataTile splits the data tile into its first width entries.
+func parseDataTile(data []byte, width int64) ([]tileLeaf, error) {
+	leaves := make([]tileLeaf, width)
+	for i := range leaves {
+		rest, err := parseTileLeaf(data, &leaves[i])
+		if err != nil {
+			return nil, fmt.Errorf("data tile entry %d: %w", i, err)
+		}
+		data = rest
+	}
+	return leaves, nil
+}
+
+// parseTileLeaf parses the entry at the beginning of data, and returns the rest.
+// Each entry is a TimestampedEntry, followed by the precertificate if it is a precertificate
+// entry, followed by the fingerprints of the chain.
+func parseTileLeaf(data []byte, leaf *tileLeaf) ([]byte, error) {
+	rest, err := cttls.Unmarshal(data, &leaf.entry)
+	if err != nil {
+		return nil, err
+	}
+	if leaf.entry.EntryType == ct.PrecertLogEntryType {
+		var preCertificate ct.ASN1Cert
+		if rest, err = cttls.Unmarshal(rest, &preCertificate); err != nil {
+			return nil, fmt.Errorf("precertificate: %w", err)
+		}
+		leaf.preCertificate = preCertificate.Data
+	}
+	if len(rest) < 2 {
+		return nil, fmt.Errorf("missing chain fingerprints")
+	}
+	n := int(binary.BigEndian.Uint16(rest))
+	rest = rest[2:]
+	if n%sha256.Size != 0 || len(rest) < n {
+		return nil, fmt.Errorf("malformed chain fingerprints of length %d", n)
+	}
+	leaf.fingerprints = make([][sha256.Size]byte, n/sha256.Size)
+	for i := range leaf.fingerprints {
+		leaf.fingerprints[i] = [sha256.Size]byte(rest[i*sha256.Size:])
+	}
+	rest = rest[n:]
+	leaf.raw = data[:len(data)-len(rest)]
+	return rest, nil
+}
+
+// parseTileLeaf parses the certificate of the entry, and downloads its chain.
+// As for the HttpLogFetcher, the certificate of a precertificate entry is the precertificate.
+func (f *StaticLogFetcher) parseTileLeaf(leaf *tileLeaf) (
+	*ctx509.Certificate, []*ctx509.Certificate, error) {
+
+	var der []byte
+	switch leaf.entry.EntryType {
+	case ct.X509LogEntryType:
+		der = leaf.entry.X509Entry.Data
+	case ct.PrecertLogEntryType:
+		der = leaf.preCertificate
+	default:
+		return nil, nil, fmt.Errorf("unknown entry type %d", leaf.entry.EntryType)
+	}
+	cert, err := ctx509.ParseCertificate(der)
+	// Accept the same certificates as CT logs, see parseLeafEntry.
+	if ctx509.IsFatal(err) {
+		return nil, nil, fmt.Errorf("parsing certificate: %w", err)
+	}
+	chain := make([]*ctx509.Certificate, len(leaf.fingerprints))
+	for i, fp := range leaf.fingerprints {
+		if chain[i], err = f.getIssuer(fp); err != nil {
+			return nil, nil, fmt.Errorf("chain certificate %d: %w", i, err)
+		}
+	}
+	if err := checkEntryType(&leaf.entry, cert, chain); err != nil {
+		return nil, nil, err
+	}
+	return cert, chain, nil
+}
+
+// getIssuer returns the issuer certificate with the fingerprint, downloading it if necessary.
+func (f *StaticLogFetcher) getIssuer(fingerprint [sha256.Size]byte) (*ctx509.Certificate, error) {
+	f.issuersMu.Lock()
+	cert, ok := f.issuers[fingerprint]
+	f.issuersMu.Unlock()
+	if ok {
+		return cert, nil
+	}
+
+	der, err := f.get(f.fetchCtx, "issuer/"+hex.EncodeToString(fingerprint[:]))
+	if err != nil {
+		return nil, err
+	}
+	if sha256.Sum256(der) != fingerprint {
+		return nil, fmt.Errorf("issuer %x does not match its fingerprint", fingerprint)
+	}
+	cert, err = ctx509.ParseCertificate(der)
+	if ctx509.IsFatal(err) {
+		return nil, fmt.Errorf("parsing issuer %x: %w", fingerprint, err)
+	}
+
+	f.issuersMu.Lock()
+	f.issuers[fingerprint] = cert
+	f.issuersMu.Unlock()
+	return cert, nil
+}
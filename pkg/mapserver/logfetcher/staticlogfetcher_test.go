@@ -0,0 +1,336 @@
+package logfetcher
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	ct "github.com/google/certificate-transparency-go"
+	cttls "github.com/google/certificate-transparency-go/tls"
+	ctx509 "github.com/google/certificate-transparency-go/x509"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netsec-ethz/fpki/pkg/tests"
+	"github.com/netsec-ethz/fpki/pkg/tests/random"
+)
+
+func TestTilePath(t *testing.T) {
+	require.Equal(t, "000", tilePath(0))
+	require.Equal(t, "067", tilePath(67))
+	require.Equal(t, "x001/000", tilePath(1000))
+	require.Equal(t, "x001/x234/067", tilePath(1234067))
+}
+
+// TestStaticLogFetcher checks the fetcher against a tiled log served from a local directory.
+func TestStaticLogFetcher(t *testing.T) {
+	key := newTestLogKey(t)
+	issuer := random.RandomX509Cert(t, "issuer.com")
+	leaves := newTestTiledLogLeaves(t, 768)
+
+	cases := map[string]struct {
+		entries        int   // Entries in the tiles.
+		checkpointSize int   // Size of the checkpoint.
+		start          int64 // First entry to fetch.
+		end            int64 // Last entry to fetch.
+	}{
+		"all": {
+			entries:        600,
+			checkpointSize: 600,
+			start:          0,
+			end:            599,
+		},
+		"middle": {
+			entries:        600,
+			checkpointSize: 600,
+			start:          300,
+			end:            550,
+		},
+		"one": {
+			entries:        600,
+			checkpointSize: 600,
+			start:          257,
+			end:            257,
+		},
+		"grown_log": { // The partial tile of the checkpoint does not exist anymore.
+			entries:        768,
+			checkpointSize: 600,
+			start:          100,
+			end:            599,
+		},
+	}
+	for name, tc := range cases {
+		name, tc := name, tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			ctx, cancelF := context.WithTimeout(context.Background(), 20*time.Second)
+			defer cancelF()
+
+			dir := t.TempDir()
+			writeTestTiledLog(t, dir, leaves[:tc.entries], issuer)
+			server := httptest.NewServer(http.FileServer(http.Dir(dir)))
+			defer server.Close()
+			origin := strings.TrimPrefix(server.URL, "http://")
+			writeTestCheckpoint(t, dir, origin, key, tc.checkpointSize)
+
+			f, err := NewStaticLogFetcher(server.URL, StaticLogConfig{
+				PublicKey: marshalTestPublicKey(t, key),
+			}, WithRangeFetchers(3))
+			require.NoError(t, err)
+			f.processBatchSize = 100
+
+			state, err := f.GetCurrentState(ctx, State{})
+			require.NoError(t, err)
+			require.Equal(t, uint64(tc.checkpointSize), state.Size)
+
+			certs, chains, excluded, err := f.FetchAllCertificates(ctx, tc.start, tc.end)
+			require.NoError(t, err)
+			require.Zero(t, excluded)
+			require.Len(t, certs, int(tc.end-tc.start+1))
+			require.Len(t, chains, int(tc.end-tc.start+1))
+			for i := range certs {
+				require.Equal(t, leaves[tc.start+int64(i)].Raw, certs[i].Raw, "at %d", i)
+				require.Len(t, chains[i], 1)
+				require.Equal(t, issuer.Raw, chains[i][0].Raw)
+			}
+		})
+	}
+}
+
+// TestStaticLogCheckpoint checks that only the checkpoints signed by the log are accepted.
+func TestStaticLogCheckpoint(t *testing.T) {
+	ctx, cancelF := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelF()
+
+	key := newTestLogKey(t)
+	otherKey := newTestLogKey(t)
+	dir := t.TempDir()
+	server := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer server.Close()
+	origin := strings.TrimPrefix(server.URL, "http://")
+
+	newFetcher := func(config StaticLogConfig) *StaticLogFetcher {
+		f, err := NewStaticLogFetcher(server.URL, config, WithRetryPolicy(RetryPolicy{}))
+		require.NoError(t, err)
+		return f
+	}
+	correct := StaticLogConfig{PublicKey: marshalTestPublicKey(t, key)}
+
+	// Signed by the log.
+	writeTestCheckpoint(t, dir, origin, key, 10)
+	state, err := newFetcher(correct).GetCurrentState(ctx, State{})
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), state.Size)
+
+	// Smaller than the previous one.
+	_, err = newFetcher(correct).GetCurrentState(ctx, State{Size: 11})
+	require.Error(t, err)
+
+	// Expecting another key.
+	_, err = newFetcher(StaticLogConfig{
+		PublicKey: marshalTestPublicKey(t, otherKey),
+	}).GetCurrentState(ctx, State{})
+	require.Error(t, err)
+
+	// Expecting another origin.
+	_, err = newFetcher(StaticLogConfig{
+		Origin:    "example.com/log",
+		PublicKey: correct.PublicKey,
+	}).GetCurrentState(ctx, State{})
+	require.Error(t, err)
+
+	// Tampered size.
+	note, err := os.ReadFile(filepath.Join(dir, "checkpoint"))
+	require.NoError(t, err)
+	note = []byte(strings.Replace(string(note), "\n10\n", "\n11\n", 1))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "checkpoint"), note, 0644))
+	_, err = newFetcher(correct).GetCurrentState(ctx, State{})
+	require.Error(t, err)
+}
+
+// TestStaticLogQuarantine checks that the entries with a certificate that cannot be parsed
+// are quarantined, and that a missing issuer fails the fetch.
+func TestStaticLogQuarantine(t *testing.T) {
+	ctx, cancelF := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelF()
+
+	issuer := random.RandomX509Cert(t, "issuer.com")
+	leaves := newTestTiledLogLeaves(t, 20)
+	leaves[4].Raw = []byte("not a certificate")
+	// A precertificate in an X.509 entry.
+	leaves[7], _ = random.RandomX509Precert(t, "leaf-7.com")
+	dir := t.TempDir()
+	writeTestTiledLog(t, dir, leaves, issuer)
+	server := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer server.Close()
+
+	filename := filepath.Join(t.TempDir(), "quarantine.jsonl")
+	q, err := OpenQuarantineFile(filename)
+	require.NoError(t, err)
+	f, err := NewStaticLogFetcher(server.URL, StaticLogConfig{
+		PublicKey: marshalTestPublicKey(t, newTestLogKey(t)),
+	}, WithQuarantine(q))
+	require.NoError(t, err)
+
+	certs, _, excluded, err := f.FetchAllCertificates(ctx, 0, 19)
+	require.NoError(t, err)
+	require.NoError(t, q.Close())
+	require.Equal(t, uint64(2), excluded)
+	require.Len(t, certs, 18)
+
+	file, err := os.Open(filename)
+	require.NoError(t, err)
+	defer file.Close()
+	quarantined, err := ReadQuarantine(file)
+	require.NoError(t, err)
+	require.Len(t, quarantined, 2)
+	require.Equal(t, int64(4), quarantined[0].Index)
+	require.Equal(t, int64(7), quarantined[1].Index)
+	require.Equal(t, server.URL, quarantined[0].URL)
+	require.NotEmpty(t, quarantined[0].LeafInput)
+
+	// Without the issuer, the entries cannot be fetched.
+	fingerprint := sha256.Sum256(issuer.Raw)
+	require.NoError(t, os.Remove(filepath.Join(dir, "issuer", hex.EncodeToString(fingerprint[:]))))
+	f, err = NewStaticLogFetcher(server.URL, StaticLogConfig{
+		PublicKey: marshalTestPublicKey(t, newTestLogKey(t)),
+	}, WithQuarantine(NewQuarantine(&strings.Builder{})))
+	require.NoError(t, err)
+	_, _, _, err = f.FetchAllCertificates(ctx, 0, 19)
+	require.Error(t, err)
+}
+
+func newTestLogKey(t tests.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	return key
+}
+
+func marshalTestPublicKey(t tests.T, key *ecdsa.PrivateKey) []byte {
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	require.NoError(t, err)
+	return der
+}
+
+// newTestTiledLogLeaves returns n leaves for writeTestTiledLog, every third one a
+// precertificate.
+func newTestTiledLogLeaves(t tests.T, n int) []ctx509.Certificate {
+	leaves := make([]ctx509.Certificate, n)
+	for i := range leaves {
+		name := fmt.Sprintf("leaf-%d.com", i)
+		if i%3 == 2 {
+			leaves[i], _ = random.RandomX509Precert(t, name)
+		} else {
+			leaves[i] = random.RandomX509Cert(t, name)
+		}
+	}
+	return leaves
+}
+
+// writeTestTiledLog writes to dir the data tiles of a tiled log with the leaves, every third
+// one in a precertificate entry, and all with the issuer as chain. The last tile is written
+// as partial if it is not full.
+func writeTestTiledLog(
+	t tests.T,
+	dir string,
+	leaves []ctx509.Certificate,
+	issuer ctx509.Certificate,
+) {
+
+	fingerprint := sha256.Sum256(issuer.Raw)
+	parsedIssuer, err := ctx509.ParseCertificate(issuer.Raw)
+	require.NoError(t, err)
+	issuerKeyHash := sha256.Sum256(parsedIssuer.RawSubjectPublicKeyInfo)
+	var tile []byte
+	for i := range leaves {
+		entry := ct.TimestampedEntry{
+			Timestamp: uint64(i),
+			EntryType: ct.X509LogEntryType,
+			X509Entry: &ct.ASN1Cert{Data: leaves[i].Raw},
+		}
+		if i%3 == 2 {
+			tbs, err := ctx509.RemoveCTPoison(leaves[i].RawTBSCertificate)
+			require.NoError(t, err)
+			entry = ct.TimestampedEntry{
+				Timestamp: uint64(i),
+				EntryType: ct.PrecertLogEntryType,
+				PrecertEntry: &ct.PreCert{
+					IssuerKeyHash:  issuerKeyHash,
+					TBSCertificate: tbs,
+				},
+			}
+		}
+		data, err := cttls.Marshal(entry)
+		require.NoError(t, err)
+		tile = append(tile, data...)
+		if i%3 == 2 {
+			data, err = cttls.Marshal(ct.ASN1Cert{Data: leaves[i].Raw})
+			require.NoError(t, err)
+			tile = append(tile, data...)
+		}
+		tile = binary.BigEndian.AppendUint16(tile, sha256.Size)
+		tile = append(tile, fingerprint[:]...)
+
+		if width := i%tileWidth + 1; width == tileWidth || i == len(leaves)-1 {
+			path := filepath.Join(dir, "tile", "data", tilePath(int64(i/tileWidth)))
+			if width < tileWidth {
+				path = filepath.Join(path+".p", fmt.Sprint(width))
+			}
+			require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+			require.NoError(t, os.WriteFile(path, tile, 0644))
+			tile = nil
+		}
+	}
+
+	path := filepath.Join(dir, "issuer", hex.EncodeToString(fingerprint[:]))
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, os.WriteFile(path, issuer.Raw, 0644))
+}
+
+// writeTestCheckpoint writes to dir a checkpoint of the given size, signed with key.
+func writeTestCheckpoint(
+	t tests.T,
+	dir string,
+	origin string,
+	key *ecdsa.PrivateKey,
+	size int,
+) {
+
+	sth := ct.SignedTreeHead{
+		Version:   ct.V1,
+		TreeSize:  uint64(size),
+		Timestamp: uint64(time.Now().UnixMilli()),
+	}
+	copy(sth.SHA256RootHash[:], random.RandomBytesForTest(t, sha256.Size))
+	input, err := ct.SerializeSTHSignatureInput(sth)
+	require.NoError(t, err)
+	signature, err := cttls.CreateSignature(*key, cttls.SHA256, input)
+	require.NoError(t, err)
+	digitallySigned, err := cttls.Marshal(signature)
+	require.NoError(t, err)
+
+	keyID := noteKeyID(origin, marshalTestPublicKey(t, key))
+	sig := append(keyID[:], binary.BigEndian.AppendUint64(nil, sth.Timestamp)...)
+	sig = append(sig, digitallySigned...)
+	note := fmt.Sprintf("%s\n%d\n%s\n\n— %s %s\n",
+		origin,
+		size,
+		base64.StdEncoding.EncodeToString(sth.SHA256RootHash[:]),
+		origin,
+		base64.StdEncoding.EncodeToString(sig),
+	)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "checkpoint"), []byte(note), 0644))
+}
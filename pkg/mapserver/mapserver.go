@@ -7,17 +7,24 @@ import (
 	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"strconv"
+	"sync"
 	"time"
 
 	ctx509 "github.com/google/certificate-transparency-go/x509"
 
 	"github.com/netsec-ethz/fpki/pkg/common"
 	"github.com/netsec-ethz/fpki/pkg/db"
-	"github.com/netsec-ethz/fpki/pkg/db/mysql"
+	"github.com/netsec-ethz/fpki/pkg/db/backends"
+	mapCommon "github.com/netsec-ethz/fpki/pkg/mapserver/common"
 	"github.com/netsec-ethz/fpki/pkg/mapserver/config"
+	"github.com/netsec-ethz/fpki/pkg/mapserver/logfetcher"
+	"github.com/netsec-ethz/fpki/pkg/mapserver/replica"
 	"github.com/netsec-ethz/fpki/pkg/mapserver/responder"
 	"github.com/netsec-ethz/fpki/pkg/mapserver/updater"
 	"github.com/netsec-ethz/fpki/pkg/util"
@@ -31,6 +38,13 @@ const (
 	CertificatesAndPolicies
 )
 
+const (
+	// DefaultSearchLimit is the page size of a domain search when none is requested.
+	DefaultSearchLimit = 100
+	// MaxSearchLimit is the largest page size a domain search can request.
+	MaxSearchLimit = 10_000
+)
+
 type MapServer struct {
 	Updater   *updater.MapUpdater
 	Responder *responder.MapResponder
@@ -42,6 +56,19 @@ type MapServer struct {
 	ReadTimeout  time.Duration
 	WriteTimeout time.Duration
 	HttpAPIPort  int
+	// SyncToken enables the sync API for replicas, if not empty.
+	SyncToken string
+	// Follower is only set in replicas, and Updater and Key are then nil.
+	Follower *replica.Follower
+
+	// serving is write locked by a replica while it applies a new epoch.
+	serving sync.RWMutex
+
+	// conf and fetcherOptions select the CT logs again before each update, if there is a CT
+	// log list. The changes since the last selection, ctLogs, are reported.
+	conf           *config.Config
+	fetcherOptions []logfetcher.FetcherOption
+	ctLogs         *config.CTLogSelection
 
 	apiStopServerChan chan struct{}
 	updateChan        chan context.Context
@@ -84,14 +111,22 @@ func NewMapServer(ctx context.Context, conf *config.Config) (*MapServer, error)
 	}
 
 	// Connect to the DB.
-	conn, err := mysql.Connect(conf.DBConfig)
+	conn, err := backends.Connect(conf.DBConfig)
 	if err != nil {
 		return nil, fmt.Errorf("error connecting to the DB: %w", err)
 	}
 
 	// Create map updater.
-	updater, err := updater.NewMapUpdater(conf.DBConfig, conf.CTLogServerURLs,
-		conf.CertificateFolders, conf.CsvIngestionMaxRows)
+	fetcherOptions, err := logFetcherOptions(conf)
+	if err != nil {
+		return nil, err
+	}
+	logs, err := selectCTLogs(conf, nil)
+	if err != nil {
+		return nil, err
+	}
+	updater, err := updater.NewMapUpdater(conf.DBConfig, logs.URLs, conf.CertificateFolders,
+		logs.StaticLogs, logs.PublicKeys, conf.CsvIngestionMaxRows, fetcherOptions...)
 	if err != nil {
 		return nil, fmt.Errorf("error creating new map updater: %w", err)
 	}
@@ -113,6 +148,11 @@ func NewMapServer(ctx context.Context, conf *config.Config) (*MapServer, error)
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 5 * time.Second,
 		HttpAPIPort:  conf.HttpAPIPort,
+		SyncToken:    conf.SyncToken,
+
+		conf:           conf,
+		fetcherOptions: fetcherOptions,
+		ctLogs:         logs,
 
 		apiStopServerChan: make(chan struct{}, 1),
 		updateChan:        make(chan context.Context),
@@ -144,6 +184,134 @@ func NewMapServer(ctx context.Context, conf *config.Config) (*MapServer, error)
 	return s, nil
 }
 
+// selectCTLogs returns the CT logs to update from now, writing to the standard error the
+// warnings that are new since the previous selection, which may be nil.
+func selectCTLogs(
+	conf *config.Config,
+	previous *config.CTLogSelection,
+) (*config.CTLogSelection, error) {
+
+	logs, err := conf.SelectCTLogs(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range logs.Changes(previous) {
+		fmt.Fprintf(os.Stderr, "WARNING: %s\n", w)
+	}
+	return logs, nil
+}
+
+// logFetcherOptions returns the options of the fetchers of the CT log servers.
+// The quarantine file, if any, remains open for the lifetime of the process.
+func logFetcherOptions(conf *config.Config) ([]logfetcher.FetcherOption, error) {
+	policy := logfetcher.DefaultRetryPolicy
+	if conf.CTRetries != 0 {
+		policy.MaxRetries = max(conf.CTRetries, 0)
+	}
+	if conf.CTRetryMaxDelay.Duration > 0 {
+		policy.MaxDelay = conf.CTRetryMaxDelay.Duration
+	}
+	options := []logfetcher.FetcherOption{
+		logfetcher.WithRetryPolicy(policy),
+	}
+	if conf.CTQuarantineFile != "" {
+		q, err := logfetcher.OpenQuarantineFile(conf.CTQuarantineFile)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, logfetcher.WithQuarantine(q))
+	}
+	return options, nil
+}
+
+// NewReplicaMapServer returns a read-only map server that follows the primary configured in
+// conf.PrimaryURL. It answers queries only after SyncWithPrimary verified an epoch.
+func NewReplicaMapServer(ctx context.Context, conf *config.Config) (*MapServer, error) {
+	// Load the certificate of the primary.
+	pemCert, err := ioutil.ReadFile(conf.PrimaryCertificatePemFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading primary certificate: %w", err)
+	}
+	cert, err := util.CertificateFromPEMBytes(pemCert)
+	if err != nil {
+		return nil, fmt.Errorf("error loading primary certificate: %w", err)
+	}
+	publicKey, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("primary certificate does not contain an RSA key")
+	}
+
+	// Connect to the DB.
+	conn, err := backends.Connect(conf.DBConfig)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to the DB: %w", err)
+	}
+
+	client := replica.NewClient(conf.PrimaryURL, conf.SyncToken)
+	return &MapServer{
+		Conn:         conn,
+		Cert:         cert,
+		Follower:     replica.NewFollower(conn, client, publicKey),
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 5 * time.Second,
+		HttpAPIPort:  conf.HttpAPIPort,
+
+		apiStopServerChan: make(chan struct{}, 1),
+	}, nil
+}
+
+// SyncWithPrimary brings a replica to the latest epoch of its primary. Queries are rejected
+// while the new epoch is applied, and until a later call succeeds if applying it fails.
+// It does nothing if the primary is in the middle of an update.
+func (s *MapServer) SyncWithPrimary(ctx context.Context) error {
+	head, pending, err := s.Follower.Check(ctx)
+	if errors.Is(err, replica.ErrPrimaryBusy) {
+		fmt.Printf("primary is updating, sync postponed\n")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !pending {
+		if s.responder() != nil {
+			return nil
+		}
+		// Already at the latest epoch, e.g. after a restart: start answering.
+		return s.reloadReplicaResponder(ctx, head)
+	}
+
+	s.serving.Lock()
+	defer s.serving.Unlock()
+	// From now on the DB is modified, do not answer with the previous epoch.
+	s.Responder = nil
+	if _, err := s.Follower.Apply(ctx, head); err != nil {
+		return fmt.Errorf("applying epoch %d: %w", head.Epoch, err)
+	}
+	resp, err := responder.NewReplicaMapResponder(ctx, s.Conn, head.SignedTreeHead)
+	if err != nil {
+		return fmt.Errorf("error creating new map responder: %w", err)
+	}
+	s.Responder = resp
+	return nil
+}
+
+func (s *MapServer) reloadReplicaResponder(ctx context.Context, head *replica.Head) error {
+	s.serving.Lock()
+	defer s.serving.Unlock()
+	resp, err := responder.NewReplicaMapResponder(ctx, s.Conn, head.SignedTreeHead)
+	if err != nil {
+		return fmt.Errorf("error creating new map responder: %w", err)
+	}
+	s.Responder = resp
+	return nil
+}
+
+func (s *MapServer) responder() *responder.MapResponder {
+	s.serving.RLock()
+	defer s.serving.RUnlock()
+	return s.Responder
+}
+
 // Listen starts an HTTPS listener for the responder.
 func (s *MapServer) Listen(ctx context.Context) error {
 	return s.listen(ctx, true)
@@ -158,19 +326,27 @@ func (s *MapServer) ListenWithoutTLS(ctx context.Context) error {
 func (s *MapServer) listen(ctx context.Context, useTLS bool) error {
 	// Reset the default sever mux, to establish the handlers from new.
 	http.DefaultServeMux = &http.ServeMux{}
-	http.HandleFunc("/getproof", s.apiGetProof)
-	http.HandleFunc("/getpayloads", func(w http.ResponseWriter, r *http.Request) { s.apiGetPayloads(w, r, CertificatesAndPolicies) })
-	http.HandleFunc("/getcertpayloads", func(w http.ResponseWriter, r *http.Request) { s.apiGetPayloads(w, r, Certificates) })
-	http.HandleFunc("/getpolicypayloads", func(w http.ResponseWriter, r *http.Request) { s.apiGetPayloads(w, r, Policies) })
+	http.HandleFunc("/getproof", s.whenServing(s.apiGetProof))
+	http.HandleFunc("/getpayloads", s.whenServing(func(w http.ResponseWriter, r *http.Request) { s.apiGetPayloads(w, r, CertificatesAndPolicies) }))
+	http.HandleFunc("/getcertpayloads", s.whenServing(func(w http.ResponseWriter, r *http.Request) { s.apiGetPayloads(w, r, Certificates) }))
+	http.HandleFunc("/getpolicypayloads", s.whenServing(func(w http.ResponseWriter, r *http.Request) { s.apiGetPayloads(w, r, Policies) }))
+	http.HandleFunc("/cert", s.whenServing(s.apiGetCertificate))
+	http.HandleFunc("/policy", s.whenServing(s.apiGetPolicy))
+	http.HandleFunc("/searchdomains", s.whenServing(s.apiSearchDomains))
+	if s.SyncToken != "" && s.Key != nil {
+		http.Handle(replica.SyncPathPrefix, replica.NewSyncHandler(s.Conn, s.Key, s.SyncToken))
+	}
 
 	server := &http.Server{
-		Addr: fmt.Sprintf(":%d", s.HttpAPIPort),
-		TLSConfig: &tls.Config{
-			Certificates: []tls.Certificate{*s.TLS},
-		},
+		Addr:         fmt.Sprintf(":%d", s.HttpAPIPort),
 		ReadTimeout:  s.ReadTimeout,
 		WriteTimeout: s.WriteTimeout,
 	}
+	if s.TLS != nil {
+		server.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{*s.TLS},
+		}
+	}
 	// chanErr will hold the error from the Listen call.
 	chanErr := make(chan error)
 	go func() {
@@ -228,6 +404,23 @@ func (s *MapServer) PruneAndUpdate(ctx context.Context) error {
 	return err
 }
 
+// whenServing wraps the handler so that it answers with 503 while a replica applies a new
+// epoch or has not verified any.
+func (s *MapServer) whenServing(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.serving.TryRLock() {
+			http.Error(w, "synchronizing with primary", http.StatusServiceUnavailable)
+			return
+		}
+		defer s.serving.RUnlock()
+		if s.Responder == nil {
+			http.Error(w, "not synchronized with primary", http.StatusServiceUnavailable)
+			return
+		}
+		handler(w, r)
+	}
+}
+
 // apiGetProof expects one GET parameter "domain" with a string value for the domain name.
 // It returns a json formatted structure with
 func (s *MapServer) apiGetProof(w http.ResponseWriter, r *http.Request) {
@@ -299,6 +492,131 @@ func (s *MapServer) apiGetPayloads(w http.ResponseWriter, r *http.Request, retur
 	}
 }
 
+// apiGetCertificate expects one GET parameter "id" with the hex representation of the ID of
+// a certificate. It returns a json formatted structure with the parsed certificate, its chain
+// up to the root, and the domains referencing it.
+func (s *MapServer) apiGetCertificate(w http.ResponseWriter, r *http.Request) {
+	ctx, cancelF := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelF()
+
+	id, err := parseHexID(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	detail, err := s.Responder.GetCertificateDetail(ctx, id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("obtaining certificate: %s", err), http.StatusBadRequest)
+		return
+	}
+	if detail == nil {
+		http.Error(w, fmt.Sprintf("certificate %x not found", id), http.StatusNotFound)
+		return
+	}
+	if err = json.NewEncoder(w).Encode(detail); err != nil {
+		http.Error(w, fmt.Sprintf("encoding certificate: %s", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// apiGetPolicy is the equivalent of apiGetCertificate for policies.
+func (s *MapServer) apiGetPolicy(w http.ResponseWriter, r *http.Request) {
+	ctx, cancelF := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelF()
+
+	id, err := parseHexID(r.URL.Query().Get("id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	detail, err := s.Responder.GetPolicyDetail(ctx, id)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("obtaining policy: %s", err), http.StatusBadRequest)
+		return
+	}
+	if detail == nil {
+		http.Error(w, fmt.Sprintf("policy %x not found", id), http.StatusNotFound)
+		return
+	}
+	if err = json.NewEncoder(w).Encode(detail); err != nil {
+		http.Error(w, fmt.Sprintf("encoding policy: %s", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// apiSearchDomains expects the optional GET parameters "suffix", to list the subdomains of a
+// domain, "pattern", to match domain names with '*' and '?' wildcards, and "after" and "limit"
+// to paginate the results.
+// It returns a json formatted structure with the domains and the total count.
+func (s *MapServer) apiSearchDomains(w http.ResponseWriter, r *http.Request) {
+	ctx, cancelF := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelF()
+
+	query := r.URL.Query()
+	search := db.DomainSearch{
+		Suffix:  query.Get("suffix"),
+		Pattern: query.Get("pattern"),
+		After:   query.Get("after"),
+		Limit:   DefaultSearchLimit,
+	}
+	if search.Suffix == "" && search.Pattern == "" {
+		http.Error(w, "one of the parameters \"suffix\" or \"pattern\" is required",
+			http.StatusBadRequest)
+		return
+	}
+	if l := query.Get("limit"); l != "" {
+		limit, err := strconv.Atoi(l)
+		if err != nil || limit <= 0 || limit > MaxSearchLimit {
+			http.Error(w, fmt.Sprintf("parameter \"limit\" must be between 1 and %d",
+				MaxSearchLimit), http.StatusBadRequest)
+			return
+		}
+		search.Limit = limit
+	}
+
+	domains, err := s.Conn.SearchDomains(ctx, search)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("searching domains: %s", err), http.StatusBadRequest)
+		return
+	}
+	total, err := s.Conn.CountDomains(ctx, search)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("counting domains: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	resp := mapCommon.DomainSearchResponse{
+		Domains: make([]mapCommon.DomainReference, len(domains)),
+		Total:   total,
+	}
+	for i, d := range domains {
+		resp.Domains[i] = mapCommon.DomainReference{
+			DomainID:   d.DomainID,
+			DomainName: d.DomainName,
+		}
+	}
+	if len(domains) == search.Limit {
+		resp.Next = domains[len(domains)-1].DomainName
+	}
+	if err = json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, fmt.Sprintf("encoding domains: %s", err), http.StatusInternalServerError)
+		return
+	}
+}
+
+// parseHexID decodes one ID encoded as 64 hexadecimal characters.
+func parseHexID(hexID string) (common.SHA256Output, error) {
+	var id common.SHA256Output
+	if len(hexID) != common.SHA256Size*2 {
+		return id, fmt.Errorf("parameter \"id\" must be %d hex characters long",
+			common.SHA256Size*2)
+	}
+	if _, err := hex.Decode(id[:], []byte(hexID)); err != nil {
+		return id, fmt.Errorf("not a hexadecimal ID: %s", hexID)
+	}
+	return id, nil
+}
+
 func (s *MapServer) pruneAndUpdate(ctx context.Context) {
 	// Refrain from updating if pruning failed.
 	err := s.prune(ctx)
@@ -361,24 +679,24 @@ func (s *MapServer) update(ctx context.Context) error {
 }
 
 func (s *MapServer) updateCerts(ctx context.Context) error {
-	// restart updater
-	s.Updater.StartFetchingRemaining()
-
-	// Main update loop.
-	for {
-		hasBatch, err := s.Updater.NextBatch(ctx)
+	// Follow the changes of the CT log list, e.g. new temporal shards.
+	if s.conf != nil && s.conf.CTLogListFile != "" {
+		logs, err := selectCTLogs(s.conf, s.ctLogs)
 		if err != nil {
-			return fmt.Errorf("waiting for next batch of x509 certificates: %w", err)
+			return err
 		}
-		if !hasBatch {
-			break
-		}
-
-		_, err = s.Updater.UpdateNextBatch(ctx)
+		fetchers, err := updater.NewFetchers(logs.URLs, s.conf.CertificateFolders,
+			logs.StaticLogs, logs.PublicKeys, s.conf.CsvIngestionMaxRows, s.fetcherOptions...)
 		if err != nil {
-			// We stop the loop here, as probably requires manual inspection of the logs, etc.
-			return fmt.Errorf("updating next batch of x509 certificates: %w", err)
+			return err
 		}
+		s.Updater.Fetchers = fetchers
+		s.ctLogs = logs
+	}
+
+	// Fetch all CT logs in parallel, inserting into the DB as the certificates arrive.
+	if err := s.Updater.UpdateFromLogs(ctx); err != nil {
+		return fmt.Errorf("updating x509 certificates from CT logs: %w", err)
 	}
 	return nil
 }
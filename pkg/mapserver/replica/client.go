@@ -0,0 +1,159 @@
+package replica
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+)
+
+// ErrNotFound is returned by Client.Head when the primary does not have the epoch.
+var ErrNotFound = errors.New("not found in primary")
+
+// Client calls the sync API of a primary map server.
+type Client struct {
+	BaseURL    string // e.g. https://primary.example.com:8443
+	Token      string
+	HTTPClient *http.Client
+}
+
+// NewClient returns a Client for the primary at baseURL.
+func NewClient(baseURL, token string) *Client {
+	return &Client{
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		Token:   token,
+		HTTPClient: &http.Client{
+			Timeout: 5 * time.Minute,
+		},
+	}
+}
+
+// Head returns the head of the given epoch of the primary, or of its latest one if epoch is
+// zero. It returns ErrNotFound if the epoch does not exist.
+func (c *Client) Head(ctx context.Context, epoch uint64) (*Head, error) {
+	params := url.Values{}
+	if epoch != 0 {
+		params.Set("epoch", strconv.FormatUint(epoch, 10))
+	}
+	head := &Head{}
+	if err := c.get(ctx, "head", params, head); err != nil {
+		return nil, err
+	}
+	return head, nil
+}
+
+// Tree returns a page of SMT nodes with a row ID in (after,upTo].
+func (c *Client) Tree(ctx context.Context, after, upTo uint64, limit int) (*TreeNodes, error) {
+	params := url.Values{}
+	params.Set("after", strconv.FormatUint(after, 10))
+	params.Set("upto", strconv.FormatUint(upTo, 10))
+	params.Set("limit", strconv.Itoa(limit))
+	page := &TreeNodes{}
+	if err := c.get(ctx, "tree", params, page); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// Domains returns a page of the domains modified by the epochs in (from,to], or of all
+// domains if from is zero.
+func (c *Client) Domains(
+	ctx context.Context,
+	from, to uint64,
+	after *common.SHA256Output,
+	limit int,
+) ([]DomainUpdate, error) {
+
+	params := url.Values{}
+	params.Set("from", strconv.FormatUint(from, 10))
+	params.Set("to", strconv.FormatUint(to, 10))
+	params.Set("limit", strconv.Itoa(limit))
+	if after != nil {
+		params.Set("after", hex.EncodeToString(after[:]))
+	}
+	var updates []DomainUpdate
+	if err := c.get(ctx, "domains", params, &updates); err != nil {
+		return nil, err
+	}
+	return updates, nil
+}
+
+// Certificates returns the certificates with the IDs. Missing ones are skipped.
+func (c *Client) Certificates(ctx context.Context, ids []common.SHA256Output,
+) ([]Payload, error) {
+	return c.payloads(ctx, "certs", ids)
+}
+
+// Policies returns the policies with the IDs. Missing ones are skipped.
+func (c *Client) Policies(ctx context.Context, ids []common.SHA256Output) ([]Payload, error) {
+	return c.payloads(ctx, "policies", ids)
+}
+
+func (c *Client) payloads(ctx context.Context, path string, ids []common.SHA256Output,
+) ([]Payload, error) {
+
+	raw := make([][]byte, len(ids))
+	for i := range ids {
+		raw[i] = ids[i][:]
+	}
+	body, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		c.BaseURL+SyncPathPrefix+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	var payloads []Payload
+	if err := c.do(req, &payloads); err != nil {
+		return nil, err
+	}
+	return payloads, nil
+}
+
+func (c *Client) get(ctx context.Context, path string, params url.Values, v any) error {
+	u := c.BaseURL + SyncPathPrefix + path
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	return c.do(req, v)
+}
+
+func (c *Client) do(req *http.Request, v any) error {
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("calling primary: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return fmt.Errorf("%s: %w", req.URL.Path, ErrNotFound)
+	default:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("primary returned %s for %s: %s",
+			resp.Status, req.URL.Path, strings.TrimSpace(string(msg)))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("decoding response of %s: %w", req.URL.Path, err)
+	}
+	return nil
+}
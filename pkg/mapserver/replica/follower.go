@@ -0,0 +1,387 @@
+package replica
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/common/crypto"
+	"github.com/netsec-ethz/fpki/pkg/db"
+	"github.com/netsec-ethz/fpki/pkg/mapserver/trie"
+	"github.com/netsec-ethz/fpki/pkg/mapserver/updater"
+)
+
+// ErrPrimaryBusy is returned by Follower.Check when the primary is in the middle of an update.
+var ErrPrimaryBusy = errors.New("primary is updating")
+
+// Follower applies the epochs of a primary into the DB of a replica.
+type Follower struct {
+	Conn   db.Conn
+	Client *Client
+	// PublicKey verifies the signed roots of the primary.
+	PublicKey *rsa.PublicKey
+	PageSize  int
+}
+
+// NewFollower returns a Follower that writes into conn the epochs obtained with client.
+func NewFollower(conn db.Conn, client *Client, publicKey *rsa.PublicKey) *Follower {
+	return &Follower{
+		Conn:      conn,
+		Client:    client,
+		PublicKey: publicKey,
+		PageSize:  DefaultPageSize,
+	}
+}
+
+// Check returns the verified head of the latest epoch of the primary, and whether the replica
+// must apply it. It returns an error if the replica diverged from the primary, or
+// ErrPrimaryBusy if the primary is updating and the replica is not at its latest epoch.
+func (f *Follower) Check(ctx context.Context) (*Head, bool, error) {
+	head, err := f.Client.Head(ctx, 0)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, false, fmt.Errorf("the primary has not recorded any epoch yet")
+		}
+		return nil, false, fmt.Errorf("obtaining head of primary: %w", err)
+	}
+	if err := f.verifyHead(head); err != nil {
+		return nil, false, err
+	}
+	local, err := f.Conn.LastEpoch(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	if local != nil && local.Number == head.Epoch {
+		if !bytes.Equal(local.Root[:], head.Root) {
+			return nil, false, fmt.Errorf("replica diverged from primary at epoch %d",
+				local.Number)
+		}
+		return head, false, nil
+	}
+	if head.Busy {
+		return nil, false, ErrPrimaryBusy
+	}
+
+	if local == nil {
+		// Only an empty replica, or one that failed its initial sync, can sync from scratch.
+		root, err := f.Conn.LoadRoot(ctx)
+		if err != nil {
+			return nil, false, err
+		}
+		if root != nil {
+			return nil, false, fmt.Errorf("the replica DB contains a map without epochs, " +
+				"it must be recreated empty")
+		}
+		return head, true, nil
+	}
+	if local.Number > head.Epoch {
+		return nil, false, fmt.Errorf("replica is at epoch %d, ahead of primary at epoch %d",
+			local.Number, head.Epoch)
+	}
+
+	// The primary must still have our epoch, with the same root.
+	previous, err := f.Client.Head(ctx, local.Number)
+	if err != nil {
+		return nil, false, fmt.Errorf("obtaining epoch %d from primary: %w", local.Number, err)
+	}
+	if !bytes.Equal(previous.Root, local.Root[:]) || previous.TreeID != local.TreeID {
+		return nil, false, fmt.Errorf("replica diverged from primary at epoch %d", local.Number)
+	}
+	return head, true, nil
+}
+
+// Apply brings the replica DB to the epoch of head, which must have been returned by Check.
+// The new root and epoch are saved only if the Merkle proofs of all modified domains verify
+// against the signed root of head. If Apply fails, the replica DB keeps its previous epoch and
+// the next Apply continues from it.
+// A replica without epochs receives all the domains of the primary, not only those listed by
+// its epochs, which miss the domains the primary had before it recorded epochs.
+func (f *Follower) Apply(ctx context.Context, head *Head) (*db.Epoch, error) {
+	local, err := f.Conn.LastEpoch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var fromEpoch, fromTreeID uint64
+	if local != nil {
+		fromEpoch, fromTreeID = local.Number, local.TreeID
+	}
+	if local == nil {
+		fmt.Printf("replica [%s]: syncing all domains up to epoch %d\n",
+			time.Now().Format(time.Stamp), head.Epoch)
+	} else {
+		fmt.Printf("replica [%s]: syncing epochs (%d,%d]\n", time.Now().Format(time.Stamp),
+			fromEpoch, head.Epoch)
+	}
+
+	if err := f.syncDomains(ctx, fromEpoch, head.Epoch); err != nil {
+		return nil, fmt.Errorf("syncing domains: %w", err)
+	}
+	if err := f.syncTree(ctx, fromTreeID, head.TreeID); err != nil {
+		return nil, fmt.Errorf("syncing SMT nodes: %w", err)
+	}
+	if err := updater.CoalescePayloadsForDirtyDomains(ctx, f.Conn); err != nil {
+		return nil, fmt.Errorf("coalescing payloads: %w", err)
+	}
+	root := (common.SHA256Output)(head.Root)
+	if err := f.verifyDirty(ctx, root); err != nil {
+		return nil, err
+	}
+
+	epoch := &db.Epoch{
+		Number: head.Epoch,
+		Root:   root,
+		TreeID: head.TreeID,
+	}
+	// The root and epoch are saved together: a replica with a root but no epoch cannot sync.
+	if err := f.Conn.SaveEpoch(ctx, epoch); err != nil {
+		return nil, err
+	}
+	if err := f.Conn.CleanupDirty(ctx); err != nil {
+		return nil, fmt.Errorf("cleaning up dirty domains: %w", err)
+	}
+	fmt.Printf("replica [%s]: at epoch %d with root %x\n", time.Now().Format(time.Stamp),
+		epoch.Number, epoch.Root)
+	return epoch, nil
+}
+
+func (f *Follower) verifyHead(head *Head) error {
+	if len(head.Root) != common.SHA256Size {
+		return fmt.Errorf("primary sent an invalid root %x", head.Root)
+	}
+	if err := crypto.VerifySignedBytes(head.Root, head.SignedTreeHead, f.PublicKey); err != nil {
+		return fmt.Errorf("verifying signed tree head of primary: %w", err)
+	}
+	return nil
+}
+
+// syncDomains stores the state in the primary of the domains modified by the epochs in
+// (from,to], or of all its domains if from is zero, and marks them as dirty.
+func (f *Follower) syncDomains(ctx context.Context, from, to uint64) error {
+	var after *common.SHA256Output
+	for {
+		updates, err := f.Client.Domains(ctx, from, to, after, f.PageSize)
+		if err != nil {
+			return err
+		}
+		if len(updates) == 0 {
+			return nil
+		}
+
+		ids := make([]common.SHA256Output, len(updates))
+		var namedIDs []common.SHA256Output
+		var names []string
+		var certs, policies []db.DomainAssociation
+		var certIDs, policyIDs []common.SHA256Output
+		for i, u := range updates {
+			if len(u.DomainID) != common.SHA256Size ||
+				len(u.CertIDs)%common.SHA256Size != 0 ||
+				len(u.PolicyIDs)%common.SHA256Size != 0 {
+
+				return fmt.Errorf("primary sent an invalid domain %x", u.DomainID)
+			}
+			ids[i] = (common.SHA256Output)(u.DomainID)
+			if u.DomainName != "" {
+				namedIDs = append(namedIDs, ids[i])
+				names = append(names, u.DomainName)
+			}
+			for _, id := range common.BytesToIDs(u.CertIDs) {
+				certs = append(certs, db.DomainAssociation{DomainID: ids[i], ID: id})
+				certIDs = append(certIDs, id)
+			}
+			for _, id := range common.BytesToIDs(u.PolicyIDs) {
+				policies = append(policies, db.DomainAssociation{DomainID: ids[i], ID: id})
+				policyIDs = append(policyIDs, id)
+			}
+		}
+
+		// Payloads first, so that the associations never point to missing ones.
+		err = f.syncPayloads(ctx, certIDs, f.Conn.CheckCertsExist, f.Client.Certificates,
+			f.Conn.UpdateCerts)
+		if err != nil {
+			return fmt.Errorf("syncing certificates: %w", err)
+		}
+		err = f.syncPayloads(ctx, policyIDs, f.Conn.CheckPoliciesExist, f.Client.Policies,
+			func(ctx context.Context, ids []common.SHA256Output, parents []*common.SHA256Output,
+				expirations []time.Time, payloads [][]byte, _ []*db.CertificateEntry) error {
+
+				return f.Conn.UpdatePolicies(ctx, ids, parents, expirations, payloads)
+			})
+		if err != nil {
+			return fmt.Errorf("syncing policies: %w", err)
+		}
+		if len(namedIDs) > 0 {
+			if err := f.Conn.UpdateDomains(ctx, namedIDs, names); err != nil {
+				return err
+			}
+		}
+		if err := f.Conn.ReplaceDomainAssociations(ctx, ids, certs, policies); err != nil {
+			return err
+		}
+		if err := f.Conn.InsertDomainsIntoDirty(ctx, ids); err != nil {
+			return err
+		}
+		after = &ids[len(ids)-1]
+	}
+}
+
+// syncPayloads fetches from the primary the certificates or policies missing in the replica,
+// and their missing ancestors.
+func (f *Follower) syncPayloads(
+	ctx context.Context,
+	ids []common.SHA256Output,
+	exist func(context.Context, []common.SHA256Output) ([]bool, error),
+	fetch func(context.Context, []common.SHA256Output) ([]Payload, error),
+	update func(context.Context, []common.SHA256Output, []*common.SHA256Output, []time.Time,
+		[][]byte, []*db.CertificateEntry) error,
+) error {
+
+	for len(ids) > 0 {
+		n := min(len(ids), f.PageSize)
+		batch := ids[:n]
+		ids = ids[n:]
+
+		present, err := exist(ctx, batch)
+		if err != nil {
+			return err
+		}
+		missing := make(map[common.SHA256Output]struct{})
+		var request []common.SHA256Output
+		for i, id := range batch {
+			if _, ok := missing[id]; !present[i] && !ok {
+				missing[id] = struct{}{}
+				request = append(request, id)
+			}
+		}
+		if len(request) == 0 {
+			continue
+		}
+
+		payloads, err := fetch(ctx, request)
+		if err != nil {
+			return err
+		}
+		newIDs := make([]common.SHA256Output, 0, len(payloads))
+		parents := make([]*common.SHA256Output, 0, len(payloads))
+		expirations := make([]time.Time, 0, len(payloads))
+		data := make([][]byte, 0, len(payloads))
+		entries := make([]*db.CertificateEntry, 0, len(payloads))
+		for _, p := range payloads {
+			id := common.SHA256Hash32Bytes(p.Payload)
+			if !bytes.Equal(id[:], p.ID) {
+				return fmt.Errorf("primary sent payload with ID %x that hashes to %x", p.ID, id)
+			}
+			if _, ok := missing[id]; !ok {
+				return fmt.Errorf("primary sent unrequested payload %x", id)
+			}
+			delete(missing, id)
+
+			var parent *common.SHA256Output
+			if p.ParentID != nil {
+				if len(p.ParentID) != common.SHA256Size {
+					return fmt.Errorf("primary sent invalid parent of %x", id)
+				}
+				parent = (*common.SHA256Output)(p.ParentID)
+				// The parent may also be missing.
+				ids = append(ids, *parent)
+			}
+			entry, err := p.Entry.certificateEntry()
+			if err != nil {
+				return fmt.Errorf("primary sent payload %x: %w", id, err)
+			}
+			newIDs = append(newIDs, id)
+			parents = append(parents, parent)
+			expirations = append(expirations, p.Expiration)
+			data = append(data, p.Payload)
+			entries = append(entries, entry)
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("primary does not have %d of the requested payloads", len(missing))
+		}
+		if err := update(ctx, newIDs, parents, expirations, data, entries); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncTree stores the SMT nodes of the primary with a row ID in (after,upTo].
+func (f *Follower) syncTree(ctx context.Context, after, upTo uint64) error {
+	for after < upTo {
+		page, err := f.Client.Tree(ctx, after, upTo, f.PageSize)
+		if err != nil {
+			return err
+		}
+		if len(page.Nodes) == 0 {
+			return nil
+		}
+		nodes := make([]*db.TreeNodeRecord, len(page.Nodes))
+		for i, n := range page.Nodes {
+			if len(n.Key) != common.SHA256Size {
+				return fmt.Errorf("primary sent an invalid SMT node key %x", n.Key)
+			}
+			nodes[i] = &db.TreeNodeRecord{
+				Key:   (common.SHA256Output)(n.Key),
+				Value: n.Value,
+			}
+		}
+		if _, err := f.Conn.UpdateTreeNodes(ctx, nodes); err != nil {
+			return err
+		}
+		if page.Last <= after {
+			return fmt.Errorf("primary sent SMT nodes out of order")
+		}
+		after = page.Last
+	}
+	return nil
+}
+
+// verifyDirty checks that the recomputed payload of each dirty domain is the one proven by
+// the SMT of the replica with the passed root.
+func (f *Follower) verifyDirty(ctx context.Context, root common.SHA256Output) error {
+	smt, err := trie.NewTrie(root[:], common.SHA256Hash, f.Conn)
+	if err != nil {
+		return fmt.Errorf("loading SMT: %w", err)
+	}
+
+	var cursor *db.DirtyDomainEntriesCursor
+	for {
+		entries, next, done, err := f.Conn.RetrieveDomainEntriesDirtyBundle(ctx, cursor,
+			uint64(f.PageSize))
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := verifyEntry(ctx, smt, root[:], e); err != nil {
+				return err
+			}
+		}
+		if done || len(entries) == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+func verifyEntry(ctx context.Context, smt *trie.Trie, root []byte, e db.DomainEntryRecord) error {
+	proof, isPoP, proofKey, proofValue, err := smt.MerkleProof(ctx, e.DomainID[:])
+	if err != nil {
+		return fmt.Errorf("obtaining proof for domain %x: %w", e.DomainID, err)
+	}
+	if len(e.Payload) == 0 {
+		if isPoP || !trie.VerifyNonInclusion(root, proof, e.DomainID[:], proofValue, proofKey) {
+			return fmt.Errorf("domain %x should not be in the map with root %x", e.DomainID, root)
+		}
+		return nil
+	}
+	value := common.SHA256Hash(e.Payload)
+	if !isPoP || !bytes.Equal(proofValue, value) ||
+		!trie.VerifyInclusion(root, proof, e.DomainID[:], value) {
+
+		return fmt.Errorf("domain %x does not match the map with root %x", e.DomainID, root)
+	}
+	return nil
+}
@@ -0,0 +1,308 @@
+package replica
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/common/crypto"
+	"github.com/netsec-ethz/fpki/pkg/db"
+)
+
+// SyncPathPrefix is the prefix of all the paths of the sync API.
+const SyncPathPrefix = "/sync/"
+
+// handlerTimeout bounds the DB work of each request to the sync API.
+const handlerTimeout = time.Minute
+
+type syncHandler struct {
+	conn  db.Conn
+	key   *rsa.PrivateKey
+	token string
+}
+
+// NewSyncHandler returns the handler of the sync API of a primary map server.
+// Every request must carry the header "Authorization: Bearer <token>". The roots of the
+// epochs are signed with key.
+func NewSyncHandler(conn db.Conn, key *rsa.PrivateKey, token string) http.Handler {
+	h := &syncHandler{
+		conn:  conn,
+		key:   key,
+		token: token,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(SyncPathPrefix+"head", h.apiHead)
+	mux.HandleFunc(SyncPathPrefix+"tree", h.apiTree)
+	mux.HandleFunc(SyncPathPrefix+"domains", h.apiDomains)
+	mux.HandleFunc(SyncPathPrefix+"certs", func(w http.ResponseWriter, r *http.Request) {
+		h.apiPayloads(w, r, h.conn.RetrieveCertificateRecords)
+	})
+	mux.HandleFunc(SyncPathPrefix+"policies", func(w http.ResponseWriter, r *http.Request) {
+		h.apiPayloads(w, r, h.conn.RetrievePolicyRecords)
+	})
+	return h.authenticate(mux)
+}
+
+func (h *syncHandler) authenticate(next http.Handler) http.Handler {
+	expected := []byte("Bearer " + h.token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if h.token == "" || subtle.ConstantTimeCompare(got, expected) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// apiHead returns the Head of the latest epoch, or of the one in the "epoch" parameter.
+func (h *syncHandler) apiHead(w http.ResponseWriter, r *http.Request) {
+	ctx, cancelF := context.WithTimeout(r.Context(), handlerTimeout)
+	defer cancelF()
+
+	var epoch *db.Epoch
+	var err error
+	if number := r.URL.Query().Get("epoch"); number != "" {
+		n, perr := strconv.ParseUint(number, 10, 64)
+		if perr != nil {
+			http.Error(w, "invalid epoch", http.StatusBadRequest)
+			return
+		}
+		epoch, err = h.conn.RetrieveEpoch(ctx, n)
+	} else {
+		epoch, err = h.conn.LastEpoch(ctx)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if epoch == nil {
+		http.Error(w, "epoch not found", http.StatusNotFound)
+		return
+	}
+	dirty, err := h.conn.DirtyCount(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sth, err := crypto.SignBytes(epoch.Root[:], h.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, Head{
+		Epoch:          epoch.Number,
+		Root:           epoch.Root[:],
+		TreeID:         epoch.TreeID,
+		SignedTreeHead: sth,
+		Busy:           dirty != 0,
+	})
+}
+
+// apiTree returns the SMT nodes with a row ID in ("after","upto"].
+func (h *syncHandler) apiTree(w http.ResponseWriter, r *http.Request) {
+	ctx, cancelF := context.WithTimeout(r.Context(), handlerTimeout)
+	defer cancelF()
+
+	after, err1 := strconv.ParseUint(r.URL.Query().Get("after"), 10, 64)
+	upTo, err2 := strconv.ParseUint(r.URL.Query().Get("upto"), 10, 64)
+	limit, err3 := parseLimit(r)
+	if err1 != nil || err2 != nil || err3 != nil {
+		http.Error(w, "invalid parameters", http.StatusBadRequest)
+		return
+	}
+
+	nodes, last, err := h.conn.RetrieveTreeNodesPage(ctx, after, upTo, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	page := TreeNodes{
+		Nodes: make([]TreeNode, len(nodes)),
+		Last:  last,
+	}
+	for i, n := range nodes {
+		page.Nodes[i] = TreeNode{Key: n.Key[:], Value: n.Value}
+	}
+	writeJSON(w, page)
+}
+
+// apiDomains returns the domains modified by the epochs in ("from","to"], sorted by ID and
+// starting after the hex encoded ID "after". If "from" is zero, all the domains are returned.
+func (h *syncHandler) apiDomains(w http.ResponseWriter, r *http.Request) {
+	ctx, cancelF := context.WithTimeout(r.Context(), handlerTimeout)
+	defer cancelF()
+
+	from, err1 := strconv.ParseUint(r.URL.Query().Get("from"), 10, 64)
+	to, err2 := strconv.ParseUint(r.URL.Query().Get("to"), 10, 64)
+	limit, err3 := parseLimit(r)
+	if err1 != nil || err2 != nil || err3 != nil {
+		http.Error(w, "invalid parameters", http.StatusBadRequest)
+		return
+	}
+	var after *common.SHA256Output
+	if hexID := r.URL.Query().Get("after"); hexID != "" {
+		id, err := parseID(hexID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		after = &id
+	}
+
+	updates, err := h.domainUpdates(ctx, from, to, after, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, updates)
+}
+
+func (h *syncHandler) domainUpdates(
+	ctx context.Context,
+	from, to uint64,
+	after *common.SHA256Output,
+	limit int,
+) ([]DomainUpdate, error) {
+
+	var ids []common.SHA256Output
+	names := make(map[common.SHA256Output]string)
+	if from == 0 {
+		domains, err := h.conn.RetrieveDomainsPage(ctx, after, limit)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range domains {
+			ids = append(ids, d.DomainID)
+			names[d.DomainID] = d.DomainName
+		}
+	} else {
+		var err error
+		ids, err = h.conn.RetrieveEpochDomainsPage(ctx, from, to, after, limit)
+		if err != nil {
+			return nil, err
+		}
+		domains, err := h.conn.RetrieveDomains(ctx, ids)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range domains {
+			names[d.DomainID] = d.DomainName
+		}
+	}
+
+	certs, policies, err := h.conn.RetrieveDomainAssociations(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	updates := make([]DomainUpdate, len(ids))
+	index := make(map[common.SHA256Output]*DomainUpdate, len(ids))
+	for i, id := range ids {
+		updates[i] = DomainUpdate{
+			DomainID:   id[:],
+			DomainName: names[id],
+		}
+		index[id] = &updates[i]
+	}
+	for _, a := range certs {
+		u := index[a.DomainID]
+		u.CertIDs = append(u.CertIDs, a.ID[:]...)
+	}
+	for _, a := range policies {
+		u := index[a.DomainID]
+		u.PolicyIDs = append(u.PolicyIDs, a.ID[:]...)
+	}
+	return updates, nil
+}
+
+// apiPayloads expects a POST request with a JSON list of IDs, and returns the rows with
+// those IDs. Missing IDs are skipped.
+func (h *syncHandler) apiPayloads(
+	w http.ResponseWriter,
+	r *http.Request,
+	retrieve func(context.Context, []common.SHA256Output) ([]*db.PayloadRecord, error),
+) {
+
+	ctx, cancelF := context.WithTimeout(r.Context(), handlerTimeout)
+	defer cancelF()
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "expected POST", http.StatusMethodNotAllowed)
+		return
+	}
+	var raw [][]byte
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<22)).Decode(&raw); err != nil {
+		http.Error(w, "invalid list of IDs", http.StatusBadRequest)
+		return
+	}
+	if len(raw) > MaxPageSize {
+		http.Error(w, "too many IDs", http.StatusBadRequest)
+		return
+	}
+	ids := make([]common.SHA256Output, len(raw))
+	for i, id := range raw {
+		if len(id) != common.SHA256Size {
+			http.Error(w, "invalid ID", http.StatusBadRequest)
+			return
+		}
+		ids[i] = (common.SHA256Output)(id)
+	}
+
+	records, err := retrieve(ctx, ids)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	payloads := make([]Payload, 0, len(records))
+	for _, rec := range records {
+		if rec == nil {
+			continue
+		}
+		p := Payload{
+			ID:         rec.ID[:],
+			Expiration: rec.Expiration,
+			Payload:    rec.Payload,
+			Entry:      newEntry(rec.Entry),
+		}
+		if rec.ParentID != nil {
+			p.ParentID = rec.ParentID[:]
+		}
+		payloads = append(payloads, p)
+	}
+	writeJSON(w, payloads)
+}
+
+func parseLimit(r *http.Request) (int, error) {
+	str := r.URL.Query().Get("limit")
+	if str == "" {
+		return DefaultPageSize, nil
+	}
+	limit, err := strconv.Atoi(str)
+	if err != nil || limit <= 0 || limit > MaxPageSize {
+		return 0, fmt.Errorf("invalid limit")
+	}
+	return limit, nil
+}
+
+func parseID(hexID string) (common.SHA256Output, error) {
+	b, err := hex.DecodeString(hexID)
+	if err != nil || len(b) != common.SHA256Size {
+		return common.SHA256Output{}, fmt.Errorf("invalid ID %q", hexID)
+	}
+	return (common.SHA256Output)(b), nil
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
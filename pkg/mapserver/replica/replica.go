@@ -0,0 +1,117 @@
+// Package replica lets a read-only map server follow a primary one.
+//
+// The primary records an epoch each time it updates its SMT, together with the domains that
+// the update modified (see db.Conn.RecordEpoch). It exposes them through an authenticated sync
+// API, served by the handler returned by NewSyncHandler. A replica uses a Follower to pull,
+// for all the epochs since its last one, the modified domains with their certificate and
+// policy associations, the missing certificates and policies, the SMT nodes written to the
+// tree table, and the signed root of the latest epoch. The replica recomputes the payloads of
+// the modified domains and verifies a Merkle proof for each of them against the signed root,
+// before making the new epoch its own.
+//
+// A replica starting from an empty DB receives the complete map, including the domains that the
+// primary had before it recorded epochs. The stale SMT nodes that the primary deletes are not
+// deleted in the replica.
+package replica
+
+import (
+	"fmt"
+	"time"
+
+	ct "github.com/google/certificate-transparency-go"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/db"
+)
+
+const (
+	// DefaultPageSize is the number of rows requested per call to the sync API.
+	DefaultPageSize = 1000
+	// MaxPageSize is the maximum number of rows the sync API returns per call.
+	MaxPageSize = 10_000
+)
+
+// Head describes an epoch of the primary.
+type Head struct {
+	Epoch  uint64
+	Root   []byte
+	TreeID uint64
+	// SignedTreeHead is the signature of Root by the primary's key.
+	SignedTreeHead []byte
+	// Busy is true if the primary is in the middle of an update.
+	Busy bool
+}
+
+// TreeNodes is a page of rows of the tree table.
+type TreeNodes struct {
+	Nodes []TreeNode
+	// Last is the row ID of the last node, to be used to request the next page.
+	Last uint64
+}
+
+// TreeNode is one SMT node.
+type TreeNode struct {
+	Key   []byte
+	Value []byte
+}
+
+// DomainUpdate contains the state of a modified domain in the primary. A domain removed from
+// the primary has no name and no associations.
+type DomainUpdate struct {
+	DomainID   []byte
+	DomainName string `json:",omitempty"`
+	// CertIDs are the IDs of the certificates of the domain, one after another.
+	CertIDs []byte `json:",omitempty"`
+	// PolicyIDs are the IDs of the policies of the domain, one after another.
+	PolicyIDs []byte `json:",omitempty"`
+}
+
+// Payload is a row of the certs or policies table. Entry is only set for the leaf certificates
+// whose CT log entry is known, as the replica needs it to compute the payloads of their domains.
+type Payload struct {
+	ID         []byte
+	ParentID   []byte `json:",omitempty"`
+	Expiration time.Time
+	Payload    []byte
+	Entry      *Entry `json:",omitempty"`
+}
+
+// Entry is the db.CertificateEntry of a leaf certificate.
+type Entry struct {
+	Type          ct.LogEntryType
+	TBSID         []byte
+	IssuerKeyHash []byte `json:",omitempty"`
+}
+
+func newEntry(e *db.CertificateEntry) *Entry {
+	if e == nil {
+		return nil
+	}
+	entry := &Entry{
+		Type:  e.Type,
+		TBSID: e.TBSID[:],
+	}
+	if e.IssuerKeyHash != nil {
+		entry.IssuerKeyHash = e.IssuerKeyHash[:]
+	}
+	return entry
+}
+
+// certificateEntry returns the db.CertificateEntry of the entry, which may be nil.
+func (e *Entry) certificateEntry() (*db.CertificateEntry, error) {
+	if e == nil {
+		return nil, nil
+	}
+	if len(e.TBSID) != common.SHA256Size ||
+		e.IssuerKeyHash != nil && len(e.IssuerKeyHash) != common.SHA256Size {
+		return nil, fmt.Errorf("invalid certificate entry")
+	}
+	entry := &db.CertificateEntry{
+		Type:  e.Type,
+		TBSID: (common.SHA256Output)(e.TBSID),
+	}
+	if e.IssuerKeyHash != nil {
+		entry.IssuerKeyHash = (*common.SHA256Output)(e.IssuerKeyHash)
+	}
+	return entry, nil
+}
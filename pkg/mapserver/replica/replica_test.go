@@ -0,0 +1,300 @@
+package replica
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/common/crypto"
+	"github.com/netsec-ethz/fpki/pkg/db"
+	"github.com/netsec-ethz/fpki/pkg/db/embedded"
+	mapCommon "github.com/netsec-ethz/fpki/pkg/mapserver/common"
+	"github.com/netsec-ethz/fpki/pkg/mapserver/prover"
+	"github.com/netsec-ethz/fpki/pkg/mapserver/responder"
+	"github.com/netsec-ethz/fpki/pkg/tests/noopdb"
+	"github.com/netsec-ethz/fpki/pkg/tests/random"
+	"github.com/netsec-ethz/fpki/pkg/tests/testdb"
+	tup "github.com/netsec-ethz/fpki/pkg/tests/updater"
+)
+
+// TestSyncHandlerAuth checks that the sync API rejects requests without the right token.
+func TestSyncHandlerAuth(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	cases := map[string]struct {
+		token    string
+		header   string
+		expected int
+	}{
+		"no_header": {
+			token:    "secret",
+			expected: http.StatusUnauthorized,
+		},
+		"wrong_token": {
+			token:    "secret",
+			header:   "Bearer other",
+			expected: http.StatusUnauthorized,
+		},
+		"disabled": {
+			token:    "",
+			header:   "Bearer ",
+			expected: http.StatusUnauthorized,
+		},
+		"authorized": {
+			token:    "secret",
+			header:   "Bearer secret",
+			expected: http.StatusNotFound, // The noop DB has no epochs.
+		},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			h := NewSyncHandler(&noopdb.Conn{}, key, tc.token)
+			req := httptest.NewRequest(http.MethodGet, SyncPathPrefix+"head", nil)
+			if tc.header != "" {
+				req.Header.Set("Authorization", tc.header)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			require.Equal(t, tc.expected, w.Code)
+		})
+	}
+}
+
+// TestFollowPrimary checks that a replica reaches the root of the primary, first from an
+// empty DB and then incrementally, and that its responder returns valid proofs.
+func TestFollowPrimary(t *testing.T) {
+	random.Seed(1)
+
+	ctx, cancelF := context.WithTimeout(context.Background(), time.Minute)
+	defer cancelF()
+
+	// Configure the DB of the primary.
+	config, removeF := testdb.ConfigureTestDB(t)
+	defer removeF()
+	conn := testdb.Connect(t, config)
+	defer conn.Close()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	server := httptest.NewServer(NewSyncHandler(conn, key, "secret"))
+	defer server.Close()
+
+	tup.UpdateDBwithRandomCerts(ctx, t, conn,
+		[]string{"a.com", "b.com"},
+		[]tup.CertsPoliciesOrBoth{tup.BothCertsAndPolicies, tup.CertsOnly})
+	epoch, err := conn.LastEpoch(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, epoch)
+
+	t.Run("replica", func(t *testing.T) {
+		config, removeF := testdb.ConfigureTestDB(t)
+		defer removeF()
+		replicaConn := testdb.Connect(t, config)
+		defer replicaConn.Close()
+
+		// Wrong token.
+		f := NewFollower(replicaConn, NewClient(server.URL, "other"), &key.PublicKey)
+		_, _, err := f.Check(ctx)
+		require.Error(t, err)
+
+		// Initial sync, with a small page size.
+		f = NewFollower(replicaConn, NewClient(server.URL, "secret"), &key.PublicKey)
+		f.PageSize = 2
+		sync := func() {
+			head, pending, err := f.Check(ctx)
+			require.NoError(t, err)
+			require.True(t, pending)
+			_, err = f.Apply(ctx, head)
+			require.NoError(t, err)
+
+			_, pending, err = f.Check(ctx)
+			require.NoError(t, err)
+			require.False(t, pending)
+		}
+		sync()
+		requireSameEpoch(ctx, t, conn, replicaConn)
+
+		// Update the primary and sync incrementally.
+		tup.UpdateDBwithRandomCerts(ctx, t, conn,
+			[]string{"c.com", "a.com"},
+			[]tup.CertsPoliciesOrBoth{tup.PoliciesOnly, tup.CertsOnly})
+		sync()
+		requireSameEpoch(ctx, t, conn, replicaConn)
+
+		// The replica serves valid proofs with the signed root of the primary.
+		head, _, err := f.Check(ctx)
+		require.NoError(t, err)
+		resp, err := responder.NewReplicaMapResponder(ctx, replicaConn, head.SignedTreeHead)
+		require.NoError(t, err)
+		for _, name := range []string{"a.com", "b.com", "c.com"} {
+			proofs, err := resp.GetProof(ctx, name)
+			require.NoError(t, err)
+			last := proofs[len(proofs)-1]
+			require.Equal(t, mapCommon.PoP, last.PoI.ProofType)
+			for _, proof := range proofs {
+				_, ok, err := prover.VerifyProofByDomain(proof)
+				require.NoError(t, err)
+				require.True(t, ok)
+				err = crypto.VerifySignedBytes(proof.PoI.Root, proof.TreeHeadSig, &key.PublicKey)
+				require.NoError(t, err)
+			}
+		}
+	})
+}
+
+// TestApplyRetry checks that a replica whose epoch failed to be saved keeps its previous state,
+// and that applying again reaches the root of the primary.
+func TestApplyRetry(t *testing.T) {
+	random.Seed(1)
+
+	ctx, cancelF := context.WithTimeout(context.Background(), time.Minute)
+	defer cancelF()
+
+	conn, err := embedded.Connect(db.NewConfig(embedded.WithDirectory(t.TempDir())))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	server := httptest.NewServer(NewSyncHandler(conn, key, "secret"))
+	defer server.Close()
+
+	tup.UpdateDBwithRandomCerts(ctx, t, conn,
+		[]string{"a.com", "b.com"},
+		[]tup.CertsPoliciesOrBoth{tup.BothCertsAndPolicies, tup.CertsOnly})
+
+	replicaConn, err := embedded.Connect(db.NewConfig(embedded.WithDirectory(t.TempDir())))
+	require.NoError(t, err)
+	defer replicaConn.Close()
+	failing := &failingEpochConn{Conn: replicaConn, fail: true}
+	f := NewFollower(failing, NewClient(server.URL, "secret"), &key.PublicKey)
+
+	// The failed initial sync leaves the replica without root nor epoch.
+	head, pending, err := f.Check(ctx)
+	require.NoError(t, err)
+	require.True(t, pending)
+	_, err = f.Apply(ctx, head)
+	require.ErrorIs(t, err, errInjected)
+	root, err := replicaConn.LoadRoot(ctx)
+	require.NoError(t, err)
+	require.Nil(t, root)
+	epoch, err := replicaConn.LastEpoch(ctx)
+	require.NoError(t, err)
+	require.Nil(t, epoch)
+
+	// Retrying syncs the replica.
+	head, pending, err = f.Check(ctx)
+	require.NoError(t, err)
+	require.True(t, pending)
+	_, err = f.Apply(ctx, head)
+	require.NoError(t, err)
+	requireSameEpoch(ctx, t, conn, replicaConn)
+}
+
+var errInjected = errors.New("injected failure")
+
+// failingEpochConn fails to save the next epoch if fail is set.
+type failingEpochConn struct {
+	db.Conn
+	fail bool
+}
+
+func (c *failingEpochConn) SaveEpoch(ctx context.Context, epoch *db.Epoch) error {
+	if c.fail {
+		c.fail = false
+		return errInjected
+	}
+	return c.Conn.SaveEpoch(ctx, epoch)
+}
+
+// requireSameEpoch checks that both DBs are at the same epoch, with the same root.
+func requireSameEpoch(ctx context.Context, t *testing.T, primary, replica db.Conn) {
+	expected, err := primary.LastEpoch(ctx)
+	require.NoError(t, err)
+	got, err := replica.LastEpoch(ctx)
+	require.NoError(t, err)
+	require.Equal(t, expected, got)
+
+	root, err := replica.LoadRoot(ctx)
+	require.NoError(t, err)
+	require.NotNil(t, root)
+	require.Equal(t, expected.Root, *root)
+
+	dirty, err := replica.DirtyCount(ctx)
+	require.NoError(t, err)
+	require.Zero(t, dirty)
+}
+
+// TestBootstrapFromPreEpochPrimary checks that a replica starting from an empty DB receives the
+// domains that the primary had before it started recording epochs, which no epoch lists.
+func TestBootstrapFromPreEpochPrimary(t *testing.T) {
+	random.Seed(1)
+
+	ctx, cancelF := context.WithTimeout(context.Background(), time.Minute)
+	defer cancelF()
+
+	conn, err := embedded.Connect(db.NewConfig(embedded.WithDirectory(t.TempDir())))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	server := httptest.NewServer(NewSyncHandler(conn, key, "secret"))
+	defer server.Close()
+
+	// The primary is updated without recording epochs, and then records its first one.
+	tup.UpdateDBwithRandomCerts(ctx, t, &preEpochConn{Conn: conn},
+		[]string{"a.com", "b.com"},
+		[]tup.CertsPoliciesOrBoth{tup.BothCertsAndPolicies, tup.CertsOnly})
+	epoch, err := conn.RecordEpoch(ctx)
+	require.NoError(t, err)
+	ids, err := conn.RetrieveEpochDomainsPage(ctx, 0, epoch.Number, nil, 10)
+	require.NoError(t, err)
+	require.Empty(t, ids)
+
+	replicaConn, err := embedded.Connect(db.NewConfig(embedded.WithDirectory(t.TempDir())))
+	require.NoError(t, err)
+	defer replicaConn.Close()
+	f := NewFollower(replicaConn, NewClient(server.URL, "secret"), &key.PublicKey)
+	f.PageSize = 2
+	head, pending, err := f.Check(ctx)
+	require.NoError(t, err)
+	require.True(t, pending)
+	_, err = f.Apply(ctx, head)
+	require.NoError(t, err)
+	requireSameEpoch(ctx, t, conn, replicaConn)
+
+	// The replica has the same domains, payloads and certificates as the primary.
+	expected, err := conn.CountRows(ctx)
+	require.NoError(t, err)
+	got, err := replicaConn.CountRows(ctx)
+	require.NoError(t, err)
+	require.Equal(t, expected, got)
+	for _, name := range []string{"a.com", "b.com"} {
+		id := common.SHA256Hash32Bytes([]byte(name))
+		expected, err := conn.RetrieveDomainEntries(ctx, []common.SHA256Output{id})
+		require.NoError(t, err)
+		require.NotEmpty(t, expected)
+		got, err := replicaConn.RetrieveDomainEntries(ctx, []common.SHA256Output{id})
+		require.NoError(t, err)
+		require.Equal(t, expected, got)
+	}
+}
+
+// preEpochConn does not record epochs, as the map servers before they were introduced.
+type preEpochConn struct {
+	db.Conn
+}
+
+func (*preEpochConn) RecordEpoch(context.Context) (*db.Epoch, error) {
+	return nil, nil
+}
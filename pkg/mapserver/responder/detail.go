@@ -0,0 +1,187 @@
+package responder
+
+import (
+	"context"
+	"fmt"
+
+	ct "github.com/google/certificate-transparency-go"
+	ctx509 "github.com/google/certificate-transparency-go/x509"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/db"
+	mapCommon "github.com/netsec-ethz/fpki/pkg/mapserver/common"
+	"github.com/netsec-ethz/fpki/pkg/util"
+)
+
+// GetCertificateDetail returns the parsed certificate identified by its ID, the chain of its
+// ancestors as recorded in the parent_id column, and the domains referencing it.
+// If the certificate is not present in the DB, it returns nil and no error.
+func (r *MapResponder) GetCertificateDetail(ctx context.Context, id common.SHA256Output,
+) (*mapCommon.CertificateDetail, error) {
+
+	records, err := walkParents(ctx, id, r.conn.RetrieveCertificateRecords)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving certificate chain: %w", err)
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	certs := make([]*ctx509.Certificate, len(records))
+	summaries := make([]mapCommon.CertificateSummary, len(records))
+	for i, rec := range records {
+		if certs[i], summaries[i], err = certificateSummary(rec); err != nil {
+			return nil, err
+		}
+	}
+	// The issuer key hash depends on the chain of the CT log entry, thus it is only known if
+	// it was stored when the certificate was ingested.
+	entryType := util.CertificateEntryType(certs[0])
+	if entry := records[0].Entry; entry != nil {
+		entryType = entry.Type
+		if entry.IssuerKeyHash != nil {
+			summaries[0].IssuerKeyHash = entry.IssuerKeyHash[:]
+		}
+	}
+	summaries[0].EntryType = "x509"
+	if entryType == ct.PrecertLogEntryType {
+		summaries[0].EntryType = "precert"
+	}
+
+	domains, err := r.conn.RetrieveCertificateDomains(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving domains of certificate: %w", err)
+	}
+
+	return &mapCommon.CertificateDetail{
+		Certificate: summaries[0],
+		Chain:       summaries[1:],
+		Domains:     domainReferences(domains),
+	}, nil
+}
+
+// GetPolicyDetail returns the parsed policy identified by its ID, the chain of its ancestors
+// as recorded in the parent_id column, and the domains referencing it.
+// If the policy is not present in the DB, it returns nil and no error.
+func (r *MapResponder) GetPolicyDetail(ctx context.Context, id common.SHA256Output,
+) (*mapCommon.PolicyDetail, error) {
+
+	records, err := walkParents(ctx, id, r.conn.RetrievePolicyRecords)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving policy chain: %w", err)
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	summaries := make([]mapCommon.PolicySummary, len(records))
+	for i, rec := range records {
+		if summaries[i], err = policySummary(rec); err != nil {
+			return nil, err
+		}
+	}
+
+	domains, err := r.conn.RetrievePolicyDomains(ctx, id)
+	if err != nil {
+		return nil, fmt.Errorf("retrieving domains of policy: %w", err)
+	}
+
+	return &mapCommon.PolicyDetail{
+		Policy:  summaries[0],
+		Chain:   summaries[1:],
+		Domains: domainReferences(domains),
+	}, nil
+}
+
+// walkParents retrieves the record identified by id and follows its parent_id until a record
+// without parent, or a parent missing in the DB, is found. A cycle is reported as an error.
+// The first element of the returned slice is the record identified by id.
+func walkParents(
+	ctx context.Context,
+	id common.SHA256Output,
+	retrieve func(context.Context, []common.SHA256Output) ([]*db.PayloadRecord, error),
+) ([]*db.PayloadRecord, error) {
+
+	var chain []*db.PayloadRecord
+	visited := make(map[common.SHA256Output]struct{})
+	for next := &id; next != nil; {
+		if _, ok := visited[*next]; ok {
+			return nil, fmt.Errorf("cycle in parent chain at %x", *next)
+		}
+		visited[*next] = struct{}{}
+
+		records, err := retrieve(ctx, []common.SHA256Output{*next})
+		if err != nil {
+			return nil, err
+		}
+		if len(records) == 0 || records[0] == nil {
+			break
+		}
+		chain = append(chain, records[0])
+		next = records[0].ParentID
+	}
+	return chain, nil
+}
+
+func certificateSummary(rec *db.PayloadRecord,
+) (*ctx509.Certificate, mapCommon.CertificateSummary, error) {
+
+	cert, err := ctx509.ParseCertificate(rec.Payload)
+	if err != nil {
+		return nil, mapCommon.CertificateSummary{},
+			fmt.Errorf("parsing certificate %x: %w", rec.ID, err)
+	}
+	return cert, mapCommon.CertificateSummary{
+		ID:           rec.ID,
+		ParentID:     rec.ParentID,
+		Expiration:   rec.Expiration,
+		Subject:      cert.Subject.String(),
+		Issuer:       cert.Issuer.String(),
+		SerialNumber: cert.SerialNumber.String(),
+		NotBefore:    cert.NotBefore,
+		NotAfter:     cert.NotAfter,
+		DNSNames:     cert.DNSNames,
+		IsCA:         cert.IsCA,
+	}, nil
+}
+
+func policySummary(rec *db.PayloadRecord) (mapCommon.PolicySummary, error) {
+	obj, err := common.FromJSON(rec.Payload)
+	if err != nil {
+		return mapCommon.PolicySummary{}, fmt.Errorf("parsing policy %x: %w", rec.ID, err)
+	}
+	s := mapCommon.PolicySummary{
+		ID:         rec.ID,
+		ParentID:   rec.ParentID,
+		Expiration: rec.Expiration,
+	}
+	switch pol := obj.(type) {
+	case common.PolicyCertificate:
+		s.Type = "pc"
+		s.Domain = pol.Domain()
+		s.SerialNumber = pol.SerialNumber()
+		s.NotBefore = pol.NotBefore
+		s.NotAfter = pol.NotAfter
+		s.CanIssue = pol.CanIssue
+		s.CanOwn = pol.CanOwn
+		s.IssuerHash = pol.IssuerHash
+	case common.PolicyCertificateRevocation:
+		s.Type = "pcrev"
+		s.Domain = pol.Domain()
+		s.SerialNumber = pol.SerialNumber()
+		s.IssuerHash = pol.IssuerHash
+	default:
+		return mapCommon.PolicySummary{},
+			fmt.Errorf("policy %x has unexpected type %T", rec.ID, obj)
+	}
+	return s, nil
+}
+
+func domainReferences(domains []db.DomainRecord) []mapCommon.DomainReference {
+	refs := make([]mapCommon.DomainReference, len(domains))
+	for i, d := range domains {
+		refs[i] = mapCommon.DomainReference{
+			DomainID:   d.DomainID,
+			DomainName: d.DomainName,
+		}
+	}
+	return refs
+}
@@ -37,10 +37,52 @@ func NewMapResponder(
 	return r, nil
 }
 
+// NewReplicaMapResponder returns a responder that serves the map in conn with the signed
+// tree head of the primary map server, obtained with its root.
+func NewReplicaMapResponder(
+	ctx context.Context,
+	conn db.Conn,
+	signedTreeHead []byte,
+) (*MapResponder, error) {
+
+	r := &MapResponder{
+		conn: conn,
+		smt:  nil,
+	}
+	err := r.ReloadRootWithSignedTreeHead(ctx, signedTreeHead)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
 func (r *MapResponder) ReloadRootAndSignTreeHead(
 	ctx context.Context,
 	privateKey *rsa.PrivateKey,
 ) error {
+	if err := r.reloadRoot(ctx); err != nil {
+		return err
+	}
+
+	// sign the SMT root
+	return r.signTreeHead(privateKey)
+}
+
+// ReloadRootWithSignedTreeHead loads the root from the DB and serves it with the passed
+// signature, instead of signing it. Used by replicas, that serve the roots of the primary.
+func (r *MapResponder) ReloadRootWithSignedTreeHead(
+	ctx context.Context,
+	signedTreeHead []byte,
+) error {
+	if err := r.reloadRoot(ctx); err != nil {
+		return err
+	}
+	r.signedTreeHead = append(signedTreeHead[:0:0], signedTreeHead...)
+	return nil
+}
+
+func (r *MapResponder) reloadRoot(ctx context.Context) error {
 	// Load root.
 	var root []byte
 	if rootID, err := r.conn.LoadRoot(ctx); err != nil {
@@ -57,9 +99,7 @@ func (r *MapResponder) ReloadRootAndSignTreeHead(
 
 	// Use the new SMT
 	r.smt = smt
-
-	// sign the SMT root
-	return r.signTreeHead(privateKey)
+	return nil
 }
 
 func (r *MapResponder) GetProof(ctx context.Context, domainName string,
@@ -7,9 +7,13 @@ import (
 	"testing"
 	"time"
 
+	ct "github.com/google/certificate-transparency-go"
+	ctx509 "github.com/google/certificate-transparency-go/x509"
 	"github.com/stretchr/testify/require"
 
 	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/db"
+	"github.com/netsec-ethz/fpki/pkg/db/embedded"
 	mapcommon "github.com/netsec-ethz/fpki/pkg/mapserver/common"
 	"github.com/netsec-ethz/fpki/pkg/mapserver/prover"
 	"github.com/netsec-ethz/fpki/pkg/tests"
@@ -154,3 +158,126 @@ func loadKey(t tests.T, filename string) *rsa.PrivateKey {
 	require.NoError(t, err)
 	return k
 }
+
+// TestCertificateAndPolicyDetail checks that the chain and the referencing domains of
+// certificates and policies are correctly returned by the responder.
+func TestCertificateAndPolicyDetail(t *testing.T) {
+	random.Seed(1)
+
+	ctx, cancelF := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelF()
+
+	// Configure a test DB.
+	config, removeF := testdb.ConfigureTestDB(t)
+	defer removeF()
+
+	// Connect to the DB.
+	conn := testdb.Connect(t, config)
+	defer conn.Close()
+
+	certs, policies, IDs, _, _ := tup.UpdateDBwithRandomCerts(ctx, t, conn,
+		[]string{"a.com"}, []tup.CertsPoliciesOrBoth{tup.BothCertsAndPolicies})
+
+	responder, err := NewMapResponder(ctx, conn, loadKey(t, "testdata/server_key.pem"))
+	require.NoError(t, err)
+
+	// The leaf of the first chain: a.com->c1.com->c0.com
+	detail, err := responder.GetCertificateDetail(ctx, IDs[2])
+	require.NoError(t, err)
+	require.NotNil(t, detail)
+	require.Equal(t, IDs[2], detail.Certificate.ID)
+	require.Equal(t, IDs[1], *detail.Certificate.ParentID)
+	require.Equal(t, certs[2].DNSNames, detail.Certificate.DNSNames)
+	require.Len(t, detail.Chain, 2)
+	require.Equal(t, IDs[1], detail.Chain[0].ID)
+	require.Equal(t, IDs[0], detail.Chain[1].ID)
+	require.Nil(t, detail.Chain[1].ParentID)
+	require.Len(t, detail.Domains, 1)
+	require.Equal(t, "a.com", detail.Domains[0].DomainName)
+	require.Equal(t, common.SHA256Hash32Bytes([]byte("a.com")), detail.Domains[0].DomainID)
+
+	// The root is referenced by c0.com.
+	detail, err = responder.GetCertificateDetail(ctx, IDs[0])
+	require.NoError(t, err)
+	require.Empty(t, detail.Chain)
+	require.Len(t, detail.Domains, 1)
+	require.Equal(t, "c0.com", detail.Domains[0].DomainName)
+
+	// Absent certificate.
+	detail, err = responder.GetCertificateDetail(ctx, random.RandomIDsForTest(t, 1)[0])
+	require.NoError(t, err)
+	require.Nil(t, detail)
+
+	// Policies.
+	raw, err := policies[0].Raw()
+	require.NoError(t, err)
+	policyID := common.SHA256Hash32Bytes(raw)
+	polDetail, err := responder.GetPolicyDetail(ctx, policyID)
+	require.NoError(t, err)
+	require.NotNil(t, polDetail)
+	require.Equal(t, policyID, polDetail.Policy.ID)
+	require.Equal(t, policies[0].Domain(), polDetail.Policy.Domain)
+	require.Equal(t, policies[0].SerialNumber(), polDetail.Policy.SerialNumber)
+	require.Empty(t, polDetail.Chain)
+	require.Len(t, polDetail.Domains, 1)
+	require.Equal(t, "a.com", polDetail.Domains[0].DomainName)
+
+	// Absent policy.
+	polDetail, err = responder.GetPolicyDetail(ctx, random.RandomIDsForTest(t, 1)[0])
+	require.NoError(t, err)
+	require.Nil(t, polDetail)
+}
+
+// TestPrecertificateDetail checks the entry type and issuer key hash of the certificates.
+// It uses the embedded backend, which needs no DB server.
+func TestPrecertificateDetail(t *testing.T) {
+	ctx, cancelF := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelF()
+
+	conn, err := embedded.Connect(db.NewConfig(embedded.WithDirectory(t.TempDir())))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	issuer := random.RandomX509Cert(t, "issuer.com")
+	parsedIssuer, err := ctx509.ParseCertificate(issuer.Raw)
+	require.NoError(t, err)
+	precert, _ := random.RandomX509Precert(t, "a.com")
+	unknown, _ := random.RandomX509Precert(t, "b.com")
+	issuerID := common.SHA256Hash32Bytes(issuer.Raw)
+	precertID := common.SHA256Hash32Bytes(precert.Raw)
+	unknownID := common.SHA256Hash32Bytes(unknown.Raw)
+	issuerKeyHash := common.SHA256Hash32Bytes(parsedIssuer.RawSubjectPublicKeyInfo)
+	// The issuer key hash is the one stored with the precertificate at ingestion.
+	err = conn.UpdateCerts(ctx,
+		[]common.SHA256Output{issuerID, precertID, unknownID},
+		[]*common.SHA256Output{nil, &issuerID, &issuerID},
+		[]time.Time{issuer.NotAfter, precert.NotAfter, unknown.NotAfter},
+		[][]byte{issuer.Raw, precert.Raw, unknown.Raw},
+		[]*db.CertificateEntry{nil, {
+			Type:          ct.PrecertLogEntryType,
+			TBSID:         common.SHA256Hash32Bytes(precert.RawTBSCertificate),
+			IssuerKeyHash: &issuerKeyHash,
+		}, nil})
+	require.NoError(t, err)
+
+	responder, err := NewMapResponder(ctx, conn, loadKey(t, "testdata/server_key.pem"))
+	require.NoError(t, err)
+
+	detail, err := responder.GetCertificateDetail(ctx, precertID)
+	require.NoError(t, err)
+	require.Equal(t, "precert", detail.Certificate.EntryType)
+	require.Equal(t, issuerKeyHash[:], detail.Certificate.IssuerKeyHash)
+	require.Len(t, detail.Chain, 1)
+	require.Empty(t, detail.Chain[0].EntryType)
+
+	// Without its entry, the issuer key hash is not known.
+	detail, err = responder.GetCertificateDetail(ctx, unknownID)
+	require.NoError(t, err)
+	require.Equal(t, "precert", detail.Certificate.EntryType)
+	require.Nil(t, detail.Certificate.IssuerKeyHash)
+
+	detail, err = responder.GetCertificateDetail(ctx, issuerID)
+	require.NoError(t, err)
+	require.Equal(t, "x509", detail.Certificate.EntryType)
+	require.Nil(t, detail.Certificate.IssuerKeyHash)
+}
@@ -14,6 +14,7 @@ import (
 	"time"
 
 	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/db"
 	testrand "github.com/netsec-ethz/fpki/pkg/tests/random"
 	"github.com/netsec-ethz/fpki/pkg/tests/testdb"
 	"github.com/stretchr/testify/require"
@@ -373,6 +374,81 @@ func TestHeight0LeafShortcut(t *testing.T) {
 	require.NoError(t, err)
 }
 
+// TestTrieWalk checks that Walk visits all the stored nodes and all the leaves, and reports
+// the missing nodes.
+func TestTrieWalk(t *testing.T) {
+	testrand.Seed(1)
+	ctx, cancelF := context.WithTimeout(context.Background(), time.Minute)
+	defer cancelF()
+
+	store := memStore{}
+	smt, err := NewTrie(nil, common.SHA256Hash, store)
+	require.NoError(t, err)
+
+	keys := getRandomData(t, 100)
+	values := getRandomData(t, 100)
+	_, err = smt.Update(ctx, keys, values)
+	require.NoError(t, err)
+	require.NoError(t, smt.Commit(ctx))
+
+	leaves := make(map[string][]byte)
+	nodes := make(map[common.SHA256Output]bool)
+	walk := func() error {
+		clear(leaves)
+		clear(nodes)
+		return smt.Walk(ctx, smt.Root,
+			func(key []byte, missing bool) error {
+				nodes[(common.SHA256Output)(key)] = missing
+				return nil
+			},
+			func(key, value []byte) error {
+				leaves[string(key)] = value
+				return nil
+			})
+	}
+	require.NoError(t, walk())
+	require.Len(t, leaves, len(keys))
+	for i, key := range keys {
+		require.Equal(t, values[i], leaves[string(key)])
+	}
+	require.Len(t, nodes, len(store))
+	for key, missing := range nodes {
+		require.False(t, missing)
+		require.Contains(t, store, key)
+	}
+
+	// Remove the root node: it is reported as missing, and nothing else is visited.
+	delete(store, (common.SHA256Output)(smt.Root))
+	require.NoError(t, walk())
+	require.Empty(t, leaves)
+	require.Equal(t, map[common.SHA256Output]bool{(common.SHA256Output)(smt.Root): true}, nodes)
+}
+
+// memStore is an in-memory DBConn for the trie.
+type memStore map[common.SHA256Output][]byte
+
+func (memStore) Close() error {
+	return nil
+}
+
+func (m memStore) RetrieveTreeNode(_ context.Context, key common.SHA256Output) ([]byte, error) {
+	return m[key], nil
+}
+
+func (m memStore) UpdateTreeNodes(_ context.Context, records []*db.TreeNodeRecord) (int, error) {
+	for _, r := range records {
+		m[r.Key] = r.Value
+	}
+	return len(records), nil
+}
+
+func (m memStore) DeleteTreeNodes(_ context.Context, keys []common.SHA256Output) (int, error) {
+	for _, k := range keys {
+		delete(m, k)
+	}
+	return len(keys), nil
+}
+
 func getRandomData(t require.TestingT, count int) [][]byte {
 	data := make([][]byte, count)
 	for i := 0; i < count; i++ {
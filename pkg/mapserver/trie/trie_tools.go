@@ -115,3 +115,62 @@ func (s *Trie) Commit(ctx context.Context) error {
 	}
 	return nil
 }
+
+// Walk visits, depth first, all the nodes and leaves of the trie with the given root.
+// visitNode is called with the key of each node stored in the DB, and whether the node is
+// missing from it, in which case its subtree is skipped. visitLeaf is called with the key and
+// value of each leaf. Walk stops at the first error returned by the callbacks.
+// The visited nodes are not cached.
+func (s *Trie) Walk(
+	ctx context.Context,
+	root []byte,
+	visitNode func(key []byte, missing bool) error,
+	visitLeaf func(key, value []byte) error,
+) error {
+	if s.db.Store == nil {
+		return fmt.Errorf("DB not connected to trie")
+	}
+	return s.walk(ctx, root, nil, 0, s.TrieHeight, visitNode, visitLeaf)
+}
+
+func (s *Trie) walk(
+	ctx context.Context,
+	root []byte,
+	batch [][]byte,
+	iBatch, height int,
+	visitNode func(key []byte, missing bool) error,
+	visitLeaf func(key, value []byte) error,
+) error {
+	if len(root) == 0 {
+		return nil
+	}
+	if height%4 == 0 {
+		// Load the node from db
+		value, err := s.db.getValueLockFree(ctx, root[:HashLength])
+		if err != nil {
+			return err
+		}
+		if err := visitNode(root[:HashLength], len(value) == 0); err != nil {
+			return err
+		}
+		if len(value) == 0 {
+			return nil
+		}
+		batch = parseBatch(value)
+		iBatch = 0
+		if batch[0][0] == 1 {
+			return visitLeaf(batch[1][:HashLength], batch[2][:HashLength])
+		}
+	} else if len(batch[iBatch]) != 0 && batch[iBatch][HashLength] == 1 {
+		// Leaf inside the batch.
+		return visitLeaf(batch[2*iBatch+1][:HashLength], batch[2*iBatch+2][:HashLength])
+	}
+	if height == 0 {
+		return nil
+	}
+	err := s.walk(ctx, batch[2*iBatch+1], batch, 2*iBatch+1, height-1, visitNode, visitLeaf)
+	if err != nil {
+		return err
+	}
+	return s.walk(ctx, batch[2*iBatch+2], batch, 2*iBatch+2, height-1, visitNode, visitLeaf)
+}
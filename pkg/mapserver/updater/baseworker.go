@@ -1,6 +1,10 @@
 package updater
 
-import "github.com/netsec-ethz/fpki/pkg/util/noallocs"
+import (
+	"bytes"
+
+	"github.com/netsec-ethz/fpki/pkg/util/noallocs"
+)
 
 func createFilepathRingCache() noallocs.RingCache[[]byte] {
 	return *noallocs.NewRingCache[[]byte](FilepathCacheSize, noallocs.WithPerNewElement(
@@ -10,6 +14,16 @@ func createFilepathRingCache() noallocs.RingCache[[]byte] {
 	)
 }
 
+// createBufferRingCache keeps as many buffers in flight as createFilepathRingCache keeps
+// file names, to stream the CSV rows instead of writing them into files.
+func createBufferRingCache() noallocs.RingCache[*bytes.Buffer] {
+	return *noallocs.NewRingCache[*bytes.Buffer](FilepathCacheSize, noallocs.WithPerNewElement(
+		func(t **bytes.Buffer) {
+			*t = new(bytes.Buffer)
+		}),
+	)
+}
+
 // ringCacheN has size 3 to allow concurrent access to:
 // 1. In-flight (downstream) to next stage.
 // 2. Actively being zeroed.
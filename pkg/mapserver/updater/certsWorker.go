@@ -2,10 +2,12 @@ package updater
 
 import (
 	"fmt"
-	"os"
+
+	ct "github.com/google/certificate-transparency-go"
 
 	"github.com/netsec-ethz/fpki/pkg/cache"
 	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/db"
 	pip "github.com/netsec-ethz/fpki/pkg/pipeline"
 )
 
@@ -17,9 +19,10 @@ import (
 // 1. The source must send the same certificate to stages 2 and 3 below.
 // 2. Gets a certificate and batches them. It outputs a batch for stage 4.
 // 3. Gets a certificate and obtains its domains and sends them to the next domain batcher stages.
-// 4. Gets a certificate batch and creates a CSV file. Outputs a filename for stage 5.
-// 5. Gets a CSV file and inserts it into the DB. Outputs a filename for stage 6.
-// 6. Removes the CSV file.
+// 4. Gets a certificate batch and creates a CSV file, or a buffer if the manager streams the
+// CSV rows. Outputs the csvRows for stage 5.
+// 5. Gets the csvRows and inserts them into the DB. Outputs the csvRows for stage 6.
+// 6. Removes the CSV file, if any.
 //
 // All stages need only one input channel. The types for each stage are:
 // 2. certBatcher			Outputs to one certBatchToCsv
@@ -73,11 +76,16 @@ func newCertBatcher(
 }
 
 // domainExtractor receives one certificate and outputs to N domain batchers.
+// Only the first certificate of each domain is output, except for the precertificates, which
+// are deduplicated by their domain and TBS ID instead: the final certificate of an output
+// precertificate is output as well, so that it replaces the precertificate in the payload of
+// the domain.
 type domainExtractor struct {
 	*pip.Stage[Certificate, DirtyDomain]
 	hasher        common.Hasher
 	domains       ringCache[DirtyDomain] // Keep a copy until the next stage has finished.
 	domainIdCache cache.Cache            // Keep track of the already seen domains.
+	precertKey    [2 * common.SHA256Size]byte
 }
 
 func newDomainExtractor(
@@ -103,22 +111,20 @@ func newDomainExtractor(
 			w.domains.rotate()
 			for _, name := range in.Names {
 				id := w.hasher.HashStringCopy(name)
-				if !w.domainIdCache.Contains(&id) {
-					// Add it to the cache.
-					w.domainIdCache.AddIDs(&id)
-
-					// Send it to next stages.
-					d := DirtyDomain{
-						DomainID: id,
-						CertID:   in.CertID,
-						Name:     name,
-					}
-					w.domains.addElem(d)
-					outChannels = append(
-						outChannels,
-						int(m.ShardFuncDomain(&d.DomainID)),
-					)
+				if !w.isNew(&id, in.Entry) {
+					continue
+				}
+				// Send it to next stages.
+				d := DirtyDomain{
+					DomainID: id,
+					CertID:   in.CertID,
+					Name:     name,
 				}
+				w.domains.addElem(d)
+				outChannels = append(
+					outChannels,
+					int(m.ShardFuncDomain(&d.DomainID)),
+				)
 			}
 			return w.domains.current(), outChannels, nil
 		}),
@@ -127,9 +133,39 @@ func newDomainExtractor(
 	return w
 }
 
-// certBatchToCsv receives one certBatch and creates a CSV file.
+// isNew returns true if the domain must be output for a certificate with the entry, and adds
+// it to the cache.
+func (w *domainExtractor) isNew(id *common.SHA256Output, entry *db.CertificateEntry) bool {
+	if entry == nil {
+		return w.addDomain(id)
+	}
+	copy(w.precertKey[:], id[:])
+	copy(w.precertKey[common.SHA256Size:], entry.TBSID[:])
+	key := w.hasher.HashCopy(w.precertKey[:])
+	if entry.Type == ct.PrecertLogEntryType {
+		if w.domainIdCache.Contains(&key) {
+			return false
+		}
+		w.domainIdCache.AddIDs(&key)
+		return true
+	}
+	// Its precertificate may have been output for the domain.
+	isNew := w.addDomain(id)
+	return isNew || w.domainIdCache.Contains(&key)
+}
+
+// addDomain adds the domain to the cache, and returns true if it was not already there.
+func (w *domainExtractor) addDomain(id *common.SHA256Output) bool {
+	if w.domainIdCache.Contains(id) {
+		return false
+	}
+	w.domainIdCache.AddIDs(id)
+	return true
+}
+
+// certBatchToCsv receives one certBatch and creates a CSV file, or a buffer if streamed.
 type certBatchToCsv struct {
-	*pip.Stage[CertBatch, string]
+	*pip.Stage[CertBatch, csvRows]
 }
 
 func newCertBatchToCsv(
@@ -139,26 +175,37 @@ func newCertBatchToCsv(
 	w := &certBatchToCsv{}
 
 	// Prepare pre-reserved storage for the strings.
-	storage := CreateStorage(1, 4,
+	storage := CreateStorage(1, 7,
 		IdBase64Len,
 		IdBase64Len,
 		ExpTimeBase64Len,
 		PayloadBase64Len,
+		EntryTypeLen,
+		IdBase64Len,
+		IdBase64Len,
 	)
 	// Storage to keep the different temporary file names per call to the process function.
 	filenamesStorage := createFilepathRingCache()
+	// Buffers to keep the CSV rows per call to the process function, if streamed.
+	buffers := createBufferRingCache()
 
-	filenameSlice := make([]string, 1) // holds the slice (not the storage) of the temp file.
+	rowsSlice := make([]csvRows, 1) // holds the slice (not the storage) of the CSV rows.
 	outChs := make([]int, 1)
 	var err error
-	w.Stage = pip.NewStage[CertBatch, string](
+	w.Stage = pip.NewStage[CertBatch, csvRows](
 		fmt.Sprintf("cert_batch_to_csv_%02d", id),
-		pip.WithProcessFunction(func(batch CertBatch) ([]string, []int, error) {
+		pip.WithProcessFunction(func(batch CertBatch) ([]csvRows, []int, error) {
 			_, span := w.Tracer.Start(w.Ctx, "create-csv")
 			defer span.End()
 
-			filenameSlice[0], err = CreateCsvCerts(storage, filenamesStorage.Rotate(), batch)
-			return filenameSlice, outChs, err
+			rowsSlice[0] = csvRows{}
+			if m.StreamCsv {
+				rowsSlice[0].buffer = buffers.Rotate()
+				bufferCsvCerts(storage, rowsSlice[0].buffer, batch)
+				return rowsSlice, outChs, nil
+			}
+			rowsSlice[0].filename, err = CreateCsvCerts(storage, filenamesStorage.Rotate(), batch)
+			return rowsSlice, outChs, err
 		}),
 	)
 
@@ -166,42 +213,41 @@ func newCertBatchToCsv(
 }
 
 type certCsvInserter struct {
-	*pip.Stage[string, string]
+	*pip.Stage[csvRows, csvRows]
 }
 
 func newCertCsvInserter(id int, m *Manager) *certCsvInserter {
 	w := &certCsvInserter{}
 
-	filenameSlice := make([]string, 1)
+	rowsSlice := make([]csvRows, 1)
 	outChs := make([]int, 1)
 	var err error
 
-	w.Stage = pip.NewStage[string, string](
+	w.Stage = pip.NewStage[csvRows, csvRows](
 		fmt.Sprintf("cert_csv_inserter_%02d", id),
-		pip.WithProcessFunction(func(in string) ([]string, []int, error) {
+		pip.WithProcessFunction(func(in csvRows) ([]csvRows, []int, error) {
 			ctx, span := w.Tracer.Start(w.Ctx, "csv-to-db")
 			defer span.End()
 
 			// Call the db to insert.
-			filenameSlice[0] = in
-			err = m.Conn.InsertCsvIntoCerts(ctx, in)
-			_ = ctx
-			return filenameSlice, outChs, err
+			rowsSlice[0] = in
+			err = insertCsv(ctx, in, m.Conn.InsertCsvIntoCerts, m.Conn.StreamCsvIntoCerts)
+			return rowsSlice, outChs, err
 		}),
 	)
 	return w
 }
 
 type certCsvRemover struct {
-	*pip.Sink[string]
+	*pip.Sink[csvRows]
 }
 
 func newCertCsvRemover(id int) *certCsvRemover {
 	return &certCsvRemover{
-		Sink: pip.NewSink[string](
+		Sink: pip.NewSink[csvRows](
 			fmt.Sprintf("cert_csv_remover_%02d", id),
-			pip.WithSinkFunction(func(in string) error {
-				return os.Remove(in)
+			pip.WithSinkFunction(func(in csvRows) error {
+				return removeCsv(in)
 			}),
 		),
 	}
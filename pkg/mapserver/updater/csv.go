@@ -1,8 +1,13 @@
 package updater
 
 import (
+	"bytes"
+	"context"
 	"encoding/base64"
 	"fmt"
+	"io"
+	"os"
+	"strconv"
 	"time"
 
 	"github.com/netsec-ethz/fpki/pkg/common"
@@ -17,10 +22,39 @@ const (
 	DomainNameLen     = 256  // 256 characters
 	ExpTimeBase64Len  = 50   // expiration time
 	PayloadBase64Len  = 0    // do not preallocate for payloads
+	EntryTypeLen      = 3    // CT log entry type
 	FilepathLen       = 2048 // 2K for file paths
 	FilepathCacheSize = 8    // 8 filepaths inflight (toward next stages)
 )
 
+// csvRows are the CSV rows of one batch, either in a temporary file that the DB loads, or in
+// memory if the manager streams them to the DB.
+type csvRows struct {
+	filename string        // Temporary file, empty if streamed.
+	buffer   *bytes.Buffer // Rows to stream, nil if in a file.
+}
+
+// insertCsv inserts the rows with insertFile if they are in a file, or with stream otherwise.
+func insertCsv(
+	ctx context.Context,
+	rows csvRows,
+	insertFile func(context.Context, string) error,
+	stream func(context.Context, io.Reader) error,
+) error {
+	if rows.buffer != nil {
+		return stream(ctx, bytes.NewReader(rows.buffer.Bytes()))
+	}
+	return insertFile(ctx, rows.filename)
+}
+
+// removeCsv removes the temporary file of the rows, if any.
+func removeCsv(rows csvRows) error {
+	if rows.buffer != nil {
+		return nil
+	}
+	return os.Remove(rows.filename)
+}
+
 func CreateStorage(nRows, nCols int, fieldLengths ...int) [][][]byte {
 	storage := make([][][]byte, nRows)
 	for i := range storage {
@@ -95,6 +129,51 @@ func CreateCsvDomainCerts(
 	)
 }
 
+// bufferCsvCerts is like CreateCsvCerts, but writes the rows into buf instead of a file.
+func bufferCsvCerts(storage [][][]byte, buf *bytes.Buffer, certs []Certificate) {
+	buf.Reset()
+	for _, cert := range certs {
+		recordsForCert(storage[0], cert)
+		bufferRow(buf, storage[0])
+	}
+}
+
+func bufferCsvDirty(storage [][][]byte, buf *bytes.Buffer, domains []DirtyDomain) {
+	bufferRecordsWithStorage(storage, buf, domains, recordsForDirty)
+}
+
+func bufferCsvDomains(storage [][][]byte, buf *bytes.Buffer, domains []DirtyDomain) {
+	bufferRecordsWithStorage(storage, buf, domains, recordsForDomains)
+}
+
+func bufferCsvDomainCerts(storage [][][]byte, buf *bytes.Buffer, domains []DirtyDomain) {
+	bufferRecordsWithStorage(storage, buf, domains, recordsForDomainCerts)
+}
+
+func bufferRecordsWithStorage[T any](
+	rows [][][]byte,
+	buf *bytes.Buffer,
+	data []T,
+	toRecords func(row [][]byte, field T),
+) {
+	buf.Reset()
+	for i, d := range data {
+		toRecords(rows[i], d)
+		bufferRow(buf, rows[i])
+	}
+}
+
+// bufferRow writes the fields as one line of CSV, the same as writeCSV.
+func bufferRow(buf *bytes.Buffer, row [][]byte) {
+	for i, field := range row {
+		if i > 0 {
+			buf.Write(commaChar)
+		}
+		buf.Write(field)
+	}
+	buf.Write(newlineChar)
+}
+
 func writeRecordsWithStorage[T any](
 	rows [][][]byte, // with the correct len(dst) == len(data), each len(dst[i]) == len(toRecords(data[i]))
 	writerFunc func([]byte, string, string, [][][]byte) (string, error), // The function to write to disk.
@@ -203,11 +282,21 @@ func writeCertCSV(
 }
 
 func recordsForCert(dst [][]byte, c Certificate) {
-	// 4 columns: ID, parentID, expTime, payload.
+	// 7 columns: ID, parentID, expTime, payload, entry type, TBS ID, issuer key hash.
+	// The last three are empty if the certificate has no entry.
 	idToBase64WithStorage(&dst[0], c.CertID)
 	idOrNilToBase64WithStorage(&dst[1], c.ParentID)
 	timeToStringWithStorage(&dst[2], c.NotAfter)
 	bytesToBase64WithStorage(&dst[3], c.Raw)
+	dst[4] = dst[4][:0]
+	var tbsID, issuerKeyHash *common.SHA256Output
+	if c.Entry != nil {
+		dst[4] = strconv.AppendUint(dst[4], uint64(c.Entry.Type), 10)
+		tbsID = &c.Entry.TBSID
+		issuerKeyHash = c.Entry.IssuerKeyHash
+	}
+	idOrNilToBase64WithStorage(&dst[5], tbsID)
+	idOrNilToBase64WithStorage(&dst[6], issuerKeyHash)
 }
 
 func recordsForDirty(dst [][]byte, d DirtyDomain) {
@@ -1,13 +1,17 @@
 package updater
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/csv"
 	"os"
 	"testing"
 	"time"
 
+	ct "github.com/google/certificate-transparency-go"
+
 	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/db"
 	"github.com/netsec-ethz/fpki/pkg/tests"
 	"github.com/netsec-ethz/fpki/pkg/tests/random"
 	"github.com/stretchr/testify/require"
@@ -36,7 +40,8 @@ func TestEncodeToBase64(t *testing.T) {
 }
 
 func TestRecordsForCert(t *testing.T) {
-	storage := CreateStorage(1, 4, IdBase64Len, IdBase64Len, ExpTimeBase64Len, PayloadBase64Len)
+	storage := CreateStorage(1, 7, IdBase64Len, IdBase64Len, ExpTimeBase64Len, PayloadBase64Len,
+		EntryTypeLen, IdBase64Len, IdBase64Len)
 
 	// One cert to records.
 	c := randomCertificate(t)
@@ -57,7 +62,7 @@ func TestRecordsForCert(t *testing.T) {
 	c.Raw = payload
 	recordsForCert(storage[0], c)
 
-	require.Len(t, row, 4)
+	require.Len(t, row, 7)
 	for i, field := range row {
 		t.Logf("field %d: %s", i, string(field))
 	}
@@ -65,14 +70,19 @@ func TestRecordsForCert(t *testing.T) {
 	require.Equal(t, idPtrToStr(c.ParentID), string(row[1]))
 	require.Equal(t, c.NotAfter.Format(time.DateTime), string(row[2]))
 	require.Equal(t, base64.StdEncoding.EncodeToString(c.Raw), string(row[3]))
+	require.Equal(t, "0", string(row[4]))
+	require.Equal(t, idPtrToStr(&c.Entry.TBSID), string(row[5]))
+	require.Empty(t, row[6])
 
 	// Another cert to records.
 	c = randomCertificate(t)
 	c.ParentID = nil // force to root cert.
+	c.Names = nil
+	c.Entry = nil
 	recordsForCert(storage[0], c)
 	require.Len(t, storage, 1)
 	row = storage[0]
-	require.Len(t, row, 4)
+	require.Len(t, row, 7)
 	for i, field := range row {
 		t.Logf("field %d: %s", i, string(field))
 	}
@@ -80,6 +90,18 @@ func TestRecordsForCert(t *testing.T) {
 	require.Equal(t, idPtrToStr(c.ParentID), string(row[1]))
 	require.Equal(t, c.NotAfter.Format(time.DateTime), string(row[2]))
 	require.Equal(t, base64.StdEncoding.EncodeToString(c.Raw), string(row[3]))
+	require.Empty(t, row[4])
+	require.Empty(t, row[5])
+	require.Empty(t, row[6])
+
+	// A precertificate.
+	c = randomCertificate(t)
+	c.Entry.Type = ct.PrecertLogEntryType
+	c.Entry.IssuerKeyHash = random.RandomIDPtrsForTest(t, 1)[0]
+	recordsForCert(storage[0], c)
+	require.Equal(t, "1", string(row[4]))
+	require.Equal(t, idPtrToStr(&c.Entry.TBSID), string(row[5]))
+	require.Equal(t, idPtrToStr(c.Entry.IssuerKeyHash), string(row[6]))
 }
 
 func TestCreateCsvCerts(t *testing.T) {
@@ -89,7 +111,8 @@ func TestCreateCsvCerts(t *testing.T) {
 		certs[i] = randomCertificate(t)
 	}
 
-	storage := CreateStorage(1, 4, IdBase64Len, IdBase64Len, ExpTimeBase64Len, PayloadBase64Len)
+	storage := CreateStorage(1, 7, IdBase64Len, IdBase64Len, ExpTimeBase64Len, PayloadBase64Len,
+		EntryTypeLen, IdBase64Len, IdBase64Len)
 
 	// Warm the reusable payload storage to the largest cert in the batch.
 	for _, cert := range certs {
@@ -196,11 +219,14 @@ func TestRecordsForDomainCerts(t *testing.T) {
 }
 
 func TestWriteCsvCerts(t *testing.T) {
-	storage := CreateStorage(1, 4,
+	storage := CreateStorage(1, 7,
 		IdBase64Len,
 		IdBase64Len,
 		ExpTimeBase64Len,
 		PayloadBase64Len,
+		EntryTypeLen,
+		IdBase64Len,
+		IdBase64Len,
 	)
 	filenameStorage := make([]byte, FilepathLen)
 	certs := make([]Certificate, 3)
@@ -227,8 +253,8 @@ func TestWriteCsvCerts(t *testing.T) {
 	expTimes := make([]time.Time, len(certs))
 	payloads := make([][]byte, len(certs))
 	for i, row := range rows {
-		require.Equal(t, 4, len(row))
-		// ID, parentID, time, payload.
+		require.Equal(t, 7, len(row))
+		// ID, parentID, time, payload, entry type, TBS ID, issuer key hash.
 		id, err := base64.StdEncoding.DecodeString(row[0])
 		require.NoError(t, err)
 		parent, err := base64.StdEncoding.DecodeString(row[1])
@@ -255,6 +281,85 @@ func TestWriteCsvCerts(t *testing.T) {
 	require.NoError(t, os.Remove(tempFilename))
 }
 
+func TestBufferCsv(t *testing.T) {
+	storage := CreateStorage(1, 7,
+		IdBase64Len,
+		IdBase64Len,
+		ExpTimeBase64Len,
+		PayloadBase64Len,
+		EntryTypeLen,
+		IdBase64Len,
+		IdBase64Len,
+	)
+	certs := make([]Certificate, 3)
+	for i := range certs {
+		certs[i] = randomCertificate(t)
+	}
+	certs[1].ParentID = nil
+
+	var buf bytes.Buffer
+	bufferCsvCerts(storage, &buf, certs)
+	rows, err := csv.NewReader(&buf).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, rows, len(certs))
+	for i, c := range certs {
+		require.Equal(t, []string{
+			base64.StdEncoding.EncodeToString(c.CertID[:]),
+			idPtrToStr(c.ParentID),
+			c.NotAfter.Format(time.DateTime),
+			base64.StdEncoding.EncodeToString(c.Raw),
+			"0",
+			idPtrToStr(&c.Entry.TBSID),
+			"",
+		}, rows[i])
+	}
+
+	// The buffer is reused for the next batch.
+	bufferCsvCerts(storage, &buf, certs[:1])
+	rows, err = csv.NewReader(&buf).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+
+	domains := make([]DirtyDomain, 3)
+	for i := range domains {
+		domains[i] = randomDirtyDomain(t)
+	}
+	storage = CreateStorage(len(domains), 2,
+		IdBase64Len,
+		DomainNameLen,
+	)
+	bufferCsvDomains(storage, &buf, domains)
+	rows, err = csv.NewReader(&buf).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, rows, len(domains))
+	for i, d := range domains {
+		require.Equal(t, []string{base64.StdEncoding.EncodeToString(d.DomainID[:]), d.Name},
+			rows[i])
+	}
+
+	bufferCsvDomainCerts(storage, &buf, domains)
+	rows, err = csv.NewReader(&buf).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, rows, len(domains))
+	for i, d := range domains {
+		require.Equal(t, []string{
+			base64.StdEncoding.EncodeToString(d.DomainID[:]),
+			base64.StdEncoding.EncodeToString(d.CertID[:]),
+		}, rows[i])
+	}
+
+	storage = CreateStorage(len(domains), 1,
+		IdBase64Len,
+	)
+	bufferCsvDirty(storage, &buf, domains)
+	rows, err = csv.NewReader(&buf).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, rows, len(domains))
+	for i, d := range domains {
+		require.Equal(t, []string{base64.StdEncoding.EncodeToString(d.DomainID[:])}, rows[i])
+	}
+}
+
 func randomCertificate(t tests.T) Certificate {
 	name := random.RandomLeafNames(t, 1)[0]
 	cert := random.RandomX509Cert(t, name)
@@ -264,6 +369,7 @@ func randomCertificate(t tests.T) Certificate {
 		NotAfter: cert.NotAfter,
 		Raw:      cert.Raw,
 		Names:    []string{name},
+		Entry:    &db.CertificateEntry{TBSID: random.RandomIDsForTest(t, 1)[0]},
 	}
 }
 
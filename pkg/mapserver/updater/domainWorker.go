@@ -2,7 +2,6 @@ package updater
 
 import (
 	"fmt"
-	"os"
 
 	pip "github.com/netsec-ethz/fpki/pkg/pipeline"
 	"github.com/netsec-ethz/fpki/pkg/util"
@@ -70,14 +69,15 @@ func newDomainBatcher(
 	return w
 }
 
-type domainsCsvFilenames struct {
-	dirtyFile       string
-	domainsFile     string
-	domainCertsFile string
+// domainsCsvs are the CSV rows of one domain batch, for each table.
+type domainsCsvs struct {
+	dirty       csvRows
+	domains     csvRows
+	domainCerts csvRows
 }
 
 type domainsToCsvs struct {
-	*pip.Stage[domainBatch, domainsCsvFilenames]
+	*pip.Stage[domainBatch, domainsCsvs]
 }
 
 func newDomainsToCsvs(
@@ -109,12 +109,17 @@ func newDomainsToCsvs(
 	// Storage to keep the different temporary file names per call to the process function.
 	domainCertsFilenameStorage := createFilepathRingCache()
 
-	filenameSlice := make([]domainsCsvFilenames, 1)
+	// Buffers to keep the CSV rows per call to the process function, if streamed.
+	dirtyBuffers := createBufferRingCache()
+	domainsBuffers := createBufferRingCache()
+	domainCertsBuffers := createBufferRingCache()
+
+	rowsSlice := make([]domainsCsvs, 1)
 	outChs := make([]int, 1)
 	var err error
-	w.Stage = pip.NewStage[domainBatch, domainsCsvFilenames](
+	w.Stage = pip.NewStage[domainBatch, domainsCsvs](
 		fmt.Sprintf("domain_batch_to_csv_%02d", id),
-		pip.WithProcessFunction(func(batch domainBatch) ([]domainsCsvFilenames, []int, error) {
+		pip.WithProcessFunction(func(batch domainBatch) ([]domainsCsvs, []int, error) {
 			_, span := w.Tracer.Start(w.Ctx, "create-csvs")
 			defer span.End()
 
@@ -122,7 +127,18 @@ func newDomainsToCsvs(
 				return nil, nil, nil
 			}
 
-			filenameSlice[0].dirtyFile, err = CreateCsvDirty(
+			rowsSlice[0] = domainsCsvs{}
+			if m.StreamCsv {
+				rowsSlice[0].dirty.buffer = dirtyBuffers.Rotate()
+				bufferCsvDirty(storageDirty, rowsSlice[0].dirty.buffer, batch)
+				rowsSlice[0].domains.buffer = domainsBuffers.Rotate()
+				bufferCsvDomains(storageDomains, rowsSlice[0].domains.buffer, batch)
+				rowsSlice[0].domainCerts.buffer = domainCertsBuffers.Rotate()
+				bufferCsvDomainCerts(storageDomainCerts, rowsSlice[0].domainCerts.buffer, batch)
+				return rowsSlice, outChs, nil
+			}
+
+			rowsSlice[0].dirty.filename, err = CreateCsvDirty(
 				storageDirty,
 				dirtyFilenameStorage.Rotate(),
 				batch)
@@ -130,7 +146,7 @@ func newDomainsToCsvs(
 				return nil, nil, err
 			}
 
-			filenameSlice[0].domainsFile, err = CreateCsvDomains(
+			rowsSlice[0].domains.filename, err = CreateCsvDomains(
 				storageDomains,
 				domainsFilenameStorage.Rotate(),
 				batch)
@@ -138,12 +154,12 @@ func newDomainsToCsvs(
 				return nil, nil, err
 			}
 
-			filenameSlice[0].domainCertsFile, err = CreateCsvDomainCerts(
+			rowsSlice[0].domainCerts.filename, err = CreateCsvDomainCerts(
 				storageDomainCerts,
 				domainCertsFilenameStorage.Rotate(),
 				batch)
 
-			return filenameSlice, outChs, err
+			return rowsSlice, outChs, err
 		}),
 	)
 
@@ -151,34 +167,36 @@ func newDomainsToCsvs(
 }
 
 type domainCsvsInserter struct {
-	*pip.Stage[domainsCsvFilenames, domainsCsvFilenames]
+	*pip.Stage[domainsCsvs, domainsCsvs]
 }
 
 func newDomainCsvsInserter(id int, m *Manager) *domainCsvsInserter {
 	w := &domainCsvsInserter{}
 
-	filenameSlice := make([]domainsCsvFilenames, 1)
+	rowsSlice := make([]domainsCsvs, 1)
 	outChs := make([]int, 1)
 	var err error
 
-	w.Stage = pip.NewStage[domainsCsvFilenames, domainsCsvFilenames](
+	w.Stage = pip.NewStage[domainsCsvs, domainsCsvs](
 		fmt.Sprintf("domain_csv_inserter_%02d", id),
-		pip.WithProcessFunction(func(in domainsCsvFilenames) ([]domainsCsvFilenames, []int, error) {
+		pip.WithProcessFunction(func(in domainsCsvs) ([]domainsCsvs, []int, error) {
 			ctx, span := w.Tracer.Start(w.Ctx, "csv-to-db")
 			defer span.End()
 
 			// Call the db to insert.
-			filenameSlice[0] = in
-			err = m.Conn.InsertCsvIntoDirty(ctx, in.dirtyFile)
+			rowsSlice[0] = in
+			err = insertCsv(ctx, in.dirty, m.Conn.InsertCsvIntoDirty, m.Conn.StreamCsvIntoDirty)
 			if err != nil {
 				return nil, nil, err
 			}
-			err = m.Conn.InsertCsvIntoDomains(ctx, in.domainsFile)
+			err = insertCsv(ctx, in.domains, m.Conn.InsertCsvIntoDomains,
+				m.Conn.StreamCsvIntoDomains)
 			if err != nil {
 				return nil, nil, err
 			}
-			err = m.Conn.InsertCsvIntoDomainCerts(ctx, in.domainCertsFile)
-			return filenameSlice, outChs, err
+			err = insertCsv(ctx, in.domainCerts, m.Conn.InsertCsvIntoDomainCerts,
+				m.Conn.StreamCsvIntoDomainCerts)
+			return rowsSlice, outChs, err
 		}),
 	)
 
@@ -186,18 +204,18 @@ func newDomainCsvsInserter(id int, m *Manager) *domainCsvsInserter {
 }
 
 type domainCsvsRemover struct {
-	*pip.Sink[domainsCsvFilenames]
+	*pip.Sink[domainsCsvs]
 }
 
 func newDomainCsvsRemover(id int) *domainCsvsRemover {
 	errs := make([]error, 3)
 	return &domainCsvsRemover{
-		Sink: pip.NewSink[domainsCsvFilenames](
+		Sink: pip.NewSink[domainsCsvs](
 			fmt.Sprintf("domain_csvs_remover_%02d", id),
-			pip.WithSinkFunction(func(in domainsCsvFilenames) error {
-				errs[0] = os.Remove(in.dirtyFile)
-				errs[1] = os.Remove(in.domainsFile)
-				errs[2] = os.Remove(in.domainCertsFile)
+			pip.WithSinkFunction(func(in domainsCsvs) error {
+				errs[0] = removeCsv(in.dirty)
+				errs[1] = removeCsv(in.domains)
+				errs[2] = removeCsv(in.domainCerts)
 				return util.ErrorsCoalesce(errs...)
 			}),
 		),
@@ -25,6 +25,9 @@ type Manager struct {
 	Stats           *statistics.Stats               // Statistics about the update
 	ShardFuncCert   func(*common.SHA256Output) uint // select cert worker index from ID
 	ShardFuncDomain func(*common.SHA256Output) uint // select the domain worker from domain ID
+	// StreamCsv sends the CSV rows to the DB thru its connection, instead of writing temporary
+	// files that the DB server reads. The DB server can then run on a different host.
+	StreamCsv bool
 
 	IncomingCertChan    chan Certificate  // Certificates arrive from this channel.
 	IncomingCertPtrChan chan *Certificate // Only one of the incoming channels is enabled.
@@ -103,9 +106,9 @@ func (m *Manager) createCertificateSource(workerCount int) *pip.Source[Certifica
 //	B1..W: batcher, transforms into certBatch, outputs to Ci
 //	C1..W: domain extractor, transforms into DirtyDomain, outputs to E1..W but no crisscross.
 
-//	D1..W: certificate to CSV, outputs to one Ei.
+//	D1..W: certificate to CSV (file or buffer if StreamCsv), outputs to one Ei.
 //	E1..W: cert CSV to DB, outputs to one Fi.
-//	F1..W: cert CSV removal. Sink.
+//	F1..W: cert CSV removal, if a file. Sink.
 
 //	G1..W: domain batcher, transforms into domainBatch, outputs to one Hi
 //	H1..W: domain inserter, inserts into DB. Sink.
@@ -13,6 +13,7 @@ import (
 
 	"github.com/netsec-ethz/fpki/pkg/common"
 	"github.com/netsec-ethz/fpki/pkg/db"
+	"github.com/netsec-ethz/fpki/pkg/db/embedded"
 	pip "github.com/netsec-ethz/fpki/pkg/pipeline"
 	"github.com/netsec-ethz/fpki/pkg/statistics"
 	"github.com/netsec-ethz/fpki/pkg/tests"
@@ -158,6 +159,32 @@ func TestManagerStart(t *testing.T) {
 	}
 }
 
+// TestManagerStreamCsv checks that the manager inserts the same rows when streaming them,
+// without any temporary file. It uses the embedded backend, which needs no DB server.
+func TestManagerStreamCsv(t *testing.T) {
+	defer pip.PrintAllDebugLines()
+
+	ctx, cancelF := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancelF()
+
+	conn, err := embedded.Connect(db.NewConfig(embedded.WithDirectory(t.TempDir())))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	manager, err := NewManager(4, conn, 10, statistics.NewStatistics(time.Hour, nil))
+	require.NoError(t, err)
+	manager.StreamCsv = true
+
+	certs := sameAncestryHierarchy(t, mockLeaves(100)...)
+	tests.TestOrTimeout(t, tests.WithContext(ctx), func(t tests.T) {
+		manager.Resume(ctx)
+		processCertificates(manager, certs)
+		manager.Stop()
+		require.NoError(t, manager.Wait(ctx))
+	})
+	verifyDB(ctx, t, conn, 2+100, 2+100)
+}
+
 func TestManagerResume(t *testing.T) {
 	defer pip.PrintAllDebugLines()
 
@@ -415,39 +442,20 @@ func verifyDB(ctx context.Context, t tests.T, conn db.Conn,
 ) {
 	t.Helper()
 
-	checkTable := func(field string, table string, n int) {
-		t.Helper()
-		rows, err := conn.DB().QueryContext(ctx,
-			fmt.Sprintf("SELECT %s FROM %s", field, table))
-		require.NoError(t, err)
-		require.NoError(t, rows.Err())
-
-		ids := make([]string, 0)
-		for rows.Next() {
-			var id []byte
-			err := rows.Scan(&id)
-			require.NoError(t, err)
-			ids = append(ids, hex.EncodeToString(id))
-		}
-		str := ""
-		if n != len(ids) {
-			str = fmt.Sprintf("failure at %s\tExisting IDs in table:\n%s",
-				table, strings.Join(ids, "\n"))
-		}
-		require.Equal(t, n, len(ids), str)
-	}
+	counts, err := conn.CountRows(ctx)
+	require.NoError(t, err)
 
 	// Check number of certificates.
-	checkTable("cert_id", "certs", ncerts)
+	require.Equal(t, uint64(ncerts), counts.Certs)
 
 	// Check number of domains.
-	checkTable("domain_id", "domains", ndomains)
+	require.Equal(t, uint64(ndomains), counts.Domains)
 
 	// Check number of dirty domains.
-	checkTable("domain_id", "dirty", ndomains)
+	require.Equal(t, uint64(ndomains), counts.Dirty)
 
 	// Check number of cert-domains.
-	checkTable("cert_id", "domain_certs", ndomains)
+	require.Equal(t, uint64(ndomains), counts.DomainCerts)
 }
 
 // createManagerWithOutputFunction creates a manager, and modifies the output functions of all the
@@ -482,17 +490,17 @@ func createManagerWithOutputFunction(
 	}
 
 	// D. Cert csv creators:
-	for _, s := range findStagesByType[pip.Stage[CertBatch, string]](t, stages) {
+	for _, s := range findStagesByType[pip.Stage[CertBatch, csvRows]](t, stages) {
 		pip.TestOnlyPurposeSetOutputFunction(t, s, outType)
 	}
 
 	// E. Cert csv inserters:
-	for _, s := range findStagesByType[pip.Stage[string, string]](t, stages) {
+	for _, s := range findStagesByType[pip.Stage[csvRows, csvRows]](t, stages) {
 		pip.TestOnlyPurposeSetOutputFunction(t, s, outType)
 	}
 
 	// F. Cert csv removers:
-	for _, s := range findStagesByType[pip.Sink[string]](t, stages) {
+	for _, s := range findStagesByType[pip.Sink[csvRows]](t, stages) {
 		pip.TestOnlyPurposeSetOutputFunction(t, s.Stage, outType)
 	}
 
@@ -502,17 +510,17 @@ func createManagerWithOutputFunction(
 	}
 
 	// H. Domain csv creators:
-	for _, s := range findStagesByType[pip.Stage[domainBatch, domainsCsvFilenames]](t, stages) {
+	for _, s := range findStagesByType[pip.Stage[domainBatch, domainsCsvs]](t, stages) {
 		pip.TestOnlyPurposeSetOutputFunction(t, s, outType)
 	}
 
 	// I. Domain csv inserters:
-	for _, s := range findStagesByType[pip.Stage[domainsCsvFilenames, domainsCsvFilenames]](t, stages) {
+	for _, s := range findStagesByType[pip.Stage[domainsCsvs, domainsCsvs]](t, stages) {
 		pip.TestOnlyPurposeSetOutputFunction(t, s, outType)
 	}
 
 	// J. Domain csv removers, sinks:
-	for _, s := range findStagesByType[pip.Sink[domainsCsvFilenames]](t, stages) {
+	for _, s := range findStagesByType[pip.Sink[domainsCsvs]](t, stages) {
 		pip.TestOnlyPurposeSetOutputFunction(t, s.Stage, outType)
 	}
 
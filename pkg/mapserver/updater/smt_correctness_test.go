@@ -220,9 +220,7 @@ func TestUpdateSMT_IncrementalUpdateMatchesFreshBuild(t *testing.T) {
 	require.NoError(t, connInc.CleanupDirty(ctxInc))
 
 	modifiedID := common.SHA256Hash32Bytes([]byte("modified.example.com"))
-	_, err := connInc.DB().ExecContext(ctxInc, "DELETE FROM domain_certs WHERE domain_id = ?", modifiedID[:])
-	require.NoError(t, err)
-	_, err = connInc.DB().ExecContext(ctxInc, "DELETE FROM domain_policies WHERE domain_id = ?", modifiedID[:])
+	err := connInc.ReplaceDomainAssociations(ctxInc, []common.SHA256Output{modifiedID}, nil, nil)
 	require.NoError(t, err)
 	require.NoError(t, connInc.InsertDomainsIntoDirty(ctxInc, []common.SHA256Output{modifiedID}))
 
@@ -275,9 +273,7 @@ func TestUpdateSMT_RemovesStaleDomainFromTrie(t *testing.T) {
 
 	require.NoError(t, conn.CleanupDirty(ctx))
 	domainID := common.SHA256Hash32Bytes([]byte("stale.example.com"))
-	_, err := conn.DB().ExecContext(ctx, "DELETE FROM domain_certs WHERE domain_id = ?", domainID[:])
-	require.NoError(t, err)
-	_, err = conn.DB().ExecContext(ctx, "DELETE FROM domain_policies WHERE domain_id = ?", domainID[:])
+	err := conn.ReplaceDomainAssociations(ctx, []common.SHA256Output{domainID}, nil, nil)
 	require.NoError(t, err)
 	require.NoError(t, conn.InsertDomainsIntoDirty(ctx, []common.SHA256Output{domainID}))
 
@@ -5,9 +5,11 @@ import (
 	"fmt"
 	"time"
 
+	ct "github.com/google/certificate-transparency-go"
 	ctx509 "github.com/google/certificate-transparency-go/x509"
 
 	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/db"
 	"github.com/netsec-ethz/fpki/pkg/util"
 )
 
@@ -33,6 +35,53 @@ type Certificate struct {
 	Names    []string
 	NotAfter time.Time
 	Raw      []byte
+	Entry    *db.CertificateEntry // Only for leaves, see NewCertificateEntry.
+}
+
+// NewCertificate returns the Certificate for the parsed certificate, which is a leaf iff
+// names is not nil. The chain is the one of the leaf in its CT log entry, if known.
+func NewCertificate(
+	cert *ctx509.Certificate,
+	id common.SHA256Output,
+	parentID *common.SHA256Output,
+	names []string,
+	chain []*ctx509.Certificate,
+) Certificate {
+
+	c := Certificate{
+		CertID:   id,
+		ParentID: parentID,
+		Names:    names,
+		NotAfter: cert.NotAfter,
+		Raw:      cert.Raw,
+	}
+	if names != nil {
+		c.Entry = NewCertificateEntry(cert, chain)
+	}
+	return c
+}
+
+// NewCertificateEntry returns the entry of the leaf certificate logged with the chain, or nil
+// if its TBS ID cannot be computed: without it, a precertificate is kept together with its
+// final certificate. The issuer key hash of a precertificate is only set if the chain has
+// its issuer.
+func NewCertificateEntry(cert *ctx509.Certificate, chain []*ctx509.Certificate,
+) *db.CertificateEntry {
+
+	tbsID, err := util.CertificateTBSID(cert)
+	if err != nil {
+		return nil
+	}
+	e := &db.CertificateEntry{
+		Type:  util.CertificateEntryType(cert),
+		TBSID: tbsID,
+	}
+	if e.Type == ct.PrecertLogEntryType {
+		if hash, err := util.PrecertIssuerKeyHash(chain); err == nil {
+			e.IssuerKeyHash = &hash
+		}
+	}
+	return e
 }
 
 func (c Certificate) String() string {
@@ -56,13 +105,9 @@ func CertificatesFromChains(data *CertWithChainData) []Certificate {
 	certs := make([]Certificate, len(payloads))
 	for i := range payloads {
 		// Add the certificate.
-		certs[i] = Certificate{
-			CertID:   certIDs[i],
-			ParentID: parentIDs[i],
-			Names:    names[i],
-			NotAfter: payloads[i].NotAfter,
-			Raw:      payloads[i].Raw,
-		}
+		// Only the leaf, the first one, has names and uses the chain.
+		certs[i] = NewCertificate(&payloads[i], certIDs[i], parentIDs[i], names[i],
+			data.ChainPayloads)
 	}
 
 	return certs
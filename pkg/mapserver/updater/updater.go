@@ -4,17 +4,22 @@ import (
 	"bytes"
 	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"slices"
 	"sort"
+	"sync"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
+	ct "github.com/google/certificate-transparency-go"
 	ctx509 "github.com/google/certificate-transparency-go/x509"
 	"github.com/netsec-ethz/fpki/pkg/common"
 	"github.com/netsec-ethz/fpki/pkg/db"
-	"github.com/netsec-ethz/fpki/pkg/db/mysql"
+	"github.com/netsec-ethz/fpki/pkg/db/backends"
 	"github.com/netsec-ethz/fpki/pkg/mapserver/logfetcher"
 	"github.com/netsec-ethz/fpki/pkg/mapserver/trie"
+	"github.com/netsec-ethz/fpki/pkg/statistics"
 	"github.com/netsec-ethz/fpki/pkg/util"
 )
 
@@ -26,6 +31,11 @@ type MapUpdater struct {
 	Fetchers []logfetcher.Fetcher
 	Conn     db.Conn
 
+	// Configuration of the Manager used by UpdateFromLogs.
+	DBWorkers       int  // Number of concurrent DB writers.
+	MultiInsertSize int  // Amount of entries before calling the DB.
+	StreamCsv       bool // See Manager.StreamCsv.
+
 	updateStartTime        time.Time        // the time when the update process was started (used to decide whether to consider a certificate expired or not)
 	currFetcher            int              // the fetcher being used once StartFetchingRemaining is called
 	currFetcherInitialized bool             // false if the current fetcher has not yet been initialized by calling startNextFetcher()
@@ -38,27 +48,62 @@ type MapUpdater struct {
 	lastBatchFinished time.Time // the time when the last batch finished processing (only used for debugging/logging)
 }
 
-// NewMapUpdater: return a new map updater.
+// Default configuration of the Manager used by UpdateFromLogs.
+const (
+	defaultDBWorkers       = 32
+	defaultMultiInsertSize = 10_000
+)
+
+// NewMapUpdater: return a new map updater. See NewFetchers for the arguments that configure
+// the fetchers of the URLs.
 func NewMapUpdater(
 	config *db.Configuration,
 	urls []string,
 	localCertificateFolders map[string]string,
+	staticLogs map[string]logfetcher.StaticLogConfig,
+	publicKeys map[string][]byte,
 	csvIngestionMaxRows uint64,
+	fetcherOptions ...logfetcher.FetcherOption,
 ) (*MapUpdater, error) {
-	if len(urls) == 0 {
-		return nil, fmt.Errorf("no URLs")
+	fetchers, err := NewFetchers(urls, localCertificateFolders, staticLogs, publicKeys,
+		csvIngestionMaxRows, fetcherOptions...)
+	if err != nil {
+		return nil, err
 	}
 	// db conn for map updater
-	dbConn, err := mysql.Connect(config)
+	dbConn, err := backends.Connect(config)
 	if err != nil {
 		return nil, fmt.Errorf("NewMapUpdater | db.Connect | %w", err)
 	}
 
-	_, err = dbConn.DB().Exec("ALTER INSTANCE DISABLE INNODB REDO_LOG;")
-	if err != nil {
+	if err := dbConn.DisableRedoLog(context.Background()); err != nil {
 		return nil, err
 	}
 
+	return &MapUpdater{
+		Fetchers:        fetchers,
+		Conn:            dbConn,
+		DBWorkers:       defaultDBWorkers,
+		MultiInsertSize: defaultMultiInsertSize,
+	}, nil
+}
+
+// NewFetchers returns a fetcher for each URL. The URLs in localCertificateFolders are read from
+// their folder, and those in staticLogs as tiled logs, see logfetcher.StaticLogFetcher.
+// The tree heads of the logs in publicKeys are verified with their key. The options apply to
+// the fetchers of the URLs without a local certificate folder.
+func NewFetchers(
+	urls []string,
+	localCertificateFolders map[string]string,
+	staticLogs map[string]logfetcher.StaticLogConfig,
+	publicKeys map[string][]byte,
+	csvIngestionMaxRows uint64,
+	fetcherOptions ...logfetcher.FetcherOption,
+) ([]logfetcher.Fetcher, error) {
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("no URLs")
+	}
+
 	fetchers := make([]logfetcher.Fetcher, len(urls))
 	alreadyURLs := make(map[string]struct{}, len(urls))
 	for i, url := range urls {
@@ -67,21 +112,24 @@ func NewMapUpdater(
 			return nil, fmt.Errorf("URL %s is duplicated", url)
 		}
 		alreadyURLs[url] = struct{}{}
+		options := fetcherOptions
+		if key, ok := publicKeys[url]; ok {
+			options = append(slices.Clip(options), logfetcher.WithPublicKey(key))
+		}
 		// Keep a new fetcher for the url.
+		var err error
 		if folder, ok := localCertificateFolders[url]; ok {
 			fetchers[i], err = logfetcher.NewLocalLogFetcher(url, folder, csvIngestionMaxRows)
+		} else if staticLog, ok := staticLogs[url]; ok {
+			fetchers[i], err = logfetcher.NewStaticLogFetcher(url, staticLog, options...)
 		} else {
-			fetchers[i], err = logfetcher.NewHttpLogFetcher(url)
+			fetchers[i], err = logfetcher.NewHttpLogFetcher(url, options...)
 		}
 		if err != nil {
 			return nil, err
 		}
 	}
-
-	return &MapUpdater{
-		Fetchers: fetchers,
-		Conn:     dbConn,
-	}, nil
+	return fetchers, nil
 }
 
 // GetProgress returns the URL of the current fetcher, four sizes for the log (those being
@@ -135,14 +183,15 @@ func (u *MapUpdater) NextBatch(ctx context.Context) (bool, error) {
 
 // UpdateNextBatch downloads the next batch from the CT log server and updates the domain and
 // Updates tables. Also the SMT.
-// TODO(juagargi) This can be optimized by having to pipelines: one for downloading and one for
-// inserting into the DB. See also NextBatch.
+// The batches of the fetchers are downloaded and inserted sequentially; see UpdateFromLogs
+// for the pipelined and parallel version.
 func (u *MapUpdater) UpdateNextBatch(ctx context.Context) (int, error) {
 	fetcher := u.Fetchers[u.currFetcher]
 	certs, chains, excludedCerts, err := fetcher.ReturnNextBatch()
 	if err != nil {
 		return 0, fmt.Errorf("fetcher: %w", err)
 	}
+	quarantinedCerts := quarantinedInBatch(fetcher)
 
 	// Verify validity of this batch.
 	// TODO(juagargi) It won't work like this. The only STHs we have are the last one and
@@ -179,7 +228,7 @@ func (u *MapUpdater) UpdateNextBatch(ctx context.Context) (int, error) {
 	if progressErr != nil {
 		err = fmt.Errorf("error printing progress information: %s", err)
 	} else {
-		fmt.Printf("Batch with size %d (%d excluded) updated in %.2fs (%.2fs verifying, %.2fs inserting); log %s progress: (current %d [%.0f%%], target %d, real %d) at %s\n", n, excludedCerts, totalTime, verificationTime, insertionTime, logUrl, currentIndex, 100.0*(float64(currentIndex)-float64(origIndex))/(float64(maxIndex)-float64(origIndex)), maxIndex, realMaxIndex, getTime())
+		fmt.Printf("Batch with size %d (%d excluded, %d quarantined) updated in %.2fs (%.2fs verifying, %.2fs inserting); log %s progress: (current %d [%.0f%%], target %d, real %d) at %s\n", n, excludedCerts-quarantinedCerts, quarantinedCerts, totalTime, verificationTime, insertionTime, logUrl, currentIndex, 100.0*(float64(currentIndex)-float64(origIndex))/(float64(maxIndex)-float64(origIndex)), maxIndex, realMaxIndex, getTime())
 	}
 	if u.lastState.Size == u.targetState.Size {
 		// Update the DB with all certs collected from this fetcher
@@ -191,6 +240,142 @@ func (u *MapUpdater) UpdateNextBatch(ctx context.Context) (int, error) {
 	return n, err
 }
 
+// UpdateFromLogs downloads the remaining certificates of all the CT logs in parallel, and
+// inserts them into the DB using a Manager. The Manager blocks the fetchers when the DB cannot
+// keep up, and the fetchers stop downloading when their batches are not consumed.
+// The state of each log server is stored in the DB only after all the certificates have been
+// inserted, and only for the logs that were fetched without errors.
+func (u *MapUpdater) UpdateFromLogs(ctx context.Context) error {
+	u.updateStartTime = time.Now()
+	fmt.Printf("Starting new parallel update cycle at %s\n",
+		u.updateStartTime.UTC().Format(time.RFC3339))
+
+	manager, err := NewManager(
+		u.DBWorkers,
+		u.Conn,
+		u.MultiInsertSize,
+		statistics.NewStatistics(time.Hour, nil),
+	)
+	if err != nil {
+		return fmt.Errorf("creating the DB manager: %w", err)
+	}
+	manager.StreamCsv = u.StreamCsv
+	manager.Resume(ctx)
+	incoming := manager.IncomingCertChan
+
+	// Fetch all logs concurrently. An error in one log does not stop the others.
+	targets := make([]logfetcher.State, len(u.Fetchers))
+	errs := make([]error, len(u.Fetchers))
+	wg := sync.WaitGroup{}
+	for i, fetcher := range u.Fetchers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			targets[i], errs[i] = u.fetchLog(ctx, fetcher, incoming)
+			if errs[i] != nil {
+				errs[i] = fmt.Errorf("fetching log %s: %w", fetcher.URL(), errs[i])
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Wait for the DB to have all the certificates.
+	manager.Stop()
+	if err := manager.Wait(ctx); err != nil {
+		return errors.Join(append(errs, fmt.Errorf("inserting certificates: %w", err))...)
+	}
+
+	// Store the state of the fetched logs.
+	for i, fetcher := range u.Fetchers {
+		if errs[i] != nil {
+			continue
+		}
+		err := u.Conn.UpdateLastCTlogServerState(ctx, fetcher.URL(),
+			int64(targets[i].Size),
+			targets[i].STH)
+		if err != nil {
+			return err
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// fetchLog downloads the certificates of the log, from the size stored in the DB up to the
+// current size of the log server, and sends them and their chains to out.
+// It returns the state of the log server the certificates correspond to.
+func (u *MapUpdater) fetchLog(
+	ctx context.Context,
+	fetcher logfetcher.Fetcher,
+	out chan<- Certificate,
+) (logfetcher.State, error) {
+
+	if err := fetcher.Initialize(u.updateStartTime); err != nil {
+		return logfetcher.State{}, fmt.Errorf("initializing fetcher: %w", err)
+	}
+	lastSize, lastSTH, err := u.Conn.LastCTlogServerState(ctx, fetcher.URL())
+	if err != nil {
+		return logfetcher.State{}, fmt.Errorf("getting the last retrieved index number from DB: %w",
+			err)
+	}
+	origState := logfetcher.State{
+		Size: uint64(lastSize),
+		STH:  lastSTH,
+	}
+	targetState, err := fetcher.GetCurrentState(ctx, origState)
+	if err != nil {
+		return logfetcher.State{}, fmt.Errorf("getting the size of the CT log server: %w", err)
+	}
+
+	fetcher.StartFetching(lastSize, int64(targetState.Size)-1)
+	defer fetcher.StopFetching()
+
+	count, quarantined := 0, 0
+	for fetcher.NextBatch(ctx) {
+		leafCerts, chains, _, err := fetcher.ReturnNextBatch()
+		if err != nil {
+			return logfetcher.State{}, err
+		}
+		quarantined += quarantinedInBatch(fetcher)
+		if len(leafCerts) != len(chains) {
+			return logfetcher.State{}, fmt.Errorf(
+				"inconsistent certs and chains count: %d and %d respectively",
+				len(leafCerts), len(chains))
+		}
+		if err := u.verifyValidity(ctx, leafCerts, chains); err != nil {
+			return logfetcher.State{}, fmt.Errorf("validity from CT log server: %w", err)
+		}
+
+		certs, certIDs, parentIDs, names := util.UnfoldCerts(leafCerts, chains)
+		for i := range certs {
+			// The leaves come first.
+			var chain []*ctx509.Certificate
+			if i < len(chains) {
+				chain = chains[i]
+			}
+			select {
+			case out <- NewCertificate(&certs[i], certIDs[i], parentIDs[i], names[i], chain):
+			case <-ctx.Done():
+				return logfetcher.State{}, ctx.Err()
+			}
+		}
+		count += len(leafCerts)
+	}
+	if err := ctx.Err(); err != nil {
+		return logfetcher.State{}, err
+	}
+	fmt.Printf("log %s: %d certificates fetched, %d entries quarantined, up to size %d at %s\n",
+		fetcher.URL(), count, quarantined, targetState.Size, getTime())
+	return targetState, nil
+}
+
+// quarantinedInBatch returns how many entries of the last batch of the fetcher were quarantined.
+func quarantinedInBatch(fetcher logfetcher.Fetcher) int {
+	if f, ok := fetcher.(logfetcher.QuarantiningFetcher); ok {
+		return f.Quarantined()
+	}
+	return 0
+}
+
 // UpdateCertsLocally: add certs (in the form of asn.1 encoded byte arrays) directly
 // without querying log.
 func (u *MapUpdater) UpdateCertsLocally(
@@ -343,7 +528,9 @@ func UpdateWithOverwrite(ctx context.Context, conn db.Conn, domainNames [][]stri
 		payloads[i] = c.Raw
 
 	}
-	err := insertCerts(ctx, conn, domainNames, certIDs, parentCertIDs, certExpirations, payloads)
+	entries := certificateEntries(domainNames, certIDs, parentCertIDs, certs)
+	err := insertCerts(ctx, conn, domainNames, certIDs, parentCertIDs, certExpirations, payloads,
+		entries)
 	if err != nil {
 		return err
 	}
@@ -383,28 +570,45 @@ func UpdateWithKeepExisting(
 		return err
 	}
 
-	// For all those certificates not already present in the DB, prepare three slices: IDs,
-	// names, payloads, and parentIDs.
+	// The chains of the leaves may be certificates already present.
+	entries := certificateEntries(domainNames, certIDs, parentCertIDs, certs)
+
+	// For all those certificates not already present in the DB, prepare the slices: IDs,
+	// names, payloads, parentIDs and entries.
 	payloads := make([][]byte, 0, len(certs))
 	runWhenFalse(maskCerts, func(to, from int) {
 		certIDs[to] = certIDs[from]
 		domainNames[to] = domainNames[from]
 		parentCertIDs[to] = parentCertIDs[from]
+		entries[to] = entries[from]
 		payloads = append(payloads, certs[from].Raw)
 	})
 	// Trim the end of the original ID slice, as it contains values from the unmasked certificates.
 	certIDs = certIDs[:len(payloads)]
 	domainNames = domainNames[:len(payloads)]
 	parentCertIDs = parentCertIDs[:len(payloads)]
+	entries = entries[:len(payloads)]
 
 	// Update those certificates that were not in the mask.
-	err = insertCerts(ctx, conn, domainNames, certIDs, parentCertIDs, certExpirations, payloads)
+	err = insertCerts(ctx, conn, domainNames, certIDs, parentCertIDs, certExpirations, payloads,
+		entries)
 	if err != nil {
 		return err
 	}
 
+	return UpdatePoliciesWithKeepExisting(ctx, conn, policies)
+}
+
+// UpdatePoliciesWithKeepExisting inserts the policies not already present in the DB, and marks
+// their domains as dirty.
+func UpdatePoliciesWithKeepExisting(
+	ctx context.Context,
+	conn db.Conn,
+	policies []common.PolicyDocument,
+) error {
+
 	// Prepare data structures for the policies.
-	payloads = make([][]byte, len(policies))
+	payloads := make([][]byte, len(policies))
 	policyIDs := make([]common.SHA256Output, len(policies))
 	policySubjects := make([]string, len(policies))
 	for i, pol := range policies {
@@ -430,9 +634,7 @@ func UpdateWithKeepExisting(
 	payloads = payloads[:n]
 	policySubjects = policySubjects[:n]
 	// Update those policies that were not in the mask.
-	err = insertPolicies(ctx, conn, policySubjects, policyIDs, payloads)
-
-	return err
+	return insertPolicies(ctx, conn, policySubjects, policyIDs, payloads)
 }
 
 func CoalescePayloadsForDirtyDomains(ctx context.Context, conn db.Conn) error {
@@ -564,9 +766,149 @@ func UpdateSMT(ctx context.Context, conn db.Conn) error {
 	}
 	fmt.Printf("smt [%s]: new root saved\n", time.Now().Format(time.Stamp))
 
+	// Record the update, so that replicas can follow it.
+	epoch, err := conn.RecordEpoch(ctx)
+	if err != nil {
+		return err
+	}
+	if epoch != nil {
+		fmt.Printf("smt [%s]: recorded epoch %d\n", time.Now().Format(time.Stamp), epoch.Number)
+	}
+
 	return nil
 }
 
+// certificateEntries returns the entries of the leaves of the certificates, those with names,
+// with the chains of their parents in the certificates.
+func certificateEntries(
+	names [][]string,
+	ids []common.SHA256Output,
+	parentIDs []*common.SHA256Output,
+	certs []ctx509.Certificate,
+) []*db.CertificateEntry {
+
+	indices := make(map[common.SHA256Output]int, len(ids))
+	for i, id := range ids {
+		indices[id] = i
+	}
+	entries := make([]*db.CertificateEntry, len(certs))
+	for i := range certs {
+		if names[i] == nil {
+			continue
+		}
+		// The issuer key hash needs at most the two first certificates of the chain.
+		var chain []*ctx509.Certificate
+		for parent := parentIDs[i]; parent != nil && len(chain) < 2; {
+			j, ok := indices[*parent]
+			if !ok {
+				break
+			}
+			chain = append(chain, &certs[j])
+			parent = parentIDs[j]
+		}
+		entries[i] = NewCertificateEntry(&certs[i], chain)
+	}
+	return entries
+}
+
+// DeriveCertificateEntries sets the entry of the leaves stored without one, i.e. those ingested
+// before the certs table stored them, and the issuer key hash of the precertificates stored
+// without it, reading the certs table in pages of pageSize rows.
+// Without the entry, a precertificate is not replaced in the payload of its domains by its
+// final certificate: the domains of the precertificates are marked dirty, so that their
+// payloads are coalesced again by the next update. It returns the number of leaves updated.
+func DeriveCertificateEntries(ctx context.Context, conn db.Conn, pageSize int) (int, error) {
+	updated := 0
+	var after *common.SHA256Output
+	for {
+		recs, err := conn.RetrieveCertificatesPage(ctx, after, pageSize)
+		if err != nil {
+			return updated, err
+		}
+		if len(recs) == 0 {
+			return updated, nil
+		}
+		after = &recs[len(recs)-1].ID
+
+		var ids []common.SHA256Output
+		var entries []db.CertificateEntry
+		var dirty []common.SHA256Output
+		for _, rec := range recs {
+			// The precertificates stored before their issuer key hash may get it.
+			if rec.Entry != nil &&
+				(rec.Entry.Type != ct.PrecertLogEntryType || rec.Entry.IssuerKeyHash != nil) {
+				continue
+			}
+			cert, err := ctx509.ParseCertificate(rec.Payload)
+			if err != nil {
+				return updated, fmt.Errorf("parsing certificate %x: %w", rec.ID, err)
+			}
+			if cert.IsCA {
+				continue
+			}
+			// Only the leaves are associated with domains.
+			domains, err := conn.RetrieveCertificateDomains(ctx, rec.ID)
+			if err != nil {
+				return updated, err
+			}
+			if len(domains) == 0 {
+				continue
+			}
+			chain, err := retrieveIssuerChain(ctx, conn, rec.ParentID)
+			if err != nil {
+				return updated, err
+			}
+			entry := NewCertificateEntry(cert, chain)
+			if entry == nil || (rec.Entry != nil && entry.IssuerKeyHash == nil) {
+				continue
+			}
+			ids = append(ids, rec.ID)
+			entries = append(entries, *entry)
+			if rec.Entry == nil && entry.Type == ct.PrecertLogEntryType {
+				for _, d := range domains {
+					dirty = append(dirty, d.DomainID)
+				}
+			}
+		}
+		if err := conn.UpdateCertificateEntries(ctx, ids, entries); err != nil {
+			return updated, err
+		}
+		if len(dirty) > 0 {
+			if err := conn.InsertDomainsIntoDirty(ctx, dirty); err != nil {
+				return updated, err
+			}
+		}
+		updated += len(ids)
+	}
+}
+
+// retrieveIssuerChain returns the parsed certificates of the chain starting at the parent,
+// up to the two needed by util.PrecertIssuerKeyHash.
+func retrieveIssuerChain(
+	ctx context.Context,
+	conn db.Conn,
+	parentID *common.SHA256Output,
+) ([]*ctx509.Certificate, error) {
+
+	var chain []*ctx509.Certificate
+	for parentID != nil && len(chain) < 2 {
+		recs, err := conn.RetrieveCertificateRecords(ctx, []common.SHA256Output{*parentID})
+		if err != nil {
+			return nil, err
+		}
+		if recs[0] == nil {
+			break
+		}
+		cert, err := ctx509.ParseCertificate(recs[0].Payload)
+		if err != nil {
+			return nil, fmt.Errorf("parsing certificate %x: %w", *parentID, err)
+		}
+		chain = append(chain, cert)
+		parentID = recs[0].ParentID
+	}
+	return chain, nil
+}
+
 func loadRoot(ctx context.Context, conn db.Conn) ([]byte, error) {
 	var root []byte
 	if rootID, err := conn.LoadRoot(ctx); err != nil {
@@ -585,6 +927,7 @@ func insertCerts(
 	parentIDs []*common.SHA256Output,
 	expirations []time.Time,
 	payloads [][]byte,
+	entries []*db.CertificateEntry,
 ) error {
 
 	if len(ids) == 0 {
@@ -595,8 +938,8 @@ func insertCerts(
 	// Disable redo-logs with:
 	// ALTER INSTANCE DISABLE INNODB REDO_LOG
 
-	// Send hash, parent hash, expiration and payload to the certs table.
-	if err := conn.UpdateCerts(ctx, ids, parentIDs, expirations, payloads); err != nil {
+	// Send hash, parent hash, expiration, payload and entry to the certs table.
+	if err := conn.UpdateCerts(ctx, ids, parentIDs, expirations, payloads, entries); err != nil {
 		return fmt.Errorf("inserting certificates: %w", err)
 	}
 	// around 3 seconds for this ^^ (100K certs)
@@ -3,14 +3,19 @@ package updater
 import (
 	"context"
 	"encoding/hex"
+	"fmt"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	ct "github.com/google/certificate-transparency-go"
 	ctx509 "github.com/google/certificate-transparency-go/x509"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/db"
+	"github.com/netsec-ethz/fpki/pkg/db/embedded"
 	"github.com/netsec-ethz/fpki/pkg/mapserver/logfetcher"
 	"github.com/netsec-ethz/fpki/pkg/tests/random"
 	"github.com/netsec-ethz/fpki/pkg/tests/testdb"
@@ -163,7 +168,7 @@ func TestMapUpdaterStartFetchingRemaining(t *testing.T) {
 	defer cancelF()
 
 	url := "myURL"
-	updater, err := NewMapUpdater(config, []string{url}, map[string]string{}, 0)
+	updater, err := NewMapUpdater(config, []string{url}, map[string]string{}, nil, nil, 0)
 	require.NoError(t, err)
 
 	// Replace fetcher with a mock one.
@@ -313,7 +318,7 @@ func TestMapUpdaterStartFetchingRemainingNextDay(t *testing.T) {
 	defer cancelF()
 
 	url := "myURL_" + t.Name()
-	updater, err := NewMapUpdater(config, []string{url}, map[string]string{}, 0)
+	updater, err := NewMapUpdater(config, []string{url}, map[string]string{}, nil, nil, 0)
 	require.NoError(t, err)
 
 	// Replace fetcher with a mock one.
@@ -393,7 +398,7 @@ func TestMultipleFetchers(t *testing.T) {
 		t.Name() + "_2",
 		t.Name() + "_3",
 	}
-	updater, err := NewMapUpdater(config, urls, map[string]string{}, 0)
+	updater, err := NewMapUpdater(config, urls, map[string]string{}, nil, nil, 0)
 	require.NoError(t, err)
 
 	// Replace fetchers with mock ones.
@@ -471,6 +476,205 @@ func TestMultipleFetchers(t *testing.T) {
 	require.Equal(t, totalSize, onReturnNextBatchCalls)
 }
 
+// TestUpdateFromLogs checks that all logs are fetched in parallel into the DB, and that the
+// state of a log is only stored if it was fetched without errors.
+// It uses the embedded backend, which needs no DB server.
+func TestUpdateFromLogs(t *testing.T) {
+	ctx, cancelF := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelF()
+
+	urls := []string{
+		t.Name() + "_1",
+		t.Name() + "_2",
+		t.Name() + "_3",
+	}
+	config := db.NewConfig(embedded.WithDirectory(t.TempDir()))
+	updater, err := NewMapUpdater(config, urls, map[string]string{}, nil, nil, 0)
+	require.NoError(t, err)
+	defer updater.Conn.Close()
+	updater.DBWorkers = 4
+	updater.MultiInsertSize = 10
+	updater.StreamCsv = true // No temporary CSV files.
+
+	// Replace fetchers with mock ones. The last one fails after its first batch.
+	var onStopFetchingCalls atomic.Int64
+	batchSize := int64(3)
+	fetcherSizes := []int64{10, 11, 12}
+	for i, url := range urls {
+		// The random package is not safe for concurrent use: create the certificates now.
+		allCerts := make([]ctx509.Certificate, fetcherSizes[i])
+		for j := range allCerts {
+			allCerts[j] = random.RandomX509Cert(t, fmt.Sprintf("%d-%d.com", i, j))
+		}
+		sentCertCount := int64(0)
+		fetcher := &mockFetcher{
+			url:  url,
+			size: fetcherSizes[i],
+			STH:  []byte{byte(i), 2, 3, 4},
+			onStopFetching: func() {
+				onStopFetchingCalls.Add(1)
+			},
+		}
+		fetcher.onNextBatch = func(ctx context.Context) bool {
+			return fetcher.size-sentCertCount > 0
+		}
+		fetcher.onReturnNextBatch = func() (
+			[]ctx509.Certificate,
+			[][]*ctx509.Certificate,
+			int,
+			error,
+		) {
+			if i == 2 && sentCertCount > 0 {
+				return nil, nil, 0, fmt.Errorf("mock error")
+			}
+			n := min(batchSize, fetcher.size-sentCertCount)
+			certs := allCerts[sentCertCount : sentCertCount+n]
+			sentCertCount += n
+			return certs, make([][]*ctx509.Certificate, n), 0, nil
+		}
+		updater.Fetchers[i] = fetcher
+	}
+
+	err = updater.UpdateFromLogs(ctx)
+	require.Error(t, err)
+	require.ErrorContains(t, err, "mock error")
+	require.ErrorContains(t, err, urls[2])
+	require.Equal(t, int64(3), onStopFetchingCalls.Load())
+
+	// All certificates sent before the error are in the DB.
+	counts, err := updater.Conn.CountRows(ctx)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10+11+batchSize), counts.Certs)
+
+	// Only the logs without errors have their state stored.
+	for i, url := range urls[:2] {
+		size, sth, err := updater.Conn.LastCTlogServerState(ctx, url)
+		require.NoError(t, err)
+		require.Equal(t, fetcherSizes[i], size)
+		require.Equal(t, []byte{byte(i), 2, 3, 4}, sth)
+	}
+	size, _, err := updater.Conn.LastCTlogServerState(ctx, urls[2])
+	require.NoError(t, err)
+	require.Equal(t, int64(0), size)
+}
+
+// TestUpdateFromLogsPrecerts checks that the payload of a domain has the final certificate
+// instead of its precertificate, when both were fetched.
+func TestUpdateFromLogsPrecerts(t *testing.T) {
+	ctx, cancelF := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelF()
+
+	url := t.Name()
+	config := db.NewConfig(embedded.WithDirectory(t.TempDir()))
+	updater, err := NewMapUpdater(config, []string{url}, map[string]string{}, nil, nil, 0)
+	require.NoError(t, err)
+	defer updater.Conn.Close()
+	updater.StreamCsv = true // No temporary CSV files.
+
+	issuer := random.RandomX509Cert(t, "issuer.com")
+	precert, final := random.RandomX509Precert(t, "a.com")
+	other := random.RandomX509Cert(t, "a.com")
+	certs := []ctx509.Certificate{precert, other, final}
+	sent := false
+	fetcher := &mockFetcher{
+		url:  url,
+		size: int64(len(certs)),
+	}
+	fetcher.onNextBatch = func(ctx context.Context) bool {
+		return !sent
+	}
+	fetcher.onReturnNextBatch = func() (
+		[]ctx509.Certificate,
+		[][]*ctx509.Certificate,
+		int,
+		error,
+	) {
+		sent = true
+		chain := []*ctx509.Certificate{&issuer}
+		return certs, [][]*ctx509.Certificate{chain, chain, chain}, 0, nil
+	}
+	updater.Fetchers[0] = fetcher
+
+	require.NoError(t, updater.UpdateFromLogs(ctx))
+	require.NoError(t, updater.CoalescePayloadsForDirtyDomains(ctx))
+	_, certIDs, err := updater.Conn.RetrieveDomainCertificatesIDs(ctx,
+		common.SHA256Hash32Bytes([]byte("a.com")))
+	require.NoError(t, err)
+	expected, _ := glueSortedIDsAndComputeItsID([]common.SHA256Output{
+		common.SHA256Hash32Bytes(issuer.Raw),
+		common.SHA256Hash32Bytes(other.Raw),
+		common.SHA256Hash32Bytes(final.Raw),
+	})
+	require.Equal(t, expected, certIDs)
+}
+
+// TestDeriveCertificateEntries checks that the entries of the leaves stored without them are
+// derived, and that the domains of the precertificates are coalesced again.
+func TestDeriveCertificateEntries(t *testing.T) {
+	ctx, cancelF := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelF()
+
+	conn, err := embedded.Connect(db.NewConfig(embedded.WithDirectory(t.TempDir())))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	issuer := random.RandomX509Cert(t, "issuer.com")
+	precert, final := random.RandomX509Precert(t, "a.com")
+	issuerID := common.SHA256Hash32Bytes(issuer.Raw)
+	precertID := common.SHA256Hash32Bytes(precert.Raw)
+	finalID := common.SHA256Hash32Bytes(final.Raw)
+	ids := []common.SHA256Output{issuerID, precertID, finalID}
+	expiration := time.Now().Add(time.Hour)
+	err = conn.UpdateCerts(ctx, ids,
+		[]*common.SHA256Output{nil, &issuerID, &issuerID},
+		[]time.Time{expiration, expiration, expiration},
+		[][]byte{issuer.Raw, precert.Raw, final.Raw},
+		nil)
+	require.NoError(t, err)
+	domainID := common.SHA256Hash32Bytes([]byte("a.com"))
+	err = conn.UpdateDomainCerts(ctx, []common.SHA256Output{domainID, domainID},
+		[]common.SHA256Output{precertID, finalID})
+	require.NoError(t, err)
+
+	// Pages of two rows.
+	n, err := DeriveCertificateEntries(ctx, conn, 2)
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	records, err := conn.RetrieveCertificateRecords(ctx, ids)
+	require.NoError(t, err)
+	require.Nil(t, records[0].Entry)
+	tbsID, err := util.CertificateTBSID(&final)
+	require.NoError(t, err)
+	parsedIssuer, err := ctx509.ParseCertificate(issuer.Raw)
+	require.NoError(t, err)
+	issuerKeyHash := common.SHA256Hash32Bytes(parsedIssuer.RawSubjectPublicKeyInfo)
+	require.Equal(t, &db.CertificateEntry{
+		Type:          ct.PrecertLogEntryType,
+		TBSID:         tbsID,
+		IssuerKeyHash: &issuerKeyHash,
+	}, records[1].Entry)
+	require.Equal(t, &db.CertificateEntry{
+		Type:  ct.X509LogEntryType,
+		TBSID: tbsID,
+	}, records[2].Entry)
+	dirty, err := conn.RetrieveDirtyDomains(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []common.SHA256Output{domainID}, dirty)
+
+	// Nothing else to derive.
+	n, err = DeriveCertificateEntries(ctx, conn, 2)
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+
+	// The payload of the domain has the final certificate instead of its precertificate.
+	require.NoError(t, CoalescePayloadsForDirtyDomains(ctx, conn))
+	_, certIDs, err := conn.RetrieveDomainCertificatesIDs(ctx, domainID)
+	require.NoError(t, err)
+	expected, _ := glueSortedIDsAndComputeItsID([]common.SHA256Output{issuerID, finalID})
+	require.Equal(t, expected, certIDs)
+}
+
 func glueSortedIDsAndComputeItsID(IDs []common.SHA256Output) ([]byte, common.SHA256Output) {
 	gluedIDs := common.SortIDsAndGlue(IDs)
 	// Compute the hash of the glued IDs.
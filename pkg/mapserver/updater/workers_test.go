@@ -9,7 +9,11 @@ import (
 	"testing"
 	"time"
 
+	ct "github.com/google/certificate-transparency-go"
+
+	"github.com/netsec-ethz/fpki/pkg/cache"
 	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/db"
 	pip "github.com/netsec-ethz/fpki/pkg/pipeline"
 	"github.com/netsec-ethz/fpki/pkg/statistics"
 	"github.com/netsec-ethz/fpki/pkg/tests"
@@ -209,6 +213,35 @@ func TestDomainBatcherAllocationOverhead(t *testing.T) {
 	require.LessOrEqual(t, allocs, N/10)
 }
 
+// TestDomainExtractorPrecerts checks that only the first certificate of a domain is output,
+// except for the precertificates and their final certificates.
+func TestDomainExtractorPrecerts(t *testing.T) {
+	w := &domainExtractor{
+		hasher:        *common.NewHasher(),
+		domainIdCache: cache.NewLruCache(10),
+	}
+	id := common.SHA256Hash32Bytes([]byte("a.com"))
+	tbsID := common.SHA256Hash32Bytes([]byte("tbs"))
+	otherTBSID := common.SHA256Hash32Bytes([]byte("other tbs"))
+	precert := &db.CertificateEntry{Type: ct.PrecertLogEntryType, TBSID: tbsID}
+	final := &db.CertificateEntry{Type: ct.X509LogEntryType, TBSID: tbsID}
+	other := &db.CertificateEntry{Type: ct.X509LogEntryType, TBSID: otherTBSID}
+
+	require.True(t, w.isNew(&id, precert))
+	require.False(t, w.isNew(&id, precert))
+	require.True(t, w.isNew(&id, other))
+	require.False(t, w.isNew(&id, other))
+	require.False(t, w.isNew(&id, nil))
+	// The final certificate of the output precertificate.
+	require.True(t, w.isNew(&id, final))
+
+	// Another domain, whose final certificate comes first.
+	id = common.SHA256Hash32Bytes([]byte("b.com"))
+	require.True(t, w.isNew(&id, final))
+	require.True(t, w.isNew(&id, precert))
+	require.False(t, w.isNew(&id, other))
+}
+
 func TestRingCacheRotatePreservesReturnedCertificateBatch(t *testing.T) {
 	// Rotation must not mutate the batch slice that was just handed downstream; otherwise
 	// clearing a recycled buffer could corrupt an in-flight insert batch.
@@ -1,6 +1,7 @@
 package statistics
 
 import (
+	"sync"
 	"sync/atomic"
 	"time"
 )
@@ -19,11 +20,20 @@ type Stats struct {
 	TotalFiles     atomic.Int64
 	TotalFilesRead atomic.Int64
 
-	TotalRows atomic.Int64
-	ReadRows  atomic.Int64
+	TotalRows     atomic.Int64
+	ReadRows      atomic.Int64
+	MalformedRows atomic.Int64 // Skipped or quarantined instead of failing.
+
+	QuarantinedEntries atomic.Int64 // Entries of CT logs that could not be parsed.
 
 	TotalCerts atomic.Int64
 
+	CacheEvictions atomic.Int64 // Of the bounded cache of certificate IDs.
+
+	// The lookups of the caches are counted by the caches themselves, see CacheLookups.
+	cacheLookupsMu sync.Mutex
+	cacheLookups   []func() (hits, misses int64)
+
 	updateFreq  time.Duration
 	updateFunc  func(*Stats)
 	statsTicker *time.Ticker
@@ -48,6 +58,26 @@ func NewStatistics(
 	return stats
 }
 
+// AddCacheLookups adds a function returning the hits and misses of a cache, which counts its
+// lookups apart to not contend for the statistics. See CacheLookups.
+func (s *Stats) AddCacheLookups(lookups func() (hits, misses int64)) {
+	s.cacheLookupsMu.Lock()
+	defer s.cacheLookupsMu.Unlock()
+	s.cacheLookups = append(s.cacheLookups, lookups)
+}
+
+// CacheLookups returns the sum of the hits and misses of the caches added with AddCacheLookups.
+func (s *Stats) CacheLookups() (hits, misses int64) {
+	s.cacheLookupsMu.Lock()
+	defer s.cacheLookupsMu.Unlock()
+	for _, lookups := range s.cacheLookups {
+		h, m := lookups()
+		hits += h
+		misses += m
+	}
+	return hits, misses
+}
+
 func (s *Stats) Start() {
 	s.LastStartTime = time.Now()
 	s.statsTicker.Reset(s.updateFreq)
@@ -2,7 +2,7 @@ package noopdb
 
 import (
 	"context"
-	"database/sql"
+	"io"
 	"time"
 
 	"github.com/netsec-ethz/fpki/pkg/common"
@@ -13,11 +13,19 @@ type Conn struct{}
 
 var _ db.Conn = (*Conn)(nil)
 
-func (*Conn) DB() *sql.DB {
+func (*Conn) Close() error {
 	return nil
 }
 
-func (*Conn) Close() error {
+func (*Conn) CheckSchema(context.Context) error {
+	return nil
+}
+
+func (*Conn) CountRows(context.Context) (*db.TableCounts, error) {
+	return &db.TableCounts{}, nil
+}
+
+func (*Conn) DisableRedoLog(context.Context) error {
 	return nil
 }
 
@@ -25,22 +33,42 @@ func (*Conn) TruncateAllTables(context.Context) error {
 	return nil
 }
 
+func (*Conn) Identity(context.Context) (db.Identity, error) {
+	return db.Identity{}, nil
+}
+
 func (*Conn) InsertCsvIntoCerts(context.Context, string) error {
 	return nil
 }
 
+func (*Conn) StreamCsvIntoCerts(context.Context, io.Reader) error {
+	return nil
+}
+
 func (*Conn) InsertCsvIntoDirty(context.Context, string) error {
 	return nil
 }
 
+func (*Conn) StreamCsvIntoDirty(context.Context, io.Reader) error {
+	return nil
+}
+
 func (*Conn) InsertCsvIntoDomains(context.Context, string) error {
 	return nil
 }
 
+func (*Conn) StreamCsvIntoDomains(context.Context, io.Reader) error {
+	return nil
+}
+
 func (*Conn) InsertCsvIntoDomainCerts(context.Context, string) error {
 	return nil
 }
 
+func (*Conn) StreamCsvIntoDomainCerts(context.Context, io.Reader) error {
+	return nil
+}
+
 func (*Conn) UpdateDomains(context.Context, []common.SHA256Output, []string) error {
 	return nil
 }
@@ -86,6 +114,10 @@ func (*Conn) RetrieveDirtyDomains(context.Context) ([]common.SHA256Output, error
 	return nil, nil
 }
 
+func (*Conn) CheckDomainsDirty(_ context.Context, ids []common.SHA256Output) ([]bool, error) {
+	return make([]bool, len(ids)), nil
+}
+
 func (*Conn) InsertDomainsIntoDirty(context.Context, []common.SHA256Output) error {
 	return nil
 }
@@ -102,7 +134,11 @@ func (*Conn) CheckCertsExist(context.Context, []common.SHA256Output) ([]bool, er
 	return nil, nil
 }
 
-func (*Conn) UpdateCerts(context.Context, []common.SHA256Output, []*common.SHA256Output, []time.Time, [][]byte) error {
+func (*Conn) UpdateCerts(context.Context, []common.SHA256Output, []*common.SHA256Output, []time.Time, [][]byte, []*db.CertificateEntry) error {
+	return nil
+}
+
+func (*Conn) UpdateCertificateEntries(context.Context, []common.SHA256Output, []db.CertificateEntry) error {
 	return nil
 }
 
@@ -150,6 +186,153 @@ func (*Conn) RetrievePolicyPayloads(context.Context, []common.SHA256Output) ([][
 	return nil, nil
 }
 
+func (*Conn) RetrieveCertificateRecords(context.Context, []common.SHA256Output,
+) ([]*db.PayloadRecord, error) {
+	return nil, nil
+}
+
+func (*Conn) RetrieveCertificateDomains(context.Context, common.SHA256Output,
+) ([]db.DomainRecord, error) {
+	return nil, nil
+}
+
+func (*Conn) RetrievePolicyRecords(context.Context, []common.SHA256Output,
+) ([]*db.PayloadRecord, error) {
+	return nil, nil
+}
+
+func (*Conn) RetrievePolicyDomains(context.Context, common.SHA256Output,
+) ([]db.DomainRecord, error) {
+	return nil, nil
+}
+
 func (*Conn) RetrieveCertificateOrPolicyPayloads(context.Context, []common.SHA256Output) ([][]byte, error) {
 	return nil, nil
 }
+
+func (*Conn) SearchDomains(context.Context, db.DomainSearch) ([]db.DomainRecord, error) {
+	return nil, nil
+}
+
+func (*Conn) CountDomains(context.Context, db.DomainSearch) (uint64, error) {
+	return 0, nil
+}
+
+func (*Conn) RetrieveDomainsPage(context.Context, *common.SHA256Output, int,
+) ([]db.DomainRecord, error) {
+	return nil, nil
+}
+
+func (*Conn) RetrieveCertificatesPage(context.Context, *common.SHA256Output, int,
+) ([]*db.PayloadRecord, error) {
+	return nil, nil
+}
+
+func (*Conn) RetrievePoliciesPage(context.Context, *common.SHA256Output, int,
+) ([]*db.PayloadRecord, error) {
+	return nil, nil
+}
+
+func (*Conn) RetrieveDomainCertsPage(context.Context, *db.DomainAssociation, int,
+) ([]db.DomainAssociation, error) {
+	return nil, nil
+}
+
+func (*Conn) RetrieveDomainPoliciesPage(context.Context, *db.DomainAssociation, int,
+) ([]db.DomainAssociation, error) {
+	return nil, nil
+}
+
+func (*Conn) RetrieveDomains(context.Context, []common.SHA256Output) ([]db.DomainRecord, error) {
+	return nil, nil
+}
+
+func (*Conn) RetrieveDomainAssociations(context.Context, []common.SHA256Output,
+) ([]db.DomainAssociation, []db.DomainAssociation, error) {
+	return nil, nil, nil
+}
+
+func (*Conn) ReplaceDomainAssociations(context.Context, []common.SHA256Output,
+	[]db.DomainAssociation, []db.DomainAssociation) error {
+	return nil
+}
+
+func (*Conn) RecordEpoch(context.Context) (*db.Epoch, error) {
+	return nil, nil
+}
+
+func (*Conn) SaveEpoch(context.Context, *db.Epoch) error {
+	return nil
+}
+
+func (*Conn) LastEpoch(context.Context) (*db.Epoch, error) {
+	return nil, nil
+}
+
+func (*Conn) RetrieveEpoch(context.Context, uint64) (*db.Epoch, error) {
+	return nil, nil
+}
+
+func (*Conn) RetrieveEpochDomainsPage(context.Context, uint64, uint64, *common.SHA256Output, int,
+) ([]common.SHA256Output, error) {
+	return nil, nil
+}
+
+func (*Conn) RetrieveTreeNodesPage(context.Context, uint64, uint64, int,
+) ([]*db.TreeNodeRecord, uint64, error) {
+	return nil, 0, nil
+}
+
+func (*Conn) RetrieveCertificateParents(context.Context, []common.SHA256Output,
+) ([]db.ParentRecord, error) {
+	return nil, nil
+}
+
+func (*Conn) RetrievePolicyParents(context.Context, []common.SHA256Output,
+) ([]db.ParentRecord, error) {
+	return nil, nil
+}
+
+func (*Conn) RetrieveCertificateParentsPage(context.Context, *common.SHA256Output, int,
+) ([]db.ParentRecord, error) {
+	return nil, nil
+}
+
+func (*Conn) RetrievePolicyParentsPage(context.Context, *common.SHA256Output, int,
+) ([]db.ParentRecord, error) {
+	return nil, nil
+}
+
+func (*Conn) EnqueueIngestJob(context.Context, *db.IngestJob, []db.IngestBatch) error {
+	return nil
+}
+
+func (*Conn) RetrieveIngestJob(context.Context, string) (*db.IngestJob, []db.IngestBatch, error) {
+	return nil, nil, nil
+}
+
+func (*Conn) ClaimIngestBatch(context.Context, string, string, time.Duration,
+) (*db.IngestBatch, error) {
+	return nil, nil
+}
+
+func (*Conn) RenewIngestBatchLease(context.Context, string, uint64, string, time.Duration) error {
+	return nil
+}
+
+func (*Conn) CompleteIngestBatch(context.Context, string, uint64, string) error {
+	return nil
+}
+
+func (*Conn) ClaimIngestFinalization(context.Context, string, string, time.Duration,
+) (bool, error) {
+	return false, nil
+}
+
+func (*Conn) RenewIngestFinalizationLease(context.Context, string, string, time.Duration) error {
+	return nil
+}
+
+func (*Conn) CompleteIngestFinalization(context.Context, string, string) error {
+	return nil
+}
@@ -8,6 +8,9 @@ import (
 	"math/rand"
 	"time"
 
+	ct "github.com/google/certificate-transparency-go"
+	"github.com/google/certificate-transparency-go/asn1"
+	cttls "github.com/google/certificate-transparency-go/tls"
 	ctx509 "github.com/google/certificate-transparency-go/x509"
 	"github.com/google/certificate-transparency-go/x509/pkix"
 
@@ -130,6 +133,64 @@ func RandomX509Cert(t tests.T, domain string) ctx509.Certificate {
 	return template
 }
 
+// RandomX509Precert creates a random precertificate, and its final certificate with a random
+// SCT. Both are parsed from their ASN.1 DER representation.
+func RandomX509Precert(t tests.T, domain string) (ctx509.Certificate, ctx509.Certificate) {
+	template := ctx509.Certificate{
+		SerialNumber: big.NewInt(randomSource.Int63()),
+		Subject: pkix.Name{
+			CommonName: domain,
+		},
+		DNSNames:  []string{domain},
+		NotBefore: RandomTimeWithoutMonotonicBounded(1900, 2000),
+		NotAfter:  RandomTimeWithoutMonotonicBounded(2200, 2300),
+		KeyUsage:  ctx509.KeyUsageKeyEncipherment | ctx509.KeyUsageDigitalSignature,
+	}
+	create := func(ext pkix.Extension) ctx509.Certificate {
+		template.ExtraExtensions = []pkix.Extension{ext}
+		derBytes, err := ctx509.CreateCertificate(
+			NewRandReader(),
+			&template,
+			&template,
+			&keyCreatingRandomCerts.PublicKey,
+			keyCreatingRandomCerts,
+		)
+		require.NoError(t, err)
+		cert, err := ctx509.ParseCertificate(derBytes)
+		require.NoError(t, err)
+		return *cert
+	}
+	precert := create(pkix.Extension{
+		Id:       ctx509.OIDExtensionCTPoison,
+		Critical: true,
+		Value:    []byte{0x05, 0x00}, // ASN.1 NULL.
+	})
+	sct, err := cttls.Marshal(ct.SignedCertificateTimestamp{
+		SCTVersion: ct.V1,
+		LogID:      ct.LogID{KeyID: ([32]byte)(RandomBytesForTest(t, 32))},
+		Timestamp:  uint64(randomSource.Int63()),
+		Signature: ct.DigitallySigned{
+			Algorithm: cttls.SignatureAndHashAlgorithm{
+				Hash:      cttls.SHA256,
+				Signature: cttls.ECDSA,
+			},
+			Signature: RandomBytesForTest(t, 64),
+		},
+	})
+	require.NoError(t, err)
+	sctList, err := cttls.Marshal(ctx509.SignedCertificateTimestampList{
+		SCTList: []ctx509.SerializedSCT{{Val: sct}},
+	})
+	require.NoError(t, err)
+	sctList, err = asn1.Marshal(sctList)
+	require.NoError(t, err)
+	final := create(pkix.Extension{
+		Id:    ctx509.OIDExtensionCTSCT,
+		Value: sctList,
+	})
+	return precert, final
+}
+
 // BuildTestRandomPolicyHierarchy creates two policy certificates for the given name.
 func BuildTestRandomPolicyHierarchy(t tests.T, domainName string) []common.PolicyDocument {
 	// Create two policy certificates for that name.
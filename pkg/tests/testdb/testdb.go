@@ -17,9 +17,14 @@ import (
 	"github.com/netsec-ethz/fpki/tools"
 )
 
-type Conn db.Conn
+// Conn is a connection to a MySQL test DB. Besides db.Conn, it gives access to the SQL DB for
+// the tests that check what is specific to MySQL.
+type Conn interface {
+	db.Conn
+	DB() *sql.DB
+}
 
-func Connect(t tests.T, config *db.Configuration) db.Conn {
+func Connect(t tests.T, config *db.Configuration) Conn {
 	conn, err := mysql.Connect(config)
 	require.NoError(t, err)
 	return conn
@@ -38,6 +43,14 @@ func ConfigureTestDB(t tests.T) (*db.Configuration, func()) {
 	require.NoError(t, err)
 	cancelF() // DB was created.
 
+	// Create its tables and procedures.
+	ctx, cancelF = context.WithTimeout(context.Background(), 30*time.Second)
+	conn := Connect(t, config)
+	_, err = mysql.Migrate(ctx, conn.DB(), 0)
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+	cancelF()
+
 	// Return the configuration and removal function.
 	removeFunc := func() {
 		ctx, cancelF := context.WithTimeout(context.Background(), 30*time.Second)
@@ -85,7 +98,7 @@ func configureTestDBOnly(t tests.T) (string, *db.Configuration) {
 	return dbName, config
 }
 
-// createTestDB creates a new and ready test DB with the same structure as the F-PKI one.
+// createTestDB creates a new and empty test DB.
 func createTestDB(ctx context.Context, dbName string) error {
 	// The create_schema script is embedded. Send it to the stdin of bash, and right after
 	// send a line with the invocation of the create_new_db function.
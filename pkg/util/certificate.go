@@ -125,6 +125,7 @@ func UnfoldCerts(leafCerts []ctx509.Certificate, chains [][]*ctx509.Certificate,
 // Additionally, if the payload of any of the ancestors of the certificate is nil, this function
 // interprets it as the ancestor is already present in the DB, and thus will omit returning it
 // and any posterior ancestors.
+// A certificate without chain is returned as root, as UnfoldCerts does.
 func UnfoldCert(leafCert *ctx509.Certificate, certID common.SHA256Output,
 	chain []*ctx509.Certificate, chainIDs []*common.SHA256Output,
 ) (
@@ -142,8 +143,12 @@ func UnfoldCert(leafCert *ctx509.Certificate, certID common.SHA256Output,
 	// Always add the leaf certificate.
 	certs = append(certs, *leafCert)
 	certIDs = append(certIDs, certID)
-	parentIDs = append(parentIDs, chainIDs[0])
 	names = append(names, ExtractCertDomains(leafCert))
+	if len(chainIDs) == 0 {
+		parentIDs = append(parentIDs, nil)
+		return
+	}
+	parentIDs = append(parentIDs, chainIDs[0])
 	// Add the intermediate certs iff their payload is not nil.
 	i := 0
 	for ; i < len(chain)-1; i++ {
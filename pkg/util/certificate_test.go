@@ -113,3 +113,17 @@ func TestUnfoldCerts(t *testing.T) {
 	assert.Equal(t, nilNames, names[2])                       // not a leaf
 	assert.Equal(t, nilNames, names[3])                       // not a leaf
 }
+
+func TestUnfoldCertWithoutChain(t *testing.T) {
+	a := ctx509.Certificate{
+		Raw:      []byte{0},
+		DNSNames: []string{"a.com"},
+	}
+	aID := common.SHA256Hash32Bytes(a.Raw)
+
+	certs, IDs, parentIDs, names := UnfoldCert(&a, aID, nil, nil)
+	require.Equal(t, []ctx509.Certificate{a}, certs)
+	require.Equal(t, []common.SHA256Output{aID}, IDs)
+	require.Equal(t, []*common.SHA256Output{nil}, parentIDs)
+	require.Equal(t, [][]string{{"a.com"}}, names)
+}
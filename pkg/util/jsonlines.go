@@ -0,0 +1,66 @@
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// JSONLinesWriter writes values as JSON objects, one per line, e.g. the records that could not
+// be processed, kept in a quarantine file to inspect and reprocess them later.
+// A JSONLinesWriter can be used concurrently.
+type JSONLinesWriter struct {
+	mu     sync.Mutex
+	enc    *json.Encoder
+	closer io.Closer
+}
+
+// NewJSONLinesWriter creates a writer that writes its values to w.
+func NewJSONLinesWriter(w io.Writer) *JSONLinesWriter {
+	return &JSONLinesWriter{
+		enc: json.NewEncoder(w),
+	}
+}
+
+// OpenJSONLinesFile creates a writer that appends its values to the file, creating it if needed.
+func OpenJSONLinesFile(filename string) (*JSONLinesWriter, error) {
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w := NewJSONLinesWriter(f)
+	w.closer = f
+	return w, nil
+}
+
+// Write writes the value as one line.
+func (w *JSONLinesWriter) Write(v any) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.enc.Encode(v)
+}
+
+// Close closes the file of the writer, if it was opened with OpenJSONLinesFile.
+func (w *JSONLinesWriter) Close() error {
+	if w.closer == nil {
+		return nil
+	}
+	return w.closer.Close()
+}
+
+// ReadJSONLines reads the values written by a JSONLinesWriter. On error, it returns the values
+// read until then.
+func ReadJSONLines[T any](r io.Reader) ([]T, error) {
+	var values []T
+	dec := json.NewDecoder(r)
+	for dec.More() {
+		var v T
+		if err := dec.Decode(&v); err != nil {
+			return values, fmt.Errorf("reading JSON lines: %w", err)
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
@@ -0,0 +1,40 @@
+package util_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/netsec-ethz/fpki/pkg/util"
+)
+
+func TestJSONLines(t *testing.T) {
+	type record struct {
+		Name  string `json:"name"`
+		Count int    `json:"count"`
+	}
+
+	// Values are appended to the file, also when opened again.
+	filename := filepath.Join(t.TempDir(), "records.jsonl")
+	for _, r := range []record{{"a", 1}, {"b", 2}} {
+		w, err := util.OpenJSONLinesFile(filename)
+		require.NoError(t, err)
+		require.NoError(t, w.Write(r))
+		require.NoError(t, w.Close())
+	}
+	data, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	require.Equal(t, "{\"name\":\"a\",\"count\":1}\n{\"name\":\"b\",\"count\":2}\n", string(data))
+
+	records, err := util.ReadJSONLines[record](bytes.NewReader(data))
+	require.NoError(t, err)
+	require.Equal(t, []record{{"a", 1}, {"b", 2}}, records)
+
+	// The values read before an error are returned.
+	records, err = util.ReadJSONLines[record](bytes.NewReader(append(data, "not json"...)))
+	require.Error(t, err)
+	require.Len(t, records, 2)
+}
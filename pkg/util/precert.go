@@ -0,0 +1,87 @@
+package util
+
+import (
+	"fmt"
+
+	ct "github.com/google/certificate-transparency-go"
+	"github.com/google/certificate-transparency-go/asn1"
+	ctx509 "github.com/google/certificate-transparency-go/x509"
+	"github.com/netsec-ethz/fpki/pkg/common"
+)
+
+// CertificateEntryType returns the type of the CT log entry of the certificate:
+// ct.PrecertLogEntryType if it is a precertificate, i.e. it has the poison extension, and
+// ct.X509LogEntryType otherwise.
+func CertificateEntryType(cert *ctx509.Certificate) ct.LogEntryType {
+	if cert.IsPrecertificate() {
+		return ct.PrecertLogEntryType
+	}
+	return ct.X509LogEntryType
+}
+
+// CertificateTBSID returns the SHA256 of the TBSCertificate of the certificate without the
+// poison and SCT list extensions. It is the same for a precertificate and its final
+// certificate, unless the precertificate was signed by a precertificate signing certificate,
+// whose issuer and key ID are not replaced.
+func CertificateTBSID(cert *ctx509.Certificate) (common.SHA256Output, error) {
+	tbs := cert.RawTBSCertificate
+	var err error
+	if cert.IsPrecertificate() {
+		tbs, err = ctx509.RemoveCTPoison(tbs)
+	} else if hasExtension(cert, ctx509.OIDExtensionCTSCT) {
+		tbs, err = ctx509.RemoveSCTList(tbs)
+	}
+	if err != nil {
+		return common.SHA256Output{}, fmt.Errorf("removing CT extensions: %w", err)
+	}
+	return common.SHA256Hash32Bytes(tbs), nil
+}
+
+// PrecertIssuerKeyHash returns the issuer key hash of the precertificate entry of a CT log
+// with the chain, as in RFC 6962 section 3.2: the SHA256 of the public key of the issuer,
+// which is the second certificate of the chain if the first one is a precertificate
+// signing certificate.
+func PrecertIssuerKeyHash(chain []*ctx509.Certificate) (common.SHA256Output, error) {
+	if len(chain) == 0 {
+		return common.SHA256Output{}, fmt.Errorf("precertificate without issuer")
+	}
+	issuer := chain[0]
+	if isPrecertSigningCert(issuer) {
+		if len(chain) < 2 {
+			return common.SHA256Output{}, fmt.Errorf(
+				"precertificate signing certificate without issuer")
+		}
+		issuer = chain[1]
+	}
+	return common.SHA256Hash32Bytes(issuer.RawSubjectPublicKeyInfo), nil
+}
+
+// isPrecertSigningCert returns true if the certificate has the CT extended key usage.
+func isPrecertSigningCert(cert *ctx509.Certificate) bool {
+	for _, eku := range cert.ExtKeyUsage {
+		if eku == ctx509.ExtKeyUsageCertificateTransparency {
+			return true
+		}
+	}
+	return false
+}
+
+func hasExtension(cert *ctx509.Certificate, oid asn1.ObjectIdentifier) bool {
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oid) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseCertificateTBSID parses the certificate and returns its entry type and TBS ID,
+// see CertificateEntryType and CertificateTBSID.
+func ParseCertificateTBSID(payload []byte) (ct.LogEntryType, common.SHA256Output, error) {
+	cert, err := ctx509.ParseCertificate(payload)
+	if ctx509.IsFatal(err) {
+		return 0, common.SHA256Output{}, err
+	}
+	tbsID, err := CertificateTBSID(cert)
+	return CertificateEntryType(cert), tbsID, err
+}
@@ -0,0 +1,63 @@
+package util_test
+
+import (
+	"testing"
+
+	ct "github.com/google/certificate-transparency-go"
+	ctx509 "github.com/google/certificate-transparency-go/x509"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netsec-ethz/fpki/pkg/common"
+	"github.com/netsec-ethz/fpki/pkg/tests/random"
+	"github.com/netsec-ethz/fpki/pkg/util"
+)
+
+func TestCertificateTBSID(t *testing.T) {
+	precert, final := random.RandomX509Precert(t, "a.com")
+	other := random.RandomX509Cert(t, "a.com")
+	parsed, err := ctx509.ParseCertificate(other.Raw)
+	require.NoError(t, err)
+	other = *parsed
+
+	require.Equal(t, ct.PrecertLogEntryType, util.CertificateEntryType(&precert))
+	require.Equal(t, ct.X509LogEntryType, util.CertificateEntryType(&final))
+	require.Equal(t, ct.X509LogEntryType, util.CertificateEntryType(&other))
+	require.NotEqual(t, precert.Raw, final.Raw)
+
+	// The precertificate and its final certificate have the same TBS ID.
+	precertID, err := util.CertificateTBSID(&precert)
+	require.NoError(t, err)
+	finalID, err := util.CertificateTBSID(&final)
+	require.NoError(t, err)
+	require.Equal(t, precertID, finalID)
+
+	// A certificate without CT extensions.
+	otherID, err := util.CertificateTBSID(&other)
+	require.NoError(t, err)
+	require.Equal(t, common.SHA256Hash32Bytes(other.RawTBSCertificate), otherID)
+	require.NotEqual(t, precertID, otherID)
+}
+
+func TestPrecertIssuerKeyHash(t *testing.T) {
+	issuer := random.RandomX509Cert(t, "issuer.com")
+	signing := random.RandomX509Cert(t, "signing.com")
+	signing.ExtKeyUsage = []ctx509.ExtKeyUsage{ctx509.ExtKeyUsageCertificateTransparency}
+	// Not the key of the issuer.
+	signing.RawSubjectPublicKeyInfo = []byte("precertificate signing key")
+	issuer.RawSubjectPublicKeyInfo = []byte("issuer key")
+	expected := common.SHA256Hash32Bytes([]byte("issuer key"))
+
+	hash, err := util.PrecertIssuerKeyHash([]*ctx509.Certificate{&issuer})
+	require.NoError(t, err)
+	require.Equal(t, expected, hash)
+
+	// Signed by a precertificate signing certificate.
+	hash, err = util.PrecertIssuerKeyHash([]*ctx509.Certificate{&signing, &issuer})
+	require.NoError(t, err)
+	require.Equal(t, expected, hash)
+
+	_, err = util.PrecertIssuerKeyHash(nil)
+	require.Error(t, err)
+	_, err = util.PrecertIssuerKeyHash([]*ctx509.Certificate{&signing})
+	require.Error(t, err)
+}